@@ -0,0 +1,231 @@
+// Package audit logs security-relevant events of 9P sessions: attaches,
+// authentication attempts, permission denials, removes and wstats. The log
+// is a stream of JSON events, one per line.
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+)
+
+// Event is a logged event.
+type Event struct {
+	Time time.Time `json:"time"`
+	// Event is one of attach, auth, denied, remove and wstat.
+	Event string `json:"event"`
+	// Op is the denied operation of a denied event, such as open.
+	Op      string `json:"op,omitempty"`
+	User    string `json:"user"`
+	Remote  string `json:"remote,omitempty"`
+	Service string `json:"service"`
+	Path    string `json:"path,omitempty"`
+	// Change describes the fields changed by a wstat, such as
+	// "mode=0644 name=new".
+	Change string `json:"change,omitempty"`
+	// Error is set if the operation failed.
+	Error string `json:"error,omitempty"`
+}
+
+type remoteCtxKey struct{}
+
+// WithRemote returns a context describing a session with the client at
+// addr, for the remote address of its events.
+func WithRemote(ctx context.Context, addr string) context.Context {
+	return context.WithValue(ctx, remoteCtxKey{}, addr)
+}
+
+// Remote returns the remote address of the session of ctx, if known.
+func Remote(ctx context.Context) string {
+	addr, _ := ctx.Value(remoteCtxKey{}).(string)
+	return addr
+}
+
+// fid is what is known about a fid of a session.
+type fid struct {
+	user    string
+	service string
+	path    string
+}
+
+// Logger is a fileserver.Interceptor logging the events of sessions. Each
+// context given to fileserver.Intercept is a session. It keeps track of the
+// paths of fids, so that events can name the files involved, until the
+// context of the session is done. Contexts should therefore be cancelled
+// when their connection closes, as those that never are keep their fids for
+// the life of the Logger.
+type Logger struct {
+	sync.Mutex
+	enc      *json.Encoder
+	err      error
+	sessions map[context.Context]map[protocol.Fid]fid
+}
+
+// NewLogger returns a Logger writing events to w. Each event is written with
+// a single call to Write.
+func NewLogger(w io.Writer) *Logger {
+	return &Logger{
+		enc:      json.NewEncoder(w),
+		sessions: make(map[context.Context]map[protocol.Fid]fid),
+	}
+}
+
+// Err returns the error that stopped logging, if any.
+func (l *Logger) Err() error {
+	l.Lock()
+	defer l.Unlock()
+	return l.err
+}
+
+// fids returns the fids of the session of ctx. Must be called with the
+// logger locked.
+func (l *Logger) fids(ctx context.Context) map[protocol.Fid]fid {
+	fids, ok := l.sessions[ctx]
+	if !ok {
+		fids = make(map[protocol.Fid]fid)
+		if ctx.Err() != nil {
+			// The session has ended, so there is nothing to keep.
+			return fids
+		}
+		l.sessions[ctx] = fids
+		if done := ctx.Done(); done != nil {
+			go func() {
+				<-done
+				l.Lock()
+				defer l.Unlock()
+				delete(l.sessions, ctx)
+			}()
+		}
+	}
+	return fids
+}
+
+// log writes an event. Once writing fails, logging stops, and Err returns
+// the error. Must be called with the logger locked.
+func (l *Logger) log(ctx context.Context, e Event, err error) {
+	if l.err != nil {
+		return
+	}
+	e.Time = time.Now()
+	e.Remote = Remote(ctx)
+	if err == fileserver.ErrPermission && e.Event != "denied" {
+		e.Op, e.Event = e.Event, "denied"
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	l.err = l.enc.Encode(&e)
+}
+
+// event returns an event about the file of f. Must be called with the logger
+// locked.
+func (l *Logger) event(ctx context.Context, typ string, f protocol.Fid) Event {
+	s := l.fids(ctx)[f]
+	return Event{Event: typ, User: s.user, Service: s.service, Path: s.path}
+}
+
+func (l *Logger) Handle(ctx context.Context, req protocol.Message, next fileserver.Next) (protocol.Message, error) {
+	resp, err := next(ctx, req)
+
+	l.Lock()
+	defer l.Unlock()
+	fids := l.fids(ctx)
+	switch r := req.(type) {
+	case *protocol.VersionRequest:
+		if err == nil {
+			// A new version starts the session over, without fids.
+			for k := range fids {
+				delete(fids, k)
+			}
+		}
+	case *protocol.AuthRequest:
+		l.log(ctx, Event{Event: "auth", User: r.Username, Service: r.Service}, err)
+	case *protocol.AttachRequest:
+		l.log(ctx, Event{Event: "attach", User: r.Username, Service: r.Service, Path: "/"}, err)
+		if err == nil {
+			fids[r.Fid] = fid{user: r.Username, service: r.Service, path: "/"}
+		}
+	case *protocol.WalkRequest:
+		if err == fileserver.ErrPermission {
+			e := l.event(ctx, "denied", r.Fid)
+			e.Op = "walk"
+			e.Path = path.Join(append([]string{e.Path}, r.Names...)...)
+			l.log(ctx, e, err)
+		}
+		if wr, ok := resp.(*protocol.WalkResponse); ok && err == nil && len(wr.Qids) == len(r.Names) {
+			f := fids[r.Fid]
+			f.path = path.Join(append([]string{f.path}, r.Names...)...)
+			fids[r.NewFid] = f
+		}
+	case *protocol.OpenRequest:
+		if err == fileserver.ErrPermission {
+			e := l.event(ctx, "denied", r.Fid)
+			e.Op = "open"
+			l.log(ctx, e, err)
+		}
+	case *protocol.CreateRequest:
+		if err == fileserver.ErrPermission {
+			e := l.event(ctx, "denied", r.Fid)
+			e.Op = "create"
+			e.Path = path.Join(e.Path, r.Name)
+			l.log(ctx, e, err)
+		}
+		if err == nil {
+			f := fids[r.Fid]
+			f.path = path.Join(f.path, r.Name)
+			fids[r.Fid] = f
+		}
+	case *protocol.RemoveRequest:
+		l.log(ctx, l.event(ctx, "remove", r.Fid), err)
+		delete(fids, r.Fid)
+	case *protocol.WriteStatRequest:
+		e := l.event(ctx, "wstat", r.Fid)
+		e.Change = change(r.Stat)
+		l.log(ctx, e, err)
+		if err == nil && r.Stat.Name != "" {
+			// Names containing slashes are moves, relative to the parent
+			// directory.
+			f := fids[r.Fid]
+			f.path = path.Join(path.Dir(f.path), r.Stat.Name)
+			fids[r.Fid] = f
+		}
+	case *protocol.ClunkRequest:
+		delete(fids, r.Fid)
+	}
+	return resp, err
+}
+
+// change describes the fields of a wstat that are not "don't touch" values.
+func change(st protocol.Stat) string {
+	var c []string
+	if st.Name != "" {
+		c = append(c, "name="+st.Name)
+	}
+	if st.Mode != ^protocol.FileMode(0) {
+		c = append(c, fmt.Sprintf("mode=%#o", uint32(st.Mode)))
+	}
+	if st.Length != ^uint64(0) {
+		c = append(c, fmt.Sprintf("length=%d", st.Length))
+	}
+	if st.Mtime != ^uint32(0) {
+		c = append(c, fmt.Sprintf("mtime=%d", st.Mtime))
+	}
+	if st.UID != "" {
+		c = append(c, "uid="+st.UID)
+	}
+	if st.GID != "" {
+		c = append(c, "gid="+st.GID)
+	}
+	if len(c) == 0 {
+		return "sync"
+	}
+	return strings.Join(c, " ")
+}
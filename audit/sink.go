@@ -0,0 +1,16 @@
+package audit
+
+import (
+	"io"
+	"os"
+)
+
+// OpenSink opens the sink named by spec for a Logger: "syslog" logs to the
+// local syslog daemon, and anything else is a file that events are appended
+// to.
+func OpenSink(spec string) (io.WriteCloser, error) {
+	if spec == "syslog" {
+		return openSyslog()
+	}
+	return os.OpenFile(spec, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+}
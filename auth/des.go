@@ -0,0 +1,112 @@
+package auth
+
+import (
+	"crypto/des"
+)
+
+// The Plan 9 authentication protocols use DES with 56 bit keys, applied in
+// the peculiar overlapping fashion of encrypt(2) so that messages need not
+// be multiples of the block size.
+
+const (
+	// DESKeyLen is the length of a Plan 9 DES key.
+	DESKeyLen = 7
+	// ANameLen is the length of names in authentication messages.
+	ANameLen = 28
+	// DomLen is the length of authentication domains.
+	DomLen = 48
+	// ChalLen is the length of challenges.
+	ChalLen = 8
+)
+
+// des56to64 spreads a 56 bit key over the 8 bytes DES expects, leaving the
+// parity bits clear.
+func des56to64(k56 []byte) []byte {
+	var v uint64
+	for _, b := range k56[:DESKeyLen] {
+		v = v<<8 | uint64(b)
+	}
+	k64 := make([]byte, 8)
+	for i := range k64 {
+		k64[i] = byte(v>>uint(56-7*(i+1))) << 1
+	}
+	return k64
+}
+
+// encrypt encrypts buf in place, as encrypt(2) does.
+func encrypt(key, buf []byte) {
+	if len(buf) < 8 {
+		return
+	}
+	c, err := des.NewCipher(des56to64(key))
+	if err != nil {
+		panic(err)
+	}
+	n := len(buf) - 1
+	r := n % 7
+	n /= 7
+	off := 0
+	for i := 0; i < n; i++ {
+		c.Encrypt(buf[off:off+8], buf[off:off+8])
+		off += 7
+	}
+	if r != 0 {
+		off = off - 7 + r
+		c.Encrypt(buf[off:off+8], buf[off:off+8])
+	}
+}
+
+// decrypt is the inverse of encrypt.
+func decrypt(key, buf []byte) {
+	if len(buf) < 8 {
+		return
+	}
+	c, err := des.NewCipher(des56to64(key))
+	if err != nil {
+		panic(err)
+	}
+	n := len(buf) - 1
+	r := n % 7
+	n /= 7
+	off := n * 7
+	if r != 0 {
+		o := off - 7 + r
+		c.Decrypt(buf[o:o+8], buf[o:o+8])
+	}
+	for i := 0; i < n; i++ {
+		off -= 7
+		c.Decrypt(buf[off:off+8], buf[off:off+8])
+	}
+}
+
+// PassToKey converts a password to a DES key, as passtokey(2) does.
+func PassToKey(password string) []byte {
+	buf := make([]byte, ANameLen)
+	for i := 0; i < 8; i++ {
+		buf[i] = ' '
+	}
+	n := len(password)
+	if n >= ANameLen {
+		n = ANameLen - 1
+	}
+	copy(buf, password[:n])
+	buf[n] = 0
+
+	key := make([]byte, DESKeyLen)
+	t := buf
+	for {
+		for i := 0; i < DESKeyLen; i++ {
+			key[i] = (t[i] >> uint(i)) + (t[i+1] << uint(8-(i+1)))
+		}
+		if n <= 8 {
+			return key
+		}
+		n -= 8
+		t = t[8:]
+		if n < 8 {
+			t = buf[len(buf)-len(t)-(8-n):]
+			n = 8
+		}
+		encrypt(key, t[:8])
+	}
+}
@@ -0,0 +1,275 @@
+package auth
+
+import (
+	"errors"
+	"io/ioutil"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrNoKey = errors.New("no key matches")
+)
+
+// Attr is a single attribute of a key, in factotum notation. Secret
+// attributes are written with a leading '!', and are never displayed.
+type Attr struct {
+	Name   string
+	Value  string
+	Secret bool
+	// Query is set for attributes of the form "name?", which match any key
+	// that has the attribute.
+	Query bool
+}
+
+func (a Attr) String() string {
+	switch {
+	case a.Query:
+		return a.Name + "?"
+	case a.Secret:
+		return "!" + a.Name + "?"
+	case a.Value == "":
+		return a.Name
+	default:
+		return a.Name + "=" + quote(a.Value)
+	}
+}
+
+// Attrs is an ordered list of attributes.
+type Attrs []Attr
+
+// Get returns the value of the named attribute.
+func (as Attrs) Get(name string) (string, bool) {
+	for _, a := range as {
+		if a.Name == name {
+			return a.Value, true
+		}
+	}
+	return "", false
+}
+
+// Public returns the attributes without secrets.
+func (as Attrs) Public() Attrs {
+	var r Attrs
+	for _, a := range as {
+		if !a.Secret {
+			r = append(r, a)
+		}
+	}
+	return r
+}
+
+// Match reports whether the attributes satisfy a query. Every attribute of
+// the query must be present, and must have the same value unless it is a
+// query attribute.
+func (as Attrs) Match(query Attrs) bool {
+	for _, q := range query {
+		v, ok := as.Get(q.Name)
+		if !ok {
+			return false
+		}
+		if !q.Query && q.Value != "" && q.Value != v {
+			return false
+		}
+	}
+	return true
+}
+
+func (as Attrs) String() string {
+	s := make([]string, len(as))
+	for i, a := range as {
+		s[i] = a.String()
+	}
+	return strings.Join(s, " ")
+}
+
+// quote quotes a value in the style of Plan 9's quote(2) if necessary.
+func quote(s string) string {
+	if s != "" && !strings.ContainsAny(s, " \t\n'=") {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
+
+// tokenize splits a line into fields, honouring Plan 9 style single quotes.
+func tokenize(s string) ([]string, error) {
+	var fields []string
+	var cur []rune
+	inField, quoted := false, false
+	rs := []rune(s)
+	for i := 0; i < len(rs); i++ {
+		r := rs[i]
+		switch {
+		case quoted && r == '\'':
+			if i+1 < len(rs) && rs[i+1] == '\'' {
+				cur = append(cur, '\'')
+				i++
+			} else {
+				quoted = false
+			}
+		case quoted:
+			cur = append(cur, r)
+		case r == '\'':
+			quoted, inField = true, true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inField {
+				fields = append(fields, string(cur))
+				cur, inField = nil, false
+			}
+		default:
+			cur = append(cur, r)
+			inField = true
+		}
+	}
+	if quoted {
+		return nil, errors.New("unterminated quote")
+	}
+	if inField {
+		fields = append(fields, string(cur))
+	}
+	return fields, nil
+}
+
+// ParseAttrs parses a list of attributes, such as
+// "proto=pass user=glenda !password=secret".
+func ParseAttrs(s string) (Attrs, error) {
+	fields, err := tokenize(s)
+	if err != nil {
+		return nil, err
+	}
+	var as Attrs
+	for _, f := range fields {
+		var a Attr
+		if strings.HasPrefix(f, "!") {
+			a.Secret = true
+			f = f[1:]
+		}
+		if idx := strings.Index(f, "="); idx != -1 {
+			a.Name, a.Value = f[:idx], f[idx+1:]
+		} else if strings.HasSuffix(f, "?") {
+			a.Name, a.Query = f[:len(f)-1], true
+		} else {
+			a.Name = f
+		}
+		if a.Name == "" {
+			return nil, errors.New("empty attribute name")
+		}
+		as = append(as, a)
+	}
+	return as, nil
+}
+
+// Key is a set of attributes describing a credential.
+type Key struct {
+	Attrs Attrs
+}
+
+// Proto returns the protocol of the key.
+func (k *Key) Proto() string {
+	p, _ := k.Attrs.Get("proto")
+	return p
+}
+
+// String formats the key with secrets hidden.
+func (k *Key) String() string {
+	return "key " + k.Attrs.String()
+}
+
+// Keyring is a set of keys.
+type Keyring struct {
+	sync.RWMutex
+	keys []*Key
+}
+
+// Add adds a key. A key with identical public attributes is replaced.
+func (kr *Keyring) Add(attrs Attrs) error {
+	if _, ok := attrs.Get("proto"); !ok {
+		return errors.New("key has no proto attribute")
+	}
+	kr.Lock()
+	defer kr.Unlock()
+	pub := attrs.Public().String()
+	for i, k := range kr.keys {
+		if k.Attrs.Public().String() == pub {
+			kr.keys[i] = &Key{Attrs: attrs}
+			return nil
+		}
+	}
+	kr.keys = append(kr.keys, &Key{Attrs: attrs})
+	return nil
+}
+
+// Delete removes all keys matching the query, returning the number of keys
+// removed.
+func (kr *Keyring) Delete(query Attrs) int {
+	kr.Lock()
+	defer kr.Unlock()
+	var keep []*Key
+	for _, k := range kr.keys {
+		if !k.Attrs.Match(query) {
+			keep = append(keep, k)
+		}
+	}
+	n := len(kr.keys) - len(keep)
+	kr.keys = keep
+	return n
+}
+
+// Find returns the first key matching the query.
+func (kr *Keyring) Find(query Attrs) (*Key, error) {
+	kr.RLock()
+	defer kr.RUnlock()
+	for _, k := range kr.keys {
+		if k.Attrs.Match(query) {
+			return k, nil
+		}
+	}
+	return nil, ErrNoKey
+}
+
+// Keys returns all keys.
+func (kr *Keyring) Keys() []*Key {
+	kr.RLock()
+	defer kr.RUnlock()
+	return append([]*Key(nil), kr.keys...)
+}
+
+// Replace replaces all keys with those of another keyring.
+func (kr *Keyring) Replace(other *Keyring) {
+	keys := other.Keys()
+	kr.Lock()
+	defer kr.Unlock()
+	kr.keys = keys
+}
+
+func NewKeyring() *Keyring {
+	return &Keyring{}
+}
+
+// LoadKeys reads a keyring from a file of lines of the form "key attrs", as
+// written to the ctl file of factotum. Empty lines and lines starting with
+// '#' are ignored.
+func LoadKeys(path string) (*Keyring, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	kr := NewKeyring()
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !strings.HasPrefix(line, "key ") {
+			return nil, errors.New("malformed key line: " + line)
+		}
+		attrs, err := ParseAttrs(line[4:])
+		if err != nil {
+			return nil, err
+		}
+		if err := kr.Add(attrs); err != nil {
+			return nil, err
+		}
+	}
+	return kr, nil
+}
@@ -0,0 +1,466 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// Message types of the Plan 9 authentication protocols.
+const (
+	AuthTreq = 1
+	AuthOK   = 4
+	AuthErr  = 5
+	AuthTs   = 64
+	AuthTc   = 65
+	AuthAs   = 66
+	AuthAc   = 67
+)
+
+// Message lengths of the Plan 9 authentication protocols.
+const (
+	TicketReqLen = 3*ANameLen + ChalLen + DomLen + 1
+	TicketLen    = ChalLen + 2*ANameLen + DESKeyLen + 1
+	AuthentLen   = 1 + ChalLen + 4
+
+	// AuthPort is the port of the Plan 9 ticket service.
+	AuthPort = "567"
+	errMax   = 64
+)
+
+// TicketReq asks the authentication server for a pair of tickets.
+type TicketReq struct {
+	Type    byte
+	AuthID  string
+	AuthDom string
+	Chal    [ChalLen]byte
+	HostID  string
+	UID     string
+}
+
+func putString(b []byte, s string) {
+	for i := range b {
+		b[i] = 0
+	}
+	copy(b[:len(b)-1], s)
+}
+
+func getString(b []byte) string {
+	if idx := bytes.IndexByte(b, 0); idx != -1 {
+		b = b[:idx]
+	}
+	return string(b)
+}
+
+func (tr *TicketReq) Marshal() []byte {
+	b := make([]byte, TicketReqLen)
+	b[0] = tr.Type
+	p := b[1:]
+	putString(p[:ANameLen], tr.AuthID)
+	p = p[ANameLen:]
+	putString(p[:DomLen], tr.AuthDom)
+	p = p[DomLen:]
+	copy(p[:ChalLen], tr.Chal[:])
+	p = p[ChalLen:]
+	putString(p[:ANameLen], tr.HostID)
+	p = p[ANameLen:]
+	putString(p[:ANameLen], tr.UID)
+	return b
+}
+
+func (tr *TicketReq) Unmarshal(b []byte) error {
+	if len(b) < TicketReqLen {
+		return errors.New("short ticket request")
+	}
+	tr.Type = b[0]
+	p := b[1:]
+	tr.AuthID = getString(p[:ANameLen])
+	p = p[ANameLen:]
+	tr.AuthDom = getString(p[:DomLen])
+	p = p[DomLen:]
+	copy(tr.Chal[:], p[:ChalLen])
+	p = p[ChalLen:]
+	tr.HostID = getString(p[:ANameLen])
+	p = p[ANameLen:]
+	tr.UID = getString(p[:ANameLen])
+	return nil
+}
+
+// Ticket grants a client access to a server, and carries the session key.
+type Ticket struct {
+	Type byte
+	Chal [ChalLen]byte
+	Cuid string
+	Suid string
+	Key  [DESKeyLen]byte
+}
+
+// Marshal encodes and encrypts the ticket with key.
+func (t *Ticket) Marshal(key []byte) []byte {
+	b := make([]byte, TicketLen)
+	b[0] = t.Type
+	p := b[1:]
+	copy(p[:ChalLen], t.Chal[:])
+	p = p[ChalLen:]
+	putString(p[:ANameLen], t.Cuid)
+	p = p[ANameLen:]
+	putString(p[:ANameLen], t.Suid)
+	p = p[ANameLen:]
+	copy(p[:DESKeyLen], t.Key[:])
+	encrypt(key, b)
+	return b
+}
+
+// Unmarshal decrypts the ticket with key and decodes it.
+func (t *Ticket) Unmarshal(key, b []byte) error {
+	if len(b) < TicketLen {
+		return errors.New("short ticket")
+	}
+	b = append([]byte(nil), b[:TicketLen]...)
+	decrypt(key, b)
+	t.Type = b[0]
+	p := b[1:]
+	copy(t.Chal[:], p[:ChalLen])
+	p = p[ChalLen:]
+	t.Cuid = getString(p[:ANameLen])
+	p = p[ANameLen:]
+	t.Suid = getString(p[:ANameLen])
+	p = p[ANameLen:]
+	copy(t.Key[:], p[:DESKeyLen])
+	return nil
+}
+
+// Authenticator proves possession of the session key.
+type Authenticator struct {
+	Type byte
+	Chal [ChalLen]byte
+	ID   uint32
+}
+
+func (a *Authenticator) Marshal(key []byte) []byte {
+	b := make([]byte, AuthentLen)
+	b[0] = a.Type
+	copy(b[1:1+ChalLen], a.Chal[:])
+	binary.LittleEndian.PutUint32(b[1+ChalLen:], a.ID)
+	encrypt(key, b)
+	return b
+}
+
+func (a *Authenticator) Unmarshal(key, b []byte) error {
+	if len(b) < AuthentLen {
+		return errors.New("short authenticator")
+	}
+	b = append([]byte(nil), b[:AuthentLen]...)
+	decrypt(key, b)
+	a.Type = b[0]
+	copy(a.Chal[:], b[1:1+ChalLen])
+	a.ID = binary.LittleEndian.Uint32(b[1+ChalLen:])
+	return nil
+}
+
+// GetTickets requests a ticket pair from the authentication server at addr.
+// The client ticket is decrypted with key, while the server ticket is
+// returned as is, to be forwarded to the server.
+func GetTickets(addr string, tr *TicketReq, key []byte) (*Ticket, []byte, error) {
+	conn, err := net.DialTimeout("tcp", addr, 30*time.Second)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write(tr.Marshal()); err != nil {
+		return nil, nil, err
+	}
+
+	var status [1]byte
+	if _, err := io.ReadFull(conn, status[:]); err != nil {
+		return nil, nil, err
+	}
+	switch status[0] {
+	case AuthOK:
+	case AuthErr:
+		msg := make([]byte, errMax)
+		io.ReadFull(conn, msg)
+		return nil, nil, errors.New(getString(msg))
+	default:
+		return nil, nil, errors.New("bad reply from authentication server")
+	}
+
+	b := make([]byte, 2*TicketLen)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return nil, nil, err
+	}
+
+	var t Ticket
+	if err := t.Unmarshal(key, b[:TicketLen]); err != nil {
+		return nil, nil, err
+	}
+	if t.Type != AuthTc || t.Chal != tr.Chal {
+		return nil, nil, errors.New("password mismatch with authentication server")
+	}
+	return &t, b[TicketLen:], nil
+}
+
+// p9sk1 is the Plan 9 shared key protocol. Keys have the form
+//
+//	proto=p9sk1 user=name dom=domain !password=secret
+//
+// where !hex may be given instead of !password, holding the 7 byte key in
+// hexadecimal. Clients reach the authentication server named by the auth
+// attribute, or the authentication domain itself if there is none.
+//
+// The client writes a challenge, reads a ticket request, writes a ticket and
+// authenticator, and reads the authenticator of the server. The server does
+// the opposite.
+type p9sk1 struct{}
+
+func (p9sk1) Name() string {
+	return "p9sk1"
+}
+
+func desKey(k *Key) ([]byte, error) {
+	if h, ok := k.Attrs.Get("hex"); ok {
+		b, err := hex.DecodeString(h)
+		if err != nil || len(b) != DESKeyLen {
+			return nil, errors.New("malformed hex key")
+		}
+		return b, nil
+	}
+	if pw, ok := k.Attrs.Get("password"); ok {
+		return PassToKey(pw), nil
+	}
+	return nil, errors.New("key has neither password nor hex")
+}
+
+func (p9sk1) Start(kr *Keyring, role string, attrs Attrs) (Conv, error) {
+	query := append(Attrs{{Name: "user", Query: true}, {Name: "dom", Query: true}}, withoutRole(attrs)...)
+	k, err := kr.Find(query)
+	if err != nil {
+		return nil, err
+	}
+	key, err := desKey(k)
+	if err != nil {
+		return nil, err
+	}
+	user, _ := k.Attrs.Get("user")
+	dom, _ := k.Attrs.Get("dom")
+
+	var chal [ChalLen]byte
+	if _, err := rand.Read(chal[:]); err != nil {
+		return nil, err
+	}
+
+	switch role {
+	case "server":
+		return &p9sk1Server{user: user, dom: dom, key: key, schal: chal}, nil
+	case "client", "":
+		authsrv, ok := k.Attrs.Get("auth")
+		if !ok {
+			authsrv = dom
+		}
+		if !strings.Contains(authsrv, ":") {
+			authsrv = net.JoinHostPort(authsrv, AuthPort)
+		}
+		return &p9sk1Client{user: user, dom: dom, key: key, authsrv: authsrv, cchal: chal}, nil
+	default:
+		return nil, ErrBadRole
+	}
+}
+
+// need accumulates writes until n bytes are available.
+func need(buf *[]byte, p []byte, n int) ([]byte, bool) {
+	*buf = append(*buf, p...)
+	if len(*buf) < n {
+		return nil, false
+	}
+	b := (*buf)[:n]
+	*buf = nil
+	return b, true
+}
+
+const (
+	stateChal = iota
+	stateTicketReq
+	stateTicket
+	stateAuthenticator
+	stateDone
+)
+
+type p9sk1Server struct {
+	user, dom string
+	key       []byte
+	schal     [ChalLen]byte
+	cchal     [ChalLen]byte
+	state     int
+	buf       []byte
+	ticket    Ticket
+}
+
+func (c *p9sk1Server) Write(p []byte) error {
+	switch c.state {
+	case stateChal:
+		b, ok := need(&c.buf, p, ChalLen)
+		if !ok {
+			return nil
+		}
+		copy(c.cchal[:], b)
+		c.state = stateTicketReq
+		return nil
+	case stateTicket:
+		b, ok := need(&c.buf, p, TicketLen+AuthentLen)
+		if !ok {
+			return nil
+		}
+		var t Ticket
+		if err := t.Unmarshal(c.key, b[:TicketLen]); err != nil {
+			return err
+		}
+		if t.Type != AuthTs || t.Chal != c.schal {
+			return ErrAuthFailed
+		}
+		var a Authenticator
+		if err := a.Unmarshal(t.Key[:], b[TicketLen:]); err != nil {
+			return err
+		}
+		if a.Type != AuthAc || a.Chal != c.schal {
+			return ErrAuthFailed
+		}
+		c.ticket = t
+		c.state = stateAuthenticator
+		return nil
+	case stateDone:
+		return ErrDone
+	default:
+		return ErrPhase
+	}
+}
+
+func (c *p9sk1Server) Read() ([]byte, error) {
+	switch c.state {
+	case stateTicketReq:
+		tr := TicketReq{
+			Type:    AuthTreq,
+			AuthID:  c.user,
+			AuthDom: c.dom,
+			Chal:    c.schal,
+		}
+		c.state = stateTicket
+		return tr.Marshal(), nil
+	case stateAuthenticator:
+		a := Authenticator{Type: AuthAs, Chal: c.cchal}
+		c.state = stateDone
+		return a.Marshal(c.ticket.Key[:]), nil
+	case stateDone:
+		return nil, ErrDone
+	default:
+		return nil, ErrPhase
+	}
+}
+
+func (c *p9sk1Server) Done() bool {
+	return c.state == stateDone
+}
+
+func (c *p9sk1Server) AuthInfo() *AuthInfo {
+	if c.state != stateDone {
+		return nil
+	}
+	return &AuthInfo{Cuid: c.ticket.Cuid, Suid: c.ticket.Suid, Secret: c.ticket.Key[:]}
+}
+
+type p9sk1Client struct {
+	user, dom string
+	key       []byte
+	authsrv   string
+	cchal     [ChalLen]byte
+	state     int
+	buf       []byte
+	ticket    *Ticket
+	tickets   []byte
+}
+
+func (c *p9sk1Client) Read() ([]byte, error) {
+	switch c.state {
+	case stateChal:
+		c.state = stateTicketReq
+		return c.cchal[:], nil
+	case stateTicket:
+		c.state = stateAuthenticator
+		return c.tickets, nil
+	case stateDone:
+		return nil, ErrDone
+	default:
+		return nil, ErrPhase
+	}
+}
+
+func (c *p9sk1Client) Write(p []byte) error {
+	switch c.state {
+	case stateTicketReq:
+		b, ok := need(&c.buf, p, TicketReqLen)
+		if !ok {
+			return nil
+		}
+		var tr TicketReq
+		if err := tr.Unmarshal(b); err != nil {
+			return err
+		}
+		if tr.Type != AuthTreq {
+			return errors.New("bad ticket request")
+		}
+		if tr.AuthDom != c.dom {
+			return ErrNoKey
+		}
+		tr.HostID = c.user
+		tr.UID = c.user
+
+		t, sticket, err := GetTickets(c.authsrv, &tr, c.key)
+		if err != nil {
+			return err
+		}
+		a := Authenticator{Type: AuthAc, Chal: tr.Chal}
+		c.ticket = t
+		c.tickets = append(sticket, a.Marshal(t.Key[:])...)
+		c.state = stateTicket
+		return nil
+	case stateAuthenticator:
+		b, ok := need(&c.buf, p, AuthentLen)
+		if !ok {
+			return nil
+		}
+		var a Authenticator
+		if err := a.Unmarshal(c.ticket.Key[:], b); err != nil {
+			return err
+		}
+		if a.Type != AuthAs || a.Chal != c.cchal {
+			return ErrAuthFailed
+		}
+		c.state = stateDone
+		return nil
+	case stateDone:
+		return ErrDone
+	default:
+		return ErrPhase
+	}
+}
+
+func (c *p9sk1Client) Done() bool {
+	return c.state == stateDone
+}
+
+func (c *p9sk1Client) AuthInfo() *AuthInfo {
+	if c.state != stateDone {
+		return nil
+	}
+	return &AuthInfo{Cuid: c.ticket.Cuid, Suid: c.ticket.Suid, Secret: c.ticket.Key[:]}
+}
+
+func init() {
+	Register(p9sk1{})
+}
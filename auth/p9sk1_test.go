@@ -0,0 +1,169 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatalf("bad test data %q: %v", s, err)
+	}
+	return b
+}
+
+// TestDESBlock encrypts the worked example of the DES standard, with the key
+// 133457799BBCDFF1 given as the 56 bits Plan 9 keys hold.
+func TestDESBlock(t *testing.T) {
+	key := unhex(t, "12695bc9b7b7f8")
+	buf := unhex(t, "0123456789abcdef")
+	encrypt(key, buf)
+	if want := unhex(t, "85e813540f0ab405"); !bytes.Equal(buf, want) {
+		t.Fatalf("encrypted block is %x, expected %x", buf, want)
+	}
+	decrypt(key, buf)
+	if want := unhex(t, "0123456789abcdef"); !bytes.Equal(buf, want) {
+		t.Fatalf("decrypted block is %x, expected %x", buf, want)
+	}
+}
+
+// The expected values below were computed with the C passtokey and encrypt
+// of Plan 9, built against the DES of OpenSSL.
+
+func TestPassToKey(t *testing.T) {
+	tests := []struct {
+		password string
+		key      string
+	}{
+		{"", "00100804028140"},
+		{"glenda", "6776d94d0e0340"},
+		{"password", "f0f07c7e7fcbc9"},
+		{"a longer password!", "f7c34053f2935d"},
+		{"this password is longer than twenty-eight bytes", "ff4cb1eb78e8b0"},
+	}
+
+	for _, tt := range tests {
+		if got := PassToKey(tt.password); hex.EncodeToString(got) != tt.key {
+			t.Errorf("PassToKey(%q) = %x, expected %s", tt.password, got, tt.key)
+		}
+	}
+}
+
+func TestEncrypt(t *testing.T) {
+	key := PassToKey("glenda")
+	tests := []struct {
+		n    int
+		want string
+	}{
+		{TicketLen, "51162cad5fa17d866e955b5fb1552260338ce1fccec8bf1a2f76220692fc32ca0b8f222aa2f58a71df75f433a983ffc4f408953509323918ac10457812e27b55cd89fba5dc6dd724"},
+		{AuthentLen, "51162cad5fab7b555b68479e2b"},
+	}
+
+	for _, tt := range tests {
+		buf := make([]byte, tt.n)
+		for i := range buf {
+			buf[i] = byte(i)
+		}
+		encrypt(key, buf)
+		if got := hex.EncodeToString(buf); got != tt.want {
+			t.Errorf("encrypting %d bytes gave %s, expected %s", tt.n, got, tt.want)
+		}
+		decrypt(key, buf)
+		for i := range buf {
+			if buf[i] != byte(i) {
+				t.Errorf("decrypting %d bytes gave %x", tt.n, buf)
+				break
+			}
+		}
+	}
+}
+
+func TestTicket(t *testing.T) {
+	key := PassToKey("glenda")
+	in := Ticket{
+		Type: AuthTs,
+		Chal: [ChalLen]byte{1, 2, 3, 4, 5, 6, 7, 8},
+		Cuid: "glenda",
+		Suid: "bootes",
+		Key:  [DESKeyLen]byte{9, 10, 11, 12, 13, 14, 15},
+	}
+	b := in.Marshal(key)
+	if len(b) != TicketLen {
+		t.Fatalf("ticket is %d bytes, expected %d", len(b), TicketLen)
+	}
+
+	var out Ticket
+	if err := out.Unmarshal(key, b); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if out != in {
+		t.Fatalf("ticket came back as %+v, expected %+v", out, in)
+	}
+
+	// Decrypting with the wrong key garbles the ticket.
+	if err := out.Unmarshal(PassToKey("bootes"), b); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if out == in {
+		t.Fatal("ticket decrypted with the wrong key")
+	}
+	if err := out.Unmarshal(key, b[:TicketLen-1]); err == nil {
+		t.Fatal("short ticket accepted")
+	}
+}
+
+func TestAuthenticator(t *testing.T) {
+	key := [DESKeyLen]byte{9, 10, 11, 12, 13, 14, 15}
+	in := Authenticator{
+		Type: AuthAc,
+		Chal: [ChalLen]byte{8, 7, 6, 5, 4, 3, 2, 1},
+		ID:   0x01020304,
+	}
+	b := in.Marshal(key[:])
+	if len(b) != AuthentLen {
+		t.Fatalf("authenticator is %d bytes, expected %d", len(b), AuthentLen)
+	}
+
+	var out Authenticator
+	if err := out.Unmarshal(key[:], b); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if out != in {
+		t.Fatalf("authenticator came back as %+v, expected %+v", out, in)
+	}
+	if err := out.Unmarshal(key[:], b[:AuthentLen-1]); err == nil {
+		t.Fatal("short authenticator accepted")
+	}
+}
+
+func TestTicketReq(t *testing.T) {
+	in := TicketReq{
+		Type:    AuthTreq,
+		AuthID:  "bootes",
+		AuthDom: "plan9",
+		Chal:    [ChalLen]byte{1, 2, 3, 4, 5, 6, 7, 8},
+		HostID:  "bootes",
+		UID:     "glenda",
+	}
+	b := in.Marshal()
+	if len(b) != TicketReqLen {
+		t.Fatalf("ticket request is %d bytes, expected %d", len(b), TicketReqLen)
+	}
+
+	var out TicketReq
+	if err := out.Unmarshal(b); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if out != in {
+		t.Fatalf("ticket request came back as %+v, expected %+v", out, in)
+	}
+}
+
+// TestLengths checks the message lengths against those of authsrv.h.
+func TestLengths(t *testing.T) {
+	if TicketReqLen != 141 || TicketLen != 72 || AuthentLen != 13 {
+		t.Fatalf("lengths are %d, %d and %d, expected 141, 72 and 13", TicketReqLen, TicketLen, AuthentLen)
+	}
+}
@@ -0,0 +1,68 @@
+package auth
+
+// pass is the trivial protocol of Plan 9's factotum: in the client role, a
+// single read returns the user and password of the matching key, quoted.
+type pass struct{}
+
+type passConv struct {
+	key  *Key
+	done bool
+}
+
+func (pass) Name() string {
+	return "pass"
+}
+
+func (pass) Start(kr *Keyring, role string, attrs Attrs) (Conv, error) {
+	if role != "" && role != "client" {
+		return nil, ErrBadRole
+	}
+	query := append(Attrs{{Name: "user", Query: true}, {Name: "password", Query: true}}, attrs...)
+	k, err := kr.Find(withoutRole(query))
+	if err != nil {
+		return nil, err
+	}
+	return &passConv{key: k}, nil
+}
+
+func (c *passConv) Read() ([]byte, error) {
+	if c.done {
+		return nil, ErrDone
+	}
+	c.done = true
+	user, _ := c.key.Attrs.Get("user")
+	password, _ := c.key.Attrs.Get("password")
+	return []byte(quote(user) + " " + quote(password)), nil
+}
+
+func (c *passConv) Write([]byte) error {
+	return ErrPhase
+}
+
+func (c *passConv) Done() bool {
+	return c.done
+}
+
+func (c *passConv) AuthInfo() *AuthInfo {
+	if !c.done {
+		return nil
+	}
+	user, _ := c.key.Attrs.Get("user")
+	return &AuthInfo{Cuid: user, Suid: user}
+}
+
+// withoutRole strips the role attribute, which describes the conversation
+// rather than the key.
+func withoutRole(attrs Attrs) Attrs {
+	var r Attrs
+	for _, a := range attrs {
+		if a.Name != "role" {
+			r = append(r, a)
+		}
+	}
+	return r
+}
+
+func init() {
+	Register(pass{})
+}
@@ -0,0 +1,100 @@
+package auth
+
+import (
+	"errors"
+	"sort"
+	"sync"
+)
+
+// DefaultProto is the protocol used for 9P authentication when none is
+// configured.
+const DefaultProto = "p9sk1"
+
+var (
+	// ErrPhase is returned by a conversation when asked to read when it
+	// expects a write, or the other way around.
+	ErrPhase = errors.New("phase error")
+	// ErrDone is returned when the conversation is already complete.
+	ErrDone       = errors.New("conversation done")
+	ErrNoProto    = errors.New("unknown protocol")
+	ErrBadRole    = errors.New("unsupported role")
+	ErrAuthFailed = errors.New("authentication failed")
+)
+
+// AuthInfo describes the outcome of a successful authentication.
+type AuthInfo struct {
+	// Cuid is the user on the client side, and Suid the user on the server
+	// side.
+	Cuid string
+	Suid string
+	// Secret is a session secret shared by the two parties, if the protocol
+	// establishes one.
+	Secret []byte
+}
+
+// Conv is a single run of an authentication protocol. The caller alternates
+// between Read, which produces a message for the peer, and Write, which
+// consumes a message from the peer, as dictated by the protocol.
+type Conv interface {
+	Read() ([]byte, error)
+	Write([]byte) error
+	Done() bool
+	AuthInfo() *AuthInfo
+}
+
+// Proto is an authentication protocol.
+type Proto interface {
+	Name() string
+	// Start begins a conversation in the given role, using keys from the
+	// keyring that match the attributes.
+	Start(kr *Keyring, role string, attrs Attrs) (Conv, error)
+}
+
+var (
+	protoLock sync.RWMutex
+	protos    = make(map[string]Proto)
+)
+
+// Register makes a protocol available by name.
+func Register(p Proto) {
+	protoLock.Lock()
+	defer protoLock.Unlock()
+	protos[p.Name()] = p
+}
+
+// Lookup returns the named protocol.
+func Lookup(name string) (Proto, error) {
+	protoLock.RLock()
+	defer protoLock.RUnlock()
+	p, ok := protos[name]
+	if !ok {
+		return nil, ErrNoProto
+	}
+	return p, nil
+}
+
+// Protos returns the names of all registered protocols.
+func Protos() []string {
+	protoLock.RLock()
+	defer protoLock.RUnlock()
+	var names []string
+	for name := range protos {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Start begins a conversation for the protocol named by the proto attribute.
+func Start(kr *Keyring, attrs Attrs) (Conv, error) {
+	name, ok := attrs.Get("proto")
+	if !ok {
+		return nil, errors.New("no proto attribute")
+	}
+	role, _ := attrs.Get("role")
+	p, err := Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	return p.Start(kr, role, attrs)
+}
@@ -1,27 +1,69 @@
 package main
 
 import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"os"
+	"path"
+	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/chzyer/readline"
-	"github.com/kennylevinsen/g9ptools/convenience"
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/auth"
+	"github.com/kennylevinsen/g9ptools/client"
+	"github.com/kennylevinsen/g9ptools/transport"
 )
 
 func main() {
 	loop := true
-	if len(os.Args) < 4 {
+	keyfile := flag.String("keys", "", "authenticate with the keys in file")
+	cache := flag.String("cache", "none", "cache mode: none, loose or strict")
+	readahead := flag.Int("readahead", 4, "reads to keep in flight when reading sequentially")
+	writebehind := flag.Int("writebehind", 0, "size of the buffer for writes sent in the background")
+	window := flag.Int("window", client.DefaultWindow, "reads or writes to keep in flight by get and put")
+	flag.Parse()
+
+	if flag.NArg() < 3 {
 		fmt.Printf("Too few arguments\n")
 		return
 	}
 
-	addr := os.Args[1]
-	user := os.Args[2]
-	service := os.Args[3]
+	addr := flag.Arg(0)
+	user := flag.Arg(1)
+	service := flag.Arg(2)
+
+	network, address, err := transport.ParseDialString(addr)
+	if err != nil {
+		fmt.Printf("Invalid address: %v\n", err)
+		return
+	}
+
+	c := client.NewConn(func() (io.ReadWriteCloser, error) {
+		return transport.Dial(network, address)
+	}, user, service)
+	if c.Cache, err = client.ParseCacheMode(*cache); err != nil {
+		fmt.Printf("Invalid cache mode: %v\n", err)
+		return
+	}
+	c.Readahead = *readahead
+	c.WriteBehind = *writebehind
+	c.Window = *window
+	if *keyfile != "" {
+		keys, err := auth.LoadKeys(*keyfile)
+		if err != nil {
+			fmt.Printf("Unable to load keys: %v\n", err)
+			return
+		}
+		c.Keys = keys
+	}
 
-	c := &convenience.Client{}
-	err := c.Dial("tcp", addr, user, service)
+	err = c.Connect()
 	if err != nil {
 		fmt.Printf("Connect failed: %v\n", err)
 		return
@@ -33,33 +75,88 @@ func main() {
 			if s == "" {
 				s = "/"
 			}
-			strs, err := c.List(s)
+			stats, err := c.ReadDir(s)
 			if err != nil {
 				fmt.Printf("ls failed: %v\n", err)
 				return
 			}
+			var strs []string
+			for _, st := range stats {
+				if st.Mode&protocol.DMDIR != 0 {
+					strs = append(strs, st.Name+"/")
+				} else {
+					strs = append(strs, st.Name)
+				}
+			}
 			fmt.Printf("%v\n", strs)
 		},
 		"cat": func(s string) {
-			strs, err := c.Read(s)
+			b, err := c.ReadFile(s)
 			if err != nil {
 				fmt.Printf("cat failed: %v\n", err)
 				return
 			}
-			fmt.Printf("%v\n", strs)
+			fmt.Printf("%s\n", b)
 		},
-		"get": func(string) {
-			fmt.Printf("get is not yet implemented\n")
+		"get": func(s string) {
+			args := strings.Fields(s)
+			if len(args) != 2 {
+				fmt.Printf("usage: get remote local\n")
+				return
+			}
+			n, err := get(c, args[0], args[1])
+			if err != nil {
+				fmt.Printf("get failed: %v\n", err)
+				return
+			}
+			fmt.Printf("%d bytes\n", n)
 		},
-		"put": func(string) {
-			fmt.Printf("put is not yet implemented\n")
+		"put": func(s string) {
+			args := strings.Fields(s)
+			if len(args) != 2 {
+				fmt.Printf("usage: put local remote\n")
+				return
+			}
+			n, err := put(c, args[0], args[1])
+			if err != nil {
+				fmt.Printf("put failed: %v\n", err)
+				return
+			}
+			fmt.Printf("%d bytes\n", n)
+		},
+		"find": func(s string) {
+			idx := strings.Index(s, " ")
+			if idx == -1 {
+				fmt.Printf("usage: find dir [glob|regex] pattern\n")
+				return
+			}
+			b, err := find(c, s[:idx], s[idx+1:])
+			if err != nil {
+				fmt.Printf("find failed: %v\n", err)
+				return
+			}
+			fmt.Printf("%s", b)
+		},
+		"untar": func(s string) {
+			args := strings.Fields(s)
+			if len(args) != 2 {
+				fmt.Printf("usage: untar remotedir localdir\n")
+				return
+			}
+			n, err := untar(c, args[0], args[1])
+			if err != nil {
+				fmt.Printf("untar failed: %v\n", err)
+				return
+			}
+			fmt.Printf("%d files\n", n)
 		},
 		"mkdir": func(s string) {
-			err := c.Create(s, true)
+			f, err := c.Create(s, protocol.DMDIR|0755, protocol.OREAD)
 			if err != nil {
 				fmt.Printf("mkdir failed: %v\n", err)
 				return
 			}
+			f.Close()
 		},
 		"rm": func(s string) {
 			err := c.Remove(s)
@@ -123,3 +220,122 @@ func main() {
 		f(args)
 	}
 }
+
+// get copies a remote file to a local one. The copy keeps several reads in
+// flight, as io.Copy uses the WriteTo of the remote file.
+func get(c *client.Conn, remote, local string) (int64, error) {
+	f, err := c.Open(remote, protocol.OREAD)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	out, err := os.Create(local)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(out, f)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return n, err
+}
+
+// put copies a local file to a remote one, truncating it if it exists. The
+// copy keeps several writes in flight, as io.Copy uses the ReadFrom of the
+// remote file.
+func put(c *client.Conn, local, remote string) (int64, error) {
+	in, err := os.Open(local)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+
+	f, err := c.Open(remote, protocol.OWRITE|protocol.OTRUNC)
+	if err != nil {
+		if f, err = c.Create(remote, 0644, protocol.OWRITE); err != nil {
+			return 0, err
+		}
+	}
+	n, err := io.Copy(f, in)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return n, err
+}
+
+// untar fetches a remote directory as a tarball, as served by servers
+// supporting package tarstream, and extracts it to a local directory.
+func untar(c *client.Conn, remote, local string) (int, error) {
+	name := path.Clean(remote)
+	if name == "/" {
+		name = "/.tar"
+	} else {
+		name += ".tar"
+	}
+	f, err := c.Open(name, protocol.OREAD)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	if err := os.MkdirAll(local, 0755); err != nil {
+		return 0, err
+	}
+
+	var files int
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return files, err
+		}
+		if !filepath.IsLocal(hdr.Name) {
+			return files, errors.New("invalid name in tarball: " + hdr.Name)
+		}
+		p := filepath.Join(local, filepath.FromSlash(hdr.Name))
+		mode := os.FileMode(hdr.Mode).Perm()
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(p, mode|0700); err != nil {
+				return files, err
+			}
+		case tar.TypeReg:
+			out, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+			if err != nil {
+				return files, err
+			}
+			_, err = io.Copy(out, tr)
+			if cerr := out.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				return files, err
+			}
+			files++
+		default:
+			continue
+		}
+		os.Chtimes(p, time.Now(), hdr.ModTime)
+	}
+}
+
+// find searches a remote directory on the server, as served by servers
+// supporting package findfs, returning the matching paths.
+func find(c *client.Conn, dir, query string) ([]byte, error) {
+	f, err := c.Open(path.Join(dir, ".find", "query"), protocol.ORDWR)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err := f.Write([]byte(query)); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	_, err = f.WriteTo(&buf)
+	return buf.Bytes(), err
+}
@@ -0,0 +1,244 @@
+package client
+
+import (
+	"errors"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kennylevinsen/g9p/protocol"
+)
+
+// CacheMode selects what a connection caches.
+type CacheMode int
+
+const (
+	// CacheNone sends every operation to the server.
+	CacheNone CacheMode = iota
+	// CacheLoose serves stats and directory listings from the cache for
+	// CacheTTL without asking the server, and read data for as long as the
+	// version of the file seen at open is unchanged.
+	CacheLoose
+	// CacheStrict validates every use of the cache against the version of
+	// the file on the server. Directory listings and read data are reused
+	// only if the qid returned by open is unchanged, and stats are not
+	// cached, as checking one costs as much as fetching it.
+	CacheStrict
+)
+
+const (
+	// DefaultCacheTTL is how long a loose cache trusts stats and directory
+	// listings if Conn.CacheTTL is zero.
+	DefaultCacheTTL = 3 * time.Second
+	// DefaultCacheSize is the amount of read data cached if Conn.CacheSize
+	// is zero.
+	DefaultCacheSize = 64 * 1024 * 1024
+)
+
+var ErrUnknownCacheMode = errors.New("unknown cache mode")
+
+// ParseCacheMode parses "none", "loose" or "strict".
+func ParseCacheMode(s string) (CacheMode, error) {
+	switch s {
+	case "none", "":
+		return CacheNone, nil
+	case "loose":
+		return CacheLoose, nil
+	case "strict":
+		return CacheStrict, nil
+	default:
+		return CacheNone, ErrUnknownCacheMode
+	}
+}
+
+func (m CacheMode) String() string {
+	switch m {
+	case CacheNone:
+		return "none"
+	case CacheLoose:
+		return "loose"
+	case CacheStrict:
+		return "strict"
+	default:
+		return "unknown"
+	}
+}
+
+type cachedStat struct {
+	st      protocol.Stat
+	expires time.Time
+}
+
+type cachedDir struct {
+	qid     protocol.Qid
+	stats   []protocol.Stat
+	expires time.Time
+}
+
+// cachedData is read data of a version of a file, by the offset it was read
+// at. Readers that read sequentially with the same buffer size, such as
+// ReadFile, hit the same offsets again.
+type cachedData struct {
+	version uint32
+	blocks  map[int64][]byte
+}
+
+// cache holds stats and directory listings by path, and read data by qid
+// path, which survives renames. It is dropped on reconnect, as a restarted
+// server may reuse qids.
+type cache struct {
+	sync.Mutex
+	stats map[string]cachedStat
+	dirs  map[string]cachedDir
+	data  map[uint64]*cachedData
+	size  int
+}
+
+// cacheKey returns the key of a path relative to the root of the service.
+func cacheKey(name string) string {
+	return path.Clean("/" + name)
+}
+
+// fidKey returns the key of a remembered fid path.
+func fidKey(names []string) string {
+	return "/" + strings.Join(names, "/")
+}
+
+// cacheable reports whether the content of a file may be cached. Append-only
+// and exclusive files are usually streams or locks, whose reads are not
+// repeatable.
+func cacheable(q protocol.Qid) bool {
+	return q.Type&(protocol.QTDIR|protocol.QTAPPEND|protocol.QTEXCL|protocol.QTAUTH) == 0
+}
+
+func (c *cache) reset() {
+	c.Lock()
+	defer c.Unlock()
+	c.stats, c.dirs, c.data, c.size = nil, nil, nil, 0
+}
+
+func (c *cache) stat(key string) (protocol.Stat, bool) {
+	c.Lock()
+	defer c.Unlock()
+	e, ok := c.stats[key]
+	if !ok || time.Now().After(e.expires) {
+		return protocol.Stat{}, false
+	}
+	return e.st, true
+}
+
+func (c *cache) storeStat(key string, st protocol.Stat, ttl time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	if c.stats == nil {
+		c.stats = make(map[string]cachedStat)
+	}
+	c.stats[key] = cachedStat{st: st, expires: time.Now().Add(ttl)}
+}
+
+// dir returns a cached listing. If q is nil, the listing must not have
+// expired, otherwise it must be of the same version of the directory.
+func (c *cache) dir(key string, q *protocol.Qid) ([]protocol.Stat, bool) {
+	c.Lock()
+	defer c.Unlock()
+	e, ok := c.dirs[key]
+	if !ok {
+		return nil, false
+	}
+	if q == nil && time.Now().After(e.expires) {
+		return nil, false
+	}
+	if q != nil && (q.Path != e.qid.Path || q.Version != e.qid.Version) {
+		return nil, false
+	}
+	return e.stats, true
+}
+
+func (c *cache) storeDir(key string, q protocol.Qid, stats []protocol.Stat, ttl time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	if c.dirs == nil {
+		c.dirs = make(map[string]cachedDir)
+	}
+	c.dirs[key] = cachedDir{qid: q, stats: stats, expires: time.Now().Add(ttl)}
+}
+
+// validate drops read data of older versions of a file.
+func (c *cache) validate(q protocol.Qid) {
+	c.Lock()
+	defer c.Unlock()
+	if e, ok := c.data[q.Path]; ok && e.version != q.Version {
+		c.dropData(q.Path)
+	}
+}
+
+func (c *cache) read(q protocol.Qid, p []byte, off int64) (int, bool) {
+	c.Lock()
+	defer c.Unlock()
+	e, ok := c.data[q.Path]
+	if !ok || e.version != q.Version {
+		return 0, false
+	}
+	b, ok := e.blocks[off]
+	if !ok {
+		return 0, false
+	}
+	return copy(p, b), true
+}
+
+// storeData caches a read, evicting other files once more than limit bytes
+// are cached.
+func (c *cache) storeData(q protocol.Qid, b []byte, off int64, limit int) {
+	c.Lock()
+	defer c.Unlock()
+	if len(b) > limit {
+		return
+	}
+	if c.data == nil {
+		c.data = make(map[uint64]*cachedData)
+	}
+	e, ok := c.data[q.Path]
+	if !ok || e.version != q.Version {
+		c.dropData(q.Path)
+		e = &cachedData{version: q.Version, blocks: make(map[int64][]byte)}
+		c.data[q.Path] = e
+	}
+	if old, ok := e.blocks[off]; ok {
+		c.size -= len(old)
+	}
+	e.blocks[off] = append([]byte(nil), b...)
+	c.size += len(b)
+
+	for qpath := range c.data {
+		if c.size <= limit {
+			break
+		}
+		if qpath != q.Path {
+			c.dropData(qpath)
+		}
+	}
+}
+
+// dropData drops the read data of a file. Must be called with the cache
+// locked.
+func (c *cache) dropData(qpath uint64) {
+	if e, ok := c.data[qpath]; ok {
+		for _, b := range e.blocks {
+			c.size -= len(b)
+		}
+		delete(c.data, qpath)
+	}
+}
+
+// invalidate drops what is cached about a file changed by this client: its
+// data, its stat, and the listing of its parent, which holds a copy of the
+// stat.
+func (c *cache) invalidate(key string, qpath uint64) {
+	c.Lock()
+	defer c.Unlock()
+	c.dropData(qpath)
+	delete(c.stats, key)
+	delete(c.dirs, key)
+	delete(c.dirs, path.Dir(key))
+}
@@ -0,0 +1,438 @@
+// Package client is a 9P client that survives transport failures. When the
+// connection to the server is lost, it dials again, attaches again, and
+// walks and opens every fid still in use to where it was, under the same fid
+// number. Operations that are safe to repeat, such as reads, are retried on
+// the new connection, so users of the package see a server restart as a
+// pause rather than an error.
+package client
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kennylevinsen/g9p"
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/auth"
+	"github.com/kennylevinsen/g9ptools/transport"
+)
+
+const (
+	DefaultMaxSize = 128 * 1024
+	Version        = "9P2000"
+	// DefaultRetries is the number of reconnection attempts used when
+	// Conn.Retries is zero.
+	DefaultRetries = 10
+	// DefaultBackoff is the initial delay between reconnection attempts
+	// used when Conn.Backoff is zero. It doubles with every attempt, up to
+	// maxBackoff.
+	DefaultBackoff = 100 * time.Millisecond
+	maxBackoff     = 10 * time.Second
+	// DefaultWindow is the number of reads or writes kept in flight by
+	// copies if Conn.Window is zero.
+	DefaultWindow = 8
+)
+
+var (
+	ErrClosed          = errors.New("connection closed")
+	ErrDisconnected    = errors.New("connection lost")
+	ErrUnknownProtocol = errors.New("unknown protocol")
+	ErrNoSuchFile      = errors.New("no such file")
+	ErrNotADirectory   = errors.New("not a directory")
+	// ErrReconnected is returned by operations that cannot safely be
+	// repeated, such as creates and removes, when the connection was lost
+	// while they were in flight. Whether they took effect is unknown.
+	ErrReconnected = errors.New("connection lost during operation")
+)
+
+// rootFid is the fid the service is attached to.
+const rootFid protocol.Fid = 0
+
+// Conn is a connection to a service, reconnecting as needed. Its exported
+// fields must be set before Connect is called.
+type Conn struct {
+	// Keys enables authentication when set, using AuthProto, or
+	// auth.DefaultProto if unset.
+	Keys      *auth.Keyring
+	AuthProto string
+	// Retries is the number of reconnection attempts made after the
+	// connection is lost, DefaultRetries if zero. A negative value
+	// disables reconnection.
+	Retries int
+	// Backoff is the initial delay between reconnection attempts,
+	// DefaultBackoff if zero.
+	Backoff time.Duration
+	// Cache selects what is cached, CacheNone by default. CacheTTL and
+	// CacheSize default to DefaultCacheTTL and DefaultCacheSize.
+	Cache     CacheMode
+	CacheTTL  time.Duration
+	CacheSize int
+	// Readahead is the number of reads kept in flight ahead of a file
+	// being read sequentially, or zero to disable readahead. Only enable it
+	// for services whose files can be read at any offset.
+	Readahead int
+	// WriteBehind is the size of the buffer writes to a file are collected
+	// in before being sent in the background, or zero to send writes as
+	// they are made. Errors of background writes are returned by a later
+	// Write, Sync or Close.
+	WriteBehind int
+	// Window is the number of reads or writes kept in flight when copying
+	// a file with WriteTo or ReadFrom, DefaultWindow if zero.
+	Window int
+
+	sync.Mutex
+	dial    func() (io.ReadWriteCloser, error)
+	user    string
+	service string
+	c       *g9p.Client
+	rwc     io.ReadWriteCloser
+	broken  chan struct{}
+	msize   uint32
+	fids    map[protocol.Fid]*Fid
+	nextFid protocol.Fid
+	closed  bool
+	cache   cache
+}
+
+// watchConn notices the failure of a transport, closing broken once reads or
+// writes fail.
+type watchConn struct {
+	io.ReadWriteCloser
+	once   sync.Once
+	broken chan struct{}
+}
+
+func (w *watchConn) fail() {
+	w.once.Do(func() { close(w.broken) })
+}
+
+func (w *watchConn) Read(p []byte) (int, error) {
+	n, err := w.ReadWriteCloser.Read(p)
+	if err != nil {
+		w.fail()
+	}
+	return n, err
+}
+
+func (w *watchConn) Write(p []byte) (int, error) {
+	n, err := w.ReadWriteCloser.Write(p)
+	if err != nil {
+		w.fail()
+	}
+	return n, err
+}
+
+// NewConn returns a connection to service as user, using dial to establish
+// the transport, initially and whenever the connection is lost. Connect
+// must be called before the connection is used.
+func NewConn(dial func() (io.ReadWriteCloser, error), user, service string) *Conn {
+	return &Conn{
+		dial:    dial,
+		user:    user,
+		service: service,
+		fids:    make(map[protocol.Fid]*Fid),
+		nextFid: rootFid + 1,
+	}
+}
+
+// Dial connects to service as user at a network address, as dialed by
+// transport.Dial.
+func Dial(network, address, user, service string) (*Conn, error) {
+	c := NewConn(func() (io.ReadWriteCloser, error) {
+		return transport.Dial(network, address)
+	}, user, service)
+	if err := c.Connect(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Connect establishes the connection.
+func (c *Conn) Connect() error {
+	c.Lock()
+	defer c.Unlock()
+	return c.connect()
+}
+
+// connect dials and attaches. Must be called with the connection locked.
+func (c *Conn) connect() error {
+	rwc, err := c.dial()
+	if err != nil {
+		return err
+	}
+	w := &watchConn{ReadWriteCloser: rwc, broken: make(chan struct{})}
+	gc := g9p.NewClient(w)
+	go func() {
+		gc.Start()
+		w.fail()
+	}()
+
+	if err := c.setup(gc); err != nil {
+		gc.Stop()
+		rwc.Close()
+		return err
+	}
+	c.c, c.rwc, c.broken = gc, rwc, w.broken
+	return nil
+}
+
+// setup negotiates the session and attaches the root fid.
+func (c *Conn) setup(gc *g9p.Client) error {
+	vresp, err := gc.Version(&protocol.VersionRequest{
+		Tag:     protocol.NOTAG,
+		MaxSize: DefaultMaxSize,
+		Version: Version,
+	})
+	if err != nil {
+		return err
+	}
+	if vresp.Version != Version {
+		return ErrUnknownProtocol
+	}
+	c.msize = vresp.MaxSize
+
+	afid := protocol.NOFID
+	if c.Keys != nil {
+		if afid, err = c.authenticate(gc); err != nil {
+			return err
+		}
+		defer gc.Clunk(&protocol.ClunkRequest{Tag: gc.NextTag(), Fid: afid})
+	}
+
+	_, err = gc.Attach(&protocol.AttachRequest{
+		Tag:      gc.NextTag(),
+		Fid:      rootFid,
+		AuthFid:  afid,
+		Username: c.user,
+		Service:  c.service,
+	})
+	return err
+}
+
+// authenticate runs the client side of the authentication protocol over a
+// new auth fid, which is returned on success.
+func (c *Conn) authenticate(gc *g9p.Client) (protocol.Fid, error) {
+	proto := c.AuthProto
+	if proto == "" {
+		proto = auth.DefaultProto
+	}
+	conv, err := auth.Start(c.Keys, auth.Attrs{
+		{Name: "proto", Value: proto},
+		{Name: "role", Value: "client"},
+	})
+	if err != nil {
+		return protocol.NOFID, err
+	}
+
+	afid := c.allocFid()
+	clunk := func() { gc.Clunk(&protocol.ClunkRequest{Tag: gc.NextTag(), Fid: afid}) }
+	_, err = gc.Auth(&protocol.AuthRequest{
+		Tag:      gc.NextTag(),
+		AuthFid:  afid,
+		Username: c.user,
+		Service:  c.service,
+	})
+	if err != nil {
+		return protocol.NOFID, err
+	}
+
+	for !conv.Done() {
+		b, err := conv.Read()
+		if err == auth.ErrPhase {
+			var rresp *protocol.ReadResponse
+			rresp, err = gc.Read(&protocol.ReadRequest{Tag: gc.NextTag(), Fid: afid, Count: c.msize - 9})
+			if err == nil && len(rresp.Data) == 0 {
+				err = auth.ErrAuthFailed
+			}
+			if err == nil {
+				err = conv.Write(rresp.Data)
+			}
+		} else if err == nil {
+			_, err = gc.Write(&protocol.WriteRequest{Tag: gc.NextTag(), Fid: afid, Data: b})
+		}
+		if err != nil {
+			clunk()
+			return protocol.NOFID, err
+		}
+	}
+	return afid, nil
+}
+
+// allocFid returns an unused fid number. Must be called with the connection
+// locked.
+func (c *Conn) allocFid() protocol.Fid {
+	for {
+		f := c.nextFid
+		c.nextFid++
+		if f == protocol.NOFID || f == rootFid {
+			continue
+		}
+		if _, ok := c.fids[f]; !ok {
+			return f
+		}
+	}
+}
+
+// current returns the client of the current connection, and the channel
+// closed when it fails. If an earlier reconnection failed, it is tried
+// again.
+func (c *Conn) current() (*g9p.Client, chan struct{}, error) {
+	c.Lock()
+	defer c.Unlock()
+	if c.closed {
+		return nil, nil, ErrClosed
+	}
+	if c.c == nil {
+		if err := c.redial(); err != nil {
+			return nil, nil, err
+		}
+	}
+	return c.c, c.broken, nil
+}
+
+// do runs fn on the current connection. If the connection fails, it
+// reconnects, and retries fn once if it is idempotent.
+func (c *Conn) do(idempotent bool, fn func(gc *g9p.Client) error) error {
+	for attempt := 0; ; attempt++ {
+		gc, broken, err := c.current()
+		if err != nil {
+			return err
+		}
+		err = fn(gc)
+		if err == nil {
+			return nil
+		}
+
+		select {
+		case <-broken:
+		default:
+			// The server answered with an error.
+			return err
+		}
+		if rerr := c.reconnect(broken); rerr != nil {
+			return rerr
+		}
+		if !idempotent {
+			return ErrReconnected
+		}
+		if attempt > 0 {
+			return err
+		}
+	}
+}
+
+// reconnect replaces the connection that failed, as signalled by broken,
+// unless another caller already did.
+func (c *Conn) reconnect(broken chan struct{}) error {
+	c.Lock()
+	defer c.Unlock()
+	if c.closed {
+		return ErrClosed
+	}
+	if c.broken != broken {
+		return nil
+	}
+
+	c.c.Stop()
+	c.rwc.Close()
+	c.c = nil
+	return c.redial()
+}
+
+// redial connects again, backing off between attempts, and walks and opens
+// the fids in use again. Fids that cannot be restored fail their future
+// operations. Must be called with the connection locked.
+func (c *Conn) redial() error {
+	retries := c.Retries
+	if retries == 0 {
+		retries = DefaultRetries
+	}
+	if retries < 0 {
+		return ErrDisconnected
+	}
+	backoff := c.Backoff
+	if backoff == 0 {
+		backoff = DefaultBackoff
+	}
+
+	var err error
+	for attempt := 0; attempt < retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+		}
+		if err = c.connect(); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	c.cache.reset()
+	for _, f := range c.fids {
+		f.err = f.restore(c.c)
+	}
+	return nil
+}
+
+// Close closes the connection. Fids need not be clunked first.
+func (c *Conn) Close() error {
+	c.Lock()
+	defer c.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	if c.c != nil {
+		c.c.Stop()
+		c.c = nil
+	}
+	if c.rwc != nil {
+		return c.rwc.Close()
+	}
+	return nil
+}
+
+// MaxSize returns the negotiated maximum message size.
+func (c *Conn) MaxSize() uint32 {
+	c.Lock()
+	defer c.Unlock()
+	return c.msize
+}
+
+func (c *Conn) cacheTTL() time.Duration {
+	if c.CacheTTL == 0 {
+		return DefaultCacheTTL
+	}
+	return c.CacheTTL
+}
+
+func (c *Conn) window() int {
+	if c.Window <= 0 {
+		return DefaultWindow
+	}
+	return c.Window
+}
+
+func (c *Conn) cacheSize() int {
+	if c.CacheSize == 0 {
+		return DefaultCacheSize
+	}
+	return c.CacheSize
+}
+
+// splitPath splits a slash-separated path into the names to walk.
+func splitPath(p string) []string {
+	var names []string
+	for _, s := range strings.Split(p, "/") {
+		if s != "" && s != "." {
+			names = append(names, s)
+		}
+	}
+	return names
+}
@@ -0,0 +1,168 @@
+package client
+
+import (
+	"io"
+
+	"github.com/kennylevinsen/g9p/protocol"
+)
+
+// WriteTo copies the file from the current offset to w, keeping Window reads
+// in flight, rather than waiting for each read before sending the next. On
+// a link with high latency, this is what makes a copy run at the speed of
+// the link. It is used by io.Copy.
+func (f *File) WriteTo(w io.Writer) (int64, error) {
+	f.Lock()
+	defer f.Unlock()
+	if err := f.flush(true); err != nil {
+		return 0, err
+	}
+	f.ahead = nil
+
+	if !cacheable(f.Qid()) {
+		// Streams may not be read ahead of what has been consumed.
+		return f.copyOut(w)
+	}
+
+	var written int64
+	size := int(f.IOUnit())
+	var inflight []*readahead
+	defer func() {
+		for _, r := range inflight {
+			<-r.done
+		}
+	}()
+
+	next := f.offset
+	for {
+		for len(inflight) < f.c.window() {
+			inflight = append(inflight, f.readAsync(next, size))
+			next += int64(size)
+		}
+
+		r := inflight[0]
+		inflight = inflight[1:]
+		<-r.done
+		if r.err != nil {
+			return written, r.err
+		}
+		if len(r.data) == 0 {
+			return written, nil
+		}
+
+		n, err := w.Write(r.data)
+		written += int64(n)
+		f.offset += int64(n)
+		if err != nil {
+			return written, err
+		}
+
+		if len(r.data) < r.size {
+			// A short read before the end of the file leaves the reads
+			// in flight at the wrong offsets, so start again after it.
+			for _, r := range inflight {
+				<-r.done
+			}
+			inflight = nil
+			next = f.offset
+		}
+	}
+}
+
+// copyOut copies the file to w one read at a time. Must be called with the
+// file locked.
+func (f *File) copyOut(w io.Writer) (int64, error) {
+	var written int64
+	b := make([]byte, f.IOUnit())
+	for {
+		n, err := f.readAt(b, f.offset)
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+		n, err = w.Write(b[:n])
+		written += int64(n)
+		f.offset += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+// ReadFrom copies r to the file at the current offset, keeping Window writes
+// in flight. Append-only files are written one write at a time, as the
+// order of their writes matters. It is used by io.Copy.
+func (f *File) ReadFrom(r io.Reader) (int64, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.ahead = nil
+	if err := f.flush(true); err != nil {
+		return 0, err
+	}
+
+	window := f.c.window()
+	if f.Qid().Type&protocol.QTAPPEND != 0 {
+		window = 1
+	}
+
+	type result struct {
+		n   int
+		err error
+	}
+	size := int(f.IOUnit())
+	bufs := make(chan []byte, window)
+	for i := 0; i < window; i++ {
+		bufs <- make([]byte, size)
+	}
+	results := make(chan result, window)
+
+	var (
+		read, written int64
+		pending       int
+		err           error
+	)
+	collect := func() {
+		res := <-results
+		pending--
+		written += int64(res.n)
+		if res.err != nil && err == nil {
+			err = res.err
+		}
+	}
+
+	for err == nil {
+		var b []byte
+		select {
+		case b = <-bufs:
+		default:
+			collect()
+			continue
+		}
+
+		n, rerr := io.ReadFull(r, b)
+		if n > 0 {
+			pending++
+			go func(b []byte, off int64) {
+				n, err := f.writeAt(b, off)
+				bufs <- b[:cap(b)]
+				results <- result{n, err}
+			}(b[:n], f.offset+read)
+			read += int64(n)
+		} else {
+			bufs <- b
+		}
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			break
+		}
+		if rerr != nil {
+			err = rerr
+		}
+	}
+	for pending > 0 {
+		collect()
+	}
+
+	f.offset += written
+	return written, err
+}
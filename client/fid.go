@@ -0,0 +1,339 @@
+package client
+
+import (
+	"github.com/kennylevinsen/g9p"
+	"github.com/kennylevinsen/g9p/protocol"
+)
+
+// Fid is a fid of a connection. The connection remembers where it was walked
+// to and how it was opened, so that it can be restored after reconnecting.
+// A Fid must be clunked once no longer needed.
+type Fid struct {
+	c   *Conn
+	fid protocol.Fid
+
+	// The following are guarded by the lock of the connection.
+	path   []string
+	qid    protocol.Qid
+	open   bool
+	mode   protocol.OpenMode
+	iounit uint32
+	// err is set if the fid could not be restored after reconnecting.
+	err error
+}
+
+// state returns the path and error of the fid.
+func (f *Fid) state() ([]string, error) {
+	f.c.Lock()
+	defer f.c.Unlock()
+	return f.path, f.err
+}
+
+// restore walks and opens the fid again on a new connection. Truncation is
+// not repeated. Must be called with the connection locked.
+func (f *Fid) restore(gc *g9p.Client) error {
+	wresp, err := gc.Walk(&protocol.WalkRequest{Tag: gc.NextTag(), Fid: rootFid, NewFid: f.fid, Names: f.path})
+	if err != nil {
+		return err
+	}
+	if len(wresp.Qids) != len(f.path) {
+		return ErrNoSuchFile
+	}
+	if !f.open {
+		return nil
+	}
+	_, err = gc.Open(&protocol.OpenRequest{Tag: gc.NextTag(), Fid: f.fid, Mode: f.mode &^ protocol.OTRUNC})
+	return err
+}
+
+// Walk walks to a path relative to the root of the service.
+func (c *Conn) Walk(path string) (*Fid, error) {
+	root := &Fid{c: c, fid: rootFid}
+	return root.Walk(splitPath(path)...)
+}
+
+// Walk returns a new fid for the file reached by walking names from f,
+// which must not be open.
+func (f *Fid) Walk(names ...string) (*Fid, error) {
+	base, err := f.state()
+	if err != nil {
+		return nil, err
+	}
+
+	// The path is kept without "..", as walking it again from the root
+	// must reach the same file.
+	path := append([]string(nil), base...)
+	for _, name := range names {
+		if name == ".." {
+			if len(path) > 0 {
+				path = path[:len(path)-1]
+			}
+			continue
+		}
+		path = append(path, name)
+	}
+
+	// The new fid is only remembered once walked, as it does not exist to
+	// be restored before that.
+	f.c.Lock()
+	nf := &Fid{c: f.c, fid: f.c.allocFid(), path: path}
+	f.c.Unlock()
+
+	err = f.c.do(true, func(gc *g9p.Client) error {
+		wresp, err := gc.Walk(&protocol.WalkRequest{Tag: gc.NextTag(), Fid: f.fid, NewFid: nf.fid, Names: names})
+		if err != nil {
+			return err
+		}
+		if len(wresp.Qids) != len(names) {
+			return ErrNoSuchFile
+		}
+		for i, q := range wresp.Qids {
+			if i < len(wresp.Qids)-1 && q.Type&protocol.QTDIR == 0 {
+				return ErrNotADirectory
+			}
+		}
+		if len(wresp.Qids) > 0 {
+			f.c.Lock()
+			nf.qid = wresp.Qids[len(wresp.Qids)-1]
+			f.c.Unlock()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	f.c.Lock()
+	f.c.fids[nf.fid] = nf
+	f.c.Unlock()
+	return nf, nil
+}
+
+// Qid returns the last known qid of the file.
+func (f *Fid) Qid() protocol.Qid {
+	f.c.Lock()
+	defer f.c.Unlock()
+	return f.qid
+}
+
+// IOUnit returns the largest amount of data that can be read or written in
+// a single message.
+func (f *Fid) IOUnit() uint32 {
+	f.c.Lock()
+	defer f.c.Unlock()
+	if f.iounit != 0 {
+		return f.iounit
+	}
+	// The size of a read or write header.
+	return f.c.msize - 24
+}
+
+func (f *Fid) opened(q protocol.Qid, iounit uint32, mode protocol.OpenMode) {
+	f.c.Lock()
+	defer f.c.Unlock()
+	f.qid = q
+	f.iounit = iounit
+	f.mode = mode
+	f.open = true
+	if f.c.Cache != CacheNone {
+		f.c.cache.validate(q)
+	}
+}
+
+// invalidate drops what the cache holds about the file after changing it.
+func (f *Fid) invalidate() {
+	if f.c.Cache == CacheNone {
+		return
+	}
+	f.c.Lock()
+	key, qpath := fidKey(f.path), f.qid.Path
+	f.c.Unlock()
+	f.c.cache.invalidate(key, qpath)
+}
+
+// Open opens the file.
+func (f *Fid) Open(mode protocol.OpenMode) error {
+	if _, err := f.state(); err != nil {
+		return err
+	}
+	return f.c.do(true, func(gc *g9p.Client) error {
+		resp, err := gc.Open(&protocol.OpenRequest{Tag: gc.NextTag(), Fid: f.fid, Mode: mode})
+		if err != nil {
+			return err
+		}
+		f.opened(resp.Qid, resp.IOUnit, mode)
+		return nil
+	})
+}
+
+// Create creates a file in the directory of f, after which f is the new
+// file, opened with mode.
+func (f *Fid) Create(name string, perm protocol.FileMode, mode protocol.OpenMode) error {
+	if _, err := f.state(); err != nil {
+		return err
+	}
+	return f.c.do(false, func(gc *g9p.Client) error {
+		resp, err := gc.Create(&protocol.CreateRequest{Tag: gc.NextTag(), Fid: f.fid, Name: name, Permissions: perm, Mode: mode})
+		if err != nil {
+			return err
+		}
+		f.c.Lock()
+		f.path = append(append([]string(nil), f.path...), name)
+		f.c.Unlock()
+		f.opened(resp.Qid, resp.IOUnit, mode)
+		f.invalidate()
+		return nil
+	})
+}
+
+// ReadAt reads from the file at an offset, returning at most IOUnit bytes.
+// A read of zero bytes is the end of the file. Reads are served from the
+// cache if enabled and the file has not changed since opened.
+func (f *Fid) ReadAt(p []byte, off int64) (int, error) {
+	if _, err := f.state(); err != nil {
+		return 0, err
+	}
+	if n := f.IOUnit(); uint32(len(p)) > n {
+		p = p[:n]
+	}
+
+	q := f.Qid()
+	cached := f.c.Cache != CacheNone && cacheable(q)
+	if cached {
+		if n, ok := f.c.cache.read(q, p, off); ok {
+			return n, nil
+		}
+	}
+
+	var n int
+	err := f.c.do(true, func(gc *g9p.Client) error {
+		resp, err := gc.Read(&protocol.ReadRequest{Tag: gc.NextTag(), Fid: f.fid, Offset: uint64(off), Count: uint32(len(p))})
+		if err != nil {
+			return err
+		}
+		n = copy(p, resp.Data)
+		return nil
+	})
+	if err == nil && cached {
+		f.c.cache.storeData(q, p[:n], off, f.c.cacheSize())
+	}
+	return n, err
+}
+
+// WriteAt writes to the file at an offset, writing at most IOUnit bytes.
+// Writes to append-only files are not retried after reconnecting, as they
+// would be appended twice.
+func (f *Fid) WriteAt(p []byte, off int64) (int, error) {
+	if _, err := f.state(); err != nil {
+		return 0, err
+	}
+	if n := f.IOUnit(); uint32(len(p)) > n {
+		p = p[:n]
+	}
+	defer f.invalidate()
+	var n int
+	err := f.c.do(f.Qid().Type&protocol.QTAPPEND == 0, func(gc *g9p.Client) error {
+		resp, err := gc.Write(&protocol.WriteRequest{Tag: gc.NextTag(), Fid: f.fid, Offset: uint64(off), Data: p})
+		if err != nil {
+			return err
+		}
+		n = int(resp.Count)
+		return nil
+	})
+	return n, err
+}
+
+// Stat returns the stat of the file.
+func (f *Fid) Stat() (protocol.Stat, error) {
+	if _, err := f.state(); err != nil {
+		return protocol.Stat{}, err
+	}
+	var st protocol.Stat
+	err := f.c.do(true, func(gc *g9p.Client) error {
+		resp, err := gc.Stat(&protocol.StatRequest{Tag: gc.NextTag(), Fid: f.fid})
+		if err != nil {
+			return err
+		}
+		st = resp.Stat
+		f.c.Lock()
+		f.qid = st.Qid
+		f.c.Unlock()
+		if f.c.Cache != CacheNone {
+			f.c.cache.validate(st.Qid)
+		}
+		return nil
+	})
+	return st, err
+}
+
+// NullStat returns a stat that changes nothing when written. Fields to be
+// changed are set on it before passing it to WriteStat.
+func NullStat() protocol.Stat {
+	return protocol.Stat{
+		Type:   ^uint16(0),
+		Dev:    ^uint32(0),
+		Qid:    protocol.Qid{Type: ^protocol.QidType(0), Version: ^uint32(0), Path: ^uint64(0)},
+		Mode:   ^protocol.FileMode(0),
+		Atime:  ^uint32(0),
+		Mtime:  ^uint32(0),
+		Length: ^uint64(0),
+	}
+}
+
+// WriteStat changes the stat of the file. Renames are reflected in the
+// remembered path of the fid.
+func (f *Fid) WriteStat(st protocol.Stat) error {
+	if _, err := f.state(); err != nil {
+		return err
+	}
+	// Both the old and the new name are invalidated.
+	f.invalidate()
+	defer f.invalidate()
+	return f.c.do(false, func(gc *g9p.Client) error {
+		if _, err := gc.WriteStat(&protocol.WriteStatRequest{Tag: gc.NextTag(), Fid: f.fid, Stat: st}); err != nil {
+			return err
+		}
+		if st.Name != "" {
+			f.c.Lock()
+			if len(f.path) > 0 {
+				f.path = append(append([]string(nil), f.path[:len(f.path)-1]...), st.Name)
+			}
+			f.c.Unlock()
+		}
+		return nil
+	})
+}
+
+// forget releases the fid number.
+func (f *Fid) forget() {
+	f.c.Lock()
+	defer f.c.Unlock()
+	delete(f.c.fids, f.fid)
+}
+
+// Remove removes the file and clunks the fid.
+func (f *Fid) Remove() error {
+	defer f.forget()
+	if _, err := f.state(); err != nil {
+		return err
+	}
+	defer f.invalidate()
+	return f.c.do(false, func(gc *g9p.Client) error {
+		_, err := gc.Remove(&protocol.RemoveRequest{Tag: gc.NextTag(), Fid: f.fid})
+		return err
+	})
+}
+
+// Clunk releases the fid. Fids lost with a connection need no clunk on the
+// server, so transport failures are not reported.
+func (f *Fid) Clunk() error {
+	defer f.forget()
+	if _, err := f.state(); err != nil {
+		return nil
+	}
+	gc, _, err := f.c.current()
+	if err != nil {
+		return nil
+	}
+	_, err = gc.Clunk(&protocol.ClunkRequest{Tag: gc.NextTag(), Fid: f.fid})
+	return err
+}
@@ -0,0 +1,463 @@
+package client
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/kennylevinsen/g9p/protocol"
+)
+
+var errInvalidChecksum = errors.New("invalid checksum")
+
+// File is an open file with an offset, implementing the io interfaces. If
+// enabled on the connection, sequential reads are served by reads sent ahead
+// of them, and writes are collected and sent in the background.
+type File struct {
+	*Fid
+	sync.Mutex
+	offset int64
+
+	// The end of the last read, and the reads in flight ahead of it.
+	next  int64
+	ahead []*readahead
+	wg    sync.WaitGroup
+
+	// Writes not yet sent, and the write being sent in the background.
+	wbuf     []byte
+	woff     int64
+	flushing *flush
+}
+
+type readahead struct {
+	off  int64
+	size int
+	data []byte
+	err  error
+	done chan struct{}
+}
+
+type flush struct {
+	err  error
+	done chan struct{}
+}
+
+// Open opens the file at a path relative to the root of the service.
+func (c *Conn) Open(name string, mode protocol.OpenMode) (*File, error) {
+	fid, err := c.Walk(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := fid.Open(mode); err != nil {
+		fid.Clunk()
+		return nil, err
+	}
+	return &File{Fid: fid}, nil
+}
+
+// Create creates and opens a file at a path relative to the root of the
+// service.
+func (c *Conn) Create(name string, perm protocol.FileMode, mode protocol.OpenMode) (*File, error) {
+	fid, err := c.Walk(path.Dir(name))
+	if err != nil {
+		return nil, err
+	}
+	if err := fid.Create(path.Base(name), perm, mode); err != nil {
+		fid.Clunk()
+		return nil, err
+	}
+	return &File{Fid: fid}, nil
+}
+
+// Stat returns the stat of the file at a path.
+func (c *Conn) Stat(name string) (protocol.Stat, error) {
+	key := cacheKey(name)
+	if c.Cache == CacheLoose {
+		if st, ok := c.cache.stat(key); ok {
+			return st, nil
+		}
+	}
+
+	fid, err := c.Walk(name)
+	if err != nil {
+		return protocol.Stat{}, err
+	}
+	defer fid.Clunk()
+	st, err := fid.Stat()
+	if err == nil && c.Cache == CacheLoose {
+		c.cache.storeStat(key, st, c.cacheTTL())
+	}
+	return st, err
+}
+
+// WriteStat changes the stat of the file at a path.
+func (c *Conn) WriteStat(name string, st protocol.Stat) error {
+	fid, err := c.Walk(name)
+	if err != nil {
+		return err
+	}
+	defer fid.Clunk()
+	return fid.WriteStat(st)
+}
+
+// Remove removes the file at a path.
+func (c *Conn) Remove(name string) error {
+	fid, err := c.Walk(name)
+	if err != nil {
+		return err
+	}
+	return fid.Remove()
+}
+
+// ReadFile returns the content of the file at a path.
+func (c *Conn) ReadFile(name string) ([]byte, error) {
+	f, err := c.Open(name, protocol.OREAD)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var buf bytes.Buffer
+	if _, err := f.WriteTo(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Checksum returns the SHA-256 of the content of the file at a path, as
+// served in name.sum by servers supporting it.
+func (c *Conn) Checksum(name string) ([]byte, error) {
+	b, err := c.ReadFile(name + ".sum")
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(string(b))
+	if len(fields) == 0 {
+		return nil, errInvalidChecksum
+	}
+	sum, err := hex.DecodeString(fields[0])
+	if err != nil {
+		return nil, errInvalidChecksum
+	}
+	return sum, nil
+}
+
+// ReadDir returns the stats of the entries of the directory at a path.
+func (c *Conn) ReadDir(name string) ([]protocol.Stat, error) {
+	key := cacheKey(name)
+	if c.Cache == CacheLoose {
+		if stats, ok := c.cache.dir(key, nil); ok {
+			return stats, nil
+		}
+	}
+
+	f, err := c.Open(name, protocol.OREAD)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// Opening the directory returns its current version, so a strict cache
+	// can tell whether its listing is still valid without reading it.
+	q := f.Qid()
+	if c.Cache == CacheStrict {
+		if stats, ok := c.cache.dir(key, &q); ok {
+			return stats, nil
+		}
+	}
+
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, f); err != nil {
+		return nil, err
+	}
+	var stats []protocol.Stat
+	for buf.Len() > 0 {
+		var st protocol.Stat
+		if err := st.Decode(&buf); err != nil {
+			return nil, err
+		}
+		stats = append(stats, st)
+	}
+
+	if c.Cache != CacheNone {
+		c.cache.storeDir(key, q, stats, c.cacheTTL())
+	}
+	return stats, nil
+}
+
+func (f *File) Read(p []byte) (int, error) {
+	f.Lock()
+	defer f.Unlock()
+	if err := f.flush(true); err != nil {
+		return 0, err
+	}
+	n, err := f.readSeq(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+// readSeq reads at an offset, using and starting readahead if the file is
+// read sequentially. Reading from the start of the file, or from where the
+// previous read ended, counts as sequential. Must be called with the file
+// locked.
+func (f *File) readSeq(p []byte, off int64) (int, error) {
+	if f.c.Readahead <= 0 || len(p) == 0 || !cacheable(f.Qid()) {
+		return f.readAt(p, off)
+	}
+
+	seq := off == f.next
+	if !seq {
+		f.ahead = nil
+	}
+	for len(f.ahead) > 0 {
+		r := f.ahead[0]
+		if off < r.off {
+			// A short read left a gap before the readahead.
+			break
+		}
+		<-r.done
+		end := r.off + int64(len(r.data))
+		if r.err == nil && len(r.data) == 0 && off == r.off {
+			f.ahead = f.ahead[1:]
+			return 0, io.EOF
+		}
+		if r.err != nil || off >= end {
+			// Failed reads are left to be repeated synchronously, which
+			// reports their error.
+			f.ahead = f.ahead[1:]
+			continue
+		}
+		n := copy(p, r.data[off-r.off:])
+		if off+int64(n) == end {
+			f.ahead = f.ahead[1:]
+		}
+		f.next = off + int64(n)
+		f.fill()
+		return n, nil
+	}
+
+	n, err := f.readAt(p, off)
+	f.next = off + int64(n)
+	if seq && n > 0 {
+		f.fill()
+	}
+	return n, err
+}
+
+// fill starts reads of the next IOUnit sized blocks, keeping Readahead of
+// them in flight, unless the end of the file was reached. Must be called
+// with the file locked.
+func (f *File) fill() {
+	start := f.next
+	for _, r := range f.ahead {
+		select {
+		case <-r.done:
+			if r.err != nil || len(r.data) < r.size {
+				return
+			}
+		default:
+		}
+		start = r.off + int64(r.size)
+	}
+
+	size := int(f.IOUnit())
+	for len(f.ahead) < f.c.Readahead {
+		f.ahead = append(f.ahead, f.readAsync(start, size))
+		start += int64(size)
+	}
+}
+
+// readAsync starts a read in the background. Close waits for it.
+func (f *File) readAsync(off int64, size int) *readahead {
+	r := &readahead{off: off, size: size, done: make(chan struct{})}
+	f.wg.Add(1)
+	go func() {
+		defer f.wg.Done()
+		defer close(r.done)
+		b := make([]byte, r.size)
+		n, err := f.Fid.ReadAt(b, r.off)
+		r.data, r.err = b[:n], err
+	}()
+	return r
+}
+
+// ReadAt reads at an offset, returning io.EOF at the end of the file, as
+// io.ReaderAt requires. Reads are limited to the iounit of the file.
+func (f *File) ReadAt(p []byte, off int64) (int, error) {
+	f.Lock()
+	err := f.flush(true)
+	f.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	return f.readAt(p, off)
+}
+
+func (f *File) readAt(p []byte, off int64) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	n, err := f.Fid.ReadAt(p, off)
+	if n == 0 && err == nil {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (f *File) Write(p []byte) (int, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.ahead = nil
+	var n int
+	var err error
+	if f.c.WriteBehind > 0 {
+		n, err = f.writeBehind(p, f.offset)
+	} else {
+		n, err = f.writeAt(p, f.offset)
+	}
+	f.offset += int64(n)
+	return n, err
+}
+
+// writeBehind adds a write to the buffer, sending the buffer once full or
+// when the write does not continue it. Must be called with the file locked.
+func (f *File) writeBehind(p []byte, off int64) (int, error) {
+	if len(f.wbuf) > 0 && off != f.woff+int64(len(f.wbuf)) {
+		if err := f.flush(false); err != nil {
+			return 0, err
+		}
+	}
+	if len(f.wbuf) == 0 {
+		f.woff = off
+	}
+	f.wbuf = append(f.wbuf, p...)
+	if len(f.wbuf) >= f.c.WriteBehind {
+		if err := f.flush(false); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// flush sends the buffered writes in the background, once the previous
+// background write is done. It returns the error of the previous background
+// write, in which case the buffered writes are dropped, or if wait is set,
+// waits for the buffered writes and returns their error. Must be called with
+// the file locked.
+func (f *File) flush(wait bool) error {
+	if f.flushing != nil {
+		<-f.flushing.done
+		err := f.flushing.err
+		f.flushing = nil
+		if err != nil {
+			f.wbuf = nil
+			return err
+		}
+	}
+	if len(f.wbuf) == 0 {
+		return nil
+	}
+
+	fl := &flush{done: make(chan struct{})}
+	buf, off := f.wbuf, f.woff
+	f.wbuf = nil
+	go func() {
+		defer close(fl.done)
+		_, fl.err = f.writeAt(buf, off)
+	}()
+	f.flushing = fl
+	if !wait {
+		return nil
+	}
+	<-fl.done
+	f.flushing = nil
+	return fl.err
+}
+
+// WriteAt writes all of p at an offset, in as many messages as needed,
+// after any buffered writes.
+func (f *File) WriteAt(p []byte, off int64) (int, error) {
+	f.Lock()
+	f.ahead = nil
+	err := f.flush(true)
+	f.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	return f.writeAt(p, off)
+}
+
+func (f *File) writeAt(p []byte, off int64) (int, error) {
+	var written int
+	for written < len(p) {
+		n, err := f.Fid.WriteAt(p[written:], off+int64(written))
+		written += n
+		if err != nil {
+			return written, err
+		}
+		if n == 0 {
+			return written, io.ErrShortWrite
+		}
+	}
+	return written, nil
+}
+
+// Sync sends any buffered writes, returning the error of any write that
+// failed in the background.
+func (f *File) Sync() error {
+	f.Lock()
+	defer f.Unlock()
+	return f.flush(true)
+}
+
+// Stat returns the stat of the file, after sending any buffered writes.
+func (f *File) Stat() (protocol.Stat, error) {
+	if err := f.Sync(); err != nil {
+		return protocol.Stat{}, err
+	}
+	return f.Fid.Stat()
+}
+
+func (f *File) Seek(offset int64, whence int) (int64, error) {
+	f.Lock()
+	defer f.Unlock()
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		if err := f.flush(true); err != nil {
+			return f.offset, err
+		}
+		st, err := f.Fid.Stat()
+		if err != nil {
+			return f.offset, err
+		}
+		offset += int64(st.Length)
+	default:
+		return f.offset, errors.New("invalid whence value")
+	}
+	if offset < 0 {
+		return f.offset, errors.New("negative seek invalid")
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+// Close sends any buffered writes and clunks the fid of the file, returning
+// the error of any write that failed in the background.
+func (f *File) Close() error {
+	f.Lock()
+	defer f.Unlock()
+	err := f.flush(true)
+	f.ahead = nil
+	f.wg.Wait()
+	if cerr := f.Clunk(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,51 @@
+package client
+
+import "sync"
+
+// Pool spreads work over several connections to the same service. Each
+// connection has its own transport, so a slow operation on one, or the
+// window of a single TCP connection on a high-latency link, does not hold
+// up operations on the others. Fids belong to the connection they were
+// walked on.
+type Pool struct {
+	sync.Mutex
+	conns []*Conn
+	next  int
+}
+
+// NewPool opens n connections with dial, closing them again if any fails.
+func NewPool(n int, dial func() (*Conn, error)) (*Pool, error) {
+	p := &Pool{}
+	for i := 0; i < n; i++ {
+		c, err := dial()
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+		p.conns = append(p.conns, c)
+	}
+	return p, nil
+}
+
+// Get returns the next connection of the pool, in turn.
+func (p *Pool) Get() *Conn {
+	p.Lock()
+	defer p.Unlock()
+	c := p.conns[p.next%len(p.conns)]
+	p.next++
+	return c
+}
+
+// Close closes all connections of the pool.
+func (p *Pool) Close() error {
+	p.Lock()
+	defer p.Unlock()
+	var err error
+	for _, c := range p.conns {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	p.conns = nil
+	return err
+}
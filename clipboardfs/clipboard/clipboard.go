@@ -0,0 +1,31 @@
+// Package clipboard accesses the host clipboard through the command line
+// tools of the platform.
+package clipboard
+
+import (
+	"bytes"
+	"errors"
+	"os/exec"
+)
+
+var ErrUnsupported = errors.New("no clipboard tool available")
+
+// Get returns the content of the clipboard.
+func Get() ([]byte, error) {
+	paste, _, err := commands()
+	if err != nil {
+		return nil, err
+	}
+	return exec.Command(paste[0], paste[1:]...).Output()
+}
+
+// Set replaces the content of the clipboard.
+func Set(b []byte) error {
+	_, copy, err := commands()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(copy[0], copy[1:]...)
+	cmd.Stdin = bytes.NewReader(b)
+	return cmd.Run()
+}
@@ -0,0 +1,5 @@
+package clipboard
+
+func commands() (paste, copy []string, err error) {
+	return []string{"pbpaste"}, []string{"pbcopy"}, nil
+}
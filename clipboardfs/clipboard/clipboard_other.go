@@ -0,0 +1,8 @@
+//go:build !linux && !freebsd && !netbsd && !openbsd && !dragonfly && !darwin && !windows
+// +build !linux,!freebsd,!netbsd,!openbsd,!dragonfly,!darwin,!windows
+
+package clipboard
+
+func commands() (paste, copy []string, err error) {
+	return nil, nil, ErrUnsupported
+}
@@ -0,0 +1,32 @@
+//go:build linux || freebsd || netbsd || openbsd || dragonfly
+// +build linux freebsd netbsd openbsd dragonfly
+
+package clipboard
+
+import (
+	"os"
+	"os/exec"
+)
+
+var tools = []struct {
+	wayland     bool
+	paste, copy []string
+}{
+	{true, []string{"wl-paste", "--no-newline"}, []string{"wl-copy"}},
+	{false, []string{"xclip", "-selection", "clipboard", "-o"}, []string{"xclip", "-selection", "clipboard", "-i"}},
+	{false, []string{"xsel", "--clipboard", "--output"}, []string{"xsel", "--clipboard", "--input"}},
+}
+
+func commands() (paste, copy []string, err error) {
+	wayland := os.Getenv("WAYLAND_DISPLAY") != ""
+	for _, t := range tools {
+		if t.wayland && !wayland {
+			continue
+		}
+		if _, err := exec.LookPath(t.paste[0]); err != nil {
+			continue
+		}
+		return t.paste, t.copy, nil
+	}
+	return nil, nil, ErrUnsupported
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/kennylevinsen/g9p"
+	"github.com/kennylevinsen/g9ptools/clipboardfs/clipboard"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+	"github.com/kennylevinsen/g9ptools/ramfs/ramtree"
+	"github.com/kennylevinsen/g9ptools/transport"
+)
+
+func main() {
+	if len(os.Args) < 5 {
+		fmt.Printf("Too few arguments\n")
+		fmt.Printf("%s service UID GID address\n", os.Args[0])
+		fmt.Printf("UID and GID are the user/group that owns /\n")
+		fmt.Printf("address is a dial string, such as :5640, or stdio to serve a single session on standard input and output\n")
+		return
+	}
+
+	service := os.Args[1]
+	user := os.Args[2]
+	group := os.Args[3]
+	addr := os.Args[4]
+
+	// The snarf file is read and written in full, so that writes split over
+	// multiple messages end up in the clipboard as one.
+	root := ramtree.NewRAMTree("/", 0555, user, group)
+	root.Add("snarf", ramtree.NewBufferFile("snarf", 0666, user, group,
+		func(string) ([]byte, error) { return clipboard.Get() },
+		func(_ string, b []byte) error { return clipboard.Set(b) }))
+
+	l, err := transport.ListenDialString(addr)
+	if err != nil {
+		log.Fatalf("Unable to listen: %v", err)
+	}
+
+	h := func() g9p.Handler {
+		m := make(map[string]fileserver.Dir)
+		m[service] = root
+		return fileserver.NewFileServer(nil, m, 10*1024*1024, fileserver.Chatty)
+	}
+
+	log.Printf("Starting clipboardfs at %s", addr)
+	transport.Ready()
+	g9p.ServeListener(l, h)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kennylevinsen/g9ptools/transport"
+)
+
+// result holds the measurements of one operation across all sessions.
+type result struct {
+	Op          string  `json:"op"`
+	Count       int     `json:"count"`
+	Errors      int     `json:"errors"`
+	OpsPerSec   float64 `json:"ops_per_sec"`
+	BytesPerSec float64 `json:"bytes_per_sec,omitempty"`
+	// Latencies are in microseconds.
+	P50 float64 `json:"p50_us"`
+	P90 float64 `json:"p90_us"`
+	P99 float64 `json:"p99_us"`
+	Max float64 `json:"max_us"`
+}
+
+type report struct {
+	Address  string   `json:"address"`
+	Sessions int      `json:"sessions"`
+	MaxSize  uint32   `json:"msize"`
+	FileSize int64    `json:"file_size"`
+	Duration float64  `json:"duration_s"`
+	Results  []result `json:"results"`
+}
+
+// samples collects the latencies of an operation.
+type samples struct {
+	sync.Mutex
+	latencies []time.Duration
+	bytes     int64
+	errors    int
+}
+
+func (s *samples) add(lat []time.Duration, bytes int64, errors int) {
+	s.Lock()
+	defer s.Unlock()
+	s.latencies = append(s.latencies, lat...)
+	s.bytes += bytes
+	s.errors += errors
+}
+
+func (s *samples) result(op string, elapsed time.Duration) result {
+	sort.Slice(s.latencies, func(i, j int) bool { return s.latencies[i] < s.latencies[j] })
+	us := func(q float64) float64 {
+		if len(s.latencies) == 0 {
+			return 0
+		}
+		i := int(q * float64(len(s.latencies)-1))
+		return float64(s.latencies[i]) / float64(time.Microsecond)
+	}
+	return result{
+		Op:          op,
+		Count:       len(s.latencies),
+		Errors:      s.errors,
+		OpsPerSec:   float64(len(s.latencies)) / elapsed.Seconds(),
+		BytesPerSec: float64(s.bytes) / elapsed.Seconds(),
+		P50:         us(0.50),
+		P90:         us(0.90),
+		P99:         us(0.99),
+		Max:         us(1),
+	}
+}
+
+func main() {
+	sessions := flag.Int("sessions", 4, "number of concurrent sessions")
+	duration := flag.Duration("duration", 10*time.Second, "how long to run each operation")
+	msize := flag.Uint("msize", 64*1024, "maximum message size to negotiate")
+	size := flag.Int64("size", 1024*1024, "size of the file of each session in bytes")
+	ops := flag.String("ops", "walk,open,read,write,stat", "comma-separated operations to measure")
+	user := flag.String("user", "bench", "user to attach as")
+	service := flag.String("service", "", "service to attach to")
+	dir := flag.String("dir", "9pbench", "directory to create the files of the sessions in")
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		fmt.Printf("Too few arguments\n")
+		fmt.Printf("%s [-sessions n] [-duration d] [-msize bytes] [-size bytes] [-ops ops] [-user user] [-service service] [-dir dir] dialstring\n", os.Args[0])
+		fmt.Printf("operations are walk, open, read, write and stat, each measured in turn\n")
+		return
+	}
+
+	network, address, err := transport.ParseDialString(flag.Arg(0))
+	if err != nil {
+		log.Fatalf("Invalid address: %v", err)
+	}
+	var opNames []string
+	for _, op := range strings.Split(*ops, ",") {
+		if _, ok := operations[op]; !ok {
+			log.Fatalf("Unknown operation %q", op)
+		}
+		opNames = append(opNames, op)
+	}
+
+	ss := make([]*session, *sessions)
+	for i := range ss {
+		s, err := dial(network, address, *user, *service, uint32(*msize))
+		if err != nil {
+			log.Fatalf("Unable to connect: %v", err)
+		}
+		defer s.Close()
+		if i == 0 {
+			if err := s.mkdir(*dir); err != nil {
+				log.Fatalf("Unable to create %s: %v", *dir, err)
+			}
+		}
+		if err := s.setup(*dir, fmt.Sprintf("%d.%d", os.Getpid(), i), *size); err != nil {
+			log.Fatalf("Unable to set up session: %v", err)
+		}
+		ss[i] = s
+	}
+
+	rep := report{
+		Address:  flag.Arg(0),
+		Sessions: *sessions,
+		MaxSize:  ss[0].iounit + ioHeader,
+		FileSize: *size,
+		Duration: duration.Seconds(),
+	}
+
+	for _, op := range opNames {
+		fn := operations[op]
+		smp := &samples{}
+		start := time.Now()
+		deadline := start.Add(*duration)
+
+		var wg sync.WaitGroup
+		for _, s := range ss {
+			wg.Add(1)
+			go func(s *session) {
+				defer wg.Done()
+				var (
+					lat    []time.Duration
+					bytes  int64
+					errors int
+				)
+				for time.Now().Before(deadline) {
+					n, d, err := fn(s)
+					if err != nil {
+						errors++
+						continue
+					}
+					lat = append(lat, d)
+					bytes += int64(n)
+				}
+				smp.add(lat, bytes, errors)
+			}(s)
+		}
+		wg.Wait()
+		rep.Results = append(rep.Results, smp.result(op, time.Since(start)))
+	}
+
+	for _, s := range ss {
+		if err := s.remove(); err != nil {
+			log.Printf("Unable to remove file: %v", err)
+		}
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "\t")
+	if err := enc.Encode(&rep); err != nil {
+		log.Fatalf("Unable to write report: %v", err)
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/kennylevinsen/g9p"
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/transport"
+)
+
+// ioHeader is the size of the header of read and write messages, which is
+// subtracted from the msize to get the largest possible data size.
+const ioHeader = 24
+
+const (
+	rootFid protocol.Fid = iota
+	fileFid
+	readFid
+	writeFid
+	tempFid
+)
+
+// session is a single connection running operations on its own file.
+type session struct {
+	c      *g9p.Client
+	conn   net.Conn
+	dir    string
+	name   string
+	size   int64
+	iounit uint32
+	buf    []byte
+	roff   int64
+	woff   int64
+}
+
+func dial(network, address, user, service string, msize uint32) (*session, error) {
+	conn, err := transport.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	c := g9p.NewClient(conn)
+	go c.Start()
+	s := &session{c: c, conn: conn}
+
+	vresp, err := c.Version(&protocol.VersionRequest{Tag: protocol.NOTAG, MaxSize: msize, Version: "9P2000"})
+	if err != nil {
+		s.Close()
+		return nil, fmt.Errorf("version: %v", err)
+	}
+	if vresp.Version != "9P2000" {
+		s.Close()
+		return nil, fmt.Errorf("server speaks %s", vresp.Version)
+	}
+	s.iounit = vresp.MaxSize - ioHeader
+
+	if _, err := c.Attach(&protocol.AttachRequest{Tag: c.NextTag(), Fid: rootFid, AuthFid: protocol.NOFID, Username: user, Service: service}); err != nil {
+		s.Close()
+		return nil, fmt.Errorf("attach: %v", err)
+	}
+	return s, nil
+}
+
+func (s *session) Close() {
+	s.c.Stop()
+	s.conn.Close()
+}
+
+func (s *session) walk(fid, newfid protocol.Fid, names ...string) error {
+	resp, err := s.c.Walk(&protocol.WalkRequest{Tag: s.c.NextTag(), Fid: fid, NewFid: newfid, Names: names})
+	if err != nil {
+		return err
+	}
+	if len(resp.Qids) != len(names) {
+		return errors.New("file not found")
+	}
+	return nil
+}
+
+func (s *session) clunk(fid protocol.Fid) error {
+	_, err := s.c.Clunk(&protocol.ClunkRequest{Tag: s.c.NextTag(), Fid: fid})
+	return err
+}
+
+func (s *session) open(fid protocol.Fid, mode protocol.OpenMode) error {
+	_, err := s.c.Open(&protocol.OpenRequest{Tag: s.c.NextTag(), Fid: fid, Mode: mode})
+	return err
+}
+
+// mkdir creates the benchmark directory, unless it already exists.
+func (s *session) mkdir(dir string) error {
+	if err := s.walk(rootFid, tempFid, dir); err == nil {
+		return s.clunk(tempFid)
+	}
+	if err := s.walk(rootFid, tempFid); err != nil {
+		return err
+	}
+	defer s.clunk(tempFid)
+	_, err := s.c.Create(&protocol.CreateRequest{Tag: s.c.NextTag(), Fid: tempFid, Name: dir, Permissions: protocol.DMDIR | 0777, Mode: protocol.OREAD})
+	return err
+}
+
+// setup creates the file of the session in dir, fills it with size bytes,
+// and opens the fids used by the operations.
+func (s *session) setup(dir, name string, size int64) error {
+	s.dir, s.name, s.size = dir, name, size
+	s.buf = make([]byte, s.iounit)
+
+	if err := s.walk(rootFid, tempFid, dir); err != nil {
+		return fmt.Errorf("walk: %v", err)
+	}
+	if _, err := s.c.Create(&protocol.CreateRequest{Tag: s.c.NextTag(), Fid: tempFid, Name: name, Permissions: 0666, Mode: protocol.OWRITE | protocol.OTRUNC}); err != nil {
+		s.clunk(tempFid)
+		return fmt.Errorf("create: %v", err)
+	}
+	for off := int64(0); off < size; {
+		n := int64(len(s.buf))
+		if size-off < n {
+			n = size - off
+		}
+		resp, err := s.c.Write(&protocol.WriteRequest{Tag: s.c.NextTag(), Fid: tempFid, Offset: uint64(off), Data: s.buf[:n]})
+		if err != nil {
+			s.clunk(tempFid)
+			return fmt.Errorf("write: %v", err)
+		}
+		off += int64(resp.Count)
+	}
+	s.clunk(tempFid)
+
+	for _, x := range []struct {
+		fid  protocol.Fid
+		mode protocol.OpenMode
+	}{{fileFid, 0}, {readFid, protocol.OREAD}, {writeFid, protocol.OWRITE}} {
+		if err := s.walk(rootFid, x.fid, dir, name); err != nil {
+			return fmt.Errorf("walk: %v", err)
+		}
+		if x.fid != fileFid {
+			if err := s.open(x.fid, x.mode); err != nil {
+				return fmt.Errorf("open: %v", err)
+			}
+		}
+	}
+	return nil
+}
+
+// remove removes the file of the session.
+func (s *session) remove() error {
+	s.clunk(readFid)
+	s.clunk(writeFid)
+	_, err := s.c.Remove(&protocol.RemoveRequest{Tag: s.c.NextTag(), Fid: fileFid})
+	return err
+}
+
+// An operation runs a single request, and returns the number of bytes
+// transferred. Only the request being measured is timed.
+type operation func(s *session) (int, time.Duration, error)
+
+var operations = map[string]operation{
+	"walk": func(s *session) (int, time.Duration, error) {
+		start := time.Now()
+		err := s.walk(rootFid, tempFid, s.dir, s.name)
+		d := time.Since(start)
+		if err != nil {
+			return 0, d, err
+		}
+		return 0, d, s.clunk(tempFid)
+	},
+	"open": func(s *session) (int, time.Duration, error) {
+		if err := s.walk(fileFid, tempFid); err != nil {
+			return 0, 0, err
+		}
+		defer s.clunk(tempFid)
+		start := time.Now()
+		err := s.open(tempFid, protocol.OREAD)
+		return 0, time.Since(start), err
+	},
+	"read": func(s *session) (int, time.Duration, error) {
+		if s.roff >= s.size {
+			s.roff = 0
+		}
+		start := time.Now()
+		resp, err := s.c.Read(&protocol.ReadRequest{Tag: s.c.NextTag(), Fid: readFid, Offset: uint64(s.roff), Count: s.iounit})
+		d := time.Since(start)
+		if err != nil {
+			return 0, d, err
+		}
+		s.roff += int64(len(resp.Data))
+		if len(resp.Data) == 0 {
+			s.roff = 0
+		}
+		return len(resp.Data), d, nil
+	},
+	"write": func(s *session) (int, time.Duration, error) {
+		n := int64(len(s.buf))
+		if s.woff+n > s.size {
+			s.woff = 0
+			if n > s.size {
+				n = s.size
+			}
+		}
+		start := time.Now()
+		resp, err := s.c.Write(&protocol.WriteRequest{Tag: s.c.NextTag(), Fid: writeFid, Offset: uint64(s.woff), Data: s.buf[:n]})
+		d := time.Since(start)
+		if err != nil {
+			return 0, d, err
+		}
+		s.woff += int64(resp.Count)
+		return int(resp.Count), d, nil
+	},
+	"stat": func(s *session) (int, time.Duration, error) {
+		start := time.Now()
+		_, err := s.c.Stat(&protocol.StatRequest{Tag: s.c.NextTag(), Fid: fileFid})
+		return 0, time.Since(start), err
+	},
+}
@@ -0,0 +1,202 @@
+// 9pcp copies files and directories between the local disk and 9P services,
+// or between two 9P services, keeping several reads and writes in flight.
+// Permissions and modification times are preserved. A remote path is
+// written as a dial string followed by a colon and an absolute path, such
+// as tcp!server!5640:/dir.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/kennylevinsen/g9ptools/auth"
+	"github.com/kennylevinsen/g9ptools/client"
+	"github.com/kennylevinsen/g9ptools/transport"
+)
+
+var errIsDir = errors.New("is a directory, use -r to copy it")
+
+// progress reports how much of a file has been copied.
+type progress struct {
+	io.Reader
+	name        string
+	done, total int64
+	last        time.Time
+	quiet       bool
+}
+
+func (p *progress) Read(b []byte) (int, error) {
+	n, err := p.Reader.Read(b)
+	p.done += int64(n)
+	if now := time.Now(); !p.quiet && now.Sub(p.last) > 200*time.Millisecond {
+		p.last = now
+		p.report()
+	}
+	return n, err
+}
+
+func (p *progress) report() {
+	fmt.Fprintf(os.Stderr, "\r%s %d/%d bytes", p.name, p.done, p.total)
+}
+
+type copier struct {
+	recursive bool
+	resume    bool
+	quiet     bool
+}
+
+// copyFile copies a file. When resuming, a shorter destination is taken to
+// be the start of the file, and only the rest is copied.
+func (cp *copier) copyFile(src fs, sname string, si info, dst fs, dname string) error {
+	var off int64
+	if cp.resume {
+		if di, err := dst.stat(dname); err == nil && !di.dir && di.size <= si.size {
+			if di.size == si.size && di.mtime == si.mtime {
+				return nil
+			}
+			off = di.size
+		}
+	}
+
+	in, err := src.open(sname, off)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := dst.create(dname, si.perm, off)
+	if err != nil {
+		return err
+	}
+
+	p := &progress{Reader: in, name: dname, done: off, total: si.size, quiet: cp.quiet}
+	_, err = io.Copy(out, p)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if !cp.quiet {
+		p.report()
+		fmt.Fprintf(os.Stderr, "\n")
+	}
+	if err != nil {
+		return err
+	}
+	return dst.setattr(dname, si)
+}
+
+// copyTree copies a file, or a directory and its content. The times of
+// directories are set once their content is copied, as copying changes
+// them.
+func (cp *copier) copyTree(src fs, sname string, dst fs, dname string) error {
+	si, err := src.stat(sname)
+	if err != nil {
+		return err
+	}
+	if !si.dir {
+		return cp.copyFile(src, sname, si, dst, dname)
+	}
+	if !cp.recursive {
+		return errIsDir
+	}
+
+	if di, err := dst.stat(dname); err != nil || !di.dir {
+		// The directory is created writable, so that its content can be
+		// copied even if it is not to be writable in the end.
+		if err := dst.mkdir(dname, si.perm|0700); err != nil {
+			return err
+		}
+	}
+	entries, err := src.readDir(sname)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := cp.copyTree(src, src.join(sname, e.name), dst, dst.join(dname, e.name)); err != nil {
+			return err
+		}
+	}
+	return dst.setattr(dname, si)
+}
+
+// parseOperand splits a remote path into its dial string and path.
+func parseOperand(s string) (dialstring, name string, remote bool) {
+	idx := strings.Index(s, ":/")
+	if idx == -1 {
+		return "", s, false
+	}
+	return s[:idx], s[idx+1:], true
+}
+
+func main() {
+	recursive := flag.Bool("r", false, "copy directories recursively")
+	resume := flag.Bool("c", false, "continue partially copied files, and skip copied ones")
+	quiet := flag.Bool("q", false, "do not report progress")
+	user := flag.String("user", os.Getenv("USER"), "the user to attach as")
+	service := flag.String("service", "", "the service to attach to")
+	keyfile := flag.String("keys", "", "authenticate with the keys in file")
+	window := flag.Int("window", client.DefaultWindow, "reads or writes to keep in flight")
+	flag.Parse()
+
+	if flag.NArg() < 2 {
+		fmt.Printf("Too few arguments\n")
+		fmt.Printf("%s [-r] [-c] [-q] [-user user] [-service service] [-keys file] [-window n] source destination\n", os.Args[0])
+		fmt.Printf("remote paths are written as dialstring:/path, such as tcp!server!5640:/dir\n")
+		return
+	}
+
+	var keys *auth.Keyring
+	if *keyfile != "" {
+		var err error
+		if keys, err = auth.LoadKeys(*keyfile); err != nil {
+			log.Fatalf("Unable to load keys: %v", err)
+		}
+	}
+
+	conns := make(map[string]*client.Conn)
+	resolve := func(operand string) (fs, string) {
+		dialstring, name, remote := parseOperand(operand)
+		if !remote {
+			return localFS{}, name
+		}
+		if c, ok := conns[dialstring]; ok {
+			return remoteFS{c}, name
+		}
+		network, address, err := transport.ParseDialString(dialstring)
+		if err != nil {
+			log.Fatalf("Invalid address: %v", err)
+		}
+		c := client.NewConn(func() (io.ReadWriteCloser, error) {
+			return transport.Dial(network, address)
+		}, *user, *service)
+		c.Keys = keys
+		c.Window = *window
+		c.Readahead = *window
+		if err := c.Connect(); err != nil {
+			log.Fatalf("Connect to %s failed: %v", dialstring, err)
+		}
+		conns[dialstring] = c
+		return remoteFS{c}, name
+	}
+
+	src, sname := resolve(flag.Arg(0))
+	dst, dname := resolve(flag.Arg(1))
+
+	// Like cp, copying to an existing directory copies into it.
+	if di, err := dst.stat(dname); err == nil && di.dir {
+		dname = dst.join(dname, src.base(sname))
+	}
+
+	cp := &copier{recursive: *recursive, resume: *resume, quiet: *quiet}
+	err := cp.copyTree(src, sname, dst, dname)
+	for _, c := range conns {
+		c.Close()
+	}
+	if err != nil {
+		log.Fatalf("Copy failed: %v", err)
+	}
+}
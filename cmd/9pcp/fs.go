@@ -0,0 +1,198 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/client"
+)
+
+type info struct {
+	name  string
+	dir   bool
+	perm  uint32
+	size  int64
+	mtime int64
+}
+
+// fs is a place files are copied from or to: the local disk, or a 9P
+// service.
+type fs interface {
+	join(dir, name string) string
+	base(name string) string
+	stat(name string) (info, error)
+	readDir(name string) ([]info, error)
+	// open opens a file for reading from off.
+	open(name string, off int64) (io.ReadCloser, error)
+	// create opens a file for writing at off, creating it if needed, and
+	// truncating it unless continuing at an offset.
+	create(name string, perm uint32, off int64) (io.WriteCloser, error)
+	mkdir(name string, perm uint32) error
+	// setattr sets the permissions and modification time of a file.
+	setattr(name string, i info) error
+}
+
+type localFS struct{}
+
+func localInfo(fi os.FileInfo) info {
+	return info{
+		name:  fi.Name(),
+		dir:   fi.IsDir(),
+		perm:  uint32(fi.Mode().Perm()),
+		size:  fi.Size(),
+		mtime: fi.ModTime().Unix(),
+	}
+}
+
+func (localFS) join(dir, name string) string { return filepath.Join(dir, name) }
+func (localFS) base(name string) string      { return filepath.Base(name) }
+
+func (localFS) stat(name string) (info, error) {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return info{}, err
+	}
+	return localInfo(fi), nil
+}
+
+func (localFS) readDir(name string) ([]info, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fis, err := f.Readdir(-1)
+	if err != nil {
+		return nil, err
+	}
+	var infos []info
+	for _, fi := range fis {
+		if fi.IsDir() || fi.Mode().IsRegular() {
+			infos = append(infos, localInfo(fi))
+		}
+	}
+	return infos, nil
+}
+
+func (localFS) open(name string, off int64) (io.ReadCloser, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(off, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func (localFS) create(name string, perm uint32, off int64) (io.WriteCloser, error) {
+	flags := os.O_WRONLY | os.O_CREATE
+	if off == 0 {
+		flags |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(name, flags, os.FileMode(perm))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(off, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func (localFS) mkdir(name string, perm uint32) error {
+	return os.Mkdir(name, os.FileMode(perm))
+}
+
+func (localFS) setattr(name string, i info) error {
+	if err := os.Chmod(name, os.FileMode(i.perm)); err != nil {
+		return err
+	}
+	mtime := time.Unix(i.mtime, 0)
+	return os.Chtimes(name, mtime, mtime)
+}
+
+type remoteFS struct {
+	c *client.Conn
+}
+
+func remoteInfo(st protocol.Stat) info {
+	return info{
+		name:  st.Name,
+		dir:   st.Mode&protocol.DMDIR != 0,
+		perm:  uint32(st.Mode & 0777),
+		size:  int64(st.Length),
+		mtime: int64(st.Mtime),
+	}
+}
+
+func (remoteFS) join(dir, name string) string { return path.Join(dir, name) }
+func (remoteFS) base(name string) string      { return path.Base(name) }
+
+func (r remoteFS) stat(name string) (info, error) {
+	st, err := r.c.Stat(name)
+	if err != nil {
+		return info{}, err
+	}
+	return remoteInfo(st), nil
+}
+
+func (r remoteFS) readDir(name string) ([]info, error) {
+	stats, err := r.c.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+	var infos []info
+	for _, st := range stats {
+		infos = append(infos, remoteInfo(st))
+	}
+	return infos, nil
+}
+
+func (r remoteFS) open(name string, off int64) (io.ReadCloser, error) {
+	f, err := r.c.Open(name, protocol.OREAD)
+	if err != nil {
+		return nil, err
+	}
+	f.Seek(off, io.SeekStart)
+	return f, nil
+}
+
+func (r remoteFS) create(name string, perm uint32, off int64) (io.WriteCloser, error) {
+	if off > 0 {
+		f, err := r.c.Open(name, protocol.OWRITE)
+		if err != nil {
+			return nil, err
+		}
+		f.Seek(off, io.SeekStart)
+		return f, nil
+	}
+	if f, err := r.c.Open(name, protocol.OWRITE|protocol.OTRUNC); err == nil {
+		return f, nil
+	}
+	return r.c.Create(name, protocol.FileMode(perm), protocol.OWRITE)
+}
+
+func (r remoteFS) mkdir(name string, perm uint32) error {
+	f, err := r.c.Create(name, protocol.DMDIR|protocol.FileMode(perm), protocol.OREAD)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func (r remoteFS) setattr(name string, i info) error {
+	st := client.NullStat()
+	st.Mode = protocol.FileMode(i.perm)
+	if i.dir {
+		st.Mode |= protocol.DMDIR
+	}
+	st.Mtime = uint32(i.mtime)
+	return r.c.WriteStat(name, st)
+}
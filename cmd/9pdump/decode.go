@@ -0,0 +1,368 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Message types of 9P2000.
+const (
+	Tversion = 100 + iota
+	Rversion
+	Tauth
+	Rauth
+	Tattach
+	Rattach
+	Terror
+	Rerror
+	Tflush
+	Rflush
+	Twalk
+	Rwalk
+	Topen
+	Ropen
+	Tcreate
+	Rcreate
+	Tread
+	Rread
+	Twrite
+	Rwrite
+	Tclunk
+	Rclunk
+	Tremove
+	Rremove
+	Tstat
+	Rstat
+	Twstat
+	Rwstat
+)
+
+var typeNames = map[uint8]string{
+	Tversion: "Tversion", Rversion: "Rversion",
+	Tauth: "Tauth", Rauth: "Rauth",
+	Tattach: "Tattach", Rattach: "Rattach",
+	Terror: "Terror", Rerror: "Rerror",
+	Tflush: "Tflush", Rflush: "Rflush",
+	Twalk: "Twalk", Rwalk: "Rwalk",
+	Topen: "Topen", Ropen: "Ropen",
+	Tcreate: "Tcreate", Rcreate: "Rcreate",
+	Tread: "Tread", Rread: "Rread",
+	Twrite: "Twrite", Rwrite: "Rwrite",
+	Tclunk: "Tclunk", Rclunk: "Rclunk",
+	Tremove: "Tremove", Rremove: "Rremove",
+	Tstat: "Tstat", Rstat: "Rstat",
+	Twstat: "Twstat", Rwstat: "Rwstat",
+}
+
+const noFid = ^uint32(0)
+
+// message is a decoded 9P message. Only the fields of its type are set.
+type message struct {
+	size  uint32
+	typ   uint8
+	tag   uint16
+	fid   uint32
+	fid2  uint32 // afid or newfid
+	names []string
+	qids  []qid
+	text  string // version, error or created name
+	user  string
+	aname string
+	msize uint32
+	mode  uint8
+	perm  uint32
+	off   uint64
+	count uint32
+	data  []byte
+	stat  *stat
+	// raw is set for messages of unknown types.
+	raw []byte
+}
+
+type qid struct {
+	typ     uint8
+	version uint32
+	path    uint64
+}
+
+func (q qid) String() string {
+	return fmt.Sprintf("(%016x %d %02x)", q.path, q.version, q.typ)
+}
+
+type stat struct {
+	typ    uint16
+	dev    uint32
+	qid    qid
+	mode   uint32
+	atime  uint32
+	mtime  uint32
+	length uint64
+	name   string
+	uid    string
+	gid    string
+	muid   string
+}
+
+func (s *stat) String() string {
+	return fmt.Sprintf("'%s' '%s' '%s' '%s' q %v m %#o at %d mt %d l %d t %d d %d",
+		s.name, s.uid, s.gid, s.muid, s.qid, s.mode, s.atime, s.mtime, s.length, s.typ, s.dev)
+}
+
+func (m *message) isRequest() bool {
+	return m.typ%2 == 0
+}
+
+func (m *message) name() string {
+	if n, ok := typeNames[m.typ]; ok {
+		return n
+	}
+	return fmt.Sprintf("type%d", m.typ)
+}
+
+var errShort = errors.New("message too short")
+
+// reader decodes the fields of a message body.
+type reader struct {
+	b   []byte
+	err error
+}
+
+func (r *reader) take(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if len(r.b) < n {
+		r.err = errShort
+		return nil
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+func (r *reader) u8() uint8 {
+	b := r.take(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (r *reader) u16() uint16 {
+	b := r.take(2)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint16(b)
+}
+
+func (r *reader) u32() uint32 {
+	b := r.take(4)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(b)
+}
+
+func (r *reader) u64() uint64 {
+	b := r.take(8)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint64(b)
+}
+
+func (r *reader) str() string {
+	return string(r.take(int(r.u16())))
+}
+
+func (r *reader) qid() qid {
+	return qid{typ: r.u8(), version: r.u32(), path: r.u64()}
+}
+
+func (r *reader) stat() *stat {
+	n := r.u16()
+	sr := &reader{b: r.take(int(n))}
+	if r.err != nil {
+		return nil
+	}
+	// The stat is prefixed by its own size as well.
+	sr.u16()
+	s := &stat{
+		typ:    sr.u16(),
+		dev:    sr.u32(),
+		qid:    sr.qid(),
+		mode:   sr.u32(),
+		atime:  sr.u32(),
+		mtime:  sr.u32(),
+		length: sr.u64(),
+		name:   sr.str(),
+		uid:    sr.str(),
+		gid:    sr.str(),
+		muid:   sr.str(),
+	}
+	if sr.err != nil {
+		r.err = sr.err
+		return nil
+	}
+	return s
+}
+
+// decode decodes a complete message, including its size.
+func decode(b []byte) (*message, error) {
+	r := &reader{b: b}
+	m := &message{size: r.u32(), typ: r.u8(), tag: r.u16()}
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	switch m.typ {
+	case Tversion, Rversion:
+		m.msize = r.u32()
+		m.text = r.str()
+	case Tauth:
+		m.fid2 = r.u32()
+		m.user = r.str()
+		m.aname = r.str()
+	case Tattach:
+		m.fid = r.u32()
+		m.fid2 = r.u32()
+		m.user = r.str()
+		m.aname = r.str()
+	case Rauth, Rattach:
+		m.qids = []qid{r.qid()}
+	case Rerror:
+		m.text = r.str()
+	case Tflush:
+		m.count = uint32(r.u16())
+	case Twalk:
+		m.fid = r.u32()
+		m.fid2 = r.u32()
+		n := int(r.u16())
+		for i := 0; i < n && r.err == nil; i++ {
+			m.names = append(m.names, r.str())
+		}
+	case Rwalk:
+		n := int(r.u16())
+		for i := 0; i < n && r.err == nil; i++ {
+			m.qids = append(m.qids, r.qid())
+		}
+	case Topen:
+		m.fid = r.u32()
+		m.mode = r.u8()
+	case Tcreate:
+		m.fid = r.u32()
+		m.text = r.str()
+		m.perm = r.u32()
+		m.mode = r.u8()
+	case Ropen, Rcreate:
+		m.qids = []qid{r.qid()}
+		m.count = r.u32()
+	case Tread:
+		m.fid = r.u32()
+		m.off = r.u64()
+		m.count = r.u32()
+	case Rread:
+		m.count = r.u32()
+		m.data = r.take(int(m.count))
+	case Twrite:
+		m.fid = r.u32()
+		m.off = r.u64()
+		m.count = r.u32()
+		m.data = r.take(int(m.count))
+	case Rwrite:
+		m.count = r.u32()
+	case Tclunk, Tremove, Tstat:
+		m.fid = r.u32()
+	case Rstat:
+		m.stat = r.stat()
+	case Twstat:
+		m.fid = r.u32()
+		m.stat = r.stat()
+	case Rflush, Rclunk, Rremove, Rwstat:
+	default:
+		m.raw = r.b
+	}
+	if r.err != nil {
+		return nil, fmt.Errorf("%s: %v", m.name(), r.err)
+	}
+	return m, nil
+}
+
+// fidString formats a fid, along with the path it was walked to, if known.
+func fidString(fid uint32, paths map[uint32]string) string {
+	if fid == noFid {
+		return "nofid"
+	}
+	if p, ok := paths[fid]; ok {
+		return fmt.Sprintf("%d (%s)", fid, p)
+	}
+	return fmt.Sprintf("%d", fid)
+}
+
+// dataString formats up to n bytes of data.
+func dataString(b []byte, n int) string {
+	s := b
+	if len(s) > n {
+		s = s[:n]
+	}
+	q := fmt.Sprintf("%q", s)
+	if len(b) > n {
+		q += "..."
+	}
+	return q
+}
+
+// format formats the fields of m in the style of the Plan 9 kernel's 9P
+// debug output, using paths to annotate fids.
+func (m *message) format(paths map[uint32]string, max int) string {
+	var f string
+	switch m.typ {
+	case Tversion, Rversion:
+		f = fmt.Sprintf("msize %d version '%s'", m.msize, m.text)
+	case Tauth:
+		f = fmt.Sprintf("afid %s uname '%s' aname '%s'", fidString(m.fid2, paths), m.user, m.aname)
+	case Tattach:
+		f = fmt.Sprintf("fid %s afid %s uname '%s' aname '%s'", fidString(m.fid, paths), fidString(m.fid2, paths), m.user, m.aname)
+	case Rauth, Rattach:
+		f = fmt.Sprintf("qid %v", m.qids[0])
+	case Rerror:
+		f = fmt.Sprintf("ename '%s'", m.text)
+	case Tflush:
+		f = fmt.Sprintf("oldtag %d", m.count)
+	case Twalk:
+		f = fmt.Sprintf("fid %s newfid %d nwname %d '%s'", fidString(m.fid, paths), m.fid2, len(m.names), strings.Join(m.names, "' '"))
+	case Rwalk:
+		var qs []string
+		for _, q := range m.qids {
+			qs = append(qs, q.String())
+		}
+		f = fmt.Sprintf("nwqid %d %s", len(m.qids), strings.Join(qs, " "))
+	case Topen:
+		f = fmt.Sprintf("fid %s mode %d", fidString(m.fid, paths), m.mode)
+	case Tcreate:
+		f = fmt.Sprintf("fid %s name '%s' perm %#o mode %d", fidString(m.fid, paths), m.text, m.perm, m.mode)
+	case Ropen, Rcreate:
+		f = fmt.Sprintf("qid %v iounit %d", m.qids[0], m.count)
+	case Tread:
+		f = fmt.Sprintf("fid %s offset %d count %d", fidString(m.fid, paths), m.off, m.count)
+	case Rread:
+		f = fmt.Sprintf("count %d %s", m.count, dataString(m.data, max))
+	case Twrite:
+		f = fmt.Sprintf("fid %s offset %d count %d %s", fidString(m.fid, paths), m.off, m.count, dataString(m.data, max))
+	case Rwrite:
+		f = fmt.Sprintf("count %d", m.count)
+	case Tclunk, Tremove, Tstat:
+		f = fmt.Sprintf("fid %s", fidString(m.fid, paths))
+	case Rstat:
+		f = fmt.Sprintf("stat %v", m.stat)
+	case Twstat:
+		f = fmt.Sprintf("fid %s stat %v", fidString(m.fid, paths), m.stat)
+	case Rflush, Rclunk, Rremove, Rwstat:
+	default:
+		f = fmt.Sprintf("size %d %s", m.size, dataString(m.raw, max))
+	}
+	return fmt.Sprintf("%s tag %d %s", m.name(), m.tag, f)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Link types of pcap files.
+const (
+	linkNull     = 0
+	linkEthernet = 1
+	linkRaw      = 101
+	linkLoop     = 108
+	linkSLL      = 113
+	linkSLL2     = 276
+)
+
+var errPcapng = errors.New("pcapng files are not supported, convert with editcap -F pcap")
+
+// pcapReader reads the packets of a pcap file.
+type pcapReader struct {
+	r     io.Reader
+	order binary.ByteOrder
+	nano  bool
+	link  uint32
+}
+
+func newPcapReader(r io.Reader) (*pcapReader, error) {
+	var hdr [24]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+
+	p := &pcapReader{r: r}
+	switch binary.LittleEndian.Uint32(hdr[:4]) {
+	case 0xa1b2c3d4:
+		p.order = binary.LittleEndian
+	case 0xa1b23c4d:
+		p.order, p.nano = binary.LittleEndian, true
+	case 0xd4c3b2a1:
+		p.order = binary.BigEndian
+	case 0x4d3cb2a1:
+		p.order, p.nano = binary.BigEndian, true
+	case 0x0a0d0d0a:
+		return nil, errPcapng
+	default:
+		return nil, errors.New("not a pcap file")
+	}
+	p.link = p.order.Uint32(hdr[20:]) & 0x0fffffff
+	return p, nil
+}
+
+// next returns the time and data of the next packet.
+func (p *pcapReader) next() (time.Time, []byte, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(p.r, hdr[:]); err != nil {
+		return time.Time{}, nil, err
+	}
+	sec, frac := p.order.Uint32(hdr[0:]), p.order.Uint32(hdr[4:])
+	n := p.order.Uint32(hdr[8:])
+	if n > 1<<24 {
+		return time.Time{}, nil, fmt.Errorf("packet of %d bytes is too large", n)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(p.r, b); err != nil {
+		return time.Time{}, nil, err
+	}
+
+	if !p.nano {
+		frac *= 1000
+	}
+	return time.Unix(int64(sec), int64(frac)), b, nil
+}
+
+// segment is the payload of a TCP segment.
+type segment struct {
+	src, dst string
+	seq      uint32
+	syn, fin bool
+	data     []byte
+}
+
+// tcp extracts the TCP segment of a packet of the given link type. ok is
+// false for packets that are not TCP over IPv4 or IPv6.
+func tcp(link uint32, b []byte) (seg segment, ok bool) {
+	var ethertype uint16
+	switch link {
+	case linkNull, linkLoop:
+		if len(b) < 4 {
+			return seg, false
+		}
+		// The address family is in host byte order for null, and
+		// network byte order for loop, so accept either.
+		family := binary.LittleEndian.Uint32(b)
+		if link == linkLoop {
+			family = binary.BigEndian.Uint32(b)
+		}
+		b = b[4:]
+		switch family {
+		case 2:
+			ethertype = 0x0800
+		case 10, 24, 28, 30:
+			ethertype = 0x86dd
+		default:
+			return seg, false
+		}
+	case linkEthernet:
+		if len(b) < 14 {
+			return seg, false
+		}
+		ethertype = binary.BigEndian.Uint16(b[12:])
+		b = b[14:]
+		for ethertype == 0x8100 && len(b) >= 4 {
+			ethertype = binary.BigEndian.Uint16(b[2:])
+			b = b[4:]
+		}
+	case linkRaw:
+		if len(b) < 1 {
+			return seg, false
+		}
+		ethertype = 0x0800
+		if b[0]>>4 == 6 {
+			ethertype = 0x86dd
+		}
+	case linkSLL:
+		if len(b) < 16 {
+			return seg, false
+		}
+		ethertype = binary.BigEndian.Uint16(b[14:])
+		b = b[16:]
+	case linkSLL2:
+		if len(b) < 20 {
+			return seg, false
+		}
+		ethertype = binary.BigEndian.Uint16(b[0:])
+		b = b[20:]
+	default:
+		return seg, false
+	}
+
+	var src, dst string
+	switch ethertype {
+	case 0x0800:
+		if len(b) < 20 || b[9] != 6 {
+			return seg, false
+		}
+		ihl := int(b[0]&0x0f) * 4
+		total := int(binary.BigEndian.Uint16(b[2:]))
+		if ihl < 20 || total < ihl || len(b) < total {
+			return seg, false
+		}
+		src = fmt.Sprintf("%d.%d.%d.%d", b[12], b[13], b[14], b[15])
+		dst = fmt.Sprintf("%d.%d.%d.%d", b[16], b[17], b[18], b[19])
+		b = b[ihl:total]
+	case 0x86dd:
+		// Extension headers are not supported.
+		if len(b) < 40 || b[6] != 6 {
+			return seg, false
+		}
+		plen := int(binary.BigEndian.Uint16(b[4:]))
+		if len(b) < 40+plen {
+			return seg, false
+		}
+		src = fmt.Sprintf("[%x]", b[8:24])
+		dst = fmt.Sprintf("[%x]", b[24:40])
+		b = b[40 : 40+plen]
+	default:
+		return seg, false
+	}
+
+	if len(b) < 20 {
+		return seg, false
+	}
+	off := int(b[12]>>4) * 4
+	if off < 20 || len(b) < off {
+		return seg, false
+	}
+	seg.src = fmt.Sprintf("%s:%d", src, binary.BigEndian.Uint16(b[0:]))
+	seg.dst = fmt.Sprintf("%s:%d", dst, binary.BigEndian.Uint16(b[2:]))
+	seg.seq = binary.BigEndian.Uint32(b[4:])
+	seg.syn = b[13]&0x02 != 0
+	seg.fin = b[13]&0x01 != 0
+	seg.data = b[off:]
+	return seg, true
+}
+
+// port returns the port of an address as formatted by tcp.
+func port(addr string) string {
+	for i := len(addr) - 1; i >= 0; i-- {
+		if addr[i] == ':' {
+			return addr[i+1:]
+		}
+	}
+	return ""
+}
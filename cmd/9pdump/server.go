@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// maxMessage is the largest message size accepted before a stream is
+// considered out of sync.
+const maxMessage = 16 * 1024 * 1024
+
+const noTag = ^uint16(0)
+
+type request struct {
+	m *message
+	t time.Time
+}
+
+// conn is the state of a 9P connection, shared by both directions.
+type conn struct {
+	name    string
+	pending map[uint16]request
+	paths   map[uint32]string
+}
+
+// stream is one direction of a TCP connection.
+type stream struct {
+	conn   *conn
+	name   string
+	synced bool
+	next   uint32
+	buf    []byte
+}
+
+type dumper struct {
+	w       *bufio.Writer
+	max     int
+	ports   map[string]bool
+	conns   map[string]*conn
+	streams map[string]*stream
+}
+
+func newConn(name string) *conn {
+	return &conn{
+		name:    name,
+		pending: make(map[uint16]request),
+		paths:   make(map[uint32]string),
+	}
+}
+
+// message prints a message, correlating responses with their requests, and
+// keeps track of the paths of fids.
+func (d *dumper) message(c *conn, t time.Time, m *message) {
+	var prefix string
+	if !t.IsZero() {
+		prefix = t.Format("15:04:05.000000") + " "
+	}
+	if c.name != "" {
+		prefix += c.name + " "
+	}
+
+	if m.isRequest() {
+		note := ""
+		if _, ok := c.pending[m.tag]; ok && m.tag != noTag {
+			note = " (tag in use)"
+		}
+		c.pending[m.tag] = request{m: m, t: t}
+		fmt.Fprintf(d.w, "%s-> %s%s\n", prefix, m.format(c.paths, d.max), note)
+		return
+	}
+
+	req, ok := c.pending[m.tag]
+	delete(c.pending, m.tag)
+	note := " (no request)"
+	if ok {
+		note = " [" + typeNames[req.m.typ]
+		if !t.IsZero() && !req.t.IsZero() {
+			note += " " + t.Sub(req.t).String()
+		}
+		note += "]"
+	}
+	fmt.Fprintf(d.w, "%s<- %s%s\n", prefix, m.format(c.paths, d.max), note)
+	if !ok {
+		return
+	}
+
+	r := req.m
+	switch r.typ {
+	case Tversion:
+		c.pending = make(map[uint16]request)
+		c.paths = make(map[uint32]string)
+	case Tflush:
+		delete(c.pending, uint16(r.count))
+	case Tattach:
+		if m.typ == Rattach {
+			c.paths[r.fid] = "/"
+			if r.aname != "" {
+				c.paths[r.fid] = r.aname + ":/"
+			}
+		}
+	case Twalk:
+		if m.typ == Rwalk && len(m.qids) == len(r.names) {
+			if base, ok := c.paths[r.fid]; ok {
+				c.paths[r.fid2] = joinPath(base, r.names...)
+			} else {
+				delete(c.paths, r.fid2)
+			}
+		}
+	case Tcreate:
+		if base, ok := c.paths[r.fid]; ok && m.typ == Rcreate {
+			c.paths[r.fid] = joinPath(base, r.text)
+		}
+	case Tclunk, Tremove:
+		// The fid is gone even if the request failed.
+		delete(c.paths, r.fid)
+	}
+}
+
+// joinPath joins names to a path as formatted for an attach, which may start
+// with an attach name.
+func joinPath(base string, names ...string) string {
+	prefix := ""
+	if idx := strings.Index(base, ":/"); idx != -1 {
+		prefix, base = base[:idx+1], base[idx+1:]
+	}
+	return prefix + path.Join(append([]string{base}, names...)...)
+}
+
+// feed adds data to a stream, and prints the messages completed by it.
+func (d *dumper) feed(s *stream, t time.Time, b []byte) {
+	s.buf = append(s.buf, b...)
+	for len(s.buf) >= 4 {
+		size := binary.LittleEndian.Uint32(s.buf)
+		if size < 7 || size > maxMessage {
+			fmt.Fprintf(d.w, "%s: lost sync, dropping %d bytes\n", s.name, len(s.buf))
+			s.buf = nil
+			return
+		}
+		if uint32(len(s.buf)) < size {
+			return
+		}
+		m, err := decode(s.buf[:size])
+		if err != nil {
+			fmt.Fprintf(d.w, "%s: %v\n", s.name, err)
+		} else {
+			d.message(s.conn, t, m)
+		}
+		s.buf = s.buf[size:]
+	}
+}
+
+// segment adds a TCP segment to its stream.
+func (d *dumper) segment(t time.Time, seg segment) {
+	if len(d.ports) > 0 && !d.ports[port(seg.src)] && !d.ports[port(seg.dst)] {
+		return
+	}
+
+	key := seg.src + " > " + seg.dst
+	s, ok := d.streams[key]
+	if !ok {
+		// Both directions share the state of the connection.
+		a, b := seg.src, seg.dst
+		if b < a {
+			a, b = b, a
+		}
+		name := a + " " + b
+		c, ok := d.conns[name]
+		if !ok {
+			c = newConn(name)
+			d.conns[name] = c
+		}
+		s = &stream{conn: c, name: key}
+		d.streams[key] = s
+	}
+
+	data := seg.data
+	switch {
+	case seg.syn:
+		s.synced, s.next, s.buf = true, seg.seq+1, nil
+		return
+	case !s.synced:
+		// The capture started in the middle of the connection, so the
+		// first message may be cut short.
+		s.synced, s.next = true, seg.seq
+	}
+
+	diff := int32(seg.seq - s.next)
+	switch {
+	case diff > 0:
+		fmt.Fprintf(d.w, "%s: %d bytes missing from capture\n", key, diff)
+		s.buf, s.next = nil, seg.seq
+	case diff < 0:
+		// Retransmitted data.
+		if int(-diff) >= len(data) {
+			return
+		}
+		data = data[-diff:]
+	}
+	s.next += uint32(len(data))
+	if len(data) > 0 {
+		d.feed(s, t, data)
+	}
+}
+
+// dumpPcap dumps the 9P traffic of a pcap file.
+func (d *dumper) dumpPcap(r io.Reader) error {
+	p, err := newPcapReader(r)
+	if err != nil {
+		return err
+	}
+	for {
+		t, b, err := p.next()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if seg, ok := tcp(p.link, b); ok {
+			d.segment(t, seg)
+		}
+	}
+}
+
+// dumpRaw dumps a stream of 9P messages, without timing.
+func (d *dumper) dumpRaw(r io.Reader) error {
+	c := newConn("")
+	var size [4]byte
+	for {
+		if _, err := io.ReadFull(r, size[:]); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		n := binary.LittleEndian.Uint32(size[:])
+		if n < 7 || n > maxMessage {
+			return fmt.Errorf("invalid message size %d", n)
+		}
+		b := make([]byte, n)
+		copy(b, size[:])
+		if _, err := io.ReadFull(r, b[4:]); err != nil {
+			return err
+		}
+		m, err := decode(b)
+		if err != nil {
+			return err
+		}
+		d.message(c, time.Time{}, m)
+	}
+}
+
+// dump dumps a file, which is read as pcap if it starts like one.
+func (d *dumper) dump(r io.Reader, raw bool) error {
+	br := bufio.NewReader(r)
+	if !raw {
+		magic, err := br.Peek(4)
+		if err == nil {
+			switch binary.LittleEndian.Uint32(magic) {
+			case 0xa1b2c3d4, 0xa1b23c4d, 0xd4c3b2a1, 0x4d3cb2a1, 0x0a0d0d0a:
+				return d.dumpPcap(br)
+			}
+		}
+	}
+	return d.dumpRaw(br)
+}
+
+func main() {
+	ports := flag.String("ports", "564,5640", "comma-separated TCP ports to decode in pcap files, or empty for all")
+	dataMax := flag.Int("data", 32, "maximum number of bytes of read and written data to show")
+	raw := flag.Bool("raw", false, "read files as raw 9P streams, even if they look like pcap files")
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		fmt.Printf("Too few arguments\n")
+		fmt.Printf("%s [-ports ports] [-data bytes] [-raw] file...\n", os.Args[0])
+		fmt.Printf("files are pcap captures or raw 9P streams, or - for standard input\n")
+		return
+	}
+
+	d := &dumper{
+		w:       bufio.NewWriter(os.Stdout),
+		max:     *dataMax,
+		ports:   make(map[string]bool),
+		conns:   make(map[string]*conn),
+		streams: make(map[string]*stream),
+	}
+	defer d.w.Flush()
+	for _, p := range strings.Split(*ports, ",") {
+		if p != "" {
+			d.ports[p] = true
+		}
+	}
+
+	for _, name := range flag.Args() {
+		var r io.Reader = os.Stdin
+		if name != "-" {
+			f, err := os.Open(name)
+			if err != nil {
+				log.Fatalf("Unable to open %s: %v", name, err)
+			}
+			defer f.Close()
+			r = f
+		}
+		if err := d.dump(r, *raw); err != nil {
+			d.w.Flush()
+			log.Fatalf("%s: %v", name, err)
+		}
+	}
+}
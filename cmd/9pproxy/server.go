@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/kennylevinsen/g9p"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+	"github.com/kennylevinsen/g9ptools/proxy"
+	"github.com/kennylevinsen/g9ptools/record"
+	"github.com/kennylevinsen/g9ptools/transport"
+)
+
+// sessionKey is the context key of the upstream of a session.
+type sessionKey struct{}
+
+func main() {
+	readOnly := flag.Bool("readonly", false, "reject all modifying requests")
+	hide := flag.String("hide", "", "comma-separated list of path patterns to hide")
+	cache := flag.Int("cache", 0, "size of the read cache in bytes, 0 to disable")
+	cacheTTL := flag.Duration("cachettl", time.Second, "time to trust cached reads before revalidating with upstream")
+	recordFile := flag.String("record", "", "record all sessions to file, for replay with 9preplay")
+	flag.Parse()
+
+	if flag.NArg() < 2 {
+		fmt.Printf("Too few arguments\n")
+		fmt.Printf("%s [-readonly] [-hide patterns] [-cache bytes] [-cachettl duration] [-record file] upstream address\n", os.Args[0])
+		fmt.Printf("address is a dial string, such as :5640, or stdio to serve a single session on standard input and output\n")
+		return
+	}
+
+	upstream := flag.Arg(0)
+	addr := flag.Arg(1)
+
+	rules := proxy.Rules{ReadOnly: *readOnly}
+	if *hide != "" {
+		rules.Hide = strings.Split(*hide, ",")
+	}
+
+	conn, err := net.Dial("tcp", upstream)
+	if err != nil {
+		log.Fatalf("Unable to connect to upstream: %v", err)
+	}
+
+	up, err := proxy.NewUpstream(conn)
+	if err != nil {
+		log.Fatalf("Unable to negotiate with upstream: %v", err)
+	}
+
+	if *cache > 0 {
+		up.Cache = proxy.NewCache(*cache, *cacheTTL)
+	}
+
+	l, err := transport.ListenDialString(addr)
+	if err != nil {
+		log.Fatalf("Unable to listen: %v", err)
+	}
+
+	h := proxy.Handler(up, rules)
+	if *recordFile != "" {
+		f, err := os.OpenFile(*recordFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			log.Fatalf("Unable to open recording: %v", err)
+		}
+		defer f.Close()
+		rec := record.NewRecorder(f)
+		session := h
+		h = func() g9p.Handler {
+			// A new context per session, which tells the sessions
+			// apart in the recording.
+			ctx := context.WithValue(context.Background(), sessionKey{}, upstream)
+			return fileserver.Intercept(ctx, session(), rec)
+		}
+	}
+
+	log.Printf("Starting proxy for %s at %s", upstream, addr)
+	transport.Ready()
+	g9p.ServeListener(l, h)
+}
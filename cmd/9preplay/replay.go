@@ -0,0 +1,84 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/kennylevinsen/g9p"
+	"github.com/kennylevinsen/g9ptools/record"
+	"github.com/kennylevinsen/g9ptools/transport"
+)
+
+func main() {
+	session := flag.Int("session", 1, "the recorded session to replay")
+	flag.Parse()
+
+	if flag.NArg() < 3 {
+		fmt.Printf("Too few arguments\n")
+		fmt.Printf("%s [-session n] drive recording dialstring\n", os.Args[0])
+		fmt.Printf("%s [-session n] serve recording dialstring\n", os.Args[0])
+		fmt.Printf("drive sends the recorded requests to a server, and reports differing responses\n")
+		fmt.Printf("serve answers a client with the recorded responses\n")
+		return
+	}
+
+	mode := flag.Arg(0)
+	network, address, err := transport.ParseDialString(flag.Arg(2))
+	if err != nil {
+		log.Fatalf("Invalid address: %v", err)
+	}
+
+	f, err := os.Open(flag.Arg(1))
+	if err != nil {
+		log.Fatalf("Unable to open recording: %v", err)
+	}
+	entries, err := record.ReadSession(f, *session)
+	f.Close()
+	if err != nil {
+		log.Fatalf("Unable to read recording: %v", err)
+	}
+	xs := record.Exchanges(entries)
+
+	switch mode {
+	case "drive":
+		conn, err := transport.Dial(network, address)
+		if err != nil {
+			log.Fatalf("Unable to connect: %v", err)
+		}
+		c := g9p.NewClient(conn)
+		go c.Start()
+		defer c.Stop()
+
+		mismatches, err := record.Replay(c, xs)
+		if err != nil {
+			log.Fatalf("Replay failed: %v", err)
+		}
+		for _, m := range mismatches {
+			req := m.Exchange.Request
+			fmt.Printf("%s %+v\n", req.Type, req.Message)
+			if rec := m.Exchange.Response; rec.Error != "" {
+				fmt.Printf("\trecorded: error %s\n", rec.Error)
+			} else {
+				fmt.Printf("\trecorded: %+v\n", rec.Message)
+			}
+			if m.Error != nil {
+				fmt.Printf("\treplayed: error %v\n", m.Error)
+			} else {
+				fmt.Printf("\treplayed: %+v\n", m.Response)
+			}
+		}
+		fmt.Printf("%d of %d responses differ\n", len(mismatches), len(xs))
+	case "serve":
+		l, err := transport.Listen(network, address)
+		if err != nil {
+			log.Fatalf("Unable to listen: %v", err)
+		}
+		p := record.NewPlayer(xs)
+		log.Printf("Serving %d recorded responses at %s", len(xs), address)
+		g9p.ServeListener(l, p.Handler)
+	default:
+		log.Fatalf("Unknown mode %q", mode)
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/kennylevinsen/g9p"
+	"github.com/kennylevinsen/g9ptools/srv"
+	"github.com/kennylevinsen/g9ptools/transport"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Printf("Too few arguments\n")
+		fmt.Printf("%s address\n", os.Args[0])
+		fmt.Printf("Servers post with \"post name\", clients attach to \"name\" or \"name/aname\"\n")
+		return
+	}
+
+	addr := os.Args[1]
+
+	l, err := transport.ListenDialString(addr)
+	if err != nil {
+		log.Fatalf("Unable to listen: %v", err)
+	}
+
+	b := srv.NewBroker()
+	log.Printf("Starting srv broker at %s", addr)
+	transport.Ready()
+	g9p.ServeListener(b.Listener(l), b.Handler())
+}
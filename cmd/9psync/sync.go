@@ -0,0 +1,278 @@
+// 9psync mirrors a local directory to or from a 9P tree, copying only the
+// files that changed, as told by their size, modification time and qid
+// version. The qid versions of remote files seen by the last sync are kept
+// in a .9psync file in the local directory, so that a remote file changed
+// without changing its size or modification time is copied again.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/kennylevinsen/g9ptools/auth"
+	"github.com/kennylevinsen/g9ptools/client"
+	"github.com/kennylevinsen/g9ptools/transport"
+)
+
+// stateFile holds the qid versions of remote files, by path.
+const stateFile = ".9psync"
+
+var errTypeDiffers = errors.New("file and directory differ")
+
+type syncer struct {
+	src, dst tree
+	// versions holds the last known qid version of remote files.
+	versions map[string]uint32
+	// remoteSrc is set when pulling, and tells which side versions are of.
+	remoteSrc bool
+	dryRun    bool
+	delete    bool
+	// checksum compares the content of files of the same size, rather
+	// than their modification times.
+	checksum bool
+
+	copied, removed, failed int
+}
+
+// unchanged reports whether a file needs no copying.
+func (s *syncer) unchanged(name string, src, dst entry) bool {
+	if src.size != dst.size {
+		return false
+	}
+	if s.checksum {
+		// Checksums of remote files are computed by the server, so only
+		// the digest crosses the wire.
+		ssum, err := s.src.sum(name)
+		if err != nil {
+			return false
+		}
+		dsum, err := s.dst.sum(name)
+		return err == nil && bytes.Equal(ssum, dsum)
+	}
+	if src.mtime != dst.mtime {
+		return false
+	}
+	remote := dst
+	if s.remoteSrc {
+		remote = src
+	}
+	v, ok := s.versions[name]
+	return !ok || v == remote.version
+}
+
+func (s *syncer) fail(action, name string, err error) {
+	fmt.Printf("%s %s failed: %v\n", action, name, err)
+	s.failed++
+}
+
+func (s *syncer) copy(name string, e entry) (entry, error) {
+	in, err := s.src.open(name)
+	if err != nil {
+		return e, err
+	}
+	defer in.Close()
+	out, err := s.dst.create(name, e)
+	if err != nil {
+		return e, err
+	}
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return e, err
+	}
+	return s.dst.finish(name, e)
+}
+
+func (s *syncer) run() error {
+	srcEntries, err := s.src.list()
+	if err != nil {
+		return err
+	}
+	dstEntries, err := s.dst.list()
+	if err != nil {
+		return err
+	}
+
+	// Sorted, a directory comes before its content.
+	var names []string
+	for name := range srcEntries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		se := srcEntries[name]
+		de, exists := dstEntries[name]
+		if exists && se.dir != de.dir {
+			s.fail("replace", name, errTypeDiffers)
+			continue
+		}
+
+		if se.dir {
+			if exists {
+				continue
+			}
+			fmt.Printf("mkdir %s\n", name)
+			if !s.dryRun {
+				if err := s.dst.mkdir(name, se); err != nil {
+					s.fail("mkdir", name, err)
+				}
+			}
+			continue
+		}
+
+		if exists && s.unchanged(name, se, de) {
+			if s.remoteSrc {
+				s.versions[name] = se.version
+			} else {
+				s.versions[name] = de.version
+			}
+			continue
+		}
+		fmt.Printf("copy %s\n", name)
+		s.copied++
+		if s.dryRun {
+			continue
+		}
+		ne, err := s.copy(name, se)
+		if err != nil {
+			s.fail("copy", name, err)
+			continue
+		}
+		if s.remoteSrc {
+			s.versions[name] = se.version
+		} else {
+			s.versions[name] = ne.version
+		}
+	}
+
+	if !s.delete {
+		return nil
+	}
+
+	// In reverse, the content of a directory is removed before it.
+	var extra []string
+	for name := range dstEntries {
+		if _, ok := srcEntries[name]; !ok {
+			extra = append(extra, name)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(extra)))
+	for _, name := range extra {
+		fmt.Printf("remove %s\n", name)
+		s.removed++
+		delete(s.versions, name)
+		if s.dryRun {
+			continue
+		}
+		if err := s.dst.remove(name); err != nil {
+			s.fail("remove", name, err)
+		}
+	}
+	return nil
+}
+
+func loadVersions(dir string) map[string]uint32 {
+	versions := make(map[string]uint32)
+	b, err := ioutil.ReadFile(filepath.Join(dir, stateFile))
+	if err != nil {
+		return versions
+	}
+	if err := json.Unmarshal(b, &versions); err != nil {
+		log.Printf("Ignoring invalid %s: %v", stateFile, err)
+	}
+	return versions
+}
+
+func saveVersions(dir string, versions map[string]uint32) error {
+	b, err := json.Marshal(versions)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, stateFile), b, 0644)
+}
+
+func main() {
+	dryRun := flag.Bool("n", false, "only print what would be done")
+	del := flag.Bool("delete", false, "remove files missing from the source")
+	keyfile := flag.String("keys", "", "authenticate with the keys in file")
+	checksum := flag.Bool("c", false, "compare files by checksum, for servers serving name.sum")
+	flag.Parse()
+
+	if flag.NArg() < 5 {
+		fmt.Printf("Too few arguments\n")
+		fmt.Printf("%s [-n] [-c] [-delete] [-keys file] push|pull localdir dialstring user service [remotedir]\n", os.Args[0])
+		fmt.Printf("push mirrors localdir to remotedir, pull mirrors remotedir to localdir\n")
+		fmt.Printf("remotedir defaults to the root of the service\n")
+		return
+	}
+
+	mode, localdir := flag.Arg(0), flag.Arg(1)
+	remotedir := "/"
+	if flag.NArg() > 5 {
+		remotedir = flag.Arg(5)
+	}
+	network, address, err := transport.ParseDialString(flag.Arg(2))
+	if err != nil {
+		log.Fatalf("Invalid address: %v", err)
+	}
+
+	c := client.NewConn(func() (io.ReadWriteCloser, error) {
+		return transport.Dial(network, address)
+	}, flag.Arg(3), flag.Arg(4))
+	if *keyfile != "" {
+		if c.Keys, err = auth.LoadKeys(*keyfile); err != nil {
+			log.Fatalf("Unable to load keys: %v", err)
+		}
+	}
+	if err := c.Connect(); err != nil {
+		log.Fatalf("Connect failed: %v", err)
+	}
+	defer c.Close()
+
+	local := &localTree{root: localdir}
+	remote := &remoteTree{c: c, root: remotedir}
+	s := &syncer{
+		versions: loadVersions(localdir),
+		dryRun:   *dryRun,
+		delete:   *del,
+		checksum: *checksum,
+	}
+	switch mode {
+	case "push":
+		s.src, s.dst = local, remote
+	case "pull":
+		s.src, s.dst, s.remoteSrc = remote, local, true
+		if !*dryRun {
+			if err := os.MkdirAll(localdir, 0755); err != nil {
+				log.Fatalf("Unable to create %s: %v", localdir, err)
+			}
+		}
+	default:
+		log.Fatalf("Unknown mode: %s", mode)
+	}
+
+	if err := s.run(); err != nil {
+		log.Fatalf("Sync failed: %v", err)
+	}
+	if !*dryRun {
+		if err := saveVersions(localdir, s.versions); err != nil {
+			log.Printf("Unable to save %s: %v", stateFile, err)
+		}
+	}
+	fmt.Printf("%d copied, %d removed, %d failed\n", s.copied, s.removed, s.failed)
+	if s.failed > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"crypto/sha256"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/client"
+)
+
+// entry is a file or directory of a tree, by its slash-separated path
+// relative to the root of the tree.
+type entry struct {
+	dir   bool
+	perm  protocol.FileMode
+	size  uint64
+	mtime uint32
+	// version is the qid version of a remote file, and zero for local ones.
+	version uint32
+}
+
+// tree is one side of a sync.
+type tree interface {
+	list() (map[string]entry, error)
+	open(name string) (io.ReadCloser, error)
+	// create opens a file for writing, truncating it if it exists.
+	create(name string, e entry) (io.WriteCloser, error)
+	mkdir(name string, e entry) error
+	remove(name string) error
+	// sum returns the SHA-256 of the content of a file.
+	sum(name string) ([]byte, error)
+	// finish sets the permissions and modification time of a copied file,
+	// and returns its entry as it now is.
+	finish(name string, e entry) (entry, error)
+}
+
+type localTree struct {
+	root string
+}
+
+func (t *localTree) path(name string) string {
+	return filepath.Join(t.root, filepath.FromSlash(name))
+}
+
+func (t *localTree) list() (map[string]entry, error) {
+	entries := make(map[string]entry)
+	err := filepath.Walk(t.root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(t.root, p)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if name == "." || name == stateFile {
+			return nil
+		}
+		if !fi.IsDir() && !fi.Mode().IsRegular() {
+			// Symlinks and devices have no 9P equivalent.
+			return nil
+		}
+		entries[name] = entry{
+			dir:   fi.IsDir(),
+			perm:  protocol.FileMode(fi.Mode().Perm()),
+			size:  uint64(fi.Size()),
+			mtime: uint32(fi.ModTime().Unix()),
+		}
+		return nil
+	})
+	return entries, err
+}
+
+func (t *localTree) open(name string) (io.ReadCloser, error) {
+	return os.Open(t.path(name))
+}
+
+func (t *localTree) create(name string, e entry) (io.WriteCloser, error) {
+	return os.OpenFile(t.path(name), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(e.perm))
+}
+
+func (t *localTree) mkdir(name string, e entry) error {
+	return os.Mkdir(t.path(name), os.FileMode(e.perm))
+}
+
+func (t *localTree) remove(name string) error {
+	return os.Remove(t.path(name))
+}
+
+func (t *localTree) sum(name string) ([]byte, error) {
+	f, err := os.Open(t.path(name))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+func (t *localTree) finish(name string, e entry) (entry, error) {
+	p := t.path(name)
+	if err := os.Chmod(p, os.FileMode(e.perm)); err != nil {
+		return e, err
+	}
+	mtime := time.Unix(int64(e.mtime), 0)
+	if err := os.Chtimes(p, mtime, mtime); err != nil {
+		return e, err
+	}
+	e.version = 0
+	return e, nil
+}
+
+type remoteTree struct {
+	c    *client.Conn
+	root string
+}
+
+func (t *remoteTree) path(name string) string {
+	return path.Join(t.root, name)
+}
+
+func remoteEntry(st protocol.Stat) entry {
+	return entry{
+		dir:     st.Mode&protocol.DMDIR != 0,
+		perm:    st.Mode & 0777,
+		size:    st.Length,
+		mtime:   st.Mtime,
+		version: st.Qid.Version,
+	}
+}
+
+func (t *remoteTree) list() (map[string]entry, error) {
+	entries := make(map[string]entry)
+	var walk func(dir string) error
+	walk = func(dir string) error {
+		stats, err := t.c.ReadDir(t.path(dir))
+		if err != nil {
+			return err
+		}
+		for _, st := range stats {
+			name := path.Join(dir, st.Name)
+			e := remoteEntry(st)
+			entries[name] = e
+			if e.dir {
+				if err := walk(name); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	return entries, walk("")
+}
+
+func (t *remoteTree) open(name string) (io.ReadCloser, error) {
+	return t.c.Open(t.path(name), protocol.OREAD)
+}
+
+func (t *remoteTree) create(name string, e entry) (io.WriteCloser, error) {
+	f, err := t.c.Open(t.path(name), protocol.OWRITE|protocol.OTRUNC)
+	if err == nil {
+		return f, nil
+	}
+	return t.c.Create(t.path(name), e.perm, protocol.OWRITE)
+}
+
+func (t *remoteTree) mkdir(name string, e entry) error {
+	f, err := t.c.Create(t.path(name), protocol.DMDIR|e.perm, protocol.OREAD)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func (t *remoteTree) remove(name string) error {
+	return t.c.Remove(t.path(name))
+}
+
+func (t *remoteTree) sum(name string) ([]byte, error) {
+	return t.c.Checksum(t.path(name))
+}
+
+func (t *remoteTree) finish(name string, e entry) (entry, error) {
+	st := client.NullStat()
+	st.Mode = e.perm
+	st.Mtime = e.mtime
+	if err := t.c.WriteStat(t.path(name), st); err != nil {
+		return e, err
+	}
+	nst, err := t.c.Stat(t.path(name))
+	if err != nil {
+		return e, err
+	}
+	return remoteEntry(nst), nil
+}
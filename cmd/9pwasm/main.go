@@ -0,0 +1,54 @@
+//go:build js && wasm
+// +build js,wasm
+
+// 9pwasm runs an in-memory 9P server in a browser, for demos and for testing
+// web-based 9P tooling without a backend. Build it with:
+//
+//	GOOS=js GOARCH=wasm go build -o 9pwasm.wasm
+//
+// and load it with the wasm_exec.js of the Go distribution. It defines a
+// global function g9pServe, which serves a session on a MessagePort, and
+// g9pConnect, which opens a WebSocket to a url, such as that of a relay, and
+// serves a session on it:
+//
+//	const ch = new MessageChannel();
+//	g9pServe(ch.port1);
+//	// speak 9P on ch.port2, or hand it to a worker
+package main
+
+import (
+	"log"
+	"syscall/js"
+
+	"github.com/kennylevinsen/g9ptools/fileserver"
+	"github.com/kennylevinsen/g9ptools/ramfs/ramtree"
+	"github.com/kennylevinsen/g9ptools/transport"
+)
+
+func main() {
+	root := ramtree.NewRAMTree("/", 0777, "glenda", "glenda")
+	newFS := func() *fileserver.FileServer {
+		return fileserver.NewFileServer(nil, map[string]fileserver.Dir{"ram": root}, 1024*1024, fileserver.Quiet)
+	}
+
+	js.Global().Set("g9pServe", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		go transport.ServeConn(transport.MessagePortConn(args[0]), newFS())
+		return nil
+	}))
+
+	js.Global().Set("g9pConnect", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		url := args[0].String()
+		go func() {
+			conn, err := transport.DialWebSocket(url)
+			if err != nil {
+				log.Printf("Unable to connect to %s: %v", url, err)
+				return
+			}
+			transport.ServeConn(conn, newFS())
+		}()
+		return nil
+	}))
+
+	log.Printf("9pwasm ready")
+	select {}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/convenience"
+)
+
+type entry struct {
+	Name  string    `json:"name"`
+	Size  uint64    `json:"size"`
+	Mode  string    `json:"mode"`
+	Mtime time.Time `json:"mtime"`
+	Dir   bool      `json:"dir"`
+	Owner string    `json:"owner"`
+}
+
+func statEntry(st protocol.Stat) entry {
+	return entry{
+		Name:  st.Name,
+		Size:  st.Length,
+		Mode:  fmt.Sprintf("%#o", st.Mode&0777),
+		Mtime: time.Unix(int64(st.Mtime), 0),
+		Dir:   st.Mode&protocol.DMDIR != 0,
+		Owner: st.UID,
+	}
+}
+
+type gateway struct {
+	c *convenience.Client
+}
+
+func (g *gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p := path.Clean("/" + r.URL.Path)
+
+	var err error
+	switch r.Method {
+	case "GET", "HEAD":
+		err = g.get(w, r, p)
+	case "PUT":
+		err = g.put(w, r, p)
+	case "DELETE":
+		err = g.c.Remove(p)
+		if err == nil {
+			w.WriteHeader(http.StatusNoContent)
+		}
+	case "MKCOL":
+		err = g.c.Create(p, true)
+		if err == nil {
+			w.WriteHeader(http.StatusCreated)
+		}
+	case "PROPFIND":
+		err = g.propfind(w, r, p)
+	case "OPTIONS":
+		w.Header().Set("DAV", "1")
+		w.Header().Set("Allow", "GET, HEAD, PUT, DELETE, MKCOL, PROPFIND, OPTIONS")
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+
+	if err != nil {
+		status := http.StatusInternalServerError
+		if err == convenience.ErrNoSuchFile {
+			status = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), status)
+	}
+}
+
+func (g *gateway) get(w http.ResponseWriter, r *http.Request, p string) error {
+	st, err := g.c.Stat(p)
+	if err != nil {
+		return err
+	}
+
+	if st.Mode&protocol.DMDIR != 0 {
+		return g.list(w, r, p)
+	}
+
+	f, err := g.c.Open(p, protocol.OREAD)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// ServeContent takes care of range requests and conditional headers.
+	http.ServeContent(w, r, st.Name, time.Unix(int64(st.Mtime), 0), f)
+	return nil
+}
+
+func (g *gateway) list(w http.ResponseWriter, r *http.Request, p string) error {
+	stats, err := g.c.ReadDir(p)
+	if err != nil {
+		return err
+	}
+
+	entries := make([]entry, 0, len(stats))
+	for _, st := range stats {
+		entries = append(entries, statEntry(st))
+	}
+
+	if r.URL.Query().Get("format") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(entries)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, "<html><head><title>%s</title></head><body>\n", html.EscapeString(p))
+	fmt.Fprintf(w, "<h1>%s</h1>\n<table>\n", html.EscapeString(p))
+	if p != "/" {
+		fmt.Fprintf(w, "<tr><td><a href=\"%s\">..</a></td></tr>\n", html.EscapeString(path.Dir(p)))
+	}
+	for _, e := range entries {
+		name := e.Name
+		if e.Dir {
+			name += "/"
+		}
+		fmt.Fprintf(w, "<tr><td><a href=\"%s\">%s</a></td><td>%s</td><td>%d</td><td>%s</td></tr>\n",
+			html.EscapeString(path.Join(p, e.Name)), html.EscapeString(name), e.Mode, e.Size, e.Mtime.Format(time.RFC3339))
+	}
+	fmt.Fprintf(w, "</table>\n</body></html>\n")
+	return nil
+}
+
+func (g *gateway) put(w http.ResponseWriter, r *http.Request, p string) error {
+	status := http.StatusNoContent
+	if _, err := g.c.Stat(p); err == convenience.ErrNoSuchFile {
+		if err := g.c.Create(p, false); err != nil {
+			return err
+		}
+		status = http.StatusCreated
+	} else if err != nil {
+		return err
+	}
+
+	f, err := g.c.Open(p, protocol.OWRITE|protocol.OTRUNC)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(f, r.Body); err != nil {
+		return err
+	}
+
+	w.WriteHeader(status)
+	return nil
+}
+
+type davProp struct {
+	DisplayName   string    `xml:"D:displayname"`
+	ContentLength uint64    `xml:"D:getcontentlength"`
+	LastModified  string    `xml:"D:getlastmodified"`
+	ResourceType  *struct{} `xml:"D:resourcetype>D:collection,omitempty"`
+}
+
+type davResponse struct {
+	Href   string  `xml:"D:href"`
+	Prop   davProp `xml:"D:propstat>D:prop"`
+	Status string  `xml:"D:propstat>D:status"`
+}
+
+type davMultistatus struct {
+	XMLName   xml.Name      `xml:"D:multistatus"`
+	XMLNS     string        `xml:"xmlns:D,attr"`
+	Responses []davResponse `xml:"D:response"`
+}
+
+func davEntry(href string, st protocol.Stat) davResponse {
+	resp := davResponse{
+		Href: href,
+		Prop: davProp{
+			DisplayName:   st.Name,
+			ContentLength: st.Length,
+			LastModified:  time.Unix(int64(st.Mtime), 0).UTC().Format(http.TimeFormat),
+		},
+		Status: "HTTP/1.1 200 OK",
+	}
+	if st.Mode&protocol.DMDIR != 0 {
+		resp.Prop.ResourceType = &struct{}{}
+	}
+	return resp
+}
+
+func (g *gateway) propfind(w http.ResponseWriter, r *http.Request, p string) error {
+	st, err := g.c.Stat(p)
+	if err != nil {
+		return err
+	}
+
+	ms := davMultistatus{
+		XMLNS:     "DAV:",
+		Responses: []davResponse{davEntry(p, st)},
+	}
+
+	if st.Mode&protocol.DMDIR != 0 && r.Header.Get("Depth") != "0" {
+		stats, err := g.c.ReadDir(p)
+		if err != nil {
+			return err
+		}
+		for _, st := range stats {
+			ms.Responses = append(ms.Responses, davEntry(path.Join(p, st.Name), st))
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(207)
+	io.WriteString(w, xml.Header)
+	return xml.NewEncoder(w).Encode(ms)
+}
+
+func main() {
+	if len(os.Args) < 5 {
+		fmt.Printf("Too few arguments\n")
+		fmt.Printf("%s address UID service httpaddress\n", os.Args[0])
+		return
+	}
+
+	addr := os.Args[1]
+	user := os.Args[2]
+	service := os.Args[3]
+	httpAddr := os.Args[4]
+
+	c := &convenience.Client{}
+	err := c.Dial("tcp", addr, user, service)
+	if err != nil {
+		log.Fatalf("Connect failed: %v", err)
+	}
+
+	log.Printf("Starting 9pweb at %s", httpAddr)
+	log.Fatal(http.ListenAndServe(httpAddr, &gateway{c: c}))
+}
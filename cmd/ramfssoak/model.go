@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"sync/atomic"
+
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/convenience"
+)
+
+// model is the expected content of the files owned by a client. Clients only
+// change their own files, so a model is exact as long as the server is
+// correct, even though all files share a directory.
+type model struct {
+	id    int
+	files map[string][]byte
+}
+
+func (m *model) name(k int) string {
+	return fmt.Sprintf("c%d-f%d", m.id, k)
+}
+
+// pick returns a random existing file, or "" if there are none.
+func (m *model) pick(r *rand.Rand) string {
+	if len(m.files) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(m.files))
+	for name := range m.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names[r.Intn(len(names))]
+}
+
+// op is a randomized operation of a client, which returns an error if the
+// server disagrees with the model.
+type op struct {
+	name   string
+	weight int
+	count  uint64
+	fn     func(w *worker) error
+}
+
+var ops = []*op{
+	{name: "create", weight: 4, fn: (*worker).create},
+	{name: "write", weight: 6, fn: (*worker).write},
+	{name: "truncate", weight: 2, fn: (*worker).truncate},
+	{name: "read", weight: 8, fn: (*worker).read},
+	{name: "stat", weight: 4, fn: (*worker).stat},
+	{name: "rename", weight: 3, fn: (*worker).rename},
+	{name: "remove", weight: 3, fn: (*worker).remove},
+	{name: "foreign", weight: 2, fn: (*worker).foreign},
+}
+
+// choose returns a random op by weight.
+func choose(r *rand.Rand) *op {
+	total := 0
+	for _, o := range ops {
+		total += o.weight
+	}
+	n := r.Intn(total)
+	for _, o := range ops {
+		if n < o.weight {
+			return o
+		}
+		n -= o.weight
+	}
+	return ops[len(ops)-1]
+}
+
+// worker is a client running random operations against its own files.
+type worker struct {
+	c       *convenience.Client
+	r       *rand.Rand
+	m       *model
+	clients int
+	names   int
+	maxSize int
+}
+
+func (w *worker) run(o *op) error {
+	atomic.AddUint64(&o.count, 1)
+	if err := o.fn(w); err != nil {
+		return fmt.Errorf("client %d: %s: %v", w.m.id, o.name, err)
+	}
+	return nil
+}
+
+func (w *worker) data() []byte {
+	b := make([]byte, w.r.Intn(w.maxSize/4+1))
+	w.r.Read(b)
+	return b
+}
+
+func (w *worker) create() error {
+	name := w.m.name(w.r.Intn(w.names))
+	err := w.c.Create(name, false)
+	if _, exists := w.m.files[name]; exists {
+		if err == nil {
+			return fmt.Errorf("creating existing file %s succeeded", name)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	w.m.files[name] = []byte{}
+	return nil
+}
+
+func (w *worker) write() error {
+	name := w.m.pick(w.r)
+	if name == "" {
+		return nil
+	}
+	content := w.m.files[name]
+	b := w.data()
+	off := w.r.Intn(len(content) + 1)
+	if off+len(b) > w.maxSize {
+		return nil
+	}
+
+	f, err := w.c.Open(name, protocol.OWRITE)
+	if err != nil {
+		return fmt.Errorf("%s: open: %v", name, err)
+	}
+	defer f.Close()
+	if _, err := f.WriteAt(b, int64(off)); err != nil {
+		return fmt.Errorf("%s: write: %v", name, err)
+	}
+	if end := off + len(b); end > len(content) {
+		content = append(content, make([]byte, end-len(content))...)
+	}
+	copy(content[off:], b)
+	w.m.files[name] = content
+	return nil
+}
+
+func (w *worker) truncate() error {
+	name := w.m.pick(w.r)
+	if name == "" {
+		return nil
+	}
+	b := w.data()
+	f, err := w.c.Open(name, protocol.OWRITE|protocol.OTRUNC)
+	if err != nil {
+		return fmt.Errorf("%s: open: %v", name, err)
+	}
+	defer f.Close()
+	if _, err := f.WriteAt(b, 0); err != nil {
+		return fmt.Errorf("%s: write: %v", name, err)
+	}
+	w.m.files[name] = b
+	return nil
+}
+
+func (w *worker) read() error {
+	name := w.m.pick(w.r)
+	if name == "" {
+		return nil
+	}
+	return check(w.c, name, w.m.files[name])
+}
+
+func (w *worker) stat() error {
+	name := w.m.pick(w.r)
+	if name == "" {
+		return nil
+	}
+	st, err := w.c.Stat(name)
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	if st.Name != name || st.Length != uint64(len(w.m.files[name])) {
+		return fmt.Errorf("%s: stat returned name %q, length %d, expected length %d", name, st.Name, st.Length, len(w.m.files[name]))
+	}
+	return nil
+}
+
+func (w *worker) rename() error {
+	name := w.m.pick(w.r)
+	if name == "" {
+		return nil
+	}
+	to := w.m.name(w.r.Intn(w.names))
+	err := w.c.Rename(name, to)
+	if _, exists := w.m.files[to]; exists {
+		if err == nil && to != name {
+			return fmt.Errorf("renaming %s onto existing file %s succeeded", name, to)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("%s to %s: %v", name, to, err)
+	}
+	w.m.files[to] = w.m.files[name]
+	delete(w.m.files, name)
+	return nil
+}
+
+func (w *worker) remove() error {
+	name := w.m.pick(w.r)
+	if name == "" {
+		return nil
+	}
+	if err := w.c.Remove(name); err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	delete(w.m.files, name)
+	if _, err := w.c.Stat(name); err == nil {
+		return fmt.Errorf("%s still exists after remove", name)
+	}
+	return nil
+}
+
+// foreign reads a file of another client, which may change or disappear at
+// any moment, so only protocol failures are reported.
+func (w *worker) foreign() error {
+	if w.clients < 2 {
+		return nil
+	}
+	id := w.r.Intn(w.clients)
+	name := fmt.Sprintf("c%d-f%d", id, w.r.Intn(w.names))
+	f, err := w.c.Open(name, protocol.OREAD)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	b := make([]byte, w.maxSize)
+	n, err := f.ReadAt(b, 0)
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("%s: read: %v", name, err)
+	}
+	if n > w.maxSize {
+		return fmt.Errorf("%s: read %d bytes, more than any file", name, n)
+	}
+	return nil
+}
+
+// check reads a file and compares it to the expected content.
+func check(c *convenience.Client, name string, content []byte) error {
+	b, err := c.Read(name)
+	if err != nil {
+		return fmt.Errorf("%s: read: %v", name, err)
+	}
+	if !bytes.Equal(b, content) {
+		return fmt.Errorf("%s: read %d bytes differing from the %d expected", name, len(b), len(content))
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kennylevinsen/g9ptools/convenience"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+	"github.com/kennylevinsen/g9ptools/ramfs/ramtree"
+)
+
+const user = "soak"
+
+// soak runs the workers, and periodically stops them all to compare the
+// complete tree against the models.
+type soak struct {
+	// The workers hold a read lock while running an operation, so that the
+	// checker can take the write lock to see a quiescent tree.
+	sync.RWMutex
+	checker *convenience.Client
+	models  []*model
+	failed  int32
+}
+
+func (s *soak) fail(err error) {
+	if atomic.CompareAndSwapInt32(&s.failed, 0, 1) {
+		log.Printf("FAIL: %v", err)
+	}
+}
+
+// verify compares the listing and content of the tree with the models.
+func (s *soak) verify() error {
+	s.Lock()
+	defer s.Unlock()
+
+	expected := make(map[string][]byte)
+	for _, m := range s.models {
+		for name, content := range m.files {
+			expected[name] = content
+		}
+	}
+
+	sts, err := s.checker.ReadDir("/")
+	if err != nil {
+		return fmt.Errorf("listing: %v", err)
+	}
+	seen := make(map[string]bool)
+	for _, st := range sts {
+		content, ok := expected[st.Name]
+		switch {
+		case !ok:
+			return fmt.Errorf("listing: unexpected file %s", st.Name)
+		case seen[st.Name]:
+			return fmt.Errorf("listing: %s listed twice", st.Name)
+		case st.Length != uint64(len(content)):
+			return fmt.Errorf("listing: %s has length %d, expected %d", st.Name, st.Length, len(content))
+		}
+		seen[st.Name] = true
+	}
+	if len(seen) != len(expected) {
+		var missing []string
+		for name := range expected {
+			if !seen[name] {
+				missing = append(missing, name)
+			}
+		}
+		sort.Strings(missing)
+		return fmt.Errorf("listing: missing %v", missing)
+	}
+
+	for name, content := range expected {
+		if err := check(s.checker, name, content); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func connect(fs *fileserver.FileServer) *convenience.Client {
+	c := &convenience.Client{}
+	if err := c.Connect(fileserver.Pipe(fs), user, ""); err != nil {
+		log.Fatalf("Unable to connect: %v", err)
+	}
+	return c
+}
+
+func main() {
+	clients := flag.Int("clients", 8, "number of concurrent clients")
+	duration := flag.Duration("duration", time.Minute, "how long to run, or 0 to run until a failure")
+	interval := flag.Duration("check", 5*time.Second, "interval between full checks of the tree")
+	names := flag.Int("names", 16, "number of file names used by each client")
+	maxSize := flag.Int("maxsize", 64*1024, "maximum size of files")
+	msize := flag.Uint("msize", 8*1024, "maximum message size")
+	seed := flag.Int64("seed", 0, "random seed, or 0 to use the time")
+	flag.Parse()
+
+	if *clients < 1 || *names < 1 || *maxSize < 1 {
+		fmt.Printf("Invalid arguments\n")
+		fmt.Printf("%s [-clients n] [-duration d] [-check d] [-names n] [-maxsize bytes] [-msize bytes] [-seed n]\n", os.Args[0])
+		return
+	}
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+	log.Printf("Seed %d", *seed)
+
+	root := ramtree.NewRAMTree("/", 0777, user, user)
+	fs := fileserver.NewFileServer(root, nil, uint32(*msize), fileserver.Quiet)
+	s := &soak{checker: connect(fs)}
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < *clients; i++ {
+		w := &worker{
+			c:       connect(fs),
+			r:       rand.New(rand.NewSource(*seed + int64(i))),
+			m:       &model{id: i, files: make(map[string][]byte)},
+			clients: *clients,
+			names:   *names,
+			maxSize: *maxSize,
+		}
+		s.models = append(s.models, w.m)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				s.RLock()
+				err := w.run(choose(w.r))
+				s.RUnlock()
+				if err != nil {
+					s.fail(err)
+					return
+				}
+			}
+		}()
+	}
+
+	var deadline <-chan time.Time
+	if *duration > 0 {
+		deadline = time.After(*duration)
+	}
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	start := time.Now()
+
+loop:
+	for atomic.LoadInt32(&s.failed) == 0 {
+		select {
+		case <-deadline:
+			break loop
+		case <-ticker.C:
+			if err := s.verify(); err != nil {
+				s.fail(err)
+				break loop
+			}
+			var total uint64
+			for _, o := range ops {
+				total += atomic.LoadUint64(&o.count)
+			}
+			log.Printf("%v: %d operations, tree consistent", time.Since(start).Truncate(time.Second), total)
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	if atomic.LoadInt32(&s.failed) == 0 {
+		if err := s.verify(); err != nil {
+			s.fail(err)
+		}
+	}
+	for _, o := range ops {
+		fmt.Printf("%-10s %d\n", o.name, atomic.LoadUint64(&o.count))
+	}
+	if atomic.LoadInt32(&s.failed) != 0 {
+		log.Fatalf("Soak failed after %v, seed %d", time.Since(start).Truncate(time.Millisecond), *seed)
+	}
+	log.Printf("Soak passed after %v", time.Since(start).Truncate(time.Millisecond))
+}
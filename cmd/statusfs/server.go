@@ -0,0 +1,120 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/kennylevinsen/g9p"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+	"github.com/kennylevinsen/g9ptools/ramfs/ramtree"
+	"github.com/kennylevinsen/g9ptools/transport"
+)
+
+// stat is a single status file. Its content is regenerated on every open.
+type stat struct {
+	name string
+	read func() (string, error)
+}
+
+func readHostname() (string, error) {
+	return os.Hostname()
+}
+
+func readSys() (string, error) {
+	return fmt.Sprintf("%s %s %d\n", runtime.GOOS, runtime.GOARCH, runtime.NumCPU()), nil
+}
+
+func readTime() (string, error) {
+	return fmt.Sprintf("%d\n", time.Now().Unix()), nil
+}
+
+func readDisk(paths []string) func() (string, error) {
+	return func() (string, error) {
+		var s string
+		for _, p := range paths {
+			total, free, avail, err := diskUsage(p)
+			if err != nil {
+				return "", err
+			}
+			s += fmt.Sprintf("%s %d %d %d\n", p, total, free, avail)
+		}
+		return s, nil
+	}
+}
+
+func callback(f func() (string, error)) ramtree.ReadFunc {
+	return func(string) ([]byte, error) {
+		s, err := f()
+		if err != nil {
+			return nil, err
+		}
+		return []byte(s), nil
+	}
+}
+
+func main() {
+	disks := flag.String("disk", "/", "comma-separated list of paths to report disk usage for")
+	flag.Parse()
+
+	if flag.NArg() < 4 {
+		fmt.Printf("Too few arguments\n")
+		fmt.Printf("%s [-disk paths] service UID GID address\n", os.Args[0])
+		fmt.Printf("UID and GID are the user/group that owns /\n")
+		fmt.Printf("address is a dial string, such as :5640, or stdio to serve a single session on standard input and output\n")
+		return
+	}
+
+	service := flag.Arg(0)
+	user := flag.Arg(1)
+	group := flag.Arg(2)
+	addr := flag.Arg(3)
+
+	// All files are read-only text, formatted as space-separated fields:
+	//
+	//	hostname	name
+	//	sys	os arch ncpu
+	//	time	seconds since the epoch
+	//	uptime	seconds since boot
+	//	load	1, 5 and 15 minute load averages
+	//	cpu	cumulative user, nice, system, idle and iowait ticks
+	//	memory	total, free and available bytes
+	//	disk	path, total, free and available bytes, one line per path
+	stats := []stat{
+		{"hostname", readHostname},
+		{"sys", readSys},
+		{"time", readTime},
+		{"uptime", readUptime},
+		{"load", readLoad},
+		{"cpu", readCPU},
+		{"memory", readMemory},
+		{"disk", readDisk(strings.Split(*disks, ","))},
+	}
+
+	root := ramtree.NewRAMTree("/", 0555, user, group)
+	for _, s := range stats {
+		f := ramtree.NewCallbackFile(s.name, 0444, user, group, callback(s.read), nil)
+		if err := root.Add(s.name, f); err != nil {
+			log.Fatalf("Unable to add %s: %v", s.name, err)
+		}
+	}
+
+	l, err := transport.ListenDialString(addr)
+	if err != nil {
+		log.Fatalf("Unable to listen: %v", err)
+	}
+
+	h := func() g9p.Handler {
+		m := make(map[string]fileserver.Dir)
+		m[service] = root
+		return fileserver.NewFileServer(nil, m, 10*1024*1024, fileserver.Chatty)
+	}
+
+	log.Printf("Starting statusfs at %s", addr)
+	transport.Ready()
+	g9p.ServeListener(l, h)
+}
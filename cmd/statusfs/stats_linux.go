@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+func readUptime() (string, error) {
+	b, err := ioutil.ReadFile("/proc/uptime")
+	if err != nil {
+		return "", err
+	}
+	fields := strings.Fields(string(b))
+	if len(fields) < 1 {
+		return "", errors.New("malformed /proc/uptime")
+	}
+	up, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d\n", int64(up)), nil
+}
+
+func readLoad() (string, error) {
+	b, err := ioutil.ReadFile("/proc/loadavg")
+	if err != nil {
+		return "", err
+	}
+	fields := strings.Fields(string(b))
+	if len(fields) < 3 {
+		return "", errors.New("malformed /proc/loadavg")
+	}
+	return strings.Join(fields[:3], " ") + "\n", nil
+}
+
+func readCPU() (string, error) {
+	f, err := os.Open("/proc/stat")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 6 || fields[0] != "cpu" {
+			continue
+		}
+		return strings.Join(fields[1:6], " ") + "\n", nil
+	}
+	if err := s.Err(); err != nil {
+		return "", err
+	}
+	return "", errors.New("no cpu line in /proc/stat")
+}
+
+func readMemory() (string, error) {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	info := make(map[string]uint64)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		v, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		// Values are reported in kB.
+		info[strings.TrimSuffix(fields[0], ":")] = v * 1024
+	}
+	if err := s.Err(); err != nil {
+		return "", err
+	}
+
+	avail, ok := info["MemAvailable"]
+	if !ok {
+		avail = info["MemFree"] + info["Buffers"] + info["Cached"]
+	}
+	return fmt.Sprintf("%d %d %d\n", info["MemTotal"], info["MemFree"], avail), nil
+}
+
+func diskUsage(path string) (total, free, avail uint64, err error) {
+	var st syscall.Statfs_t
+	if err = syscall.Statfs(path, &st); err != nil {
+		return 0, 0, 0, err
+	}
+	bsize := uint64(st.Bsize)
+	return st.Blocks * bsize, st.Bfree * bsize, st.Bavail * bsize, nil
+}
@@ -0,0 +1,28 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "errors"
+
+var errUnsupported = errors.New("not supported on this platform")
+
+func readUptime() (string, error) {
+	return "", errUnsupported
+}
+
+func readLoad() (string, error) {
+	return "", errUnsupported
+}
+
+func readCPU() (string, error) {
+	return "", errUnsupported
+}
+
+func readMemory() (string, error) {
+	return "", errUnsupported
+}
+
+func diskUsage(path string) (total, free, avail uint64, err error) {
+	return 0, 0, 0, errUnsupported
+}
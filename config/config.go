@@ -0,0 +1,530 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/kennylevinsen/g9ptools/fileserver"
+	"github.com/kennylevinsen/g9ptools/ramfs/ramtree"
+)
+
+// Config describes a server. A configuration file looks like:
+//
+//	verbosity = "chatty"
+//	maxsize = 10485760
+//	keys = "/etc/g9p/keys"
+//	audit = "syslog"
+//
+//	[srvctl]
+//	user = "glenda"
+//	group = "glenda"
+//
+//	[users]
+//	source = "file"
+//	file = "/etc/g9p/users"
+//
+//	[[tree]]
+//	service = "ram"
+//	user = "glenda"
+//	group = "glenda"
+//	perm = 0o777
+//	quota = 104857600
+//	stable_ids = true
+//	umask = 0o022
+//	atime = "relatime"
+//
+//	[[listener]]
+//	network = "tcp"
+//	address = ":5640"
+//	auth = true
+//
+//	[[restrict]]
+//	user = "none"
+//	scope = "/pub"
+//	readonly = true
+//
+//	[[listener]]
+//	network = "tcp"
+//	address = ":5641"
+//	readonly = true
+//	scope = "/pub"
+//	tls_cert = "/etc/g9p/cert.pem"
+//	tls_key = "/etc/g9p/key.pem"
+//	tls_ca = "/etc/g9p/ca.pem"
+//	policy = "/etc/g9p/policy"
+type Config struct {
+	// Verbosity is one of quiet, chatty, loud, obnoxious and debug.
+	Verbosity string
+	MaxSize   uint32
+	// Keys is a keyring file, as read by auth.LoadKeys, used by listeners
+	// that require authentication.
+	Keys string
+	// Faults injects faults into all sessions, as parsed by
+	// fileserver.ParseFaults. It is meant for testing clients.
+	Faults string
+	// Record, if set, is a file that all sessions are recorded to, as
+	// written by record.Recorder.
+	Record string
+	// Audit, if set, enables the audit log, written to syslog if it is
+	// "syslog", and otherwise appended to the named file, as opened by
+	// audit.OpenSink.
+	Audit     string
+	Trees     []Tree
+	Listeners []Listener
+	// Restrictions confine individual users, on all listeners.
+	Restrictions []Restriction
+	// Srvctl enables the srvctl service, which controls the server itself,
+	// if User is set.
+	Srvctl Srvctl
+	// Users is the user database, which decides group membership for
+	// permission checks, and which users may attach.
+	Users Users
+}
+
+// Srvctl configures the srvctl service.
+type Srvctl struct {
+	User  string
+	Group string
+}
+
+// Users configures the user database.
+type Users struct {
+	// Source is one of file, os and ldap. If empty, every user may attach,
+	// and users are only members of the group of their own name.
+	Source string
+	// File is the users file of the file source, as parsed by
+	// userdb.Parse.
+	File string
+	// LDAP configures the ldap source, as described by userdb.LDAP.
+	LDAPURL          string
+	LDAPBindDN       string
+	LDAPBindPassword string
+	LDAPBaseDN       string
+	LDAPUserFilter   string
+	LDAPGroupFilter  string
+	LDAPGroupAttr    string
+	// Cache, if positive, is how many seconds answers of the database are
+	// remembered. Answers of the ldap source are otherwise remembered for a
+	// minute, and those of other sources are not remembered.
+	Cache int64
+}
+
+// Tree is an exported tree.
+type Tree struct {
+	Service string
+	User    string
+	Group   string
+	Perm    uint32
+	// Quota limits the total content size in bytes. Zero means unlimited.
+	Quota int64
+	// StableIDs derives qid paths from file paths, so that they stay the
+	// same across restarts.
+	StableIDs bool
+	// UID and GID, if set, are the owner and group of files created in the
+	// tree. Otherwise, the creating user and the group of the directory are
+	// used.
+	UID string
+	GID string
+	// Umask, if not negative, is cleared from the permissions of created
+	// files. Unless any of UID, GID and Umask are set, files instead inherit
+	// owner and group from their directory, and have their permissions
+	// masked by it.
+	Umask int64
+	// Atime is the access time mode, one of strict, relatime and off.
+	Atime string
+	// MaxName, MaxDepth and MaxChildren, if positive, limit the length of
+	// names, the depth of paths and the number of entries per directory.
+	MaxName     int64
+	MaxDepth    int64
+	MaxChildren int64
+	// Names is the name policy, a comma-separated list of strict, nfc and
+	// fold, as parsed by ramtree.ParseNamePolicy.
+	Names string
+	// Evict makes writes exceeding the quota evict the least recently
+	// accessed files, rather than fail.
+	Evict bool
+	// Dedup stores identical blocks of file content only once.
+	Dedup bool
+	// Spill, if positive, moves the content of files that are not open to
+	// disk once more than Spill bytes are held in memory. The content is
+	// stored in a temporary directory created in SpillDir, or in the default
+	// directory for temporary files.
+	Spill    int64
+	SpillDir string
+	// Proto, if set, is a manifest of files to populate the tree with when
+	// it is created, in the format parsed by ramtree.ParseManifest.
+	Proto string
+	// TarStreams serves tarballs of directories, as by package tarstream.
+	TarStreams bool
+	// Find answers searches, as by package findfs.
+	Find bool
+	// Checksums serves checksums of files, as by package checksum.
+	Checksums bool
+}
+
+// Ownership reports whether the tree overrides the ownership of created
+// files.
+func (t *Tree) Ownership() bool {
+	return t.UID != "" || t.GID != "" || t.Umask >= 0
+}
+
+// Restriction confines a user to a subtree of every service, or to
+// read-only access, as fileserver.Restriction.
+type Restriction struct {
+	User     string
+	Scope    string
+	ReadOnly bool
+}
+
+// Listener is an endpoint serving all trees.
+type Listener struct {
+	// Network is tcp, unix, vsock or stdio, as listened on by
+	// transport.Listen, or quic, which requires TLS.
+	Network  string
+	Address  string
+	Auth     bool
+	ReadOnly bool
+	TLSCert  string
+	TLSKey   string
+	TLSCA    string
+	Policy   string
+	// Faults injects faults into the sessions of the listener, in addition
+	// to those of the configuration.
+	Faults string
+	// Scope, if set, confines the sessions of the listener to a path within
+	// every service, as if it was the root of the service.
+	Scope string
+}
+
+// TLS reports whether the listener serves TLS.
+func (l *Listener) TLS() bool {
+	return l.TLSCert != ""
+}
+
+// FileServerVerbosity returns the configured verbosity.
+func (c *Config) FileServerVerbosity() (fileserver.Verbosity, error) {
+	switch strings.ToLower(c.Verbosity) {
+	case "", "chatty":
+		return fileserver.Chatty, nil
+	case "quiet":
+		return fileserver.Quiet, nil
+	case "loud":
+		return fileserver.Loud, nil
+	case "obnoxious":
+		return fileserver.Obnoxious, nil
+	case "debug":
+		return fileserver.Debug, nil
+	default:
+		return 0, fmt.Errorf("unknown verbosity %q", c.Verbosity)
+	}
+}
+
+// decoder extracts typed values from a table, remembering the first error.
+type decoder struct {
+	t    table
+	name string
+	err  error
+	seen map[string]bool
+}
+
+func newDecoder(t table, name string) *decoder {
+	return &decoder{t: t, name: name, seen: make(map[string]bool)}
+}
+
+func (d *decoder) fail(key, want string) {
+	if d.err == nil {
+		d.err = fmt.Errorf("%s%s: expected %s", d.name, key, want)
+	}
+}
+
+func (d *decoder) get(key string) (interface{}, bool) {
+	d.seen[key] = true
+	v, ok := d.t[key]
+	return v, ok
+}
+
+func (d *decoder) str(key string, dst *string) {
+	if v, ok := d.get(key); ok {
+		s, ok := v.(string)
+		if !ok {
+			d.fail(key, "string")
+			return
+		}
+		*dst = s
+	}
+}
+
+func (d *decoder) int(key string, dst *int64) {
+	if v, ok := d.get(key); ok {
+		n, ok := v.(int64)
+		if !ok {
+			d.fail(key, "integer")
+			return
+		}
+		*dst = n
+	}
+}
+
+func (d *decoder) bool(key string, dst *bool) {
+	if v, ok := d.get(key); ok {
+		b, ok := v.(bool)
+		if !ok {
+			d.fail(key, "boolean")
+			return
+		}
+		*dst = b
+	}
+}
+
+func (d *decoder) table(key string) table {
+	v, ok := d.get(key)
+	if !ok {
+		return table{}
+	}
+	t, ok := v.(table)
+	if !ok {
+		d.fail(key, "table")
+		return table{}
+	}
+	return t
+}
+
+func (d *decoder) tables(key string) []table {
+	v, ok := d.get(key)
+	if !ok {
+		return nil
+	}
+	ts, ok := v.([]table)
+	if !ok {
+		d.fail(key, "array of tables")
+		return nil
+	}
+	return ts
+}
+
+// done reports unknown keys, which are most likely typos.
+func (d *decoder) done() error {
+	if d.err != nil {
+		return d.err
+	}
+	for k := range d.t {
+		if !d.seen[k] {
+			return fmt.Errorf("%s%s: unknown key", d.name, k)
+		}
+	}
+	return nil
+}
+
+// Parse parses a configuration.
+func Parse(data string) (*Config, error) {
+	t, err := parse(strings.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Config{MaxSize: 10 * 1024 * 1024}
+	d := newDecoder(t, "")
+	d.str("verbosity", &c.Verbosity)
+	maxSize := int64(c.MaxSize)
+	d.int("maxsize", &maxSize)
+	c.MaxSize = uint32(maxSize)
+	d.str("keys", &c.Keys)
+	d.str("faults", &c.Faults)
+	d.str("record", &c.Record)
+	d.str("audit", &c.Audit)
+
+	sd := newDecoder(d.table("srvctl"), "srvctl.")
+	sd.str("user", &c.Srvctl.User)
+	sd.str("group", &c.Srvctl.Group)
+	if err := sd.done(); err != nil {
+		return nil, err
+	}
+
+	ud := newDecoder(d.table("users"), "users.")
+	ud.str("source", &c.Users.Source)
+	ud.str("file", &c.Users.File)
+	ud.str("ldap_url", &c.Users.LDAPURL)
+	ud.str("ldap_bind_dn", &c.Users.LDAPBindDN)
+	ud.str("ldap_bind_password", &c.Users.LDAPBindPassword)
+	ud.str("ldap_base_dn", &c.Users.LDAPBaseDN)
+	ud.str("ldap_user_filter", &c.Users.LDAPUserFilter)
+	ud.str("ldap_group_filter", &c.Users.LDAPGroupFilter)
+	ud.str("ldap_group_attr", &c.Users.LDAPGroupAttr)
+	ud.int("cache", &c.Users.Cache)
+	if err := ud.done(); err != nil {
+		return nil, err
+	}
+
+	for i, tt := range d.tables("tree") {
+		tree := Tree{Perm: 0777, Umask: -1}
+		td := newDecoder(tt, fmt.Sprintf("tree[%d].", i))
+		td.str("service", &tree.Service)
+		td.str("user", &tree.User)
+		td.str("group", &tree.Group)
+		perm := int64(tree.Perm)
+		td.int("perm", &perm)
+		tree.Perm = uint32(perm)
+		td.int("quota", &tree.Quota)
+		td.bool("stable_ids", &tree.StableIDs)
+		td.str("uid", &tree.UID)
+		td.str("gid", &tree.GID)
+		td.int("umask", &tree.Umask)
+		td.str("atime", &tree.Atime)
+		td.str("names", &tree.Names)
+		td.int("max_name", &tree.MaxName)
+		td.int("max_depth", &tree.MaxDepth)
+		td.int("max_children", &tree.MaxChildren)
+		td.bool("evict", &tree.Evict)
+		td.bool("dedup", &tree.Dedup)
+		td.int("spill", &tree.Spill)
+		td.str("spill_dir", &tree.SpillDir)
+		td.str("proto", &tree.Proto)
+		td.bool("tar_streams", &tree.TarStreams)
+		td.bool("find", &tree.Find)
+		td.bool("checksums", &tree.Checksums)
+		if err := td.done(); err != nil {
+			return nil, err
+		}
+		c.Trees = append(c.Trees, tree)
+	}
+
+	for i, lt := range d.tables("listener") {
+		l := Listener{Network: "tcp"}
+		ld := newDecoder(lt, fmt.Sprintf("listener[%d].", i))
+		ld.str("network", &l.Network)
+		ld.str("address", &l.Address)
+		ld.bool("auth", &l.Auth)
+		ld.bool("readonly", &l.ReadOnly)
+		ld.str("scope", &l.Scope)
+		ld.str("tls_cert", &l.TLSCert)
+		ld.str("tls_key", &l.TLSKey)
+		ld.str("tls_ca", &l.TLSCA)
+		ld.str("policy", &l.Policy)
+		ld.str("faults", &l.Faults)
+		if err := ld.done(); err != nil {
+			return nil, err
+		}
+		c.Listeners = append(c.Listeners, l)
+	}
+
+	for i, rt := range d.tables("restrict") {
+		var r Restriction
+		rd := newDecoder(rt, fmt.Sprintf("restrict[%d].", i))
+		rd.str("user", &r.User)
+		rd.str("scope", &r.Scope)
+		rd.bool("readonly", &r.ReadOnly)
+		if err := rd.done(); err != nil {
+			return nil, err
+		}
+		c.Restrictions = append(c.Restrictions, r)
+	}
+
+	if err := d.done(); err != nil {
+		return nil, err
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Validate checks the configuration for consistency. Parse validates the
+// configurations it returns.
+func (c *Config) Validate() error {
+	if _, err := fileserver.ParseFaults(c.Faults); err != nil {
+		return err
+	}
+	if _, err := c.FileServerVerbosity(); err != nil {
+		return err
+	}
+	if len(c.Trees) == 0 {
+		return fmt.Errorf("no trees configured")
+	}
+	if len(c.Listeners) == 0 {
+		return fmt.Errorf("no listeners configured")
+	}
+
+	if c.Srvctl.User != "" && c.Srvctl.Group == "" {
+		c.Srvctl.Group = c.Srvctl.User
+	}
+
+	switch c.Users.Source {
+	case "", "os":
+	case "file":
+		if c.Users.File == "" {
+			return fmt.Errorf("users: file source requires file")
+		}
+	case "ldap":
+		if c.Users.LDAPURL == "" || c.Users.LDAPBaseDN == "" {
+			return fmt.Errorf("users: ldap source requires ldap_url and ldap_base_dn")
+		}
+	default:
+		return fmt.Errorf("users: unknown source %q", c.Users.Source)
+	}
+
+	services := make(map[string]bool)
+	for i, t := range c.Trees {
+		if t.Service == "" || t.User == "" || t.Group == "" {
+			return fmt.Errorf("tree[%d]: service, user and group are required", i)
+		}
+		if services[t.Service] || (t.Service == "srvctl" && c.Srvctl.User != "") {
+			return fmt.Errorf("tree[%d]: duplicate service %s", i, t.Service)
+		}
+		if _, err := ramtree.ParseAtimeMode(t.Atime); err != nil {
+			return fmt.Errorf("tree[%d]: %v", i, err)
+		}
+		if _, err := ramtree.ParseNamePolicy(t.Names); err != nil {
+			return fmt.Errorf("tree[%d]: %v", i, err)
+		}
+		if t.MaxName < 0 || t.MaxDepth < 0 || t.MaxChildren < 0 {
+			return fmt.Errorf("tree[%d]: limits must not be negative", i)
+		}
+		if t.Umask > 0777 {
+			return fmt.Errorf("tree[%d]: umask must be at most 0777", i)
+		}
+		services[t.Service] = true
+	}
+
+	users := make(map[string]bool)
+	for i, r := range c.Restrictions {
+		if r.User == "" {
+			return fmt.Errorf("restrict[%d]: user is required", i)
+		}
+		if users[r.User] {
+			return fmt.Errorf("restrict[%d]: duplicate user %s", i, r.User)
+		}
+		users[r.User] = true
+	}
+
+	for i, l := range c.Listeners {
+		if l.Address == "" && l.Network != "stdio" {
+			return fmt.Errorf("listener[%d]: address is required", i)
+		}
+		if l.Auth && c.Keys == "" {
+			return fmt.Errorf("listener[%d]: auth requires keys", i)
+		}
+		if (l.TLSCert == "") != (l.TLSKey == "") {
+			return fmt.Errorf("listener[%d]: tls_cert and tls_key must be given together", i)
+		}
+		if l.Policy != "" && !l.TLS() {
+			return fmt.Errorf("listener[%d]: policy requires TLS", i)
+		}
+		if l.Network == "quic" && !l.TLS() {
+			return fmt.Errorf("listener[%d]: quic requires tls_cert and tls_key", i)
+		}
+		if _, err := fileserver.ParseFaults(l.Faults); err != nil {
+			return fmt.Errorf("listener[%d]: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// Load reads a configuration file.
+func Load(path string) (*Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(string(b))
+}
@@ -0,0 +1,143 @@
+package config_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/kennylevinsen/g9ptools/config"
+)
+
+// minimal is the smallest valid configuration, to which the tests of single
+// keys append.
+const minimal = `
+[[tree]]
+service = "ram"
+user = "glenda"
+group = "glenda"
+
+[[listener]]
+address = ":5640"
+`
+
+func TestParse(t *testing.T) {
+	c, err := config.Parse(`
+# A comment.
+verbosity = "chatty"   # Trailing comment.
+maxsize = 65_536
+keys = "/etc/g9p/keys"
+
+[srvctl]
+user = "glenda"
+
+[users]
+source = "file"
+file = "/etc/g9p/users"
+cache = 30
+
+[[tree]]
+service = "ram"
+user = "glenda"
+group = "sys"
+perm = 0o750
+quota = 0x100000
+stable_ids = true
+umask = 0o022
+atime = "relatime"
+
+[[tree]]
+service = "tmp"
+user = "glenda"
+group = "glenda"
+
+[[listener]]
+network = "unix"
+address = "/tmp/ram"
+auth = true
+
+[[restrict]]
+user = "none"
+scope = "/pub"
+readonly = true
+`)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	want := &config.Config{
+		Verbosity: "chatty",
+		MaxSize:   65536,
+		Keys:      "/etc/g9p/keys",
+		Srvctl:    config.Srvctl{User: "glenda", Group: "glenda"},
+		Users:     config.Users{Source: "file", File: "/etc/g9p/users", Cache: 30},
+		Trees: []config.Tree{
+			{Service: "ram", User: "glenda", Group: "sys", Perm: 0750, Quota: 1 << 20, StableIDs: true, Umask: 022, Atime: "relatime"},
+			{Service: "tmp", User: "glenda", Group: "glenda", Perm: 0777, Umask: -1},
+		},
+		Listeners:    []config.Listener{{Network: "unix", Address: "/tmp/ram", Auth: true}},
+		Restrictions: []config.Restriction{{User: "none", Scope: "/pub", ReadOnly: true}},
+	}
+	if !reflect.DeepEqual(c, want) {
+		t.Fatalf("parsed\n%+v\nexpected\n%+v", c, want)
+	}
+}
+
+func TestParseDefaults(t *testing.T) {
+	c, err := config.Parse(minimal)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if c.MaxSize != 10*1024*1024 {
+		t.Errorf("maxsize defaults to %d", c.MaxSize)
+	}
+	if c.Listeners[0].Network != "tcp" {
+		t.Errorf("network defaults to %q", c.Listeners[0].Network)
+	}
+	if tr := c.Trees[0]; tr.Perm != 0777 || tr.Umask != -1 || tr.Ownership() {
+		t.Errorf("tree defaults to %+v", tr)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		err  string
+	}{
+		// Type mismatches.
+		{"string for integer", "maxsize = \"big\"\n" + minimal, "maxsize: expected integer"},
+		{"integer for string", "verbosity = 2\n" + minimal, "verbosity: expected string"},
+		{"string for boolean", minimal + "auth = \"yes\"\n", "listener[0].auth: expected boolean"},
+		{"integer for table", "srvctl = 1\n" + minimal, "srvctl: expected table"},
+		{"table for array", "[tree]\n", "tree: expected array of tables"},
+
+		// Unknown keys.
+		{"unknown key", "verbose = true\n" + minimal, "verbose: unknown key"},
+		{"unknown table key", "[users]\nsorce = \"os\"\n" + minimal, "users.sorce: unknown key"},
+		{"unknown tree key", minimal + "[[tree]]\nservice = \"tmp\"\nuser = \"glenda\"\ngroup = \"glenda\"\nquota_bytes = 1\n", "tree[1].quota_bytes: unknown key"},
+
+		// Syntax errors.
+		{"missing value", "verbosity =\n" + minimal, "line 1: missing value"},
+		{"unterminated string", "verbosity = \"chatty\n" + minimal, "line 1: unterminated string"},
+		{"duplicate key", "keys = \"a\"\nkeys = \"b\"\n" + minimal, "line 2: duplicate key keys"},
+		{"trailing characters", "maxsize = 1 2\n" + minimal, "line 1: trailing characters after value"},
+		{"malformed header", "[users\n" + minimal, "line 1: malformed table header"},
+
+		// Validation.
+		{"no trees", "[[listener]]\naddress = \":5640\"\n", "no trees configured"},
+		{"no listeners", "[[tree]]\nservice = \"ram\"\nuser = \"glenda\"\ngroup = \"glenda\"\n", "no listeners configured"},
+		{"auth without keys", minimal + "auth = true\n", "listener[0]: auth requires keys"},
+		{"unknown verbosity", "verbosity = \"shouty\"\n" + minimal, "unknown verbosity"},
+	}
+
+	for _, tt := range tests {
+		_, err := config.Parse(tt.data)
+		if err == nil {
+			t.Errorf("%s: parse succeeded", tt.name)
+			continue
+		}
+		if !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: parse failed with %q, expected %q", tt.name, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,312 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// The configuration format is a subset of TOML: tables, arrays of tables,
+// and key/value pairs whose values are strings, integers, booleans or arrays
+// thereof. Dotted keys, inline tables, floats and dates are not supported.
+
+type table map[string]interface{}
+
+type parser struct {
+	root    table
+	cur     table
+	lineno  int
+	pending string
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("line %d: %s", p.lineno, fmt.Sprintf(format, args...))
+}
+
+// stripComment removes a trailing comment, honouring strings.
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// balanced reports whether all brackets opened outside strings are closed.
+func balanced(s string) bool {
+	depth := 0
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '[':
+			depth++
+		case c == ']':
+			depth--
+		}
+	}
+	return depth <= 0
+}
+
+func (p *parser) lookupTable(path []string, array bool) (table, error) {
+	t := p.root
+	for i, name := range path {
+		last := i == len(path)-1
+		v, ok := t[name]
+		if !ok {
+			if last && array {
+				nt := table{}
+				t[name] = []table{nt}
+				return nt, nil
+			}
+			nt := table{}
+			t[name] = nt
+			t = nt
+			continue
+		}
+		switch x := v.(type) {
+		case table:
+			if last && array {
+				return nil, p.errorf("%s is not an array of tables", name)
+			}
+			t = x
+		case []table:
+			if last && array {
+				nt := table{}
+				t[name] = append(x, nt)
+				return nt, nil
+			}
+			t = x[len(x)-1]
+		default:
+			return nil, p.errorf("%s is not a table", name)
+		}
+	}
+	return t, nil
+}
+
+func parseKey(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "\"") || strings.HasPrefix(s, "'") {
+		v, rest, err := parseString(s)
+		if err != nil {
+			return "", err
+		}
+		if strings.TrimSpace(rest) != "" {
+			return "", fmt.Errorf("malformed key %q", s)
+		}
+		return v, nil
+	}
+	if s == "" || strings.ContainsAny(s, " \t.") {
+		return "", fmt.Errorf("malformed key %q", s)
+	}
+	return s, nil
+}
+
+func parseString(s string) (string, string, error) {
+	quote := s[0]
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		if c == quote {
+			return b.String(), s[i+1:], nil
+		}
+		if c == '\\' && quote == '"' {
+			i++
+			if i >= len(s) {
+				break
+			}
+			switch s[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case 'r':
+				b.WriteByte('\r')
+			case '\\', '"':
+				b.WriteByte(s[i])
+			default:
+				return "", "", fmt.Errorf("unknown escape \\%c", s[i])
+			}
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return "", "", fmt.Errorf("unterminated string")
+}
+
+// parseValue parses a value at the start of s, returning the remainder.
+func parseValue(s string) (interface{}, string, error) {
+	s = strings.TrimLeft(s, " \t\n")
+	if s == "" {
+		return nil, "", fmt.Errorf("missing value")
+	}
+
+	switch {
+	case s[0] == '"' || s[0] == '\'':
+		return parseString(s)
+	case s[0] == '[':
+		var arr []interface{}
+		s = s[1:]
+		for {
+			s = strings.TrimLeft(s, " \t\n")
+			if strings.HasPrefix(s, "]") {
+				return arr, s[1:], nil
+			}
+			v, rest, err := parseValue(s)
+			if err != nil {
+				return nil, "", err
+			}
+			arr = append(arr, v)
+			s = strings.TrimLeft(rest, " \t\n")
+			if strings.HasPrefix(s, ",") {
+				s = s[1:]
+			} else if !strings.HasPrefix(s, "]") {
+				return nil, "", fmt.Errorf("expected , or ] in array")
+			}
+		}
+	}
+
+	end := strings.IndexAny(s, ",] \t\n")
+	if end == -1 {
+		end = len(s)
+	}
+	word, rest := s[:end], s[end:]
+	switch word {
+	case "true":
+		return true, rest, nil
+	case "false":
+		return false, rest, nil
+	}
+
+	clean := strings.Replace(word, "_", "", -1)
+	base := 10
+	switch {
+	case strings.HasPrefix(clean, "0x"):
+		base, clean = 16, clean[2:]
+	case strings.HasPrefix(clean, "0o"):
+		base, clean = 8, clean[2:]
+	case strings.HasPrefix(clean, "0b"):
+		base, clean = 2, clean[2:]
+	}
+	n, err := strconv.ParseInt(clean, base, 64)
+	if err != nil {
+		return nil, "", fmt.Errorf("unsupported value %q", word)
+	}
+	return n, rest, nil
+}
+
+func (p *parser) line(line string) error {
+	if p.pending != "" {
+		line = p.pending + "\n" + line
+		p.pending = ""
+	}
+
+	line = strings.TrimSpace(stripComment(line))
+	if line == "" {
+		return nil
+	}
+
+	if strings.HasPrefix(line, "[") {
+		array := strings.HasPrefix(line, "[[")
+		var name string
+		if array {
+			if !strings.HasSuffix(line, "]]") {
+				return p.errorf("malformed table header")
+			}
+			name = line[2 : len(line)-2]
+		} else {
+			if !strings.HasSuffix(line, "]") {
+				return p.errorf("malformed table header")
+			}
+			name = line[1 : len(line)-1]
+		}
+
+		var path []string
+		for _, part := range strings.Split(name, ".") {
+			k, err := parseKey(part)
+			if err != nil {
+				return p.errorf("%v", err)
+			}
+			path = append(path, k)
+		}
+
+		t, err := p.lookupTable(path, array)
+		if err != nil {
+			return err
+		}
+		p.cur = t
+		return nil
+	}
+
+	idx := strings.Index(line, "=")
+	if idx == -1 {
+		return p.errorf("expected key = value")
+	}
+	key, err := parseKey(line[:idx])
+	if err != nil {
+		return p.errorf("%v", err)
+	}
+
+	value := strings.TrimSpace(line[idx+1:])
+	if !balanced(value) {
+		// Arrays may span several lines.
+		p.pending = line
+		return nil
+	}
+
+	v, rest, err := parseValue(value)
+	if err != nil {
+		return p.errorf("%v", err)
+	}
+	if strings.TrimSpace(rest) != "" {
+		return p.errorf("trailing characters after value")
+	}
+	if _, ok := p.cur[key]; ok {
+		return p.errorf("duplicate key %s", key)
+	}
+	p.cur[key] = v
+	return nil
+}
+
+// parse reads a document into nested tables.
+func parse(r io.Reader) (table, error) {
+	p := &parser{root: table{}}
+	p.cur = p.root
+
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		p.lineno++
+		if err := p.line(s.Text()); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if p.pending != "" {
+		return nil, p.errorf("unterminated array")
+	}
+	return p.root, nil
+}
@@ -4,12 +4,14 @@ import (
 	"bytes"
 	"errors"
 	"io"
-	"net"
 	"path"
 	"strings"
+	"sync"
 
 	"github.com/kennylevinsen/g9p"
 	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/auth"
+	"github.com/kennylevinsen/g9ptools/transport"
 )
 
 const (
@@ -25,6 +27,12 @@ var (
 )
 
 type Client struct {
+	// Keys enables authentication when set, using AuthProto, or
+	// auth.DefaultProto if unset.
+	Keys      *auth.Keyring
+	AuthProto string
+
+	fidLock sync.Mutex
 	c       *g9p.Client
 	maxSize uint32
 	root    protocol.Fid
@@ -32,6 +40,9 @@ type Client struct {
 }
 
 func (c *Client) getFid() protocol.Fid {
+	c.fidLock.Lock()
+	defer c.fidLock.Unlock()
+
 	// We need to skip NOFID (highest value) and 0 (our root)
 	if c.nextFid == protocol.NOFID {
 		c.nextFid++
@@ -68,10 +79,21 @@ func (c *Client) setup(username, servicename string) error {
 
 	c.maxSize = vresp.MaxSize
 
+	afid := protocol.NOFID
+	if c.Keys != nil {
+		afid, err = c.authenticate(username, servicename)
+		if err != nil {
+			c.c.Stop()
+			c.c = nil
+			return err
+		}
+		defer c.clunk(afid)
+	}
+
 	areq := &protocol.AttachRequest{
 		Tag:      c.c.NextTag(),
 		Fid:      c.root,
-		AuthFid:  protocol.NOFID,
+		AuthFid:  afid,
 		Username: username,
 		Service:  servicename,
 	}
@@ -85,6 +107,65 @@ func (c *Client) setup(username, servicename string) error {
 	return nil
 }
 
+// authenticate runs the client side of the authentication protocol over a
+// new auth fid, which is returned on success.
+func (c *Client) authenticate(username, servicename string) (protocol.Fid, error) {
+	proto := c.AuthProto
+	if proto == "" {
+		proto = auth.DefaultProto
+	}
+	conv, err := auth.Start(c.Keys, auth.Attrs{
+		{Name: "proto", Value: proto},
+		{Name: "role", Value: "client"},
+	})
+	if err != nil {
+		return protocol.NOFID, err
+	}
+
+	afid := c.getFid()
+	_, err = c.c.Auth(&protocol.AuthRequest{
+		Tag:      c.c.NextTag(),
+		AuthFid:  afid,
+		Username: username,
+		Service:  servicename,
+	})
+	if err != nil {
+		return protocol.NOFID, err
+	}
+
+	for !conv.Done() {
+		b, err := conv.Read()
+		if err == auth.ErrPhase {
+			rresp, err := c.c.Read(&protocol.ReadRequest{
+				Tag:   c.c.NextTag(),
+				Fid:   afid,
+				Count: c.maxSize - 9,
+			})
+			if err != nil {
+				c.clunk(afid)
+				return protocol.NOFID, err
+			}
+			if len(rresp.Data) == 0 {
+				c.clunk(afid)
+				return protocol.NOFID, auth.ErrAuthFailed
+			}
+			err = conv.Write(rresp.Data)
+		} else if err == nil {
+			_, err = c.c.Write(&protocol.WriteRequest{
+				Tag:  c.c.NextTag(),
+				Fid:  afid,
+				Data: b,
+			})
+		}
+		if err != nil {
+			c.clunk(afid)
+			return protocol.NOFID, err
+		}
+	}
+
+	return afid, nil
+}
+
 func (c *Client) readAll(fid protocol.Fid) ([]byte, error) {
 	var b []byte
 
@@ -111,7 +192,7 @@ func (c *Client) readAll(fid protocol.Fid) ([]byte, error) {
 
 func (c *Client) writeAll(fid protocol.Fid, data []byte) error {
 	var offset uint64
-	for {
+	for offset < uint64(len(data)) {
 		count := int(c.maxSize - 20)
 		if len(data[offset:]) < count {
 			count = len(data[offset:])
@@ -225,6 +306,24 @@ func (c *Client) Write(content []byte, file string) error {
 }
 
 func (c *Client) List(file string) ([]string, error) {
+	stats, err := c.ReadDir(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var strs []string
+	for _, x := range stats {
+		if x.Mode&protocol.DMDIR == 0 {
+			strs = append(strs, x.Name)
+		} else {
+			strs = append(strs, x.Name+"/")
+		}
+	}
+
+	return strs, nil
+}
+
+func (c *Client) ReadDir(file string) ([]protocol.Stat, error) {
 	fid, _, err := c.walkTo(file)
 	if err != nil {
 		return nil, err
@@ -247,20 +346,57 @@ func (c *Client) List(file string) ([]string, error) {
 	}
 
 	buf := bytes.NewBuffer(b)
-	var strs []string
+	var stats []protocol.Stat
 	for buf.Len() > 0 {
-		x := &protocol.Stat{}
+		x := protocol.Stat{}
 		if err := x.Decode(buf); err != nil {
 			return nil, err
 		}
-		if x.Mode&protocol.DMDIR == 0 {
-			strs = append(strs, x.Name)
-		} else {
-			strs = append(strs, x.Name+"/")
-		}
+		stats = append(stats, x)
 	}
 
-	return strs, nil
+	return stats, nil
+}
+
+func (c *Client) Stat(file string) (protocol.Stat, error) {
+	fid, _, err := c.walkTo(file)
+	if err != nil {
+		return protocol.Stat{}, err
+	}
+	defer c.clunk(fid)
+
+	sreq := &protocol.StatRequest{
+		Tag: c.c.NextTag(),
+		Fid: fid,
+	}
+	sresp, err := c.c.Stat(sreq)
+	if err != nil {
+		return protocol.Stat{}, err
+	}
+
+	return sresp.Stat, nil
+}
+
+// Open opens a file with the given mode. The returned File must be closed to
+// release the fid.
+func (c *Client) Open(file string, mode protocol.OpenMode) (*File, error) {
+	fid, _, err := c.walkTo(file)
+	if err != nil {
+		return nil, err
+	}
+
+	oreq := &protocol.OpenRequest{
+		Tag:  c.c.NextTag(),
+		Fid:  fid,
+		Mode: mode,
+	}
+	_, err = c.c.Open(oreq)
+	if err != nil {
+		c.clunk(fid)
+		return nil, err
+	}
+
+	return &File{c: c, fid: fid}, nil
 }
 
 func (c *Client) Create(name string, directory bool) error {
@@ -311,8 +447,37 @@ func (c *Client) Remove(name string) error {
 	return nil
 }
 
+// Rename renames a file within its directory, leaving the rest of its stat
+// alone.
+func (c *Client) Rename(file, name string) error {
+	fid, _, err := c.walkTo(file)
+	if err != nil {
+		return err
+	}
+	defer c.clunk(fid)
+
+	wreq := &protocol.WriteStatRequest{
+		Tag: c.c.NextTag(),
+		Fid: fid,
+		Stat: protocol.Stat{
+			Type:   ^uint16(0),
+			Dev:    ^uint32(0),
+			Qid:    protocol.Qid{Type: ^protocol.QidType(0), Version: ^uint32(0), Path: ^uint64(0)},
+			Mode:   ^protocol.FileMode(0),
+			Atime:  ^uint32(0),
+			Mtime:  ^uint32(0),
+			Length: ^uint64(0),
+			Name:   name,
+		},
+	}
+	_, err = c.c.WriteStat(wreq)
+	return err
+}
+
+// Dial connects to a server with transport.Dial, and attaches to the
+// service.
 func (c *Client) Dial(network, address, username, servicename string) error {
-	conn, err := net.Dial(network, address)
+	conn, err := transport.Dial(network, address)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,136 @@
+package convenience
+
+import (
+	"errors"
+	"io"
+
+	"github.com/kennylevinsen/g9p/protocol"
+)
+
+// File is an open file on the server. It implements io.ReadWriteSeeker,
+// io.ReaderAt and io.WriterAt.
+type File struct {
+	c      *Client
+	fid    protocol.Fid
+	offset int64
+}
+
+// Sizes of the Rread and Twrite headers, which, with the data, must fit in
+// the negotiated message size.
+const (
+	rreadHeader  = 4 + 1 + 2 + 4
+	twriteHeader = 4 + 1 + 2 + 4 + 8 + 4
+)
+
+// read issues a single Tread at off, for at most len(p) bytes.
+func (f *File) read(p []byte, off int64) (int, error) {
+	count := len(p)
+	if max := int(f.c.maxSize) - rreadHeader; count > max {
+		count = max
+	}
+	rreq := &protocol.ReadRequest{
+		Tag:    f.c.c.NextTag(),
+		Fid:    f.fid,
+		Offset: uint64(off),
+		Count:  uint32(count),
+	}
+	rresp, err := f.c.c.Read(rreq)
+	if err != nil {
+		return 0, err
+	}
+	if len(rresp.Data) == 0 {
+		return 0, io.EOF
+	}
+	return copy(p, rresp.Data), nil
+}
+
+// ReadAt reads until p is full, or the end of the file is reached.
+func (f *File) ReadAt(p []byte, off int64) (int, error) {
+	var total int
+	for total < len(p) {
+		n, err := f.read(p[total:], off+int64(total))
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+func (f *File) WriteAt(p []byte, off int64) (int, error) {
+	var total int
+	for total < len(p) {
+		count := len(p) - total
+		if max := int(f.c.maxSize) - twriteHeader; count > max {
+			count = max
+		}
+		wreq := &protocol.WriteRequest{
+			Tag:    f.c.c.NextTag(),
+			Fid:    f.fid,
+			Offset: uint64(off) + uint64(total),
+			Data:   p[total : total+count],
+		}
+		wresp, err := f.c.c.Write(wreq)
+		if err != nil {
+			return total, err
+		}
+		if wresp.Count == 0 {
+			return total, io.ErrShortWrite
+		}
+		total += int(wresp.Count)
+	}
+	return total, nil
+}
+
+// Read issues a single Tread, and thus returns what the server returned for
+// it, which for files such as streams is a single message.
+func (f *File) Read(p []byte) (int, error) {
+	n, err := f.read(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *File) Write(p []byte) (int, error) {
+	n, err := f.WriteAt(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *File) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case 0:
+	case 1:
+		offset = f.offset + offset
+	case 2:
+		st, err := f.Stat()
+		if err != nil {
+			return f.offset, err
+		}
+		offset = int64(st.Length) + offset
+	default:
+		return f.offset, errors.New("invalid whence value")
+	}
+
+	if offset < 0 {
+		return f.offset, errors.New("negative seek invalid")
+	}
+	f.offset = offset
+	return f.offset, nil
+}
+
+func (f *File) Stat() (protocol.Stat, error) {
+	sreq := &protocol.StatRequest{
+		Tag: f.c.c.NextTag(),
+		Fid: f.fid,
+	}
+	sresp, err := f.c.c.Stat(sreq)
+	if err != nil {
+		return protocol.Stat{}, err
+	}
+	return sresp.Stat, nil
+}
+
+func (f *File) Close() error {
+	f.c.clunk(f.fid)
+	return nil
+}
@@ -0,0 +1,129 @@
+package crontree
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Spec is a parsed crontab schedule: minute, hour, day of month, month and
+// day of week. Each field supports *, numbers, lists (a,b), ranges (a-b)
+// and steps (*/n, a-b/n or a/n, the latter running from a to the maximum).
+type Spec struct {
+	text   string
+	minute map[int]bool
+	hour   map[int]bool
+	dom    map[int]bool
+	month  map[int]bool
+	dow    map[int]bool
+
+	// anyDay is set if either day of month or day of week is *. If not,
+	// the schedule fires on days matching either of them, as with cron.
+	anyDay bool
+}
+
+func parseField(s string, min, max int) (map[int]bool, error) {
+	set := make(map[int]bool)
+	for _, part := range strings.Split(s, ",") {
+		step, stepped := 1, false
+		if idx := strings.Index(part, "/"); idx != -1 {
+			var err error
+			step, err = strconv.Atoi(part[idx+1:])
+			if err != nil || step <= 0 {
+				return nil, fmt.Errorf("invalid step: %s", part)
+			}
+			part = part[:idx]
+			stepped = true
+		}
+
+		lo, hi := min, max
+		if part != "*" {
+			if idx := strings.Index(part, "-"); idx != -1 {
+				var err1, err2 error
+				lo, err1 = strconv.Atoi(part[:idx])
+				hi, err2 = strconv.Atoi(part[idx+1:])
+				if err1 != nil || err2 != nil {
+					return nil, fmt.Errorf("invalid range: %s", part)
+				}
+			} else {
+				var err error
+				lo, err = strconv.Atoi(part)
+				if err != nil {
+					return nil, fmt.Errorf("invalid value: %s", part)
+				}
+				if !stepped {
+					hi = lo
+				}
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return nil, fmt.Errorf("value out of range: %s", part)
+		}
+
+		for i := lo; i <= hi; i += step {
+			set[i] = true
+		}
+	}
+	return set, nil
+}
+
+// ParseSpec parses the five schedule fields of a crontab line.
+func ParseSpec(fields []string) (*Spec, error) {
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("expected 5 schedule fields, got %d", len(fields))
+	}
+
+	var err error
+	s := &Spec{
+		text:   strings.Join(fields, " "),
+		anyDay: strings.HasPrefix(fields[2], "*") || strings.HasPrefix(fields[4], "*"),
+	}
+	if s.minute, err = parseField(fields[0], 0, 59); err != nil {
+		return nil, err
+	}
+	if s.hour, err = parseField(fields[1], 0, 23); err != nil {
+		return nil, err
+	}
+	if s.dom, err = parseField(fields[2], 1, 31); err != nil {
+		return nil, err
+	}
+	if s.month, err = parseField(fields[3], 1, 12); err != nil {
+		return nil, err
+	}
+	if s.dow, err = parseField(fields[4], 0, 7); err != nil {
+		return nil, err
+	}
+	// Both 0 and 7 are Sunday.
+	if s.dow[7] {
+		s.dow[0] = true
+	}
+	return s, nil
+}
+
+// Match reports whether the schedule fires at the minute of t.
+func (s *Spec) Match(t time.Time) bool {
+	if !s.minute[t.Minute()] || !s.hour[t.Hour()] || !s.month[int(t.Month())] {
+		return false
+	}
+	if s.anyDay {
+		return s.dom[t.Day()] && s.dow[int(t.Weekday())]
+	}
+	return s.dom[t.Day()] || s.dow[int(t.Weekday())]
+}
+
+// Next returns the first time after t at which the schedule fires, or the
+// zero time if it does not fire within a year.
+func (s *Spec) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	for end := t.AddDate(1, 0, 0); t.Before(end); t = t.Add(time.Minute) {
+		if s.Match(t) {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (s *Spec) String() string {
+	return s.text
+}
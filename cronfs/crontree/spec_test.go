@@ -0,0 +1,135 @@
+package crontree
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseField(t *testing.T) {
+	tests := []struct {
+		field    string
+		min, max int
+		want     []int
+		err      bool
+	}{
+		{field: "*", min: 1, max: 5, want: []int{1, 2, 3, 4, 5}},
+		{field: "3", min: 0, max: 59, want: []int{3}},
+		{field: "1,4,9", min: 0, max: 59, want: []int{1, 4, 9}},
+		{field: "2-5", min: 0, max: 59, want: []int{2, 3, 4, 5}},
+		{field: "*/15", min: 0, max: 59, want: []int{0, 15, 30, 45}},
+		{field: "10-20/5", min: 0, max: 59, want: []int{10, 15, 20}},
+		{field: "5/10", min: 0, max: 59, want: []int{5, 15, 25, 35, 45, 55}},
+		{field: "1-2,50/5", min: 0, max: 59, want: []int{1, 2, 50, 55}},
+		{field: "60", min: 0, max: 59, err: true},
+		{field: "0", min: 1, max: 31, err: true},
+		{field: "5-2", min: 0, max: 59, err: true},
+		{field: "*/0", min: 0, max: 59, err: true},
+		{field: "a", min: 0, max: 59, err: true},
+		{field: "1-b", min: 0, max: 59, err: true},
+	}
+
+	for _, tt := range tests {
+		set, err := parseField(tt.field, tt.min, tt.max)
+		if tt.err {
+			if err == nil {
+				t.Errorf("parseField(%q) succeeded, expected error", tt.field)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseField(%q): %v", tt.field, err)
+			continue
+		}
+		var got []int
+		for i := tt.min; i <= tt.max; i++ {
+			if set[i] {
+				got = append(got, i)
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseField(%q) = %v, expected %v", tt.field, got, tt.want)
+		}
+	}
+}
+
+func spec(t *testing.T, s string) *Spec {
+	sp, err := ParseSpec(strings.Fields(s))
+	if err != nil {
+		t.Fatalf("parse %q: %v", s, err)
+	}
+	return sp
+}
+
+func date(s string) time.Time {
+	t, err := time.Parse("2006-01-02 15:04", s)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		spec string
+		time string
+		want bool
+	}{
+		{"* * * * *", "2026-10-15 12:34", true},
+		{"30 12 * * *", "2026-10-15 12:30", true},
+		{"30 12 * * *", "2026-10-15 12:31", false},
+		{"0 0 15 10 *", "2026-10-15 00:00", true},
+		{"0 0 15 11 *", "2026-10-15 00:00", false},
+
+		// Thursday, the 15th.
+		{"0 0 * * 4", "2026-10-15 00:00", true},
+		{"0 0 * * 2", "2026-10-15 00:00", false},
+		{"0 0 15 * *", "2026-10-15 00:00", true},
+		{"0 0 */2 * 2", "2026-10-15 00:00", false},
+		{"0 0 * * 0", "2026-11-01 00:00", true},
+		{"0 0 * * 7", "2026-11-01 00:00", true},
+
+		// With both days restricted, either matching is enough.
+		{"0 0 1 * 2", "2026-10-13 00:00", true},
+		{"0 0 1 * 2", "2026-10-01 00:00", true},
+		{"0 0 1 * 2", "2026-10-15 00:00", false},
+		{"0 0 15 * 2", "2026-10-15 00:00", true},
+	}
+
+	for _, tt := range tests {
+		if got := spec(t, tt.spec).Match(date(tt.time)); got != tt.want {
+			t.Errorf("%q matching %s = %v, expected %v", tt.spec, tt.time, got, tt.want)
+		}
+	}
+}
+
+func TestNext(t *testing.T) {
+	// An empty want is the zero time, as the schedule does not fire
+	// within a year.
+	tests := []struct {
+		spec string
+		from string
+		want string
+	}{
+		{"* * * * *", "2026-10-15 12:34", "2026-10-15 12:35"},
+		{"0 * * * *", "2026-10-15 12:34", "2026-10-15 13:00"},
+		{"0 * * * *", "2026-10-15 12:00", "2026-10-15 13:00"},
+		{"5/10 * * * *", "2026-10-15 12:34", "2026-10-15 12:35"},
+		{"0 0 * * 5", "2026-10-15 12:34", "2026-10-16 00:00"},
+		{"0 0 1 * 2", "2026-10-01 00:00", "2026-10-06 00:00"},
+		{"0 0 1 * *", "2026-10-15 12:34", "2026-11-01 00:00"},
+		{"0 0 29 2 *", "2026-10-15 12:34", ""},
+	}
+
+	for _, tt := range tests {
+		got := spec(t, tt.spec).Next(date(tt.from))
+		var want time.Time
+		if tt.want != "" {
+			want = date(tt.want)
+		}
+		if !got.Equal(want) {
+			t.Errorf("%q after %s = %v, expected %v", tt.spec, tt.from, got, want)
+		}
+	}
+}
@@ -0,0 +1,322 @@
+package crontree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+	"github.com/kennylevinsen/g9ptools/fileserver/ctl"
+	"github.com/kennylevinsen/g9ptools/ramfs/ramtree"
+)
+
+const (
+	// MaxOutput is the amount of output retained from the last run of a job.
+	MaxOutput = 64 * 1024
+)
+
+// CronTree schedules commands on the host. Every user has a directory,
+// /cron/<user>, which is created the first time the user walks to it. Writing
+// a crontab line to /cron/<user>/ctl schedules a job:
+//
+//	min hour dom month dow command
+//
+// and writing "del <id>" removes it. Reading ctl lists the jobs. Each job has
+// a directory, /cron/<user>/<id>, with a status file and an output file
+// holding the output of the last run.
+//
+// Commands are run with sh -c as the user running the server, regardless of
+// the 9P user that scheduled them.
+type CronTree struct {
+	*ramtree.RAMTree
+	cron *cronDir
+	stop chan struct{}
+}
+
+type cronDir struct {
+	*ramtree.RAMTree
+	sync.Mutex
+	group string
+	users map[string]*userDir
+}
+
+type userDir struct {
+	*ramtree.RAMTree
+	sync.Mutex
+	user  string
+	group string
+	next  int
+	jobs  map[int]*job
+	ctl   *ctl.Parser
+}
+
+type job struct {
+	sync.Mutex
+	id      int
+	spec    *Spec
+	command string
+	running bool
+	lastRun time.Time
+	lastErr error
+	runs    int
+	output  []byte
+}
+
+// Walk creates the directory of the walking user on demand.
+func (d *cronDir) Walk(user, name string) (fileserver.File, error) {
+	f, err := d.RAMTree.Walk(user, name)
+	if err != fileserver.ErrNotExist || name != user {
+		return f, err
+	}
+
+	d.Lock()
+	defer d.Unlock()
+	if u, ok := d.users[name]; ok {
+		return u, nil
+	}
+	u := newUserDir(user, d.group)
+	if err := d.RAMTree.Add(user, u); err != nil {
+		return nil, err
+	}
+	d.users[user] = u
+	return u, nil
+}
+
+func (d *cronDir) Create(user, name string, perms protocol.FileMode) (fileserver.File, error) {
+	return nil, fileserver.ErrPermission
+}
+
+func (d *cronDir) userDirs() []*userDir {
+	d.Lock()
+	defer d.Unlock()
+	var dirs []*userDir
+	for _, u := range d.users {
+		dirs = append(dirs, u)
+	}
+	return dirs
+}
+
+func (u *userDir) Create(user, name string, perms protocol.FileMode) (fileserver.File, error) {
+	return nil, fileserver.ErrPermission
+}
+
+func (u *userDir) Remove(user, name string) error {
+	id, err := strconv.Atoi(name)
+	if err != nil {
+		return fileserver.ErrPermission
+	}
+	if user != u.user {
+		return fileserver.ErrPermission
+	}
+	return u.del(id)
+}
+
+func (u *userDir) add(spec *Spec, command string) (*job, error) {
+	u.Lock()
+	id := u.next
+	u.next++
+	j := &job{id: id, spec: spec, command: command}
+	u.jobs[id] = j
+	u.Unlock()
+
+	dir := ramtree.NewRAMTree(strconv.Itoa(id), 0500, u.user, u.group)
+	dir.Add("status", ramtree.NewCallbackFile("status", 0400, u.user, u.group, j.readStatus, nil))
+	dir.Add("output", ramtree.NewCallbackFile("output", 0400, u.user, u.group, j.readOutput, nil))
+	if err := u.RAMTree.Add(strconv.Itoa(id), dir); err != nil {
+		u.Lock()
+		delete(u.jobs, id)
+		u.Unlock()
+		return nil, err
+	}
+	return j, nil
+}
+
+func (u *userDir) del(id int) error {
+	u.Lock()
+	_, ok := u.jobs[id]
+	delete(u.jobs, id)
+	u.Unlock()
+	if !ok {
+		return errors.New("no such job")
+	}
+	return u.RAMTree.Delete(strconv.Itoa(id))
+}
+
+func (u *userDir) list() []*job {
+	u.Lock()
+	defer u.Unlock()
+	var jobs []*job
+	for _, j := range u.jobs {
+		jobs = append(jobs, j)
+	}
+	sort.Slice(jobs, func(a, b int) bool { return jobs[a].id < jobs[b].id })
+	return jobs
+}
+
+func (u *userDir) readCtl(string) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	for _, j := range u.list() {
+		fmt.Fprintf(buf, "%d %s %s\n", j.id, j.spec, j.command)
+	}
+	return buf.Bytes(), nil
+}
+
+// commands returns the parser of the ctl commands. Crontab lines are not
+// commands, and are handled by writeCtl, as their command is passed to the
+// shell and must keep its quotes.
+func (u *userDir) commands() *ctl.Parser {
+	p := ctl.NewParser()
+	p.Register(ctl.Command{
+		Name:    "del",
+		Usage:   "del id",
+		MinArgs: 1,
+		MaxArgs: 1,
+		Run: func(_ string, args []string) error {
+			id, err := strconv.Atoi(args[0])
+			if err != nil {
+				return err
+			}
+			return u.del(id)
+		},
+	})
+	return p
+}
+
+func (u *userDir) writeCtl(user string, p []byte) (int, error) {
+	for _, line := range strings.Split(string(p), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "del" {
+			if err := u.ctl.Exec(user, line); err != nil {
+				return 0, err
+			}
+			continue
+		}
+
+		if len(fields) < 6 {
+			return 0, errors.New("usage: min hour dom month dow command")
+		}
+		spec, err := ParseSpec(fields[:5])
+		if err != nil {
+			return 0, err
+		}
+		if _, err := u.add(spec, strings.Join(fields[5:], " ")); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (j *job) readStatus(string) ([]byte, error) {
+	j.Lock()
+	defer j.Unlock()
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "schedule %s\n", j.spec)
+	fmt.Fprintf(buf, "command %s\n", j.command)
+	fmt.Fprintf(buf, "runs %d\n", j.runs)
+	fmt.Fprintf(buf, "running %v\n", j.running)
+	if !j.lastRun.IsZero() {
+		fmt.Fprintf(buf, "last %s\n", j.lastRun.Format(time.RFC3339))
+		status := "ok"
+		if j.lastErr != nil {
+			status = j.lastErr.Error()
+		}
+		fmt.Fprintf(buf, "status %s\n", status)
+	}
+	if next := j.spec.Next(time.Now()); !next.IsZero() {
+		fmt.Fprintf(buf, "next %s\n", next.Format(time.RFC3339))
+	}
+	return buf.Bytes(), nil
+}
+
+func (j *job) readOutput(string) ([]byte, error) {
+	j.Lock()
+	defer j.Unlock()
+	return j.output, nil
+}
+
+// run executes the job unless the previous run is still going.
+func (j *job) run(now time.Time) {
+	j.Lock()
+	if j.running {
+		j.Unlock()
+		return
+	}
+	j.running = true
+	j.Unlock()
+
+	out, err := exec.Command("sh", "-c", j.command).CombinedOutput()
+	if len(out) > MaxOutput {
+		out = out[len(out)-MaxOutput:]
+	}
+
+	j.Lock()
+	defer j.Unlock()
+	j.running = false
+	j.lastRun = now
+	j.lastErr = err
+	j.output = out
+	j.runs++
+}
+
+// Run starts the scheduler. It checks the jobs at the start of every minute
+// until Stop is called.
+func (t *CronTree) Run() {
+	for {
+		now := time.Now()
+		next := now.Truncate(time.Minute).Add(time.Minute)
+		select {
+		case <-t.stop:
+			return
+		case <-time.After(next.Sub(now)):
+		}
+
+		for _, u := range t.cron.userDirs() {
+			for _, j := range u.list() {
+				if j.spec.Match(next) {
+					go j.run(next)
+				}
+			}
+		}
+	}
+}
+
+func (t *CronTree) Stop() {
+	close(t.stop)
+}
+
+func newUserDir(user, group string) *userDir {
+	u := &userDir{
+		RAMTree: ramtree.NewRAMTree(user, 0700, user, group),
+		user:    user,
+		group:   group,
+		jobs:    make(map[int]*job),
+	}
+	u.ctl = u.commands()
+	u.RAMTree.Add("ctl", ramtree.NewCallbackFile("ctl", 0600, user, group, u.readCtl, u.writeCtl))
+	return u
+}
+
+func NewCronTree(user, group string) *CronTree {
+	cron := &cronDir{
+		RAMTree: ramtree.NewRAMTree("cron", 0555, user, group),
+		group:   group,
+		users:   make(map[string]*userDir),
+	}
+	t := &CronTree{
+		RAMTree: ramtree.NewRAMTree("/", 0555, user, group),
+		cron:    cron,
+		stop:    make(chan struct{}),
+	}
+	t.RAMTree.Add("cron", cron)
+	return t
+}
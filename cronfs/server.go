@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/kennylevinsen/g9p"
+	"github.com/kennylevinsen/g9ptools/cronfs/crontree"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+	"github.com/kennylevinsen/g9ptools/transport"
+)
+
+func main() {
+	if len(os.Args) < 5 {
+		fmt.Printf("Too few arguments\n")
+		fmt.Printf("%s service UID GID address\n", os.Args[0])
+		fmt.Printf("UID and GID are the user/group that owns /\n")
+		fmt.Printf("address is a dial string, such as :5640, or stdio to serve a single session on standard input and output\n")
+		return
+	}
+
+	service := os.Args[1]
+	user := os.Args[2]
+	group := os.Args[3]
+	addr := os.Args[4]
+
+	root := crontree.NewCronTree(user, group)
+	go root.Run()
+	l, err := transport.ListenDialString(addr)
+	if err != nil {
+		log.Fatalf("Unable to listen: %v", err)
+	}
+
+	h := func() g9p.Handler {
+		m := make(map[string]fileserver.Dir)
+		m[service] = root
+		return fileserver.NewFileServer(nil, m, 10*1024*1024, fileserver.Chatty)
+	}
+
+	log.Printf("Starting cronfs at %s", addr)
+	transport.Ready()
+	g9p.ServeListener(l, h)
+}
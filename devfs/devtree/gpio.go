@@ -0,0 +1,82 @@
+package devtree
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+	"github.com/kennylevinsen/g9ptools/fileserver/templatefs"
+)
+
+// GPIOPath is where the sysfs GPIO interface is mounted.
+var GPIOPath = "/sys/class/gpio"
+
+// gpioAttrs are the sysfs attributes of a pin that are exported.
+var gpioAttrs = []string{"value", "direction", "edge", "active_low"}
+
+// gpio is the directory of a GPIO pin, holding a file per attribute.
+type gpio struct {
+	templatefs.DirBase
+}
+
+func newGPIO(name string, pin int, perms protocol.FileMode, user, group string) (*gpio, error) {
+	dir := filepath.Join(GPIOPath, fmt.Sprintf("gpio%d", pin))
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		if err := ioutil.WriteFile(filepath.Join(GPIOPath, "export"), []byte(strconv.Itoa(pin)), 0); err != nil {
+			return nil, err
+		}
+	}
+
+	g := &gpio{}
+	// Directories need the exec bits wherever the read bits are set.
+	g.Init(name, perms|(perms&0444)>>2, user, group)
+	for _, attr := range gpioAttrs {
+		a := &gpioAttr{path: filepath.Join(dir, attr)}
+		a.Init(attr, perms&0666, user, group)
+		if err := g.Add(a); err != nil {
+			return nil, err
+		}
+	}
+	return g, nil
+}
+
+// gpioAttr is a sysfs attribute of a pin. Its content is read when opened,
+// and each write is written to the attribute as is, such as "1" to value or
+// "out" to direction.
+type gpioAttr struct {
+	templatefs.FileBase
+	path string
+}
+
+func (a *gpioAttr) Open(user string, mode protocol.OpenMode) (fileserver.OpenFile, error) {
+	if err := a.CheckOpen(user, mode); err != nil {
+		return nil, err
+	}
+	var content []byte
+	if mode&3 == protocol.OREAD || mode&3 == protocol.ORDWR {
+		b, err := ioutil.ReadFile(a.path)
+		if err != nil {
+			return nil, err
+		}
+		content = b
+	}
+	return &gpioAttrOpenFile{Reader: templatefs.NewReader(content), a: a, user: user}, nil
+}
+
+type gpioAttrOpenFile struct {
+	*templatefs.Reader
+	a    *gpioAttr
+	user string
+}
+
+func (of *gpioAttrOpenFile) Write(p []byte) (int, error) {
+	if err := ioutil.WriteFile(of.a.path, p, 0); err != nil {
+		return 0, err
+	}
+	of.a.Modified(of.user)
+	return len(p), nil
+}
@@ -0,0 +1,143 @@
+package devtree
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+	"github.com/kennylevinsen/g9ptools/fileserver/templatefs"
+	"github.com/kennylevinsen/g9ptools/ramfs/ramtree"
+)
+
+// DevTree exports selected host devices. Character devices, such as serial
+// ports, are files that open the device on the host, and GPIO pins are
+// directories of their sysfs attributes. Line settings of serial ports, such
+// as the baud rate, are left to the host.
+type DevTree struct {
+	templatefs.DirBase
+	user  string
+	group string
+}
+
+// AddDevice exports the character device at path as name.
+func (t *DevTree) AddDevice(name, path string, perms protocol.FileMode) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeCharDevice == 0 {
+		return errors.New("not a character device")
+	}
+
+	d := &Device{path: path}
+	d.Init(name, perms&0777, t.user, t.group)
+	return t.Add(d)
+}
+
+// AddGPIO exports the GPIO pin as the directory name, exporting the pin in
+// sysfs first if needed.
+func (t *DevTree) AddGPIO(name string, pin int, perms protocol.FileMode) error {
+	g, err := newGPIO(name, pin, perms&0777, t.user, t.group)
+	if err != nil {
+		return err
+	}
+	return t.Add(g)
+}
+
+// Device is an exported character device. Every open of it opens the
+// device on the host, and reads and writes of the open file go to the device
+// directly, blocking as they do on the host. Offsets are ignored.
+type Device struct {
+	templatefs.FileBase
+	path string
+}
+
+func (d *Device) Open(user string, mode protocol.OpenMode) (fileserver.OpenFile, error) {
+	var flag int
+	switch mode & 3 {
+	case protocol.OREAD:
+		flag = os.O_RDONLY
+	case protocol.OWRITE:
+		flag = os.O_WRONLY
+	case protocol.ORDWR:
+		flag = os.O_RDWR
+	default:
+		return nil, errors.New("devices cannot be executed")
+	}
+	if err := d.CheckOpen(user, mode); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(d.path, flag, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &deviceOpenFile{d: d, user: user, f: f}, nil
+}
+
+// deviceOpenFile is an open device. Blocked reads and writes are interrupted
+// by expiring the deadline of the file, which requires the device to be
+// pollable, as terminals and most other character devices are.
+type deviceOpenFile struct {
+	sync.Mutex
+	d           *Device
+	user        string
+	f           *os.File
+	interrupted bool
+}
+
+func (of *deviceOpenFile) Seek(offset int64, whence int) (int64, error) {
+	return offset, nil
+}
+
+// done finishes an operation that transferred n bytes, consuming a pending
+// interrupt.
+func (of *deviceOpenFile) done(n int, err error) (int, error) {
+	of.Lock()
+	defer of.Unlock()
+	if of.interrupted {
+		of.interrupted = false
+		of.f.SetDeadline(time.Time{})
+		if n == 0 {
+			return 0, ramtree.ErrInterrupted
+		}
+		return n, nil
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+func (of *deviceOpenFile) Read(p []byte) (int, error) {
+	return of.done(of.f.Read(p))
+}
+
+func (of *deviceOpenFile) Write(p []byte) (int, error) {
+	n, err := of.done(of.f.Write(p))
+	if n > 0 {
+		of.d.Modified(of.user)
+	}
+	return n, err
+}
+
+func (of *deviceOpenFile) Interrupt() {
+	of.Lock()
+	defer of.Unlock()
+	of.interrupted = true
+	of.f.SetDeadline(time.Now())
+}
+
+func (of *deviceOpenFile) Close() error {
+	return of.f.Close()
+}
+
+func NewDevTree(user, group string) *DevTree {
+	t := &DevTree{user: user, group: group}
+	t.Init("/", 0555, user, group)
+	return t
+}
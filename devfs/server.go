@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/kennylevinsen/g9p"
+	"github.com/kennylevinsen/g9ptools/devfs/devtree"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+	"github.com/kennylevinsen/g9ptools/transport"
+)
+
+func main() {
+	if len(os.Args) < 6 {
+		fmt.Printf("Too few arguments\n")
+		fmt.Printf("%s service UID GID address name=device...\n", os.Args[0])
+		fmt.Printf("UID and GID are the user/group that owns / and the devices\n")
+		fmt.Printf("address is a dial string, such as :5640, or stdio to serve a single session on standard input and output\n")
+		fmt.Printf("device is the path of a character device, or gpioN for GPIO pin N, e.g.:\n")
+		fmt.Printf("  %s dev glenda glenda :5640 serial=/dev/ttyUSB0 led=gpio17\n", os.Args[0])
+		return
+	}
+
+	service := os.Args[1]
+	user := os.Args[2]
+	group := os.Args[3]
+	addr := os.Args[4]
+
+	root := devtree.NewDevTree(user, group)
+	for _, arg := range os.Args[5:] {
+		idx := strings.Index(arg, "=")
+		if idx == -1 {
+			log.Fatalf("Invalid device %q: expected name=device", arg)
+		}
+		name, dev := arg[:idx], arg[idx+1:]
+
+		var err error
+		if strings.HasPrefix(dev, "gpio") {
+			var pin int
+			pin, err = strconv.Atoi(dev[len("gpio"):])
+			if err != nil {
+				log.Fatalf("Invalid GPIO pin %q", dev)
+			}
+			err = root.AddGPIO(name, pin, 0660)
+		} else {
+			err = root.AddDevice(name, dev, 0660)
+		}
+		if err != nil {
+			log.Fatalf("Unable to add device %s: %v", name, err)
+		}
+	}
+
+	l, err := transport.ListenDialString(addr)
+	if err != nil {
+		log.Fatalf("Unable to listen: %v", err)
+	}
+
+	h := func() g9p.Handler {
+		m := make(map[string]fileserver.Dir)
+		m[service] = root
+		return fileserver.NewFileServer(nil, m, 10*1024*1024, fileserver.Chatty)
+	}
+
+	log.Printf("Starting devfs at %s", addr)
+	transport.Ready()
+	g9p.ServeListener(l, h)
+}
@@ -0,0 +1,300 @@
+// Package dnstree serves a DNS resolver, in the manner of Plan 9's ndb/dns.
+// Walking to a name yields a directory of its records, which are looked up
+// when opened:
+//
+//	ctl			"server addr", "timeout duration", read for the
+//				current configuration
+//	example.com/a		the IPv4 addresses of the name, one per line
+//	example.com/aaaa	the IPv6 addresses
+//	example.com/ip		both
+//	example.com/cname	the canonical name
+//	example.com/mx		"preference host" per mail exchanger
+//	example.com/ns		the name servers
+//	example.com/txt		the text records, one per line
+//	_sip._tcp.example.com/srv	"priority weight port target" per record
+//	192.0.2.1/ptr		the names of an address
+//
+// Names are not listed, as any may be looked up. A failed lookup fails the
+// open, with the error of the resolver.
+package dnstree
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+	"github.com/kennylevinsen/g9ptools/fileserver/ctl"
+	"github.com/kennylevinsen/g9ptools/fileserver/templatefs"
+	"github.com/kennylevinsen/g9ptools/ramfs/ramtree"
+)
+
+// DefaultTimeout is the time allowed for a lookup unless configured
+// otherwise.
+const DefaultTimeout = 5 * time.Second
+
+var errInvalidName = errors.New("invalid name")
+
+// lookup looks up the records of a type.
+type lookup func(ctx context.Context, r *net.Resolver, name string) ([]string, error)
+
+var lookups = map[string]lookup{
+	"a": func(ctx context.Context, r *net.Resolver, name string) ([]string, error) {
+		return lookupIP(ctx, r, name, "ip4")
+	},
+	"aaaa": func(ctx context.Context, r *net.Resolver, name string) ([]string, error) {
+		return lookupIP(ctx, r, name, "ip6")
+	},
+	"ip": func(ctx context.Context, r *net.Resolver, name string) ([]string, error) {
+		return lookupIP(ctx, r, name, "ip")
+	},
+	"cname": func(ctx context.Context, r *net.Resolver, name string) ([]string, error) {
+		cname, err := r.LookupCNAME(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		return []string{cname}, nil
+	},
+	"mx": func(ctx context.Context, r *net.Resolver, name string) ([]string, error) {
+		mxs, err := r.LookupMX(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		var res []string
+		for _, mx := range mxs {
+			res = append(res, fmt.Sprintf("%d %s", mx.Pref, mx.Host))
+		}
+		return res, nil
+	},
+	"ns": func(ctx context.Context, r *net.Resolver, name string) ([]string, error) {
+		nss, err := r.LookupNS(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		var res []string
+		for _, ns := range nss {
+			res = append(res, ns.Host)
+		}
+		return res, nil
+	},
+	"txt": func(ctx context.Context, r *net.Resolver, name string) ([]string, error) {
+		return r.LookupTXT(ctx, name)
+	},
+	"srv": func(ctx context.Context, r *net.Resolver, name string) ([]string, error) {
+		_, srvs, err := r.LookupSRV(ctx, "", "", name)
+		if err != nil {
+			return nil, err
+		}
+		var res []string
+		for _, srv := range srvs {
+			res = append(res, fmt.Sprintf("%d %d %d %s", srv.Priority, srv.Weight, srv.Port, srv.Target))
+		}
+		return res, nil
+	},
+	"ptr": func(ctx context.Context, r *net.Resolver, name string) ([]string, error) {
+		return r.LookupAddr(ctx, name)
+	},
+}
+
+// types are the record files of a name, in the order they are listed.
+var types = []string{"a", "aaaa", "ip", "cname", "mx", "ns", "txt", "srv", "ptr"}
+
+func lookupIP(ctx context.Context, r *net.Resolver, name, network string) ([]string, error) {
+	ips, err := r.LookupIPAddr(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	var res []string
+	for _, ip := range ips {
+		v4 := ip.IP.To4() != nil
+		if network == "ip" || (network == "ip4") == v4 {
+			res = append(res, ip.IP.String())
+		}
+	}
+	return res, nil
+}
+
+// id returns a qid path for the file at p. Paths are hashed, so that the qid
+// of a name stays the same across walks, and have the top bit set, so that
+// they do not collide with the qid paths allocated by templatefs.NextID.
+func id(p string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(p))
+	return h.Sum64() | 1<<63
+}
+
+// DNSTree is the root of the tree.
+type DNSTree struct {
+	templatefs.DirBase
+	cfg sync.Mutex
+
+	server  string
+	timeout time.Duration
+}
+
+// SetServer sets the address of the server to query, as host or host:port.
+// An empty address uses the resolver of the system.
+func (t *DNSTree) SetServer(addr string) {
+	if addr != "" {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(addr, "53")
+		}
+	}
+	t.cfg.Lock()
+	defer t.cfg.Unlock()
+	t.server = addr
+}
+
+// SetTimeout sets the time allowed for a lookup.
+func (t *DNSTree) SetTimeout(d time.Duration) {
+	t.cfg.Lock()
+	defer t.cfg.Unlock()
+	t.timeout = d
+}
+
+// resolver returns the resolver to use for a lookup, and the time allowed
+// for it.
+func (t *DNSTree) resolver() (*net.Resolver, time.Duration) {
+	t.cfg.Lock()
+	defer t.cfg.Unlock()
+	if t.server == "" {
+		return net.DefaultResolver, t.timeout
+	}
+	server := t.server
+	var d net.Dialer
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return d.DialContext(ctx, network, server)
+		},
+	}, t.timeout
+}
+
+func (t *DNSTree) config(string) ([]byte, error) {
+	t.cfg.Lock()
+	defer t.cfg.Unlock()
+	var s string
+	if t.server != "" {
+		s += fmt.Sprintf("server %s\n", t.server)
+	}
+	s += fmt.Sprintf("timeout %v\n", t.timeout)
+	return []byte(s), nil
+}
+
+// ctl returns the parser of the commands of the ctl file.
+func (t *DNSTree) ctl() *ctl.Parser {
+	p := ctl.NewParser()
+	p.Register(ctl.Command{
+		Name:    "server",
+		Usage:   "server [addr]",
+		MinArgs: 0,
+		MaxArgs: 1,
+		Run: func(_ string, args []string) error {
+			var addr string
+			if len(args) > 0 {
+				addr = args[0]
+			}
+			t.SetServer(addr)
+			return nil
+		},
+	})
+	p.Register(ctl.Command{
+		Name:    "timeout",
+		Usage:   "timeout duration",
+		MinArgs: 1,
+		MaxArgs: 1,
+		Run: func(_ string, args []string) error {
+			d, err := time.ParseDuration(args[0])
+			if err != nil {
+				return err
+			}
+			if d <= 0 {
+				return errors.New("timeout must be positive")
+			}
+			t.SetTimeout(d)
+			return nil
+		},
+	})
+	return p
+}
+
+// validName reports whether name may be looked up.
+func validName(name string) bool {
+	if name == "" || name == "." || name == ".." || len(name) > 253 {
+		return false
+	}
+	return !strings.ContainsAny(name, "/ \t\r\n")
+}
+
+func (t *DNSTree) Walk(user, name string) (fileserver.File, error) {
+	f, err := t.DirBase.Walk(user, name)
+	if err != fileserver.ErrNotExist {
+		return f, err
+	}
+	if !validName(name) {
+		return nil, errInvalidName
+	}
+	user, group, _ := t.Permissions()
+	return t.newName(name, user, group), nil
+}
+
+// newName returns the directory of the records of a name.
+func (t *DNSTree) newName(name, user, group string) *templatefs.DirBase {
+	d := &templatefs.DirBase{}
+	d.Init(name, 0555, user, group)
+	d.SetID(id(name))
+	for _, typ := range types {
+		f := &recordFile{t: t, name: name, lookup: lookups[typ]}
+		f.Init(typ, 0444, user, group)
+		f.SetID(id(name + "/" + typ))
+		d.Add(f)
+	}
+	return d
+}
+
+// recordFile is the records of a type for a name.
+type recordFile struct {
+	templatefs.FileBase
+	t      *DNSTree
+	name   string
+	lookup lookup
+}
+
+func (f *recordFile) Open(user string, mode protocol.OpenMode) (fileserver.OpenFile, error) {
+	if err := f.CheckOpen(user, mode); err != nil {
+		return nil, err
+	}
+	r, timeout := f.t.resolver()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	res, err := f.lookup(ctx, r, f.name)
+	if err != nil {
+		return nil, err
+	}
+	var s string
+	for _, rec := range res {
+		s += rec + "\n"
+	}
+	return templatefs.NewReader([]byte(s)), nil
+}
+
+// NewDNSTree returns a tree using the resolver of the system, owned by user
+// and group. Anyone may look names up, while only the owners may use ctl.
+func NewDNSTree(user, group string) *DNSTree {
+	t := &DNSTree{timeout: DefaultTimeout}
+	t.Init("/", 0555, user, group)
+
+	// The qid of the callback file is taken from the same counter as those
+	// of the other files.
+	c := t.ctl()
+	cf := ramtree.NewCallbackFile("ctl", 0660, user, group, t.config, c.Write)
+	cf.SetID(templatefs.NextID())
+	t.Add(cf)
+	return t
+}
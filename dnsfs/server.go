@@ -0,0 +1,51 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/kennylevinsen/g9p"
+	"github.com/kennylevinsen/g9ptools/dnsfs/dnstree"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+	"github.com/kennylevinsen/g9ptools/transport"
+)
+
+func main() {
+	server := flag.String("server", "", "address of the DNS server to query, instead of the resolver of the system")
+	timeout := flag.Duration("timeout", dnstree.DefaultTimeout, "time allowed for a lookup")
+	flag.Parse()
+
+	if flag.NArg() < 4 {
+		fmt.Printf("Too few arguments\n")
+		fmt.Printf("%s [-server addr] [-timeout duration] service UID GID address\n", os.Args[0])
+		fmt.Printf("UID and GID are the user/group that owns / and may use ctl\n")
+		fmt.Printf("address is a dial string, such as :5640, or stdio to serve a single session on standard input and output\n")
+		return
+	}
+
+	service := flag.Arg(0)
+	user := flag.Arg(1)
+	group := flag.Arg(2)
+	addr := flag.Arg(3)
+
+	root := dnstree.NewDNSTree(user, group)
+	root.SetServer(*server)
+	root.SetTimeout(*timeout)
+
+	l, err := transport.ListenDialString(addr)
+	if err != nil {
+		log.Fatalf("Unable to listen: %v", err)
+	}
+
+	h := func() g9p.Handler {
+		m := make(map[string]fileserver.Dir)
+		m[service] = root
+		return fileserver.NewFileServer(nil, m, 10*1024*1024, fileserver.Chatty)
+	}
+
+	log.Printf("Starting dnsfs at %s", addr)
+	transport.Ready()
+	g9p.ServeListener(l, h)
+}
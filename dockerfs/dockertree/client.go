@@ -0,0 +1,192 @@
+package dockertree
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// DefaultHost is the Docker daemon address used when none is given.
+const DefaultHost = "unix:///var/run/docker.sock"
+
+// Container is the subset of the Docker container listing used by the tree.
+type Container struct {
+	ID    string   `json:"Id"`
+	Names []string `json:"Names"`
+	Image string   `json:"Image"`
+	State string   `json:"State"`
+}
+
+// Name returns the primary name of the container, without the leading
+// slash, falling back to the short ID.
+func (c Container) Name() string {
+	for _, n := range c.Names {
+		n = strings.TrimPrefix(n, "/")
+		if n != "" && !strings.Contains(n, "/") {
+			return n
+		}
+	}
+	if len(c.ID) > 12 {
+		return c.ID[:12]
+	}
+	return c.ID
+}
+
+// Client is a minimal client for the Docker Engine API.
+type Client struct {
+	http *http.Client
+	base string
+}
+
+func (c *Client) do(method, path string, query url.Values) (*http.Response, error) {
+	u := c.base + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		defer resp.Body.Close()
+		var e struct {
+			Message string `json:"message"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&e) == nil && e.Message != "" {
+			return nil, fmt.Errorf("%s", e.Message)
+		}
+		return nil, fmt.Errorf("%s", resp.Status)
+	}
+	return resp, nil
+}
+
+// Containers lists all containers, running or not.
+func (c *Client) Containers() ([]Container, error) {
+	resp, err := c.do("GET", "/containers/json", url.Values{"all": {"1"}})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var cs []Container
+	if err := json.NewDecoder(resp.Body).Decode(&cs); err != nil {
+		return nil, err
+	}
+	return cs, nil
+}
+
+// Inspect returns the raw inspection document of a container.
+func (c *Client) Inspect(id string) ([]byte, error) {
+	resp, err := c.do("GET", "/containers/"+url.PathEscape(id)+"/json", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
+}
+
+// Action performs a lifecycle action, such as start, stop, restart, kill,
+// pause or unpause, on a container.
+func (c *Client) Action(id, action string) error {
+	resp, err := c.do("POST", "/containers/"+url.PathEscape(id)+"/"+action, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Remove removes a container.
+func (c *Client) Remove(id string, force bool) error {
+	q := url.Values{}
+	if force {
+		q.Set("force", "1")
+	}
+	resp, err := c.do("DELETE", "/containers/"+url.PathEscape(id), q)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Logs follows the output of a container. Unless the container has a TTY,
+// the stream is multiplexed, and must be demultiplexed with Demux.
+func (c *Client) Logs(id string, tail string) (io.ReadCloser, bool, error) {
+	b, err := c.Inspect(id)
+	if err != nil {
+		return nil, false, err
+	}
+	var info struct {
+		Config struct {
+			Tty bool `json:"Tty"`
+		} `json:"Config"`
+	}
+	if err := json.Unmarshal(b, &info); err != nil {
+		return nil, false, err
+	}
+
+	q := url.Values{
+		"follow": {"1"},
+		"stdout": {"1"},
+		"stderr": {"1"},
+		"tail":   {tail},
+	}
+	resp, err := c.do("GET", "/containers/"+url.PathEscape(id)+"/logs", q)
+	if err != nil {
+		return nil, false, err
+	}
+	return resp.Body, info.Config.Tty, nil
+}
+
+// Demux copies a multiplexed Docker stream to w, stripping the 8 byte frame
+// headers.
+func Demux(w io.Writer, r io.Reader) error {
+	var hdr [8]byte
+	for {
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		size := int64(hdr[4])<<24 | int64(hdr[5])<<16 | int64(hdr[6])<<8 | int64(hdr[7])
+		if _, err := io.CopyN(w, r, size); err != nil {
+			return err
+		}
+	}
+}
+
+// NewClient returns a client for the daemon at host, which is either a
+// unix:// or a tcp:// address.
+func NewClient(host string) (*Client, error) {
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "unix":
+		sock := u.Path
+		tr := &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", sock)
+			},
+		}
+		return &Client{http: &http.Client{Transport: tr}, base: "http://docker"}, nil
+	case "tcp", "http":
+		return &Client{http: &http.Client{}, base: "http://" + u.Host}, nil
+	default:
+		return nil, fmt.Errorf("unsupported docker host: %s", host)
+	}
+}
@@ -0,0 +1,253 @@
+package dockertree
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+	"github.com/kennylevinsen/g9ptools/ramfs/ramtree"
+)
+
+// RefreshInterval is the minimum time between container listings. Walks and
+// directory reads within the interval are served from the previous listing.
+const RefreshInterval = time.Second
+
+// DockerTree exposes the containers of a Docker daemon as directories. Each
+// container directory contains:
+//
+//	ctl	reads "id image state", accepts start, stop, restart, kill, pause
+//		and unpause
+//	log	follows the container output, blocking for new lines
+//	inspect	the container inspection document as JSON
+//
+// Removing a container directory removes the container.
+type DockerTree struct {
+	*ramtree.RAMTree
+	sync.Mutex
+	user       string
+	group      string
+	client     *Client
+	containers map[string]*container
+	refreshed  time.Time
+}
+
+type container struct {
+	sync.Mutex
+	t     *DockerTree
+	id    string
+	image string
+	state string
+}
+
+func (c *container) info() (string, string, string) {
+	c.Lock()
+	defer c.Unlock()
+	return c.id, c.image, c.state
+}
+
+func (c *container) readCtl(string) ([]byte, error) {
+	id, image, state := c.info()
+	return []byte(fmt.Sprintf("%s %s %s\n", id, image, state)), nil
+}
+
+func (c *container) writeCtl(_ string, p []byte) (int, error) {
+	cmd := strings.TrimSpace(string(p))
+	switch cmd {
+	case "start", "stop", "restart", "kill", "pause", "unpause":
+	default:
+		return 0, fmt.Errorf("unknown ctl command: %s", cmd)
+	}
+	id, _, _ := c.info()
+	if err := c.t.client.Action(id, cmd); err != nil {
+		return 0, err
+	}
+	c.t.invalidate()
+	return len(p), nil
+}
+
+func (c *container) readInspect(string) ([]byte, error) {
+	id, _, _ := c.info()
+	return c.t.client.Inspect(id)
+}
+
+func (c *container) openLog(user string, mode protocol.OpenMode) (fileserver.OpenFile, error) {
+	id, _, _ := c.info()
+	r, tty, err := c.t.client.Logs(id, "all")
+	if err != nil {
+		return nil, err
+	}
+
+	p := ramtree.NewPipe()
+	go func() {
+		if tty {
+			io.Copy(p, r)
+		} else {
+			Demux(p, r)
+		}
+		p.CloseWrite()
+	}()
+
+	of, err := p.Opener()(user, mode)
+	if err != nil {
+		r.Close()
+		p.CloseWrite()
+		return nil, err
+	}
+	return &logOpenFile{OpenFile: of, r: r, p: p}, nil
+}
+
+// logOpenFile stops following the log when closed.
+type logOpenFile struct {
+	fileserver.OpenFile
+	r io.Closer
+	p *ramtree.Pipe
+}
+
+func (of *logOpenFile) Interrupt() {
+	if i, ok := of.OpenFile.(fileserver.Interrupter); ok {
+		i.Interrupt()
+	}
+}
+
+func (of *logOpenFile) Close() error {
+	of.r.Close()
+	of.p.CloseWrite()
+	return of.OpenFile.Close()
+}
+
+func (t *DockerTree) newContainer(name string, info Container) error {
+	c := &container{
+		t:     t,
+		id:    info.ID,
+		image: info.Image,
+		state: info.State,
+	}
+
+	dir := ramtree.NewRAMTree(name, 0555, t.user, t.group)
+	files := []*ramtree.SyntheticFile{
+		ramtree.NewCallbackFile("ctl", 0666, t.user, t.group, c.readCtl, c.writeCtl),
+		ramtree.NewSyntheticFile("log", 0444, t.user, t.group, c.openLog),
+		ramtree.NewCallbackFile("inspect", 0444, t.user, t.group, c.readInspect, nil),
+	}
+	for _, f := range files {
+		n, _ := f.Name()
+		if err := dir.Add(n, f); err != nil {
+			return err
+		}
+	}
+
+	if err := t.RAMTree.Add(name, dir); err != nil {
+		return err
+	}
+	t.containers[name] = c
+	return nil
+}
+
+// invalidate forces the next access to list the containers again.
+func (t *DockerTree) invalidate() {
+	t.Lock()
+	defer t.Unlock()
+	t.refreshed = time.Time{}
+}
+
+// refresh synchronizes the directory with the containers of the daemon.
+func (t *DockerTree) refresh() error {
+	t.Lock()
+	defer t.Unlock()
+	if time.Since(t.refreshed) < RefreshInterval {
+		return nil
+	}
+
+	cs, err := t.client.Containers()
+	if err != nil {
+		return err
+	}
+
+	seen := make(map[string]bool)
+	for _, info := range cs {
+		name := info.Name()
+		seen[name] = true
+		if c, ok := t.containers[name]; ok {
+			c.Lock()
+			c.id, c.image, c.state = info.ID, info.Image, info.State
+			c.Unlock()
+			continue
+		}
+		if err := t.newContainer(name, info); err != nil {
+			return err
+		}
+	}
+
+	for name := range t.containers {
+		if !seen[name] {
+			t.RAMTree.Delete(name)
+			delete(t.containers, name)
+		}
+	}
+
+	t.refreshed = time.Now()
+	return nil
+}
+
+func (t *DockerTree) Walk(user, name string) (fileserver.File, error) {
+	if err := t.refresh(); err != nil {
+		return nil, err
+	}
+	return t.RAMTree.Walk(user, name)
+}
+
+func (t *DockerTree) Open(user string, mode protocol.OpenMode) (fileserver.OpenFile, error) {
+	if err := t.refresh(); err != nil {
+		return nil, err
+	}
+	return t.RAMTree.Open(user, mode)
+}
+
+func (t *DockerTree) Create(user, name string, perms protocol.FileMode) (fileserver.File, error) {
+	return nil, fileserver.ErrPermission
+}
+
+// Remove removes the named container from the daemon.
+func (t *DockerTree) Remove(user, name string) error {
+	if user != t.user {
+		return fileserver.ErrPermission
+	}
+
+	t.Lock()
+	c, ok := t.containers[name]
+	t.Unlock()
+	if !ok {
+		return errors.New("no such file")
+	}
+
+	id, _, _ := c.info()
+	if err := t.client.Remove(id, false); err != nil {
+		return err
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	t.RAMTree.Delete(name)
+	delete(t.containers, name)
+	return nil
+}
+
+// Rename is not permitted.
+func (t *DockerTree) Rename(user, oldname, newname string) error {
+	return fileserver.ErrPermission
+}
+
+func NewDockerTree(user, group string, client *Client) *DockerTree {
+	return &DockerTree{
+		RAMTree:    ramtree.NewRAMTree("/", 0555, user, group),
+		user:       user,
+		group:      group,
+		client:     client,
+		containers: make(map[string]*container),
+	}
+}
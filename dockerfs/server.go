@@ -0,0 +1,56 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/kennylevinsen/g9p"
+	"github.com/kennylevinsen/g9ptools/dockerfs/dockertree"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+	"github.com/kennylevinsen/g9ptools/transport"
+)
+
+func main() {
+	defaultHost := os.Getenv("DOCKER_HOST")
+	if defaultHost == "" {
+		defaultHost = dockertree.DefaultHost
+	}
+	host := flag.String("host", defaultHost, "docker daemon address")
+	flag.Parse()
+
+	if flag.NArg() < 4 {
+		fmt.Printf("Too few arguments\n")
+		fmt.Printf("%s [-host address] service UID GID address\n", os.Args[0])
+		fmt.Printf("UID and GID are the user/group that owns /\n")
+		fmt.Printf("address is a dial string, such as :5640, or stdio to serve a single session on standard input and output\n")
+		return
+	}
+
+	service := flag.Arg(0)
+	user := flag.Arg(1)
+	group := flag.Arg(2)
+	addr := flag.Arg(3)
+
+	client, err := dockertree.NewClient(*host)
+	if err != nil {
+		log.Fatalf("Unable to create docker client: %v", err)
+	}
+
+	root := dockertree.NewDockerTree(user, group, client)
+	l, err := transport.ListenDialString(addr)
+	if err != nil {
+		log.Fatalf("Unable to listen: %v", err)
+	}
+
+	h := func() g9p.Handler {
+		m := make(map[string]fileserver.Dir)
+		m[service] = root
+		return fileserver.NewFileServer(nil, m, 10*1024*1024, fileserver.Chatty)
+	}
+
+	log.Printf("Starting dockerfs at %s", addr)
+	transport.Ready()
+	g9p.ServeListener(l, h)
+}
@@ -0,0 +1,106 @@
+package envtree
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+	"github.com/kennylevinsen/g9ptools/ramfs/ramtree"
+)
+
+var ErrNoSuchVariable = errors.New("no such variable")
+
+// EnvTree is a flat directory of variables, in the style of Plan 9's /env.
+// Each file is a variable, and its content is the value.
+type EnvTree struct {
+	*ramtree.RAMTree
+	user  string
+	group string
+}
+
+// Create only permits plain files, as the environment is flat.
+func (t *EnvTree) Create(user, name string, perms protocol.FileMode) (fileserver.File, error) {
+	if perms&protocol.DMDIR != 0 {
+		return nil, errors.New("cannot create directories in environment")
+	}
+	return t.RAMTree.Create(user, name, perms)
+}
+
+func (t *EnvTree) variable(name string) (*ramtree.RAMFile, error) {
+	f, err := t.RAMTree.Walk(t.user, name)
+	if err == fileserver.ErrNotExist {
+		return nil, ErrNoSuchVariable
+	} else if err != nil {
+		return nil, err
+	}
+	rf, ok := f.(*ramtree.RAMFile)
+	if !ok {
+		return nil, ErrNoSuchVariable
+	}
+	return rf, nil
+}
+
+// Get returns the value of a variable.
+func (t *EnvTree) Get(name string) ([]byte, error) {
+	f, err := t.variable(name)
+	if err != nil {
+		return nil, err
+	}
+	return f.Content(), nil
+}
+
+// Set sets the value of a variable, creating it if necessary.
+func (t *EnvTree) Set(name string, value []byte) error {
+	f, err := t.variable(name)
+	if err == ErrNoSuchVariable {
+		f = ramtree.NewRAMFile(name, 0666, t.user, t.group)
+		if err := t.RAMTree.Add(name, f); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	f.SetContent(value)
+	return nil
+}
+
+// Import sets variables from a list of name=value pairs, such as the one
+// returned by os.Environ.
+func (t *EnvTree) Import(environ []string) error {
+	for _, kv := range environ {
+		idx := strings.Index(kv, "=")
+		if idx <= 0 {
+			continue
+		}
+		if err := t.Set(kv[:idx], []byte(kv[idx+1:])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Clone returns an independent copy of the environment.
+func (t *EnvTree) Clone() (*EnvTree, error) {
+	n := NewEnvTree(t.user, t.group)
+	for _, name := range t.RAMTree.Names() {
+		v, err := t.Get(name)
+		if err == ErrNoSuchVariable {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if err := n.Set(name, v); err != nil {
+			return nil, err
+		}
+	}
+	return n, nil
+}
+
+func NewEnvTree(user, group string) *EnvTree {
+	return &EnvTree{
+		RAMTree: ramtree.NewRAMTree("/", 0777, user, group),
+		user:    user,
+		group:   group,
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/kennylevinsen/g9p"
+	"github.com/kennylevinsen/g9ptools/envfs/envtree"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+	"github.com/kennylevinsen/g9ptools/transport"
+)
+
+func main() {
+	session := flag.Bool("session", false, "give every connection its own copy of the environment")
+	importEnv := flag.Bool("import", false, "populate the environment from the server process")
+	flag.Parse()
+
+	if flag.NArg() < 4 {
+		fmt.Printf("Too few arguments\n")
+		fmt.Printf("%s [-session] [-import] service UID GID address\n", os.Args[0])
+		fmt.Printf("UID and GID are the user/group that owns /\n")
+		fmt.Printf("address is a dial string, such as :5640, or stdio to serve a single session on standard input and output\n")
+		return
+	}
+
+	service := flag.Arg(0)
+	user := flag.Arg(1)
+	group := flag.Arg(2)
+	addr := flag.Arg(3)
+
+	root := envtree.NewEnvTree(user, group)
+	if *importEnv {
+		if err := root.Import(os.Environ()); err != nil {
+			log.Fatalf("Unable to import environment: %v", err)
+		}
+	}
+
+	l, err := transport.ListenDialString(addr)
+	if err != nil {
+		log.Fatalf("Unable to listen: %v", err)
+	}
+
+	h := func() g9p.Handler {
+		env := root
+		if *session {
+			// The shared tree only serves as a template.
+			var err error
+			env, err = root.Clone()
+			if err != nil {
+				log.Printf("Unable to clone environment: %v", err)
+				env = envtree.NewEnvTree(user, group)
+			}
+		}
+		m := make(map[string]fileserver.Dir)
+		m[service] = env
+		return fileserver.NewFileServer(nil, m, 10*1024*1024, fileserver.Chatty)
+	}
+
+	log.Printf("Starting envfs at %s", addr)
+	transport.Ready()
+	g9p.ServeListener(l, h)
+}
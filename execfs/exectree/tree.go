@@ -0,0 +1,332 @@
+package exectree
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+	"github.com/kennylevinsen/g9ptools/fileserver/ctl"
+	"github.com/kennylevinsen/g9ptools/ramfs/ramtree"
+)
+
+var (
+	ErrNotStarted     = errors.New("process not started")
+	ErrAlreadyStarted = errors.New("process already started")
+)
+
+// ExecTree runs commands on the host, in the style of Plan 9's devcmd.
+// Opening clone allocates a process directory containing ctl, stdin, stdout,
+// stderr and wait files, and the clone file then acts as the ctl file of the
+// process. The ctl commands are:
+//
+//	dir path	set the working directory
+//	env name=value	add an environment variable
+//	exec cmd args...	start the process
+//	eof		close the standard input of the process
+//	kill		kill the process
+//
+// Arguments may be quoted with single quotes. Reads of stdout, stderr and
+// wait block until data is available; wait returns "pid user sys real
+// status" once the process has exited. The process is killed and its
+// directory removed when the last file referencing it is closed.
+//
+// Commands are run as the user running the server, regardless of the 9P user
+// that started them.
+type ExecTree struct {
+	*ramtree.RAMTree
+	sync.Mutex
+	user  string
+	group string
+	next  int
+}
+
+type proc struct {
+	sync.Mutex
+	id      int
+	t       *ExecTree
+	refs    int
+	dir     string
+	env     []string
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	stdout  *ramtree.Pipe
+	stderr  *ramtree.Pipe
+	start   time.Time
+	done    chan struct{}
+	waitmsg string
+}
+
+func (p *proc) ref() {
+	p.Lock()
+	defer p.Unlock()
+	p.refs++
+}
+
+func (p *proc) unref() {
+	p.Lock()
+	p.refs--
+	if p.refs > 0 {
+		p.Unlock()
+		return
+	}
+	if p.cmd != nil && p.cmd.Process != nil && p.waitmsg == "" {
+		p.cmd.Process.Kill()
+	}
+	p.Unlock()
+	p.t.RAMTree.Delete(strconv.Itoa(p.id))
+}
+
+func (p *proc) ctl(line string) error {
+	fields, err := ctl.Tokenize(line)
+	if err != nil {
+		return err
+	}
+	if len(fields) == 0 {
+		return errors.New("empty ctl message")
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	switch fields[0] {
+	case "dir":
+		if len(fields) != 2 {
+			return errors.New("usage: dir path")
+		}
+		p.dir = fields[1]
+	case "env":
+		if len(fields) != 2 || !strings.Contains(fields[1], "=") {
+			return errors.New("usage: env name=value")
+		}
+		p.env = append(p.env, fields[1])
+	case "exec":
+		if len(fields) < 2 {
+			return errors.New("usage: exec cmd args...")
+		}
+		return p.exec(fields[1:])
+	case "eof":
+		if p.stdin == nil {
+			return ErrNotStarted
+		}
+		return p.stdin.Close()
+	case "kill":
+		if p.cmd == nil || p.cmd.Process == nil {
+			return ErrNotStarted
+		}
+		return p.cmd.Process.Kill()
+	default:
+		return fmt.Errorf("unknown ctl command: %s", fields[0])
+	}
+	return nil
+}
+
+// exec must be called with the process locked.
+func (p *proc) exec(args []string) error {
+	if p.cmd != nil {
+		return ErrAlreadyStarted
+	}
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Dir = p.dir
+	if len(p.env) > 0 {
+		cmd.Env = p.env
+	}
+	cmd.Stdout = p.stdout
+	cmd.Stderr = p.stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	p.cmd = cmd
+	p.stdin = stdin
+	p.start = time.Now()
+	go p.wait()
+	return nil
+}
+
+func (p *proc) wait() {
+	err := p.cmd.Wait()
+	p.stdout.CloseWrite()
+	p.stderr.CloseWrite()
+
+	status := ""
+	if err != nil {
+		status = err.Error()
+	}
+
+	var user, sys time.Duration
+	if ps := p.cmd.ProcessState; ps != nil {
+		user = ps.UserTime()
+		sys = ps.SystemTime()
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	p.waitmsg = fmt.Sprintf("%d %d %d %d '%s'",
+		p.cmd.Process.Pid,
+		user/time.Millisecond,
+		sys/time.Millisecond,
+		time.Since(p.start)/time.Millisecond,
+		strings.Replace(status, "'", "''", -1))
+	close(p.done)
+}
+
+func (p *proc) readID(string) ([]byte, error) {
+	return []byte(strconv.Itoa(p.id)), nil
+}
+
+func (p *proc) writeCtl(_ string, b []byte) (int, error) {
+	if err := p.ctl(string(b)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (p *proc) writeStdin(_ string, b []byte) (int, error) {
+	p.Lock()
+	stdin := p.stdin
+	p.Unlock()
+	if stdin == nil {
+		return 0, ErrNotStarted
+	}
+	return stdin.Write(b)
+}
+
+func (p *proc) openWait(user string, mode protocol.OpenMode) (fileserver.OpenFile, error) {
+	return &waitOpenFile{p: p, intr: make(chan struct{})}, nil
+}
+
+// opener wraps an OpenFunc so that the handle holds a reference to the
+// process for as long as it is open.
+func (p *proc) opener(open ramtree.OpenFunc) ramtree.OpenFunc {
+	return ramtree.RefOpener(open, p.ref, p.unref)
+}
+
+// waitOpenFile blocks until the process has exited, and then serves the wait
+// message.
+type waitOpenFile struct {
+	sync.Mutex
+	p    *proc
+	intr chan struct{}
+	msg  []byte
+}
+
+func (of *waitOpenFile) Seek(offset int64, whence int) (int64, error) {
+	return offset, nil
+}
+
+func (of *waitOpenFile) Read(b []byte) (int, error) {
+	of.Lock()
+	intr := of.intr
+	msg := of.msg
+	of.Unlock()
+
+	if msg == nil {
+		of.p.Lock()
+		started := of.p.cmd != nil
+		of.p.Unlock()
+		if !started {
+			return 0, ErrNotStarted
+		}
+
+		select {
+		case <-of.p.done:
+		case <-intr:
+			return 0, ramtree.ErrInterrupted
+		}
+
+		of.p.Lock()
+		msg = []byte(of.p.waitmsg)
+		of.p.Unlock()
+		of.Lock()
+		of.msg = msg
+		of.Unlock()
+		return copy(b, msg), nil
+	}
+
+	// The wait message is only returned once.
+	return 0, nil
+}
+
+func (of *waitOpenFile) Write(b []byte) (int, error) {
+	return 0, errors.New("wait is read-only")
+}
+
+func (of *waitOpenFile) Interrupt() {
+	of.Lock()
+	defer of.Unlock()
+	close(of.intr)
+	of.intr = make(chan struct{})
+}
+
+func (of *waitOpenFile) Close() error {
+	return nil
+}
+
+func (t *ExecTree) newProc() (*proc, error) {
+	t.Lock()
+	id := t.next
+	t.next++
+	t.Unlock()
+
+	p := &proc{
+		id:     id,
+		t:      t,
+		stdout: ramtree.NewPipe(),
+		stderr: ramtree.NewPipe(),
+		done:   make(chan struct{}),
+	}
+
+	dir := ramtree.NewRAMTree(strconv.Itoa(id), 0555, t.user, t.group)
+	files := []*ramtree.SyntheticFile{
+		ramtree.NewSyntheticFile("ctl", 0666, t.user, t.group, p.opener(ramtree.CallbackOpener(p.readID, p.writeCtl))),
+		ramtree.NewSyntheticFile("stdin", 0222, t.user, t.group, p.opener(ramtree.CallbackOpener(nil, p.writeStdin))),
+		ramtree.NewSyntheticFile("stdout", 0444, t.user, t.group, p.opener(p.stdout.Opener())),
+		ramtree.NewSyntheticFile("stderr", 0444, t.user, t.group, p.opener(p.stderr.Opener())),
+		ramtree.NewSyntheticFile("wait", 0444, t.user, t.group, p.opener(p.openWait)),
+	}
+	for _, f := range files {
+		n, _ := f.Name()
+		if err := dir.Add(n, f); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := t.RAMTree.Add(strconv.Itoa(id), dir); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (t *ExecTree) openClone(user string, mode protocol.OpenMode) (fileserver.OpenFile, error) {
+	p, err := t.newProc()
+	if err != nil {
+		return nil, err
+	}
+	return p.opener(ramtree.CallbackOpener(p.readID, p.writeCtl))(user, mode)
+}
+
+func (t *ExecTree) Create(user, name string, perms protocol.FileMode) (fileserver.File, error) {
+	return nil, fileserver.ErrPermission
+}
+
+func NewExecTree(user, group string) *ExecTree {
+	t := &ExecTree{
+		RAMTree: ramtree.NewRAMTree("/", 0555, user, group),
+		user:    user,
+		group:   group,
+	}
+	t.RAMTree.Add("clone", ramtree.NewSyntheticFile("clone", 0666, user, group, t.openClone))
+	return t
+}
@@ -7,10 +7,14 @@ import (
 	"errors"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 
 	"github.com/kennylevinsen/g9p/protocol"
 	"github.com/kennylevinsen/g9ptools/fileserver"
+	"github.com/kennylevinsen/g9ptools/fileserver/checksum"
+	"github.com/kennylevinsen/g9ptools/fileserver/findfs"
+	"github.com/kennylevinsen/g9ptools/fileserver/tarstream"
 )
 
 func permCheck(permissions protocol.FileMode, mode protocol.OpenMode) bool {
@@ -148,6 +152,9 @@ type ProxyFile struct {
 	caching int
 	user    string
 	group   string
+	tar     bool
+	find    bool
+	sums    bool
 }
 
 func (pf *ProxyFile) updateInfo() error {
@@ -265,11 +272,19 @@ func (pf *ProxyFile) CanRemove() (bool, error) {
 	return true, nil
 }
 
-func (pf *ProxyFile) Walk(_, name string) (fileserver.File, error) {
+func (pf *ProxyFile) Walk(user, name string) (fileserver.File, error) {
 	p := filepath.Join(pf.path, name)
 
 	if _, err := os.Stat(filepath.Join(pf.root, p)); os.IsNotExist(err) {
-		return nil, nil
+		switch {
+		case pf.find && name == findfs.DirName:
+			return findfs.NewDir(pf)
+		case pf.sums && strings.HasSuffix(name, checksum.Suffix):
+			return checksum.Walk(pf, user, name)
+		case pf.tar:
+			return tarstream.Walk(pf, user, name)
+		}
+		return nil, fileserver.ErrNotExist
 	} else if err != nil {
 		return nil, err
 	}
@@ -277,6 +292,9 @@ func (pf *ProxyFile) Walk(_, name string) (fileserver.File, error) {
 	return &ProxyFile{
 		root: pf.root,
 		path: p,
+		tar:  pf.tar,
+		find: pf.find,
+		sums: pf.sums,
 	}, nil
 }
 
@@ -298,6 +316,9 @@ func (pf *ProxyFile) Create(_, name string, perms protocol.FileMode) (fileserver
 	return &ProxyFile{
 		root: pf.root,
 		path: p,
+		tar:  pf.tar,
+		find: pf.find,
+		sums: pf.sums,
 	}, nil
 }
 
@@ -319,7 +340,26 @@ func (pf *ProxyFile) IsDir() (bool, error) {
 	return pf.info.IsDir(), nil
 }
 
-func NewProxyTree(root, path, user, group string) fileserver.Dir {
+// SetTarStreams makes the tree serve tarballs of its directories by the
+// conventions of package tarstream. It must be called before the tree is
+// served.
+func (pf *ProxyFile) SetTarStreams(on bool) {
+	pf.tar = on
+}
+
+// SetFind makes the tree answer searches by the conventions of package
+// findfs. It must be called before the tree is served.
+func (pf *ProxyFile) SetFind(on bool) {
+	pf.find = on
+}
+
+// SetChecksums makes the tree serve checksums of files by the conventions
+// of package checksum. It must be called before the tree is served.
+func (pf *ProxyFile) SetChecksums(on bool) {
+	pf.sums = on
+}
+
+func NewProxyTree(root, path, user, group string) *ProxyFile {
 	return &ProxyFile{
 		root:  root,
 		path:  path,
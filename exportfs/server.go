@@ -1,32 +1,42 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
-	"net"
 	"os"
 
 	"github.com/kennylevinsen/g9p"
 	"github.com/kennylevinsen/g9ptools/exportfs/proxytree"
 	"github.com/kennylevinsen/g9ptools/fileserver"
+	"github.com/kennylevinsen/g9ptools/transport"
 )
 
 func main() {
-	if len(os.Args) < 6 {
+	tarStreams := flag.Bool("tar", false, "serve tarballs of directories as name.tar")
+	find := flag.Bool("find", false, "answer searches in .find directories")
+	sums := flag.Bool("sums", false, "serve SHA-256 checksums of files as name.sum")
+	flag.Parse()
+
+	if flag.NArg() < 5 {
 		fmt.Printf("Too few arguments\n")
-		fmt.Printf("%s path service UID GID address\n", os.Args[0])
+		fmt.Printf("%s [-tar] [-find] [-sums] path service UID GID address\n", os.Args[0])
 		fmt.Printf("UID and GID are the user/group that owns /\n")
+		fmt.Printf("address is a dial string, such as :5640, or stdio to serve a single session on standard input and output\n")
 		return
 	}
 
-	path := os.Args[1]
-	service := os.Args[2]
-	user := os.Args[3]
-	group := os.Args[4]
-	addr := os.Args[5]
+	path := flag.Arg(0)
+	service := flag.Arg(1)
+	user := flag.Arg(2)
+	group := flag.Arg(3)
+	addr := flag.Arg(4)
 
 	root := proxytree.NewProxyTree(path, "", user, group)
-	l, err := net.Listen("tcp", addr)
+	root.SetTarStreams(*tarStreams)
+	root.SetFind(*find)
+	root.SetChecksums(*sums)
+	l, err := transport.ListenDialString(addr)
 	if err != nil {
 		log.Fatalf("Unable to listen: %v", err)
 	}
@@ -38,5 +48,6 @@ func main() {
 	}
 
 	log.Printf("Starting proxy at %s", addr)
+	transport.Ready()
 	g9p.ServeListener(l, h)
 }
@@ -0,0 +1,219 @@
+package factotumtree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/auth"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+	"github.com/kennylevinsen/g9ptools/ramfs/ramtree"
+)
+
+// FactotumTree is an authentication agent in the style of Plan 9's
+// factotum(4). It holds a keyring, and runs authentication protocols on
+// behalf of its clients, so that programs never see the secrets involved.
+//
+//	ctl	reading lists the keys with secrets hidden. Writing "key attrs"
+//		adds a key, and "delkey attrs" removes all matching keys.
+//	rpc	every open is a new conversation. Writes are requests and must
+//		each be followed by a read of the reply.
+//	proto	lists the supported protocols.
+//
+// The rpc requests are "start attrs", "read", "write data", "authinfo" and
+// "attr", and the replies are "ok [data]", "done", "phase msg", "needkey
+// attrs" and "error msg".
+type FactotumTree struct {
+	*ramtree.RAMTree
+	keys *auth.Keyring
+}
+
+// Keyring returns the keyring of the agent.
+func (t *FactotumTree) Keyring() *auth.Keyring {
+	return t.keys
+}
+
+// Ctl executes a ctl message.
+func (t *FactotumTree) Ctl(msg string) error {
+	for _, line := range strings.Split(msg, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var verb, rest string
+		if idx := strings.Index(line, " "); idx != -1 {
+			verb, rest = line[:idx], line[idx+1:]
+		} else {
+			verb = line
+		}
+
+		attrs, err := auth.ParseAttrs(rest)
+		if err != nil {
+			return err
+		}
+
+		switch verb {
+		case "key":
+			if err := t.keys.Add(attrs); err != nil {
+				return err
+			}
+		case "delkey":
+			if len(attrs) == 0 {
+				return errors.New("delkey needs attributes")
+			}
+			if t.keys.Delete(attrs) == 0 {
+				return auth.ErrNoKey
+			}
+		default:
+			return fmt.Errorf("unknown ctl command: %s", verb)
+		}
+	}
+	return nil
+}
+
+func (t *FactotumTree) readCtl(string) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, k := range t.keys.Keys() {
+		fmt.Fprintf(&buf, "%s\n", k)
+	}
+	return buf.Bytes(), nil
+}
+
+func (t *FactotumTree) writeCtl(_ string, p []byte) (int, error) {
+	if err := t.Ctl(string(p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (t *FactotumTree) readProto(string) ([]byte, error) {
+	return []byte(strings.Join(auth.Protos(), "\n") + "\n"), nil
+}
+
+func (t *FactotumTree) openRPC(user string, mode protocol.OpenMode) (fileserver.OpenFile, error) {
+	return &rpcOpenFile{keys: t.keys}, nil
+}
+
+// rpcOpenFile is a single conversation with the agent.
+type rpcOpenFile struct {
+	sync.Mutex
+	keys  *auth.Keyring
+	conv  auth.Conv
+	attrs auth.Attrs
+	reply []byte
+}
+
+func (of *rpcOpenFile) rpc(verb string, arg []byte) string {
+	if verb == "start" {
+		attrs, err := auth.ParseAttrs(string(arg))
+		if err != nil {
+			return "error " + err.Error()
+		}
+		conv, err := auth.Start(of.keys, attrs)
+		if err == auth.ErrNoKey {
+			return "needkey " + attrs.String()
+		}
+		if err != nil {
+			return "error " + err.Error()
+		}
+		of.conv, of.attrs = conv, attrs
+		return "ok"
+	}
+
+	if of.conv == nil {
+		return "error no conversation started"
+	}
+
+	switch verb {
+	case "read":
+		if of.conv.Done() {
+			return "done"
+		}
+		b, err := of.conv.Read()
+		if err == auth.ErrPhase {
+			return "phase cannot read now"
+		}
+		if err != nil {
+			return "error " + err.Error()
+		}
+		return "ok " + string(b)
+	case "write":
+		if of.conv.Done() {
+			return "done"
+		}
+		err := of.conv.Write(arg)
+		if err == auth.ErrPhase {
+			return "phase cannot write now"
+		}
+		if err != nil {
+			return "error " + err.Error()
+		}
+		return "ok"
+	case "authinfo":
+		ai := of.conv.AuthInfo()
+		if ai == nil {
+			return "error conversation not done"
+		}
+		return fmt.Sprintf("ok %s %s", ai.Cuid, ai.Suid)
+	case "attr":
+		return "ok " + of.attrs.Public().String()
+	default:
+		return "error unknown rpc: " + verb
+	}
+}
+
+func (of *rpcOpenFile) Seek(offset int64, whence int) (int64, error) {
+	return offset, nil
+}
+
+func (of *rpcOpenFile) Write(p []byte) (int, error) {
+	verb, arg := string(p), []byte(nil)
+	if idx := bytes.IndexByte(p, ' '); idx != -1 {
+		verb, arg = string(p[:idx]), p[idx+1:]
+	}
+	verb = strings.TrimSpace(verb)
+
+	of.Lock()
+	defer of.Unlock()
+	if of.reply != nil {
+		return 0, errors.New("reply not read")
+	}
+	of.reply = []byte(of.rpc(verb, arg))
+	return len(p), nil
+}
+
+func (of *rpcOpenFile) Read(p []byte) (int, error) {
+	of.Lock()
+	defer of.Unlock()
+	if of.reply == nil {
+		return 0, errors.New("no pending rpc")
+	}
+	if len(p) < len(of.reply) {
+		return copy(p, "toosmall"), nil
+	}
+	n := copy(p, of.reply)
+	of.reply = nil
+	return n, nil
+}
+
+func (of *rpcOpenFile) Close() error {
+	return nil
+}
+
+func (t *FactotumTree) Create(user, name string, perms protocol.FileMode) (fileserver.File, error) {
+	return nil, fileserver.ErrPermission
+}
+
+func NewFactotumTree(user, group string) *FactotumTree {
+	t := &FactotumTree{
+		RAMTree: ramtree.NewRAMTree("/", 0500, user, group),
+		keys:    auth.NewKeyring(),
+	}
+	t.RAMTree.Add("ctl", ramtree.NewCallbackFile("ctl", 0600, user, group, t.readCtl, t.writeCtl))
+	t.RAMTree.Add("rpc", ramtree.NewSyntheticFile("rpc", 0600, user, group, t.openRPC))
+	t.RAMTree.Add("proto", ramtree.NewCallbackFile("proto", 0400, user, group, t.readProto, nil))
+	return t
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/kennylevinsen/g9p"
+	"github.com/kennylevinsen/g9ptools/factotumfs/factotumtree"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+	"github.com/kennylevinsen/g9ptools/transport"
+)
+
+func main() {
+	keys := flag.String("keys", "", "file of ctl messages to load keys from")
+	flag.Parse()
+
+	if flag.NArg() < 4 {
+		fmt.Printf("Too few arguments\n")
+		fmt.Printf("%s [-keys file] service UID GID address\n", os.Args[0])
+		fmt.Printf("UID and GID are the user/group that owns /\n")
+		fmt.Printf("address is a dial string, such as :5640, or stdio to serve a single session on standard input and output\n")
+		return
+	}
+
+	service := flag.Arg(0)
+	user := flag.Arg(1)
+	group := flag.Arg(2)
+	addr := flag.Arg(3)
+
+	root := factotumtree.NewFactotumTree(user, group)
+	if *keys != "" {
+		b, err := ioutil.ReadFile(*keys)
+		if err != nil {
+			log.Fatalf("Unable to read keys: %v", err)
+		}
+		if err := root.Ctl(string(b)); err != nil {
+			log.Fatalf("Unable to load keys: %v", err)
+		}
+	}
+
+	l, err := transport.ListenDialString(addr)
+	if err != nil {
+		log.Fatalf("Unable to listen: %v", err)
+	}
+
+	h := func() g9p.Handler {
+		m := make(map[string]fileserver.Dir)
+		m[service] = root
+		return fileserver.NewFileServer(nil, m, 10*1024*1024, fileserver.Chatty)
+	}
+
+	log.Printf("Starting factotumfs at %s", addr)
+	transport.Ready()
+	g9p.ServeListener(l, h)
+}
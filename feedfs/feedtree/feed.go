@@ -0,0 +1,143 @@
+package feedtree
+
+import (
+	"encoding/xml"
+	"errors"
+	"io"
+	"strings"
+)
+
+var errUnknownFormat = errors.New("neither an RSS nor an Atom feed")
+
+// Entry is an entry of a feed.
+type Entry struct {
+	ID      string
+	Title   string
+	Link    string
+	Date    string
+	Summary string
+}
+
+// key returns what identifies the entry among those of its feed, which is
+// its id, or its link or title for feeds without ids.
+func (e *Entry) key() string {
+	for _, k := range []string{e.ID, e.Link, e.Title} {
+		if k != "" {
+			return k
+		}
+	}
+	return e.Summary
+}
+
+// String formats the entry as served.
+func (e *Entry) String() string {
+	var b strings.Builder
+	b.WriteString("title " + oneLine(e.Title) + "\n")
+	b.WriteString("link " + oneLine(e.Link) + "\n")
+	b.WriteString("date " + oneLine(e.Date) + "\n")
+	b.WriteString("id " + oneLine(e.ID) + "\n")
+	b.WriteString("\n")
+	if e.Summary != "" {
+		b.WriteString(strings.TrimSpace(e.Summary) + "\n")
+	}
+	return b.String()
+}
+
+func oneLine(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+type rssDoc struct {
+	Items []struct {
+		Title       string `xml:"title"`
+		Link        string `xml:"link"`
+		GUID        string `xml:"guid"`
+		PubDate     string `xml:"pubDate"`
+		Description string `xml:"description"`
+	} `xml:"channel>item"`
+}
+
+type atomDoc struct {
+	Entries []struct {
+		Title string `xml:"title"`
+		Links []struct {
+			Href string `xml:"href,attr"`
+			Rel  string `xml:"rel,attr"`
+		} `xml:"link"`
+		ID        string `xml:"id"`
+		Updated   string `xml:"updated"`
+		Published string `xml:"published"`
+		Summary   string `xml:"summary"`
+		Content   string `xml:"content"`
+	} `xml:"entry"`
+}
+
+// parseFeed parses an RSS 2.0 or Atom feed, returning its entries in the
+// order they appear in it.
+func parseFeed(r io.Reader) ([]Entry, error) {
+	dec := xml.NewDecoder(r)
+	// Feeds are frequently served in encodings other than UTF-8, which are
+	// read as is rather than rejected.
+	dec.CharsetReader = func(_ string, r io.Reader) (io.Reader, error) {
+		return r, nil
+	}
+
+	var start xml.StartElement
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		if se, ok := tok.(xml.StartElement); ok {
+			start = se
+			break
+		}
+	}
+
+	var entries []Entry
+	switch start.Name.Local {
+	case "rss":
+		var doc rssDoc
+		if err := dec.DecodeElement(&doc, &start); err != nil {
+			return nil, err
+		}
+		for _, it := range doc.Items {
+			entries = append(entries, Entry{
+				ID:      strings.TrimSpace(it.GUID),
+				Title:   it.Title,
+				Link:    strings.TrimSpace(it.Link),
+				Date:    it.PubDate,
+				Summary: it.Description,
+			})
+		}
+	case "feed":
+		var doc atomDoc
+		if err := dec.DecodeElement(&doc, &start); err != nil {
+			return nil, err
+		}
+		for _, it := range doc.Entries {
+			e := Entry{
+				ID:      strings.TrimSpace(it.ID),
+				Title:   it.Title,
+				Date:    it.Updated,
+				Summary: it.Summary,
+			}
+			if e.Date == "" {
+				e.Date = it.Published
+			}
+			if e.Summary == "" {
+				e.Summary = it.Content
+			}
+			for _, l := range it.Links {
+				if l.Rel == "" || l.Rel == "alternate" {
+					e.Link = l.Href
+					break
+				}
+			}
+			entries = append(entries, e)
+		}
+	default:
+		return nil, errUnknownFormat
+	}
+	return entries, nil
+}
@@ -0,0 +1,400 @@
+// Package feedtree serves RSS and Atom feeds as directories of entries,
+// polling them for new ones:
+//
+//	ctl		"add name url", "remove name", "poll [name]" and
+//			"interval duration", read for the feeds and their state
+//	new		"name/n title" of every new entry, one per read
+//	name/url	the url of the feed
+//	name/status	when the feed was last polled, and how it went
+//	name/new	"n title" of every new entry of the feed, one per read
+//	name/n		the entries, numbered in the order they arrived
+//
+// Entries hold "title", "link", "date" and "id" lines, followed by a blank
+// line and the summary of the entry. Reads of new files block until an entry
+// arrives. The entries found when a feed is first polled are added, but not
+// sent to new, and only the last MaxEntries entries of a feed are kept.
+// Removing a feed directory removes the feed.
+package feedtree
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+	"github.com/kennylevinsen/g9ptools/fileserver/ctl"
+	"github.com/kennylevinsen/g9ptools/ramfs/ramtree"
+)
+
+const (
+	// DefaultInterval is the time between polls unless configured
+	// otherwise.
+	DefaultInterval = 30 * time.Minute
+
+	// MaxEntries is the number of entries kept per feed.
+	MaxEntries = 500
+)
+
+var (
+	ErrNoFeed    = errors.New("no such feed")
+	errExists    = errors.New("feed already exists")
+	errNewOnly   = errors.New("new is read-only")
+	errBadStatus = errors.New("unexpected http status")
+)
+
+// FeedTree is the root of the file system.
+type FeedTree struct {
+	*ramtree.RAMTree
+	sync.Mutex
+	user     string
+	group    string
+	client   *http.Client
+	interval time.Duration
+	feeds    map[string]*feed
+	new      *ramtree.Stream
+}
+
+type feed struct {
+	*ramtree.RAMTree
+	sync.Mutex
+	t       *FeedTree
+	name    string
+	url     string
+	status  string
+	polled  bool
+	next    int
+	seen    map[string]bool
+	entries []string
+	new     *ramtree.Stream
+	stop    chan struct{}
+	poke    chan struct{}
+}
+
+// SetInterval sets the time between polls, which applies from the next
+// poll of each feed.
+func (t *FeedTree) SetInterval(d time.Duration) {
+	t.Lock()
+	defer t.Unlock()
+	t.interval = d
+}
+
+func (t *FeedTree) getInterval() time.Duration {
+	t.Lock()
+	defer t.Unlock()
+	return t.interval
+}
+
+// AddFeed adds the feed name at url, and starts polling it.
+func (t *FeedTree) AddFeed(name, url string) error {
+	f := t.newFeed(name, url)
+	t.Lock()
+	if _, ok := t.feeds[name]; ok {
+		t.Unlock()
+		return errExists
+	}
+	t.feeds[name] = f
+	t.Unlock()
+
+	if err := t.RAMTree.Add(name, f); err != nil {
+		t.Lock()
+		delete(t.feeds, name)
+		t.Unlock()
+		return err
+	}
+	go f.run()
+	return nil
+}
+
+// RemoveFeed stops polling the feed name, and removes it.
+func (t *FeedTree) RemoveFeed(name string) error {
+	t.Lock()
+	f, ok := t.feeds[name]
+	delete(t.feeds, name)
+	t.Unlock()
+	if !ok {
+		return ErrNoFeed
+	}
+
+	close(f.stop)
+	t.RAMTree.Delete(name)
+	f.new.Close()
+	return nil
+}
+
+// Poll polls the feed name now.
+func (t *FeedTree) Poll(name string) error {
+	t.Lock()
+	f, ok := t.feeds[name]
+	t.Unlock()
+	if !ok {
+		return ErrNoFeed
+	}
+	return f.poll()
+}
+
+func (t *FeedTree) feedList() []*feed {
+	t.Lock()
+	defer t.Unlock()
+	var feeds []*feed
+	for _, f := range t.feeds {
+		feeds = append(feeds, f)
+	}
+	sort.Slice(feeds, func(i, j int) bool { return feeds[i].name < feeds[j].name })
+	return feeds
+}
+
+func (t *FeedTree) readCtl(string) ([]byte, error) {
+	b := []byte(fmt.Sprintf("interval %v\n", t.getInterval()))
+	for _, f := range t.feedList() {
+		f.Lock()
+		b = append(b, fmt.Sprintf("%s %s %s\n", f.name, f.url, f.status)...)
+		f.Unlock()
+	}
+	return b, nil
+}
+
+func (t *FeedTree) ctl() *ctl.Parser {
+	p := ctl.NewParser()
+	p.Register(ctl.Command{
+		Name:    "add",
+		Usage:   "add name url",
+		MinArgs: 2,
+		MaxArgs: 2,
+		Run: func(_ string, args []string) error {
+			return t.AddFeed(args[0], args[1])
+		},
+	})
+	p.Register(ctl.Command{
+		Name:    "remove",
+		Usage:   "remove name",
+		MinArgs: 1,
+		MaxArgs: 1,
+		Run: func(_ string, args []string) error {
+			return t.RemoveFeed(args[0])
+		},
+	})
+	p.Register(ctl.Command{
+		Name:    "poll",
+		Usage:   "poll [name]",
+		MaxArgs: 1,
+		Run: func(_ string, args []string) error {
+			if len(args) == 1 {
+				return t.Poll(args[0])
+			}
+			var err error
+			for _, f := range t.feedList() {
+				if perr := f.poll(); err == nil {
+					err = perr
+				}
+			}
+			return err
+		},
+	})
+	p.Register(ctl.Command{
+		Name:    "interval",
+		Usage:   "interval duration",
+		MinArgs: 1,
+		MaxArgs: 1,
+		Run: func(_ string, args []string) error {
+			d, err := time.ParseDuration(args[0])
+			if err != nil {
+				return err
+			}
+			if d <= 0 {
+				return errors.New("interval must be positive")
+			}
+			t.SetInterval(d)
+			// Wake the pollers up, so that they wait for the new interval.
+			for _, f := range t.feedList() {
+				select {
+				case f.poke <- struct{}{}:
+				default:
+				}
+			}
+			return nil
+		},
+	})
+	return p
+}
+
+func (t *FeedTree) Create(user, name string, perms protocol.FileMode) (fileserver.File, error) {
+	return nil, fileserver.ErrPermission
+}
+
+// Remove removes a feed.
+func (t *FeedTree) Remove(user, name string) error {
+	if !mayRemove(t.RAMTree, user) {
+		return fileserver.ErrPermission
+	}
+	t.Lock()
+	_, ok := t.feeds[name]
+	t.Unlock()
+	if !ok {
+		return fileserver.ErrPermission
+	}
+	return t.RemoveFeed(name)
+}
+
+func (t *FeedTree) newFeed(name, url string) *feed {
+	f := &feed{
+		RAMTree: ramtree.NewRAMTree(name, 0755, t.user, t.group),
+		t:       t,
+		name:    name,
+		url:     url,
+		status:  "pending",
+		next:    1,
+		seen:    make(map[string]bool),
+		new:     ramtree.NewStream(),
+		stop:    make(chan struct{}),
+		poke:    make(chan struct{}, 1),
+	}
+	f.RAMTree.Add("url", ramtree.NewCallbackFile("url", 0444, t.user, t.group, f.readURL, nil))
+	f.RAMTree.Add("status", ramtree.NewCallbackFile("status", 0444, t.user, t.group, f.readStatus, nil))
+	f.RAMTree.Add("new", ramtree.NewSyntheticFile("new", 0444, t.user, t.group, f.openNew))
+	return f
+}
+
+func (f *feed) readURL(string) ([]byte, error) {
+	return []byte(f.url + "\n"), nil
+}
+
+func (f *feed) readStatus(string) ([]byte, error) {
+	f.Lock()
+	defer f.Unlock()
+	return []byte(f.status + "\n"), nil
+}
+
+func (f *feed) openNew(user string, mode protocol.OpenMode) (fileserver.OpenFile, error) {
+	if mode&3 != protocol.OREAD {
+		return nil, errNewOnly
+	}
+	return f.new.Open(), nil
+}
+
+// run polls the feed until it is removed.
+func (f *feed) run() {
+	f.poll()
+	for {
+		select {
+		case <-f.stop:
+			return
+		case <-f.poke:
+			// The interval changed, so start waiting again.
+		case <-time.After(f.t.getInterval()):
+			f.poll()
+		}
+	}
+}
+
+// poll fetches the feed, and adds the entries not seen before.
+func (f *feed) poll() error {
+	entries, err := f.fetch()
+	now := time.Now().Format(time.RFC3339)
+
+	f.Lock()
+	if err != nil {
+		f.status = fmt.Sprintf("%s error %v", now, err)
+		f.Unlock()
+		return err
+	}
+	first := !f.polled
+	f.polled = true
+
+	// Feeds list their newest entries first, so they are added from the
+	// end, in order to number them in the order they were published.
+	var added []string
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := &entries[i]
+		if f.seen[e.key()] {
+			continue
+		}
+		f.seen[e.key()] = true
+
+		name := strconv.Itoa(f.next)
+		f.next++
+		file := ramtree.NewRAMFile(name, 0444, f.t.user, f.t.group)
+		file.SetContent([]byte(e.String()))
+		if err := f.RAMTree.Add(name, file); err != nil {
+			continue
+		}
+		f.entries = append(f.entries, name)
+		added = append(added, name+" "+oneLine(e.Title))
+	}
+	for len(f.entries) > MaxEntries {
+		f.RAMTree.Delete(f.entries[0])
+		f.entries = f.entries[1:]
+	}
+	f.status = fmt.Sprintf("%s ok %d entries", now, len(f.entries))
+	f.Unlock()
+
+	if first {
+		return nil
+	}
+	for _, a := range added {
+		f.new.Send([]byte(a + "\n"))
+		f.t.new.Send([]byte(f.name + "/" + a + "\n"))
+	}
+	return nil
+}
+
+func (f *feed) fetch() ([]Entry, error) {
+	resp, err := f.t.client.Get(f.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%v: %s", errBadStatus, resp.Status)
+	}
+	return parseFeed(resp.Body)
+}
+
+func (f *feed) Create(user, name string, perms protocol.FileMode) (fileserver.File, error) {
+	return nil, fileserver.ErrPermission
+}
+
+// Remove is not permitted, as entries are kept until they are old.
+func (f *feed) Remove(user, name string) error {
+	return fileserver.ErrPermission
+}
+
+// CanRemove always permits removal, as the entries of a feed go with it.
+func (f *feed) CanRemove() (bool, error) {
+	return true, nil
+}
+
+// mayRemove reports whether user may remove files from d.
+func mayRemove(d *ramtree.RAMTree, user string) bool {
+	st, err := d.Stat()
+	if err != nil {
+		return false
+	}
+	return fileserver.Allowed(nil, user, st.UID, st.GID, st.Mode, protocol.OWRITE)
+}
+
+func (t *FeedTree) openNew(user string, mode protocol.OpenMode) (fileserver.OpenFile, error) {
+	if mode&3 != protocol.OREAD {
+		return nil, errNewOnly
+	}
+	return t.new.Open(), nil
+}
+
+func NewFeedTree(user, group string) *FeedTree {
+	t := &FeedTree{
+		RAMTree:  ramtree.NewRAMTree("/", 0755, user, group),
+		user:     user,
+		group:    group,
+		client:   &http.Client{Timeout: time.Minute},
+		interval: DefaultInterval,
+		feeds:    make(map[string]*feed),
+		new:      ramtree.NewStream(),
+	}
+	t.RAMTree.Add("ctl", ramtree.NewCallbackFile("ctl", 0660, user, group, t.readCtl, t.ctl().Write))
+	t.RAMTree.Add("new", ramtree.NewSyntheticFile("new", 0444, user, group, t.openNew))
+	return t
+}
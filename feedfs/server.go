@@ -0,0 +1,61 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/kennylevinsen/g9p"
+	"github.com/kennylevinsen/g9ptools/feedfs/feedtree"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+	"github.com/kennylevinsen/g9ptools/transport"
+)
+
+func main() {
+	interval := flag.Duration("interval", feedtree.DefaultInterval, "time between polls of each feed")
+	flag.Parse()
+
+	if flag.NArg() < 4 {
+		fmt.Printf("Too few arguments\n")
+		fmt.Printf("%s [-interval duration] service UID GID address [name=url...]\n", os.Args[0])
+		fmt.Printf("UID and GID are the user/group that owns / and may use ctl\n")
+		fmt.Printf("address is a dial string, such as :5640, or stdio to serve a single session on standard input and output\n")
+		fmt.Printf("feeds to poll may be given, e.g.:\n")
+		fmt.Printf("  %s feeds glenda glenda :5640 go=https://go.dev/blog/feed.atom\n", os.Args[0])
+		return
+	}
+
+	service := flag.Arg(0)
+	user := flag.Arg(1)
+	group := flag.Arg(2)
+	addr := flag.Arg(3)
+
+	root := feedtree.NewFeedTree(user, group)
+	root.SetInterval(*interval)
+	for _, arg := range flag.Args()[4:] {
+		eq := strings.Index(arg, "=")
+		if eq < 1 {
+			log.Fatalf("Invalid feed %q: expected name=url", arg)
+		}
+		if err := root.AddFeed(arg[:eq], arg[eq+1:]); err != nil {
+			log.Printf("Unable to add %s: %v", arg[:eq], err)
+		}
+	}
+
+	l, err := transport.ListenDialString(addr)
+	if err != nil {
+		log.Fatalf("Unable to listen: %v", err)
+	}
+
+	h := func() g9p.Handler {
+		m := make(map[string]fileserver.Dir)
+		m[service] = root
+		return fileserver.NewFileServer(nil, m, 10*1024*1024, fileserver.Chatty)
+	}
+
+	log.Printf("Starting feedfs at %s", addr)
+	transport.Ready()
+	g9p.ServeListener(l, h)
+}
@@ -0,0 +1,125 @@
+// Package aferofs adapts between fileserver trees and afero file systems.
+// NewTree serves an afero.Fs as a tree, and FS exposes a tree as an
+// afero.Fs.
+package aferofs
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	"github.com/kennylevinsen/g9ptools/fileserver"
+	"github.com/kennylevinsen/g9ptools/fileserver/internal/vfs"
+	"github.com/spf13/afero"
+)
+
+// backend is an afero.Fs as a vfs.FS.
+type backend struct {
+	fs afero.Fs
+}
+
+func (b *backend) OpenFile(name string, flag int, perm os.FileMode) (vfs.File, error) {
+	return b.fs.OpenFile(name, flag, perm)
+}
+
+func (b *backend) Stat(name string) (os.FileInfo, error) {
+	return b.fs.Stat(name)
+}
+
+func (b *backend) ReadDir(name string) ([]os.FileInfo, error) {
+	return afero.ReadDir(b.fs, name)
+}
+
+func (b *backend) Mkdir(name string, perm os.FileMode) error {
+	return b.fs.Mkdir(name, perm)
+}
+
+func (b *backend) Remove(name string) error {
+	return b.fs.Remove(name)
+}
+
+func (b *backend) Rename(oldname, newname string) error {
+	return b.fs.Rename(oldname, newname)
+}
+
+func (b *backend) Chmod(name string, mode os.FileMode) error {
+	return b.fs.Chmod(name, mode)
+}
+
+func (b *backend) Chtimes(name string, atime, mtime time.Time) error {
+	return b.fs.Chtimes(name, atime, mtime)
+}
+
+// NewTree returns the directory at root of fs as a tree, with all files
+// owned by user and group.
+func NewTree(fs afero.Fs, root, user, group string) fileserver.Dir {
+	return vfs.NewTree(&backend{fs: fs}, root, user, group)
+}
+
+// treeFS is a tree as an afero.Fs.
+type treeFS struct {
+	c *vfs.Client
+}
+
+// FS returns root as an afero.Fs, accessed with the permissions of user.
+// Ownership cannot be changed, as 9P identifies users by name.
+func FS(root fileserver.Dir, user string) afero.Fs {
+	return &treeFS{c: &vfs.Client{Root: root, User: user}}
+}
+
+func (t *treeFS) Name() string {
+	return "9p"
+}
+
+func (t *treeFS) Create(name string) (afero.File, error) {
+	return t.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (t *treeFS) Open(name string) (afero.File, error) {
+	return t.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (t *treeFS) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	f, err := t.c.OpenFile(name, flag, perm)
+	if err != nil {
+		// Avoid returning a nil *vfs.ClientFile in a non-nil afero.File.
+		return nil, err
+	}
+	return f, nil
+}
+
+func (t *treeFS) Mkdir(name string, perm os.FileMode) error {
+	return t.c.Mkdir(name, perm)
+}
+
+func (t *treeFS) MkdirAll(path string, perm os.FileMode) error {
+	return t.c.MkdirAll(path, perm)
+}
+
+func (t *treeFS) Remove(name string) error {
+	return t.c.Remove(name)
+}
+
+func (t *treeFS) RemoveAll(path string) error {
+	return t.c.RemoveAll(path)
+}
+
+func (t *treeFS) Rename(oldname, newname string) error {
+	return t.c.Rename(oldname, newname)
+}
+
+func (t *treeFS) Stat(name string) (os.FileInfo, error) {
+	return t.c.Stat(name)
+}
+
+func (t *treeFS) Chmod(name string, mode os.FileMode) error {
+	return t.c.Chmod(name, mode)
+}
+
+func (t *treeFS) Chown(name string, uid, gid int) error {
+	return &os.PathError{Op: "chown", Path: name, Err: errors.New("numeric ids are not supported")}
+}
+
+func (t *treeFS) Chtimes(name string, atime, mtime time.Time) error {
+	return t.c.Chtimes(name, atime, mtime)
+}
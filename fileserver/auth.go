@@ -0,0 +1,63 @@
+package fileserver
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/kennylevinsen/g9ptools/auth"
+)
+
+// authOpenFile runs the server side of an authentication conversation over
+// an auth fid. Every write is handed to the conversation, and every read
+// returns the next message of the conversation.
+type authOpenFile struct {
+	sync.Mutex
+	conv    auth.Conv
+	pending []byte
+}
+
+func (of *authOpenFile) Seek(offset int64, whence int) (int64, error) {
+	return offset, nil
+}
+
+func (of *authOpenFile) Read(p []byte) (int, error) {
+	of.Lock()
+	defer of.Unlock()
+	if len(of.pending) == 0 {
+		b, err := of.conv.Read()
+		if err != nil {
+			return 0, err
+		}
+		of.pending = b
+	}
+	n := copy(p, of.pending)
+	of.pending = of.pending[n:]
+	return n, nil
+}
+
+func (of *authOpenFile) Write(p []byte) (int, error) {
+	of.Lock()
+	defer of.Unlock()
+	if err := of.conv.Write(p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (of *authOpenFile) Close() error {
+	return nil
+}
+
+// authenticated verifies that the auth fid completed authentication as user.
+func (of *authOpenFile) authenticated(user string) error {
+	of.Lock()
+	defer of.Unlock()
+	if !of.conv.Done() {
+		return errors.New("authentication not complete")
+	}
+	ai := of.conv.AuthInfo()
+	if ai == nil || ai.Cuid != user {
+		return errors.New("authentication failed")
+	}
+	return nil
+}
@@ -0,0 +1,270 @@
+package fileserver_test
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/convenience"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+	"github.com/kennylevinsen/g9ptools/ramfs/ramtree"
+)
+
+const (
+	user      = "bench"
+	fileSize  = 1024 * 1024
+	blockSize = 4096
+)
+
+var (
+	msizes     = []uint32{8 * 1024, 64 * 1024, 1024 * 1024}
+	dirSizes   = []int{10, 1000, 10000}
+	walkDepths = []int{1, 8, 16}
+	clients    = []int{1, 4, 16}
+)
+
+// byMsize runs fn for each of msizes.
+func byMsize(b *testing.B, fn func(b *testing.B, msize uint32)) {
+	for _, m := range msizes {
+		m := m
+		b.Run(fmt.Sprintf("msize=%d", m), func(b *testing.B) { fn(b, m) })
+	}
+}
+
+// byCount runs fn for each of ns, naming the runs after what they count.
+func byCount(b *testing.B, what string, ns []int, fn func(b *testing.B, n int)) {
+	for _, n := range ns {
+		n := n
+		b.Run(fmt.Sprintf("%s=%d", what, n), func(b *testing.B) { fn(b, n) })
+	}
+}
+
+func BenchmarkSeqRead(b *testing.B)   { byMsize(b, benchSeqRead) }
+func BenchmarkSeqWrite(b *testing.B)  { byMsize(b, benchSeqWrite) }
+func BenchmarkRandRead(b *testing.B)  { byMsize(b, benchRandRead) }
+func BenchmarkRandWrite(b *testing.B) { byMsize(b, benchRandWrite) }
+
+func BenchmarkListDir(b *testing.B) { byCount(b, "entries", dirSizes, benchListDir) }
+func BenchmarkWalk(b *testing.B)    { byCount(b, "depth", walkDepths, benchWalk) }
+
+func BenchmarkConcurrentRead(b *testing.B) { byCount(b, "clients", clients, benchConcurrentRead) }
+func BenchmarkConcurrentStat(b *testing.B) { byCount(b, "clients", clients, benchConcurrentStat) }
+
+// newTree returns an empty tree, served with the given maximum message size.
+func newTree(msize uint32) (*ramtree.RAMTree, *fileserver.FileServer) {
+	root := ramtree.NewRAMTree("/", 0777, user, user)
+	return root, fileserver.NewFileServer(root, nil, msize, fileserver.Quiet)
+}
+
+func connect(b *testing.B, fs *fileserver.FileServer) *convenience.Client {
+	c := &convenience.Client{}
+	if err := c.Connect(fileserver.Pipe(fs), user, ""); err != nil {
+		b.Fatalf("connect: %v", err)
+	}
+	return c
+}
+
+func addFile(b *testing.B, d fileserver.Dir, name string, size int) {
+	f, err := d.Create(user, name, 0666)
+	if err != nil {
+		b.Fatalf("create: %v", err)
+	}
+	f.(*ramtree.RAMFile).SetContent(make([]byte, size))
+}
+
+func open(b *testing.B, c *convenience.Client, name string, mode protocol.OpenMode) *convenience.File {
+	f, err := c.Open(name, mode)
+	if err != nil {
+		b.Fatalf("open: %v", err)
+	}
+	return f
+}
+
+func benchSeqRead(b *testing.B, msize uint32) {
+	root, fs := newTree(msize)
+	addFile(b, root, "file", fileSize)
+	c := connect(b, fs)
+	buf := make([]byte, msize)
+
+	b.SetBytes(fileSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		f := open(b, c, "file", protocol.OREAD)
+		for {
+			_, err := f.Read(buf)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				b.Fatalf("read: %v", err)
+			}
+		}
+		f.Close()
+	}
+}
+
+func benchSeqWrite(b *testing.B, msize uint32) {
+	root, fs := newTree(msize)
+	addFile(b, root, "file", 0)
+	c := connect(b, fs)
+	buf := make([]byte, msize)
+
+	b.SetBytes(fileSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		f := open(b, c, "file", protocol.OWRITE|protocol.OTRUNC)
+		for n := 0; n < fileSize; n += len(buf) {
+			if _, err := f.Write(buf); err != nil {
+				b.Fatalf("write: %v", err)
+			}
+		}
+		f.Close()
+	}
+}
+
+func benchRandRead(b *testing.B, msize uint32) {
+	root, fs := newTree(msize)
+	addFile(b, root, "file", fileSize)
+	c := connect(b, fs)
+	f := open(b, c, "file", protocol.OREAD)
+	defer f.Close()
+	buf := make([]byte, blockSize)
+	r := rand.New(rand.NewSource(1))
+
+	b.SetBytes(blockSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		off := int64(r.Intn(fileSize/blockSize)) * blockSize
+		if _, err := f.ReadAt(buf, off); err != nil {
+			b.Fatalf("read: %v", err)
+		}
+	}
+}
+
+func benchRandWrite(b *testing.B, msize uint32) {
+	root, fs := newTree(msize)
+	addFile(b, root, "file", fileSize)
+	c := connect(b, fs)
+	f := open(b, c, "file", protocol.OWRITE)
+	defer f.Close()
+	buf := make([]byte, blockSize)
+	r := rand.New(rand.NewSource(1))
+
+	b.SetBytes(blockSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		off := int64(r.Intn(fileSize/blockSize)) * blockSize
+		if _, err := f.WriteAt(buf, off); err != nil {
+			b.Fatalf("write: %v", err)
+		}
+	}
+}
+
+func benchListDir(b *testing.B, n int) {
+	root, fs := newTree(64 * 1024)
+	for i := 0; i < n; i++ {
+		addFile(b, root, fmt.Sprintf("file%d", i), 0)
+	}
+	c := connect(b, fs)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sts, err := c.ReadDir("/")
+		if err != nil {
+			b.Fatalf("readdir: %v", err)
+		}
+		if len(sts) != n {
+			b.Fatalf("readdir returned %d entries, expected %d", len(sts), n)
+		}
+	}
+}
+
+func benchWalk(b *testing.B, depth int) {
+	root, fs := newTree(64 * 1024)
+	var d fileserver.Dir = root
+	var names []string
+	for i := 0; i < depth; i++ {
+		f, err := d.Create(user, "dir", protocol.DMDIR|0777)
+		if err != nil {
+			b.Fatalf("create: %v", err)
+		}
+		d = f.(fileserver.Dir)
+		names = append(names, "dir")
+	}
+	p := strings.Join(names, "/")
+	c := connect(b, fs)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := c.Stat(p); err != nil {
+			b.Fatalf("stat: %v", err)
+		}
+	}
+}
+
+// runClients spreads b.N calls of fn over n clients of fs, running
+// concurrently.
+func runClients(b *testing.B, fs *fileserver.FileServer, n int, fn func(c *convenience.Client, i int) error) {
+	cs := make([]*convenience.Client, n)
+	for i := range cs {
+		cs[i] = connect(b, fs)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	var wg sync.WaitGroup
+	for i, c := range cs {
+		calls := b.N / n
+		if i < b.N%n {
+			calls++
+		}
+		wg.Add(1)
+		go func(c *convenience.Client, calls int) {
+			defer wg.Done()
+			for j := 0; j < calls; j++ {
+				if err := fn(c, j); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		}(c, calls)
+	}
+	wg.Wait()
+}
+
+func benchConcurrentRead(b *testing.B, n int) {
+	const size = 64 * 1024
+	root, fs := newTree(64 * 1024)
+	addFile(b, root, "file", size)
+
+	b.SetBytes(size)
+	runClients(b, fs, n, func(c *convenience.Client, i int) error {
+		_, err := c.Read("file")
+		return err
+	})
+}
+
+// benchConcurrentStat walks to and stats files of a large directory from
+// several clients, which mostly exercises tree locking.
+func benchConcurrentStat(b *testing.B, n int) {
+	const entries = 1000
+	root, fs := newTree(64 * 1024)
+	for i := 0; i < entries; i++ {
+		addFile(b, root, fmt.Sprintf("file%d", i), 0)
+	}
+
+	runClients(b, fs, n, func(c *convenience.Client, i int) error {
+		_, err := c.Stat(fmt.Sprintf("file%d", i%entries))
+		return err
+	})
+}
@@ -0,0 +1,205 @@
+// Package billyfs adapts between fileserver trees and go-billy file systems.
+// NewTree serves a billy.Filesystem as a tree, and FS exposes a tree as a
+// billy.Filesystem.
+package billyfs
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+	"github.com/kennylevinsen/g9ptools/fileserver/internal/vfs"
+)
+
+// backend is a billy.Filesystem as a vfs.FS. Modes and times can only be
+// changed if the file system implements billy.Change.
+type backend struct {
+	fs billy.Filesystem
+}
+
+func (b *backend) OpenFile(name string, flag int, perm os.FileMode) (vfs.File, error) {
+	return b.fs.OpenFile(name, flag, perm)
+}
+
+func (b *backend) Stat(name string) (os.FileInfo, error) {
+	return b.fs.Stat(name)
+}
+
+func (b *backend) ReadDir(name string) ([]os.FileInfo, error) {
+	return b.fs.ReadDir(name)
+}
+
+// Mkdir creates a single directory, which billy lacks.
+func (b *backend) Mkdir(name string, perm os.FileMode) error {
+	if _, err := b.fs.Stat(name); err == nil {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrExist}
+	}
+	if _, err := b.fs.Stat(path.Dir(name)); err != nil {
+		return err
+	}
+	return b.fs.MkdirAll(name, perm)
+}
+
+func (b *backend) Remove(name string) error {
+	return b.fs.Remove(name)
+}
+
+func (b *backend) Rename(oldname, newname string) error {
+	return b.fs.Rename(oldname, newname)
+}
+
+func (b *backend) Chmod(name string, mode os.FileMode) error {
+	c, ok := b.fs.(billy.Change)
+	if !ok {
+		return billy.ErrNotSupported
+	}
+	return c.Chmod(name, mode)
+}
+
+func (b *backend) Chtimes(name string, atime, mtime time.Time) error {
+	c, ok := b.fs.(billy.Change)
+	if !ok {
+		return billy.ErrNotSupported
+	}
+	return c.Chtimes(name, atime, mtime)
+}
+
+// NewTree returns the directory at root of fs as a tree, with all files
+// owned by user and group.
+func NewTree(fs billy.Filesystem, root, user, group string) fileserver.Dir {
+	return vfs.NewTree(&backend{fs: fs}, root, user, group)
+}
+
+// treeFS is a tree as a billy.Filesystem.
+type treeFS struct {
+	c    *vfs.Client
+	root string
+}
+
+// FS returns root as a billy.Filesystem, accessed with the permissions of
+// user. It also implements billy.Change, except for changing ownership, as
+// 9P identifies users by name. 9P2000 has neither symbolic links nor locks,
+// so Symlink and Readlink are not supported, and locking does nothing.
+func FS(root fileserver.Dir, user string) billy.Filesystem {
+	return &treeFS{c: &vfs.Client{Root: root, User: user}, root: "/"}
+}
+
+func (t *treeFS) Create(filename string) (billy.File, error) {
+	return t.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (t *treeFS) Open(filename string) (billy.File, error) {
+	return t.OpenFile(filename, os.O_RDONLY, 0)
+}
+
+func (t *treeFS) OpenFile(filename string, flag int, perm os.FileMode) (billy.File, error) {
+	f, err := t.c.OpenFile(filename, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &file{f}, nil
+}
+
+func (t *treeFS) Stat(filename string) (os.FileInfo, error) {
+	return t.c.Stat(filename)
+}
+
+func (t *treeFS) Rename(oldpath, newpath string) error {
+	return t.c.Rename(oldpath, newpath)
+}
+
+func (t *treeFS) Remove(filename string) error {
+	return t.c.Remove(filename)
+}
+
+func (t *treeFS) Join(elem ...string) string {
+	return path.Join(elem...)
+}
+
+// TempFile creates a new file in dir with a name starting with prefix.
+func (t *treeFS) TempFile(dir, prefix string) (billy.File, error) {
+	for i := 0; i < 100; i++ {
+		name := path.Join(dir, fmt.Sprintf("%s%d", prefix, rand.Uint32()))
+		f, err := t.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+		if os.IsExist(err) {
+			continue
+		}
+		return f, err
+	}
+	return nil, &os.PathError{Op: "tempfile", Path: dir, Err: os.ErrExist}
+}
+
+func (t *treeFS) ReadDir(path string) ([]os.FileInfo, error) {
+	return t.c.ReadDir(path)
+}
+
+func (t *treeFS) MkdirAll(filename string, perm os.FileMode) error {
+	return t.c.MkdirAll(filename, perm)
+}
+
+// Lstat is Stat, as there are no symbolic links.
+func (t *treeFS) Lstat(filename string) (os.FileInfo, error) {
+	return t.c.Stat(filename)
+}
+
+func (t *treeFS) Symlink(target, link string) error {
+	return billy.ErrNotSupported
+}
+
+func (t *treeFS) Readlink(link string) (string, error) {
+	return "", billy.ErrNotSupported
+}
+
+// Chroot returns the directory at p as a file system of its own.
+func (t *treeFS) Chroot(p string) (billy.Filesystem, error) {
+	f, err := fileserver.WalkPath(t.c.Root, t.c.User, p)
+	if err != nil {
+		return nil, &os.PathError{Op: "chroot", Path: p, Err: err}
+	}
+	d, ok := f.(fileserver.Dir)
+	if isdir, _ := f.IsDir(); !ok || !isdir {
+		return nil, &os.PathError{Op: "chroot", Path: p, Err: fileserver.ErrNotDir}
+	}
+	return &treeFS{
+		c:    &vfs.Client{Root: d, User: t.c.User},
+		root: path.Join(t.root, p),
+	}, nil
+}
+
+func (t *treeFS) Root() string {
+	return t.root
+}
+
+func (t *treeFS) Chmod(name string, mode os.FileMode) error {
+	return t.c.Chmod(name, mode)
+}
+
+func (t *treeFS) Lchown(name string, uid, gid int) error {
+	return t.Chown(name, uid, gid)
+}
+
+func (t *treeFS) Chown(name string, uid, gid int) error {
+	return &os.PathError{Op: "chown", Path: name, Err: errors.New("numeric ids are not supported")}
+}
+
+func (t *treeFS) Chtimes(name string, atime, mtime time.Time) error {
+	return t.c.Chtimes(name, atime, mtime)
+}
+
+// file is a vfs.ClientFile as a billy.File.
+type file struct {
+	*vfs.ClientFile
+}
+
+func (f *file) Lock() error {
+	return nil
+}
+
+func (f *file) Unlock() error {
+	return nil
+}
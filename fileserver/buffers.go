@@ -0,0 +1,78 @@
+package fileserver
+
+import "sync"
+
+const (
+	// minPooled is the smallest read buffer taken from the pool. Smaller
+	// buffers are allocated to fit, as is the result of the read.
+	minPooled = 4 * 1024
+	// maxPooled is the largest read buffer taken from the pool, so that
+	// the pool does not hold on to buffers of the negotiated message size,
+	// which may be up to DefaultMaxSize.
+	maxPooled = 1024 * 1024
+)
+
+// buffers pools read buffers in power of two size classes, from minPooled to
+// maxPooled. The buffer given to OpenFile.Read comes from the class that
+// fits the count of the read. Small results are copied out into a slice of
+// exactly their length for the response, after which the buffer goes back
+// to the pool, while results filling most of the buffer take it over.
+type buffers struct {
+	pools [classes]sync.Pool
+}
+
+// classes is the number of size classes from minPooled to maxPooled.
+const classes = 9
+
+// readBuffers is shared by all FileServers.
+var readBuffers buffers
+
+// class returns the size class for buffers of length n, which must be
+// within minPooled and maxPooled.
+func class(n int) int {
+	c := 0
+	for minPooled<<uint(c) < n {
+		c++
+	}
+	return c
+}
+
+// pooled reports whether buf has the capacity of a size class.
+func pooled(buf []byte) bool {
+	n := cap(buf)
+	return n >= minPooled && n <= maxPooled && n&(n-1) == 0
+}
+
+// get returns a buffer of length n.
+func (b *buffers) get(n int) []byte {
+	if n < minPooled || n > maxPooled {
+		return make([]byte, n)
+	}
+	c := class(n)
+	if buf, ok := b.pools[c].Get().([]byte); ok {
+		return buf[:n]
+	}
+	return make([]byte, n, minPooled<<uint(c))
+}
+
+// put returns buf to the pool. buf must not be used afterwards.
+func (b *buffers) put(buf []byte) {
+	if !pooled(buf) {
+		return
+	}
+	b.pools[class(cap(buf))].Put(buf[:cap(buf)])
+}
+
+// detach returns the first n bytes of buf for use in a response, which
+// outlives the request. buf must not be used afterwards. Buffers that did
+// not come from the pool, or that the result fills more than half of, are
+// handed over without copying.
+func (b *buffers) detach(buf []byte, n int) []byte {
+	if !pooled(buf) || n > cap(buf)/2 {
+		return buf[:n]
+	}
+	res := make([]byte, n)
+	copy(res, buf)
+	b.put(buf)
+	return res
+}
@@ -0,0 +1,111 @@
+// Package checksum serves checksums of files, so that clients, such as sync
+// tools, can compare content without reading it over the wire.
+//
+// By convention, a directory supporting it answers a walk to name.sum, where
+// name is a file in it and no file called name.sum exists, with a read-only
+// file holding the SHA-256 of the content of the file, in the format of
+// sha256sum: the digest in hex, two spaces and the name, and a newline. The
+// checksum is computed by the server when the file is opened, through the
+// fileserver.Checksummer of the file if it implements it, and by reading the
+// file otherwise. The files are not listed in the directory, and only exist
+// for regular files.
+package checksum
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"strings"
+
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+	"github.com/kennylevinsen/g9ptools/fileserver/templatefs"
+)
+
+const (
+	// Suffix is the suffix of the names of checksum files.
+	Suffix = ".sum"
+	// Algorithm is the algorithm of checksum files.
+	Algorithm = "sha256"
+)
+
+// Walk returns the checksum file called name in d, or fileserver.ErrNotExist
+// if name does not refer to one. Directories supporting checksums call it
+// when a walk finds no file.
+func Walk(d fileserver.Dir, user, name string) (fileserver.File, error) {
+	base := strings.TrimSuffix(name, Suffix)
+	if base == name || base == "" {
+		return nil, fileserver.ErrNotExist
+	}
+	f, err := d.Walk(user, base)
+	if err != nil {
+		return nil, err
+	}
+	return NewFile(f, name)
+}
+
+// Sum returns the SHA-256 of the content of f, as read by user.
+func Sum(f fileserver.File, user string) ([]byte, error) {
+	if c, ok := f.(fileserver.Checksummer); ok {
+		return c.Checksum(user, Algorithm)
+	}
+
+	of, err := f.Open(user, protocol.OREAD)
+	if err != nil {
+		return nil, err
+	}
+	defer of.Close()
+	if _, err := of.Seek(0, 0); err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	b := make([]byte, 64*1024)
+	for {
+		n, err := of.Read(b)
+		h.Write(b[:n])
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		// A read returning no data is the end of the file.
+		if n == 0 {
+			break
+		}
+	}
+	return h.Sum(nil), nil
+}
+
+// File is the checksum of a file.
+type File struct {
+	templatefs.FileBase
+	f    fileserver.File
+	name string
+}
+
+// NewFile returns the checksum of f, called name. Only regular files have
+// checksums, as reading the others, such as streams, may not end.
+func NewFile(f fileserver.File, name string) (*File, error) {
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if st.Qid.Type&(protocol.QTDIR|protocol.QTAPPEND|protocol.QTEXCL|protocol.QTAUTH) != 0 {
+		return nil, fileserver.ErrNotExist
+	}
+	sf := &File{f: f, name: st.Name}
+	sf.Init(name, st.Mode&0444, st.UID, st.GID)
+	return sf, nil
+}
+
+func (sf *File) Open(user string, mode protocol.OpenMode) (fileserver.OpenFile, error) {
+	if err := sf.CheckOpen(user, mode); err != nil {
+		return nil, err
+	}
+	sum, err := Sum(sf.f, user)
+	if err != nil {
+		return nil, err
+	}
+	return templatefs.NewReader([]byte(hex.EncodeToString(sum) + "  " + sf.name + "\n")), nil
+}
@@ -0,0 +1,173 @@
+// Package ctl implements Plan 9 style ctl files, which are controlled by
+// writing commands to them, one per line:
+//
+//	p := ctl.NewParser()
+//	p.Register(ctl.Command{
+//		Name:    "limit",
+//		Usage:   "limit bytes",
+//		MinArgs: 1,
+//		MaxArgs: 1,
+//		Run: func(user string, args []string) error {
+//			...
+//		},
+//	})
+//	dir.Add(ctl.NewFile("ctl", 0660, "glenda", "glenda", p))
+//
+// Lines are split into fields at white space, and fields may be quoted with
+// single quotes, with two single quotes standing for one within them. Blank
+// lines and lines starting with # are ignored. The error of a failed command
+// is returned by the write that completed its line.
+package ctl
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrEmpty            = errors.New("empty ctl message")
+	errUnterminated     = errors.New("unterminated quote")
+	errAlreadyExists    = errors.New("command already registered")
+	errInvalidArgBounds = errors.New("invalid argument bounds")
+)
+
+// Tokenize splits a line into fields, honouring Plan 9 style single quotes.
+func Tokenize(s string) ([]string, error) {
+	var fields []string
+	var cur []rune
+	inField, quoted := false, false
+	rs := []rune(s)
+	for i := 0; i < len(rs); i++ {
+		r := rs[i]
+		switch {
+		case quoted && r == '\'':
+			if i+1 < len(rs) && rs[i+1] == '\'' {
+				cur = append(cur, '\'')
+				i++
+			} else {
+				quoted = false
+			}
+		case quoted:
+			cur = append(cur, r)
+		case r == '\'':
+			quoted, inField = true, true
+		case r == ' ' || r == '\t' || r == '\r' || r == '\n':
+			if inField {
+				fields = append(fields, string(cur))
+				cur, inField = nil, false
+			}
+		default:
+			cur = append(cur, r)
+			inField = true
+		}
+	}
+	if quoted {
+		return nil, errUnterminated
+	}
+	if inField {
+		fields = append(fields, string(cur))
+	}
+	return fields, nil
+}
+
+// Quote quotes s so that Tokenize reads it back as a single field.
+func Quote(s string) string {
+	if s != "" && !strings.ContainsAny(s, " \t\r\n'") {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
+
+// Command is a ctl command.
+type Command struct {
+	Name string
+	// Usage describes the command and its arguments, such as "limit bytes",
+	// and is reported when it is given the wrong number of arguments.
+	Usage string
+	// MinArgs and MaxArgs bound the number of arguments. A negative MaxArgs
+	// allows any number.
+	MinArgs, MaxArgs int
+	// Run runs the command on behalf of user.
+	Run func(user string, args []string) error
+}
+
+// Parser runs the commands registered with it.
+type Parser struct {
+	sync.RWMutex
+	cmds map[string]*Command
+}
+
+// Register adds a command.
+func (p *Parser) Register(c Command) error {
+	if c.MinArgs < 0 || (c.MaxArgs >= 0 && c.MaxArgs < c.MinArgs) {
+		return errInvalidArgBounds
+	}
+	if c.Usage == "" {
+		c.Usage = c.Name
+	}
+	p.Lock()
+	defer p.Unlock()
+	if _, ok := p.cmds[c.Name]; ok {
+		return errAlreadyExists
+	}
+	p.cmds[c.Name] = &c
+	return nil
+}
+
+// Exec runs a single line on behalf of user. Blank lines and comments do
+// nothing.
+func (p *Parser) Exec(user, line string) error {
+	if t := strings.TrimSpace(line); t == "" || strings.HasPrefix(t, "#") {
+		return nil
+	}
+	fields, err := Tokenize(line)
+	if err != nil {
+		return err
+	}
+
+	p.RLock()
+	c, ok := p.cmds[fields[0]]
+	p.RUnlock()
+	if !ok {
+		return fmt.Errorf("unknown ctl command: %s", fields[0])
+	}
+	args := fields[1:]
+	if len(args) < c.MinArgs || (c.MaxArgs >= 0 && len(args) > c.MaxArgs) {
+		return fmt.Errorf("usage: %s", c.Usage)
+	}
+	return c.Run(user, args)
+}
+
+// Write runs every line of b on behalf of user, stopping at the first that
+// fails. A final line need not end with a newline. It can be used as the
+// write function of a synthetic file whose every write is a whole message.
+func (p *Parser) Write(user string, b []byte) (int, error) {
+	if strings.TrimSpace(string(b)) == "" {
+		return 0, ErrEmpty
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if err := p.Exec(user, line); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// Usage returns the usage of every command, one per line, in order.
+func (p *Parser) Usage() string {
+	p.RLock()
+	defer p.RUnlock()
+	var usages []string
+	for _, c := range p.cmds {
+		usages = append(usages, c.Usage)
+	}
+	sort.Strings(usages)
+	return strings.Join(usages, "\n") + "\n"
+}
+
+func NewParser() *Parser {
+	return &Parser{cmds: make(map[string]*Command)}
+}
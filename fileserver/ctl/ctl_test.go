@@ -0,0 +1,111 @@
+package ctl_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/kennylevinsen/g9ptools/fileserver/ctl"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		line string
+		want []string
+		err  bool
+	}{
+		{line: "", want: nil},
+		{line: "  \t ", want: nil},
+		{line: "limit 10", want: []string{"limit", "10"}},
+		{line: " a\tb  c\n", want: []string{"a", "b", "c"}},
+		{line: "say 'hello world'", want: []string{"say", "hello world"}},
+		{line: "say 'it''s'", want: []string{"say", "it's"}},
+		{line: "''''", want: []string{"'"}},
+		{line: "a '' b", want: []string{"a", "", "b"}},
+		{line: "''", want: []string{""}},
+		{line: "key='a b'c", want: []string{"key=a bc"}},
+		{line: "say 'unterminated", err: true},
+		{line: "say 'it''", err: true},
+	}
+
+	for _, tt := range tests {
+		got, err := ctl.Tokenize(tt.line)
+		if tt.err {
+			if err == nil {
+				t.Errorf("Tokenize(%q) = %q, expected error", tt.line, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Tokenize(%q): %v", tt.line, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Tokenize(%q) = %q, expected %q", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestQuote(t *testing.T) {
+	for _, s := range []string{"", "plain", "two words", "it's", "'", "tab\there", "line\nbreak"} {
+		got, err := ctl.Tokenize(ctl.Quote(s))
+		if err != nil {
+			t.Errorf("Tokenize(Quote(%q)): %v", s, err)
+			continue
+		}
+		if len(got) != 1 || got[0] != s {
+			t.Errorf("Tokenize(Quote(%q)) = %q", s, got)
+		}
+	}
+}
+
+func TestParser(t *testing.T) {
+	var ran [][]string
+	p := ctl.NewParser()
+	err := p.Register(ctl.Command{
+		Name:    "set",
+		Usage:   "set name [value]",
+		MinArgs: 1,
+		MaxArgs: 2,
+		Run: func(user string, args []string) error {
+			ran = append(ran, append([]string{user}, args...))
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	if err := p.Register(ctl.Command{Name: "set"}); err == nil {
+		t.Fatal("registering a command twice succeeded")
+	}
+	if err := p.Register(ctl.Command{Name: "bad", MinArgs: 2, MaxArgs: 1}); err == nil {
+		t.Fatal("registering a command with invalid bounds succeeded")
+	}
+
+	if _, err := p.Write("glenda", []byte("set a\n# comment\n\nset b 'x y'\n")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	want := [][]string{{"glenda", "a"}, {"glenda", "b", "x y"}}
+	if !reflect.DeepEqual(ran, want) {
+		t.Fatalf("ran %q, expected %q", ran, want)
+	}
+
+	if _, err := p.Write("glenda", []byte(" \n")); err != ctl.ErrEmpty {
+		t.Errorf("empty write returned %v, expected %v", err, ctl.ErrEmpty)
+	}
+	if err := p.Exec("glenda", "unknown"); err == nil {
+		t.Error("unknown command succeeded")
+	}
+	if err := p.Exec("glenda", "set"); err == nil || !strings.Contains(err.Error(), "set name [value]") {
+		t.Errorf("too few arguments returned %v", err)
+	}
+	if err := p.Exec("glenda", "set a b c"); err == nil {
+		t.Error("too many arguments succeeded")
+	}
+	if err := p.Exec("glenda", "set 'a"); err == nil {
+		t.Error("unterminated quote succeeded")
+	}
+	if got := p.Usage(); got != "set name [value]\n" {
+		t.Errorf("usage is %q", got)
+	}
+}
@@ -0,0 +1,80 @@
+package ctl
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+	"github.com/kennylevinsen/g9ptools/fileserver/templatefs"
+)
+
+// File is a ctl file running the commands of a Parser. Reading it lists
+// the usage of the commands.
+type File struct {
+	templatefs.FileBase
+	p *Parser
+}
+
+// NewFile returns a ctl file for p.
+func NewFile(name string, permissions protocol.FileMode, user, group string, p *Parser) *File {
+	f := &File{p: p}
+	f.Init(name, permissions, user, group)
+	return f
+}
+
+func (f *File) Open(user string, mode protocol.OpenMode) (fileserver.OpenFile, error) {
+	if err := f.CheckOpen(user, mode); err != nil {
+		return nil, err
+	}
+	return &OpenFile{
+		Reader: templatefs.NewReader([]byte(f.p.Usage())),
+		p:      f.p,
+		user:   user,
+	}, nil
+}
+
+// OpenFile is an open ctl file. Writes are buffered until they complete a
+// line, so that a command may be written in pieces, and each complete line
+// is run as it arrives. The error of a failed command is returned by the
+// write completing it, and the rest of that write is discarded. A partial
+// line left when the file is closed is run then, with its error returned by
+// Tclunk.
+type OpenFile struct {
+	*templatefs.Reader
+	wlock sync.Mutex
+	p     *Parser
+	user  string
+	buf   []byte
+}
+
+func (of *OpenFile) Write(b []byte) (int, error) {
+	of.wlock.Lock()
+	defer of.wlock.Unlock()
+	of.buf = append(of.buf, b...)
+	for {
+		idx := bytes.IndexByte(of.buf, '\n')
+		if idx == -1 {
+			return len(b), nil
+		}
+		line := string(of.buf[:idx])
+		of.buf = of.buf[idx+1:]
+		if err := of.p.Exec(of.user, line); err != nil {
+			of.buf = nil
+			return 0, err
+		}
+	}
+}
+
+func (of *OpenFile) Close() error {
+	of.wlock.Lock()
+	line := string(of.buf)
+	of.buf = nil
+	of.wlock.Unlock()
+
+	err := of.p.Exec(of.user, line)
+	if cerr := of.Reader.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,224 @@
+package fileserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kennylevinsen/g9p"
+	"github.com/kennylevinsen/g9p/protocol"
+)
+
+// ErrInjected is the error returned for requests failed by Faults.
+var ErrInjected = errors.New("injected fault")
+
+// Faults is an Interceptor injecting faults into sessions, for testing how
+// clients cope with slow or misbehaving servers. Probabilities are between 0
+// and 1, and zero fields inject nothing. Version and Flush requests are only
+// delayed, so that sessions can always be set up and recovered.
+//
+// A Faults may be shared between sessions, but the context given to
+// Intercept must then be distinct for each session, as it is used to tell
+// their tags apart.
+type Faults struct {
+	sync.Mutex
+
+	// Latency is the maximum delay added before each request.
+	Latency time.Duration
+	// Drop is the probability of handling a request, but never responding
+	// to it, until the client flushes it.
+	Drop float64
+	// ShortRead is the probability of returning only part of the data of a
+	// read.
+	ShortRead float64
+	// Error is the probability of failing a request with ErrInjected.
+	Error float64
+
+	rand    *rand.Rand
+	dropped map[droppedKey]chan struct{}
+}
+
+type droppedKey struct {
+	ctx context.Context
+	tag protocol.Tag
+}
+
+// chance reports whether an event of probability p happens.
+func (f *Faults) chance(p float64) bool {
+	if p <= 0 {
+		return false
+	}
+	f.Lock()
+	defer f.Unlock()
+	return f.rand.Float64() < p
+}
+
+// intn returns a random number in [0, n).
+func (f *Faults) intn(n int64) int64 {
+	f.Lock()
+	defer f.Unlock()
+	return f.rand.Int63n(n)
+}
+
+// delay sleeps for a random part of the latency, or until ctx is done.
+func (f *Faults) delay(ctx context.Context) {
+	if f.Latency <= 0 {
+		return
+	}
+	t := time.NewTimer(time.Duration(f.intn(int64(f.Latency))))
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+	}
+}
+
+// hold registers the request with tag as dropped, so that a flush of it
+// releases it. It is registered before the request is handled, as the client
+// may flush it at any time.
+func (f *Faults) hold(ctx context.Context, tag protocol.Tag) chan struct{} {
+	ch := make(chan struct{})
+	f.Lock()
+	f.dropped[droppedKey{ctx, tag}] = ch
+	f.Unlock()
+	return ch
+}
+
+// drop waits until the request with tag, held as ch, is flushed, or ctx is
+// done.
+func (f *Faults) drop(ctx context.Context, tag protocol.Tag, ch chan struct{}) {
+	key := droppedKey{ctx, tag}
+	select {
+	case <-ch:
+	case <-ctx.Done():
+		f.Lock()
+		delete(f.dropped, key)
+		f.Unlock()
+	}
+}
+
+// flush releases the dropped request with tag, if any.
+func (f *Faults) flush(ctx context.Context, tag protocol.Tag) {
+	key := droppedKey{ctx, tag}
+	f.Lock()
+	defer f.Unlock()
+	if ch, ok := f.dropped[key]; ok {
+		close(ch)
+		delete(f.dropped, key)
+	}
+}
+
+func (f *Faults) Handle(ctx context.Context, req protocol.Message, next Next) (protocol.Message, error) {
+	f.delay(ctx)
+
+	switch r := req.(type) {
+	case *protocol.VersionRequest:
+		return next(ctx, req)
+	case *protocol.FlushRequest:
+		f.flush(ctx, r.OldTag)
+		return next(ctx, req)
+	case *protocol.ClunkRequest, *protocol.RemoveRequest:
+		// The fid is gone even if these fail, so they are always
+		// passed on.
+		resp, err := next(ctx, req)
+		if err == nil && f.chance(f.Error) {
+			return nil, ErrInjected
+		}
+		return resp, err
+	}
+
+	if f.chance(f.Error) {
+		return nil, ErrInjected
+	}
+
+	var held chan struct{}
+	if f.chance(f.Drop) {
+		held = f.hold(ctx, req.GetTag())
+	}
+	resp, err := next(ctx, req)
+	if held != nil {
+		f.drop(ctx, req.GetTag(), held)
+		return nil, g9p.ErrFlushed
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if r, ok := resp.(*protocol.ReadResponse); ok && len(r.Data) > 1 && f.chance(f.ShortRead) {
+		short := *r
+		short.Data = r.Data[:1+f.intn(int64(len(r.Data)-1))]
+		return &short, nil
+	}
+	return resp, nil
+}
+
+// NewFaults returns a Faults using seed for its random choices.
+func NewFaults(seed int64) *Faults {
+	return &Faults{
+		rand:    rand.New(rand.NewSource(seed)),
+		dropped: make(map[droppedKey]chan struct{}),
+	}
+}
+
+// ParseFaults parses a fault specification, a comma-separated list of
+// key=value pairs for the keys latency, drop, short, error and seed, such as
+// "latency=50ms,error=0.01". Without a seed, the current time is used.
+func ParseFaults(s string) (*Faults, error) {
+	var (
+		latency                time.Duration
+		drop, short, errChance float64
+		seed                   = time.Now().UnixNano()
+	)
+	for _, opt := range strings.Split(s, ",") {
+		if opt == "" {
+			continue
+		}
+		idx := strings.Index(opt, "=")
+		if idx == -1 {
+			return nil, fmt.Errorf("fault option %q has no value", opt)
+		}
+		key, value := opt[:idx], opt[idx+1:]
+
+		var err error
+		switch key {
+		case "latency":
+			latency, err = time.ParseDuration(value)
+		case "drop":
+			drop, err = parseChance(value)
+		case "short":
+			short, err = parseChance(value)
+		case "error":
+			errChance, err = parseChance(value)
+		case "seed":
+			seed, err = strconv.ParseInt(value, 10, 64)
+		default:
+			return nil, fmt.Errorf("unknown fault option %q", key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("fault option %s: %v", key, err)
+		}
+	}
+
+	f := NewFaults(seed)
+	f.Latency = latency
+	f.Drop = drop
+	f.ShortRead = short
+	f.Error = errChance
+	return f, nil
+}
+
+func parseChance(s string) (float64, error) {
+	p, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	if p < 0 || p > 1 {
+		return 0, errors.New("probability must be between 0 and 1")
+	}
+	return p, nil
+}
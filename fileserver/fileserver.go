@@ -5,11 +5,15 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"path"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/kennylevinsen/g9p"
 	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/auth"
 )
 
 type Verbosity int
@@ -24,6 +28,9 @@ const (
 
 const (
 	DefaultMaxSize = (1024 * 1024 * 1024)
+
+	// MaxWalkElements is the maximum number of names in a walk.
+	MaxWalkElements = 16
 )
 
 type State struct {
@@ -34,19 +41,117 @@ type State struct {
 	mode     protocol.OpenMode
 	service  string
 	username string
+	readOnly bool
+
+	// seekLock serialises I/O on open files without positional I/O, as
+	// their offset is shared by all requests on the fid.
+	seekLock sync.Mutex
+
+	// read and written count the bytes transferred through the fid. They
+	// are accessed atomically.
+	read    uint64
+	written uint64
 }
 
+var errReadOnly = errors.New("read-only file system")
+
 type FileServer struct {
 	sync.RWMutex
 	Roots  map[string]Dir
 	Root   Dir
 	Chatty Verbosity
 
+	// Keys enables authentication when set. Attaches must then present an
+	// auth fid that completed AuthProto, or auth.DefaultProto if unset, for
+	// the user attaching.
+	Keys      *auth.Keyring
+	AuthProto string
+
+	// Users, if set, rejects attaches by users it does not know.
+	Users UserDB
+
+	// ReadOnly rejects all requests that would modify the served trees.
+	ReadOnly bool
+
+	// Scope, if set, is a path within every service that attaches are
+	// confined to, as if it was the root of the service.
+	Scope string
+
+	// Restrict, if set, returns further restrictions of a user, which are
+	// applied to the fids of its attaches.
+	Restrict func(user string) Restriction
+
+	// Locks holds the byte-range locks of the served files. If nil, a
+	// table of its own is made when the FileServer first needs it. Set it
+	// to share locks with other FileServers serving the same trees.
+	Locks     *LockTable
+	locksOnce sync.Once
+
 	MaxSize uint32
 	fidLock sync.RWMutex
 	Fids    map[protocol.Fid]*State
 	tagLock sync.Mutex
 	tags    map[protocol.Tag]bool
+	pending map[protocol.Tag]OpenFile
+}
+
+// sync syncs the open file of the fid, or otherwise its file, if either is
+// a Syncer. Must be called with the state read locked.
+func (s *State) sync() error {
+	if sy, ok := s.open.(Syncer); ok {
+		return sy.Sync()
+	}
+	if sy, ok := s.location.Current().(Syncer); ok {
+		return sy.Sync()
+	}
+	return nil
+}
+
+// interrupt wakes up any blocked reads or writes on the fid, so that it can be
+// clunked.
+func (s *State) interrupt() {
+	s.RLock()
+	of := s.open
+	s.RUnlock()
+	if i, ok := of.(Interrupter); ok {
+		i.Interrupt()
+	}
+}
+
+// readAt reads from the open file at off. It uses io.ReaderAt if the open
+// file implements it, and falls back to Seek and Read otherwise. As with
+// io.ReaderAt, data may be returned along with io.EOF.
+func (s *State) readAt(p []byte, off int64) (int, error) {
+	if ra, ok := s.open.(io.ReaderAt); ok {
+		return ra.ReadAt(p, off)
+	}
+
+	s.seekLock.Lock()
+	defer s.seekLock.Unlock()
+	if _, err := s.open.Seek(off, 0); err != nil {
+		return 0, err
+	}
+	n, err := s.open.Read(p)
+	if err == io.EOF {
+		// Seek-based files signal end of file without data.
+		n = 0
+	}
+	return n, err
+}
+
+// writeAt writes to the open file at off. It uses io.WriterAt if the open
+// file implements it, and falls back to Seek and Write otherwise.
+func (s *State) writeAt(p []byte, off int64) (int, error) {
+	if wa, ok := s.open.(io.WriterAt); ok {
+		return wa.WriteAt(p, off)
+	}
+
+	s.seekLock.Lock()
+	defer s.seekLock.Unlock()
+	if _, err := s.open.Seek(off, 0); err != nil {
+		return 0, err
+	}
+	return s.open.Write(p)
 }
 
 func (fs *FileServer) logreq(d protocol.Message) {
@@ -90,11 +195,30 @@ func (fs *FileServer) register(d protocol.Message) error {
 
 func (fs *FileServer) flush(t protocol.Tag) {
 	fs.tagLock.Lock()
-	defer fs.tagLock.Unlock()
-
 	if _, ok := fs.tags[t]; ok {
 		delete(fs.tags, t)
 	}
+	of := fs.pending[t]
+	fs.tagLock.Unlock()
+
+	// Wake up the flushed request if it is blocked on its file.
+	if i, ok := of.(Interrupter); ok {
+		i.Interrupt()
+	}
+}
+
+// pend records the open file a request is operating on, so that a flush can
+// interrupt it.
+func (fs *FileServer) pend(t protocol.Tag, of OpenFile) {
+	fs.tagLock.Lock()
+	defer fs.tagLock.Unlock()
+	fs.pending[t] = of
+}
+
+func (fs *FileServer) unpend(t protocol.Tag) {
+	fs.tagLock.Lock()
+	defer fs.tagLock.Unlock()
+	delete(fs.pending, t)
 }
 
 func (fs *FileServer) flushed(d protocol.Message) bool {
@@ -129,9 +253,14 @@ func (fs *FileServer) Version(r *protocol.VersionRequest) (resp *protocol.Versio
 	} else {
 		fs.MaxSize = DefaultMaxSize
 	}
+	// A new session starts without locks.
+	fs.locks().release(fs, 0, true)
 
+	// Extended versions, such as the 9P2000.L and 9P2000.u offered by the
+	// Linux v9fs client of virtual machine guests, are answered with the
+	// base protocol, which the client then falls back to.
 	proto := "9P2000"
-	if r.Version != "9P2000" {
+	if r.Version != "9P2000" && !strings.HasPrefix(r.Version, "9P2000.") {
 		proto = "unknown"
 	}
 
@@ -156,7 +285,43 @@ func (fs *FileServer) Auth(r *protocol.AuthRequest) (resp *protocol.AuthResponse
 
 	fs.logreq(r)
 
-	return nil, fmt.Errorf("auth not supported")
+	if fs.Keys == nil {
+		return nil, fmt.Errorf("auth not supported")
+	}
+
+	proto := fs.AuthProto
+	if proto == "" {
+		proto = auth.DefaultProto
+	}
+	conv, err := auth.Start(fs.Keys, auth.Attrs{
+		{Name: "proto", Value: proto},
+		{Name: "role", Value: "server"},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	fs.fidLock.Lock()
+	defer fs.fidLock.Unlock()
+
+	if _, ok := fs.Fids[r.AuthFid]; ok {
+		return nil, fmt.Errorf("fid already in use")
+	}
+
+	// The auth fid has no location, and is opened from the start, so that it
+	// can be neither walked nor opened.
+	fs.Fids[r.AuthFid] = &State{
+		service:  r.Service,
+		username: r.Username,
+		open:     &authOpenFile{conv: conv},
+		mode:     protocol.ORDWR,
+	}
+
+	resp = &protocol.AuthResponse{
+		AuthQid: protocol.Qid{Type: protocol.QTAUTH},
+	}
+
+	return resp, nil
 }
 
 func (fs *FileServer) Attach(r *protocol.AttachRequest) (resp *protocol.AttachResponse, err error) {
@@ -178,6 +343,32 @@ func (fs *FileServer) Attach(r *protocol.AttachRequest) (resp *protocol.AttachRe
 		return nil, fmt.Errorf("fid already in use")
 	}
 
+	if fs.Keys != nil {
+		as, ok := fs.Fids[r.AuthFid]
+		if !ok {
+			return nil, fmt.Errorf("authentication required")
+		}
+		as.RLock()
+		af, ok := as.open.(*authOpenFile)
+		as.RUnlock()
+		if !ok || as.username != r.Username || as.service != r.Service {
+			return nil, fmt.Errorf("not an auth fid")
+		}
+		if err := af.authenticated(r.Username); err != nil {
+			return nil, err
+		}
+	}
+
+	if fs.Users != nil {
+		ok, err := fs.Users.Exists(r.Username)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, fmt.Errorf("unknown user")
+		}
+	}
+
 	var root Dir
 	if x, ok := fs.Roots[r.Service]; ok {
 		root = x
@@ -189,10 +380,20 @@ func (fs *FileServer) Attach(r *protocol.AttachRequest) (resp *protocol.AttachRe
 		return nil, fmt.Errorf("no such service")
 	}
 
+	var rs Restriction
+	if fs.Restrict != nil {
+		rs = fs.Restrict(r.Username)
+	}
+	loc, err := scope(r.Username, root, path.Join("/", fs.Scope, rs.Scope))
+	if err != nil {
+		return nil, err
+	}
+
 	s := &State{
 		service:  r.Service,
 		username: r.Username,
-		location: FilePath{root},
+		location: loc,
+		readOnly: fs.ReadOnly || rs.ReadOnly,
 	}
 
 	fs.Fids[r.Fid] = s
@@ -229,6 +430,39 @@ func (fs *FileServer) Flush(r *protocol.FlushRequest) (resp *protocol.FlushRespo
 	return resp, nil
 }
 
+// walkStep walks from loc to name. The current file of loc must be a
+// directory that the user may search. ".." at the root stays at the root.
+func walkStep(user string, loc FilePath, name string) (FilePath, error) {
+	cur := loc.Current()
+	d, err := asDir(cur)
+	if err != nil {
+		return nil, err
+	}
+	x, err := cur.Open(user, protocol.OEXEC)
+	if err != nil {
+		return nil, err
+	}
+	x.Close()
+
+	switch name {
+	case ".":
+		return loc, nil
+	case "..":
+		if len(loc) > 1 {
+			return loc[:len(loc)-1], nil
+		}
+		return loc, nil
+	}
+
+	f, err := d.Walk(user, name)
+	if err != nil {
+		return nil, err
+	}
+	// Limit the capacity, so that the append never modifies the location
+	// of another fid.
+	return append(loc[:len(loc):len(loc)], f), nil
+}
+
 func (fs *FileServer) Walk(r *protocol.WalkRequest) (resp *protocol.WalkResponse, err error) {
 	fs.register(r)
 	defer func() {
@@ -242,6 +476,10 @@ func (fs *FileServer) Walk(r *protocol.WalkRequest) (resp *protocol.WalkResponse
 
 	fs.logreq(r)
 
+	if len(r.Names) > MaxWalkElements {
+		return nil, fmt.Errorf("too many names in walk")
+	}
+
 	fs.fidLock.Lock()
 	defer fs.fidLock.Unlock()
 	s, ok := fs.Fids[r.Fid]
@@ -249,111 +487,48 @@ func (fs *FileServer) Walk(r *protocol.WalkRequest) (resp *protocol.WalkResponse
 		return nil, fmt.Errorf("unknown fid")
 	}
 
-	s.Lock()
-	defer s.Unlock()
+	s.RLock()
+	defer s.RUnlock()
 
 	if s.open != nil {
 		return nil, fmt.Errorf("fid cannot be open for walk")
 	}
 
-	if _, ok = fs.Fids[r.NewFid]; ok {
+	if _, ok = fs.Fids[r.NewFid]; ok && r.NewFid != r.Fid {
 		return nil, fmt.Errorf("fid already in use")
 	}
 
-	if len(r.Names) == 0 {
-		x := &State{
-			service:  s.service,
-			username: s.username,
-			location: s.location,
-		}
-		fs.Fids[r.NewFid] = x
-
-		resp := &protocol.WalkResponse{}
-		return resp, nil
-	}
-
-	cur := s.location.Current()
-	d, err := cur.IsDir()
-	if err != nil {
-		return nil, err
-	}
-	if !d {
-		return nil, fmt.Errorf("walk -- in a non-directory")
-	}
-	root := cur
-
-	newloc := s.location
-	first := true
+	// A walk that fails on the first name is an error. Otherwise, the qids
+	// of the names walked are returned, and newfid is only affected if all
+	// names were walked.
+	loc := s.location
 	var qids []protocol.Qid
-	for i := range r.Names {
-		x, err := root.Open(s.username, protocol.OEXEC)
+	for i, name := range r.Names {
+		next, err := walkStep(s.username, loc, name)
 		if err != nil {
-			goto write
-		}
-		x.Close()
-
-		addToLoc := true
-		name := r.Names[i]
-		switch name {
-		case ".":
-			// This is a nop, but we should still report the result
-			addToLoc = false
-		case "..":
-			// Go one directory up, or nop if we're at /
-			root = newloc.Parent()
-			if len(newloc) > 1 {
-				newloc = newloc[:len(newloc)-1]
-				addToLoc = false
-			}
-		default:
-			istree, err := root.IsDir()
-			if err != nil {
+			if i == 0 {
 				return nil, err
 			}
-			if !istree {
-				goto write
-			}
-
-			d := root.(Dir)
-			root, err = d.Walk(s.username, name)
-			if err != nil {
-				goto write
-			}
-			if root == nil {
-				if first {
-					return nil, errors.New("file does not exist")
-				}
-				goto write
-			}
-		}
-
-		if addToLoc {
-			newloc = append(newloc, root)
+			break
 		}
-		q, err := root.Qid()
+		loc = next
+		q, err := loc.Current().Qid()
 		if err != nil {
 			return nil, err
 		}
 		qids = append(qids, q)
-
-		if i >= len(r.Names)-1 {
-			s := &State{
-				service:  s.service,
-				username: s.username,
-				location: newloc,
-			}
-			fs.Fids[r.NewFid] = s
-		}
-
-		first = false
 	}
 
-write:
-	resp = &protocol.WalkResponse{
-		Qids: qids,
+	if len(qids) == len(r.Names) {
+		fs.Fids[r.NewFid] = &State{
+			service:  s.service,
+			username: s.username,
+			location: loc,
+			readOnly: s.readOnly,
+		}
 	}
 
-	return resp, nil
+	return &protocol.WalkResponse{Qids: qids}, nil
 }
 
 func (fs *FileServer) Open(r *protocol.OpenRequest) (resp *protocol.OpenResponse, err error) {
@@ -370,8 +545,8 @@ func (fs *FileServer) Open(r *protocol.OpenRequest) (resp *protocol.OpenResponse
 	fs.logreq(r)
 
 	fs.fidLock.RLock()
-	defer fs.fidLock.RUnlock()
 	s, ok := fs.Fids[r.Fid]
+	fs.fidLock.RUnlock()
 	if !ok {
 		return nil, fmt.Errorf("unknown fid")
 	}
@@ -383,6 +558,10 @@ func (fs *FileServer) Open(r *protocol.OpenRequest) (resp *protocol.OpenResponse
 		return nil, fmt.Errorf("already open")
 	}
 
+	if s.readOnly && (r.Mode&3 == protocol.OWRITE || r.Mode&3 == protocol.ORDWR || r.Mode&(protocol.OTRUNC|protocol.ORCLOSE) != 0) {
+		return nil, errReadOnly
+	}
+
 	l := s.location.Current()
 	q, err := l.Qid()
 	if err != nil {
@@ -416,8 +595,8 @@ func (fs *FileServer) Create(r *protocol.CreateRequest) (resp *protocol.CreateRe
 	fs.logreq(r)
 
 	fs.fidLock.RLock()
-	defer fs.fidLock.RUnlock()
 	s, ok := fs.Fids[r.Fid]
+	fs.fidLock.RUnlock()
 	if !ok {
 		return nil, fmt.Errorf("unknown fid")
 	}
@@ -433,32 +612,42 @@ func (fs *FileServer) Create(r *protocol.CreateRequest) (resp *protocol.CreateRe
 		return nil, fmt.Errorf("file name syntax")
 	}
 
-	cur := s.location.Current()
-	isdir, err := cur.IsDir()
-	if err != nil {
-		return nil, err
+	if s.readOnly {
+		return nil, errReadOnly
 	}
-	if !isdir {
-		return nil, fmt.Errorf("create -- in a non-directory")
-	}
-	t := cur.(Dir)
 
-	l, err := t.Create(s.username, r.Name, r.Permissions)
+	t, err := asDir(s.location.Current())
 	if err != nil {
 		return nil, err
 	}
 
-	q, err := l.Qid()
-	if err != nil {
-		return nil, err
+	var l File
+	var x OpenFile
+	if co, ok := t.(CreateOpener); ok {
+		l, x, err = co.CreateOpen(s.username, r.Name, r.Permissions, r.Mode)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		l, err = t.Create(s.username, r.Name, r.Permissions)
+		if err != nil {
+			return nil, err
+		}
+		x, err = l.Open(s.username, r.Mode)
+		if err != nil {
+			// A failed create must not leave anything behind.
+			t.Remove(s.username, r.Name)
+			return nil, err
+		}
 	}
 
-	x, err := l.Open(s.username, r.Mode)
+	q, err := l.Qid()
 	if err != nil {
+		x.Close()
 		return nil, err
 	}
 
-	s.location = append(s.location, l)
+	s.location = append(s.location[:len(s.location):len(s.location)], l)
 	s.open = x
 	s.mode = r.Mode
 	resp = &protocol.CreateResponse{
@@ -483,8 +672,8 @@ func (fs *FileServer) Read(r *protocol.ReadRequest) (resp *protocol.ReadResponse
 	fs.logreq(r)
 
 	fs.fidLock.RLock()
-	defer fs.fidLock.RUnlock()
 	s, ok := fs.Fids[r.Fid]
+	fs.fidLock.RUnlock()
 	if !ok {
 		return nil, fmt.Errorf("unknown fid")
 	}
@@ -505,21 +694,28 @@ func (fs *FileServer) Read(r *protocol.ReadRequest) (resp *protocol.ReadResponse
 		count = int(r.Count)
 	}
 
-	b := make([]byte, count)
+	fs.pend(r.Tag, s.open)
+	defer fs.unpend(r.Tag)
 
-	_, err = s.open.Seek(int64(r.Offset), 0)
-	if err != nil {
-		return nil, err
+	if sl, ok := s.open.(Slicer); ok {
+		b, err := sl.Slice(int64(r.Offset), count)
+		if err != nil {
+			return nil, err
+		}
+		atomic.AddUint64(&s.read, uint64(len(b)))
+		return &protocol.ReadResponse{Data: b}, nil
 	}
-	n, err := s.open.Read(b)
-	if err == io.EOF {
-		n = 0
-	} else if err != nil {
+
+	b := readBuffers.get(count)
+
+	n, err := s.readAt(b, int64(r.Offset))
+	if err != nil && err != io.EOF {
+		readBuffers.put(b)
 		return nil, err
 	}
-	b = b[:n]
+	atomic.AddUint64(&s.read, uint64(n))
 	resp = &protocol.ReadResponse{
-		Data: b,
+		Data: readBuffers.detach(b, n),
 	}
 
 	return resp, nil
@@ -539,8 +735,8 @@ func (fs *FileServer) Write(r *protocol.WriteRequest) (resp *protocol.WriteRespo
 	fs.logreq(r)
 
 	fs.fidLock.RLock()
-	defer fs.fidLock.RUnlock()
 	s, ok := fs.Fids[r.Fid]
+	fs.fidLock.RUnlock()
 	if !ok {
 		return nil, fmt.Errorf("unknown fid")
 	}
@@ -556,14 +752,17 @@ func (fs *FileServer) Write(r *protocol.WriteRequest) (resp *protocol.WriteRespo
 		return nil, fmt.Errorf("file not opened for writing")
 	}
 
-	_, err = s.open.Seek(int64(r.Offset), 0)
-	if err != nil {
-		return nil, err
-	}
-	n, err := s.open.Write(r.Data)
+	fs.pend(r.Tag, s.open)
+	defer fs.unpend(r.Tag)
+
+	// The payload is handed to the file as decoded, without copying, as
+	// the request is not used once the write is done. Files keeping the
+	// data must copy it.
+	n, err := s.writeAt(r.Data, int64(r.Offset))
 	if err != nil {
 		return nil, err
 	}
+	atomic.AddUint64(&s.written, uint64(n))
 
 	resp = &protocol.WriteResponse{
 		Count: uint32(n),
@@ -585,23 +784,36 @@ func (fs *FileServer) Clunk(r *protocol.ClunkRequest) (resp *protocol.ClunkRespo
 
 	fs.logreq(r)
 
+	if err := fs.clunk(r.Fid); err != nil {
+		return nil, err
+	}
+	return &protocol.ClunkResponse{}, nil
+}
+
+// clunk forgets a fid, closing its open file and releasing its locks.
+func (fs *FileServer) clunk(fid protocol.Fid) error {
 	fs.fidLock.Lock()
-	defer fs.fidLock.Unlock()
-	s, ok := fs.Fids[r.Fid]
+	s, ok := fs.Fids[fid]
 	if !ok {
-		return nil, fmt.Errorf("unknown fid")
+		fs.fidLock.Unlock()
+		return fmt.Errorf("unknown fid")
 	}
+	delete(fs.Fids, fid)
+	fs.fidLock.Unlock()
+	fs.locks().release(fs, fid, false)
 
+	s.interrupt()
 	s.Lock()
 	defer s.Unlock()
 
+	// Files acting on their content when closed, such as by validating it,
+	// report failure through Rclunk. The fid is gone regardless.
+	var err error
 	if s.open != nil {
-		s.open.Close()
+		err = s.open.Close()
 		s.open = nil
 	}
-
-	delete(fs.Fids, r.Fid)
-	return &protocol.ClunkResponse{}, nil
+	return err
 }
 
 func (fs *FileServer) Remove(r *protocol.RemoveRequest) (resp *protocol.RemoveResponse, err error) {
@@ -618,12 +830,16 @@ func (fs *FileServer) Remove(r *protocol.RemoveRequest) (resp *protocol.RemoveRe
 	fs.logreq(r)
 
 	fs.fidLock.Lock()
-	defer fs.fidLock.Unlock()
 	s, ok := fs.Fids[r.Fid]
 	if !ok {
+		fs.fidLock.Unlock()
 		return nil, fmt.Errorf("unknown fid")
 	}
-	defer delete(fs.Fids, r.Fid)
+	delete(fs.Fids, r.Fid)
+	fs.fidLock.Unlock()
+	fs.locks().release(fs, r.Fid, false)
+
+	s.interrupt()
 	s.Lock()
 	defer s.Unlock()
 
@@ -632,21 +848,25 @@ func (fs *FileServer) Remove(r *protocol.RemoveRequest) (resp *protocol.RemoveRe
 		s.open = nil
 	}
 
-	var cur, p File
+	// The fid is clunked at this point, regardless of whether the remove
+	// succeeds.
+	if s.readOnly {
+		return nil, errReadOnly
+	}
 
-	// We're not going to remove /.
 	if len(s.location) <= 1 {
-		return &protocol.RemoveResponse{}, nil
+		return nil, errors.New("cannot remove root")
 	}
 
-	// Attempt to delete it, but ignore error.
-	cur = s.location.Current()
-	p = s.location.Parent()
+	cur := s.location.Current()
+	p := s.location.Parent()
 	n, err := cur.Name()
 	if err != nil {
 		return nil, err
 	}
-	p.(Dir).Remove(s.username, n)
+	if err := p.(Dir).Remove(s.username, n); err != nil {
+		return nil, err
+	}
 
 	return &protocol.RemoveResponse{}, nil
 }
@@ -665,8 +885,8 @@ func (fs *FileServer) Stat(r *protocol.StatRequest) (resp *protocol.StatResponse
 	fs.logreq(r)
 
 	fs.fidLock.RLock()
-	defer fs.fidLock.RUnlock()
 	s, ok := fs.Fids[r.Fid]
+	fs.fidLock.RUnlock()
 	if !ok {
 		return nil, fmt.Errorf("unknown fid")
 	}
@@ -714,23 +934,67 @@ func (fs *FileServer) WriteStat(r *protocol.WriteStatRequest) (resp *protocol.Wr
 	s.Lock()
 	defer s.Unlock()
 
-	var l File
-	var p Dir
-	l = s.location.Current()
-	if l == nil {
+	if s.location.Current() == nil {
 		return nil, fmt.Errorf("no such file")
 	}
 
-	if len(s.location) > 1 {
-		p = s.location.Parent().(Dir)
+	if isSyncStat(r.Stat) {
+		if err := s.sync(); err != nil {
+			return nil, err
+		}
+		return &protocol.WriteStatResponse{}, nil
 	}
-	if err := setStat(s.username, l, p, r.Stat); err != nil {
+
+	if s.readOnly {
+		return nil, errReadOnly
+	}
+
+	loc, err := setStat(s.username, s.location, r.Stat)
+	if err != nil {
 		return nil, err
 	}
+	s.location = loc
 
 	return &protocol.WriteStatResponse{}, nil
 }
 
+// Sync makes what has been written to the file of fid durable, if the
+// backend supports it, as for a 9P2000.L Tfsync. The FileServer only speaks
+// 9P2000, so Tfsync is never served; clients sync with a wstat of "don't
+// touch" fields instead, and Sync is only for callers of the API.
+func (fs *FileServer) Sync(fid protocol.Fid) error {
+	fs.fidLock.RLock()
+	s, ok := fs.Fids[fid]
+	fs.fidLock.RUnlock()
+	if !ok {
+		return fmt.Errorf("unknown fid")
+	}
+	s.RLock()
+	defer s.RUnlock()
+	return s.sync()
+}
+
+// Statfs describes the file system of the file of fid, as for a 9P2000.L
+// Tstatfs, using the nearest directory on the path to the file that is a
+// StatfsDir. The FileServer only speaks 9P2000, so Tstatfs is never served,
+// and Statfs is only for callers of the API, such as a df file.
+func (fs *FileServer) Statfs(fid protocol.Fid) (Statfs, error) {
+	fs.fidLock.RLock()
+	s, ok := fs.Fids[fid]
+	fs.fidLock.RUnlock()
+	if !ok {
+		return Statfs{}, fmt.Errorf("unknown fid")
+	}
+	s.RLock()
+	defer s.RUnlock()
+	for i := len(s.location) - 1; i >= 0; i-- {
+		if d, ok := s.location[i].(StatfsDir); ok {
+			return d.Statfs()
+		}
+	}
+	return Statfs{}, nil
+}
+
 func NewFileServer(root Dir, roots map[string]Dir, maxSize uint32, chat Verbosity) *FileServer {
 	fs := &FileServer{
 		Root:    root,
@@ -739,6 +1003,7 @@ func NewFileServer(root Dir, roots map[string]Dir, maxSize uint32, chat Verbosit
 		Chatty:  chat,
 		Fids:    make(map[protocol.Fid]*State),
 		tags:    make(map[protocol.Tag]bool),
+		pending: make(map[protocol.Tag]OpenFile),
 	}
 
 	if chat == Debug {
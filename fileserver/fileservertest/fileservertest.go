@@ -0,0 +1,1207 @@
+// Package fileservertest implements support for testing implementations of
+// fileserver.File and fileserver.Dir, in the spirit of testing/fstest.
+package fileservertest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/kennylevinsen/g9p"
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+)
+
+const (
+	// Other is the user name used when checking that permissions are
+	// enforced for users other than the owner.
+	Other = "fileservertest-other"
+
+	// Concurrency is the number of simultaneous opens used by the
+	// concurrency checks.
+	Concurrency = 16
+)
+
+type check struct {
+	name string
+	fn   func(d fileserver.Dir, user string) error
+}
+
+var checks = []check{
+	{"create", checkCreate},
+	{"walk", checkWalk},
+	{"paths", checkPaths},
+	{"readwrite", checkReadWrite},
+	{"dirread", checkDirRead},
+	{"permissions", checkPermissions},
+	{"rename", checkRename},
+	{"remove", checkRemove},
+	{"concurrent", checkConcurrent},
+	{"openremove", checkOpenRemove},
+	{"protowalk", checkProtoWalk},
+	{"protonotdir", checkProtoNotDir},
+	{"protowstat", checkProtoWriteStat},
+	{"protofids", checkProtoFids},
+	{"protocreate", checkProtoCreate},
+	{"protoversion", checkProtoVersion},
+}
+
+// TestDir checks that root behaves the way fileserver expects a Dir, and the
+// Files created within it, to behave. root must be writable by user, and
+// each check runs in a fresh directory created in root and removed again
+// afterwards. Some checks access the tree directly, while others serve it
+// over an in-memory 9P connection.
+//
+// If any check fails, the returned error describes all failures. A backend
+// test can thus be written as:
+//
+//	if err := fileservertest.TestDir(root, "user"); err != nil {
+//		t.Fatal(err)
+//	}
+func TestDir(root fileserver.Dir, user string) error {
+	var errs []string
+	for _, c := range checks {
+		name := "fileservertest-" + c.name
+		f, err := root.Create(user, name, protocol.DMDIR|0777)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: create directory: %v", c.name, err))
+			continue
+		}
+		d, ok := f.(fileserver.Dir)
+		if !ok {
+			errs = append(errs, fmt.Sprintf("%s: created directory does not implement Dir", c.name))
+			continue
+		}
+		if err := c.fn(d, user); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", c.name, err))
+		}
+		removeAll(d, user)
+		root.Remove(user, name)
+	}
+
+	if len(errs) > 0 {
+		return errors.New("fileservertest: " + strings.Join(errs, "\nfileservertest: "))
+	}
+	return nil
+}
+
+// removeAll recursively removes the content of d, ignoring errors.
+func removeAll(d fileserver.Dir, user string) {
+	sts, err := readDir(d, user)
+	if err != nil {
+		return
+	}
+	for _, st := range sts {
+		if st.Mode&protocol.DMDIR != 0 {
+			if f, err := d.Walk(user, st.Name); err == nil {
+				if sub, ok := f.(fileserver.Dir); ok {
+					removeAll(sub, user)
+				}
+			}
+		}
+		d.Remove(user, st.Name)
+	}
+}
+
+// readAll reads of from the start until a read returns no data. Like
+// fileserver, it seeks before reading, which some OpenFiles rely on to
+// prepare their content.
+func readAll(of fileserver.OpenFile) ([]byte, error) {
+	if _, err := of.Seek(0, 0); err != nil {
+		return nil, err
+	}
+	var b []byte
+	buf := make([]byte, 4096)
+	for {
+		n, err := of.Read(buf)
+		b = append(b, buf[:n]...)
+		if err == io.EOF {
+			return b, nil
+		}
+		if err != nil {
+			return b, err
+		}
+		if n == 0 {
+			return b, nil
+		}
+	}
+}
+
+// decodeDir decodes the stats of a directory read.
+func decodeDir(b []byte) ([]protocol.Stat, error) {
+	var sts []protocol.Stat
+	r := bytes.NewReader(b)
+	for r.Len() > 0 {
+		var st protocol.Stat
+		if err := st.Decode(r); err != nil {
+			return nil, fmt.Errorf("decode directory entry: %v", err)
+		}
+		sts = append(sts, st)
+	}
+	return sts, nil
+}
+
+func readDir(d fileserver.Dir, user string) ([]protocol.Stat, error) {
+	of, err := d.Open(user, protocol.OREAD)
+	if err != nil {
+		return nil, err
+	}
+	defer of.Close()
+	b, err := readAll(of)
+	if err != nil {
+		return nil, err
+	}
+	return decodeDir(b)
+}
+
+func readFile(f fileserver.File, user string) ([]byte, error) {
+	of, err := f.Open(user, protocol.OREAD)
+	if err != nil {
+		return nil, err
+	}
+	defer of.Close()
+	return readAll(of)
+}
+
+func writeFile(f fileserver.File, user string, b []byte) error {
+	of, err := f.Open(user, protocol.OWRITE|protocol.OTRUNC)
+	if err != nil {
+		return err
+	}
+	defer of.Close()
+	n, err := of.Write(b)
+	if err != nil {
+		return err
+	}
+	if n != len(b) {
+		return fmt.Errorf("short write: %d of %d bytes", n, len(b))
+	}
+	return nil
+}
+
+// mustWalk walks to name, which must exist.
+func mustWalk(d fileserver.Dir, user, name string) (fileserver.File, error) {
+	f, err := d.Walk(user, name)
+	if err != nil {
+		return nil, fmt.Errorf("walk %q: %v", name, err)
+	}
+	if f == nil {
+		return nil, fmt.Errorf("walk %q: returned neither file nor error", name)
+	}
+	return f, nil
+}
+
+// mustNotWalk walks to name, which must not exist.
+func mustNotWalk(d fileserver.Dir, user, name string) error {
+	f, err := d.Walk(user, name)
+	if err == nil {
+		return fmt.Errorf("walk %q: found a file that should not exist", name)
+	}
+	if err != fileserver.ErrNotExist {
+		return fmt.Errorf("walk %q: returned %v, expected fileserver.ErrNotExist", name, err)
+	}
+	if f != nil {
+		return fmt.Errorf("walk %q: returned a file along with an error", name)
+	}
+	return nil
+}
+
+func qidPath(f fileserver.File) (uint64, error) {
+	q, err := f.Qid()
+	if err != nil {
+		return 0, err
+	}
+	return q.Path, nil
+}
+
+func checkCreate(d fileserver.Dir, user string) error {
+	f, err := d.Create(user, "file", 0666)
+	if err != nil {
+		return fmt.Errorf("create file: %v", err)
+	}
+	if isDir, err := f.IsDir(); err != nil || isDir {
+		return fmt.Errorf("created file: IsDir returned %v, %v", isDir, err)
+	}
+	if n, err := f.Name(); err != nil || n != "file" {
+		return fmt.Errorf("created file: Name returned %q, %v", n, err)
+	}
+	fq, err := f.Qid()
+	if err != nil {
+		return fmt.Errorf("created file: qid: %v", err)
+	}
+	if fq.Type&protocol.QTDIR != 0 {
+		return errors.New("created file: qid has QTDIR set")
+	}
+	st, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("created file: stat: %v", err)
+	}
+	if st.Name != "file" || st.Mode&protocol.DMDIR != 0 || st.Qid != fq {
+		return fmt.Errorf("created file: stat does not match file: %+v", st)
+	}
+
+	sub, err := d.Create(user, "dir", protocol.DMDIR|0777)
+	if err != nil {
+		return fmt.Errorf("create directory: %v", err)
+	}
+	if _, ok := sub.(fileserver.Dir); !ok {
+		return errors.New("created directory does not implement Dir")
+	}
+	if isDir, err := sub.IsDir(); err != nil || !isDir {
+		return fmt.Errorf("created directory: IsDir returned %v, %v", isDir, err)
+	}
+	dq, err := sub.Qid()
+	if err != nil {
+		return fmt.Errorf("created directory: qid: %v", err)
+	}
+	if dq.Type&protocol.QTDIR == 0 {
+		return errors.New("created directory: qid lacks QTDIR")
+	}
+	st, err = sub.Stat()
+	if err != nil {
+		return fmt.Errorf("created directory: stat: %v", err)
+	}
+	if st.Mode&protocol.DMDIR == 0 {
+		return errors.New("created directory: stat mode lacks DMDIR")
+	}
+	if dq.Path == fq.Path {
+		return errors.New("file and directory share qid path")
+	}
+
+	if _, err := d.Create(user, "file", 0666); err == nil {
+		return errors.New("creating an existing file succeeded")
+	}
+	if _, err := d.Create(user, "dir", protocol.DMDIR|0777); err == nil {
+		return errors.New("creating an existing directory succeeded")
+	}
+	return nil
+}
+
+func checkWalk(d fileserver.Dir, user string) error {
+	f, err := d.Create(user, "file", 0666)
+	if err != nil {
+		return fmt.Errorf("create file: %v", err)
+	}
+	want, err := qidPath(f)
+	if err != nil {
+		return err
+	}
+	w, err := mustWalk(d, user, "file")
+	if err != nil {
+		return err
+	}
+	got, err := qidPath(w)
+	if err != nil {
+		return err
+	}
+	if got != want {
+		return fmt.Errorf("walk returned qid path %d, created file has %d", got, want)
+	}
+	if err := mustNotWalk(d, user, "missing"); err != nil {
+		return err
+	}
+
+	// Qids must be stable across walks and writes.
+	if err := writeFile(w, user, []byte("data")); err != nil {
+		return fmt.Errorf("write: %v", err)
+	}
+	w, err = mustWalk(d, user, "file")
+	if err != nil {
+		return err
+	}
+	if got, err = qidPath(w); err != nil || got != want {
+		return fmt.Errorf("qid path changed after write: %d, %v", got, err)
+	}
+	return nil
+}
+
+// checkPaths checks the path helpers of fileserver against the tree.
+func checkPaths(d fileserver.Dir, user string) error {
+	if err := fileserver.MkdirAll(d, user, "a/b/c", 0777); err != nil {
+		return fmt.Errorf("mkdirall: %v", err)
+	}
+	if err := fileserver.MkdirAll(d, user, "a/b", 0777); err != nil {
+		return fmt.Errorf("mkdirall of existing directory: %v", err)
+	}
+	if err := fileserver.WriteFile(d, user, "a/b/c/file", []byte("first content"), 0666); err != nil {
+		return fmt.Errorf("writefile: %v", err)
+	}
+	if err := fileserver.WriteFile(d, user, "a/b/../b/c/file", []byte("second"), 0666); err != nil {
+		return fmt.Errorf("writefile of existing file: %v", err)
+	}
+	b, err := fileserver.ReadFile(d, user, "/a/b/c/file")
+	if err != nil {
+		return fmt.Errorf("readfile: %v", err)
+	}
+	if string(b) != "second" {
+		return fmt.Errorf("readfile returned %q, expected %q", b, "second")
+	}
+
+	f, err := fileserver.WalkPath(d, user, "a/b/c")
+	if err != nil {
+		return fmt.Errorf("walkpath: %v", err)
+	}
+	if name, err := f.Name(); err != nil || name != "c" {
+		return fmt.Errorf("walkpath returned %q, %v", name, err)
+	}
+	if _, err := fileserver.WalkPath(d, user, "a/missing/c"); err != fileserver.ErrNotExist {
+		return fmt.Errorf("walkpath through missing directory returned %v", err)
+	}
+	if _, err := fileserver.WalkPath(d, user, "a/b/c/file/x"); err != fileserver.ErrNotDir {
+		return fmt.Errorf("walkpath through file returned %v", err)
+	}
+	if err := fileserver.MkdirAll(d, user, "a/b/c/file/x", 0777); err != fileserver.ErrNotDir {
+		return fmt.Errorf("mkdirall through file returned %v", err)
+	}
+	return nil
+}
+
+func checkReadWrite(d fileserver.Dir, user string) error {
+	f, err := d.Create(user, "file", 0666)
+	if err != nil {
+		return fmt.Errorf("create file: %v", err)
+	}
+
+	of, err := f.Open(user, protocol.ORDWR)
+	if err != nil {
+		return fmt.Errorf("open: %v", err)
+	}
+	defer of.Close()
+
+	if _, err := of.Write([]byte("hello, world")); err != nil {
+		return fmt.Errorf("write: %v", err)
+	}
+	if _, err := of.Seek(7, 0); err != nil {
+		return fmt.Errorf("seek: %v", err)
+	}
+	if _, err := of.Write([]byte("there")); err != nil {
+		return fmt.Errorf("write at offset: %v", err)
+	}
+	if _, err := of.Seek(0, 0); err != nil {
+		return fmt.Errorf("seek: %v", err)
+	}
+	b, err := readAll(of)
+	if err != nil {
+		return fmt.Errorf("read: %v", err)
+	}
+	if string(b) != "hello, there" {
+		return fmt.Errorf("read %q, expected %q", b, "hello, there")
+	}
+
+	st, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("stat: %v", err)
+	}
+	if st.Length != uint64(len(b)) {
+		return fmt.Errorf("stat length %d, expected %d", st.Length, len(b))
+	}
+
+	if err := writeFile(f, user, []byte("new")); err != nil {
+		return fmt.Errorf("truncating write: %v", err)
+	}
+	if b, err = readFile(f, user); err != nil || string(b) != "new" {
+		return fmt.Errorf("read after OTRUNC returned %q, %v", b, err)
+	}
+	return nil
+}
+
+func checkDirRead(d fileserver.Dir, user string) error {
+	want := []string{"a", "b", "c", "dir"}
+	qids := make(map[string]uint64)
+	for _, name := range want {
+		perms := protocol.FileMode(0666)
+		if name == "dir" {
+			perms = protocol.DMDIR | 0777
+		}
+		f, err := d.Create(user, name, perms)
+		if err != nil {
+			return fmt.Errorf("create %q: %v", name, err)
+		}
+		if qids[name], err = qidPath(f); err != nil {
+			return err
+		}
+	}
+	if err := d.Remove(user, "b"); err != nil {
+		return fmt.Errorf("remove: %v", err)
+	}
+	want = []string{"a", "c", "dir"}
+
+	sts, err := readDir(d, user)
+	if err != nil {
+		return fmt.Errorf("read directory: %v", err)
+	}
+	var got []string
+	for _, st := range sts {
+		got = append(got, st.Name)
+		if st.Qid.Path != qids[st.Name] {
+			return fmt.Errorf("entry %q has qid path %d, expected %d", st.Name, st.Qid.Path, qids[st.Name])
+		}
+		if (st.Name == "dir") != (st.Mode&protocol.DMDIR != 0) {
+			return fmt.Errorf("entry %q has wrong DMDIR bit", st.Name)
+		}
+	}
+	sort.Strings(got)
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		return fmt.Errorf("directory contains %q, expected %q", got, want)
+	}
+
+	if _, err := d.Open(user, protocol.OWRITE); err == nil {
+		return errors.New("opening a directory for writing succeeded")
+	}
+	return nil
+}
+
+func checkPermissions(d fileserver.Dir, user string) error {
+	f, err := d.Create(user, "private", 0600)
+	if err != nil {
+		return fmt.Errorf("create file: %v", err)
+	}
+	st, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("stat: %v", err)
+	}
+	owner := st.UID
+	if st.Mode&0777 != 0600 {
+		return fmt.Errorf("created with mode 0600, got %o", st.Mode&0777)
+	}
+
+	of, err := f.Open(owner, protocol.ORDWR)
+	if err != nil {
+		return fmt.Errorf("owner open of 0600 file: %v", err)
+	}
+	of.Close()
+	for _, mode := range []protocol.OpenMode{protocol.OREAD, protocol.OWRITE, protocol.ORDWR} {
+		if of, err := f.Open(Other, mode); err == nil {
+			of.Close()
+			return fmt.Errorf("open of 0600 file in mode %d by other user succeeded", mode)
+		}
+	}
+
+	f, err = d.Create(user, "readonly", 0444)
+	if err != nil {
+		return fmt.Errorf("create file: %v", err)
+	}
+	if of, err := f.Open(owner, protocol.OWRITE); err == nil {
+		of.Close()
+		return errors.New("write open of 0444 file succeeded")
+	}
+	of, err = f.Open(Other, protocol.OREAD)
+	if err != nil {
+		return fmt.Errorf("read open of 0444 file by other user: %v", err)
+	}
+	of.Close()
+
+	sub, err := d.Create(user, "closed", protocol.DMDIR|0700)
+	if err != nil {
+		return fmt.Errorf("create directory: %v", err)
+	}
+	if _, err := sub.(fileserver.Dir).Create(Other, "file", 0666); err == nil {
+		return errors.New("create in 0700 directory by other user succeeded")
+	}
+	return nil
+}
+
+func checkRename(d fileserver.Dir, user string) error {
+	a, err := d.Create(user, "a", 0666)
+	if err != nil {
+		return fmt.Errorf("create: %v", err)
+	}
+	b, err := d.Create(user, "b", 0666)
+	if err != nil {
+		return fmt.Errorf("create: %v", err)
+	}
+	aq, _ := qidPath(a)
+	bq, _ := qidPath(b)
+
+	if err := d.Rename(user, "a", "b"); err == nil {
+		return errors.New("rename onto an existing file succeeded")
+	}
+	for name, want := range map[string]uint64{"a": aq, "b": bq} {
+		f, err := mustWalk(d, user, name)
+		if err != nil {
+			return fmt.Errorf("after failed rename: %v", err)
+		}
+		if got, _ := qidPath(f); got != want {
+			return fmt.Errorf("after failed rename: %q has qid path %d, expected %d", name, got, want)
+		}
+	}
+
+	if err := d.Rename(user, "missing", "c"); err == nil {
+		return errors.New("rename of a missing file succeeded")
+	}
+
+	if err := d.Rename(user, "a", "c"); err != nil {
+		return fmt.Errorf("rename: %v", err)
+	}
+	if err := mustNotWalk(d, user, "a"); err != nil {
+		return fmt.Errorf("after rename: %v", err)
+	}
+	c, err := mustWalk(d, user, "c")
+	if err != nil {
+		return fmt.Errorf("after rename: %v", err)
+	}
+	if got, _ := qidPath(c); got != aq {
+		return fmt.Errorf("renamed file has qid path %d, expected %d", got, aq)
+	}
+	return nil
+}
+
+func checkRemove(d fileserver.Dir, user string) error {
+	if _, err := d.Create(user, "file", 0666); err != nil {
+		return fmt.Errorf("create: %v", err)
+	}
+	sub, err := d.Create(user, "dir", protocol.DMDIR|0777)
+	if err != nil {
+		return fmt.Errorf("create: %v", err)
+	}
+	if _, err := sub.(fileserver.Dir).Create(user, "file", 0666); err != nil {
+		return fmt.Errorf("create: %v", err)
+	}
+
+	if err := d.Remove(user, "dir"); err == nil {
+		return errors.New("removing a non-empty directory succeeded")
+	}
+	if _, err := mustWalk(d, user, "dir"); err != nil {
+		return fmt.Errorf("after failed remove: %v", err)
+	}
+	if err := d.Remove(user, "missing"); err == nil {
+		return errors.New("removing a missing file succeeded")
+	}
+	if err := d.Remove(user, "file"); err != nil {
+		return fmt.Errorf("remove: %v", err)
+	}
+	if err := mustNotWalk(d, user, "file"); err != nil {
+		return fmt.Errorf("after remove: %v", err)
+	}
+	return nil
+}
+
+func checkConcurrent(d fileserver.Dir, user string) error {
+	f, err := d.Create(user, "file", 0666)
+	if err != nil {
+		return fmt.Errorf("create: %v", err)
+	}
+	content := []byte("concurrent")
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*Concurrency)
+	for i := 0; i < Concurrency; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			of, err := f.Open(user, protocol.OWRITE)
+			if err != nil {
+				errs <- fmt.Errorf("open for writing: %v", err)
+				return
+			}
+			defer of.Close()
+			if _, err := of.Write(content); err != nil {
+				errs <- fmt.Errorf("write: %v", err)
+			}
+		}()
+		go func(i int) {
+			defer wg.Done()
+			name := fmt.Sprintf("file%d", i)
+			if _, err := d.Create(user, name, 0666); err != nil {
+				errs <- fmt.Errorf("create %q: %v", name, err)
+				return
+			}
+			if _, err := readDir(d, user); err != nil {
+				errs <- fmt.Errorf("read directory: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		return err
+	}
+
+	b, err := readFile(f, user)
+	if err != nil {
+		return fmt.Errorf("read: %v", err)
+	}
+	if !bytes.Equal(b, content) {
+		return fmt.Errorf("read %q after concurrent writes, expected %q", b, content)
+	}
+	sts, err := readDir(d, user)
+	if err != nil {
+		return fmt.Errorf("read directory: %v", err)
+	}
+	if len(sts) != Concurrency+1 {
+		return fmt.Errorf("directory has %d entries after concurrent creates, expected %d", len(sts), Concurrency+1)
+	}
+	return nil
+}
+
+// checkOpenRemove checks that removing or truncating a file leaves those
+// that have it open in a sane state. Like on Plan 9, removal only unlinks the
+// file, so open files keep working, while readers of a truncated file see the
+// end of the file.
+func checkOpenRemove(d fileserver.Dir, user string) error {
+	f, err := d.Create(user, "file", 0666)
+	if err != nil {
+		return fmt.Errorf("create: %v", err)
+	}
+	content := bytes.Repeat([]byte("content"), 1024)
+	if err := writeFile(f, user, content); err != nil {
+		return fmt.Errorf("write: %v", err)
+	}
+
+	// Read concurrently with the remove.
+	var wg sync.WaitGroup
+	errs := make(chan error, Concurrency)
+	for i := 0; i < Concurrency; i++ {
+		of, err := f.Open(user, protocol.OREAD)
+		if err != nil {
+			return fmt.Errorf("open: %v", err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer of.Close()
+			b, err := readAll(of)
+			if err != nil {
+				errs <- fmt.Errorf("read during remove: %v", err)
+				return
+			}
+			if !bytes.Equal(b, content) {
+				errs <- fmt.Errorf("read %d bytes during remove, expected %d", len(b), len(content))
+			}
+		}()
+	}
+	of, err := f.Open(user, protocol.ORDWR)
+	if err != nil {
+		return fmt.Errorf("open: %v", err)
+	}
+	defer of.Close()
+	if err := d.Remove(user, "file"); err != nil {
+		return fmt.Errorf("remove: %v", err)
+	}
+	wg.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		return err
+	}
+
+	if err := mustNotWalk(d, user, "file"); err != nil {
+		return fmt.Errorf("after remove: %v", err)
+	}
+	if _, err := of.Seek(0, 0); err != nil {
+		return fmt.Errorf("seek in removed file: %v", err)
+	}
+	if _, err := of.Write([]byte("orphan")); err != nil {
+		return fmt.Errorf("write to removed file: %v", err)
+	}
+	b, err := readAll(of)
+	if err != nil {
+		return fmt.Errorf("read of removed file: %v", err)
+	}
+	if !bytes.HasPrefix(b, []byte("orphan")) || len(b) != len(content) {
+		return errors.New("removed file does not hold the data written to it")
+	}
+
+	// Truncating a file being read makes the reader hit the end.
+	g, err := d.Create(user, "other", 0666)
+	if err != nil {
+		return fmt.Errorf("create: %v", err)
+	}
+	if err := writeFile(g, user, content); err != nil {
+		return fmt.Errorf("write: %v", err)
+	}
+	rf, err := g.Open(user, protocol.OREAD)
+	if err != nil {
+		return fmt.Errorf("open: %v", err)
+	}
+	defer rf.Close()
+	buf := make([]byte, len(content)/2)
+	if _, err := rf.Read(buf); err != nil {
+		return fmt.Errorf("read: %v", err)
+	}
+	tf, err := g.Open(user, protocol.OWRITE|protocol.OTRUNC)
+	if err != nil {
+		return fmt.Errorf("open for truncation: %v", err)
+	}
+	tf.Close()
+	n, err := rf.Read(buf)
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("read after truncation: %v", err)
+	}
+	if n != 0 {
+		return fmt.Errorf("read %d bytes after truncation, expected none", n)
+	}
+	return nil
+}
+
+// conn is a 9P client connected to a fileserver serving a single directory.
+type conn struct {
+	c    *g9p.Client
+	rw   io.Closer
+	root protocol.Fid
+}
+
+func dial(d fileserver.Dir, user string) (*conn, error) {
+	fs := fileserver.NewFileServer(d, nil, 64*1024, fileserver.Quiet)
+	rw := fileserver.Pipe(fs)
+	c := g9p.NewClient(rw)
+	go c.Start()
+
+	cc := &conn{c: c, rw: rw, root: 0}
+	if _, err := c.Version(&protocol.VersionRequest{Tag: protocol.NOTAG, MaxSize: 64 * 1024, Version: "9P2000"}); err != nil {
+		cc.Close()
+		return nil, fmt.Errorf("version: %v", err)
+	}
+	if _, err := c.Attach(&protocol.AttachRequest{Tag: c.NextTag(), Fid: cc.root, AuthFid: protocol.NOFID, Username: user}); err != nil {
+		cc.Close()
+		return nil, fmt.Errorf("attach: %v", err)
+	}
+	return cc, nil
+}
+
+func (cc *conn) Close() {
+	cc.c.Stop()
+	cc.rw.Close()
+}
+
+func (cc *conn) walk(fid, newfid protocol.Fid, names ...string) (*protocol.WalkResponse, error) {
+	return cc.c.Walk(&protocol.WalkRequest{Tag: cc.c.NextTag(), Fid: fid, NewFid: newfid, Names: names})
+}
+
+func (cc *conn) clunk(fid protocol.Fid) error {
+	_, err := cc.c.Clunk(&protocol.ClunkRequest{Tag: cc.c.NextTag(), Fid: fid})
+	return err
+}
+
+func (cc *conn) stat(fid protocol.Fid) (protocol.Stat, error) {
+	resp, err := cc.c.Stat(&protocol.StatRequest{Tag: cc.c.NextTag(), Fid: fid})
+	if err != nil {
+		return protocol.Stat{}, err
+	}
+	return resp.Stat, nil
+}
+
+func checkProtoWalk(d fileserver.Dir, user string) error {
+	sub, err := d.Create(user, "dir", protocol.DMDIR|0777)
+	if err != nil {
+		return fmt.Errorf("create: %v", err)
+	}
+	if _, err := sub.(fileserver.Dir).Create(user, "file", 0666); err != nil {
+		return fmt.Errorf("create: %v", err)
+	}
+
+	cc, err := dial(d, user)
+	if err != nil {
+		return err
+	}
+	defer cc.Close()
+
+	// A walk of zero names clones the fid.
+	if resp, err := cc.walk(cc.root, 1); err != nil || len(resp.Qids) != 0 {
+		return fmt.Errorf("clone walk: %v", err)
+	}
+	if _, err := cc.walk(cc.root, 1); err == nil {
+		return errors.New("walk to a fid in use succeeded")
+	}
+
+	resp, err := cc.walk(1, 2, "dir", "file")
+	if err != nil {
+		return fmt.Errorf("walk: %v", err)
+	}
+	if len(resp.Qids) != 2 || resp.Qids[0].Type&protocol.QTDIR == 0 || resp.Qids[1].Type&protocol.QTDIR != 0 {
+		return fmt.Errorf("walk returned qids %+v", resp.Qids)
+	}
+
+	// A walk failing on the first name is an error, while a walk failing
+	// later returns the qids walked, and leaves newfid unused.
+	if _, err := cc.walk(1, 3, "missing"); err == nil {
+		return errors.New("walk to a missing file succeeded")
+	}
+	resp, err = cc.walk(1, 3, "dir", "missing")
+	if err != nil {
+		return fmt.Errorf("partial walk: %v", err)
+	}
+	if len(resp.Qids) != 1 {
+		return fmt.Errorf("partial walk returned %d qids, expected 1", len(resp.Qids))
+	}
+	if err := cc.clunk(3); err == nil {
+		return errors.New("partial walk allocated newfid")
+	}
+
+	// Walks are limited to MaxWalkElements names.
+	long := make([]string, fileserver.MaxWalkElements+1)
+	for i := range long {
+		long[i] = "."
+	}
+	if _, err := cc.walk(1, 3, long...); err == nil {
+		return errors.New("walk of too many names succeeded")
+	}
+
+	// ".." at the root is the root, and a walk may replace its own fid.
+	rq, err := cc.walk(cc.root, 3, "..")
+	if err != nil {
+		return fmt.Errorf("walk to ..: %v", err)
+	}
+	dq, err := cc.walk(3, 3, "dir", "..")
+	if err != nil {
+		return fmt.Errorf("walk to own fid: %v", err)
+	}
+	if len(rq.Qids) != 1 || len(dq.Qids) != 2 || rq.Qids[0].Path != dq.Qids[1].Path {
+		return fmt.Errorf("walk to .. returned qids %+v and %+v", rq.Qids, dq.Qids)
+	}
+	if err := cc.clunk(3); err != nil {
+		return fmt.Errorf("clunk: %v", err)
+	}
+
+	// Walking within a file, or from an open fid, is an error.
+	if _, err := cc.walk(2, 3, "x"); err == nil {
+		return errors.New("walk in a file succeeded")
+	}
+	if _, err := cc.c.Open(&protocol.OpenRequest{Tag: cc.c.NextTag(), Fid: 1, Mode: protocol.OREAD}); err != nil {
+		return fmt.Errorf("open: %v", err)
+	}
+	if _, err := cc.walk(1, 3); err == nil {
+		return errors.New("walk from an open fid succeeded")
+	}
+
+	// Clunked fids are gone.
+	if err := cc.clunk(1); err != nil {
+		return fmt.Errorf("clunk: %v", err)
+	}
+	if err := cc.clunk(1); err == nil {
+		return errors.New("clunk of a clunked fid succeeded")
+	}
+	if _, err := cc.stat(1); err == nil {
+		return errors.New("stat of a clunked fid succeeded")
+	}
+	return cc.clunk(2)
+}
+
+// checkProtoNotDir checks that walking through a file fails with
+// fileserver.ErrNotDir. Plan 9 clients show the error as is, while the Linux
+// client maps the message to ENOTDIR.
+func checkProtoNotDir(d fileserver.Dir, user string) error {
+	sub, err := d.Create(user, "dir", protocol.DMDIR|0777)
+	if err != nil {
+		return fmt.Errorf("create: %v", err)
+	}
+	if _, err := sub.(fileserver.Dir).Create(user, "file", 0666); err != nil {
+		return fmt.Errorf("create: %v", err)
+	}
+
+	cc, err := dial(d, user)
+	if err != nil {
+		return err
+	}
+	defer cc.Close()
+
+	notDir := func(what string, err error) error {
+		if err == nil {
+			return fmt.Errorf("%s succeeded", what)
+		}
+		if err.Error() != fileserver.ErrNotDir.Error() {
+			return fmt.Errorf("%s returned %q, expected %q", what, err, fileserver.ErrNotDir)
+		}
+		return nil
+	}
+
+	// Walking from a file fid fails on the first name, and is thus an
+	// error, as is creating in it.
+	if _, err := cc.walk(cc.root, 1, "dir", "file"); err != nil {
+		return fmt.Errorf("walk: %v", err)
+	}
+	_, err = cc.walk(1, 2, "extra")
+	if err := notDir("walk from a file", err); err != nil {
+		return err
+	}
+	_, err = cc.c.Create(&protocol.CreateRequest{Tag: cc.c.NextTag(), Fid: 1, Name: "extra", Permissions: 0666, Mode: protocol.OREAD})
+	if err := notDir("create in a file", err); err != nil {
+		return err
+	}
+	if err := cc.clunk(1); err != nil {
+		return fmt.Errorf("clunk: %v", err)
+	}
+
+	// Walking through a file stops at the file, like any other partial
+	// walk, which the Linux client reports as ENOTDIR.
+	resp, err := cc.walk(cc.root, 1, "dir", "file", "extra")
+	if err != nil {
+		return fmt.Errorf("walk through a file: %v", err)
+	}
+	if len(resp.Qids) != 2 || resp.Qids[1].Type&protocol.QTDIR != 0 {
+		return fmt.Errorf("walk through a file returned qids %+v", resp.Qids)
+	}
+	if err := cc.clunk(1); err == nil {
+		return errors.New("walk through a file allocated newfid")
+	}
+	return nil
+}
+
+func checkProtoWriteStat(d fileserver.Dir, user string) error {
+	f, err := d.Create(user, "file", 0640)
+	if err != nil {
+		return fmt.Errorf("create: %v", err)
+	}
+	if err := writeFile(f, user, []byte("content")); err != nil {
+		return fmt.Errorf("write: %v", err)
+	}
+
+	cc, err := dial(d, user)
+	if err != nil {
+		return err
+	}
+	defer cc.Close()
+
+	if _, err := cc.walk(cc.root, 1, "file"); err != nil {
+		return fmt.Errorf("walk: %v", err)
+	}
+	before, err := cc.stat(1)
+	if err != nil {
+		return fmt.Errorf("stat: %v", err)
+	}
+
+	// A stat with every field set to "don't touch" asks for a sync, and must
+	// change nothing but the version.
+	nochange := protocol.Stat{
+		Type:   ^uint16(0),
+		Dev:    ^uint32(0),
+		Qid:    protocol.Qid{Type: ^protocol.QidType(0), Version: ^uint32(0), Path: ^uint64(0)},
+		Mode:   ^protocol.FileMode(0),
+		Atime:  ^uint32(0),
+		Mtime:  ^uint32(0),
+		Length: ^uint64(0),
+	}
+	if _, err := cc.c.WriteStat(&protocol.WriteStatRequest{Tag: cc.c.NextTag(), Fid: 1, Stat: nochange}); err != nil {
+		return fmt.Errorf("wstat: %v", err)
+	}
+	after, err := cc.stat(1)
+	if err != nil {
+		return fmt.Errorf("stat: %v", err)
+	}
+	before.Qid.Version, after.Qid.Version = 0, 0
+	before.Atime, after.Atime = 0, 0
+	if before != after {
+		return fmt.Errorf("no-op wstat changed stat from %+v to %+v", before, after)
+	}
+
+	// Changing a single field leaves the others alone.
+	mode := nochange
+	mode.Mode = 0600
+	if _, err := cc.c.WriteStat(&protocol.WriteStatRequest{Tag: cc.c.NextTag(), Fid: 1, Stat: mode}); err != nil {
+		return fmt.Errorf("wstat mode: %v", err)
+	}
+	after, err = cc.stat(1)
+	if err != nil {
+		return fmt.Errorf("stat: %v", err)
+	}
+	if after.Mode != 0600 || after.Name != before.Name || after.Length != before.Length || after.UID != before.UID {
+		return fmt.Errorf("wstat of mode resulted in %+v", after)
+	}
+
+	// Renaming onto an existing name fails and leaves the file alone.
+	if _, err := d.Create(user, "other", 0666); err != nil {
+		return fmt.Errorf("create: %v", err)
+	}
+	rename := nochange
+	rename.Name = "other"
+	if _, err := cc.c.WriteStat(&protocol.WriteStatRequest{Tag: cc.c.NextTag(), Fid: 1, Stat: rename}); err == nil {
+		return errors.New("wstat rename onto an existing file succeeded")
+	}
+	if after, err = cc.stat(1); err != nil || after.Name != "file" {
+		return fmt.Errorf("after failed rename, stat returned %q, %v", after.Name, err)
+	}
+	return cc.clunk(1)
+}
+
+// checkProtoFids checks the fid state after failing requests: Tremove clunks
+// the fid even if the remove fails, while a failed Topen or Tcreate leaves
+// the fid as it was.
+func checkProtoFids(d fileserver.Dir, user string) error {
+	if _, err := d.Create(user, "file", 0400); err != nil {
+		return fmt.Errorf("create: %v", err)
+	}
+	sub, err := d.Create(user, "dir", protocol.DMDIR|0777)
+	if err != nil {
+		return fmt.Errorf("create: %v", err)
+	}
+	if _, err := sub.(fileserver.Dir).Create(user, "file", 0666); err != nil {
+		return fmt.Errorf("create: %v", err)
+	}
+
+	cc, err := dial(d, user)
+	if err != nil {
+		return err
+	}
+	defer cc.Close()
+
+	// Removing the root, or a non-empty directory, fails, but clunks the
+	// fid.
+	if _, err := cc.walk(cc.root, 1); err != nil {
+		return fmt.Errorf("walk: %v", err)
+	}
+	if _, err := cc.c.Remove(&protocol.RemoveRequest{Tag: cc.c.NextTag(), Fid: 1}); err == nil {
+		return errors.New("remove of root succeeded")
+	}
+	if _, err := cc.stat(1); err == nil {
+		return errors.New("failed remove of root left fid alive")
+	}
+	if _, err := cc.walk(cc.root, 1, "dir"); err != nil {
+		return fmt.Errorf("walk: %v", err)
+	}
+	if _, err := cc.c.Remove(&protocol.RemoveRequest{Tag: cc.c.NextTag(), Fid: 1}); err == nil {
+		return errors.New("remove of non-empty directory succeeded")
+	}
+	if _, err := cc.stat(1); err == nil {
+		return errors.New("failed remove left fid alive")
+	}
+	if _, err := mustWalk(d, user, "dir"); err != nil {
+		return err
+	}
+
+	// A failed open leaves the fid unopened.
+	if _, err := cc.walk(cc.root, 1, "file"); err != nil {
+		return fmt.Errorf("walk: %v", err)
+	}
+	if _, err := cc.c.Open(&protocol.OpenRequest{Tag: cc.c.NextTag(), Fid: 1, Mode: protocol.OWRITE}); err == nil {
+		return errors.New("open for write of read-only file succeeded")
+	}
+	if _, err := cc.c.Open(&protocol.OpenRequest{Tag: cc.c.NextTag(), Fid: 1, Mode: protocol.OREAD}); err != nil {
+		return fmt.Errorf("open after failed open: %v", err)
+	}
+	if err := cc.clunk(1); err != nil {
+		return fmt.Errorf("clunk: %v", err)
+	}
+
+	// A failed create leaves the fid at the directory, unopened.
+	if _, err := cc.walk(cc.root, 1, "dir"); err != nil {
+		return fmt.Errorf("walk: %v", err)
+	}
+	if _, err := cc.c.Create(&protocol.CreateRequest{Tag: cc.c.NextTag(), Fid: 1, Name: "file", Permissions: 0666, Mode: protocol.OREAD}); err == nil {
+		return errors.New("create of existing file succeeded")
+	}
+	if _, err := cc.walk(1, 2, "file"); err != nil {
+		return fmt.Errorf("walk after failed create: %v", err)
+	}
+	if err := cc.clunk(2); err != nil {
+		return fmt.Errorf("clunk: %v", err)
+	}
+
+	// A successful remove clunks the fid as well.
+	if _, err := cc.walk(1, 2, "file"); err != nil {
+		return fmt.Errorf("walk: %v", err)
+	}
+	if _, err := cc.c.Remove(&protocol.RemoveRequest{Tag: cc.c.NextTag(), Fid: 2}); err != nil {
+		return fmt.Errorf("remove: %v", err)
+	}
+	if err := cc.clunk(2); err == nil {
+		return errors.New("clunk of removed fid succeeded")
+	}
+	if err := mustNotWalk(sub.(fileserver.Dir), user, "file"); err != nil {
+		return err
+	}
+	return cc.clunk(1)
+}
+
+// checkProtoCreate checks that Tcreate leaves the fid open on the new file
+// with the requested mode, even if the permissions of the file would not
+// allow it.
+func checkProtoCreate(d fileserver.Dir, user string) error {
+	cc, err := dial(d, user)
+	if err != nil {
+		return err
+	}
+	defer cc.Close()
+
+	if _, err := cc.walk(cc.root, 1); err != nil {
+		return fmt.Errorf("walk: %v", err)
+	}
+	resp, err := cc.c.Create(&protocol.CreateRequest{Tag: cc.c.NextTag(), Fid: 1, Name: "file", Permissions: 0444, Mode: protocol.ORDWR})
+	if err != nil {
+		return fmt.Errorf("create: %v", err)
+	}
+	if resp.Qid.Type&protocol.QTDIR != 0 {
+		return errors.New("created file has QTDIR set")
+	}
+	if _, err := cc.c.Write(&protocol.WriteRequest{Tag: cc.c.NextTag(), Fid: 1, Offset: 0, Data: []byte("content")}); err != nil {
+		return fmt.Errorf("write to created read-only file: %v", err)
+	}
+	rresp, err := cc.c.Read(&protocol.ReadRequest{Tag: cc.c.NextTag(), Fid: 1, Offset: 0, Count: 64})
+	if err != nil {
+		return fmt.Errorf("read: %v", err)
+	}
+	if string(rresp.Data) != "content" {
+		return fmt.Errorf("read %q from created file, expected %q", rresp.Data, "content")
+	}
+	if _, err := cc.c.Open(&protocol.OpenRequest{Tag: cc.c.NextTag(), Fid: 1, Mode: protocol.OREAD}); err == nil {
+		return errors.New("open of fid left open by create succeeded")
+	}
+	st, err := cc.stat(1)
+	if err != nil {
+		return fmt.Errorf("stat: %v", err)
+	}
+	if st.Name != "file" || st.Qid.Path != resp.Qid.Path {
+		return fmt.Errorf("fid does not refer to created file: %+v", st)
+	}
+	if err := cc.clunk(1); err != nil {
+		return fmt.Errorf("clunk: %v", err)
+	}
+
+	// The file keeps its permissions for later opens.
+	if _, err := cc.walk(cc.root, 1, "file"); err != nil {
+		return fmt.Errorf("walk: %v", err)
+	}
+	if _, err := cc.c.Open(&protocol.OpenRequest{Tag: cc.c.NextTag(), Fid: 1, Mode: protocol.OWRITE}); err == nil {
+		return errors.New("open for write of read-only file succeeded")
+	}
+	if err := cc.clunk(1); err != nil {
+		return fmt.Errorf("clunk: %v", err)
+	}
+
+	// Directories are created open for reading.
+	if _, err := cc.walk(cc.root, 1); err != nil {
+		return fmt.Errorf("walk: %v", err)
+	}
+	if _, err := cc.c.Create(&protocol.CreateRequest{Tag: cc.c.NextTag(), Fid: 1, Name: "dir", Permissions: protocol.DMDIR | 0777, Mode: protocol.OREAD}); err != nil {
+		return fmt.Errorf("create directory: %v", err)
+	}
+	rresp, err = cc.c.Read(&protocol.ReadRequest{Tag: cc.c.NextTag(), Fid: 1, Offset: 0, Count: 64})
+	if err != nil {
+		return fmt.Errorf("read of created directory: %v", err)
+	}
+	if len(rresp.Data) != 0 {
+		return fmt.Errorf("created directory has %d bytes of entries", len(rresp.Data))
+	}
+	return cc.clunk(1)
+}
+
+// checkProtoVersion checks version negotiation with the extended versions
+// offered by the Linux v9fs client, as used by virtual machine guests.
+func checkProtoVersion(d fileserver.Dir, user string) error {
+	fs := fileserver.NewFileServer(d, nil, 64*1024, fileserver.Quiet)
+	rw := fileserver.Pipe(fs)
+	c := g9p.NewClient(rw)
+	go c.Start()
+	defer func() {
+		c.Stop()
+		rw.Close()
+	}()
+
+	for version, want := range map[string]string{
+		"9P2000":   "9P2000",
+		"9P2000.L": "9P2000",
+		"9P2000.u": "9P2000",
+		"9P1":      "unknown",
+	} {
+		resp, err := c.Version(&protocol.VersionRequest{Tag: protocol.NOTAG, MaxSize: 64 * 1024, Version: version})
+		if err != nil {
+			return fmt.Errorf("version %s: %v", version, err)
+		}
+		if resp.Version != want {
+			return fmt.Errorf("version %s negotiated %q, expected %q", version, resp.Version, want)
+		}
+	}
+	return nil
+}
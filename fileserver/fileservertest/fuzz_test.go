@@ -0,0 +1,277 @@
+package fileservertest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+	"github.com/kennylevinsen/g9ptools/ramfs/ramtree"
+)
+
+// 9P message types, as found on the wire.
+const (
+	tversion = 100
+	tauth    = 102
+	tattach  = 104
+	rerror   = 107
+	tflush   = 108
+	twalk    = 110
+	topen    = 112
+	tcreate  = 114
+	tread    = 116
+	twrite   = 118
+	tclunk   = 120
+	tremove  = 122
+	tstat    = 124
+	twstat   = 126
+)
+
+const (
+	// fuzzDeadline bounds a single run, as a server waiting for the rest of
+	// a message never reads the remaining input.
+	fuzzDeadline = time.Second
+
+	// fuzzTimeout is how long to wait for further responses once all input
+	// has been written.
+	fuzzTimeout = 100 * time.Millisecond
+)
+
+// prelude negotiates a version and attaches fid 0, so that fuzzed messages
+// reach past session setup.
+var prelude = func() []byte {
+	buf := new(bytes.Buffer)
+	msg(buf, tversion, protocol.NOTAG, u32(8192), str("9P2000"))
+	msg(buf, tattach, 0, u32(0), u32(uint32(protocol.NOFID)), str("fuzz"), str(""))
+	return buf.Bytes()
+}()
+
+func u32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, v)
+	return b
+}
+
+func str(s string) []byte {
+	b := make([]byte, 2, 2+len(s))
+	binary.LittleEndian.PutUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+func msg(w io.Writer, typ byte, tag protocol.Tag, fields ...[]byte) {
+	size := 4 + 1 + 2
+	for _, f := range fields {
+		size += len(f)
+	}
+	hdr := make([]byte, 7)
+	binary.LittleEndian.PutUint32(hdr, uint32(size))
+	hdr[4] = typ
+	binary.LittleEndian.PutUint16(hdr[5:], uint16(tag))
+	w.Write(hdr)
+	for _, f := range fields {
+		w.Write(f)
+	}
+}
+
+// request is what FuzzFileServer knows about a message it sent.
+type request struct {
+	typ byte
+	fid uint32
+	// ambiguous is set if the tag was reused while in flight, in which case
+	// responses cannot be attributed.
+	ambiguous bool
+}
+
+// fuzzState tracks the requests in the input, as far as they can be framed.
+type fuzzState struct {
+	pending map[uint16]*request
+	// fids holds every fid that a request could have made valid.
+	fids map[uint32]bool
+}
+
+func (st *fuzzState) scan(b []byte) {
+	for len(b) >= 7 {
+		size := binary.LittleEndian.Uint32(b)
+		if size < 7 || uint64(size) > uint64(len(b)) {
+			return
+		}
+		m := b[:size]
+		b = b[size:]
+
+		typ, tag := m[4], binary.LittleEndian.Uint16(m[5:])
+		r := &request{typ: typ, fid: uint32(protocol.NOFID)}
+		if len(m) >= 11 {
+			r.fid = binary.LittleEndian.Uint32(m[7:])
+		}
+		switch typ {
+		case tauth, tattach:
+			st.fids[r.fid] = true
+			r.fid = uint32(protocol.NOFID)
+		case twalk:
+			if len(m) >= 15 {
+				st.fids[binary.LittleEndian.Uint32(m[11:])] = true
+			}
+		case tversion, tflush:
+			r.fid = uint32(protocol.NOFID)
+		}
+		if old, ok := st.pending[tag]; ok {
+			old.ambiguous = true
+			continue
+		}
+		st.pending[tag] = r
+	}
+}
+
+// check verifies a single response against the request it answers.
+func (st *fuzzState) check(m []byte) error {
+	typ, tag := m[4], binary.LittleEndian.Uint16(m[5:])
+	if typ%2 != 1 || typ < tversion+1 || typ > twstat+1 {
+		return fmt.Errorf("response has invalid type %d", typ)
+	}
+	if typ == rerror {
+		if len(m) < 9 || int(binary.LittleEndian.Uint16(m[7:])) != len(m)-9 {
+			return errors.New("malformed Rerror")
+		}
+	}
+
+	r, ok := st.pending[tag]
+	if !ok {
+		return fmt.Errorf("response to unknown tag %d", tag)
+	}
+	if r.ambiguous {
+		return nil
+	}
+	delete(st.pending, tag)
+	if typ == rerror {
+		return nil
+	}
+	if typ != r.typ+1 {
+		return fmt.Errorf("response type %d to request type %d", typ, r.typ)
+	}
+	if r.fid != uint32(protocol.NOFID) && !st.fids[r.fid] {
+		return fmt.Errorf("successful response type %d for fid %d that was never valid", typ, r.fid)
+	}
+	return nil
+}
+
+// seeds are the inputs the corpus starts from, each a stream of messages
+// following the prelude.
+func seeds() [][]byte {
+	var seeds [][]byte
+	add := func(fn func(w io.Writer)) {
+		buf := new(bytes.Buffer)
+		fn(buf)
+		seeds = append(seeds, buf.Bytes())
+	}
+	wname := func(names ...string) []byte {
+		b := []byte{byte(len(names)), 0}
+		for _, n := range names {
+			b = append(b, str(n)...)
+		}
+		return b
+	}
+	u64 := func(v uint64) []byte {
+		return append(u32(uint32(v)), u32(uint32(v>>32))...)
+	}
+
+	// A well-behaved session reading and writing the file.
+	add(func(w io.Writer) {
+		msg(w, twalk, 1, u32(0), u32(1), wname("file"))
+		msg(w, topen, 2, u32(1), []byte{2})
+		msg(w, tread, 3, u32(1), u64(0), u32(64))
+		msg(w, twrite, 4, u32(1), u64(7), u32(4), []byte("more"))
+		msg(w, tstat, 5, u32(1))
+		msg(w, tclunk, 6, u32(1))
+	})
+	// Requests on fids that were never valid.
+	add(func(w io.Writer) {
+		msg(w, tclunk, 1, u32(7))
+		msg(w, tread, 2, u32(7), u64(0), u32(64))
+		msg(w, tremove, 3, u32(7))
+	})
+	// A tag reused while in flight, and a flush of it.
+	add(func(w io.Writer) {
+		msg(w, twalk, 1, u32(0), u32(1), wname("dir", "..", "file"))
+		msg(w, twalk, 1, u32(0), u32(2), wname("dir"))
+		msg(w, tflush, 2, []byte{1, 0})
+	})
+	// A wstat with a truncated stat.
+	add(func(w io.Writer) {
+		msg(w, twstat, 1, u32(0), []byte{20, 0, 18, 0, 0, 0})
+	})
+	// A message claiming to be larger than the negotiated size.
+	add(func(w io.Writer) {
+		w.Write(u32(1 << 20))
+		w.Write([]byte{tread, 1, 0})
+	})
+	return seeds
+}
+
+// FuzzFileServer writes data, a stream of 9P messages, as-is to a
+// fileserver serving a small RAM tree over an in-memory connection, after a
+// valid version and attach. Malformed input must not cause panics, and every
+// response must be a well-formed reply to a request that was sent, with
+// errors returned for fids that were never made valid.
+func FuzzFileServer(f *testing.F) {
+	for _, seed := range seeds() {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		root := ramtree.NewRAMTree("/", 0777, "fuzz", "fuzz")
+		file, _ := root.Create("fuzz", "file", 0666)
+		file.(*ramtree.RAMFile).SetContent([]byte("content"))
+		root.Create("fuzz", "dir", protocol.DMDIR|0777)
+
+		fs := fileserver.NewFileServer(root, nil, 8192, fileserver.Quiet)
+		conn := fileserver.Pipe(fs)
+		defer conn.Close()
+
+		input := append(append([]byte(nil), prelude...), data...)
+		st := &fuzzState{
+			pending: make(map[uint16]*request),
+			fids:    make(map[uint32]bool),
+		}
+		st.scan(input)
+
+		conn.SetDeadline(time.Now().Add(fuzzDeadline))
+		done := make(chan struct{})
+		go func() {
+			conn.Write(input)
+			close(done)
+		}()
+
+		hdr := make([]byte, 4)
+		for {
+			select {
+			case <-done:
+				conn.SetReadDeadline(time.Now().Add(fuzzTimeout))
+			default:
+			}
+			if _, err := io.ReadFull(conn, hdr); err != nil {
+				// The server closed the connection, or stopped responding.
+				break
+			}
+			size := binary.LittleEndian.Uint32(hdr)
+			if size < 7 || size > 8192 {
+				t.Fatalf("response has invalid size %d", size)
+			}
+			m := make([]byte, size)
+			copy(m, hdr)
+			if _, err := io.ReadFull(conn, m[4:]); err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					break
+				}
+				t.Fatalf("truncated response: %v", err)
+			}
+			if err := st.check(m); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+}
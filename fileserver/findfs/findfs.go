@@ -0,0 +1,292 @@
+// Package findfs lets clients search a tree on the server, rather than walk
+// it over the wire, which on a link with high latency takes a round trip per
+// directory.
+//
+// By convention, a directory supporting it answers a walk to .find with a
+// directory holding two files. A query written to query is remembered for
+// the writing user, and reading results lists the paths of the files below
+// the directory matching the last query of the reading user, relative to
+// it, one per line. query may also be opened for reading and writing, in
+// which case reading it after writing lists the matches of what was written.
+// The .find directory is not listed.
+//
+// A query is either "glob pattern", matching the names of files as
+// path.Match, or "regex expression", matching their paths. A query without
+// either prefix is a glob pattern.
+//
+// Searches walk the directory with the permissions of the user, unless the
+// directory implements Searcher, which lets backends use faster means.
+package findfs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+	"github.com/kennylevinsen/g9ptools/fileserver/iofs"
+	"github.com/kennylevinsen/g9ptools/fileserver/templatefs"
+)
+
+// DirName is the name of the search directory.
+const DirName = ".find"
+
+var (
+	ErrNoQuery      = errors.New("no query written")
+	errInterrupted  = errors.New("interrupted")
+	errEmptyPattern = errors.New("empty pattern")
+)
+
+// Query selects files by name or path.
+type Query struct {
+	// Glob matches the names of files, as path.Match.
+	Glob string
+	// Regexp, if set, matches the paths of files instead.
+	Regexp *regexp.Regexp
+}
+
+// ParseQuery parses a query, as written to the query file.
+func ParseQuery(s string) (Query, error) {
+	s = strings.TrimSpace(s)
+	kind, pattern := "glob", s
+	if idx := strings.IndexAny(s, " \t"); idx != -1 {
+		switch s[:idx] {
+		case "glob", "regex":
+			kind, pattern = s[:idx], strings.TrimSpace(s[idx+1:])
+		}
+	}
+	if pattern == "" {
+		return Query{}, errEmptyPattern
+	}
+	if kind == "regex" {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return Query{}, err
+		}
+		return Query{Regexp: re}, nil
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return Query{}, err
+	}
+	return Query{Glob: pattern}, nil
+}
+
+// Match reports whether the file at the slash-separated path p matches.
+func (q Query) Match(p string) bool {
+	if q.Regexp != nil {
+		return q.Regexp.MatchString(p)
+	}
+	ok, _ := path.Match(q.Glob, path.Base(p))
+	return ok
+}
+
+// Searcher is implemented by directories that can search their subtree
+// faster than by walking it, such as with an index.
+type Searcher interface {
+	// Search calls fn with the slash-separated path, relative to the
+	// directory, of every file below it that matches q and that user could
+	// reach by walking, stopping at the first error returned by fn.
+	Search(user string, q Query, fn func(p string) error) error
+}
+
+// Search searches the subtree of d as user, calling fn for every match.
+func Search(d fileserver.Dir, user string, q Query, fn func(p string) error) error {
+	if s, ok := d.(Searcher); ok {
+		return s.Search(user, q, fn)
+	}
+	return fs.WalkDir(iofs.FS(d, user), ".", func(p string, de fs.DirEntry, err error) error {
+		if errors.Is(err, fileserver.ErrPermission) {
+			if de != nil && de.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if p != "." && q.Match(p) {
+			return fn(p)
+		}
+		return nil
+	})
+}
+
+// The last query of every user, which the results file of any directory
+// applies.
+var (
+	queriesLock sync.Mutex
+	queries     = make(map[string]Query)
+)
+
+func lastQuery(user string) (Query, bool) {
+	queriesLock.Lock()
+	defer queriesLock.Unlock()
+	q, ok := queries[user]
+	return q, ok
+}
+
+func setQuery(user string, q Query) {
+	queriesLock.Lock()
+	defer queriesLock.Unlock()
+	queries[user] = q
+}
+
+// Walk returns the search directory of d if name is DirName, and
+// fileserver.ErrNotExist otherwise. Directories supporting search call it
+// when a walk finds no file.
+func Walk(d fileserver.Dir, user, name string) (fileserver.File, error) {
+	if name != DirName {
+		return nil, fileserver.ErrNotExist
+	}
+	return NewDir(d)
+}
+
+// NewDir returns the search directory of d, owned by the owner of d.
+func NewDir(d fileserver.Dir) (fileserver.Dir, error) {
+	st, err := d.Stat()
+	if err != nil {
+		return nil, err
+	}
+	dir := &templatefs.DirBase{}
+	dir.Init(DirName, 0555, st.UID, st.GID)
+
+	q := &queryFile{dir: d}
+	q.Init("query", protocol.DMAPPEND|0666, st.UID, st.GID)
+	r := &resultsFile{dir: d}
+	r.Init("results", protocol.DMAPPEND|0444, st.UID, st.GID)
+	dir.Add(q)
+	dir.Add(r)
+	return dir, nil
+}
+
+type queryFile struct {
+	templatefs.FileBase
+	dir fileserver.Dir
+}
+
+func (f *queryFile) Open(user string, mode protocol.OpenMode) (fileserver.OpenFile, error) {
+	if err := f.CheckOpen(user, mode); err != nil {
+		return nil, err
+	}
+	return &queryOpenFile{dir: f.dir, user: user}, nil
+}
+
+// queryOpenFile remembers what was written to it, and streams its matches
+// when read.
+type queryOpenFile struct {
+	sync.Mutex
+	dir     fileserver.Dir
+	user    string
+	query   *Query
+	results *results
+}
+
+func (of *queryOpenFile) Seek(offset int64, whence int) (int64, error) {
+	return offset, nil
+}
+
+func (of *queryOpenFile) Write(p []byte) (int, error) {
+	q, err := ParseQuery(string(p))
+	if err != nil {
+		return 0, err
+	}
+	setQuery(of.user, q)
+
+	of.Lock()
+	defer of.Unlock()
+	of.query = &q
+	if of.results != nil {
+		of.results.Close()
+		of.results = nil
+	}
+	return len(p), nil
+}
+
+func (of *queryOpenFile) Read(p []byte) (int, error) {
+	of.Lock()
+	if of.results == nil {
+		if of.query == nil {
+			of.Unlock()
+			return 0, ErrNoQuery
+		}
+		of.results = search(of.dir, of.user, *of.query)
+	}
+	r := of.results
+	of.Unlock()
+	return r.Read(p)
+}
+
+func (of *queryOpenFile) Interrupt() {
+	of.Lock()
+	defer of.Unlock()
+	if of.results != nil {
+		of.results.Interrupt()
+	}
+}
+
+func (of *queryOpenFile) Close() error {
+	of.Lock()
+	defer of.Unlock()
+	if of.results != nil {
+		return of.results.Close()
+	}
+	return nil
+}
+
+type resultsFile struct {
+	templatefs.FileBase
+	dir fileserver.Dir
+}
+
+func (f *resultsFile) Open(user string, mode protocol.OpenMode) (fileserver.OpenFile, error) {
+	if err := f.CheckOpen(user, mode); err != nil {
+		return nil, err
+	}
+	q, ok := lastQuery(user)
+	if !ok {
+		return nil, ErrNoQuery
+	}
+	return search(f.dir, user, q), nil
+}
+
+// results streams the matches of a search, one per line. Offsets are
+// ignored, as the matches are produced as they are read.
+type results struct {
+	r *io.PipeReader
+}
+
+func search(d fileserver.Dir, user string, q Query) *results {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(Search(d, user, q, func(p string) error {
+			_, err := io.WriteString(pw, p+"\n")
+			return err
+		}))
+	}()
+	return &results{r: pr}
+}
+
+func (r *results) Seek(offset int64, whence int) (int64, error) {
+	return offset, nil
+}
+
+func (r *results) Read(p []byte) (int, error) {
+	return r.r.Read(p)
+}
+
+func (r *results) Write(p []byte) (int, error) {
+	return 0, fileserver.ErrPermission
+}
+
+func (r *results) Interrupt() {
+	r.r.CloseWithError(errInterrupted)
+}
+
+func (r *results) Close() error {
+	return r.r.Close()
+}
@@ -0,0 +1,248 @@
+package fileserver
+
+import (
+	"context"
+	"errors"
+
+	"github.com/kennylevinsen/g9p"
+	"github.com/kennylevinsen/g9p/protocol"
+)
+
+// Next passes a request on to the rest of a chain of interceptors, and
+// finally to the handler.
+type Next func(ctx context.Context, req protocol.Message) (protocol.Message, error)
+
+// Interceptor handles requests on their way to a g9p.Handler, allowing
+// concerns such as auditing, access checks, rewriting of requests or fault
+// injection to be layered on top of any backend. Handle may inspect or
+// replace the request before calling next, inspect or replace the response
+// after, or answer the request itself without calling next at all. The
+// response must be of the type matching the request, such as a
+// *protocol.WalkResponse for a *protocol.WalkRequest.
+type Interceptor interface {
+	Handle(ctx context.Context, req protocol.Message, next Next) (protocol.Message, error)
+}
+
+// InterceptorFunc is a function implementing Interceptor.
+type InterceptorFunc func(ctx context.Context, req protocol.Message, next Next) (protocol.Message, error)
+
+func (f InterceptorFunc) Handle(ctx context.Context, req protocol.Message, next Next) (protocol.Message, error) {
+	return f(ctx, req, next)
+}
+
+var errBadResponse = errors.New("interceptor returned a response of the wrong type")
+
+// Intercept returns a handler passing each request through chain, in order,
+// before it reaches h. ctx is given to the interceptors with every request,
+// and should describe the connection served by h.
+func Intercept(ctx context.Context, h g9p.Handler, chain ...Interceptor) g9p.Handler {
+	if len(chain) == 0 {
+		return h
+	}
+	next := func(ctx context.Context, req protocol.Message) (protocol.Message, error) {
+		return dispatch(h, req)
+	}
+	for i := len(chain) - 1; i >= 0; i-- {
+		ic, n := chain[i], next
+		next = func(ctx context.Context, req protocol.Message) (protocol.Message, error) {
+			return ic.Handle(ctx, req, n)
+		}
+	}
+	return &intercepted{ctx: ctx, next: next}
+}
+
+// dispatch calls the method of h handling req.
+func dispatch(h g9p.Handler, req protocol.Message) (protocol.Message, error) {
+	switch r := req.(type) {
+	case *protocol.VersionRequest:
+		return h.Version(r)
+	case *protocol.AuthRequest:
+		return h.Auth(r)
+	case *protocol.AttachRequest:
+		return h.Attach(r)
+	case *protocol.FlushRequest:
+		return h.Flush(r)
+	case *protocol.WalkRequest:
+		return h.Walk(r)
+	case *protocol.OpenRequest:
+		return h.Open(r)
+	case *protocol.CreateRequest:
+		return h.Create(r)
+	case *protocol.ReadRequest:
+		return h.Read(r)
+	case *protocol.WriteRequest:
+		return h.Write(r)
+	case *protocol.ClunkRequest:
+		return h.Clunk(r)
+	case *protocol.RemoveRequest:
+		return h.Remove(r)
+	case *protocol.StatRequest:
+		return h.Stat(r)
+	case *protocol.WriteStatRequest:
+		return h.WriteStat(r)
+	default:
+		return nil, errors.New("unknown request type")
+	}
+}
+
+// intercepted is a g9p.Handler running every request through a chain.
+type intercepted struct {
+	ctx  context.Context
+	next Next
+}
+
+func (i *intercepted) Version(r *protocol.VersionRequest) (*protocol.VersionResponse, error) {
+	resp, err := i.next(i.ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	x, ok := resp.(*protocol.VersionResponse)
+	if !ok {
+		return nil, errBadResponse
+	}
+	return x, nil
+}
+
+func (i *intercepted) Auth(r *protocol.AuthRequest) (*protocol.AuthResponse, error) {
+	resp, err := i.next(i.ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	x, ok := resp.(*protocol.AuthResponse)
+	if !ok {
+		return nil, errBadResponse
+	}
+	return x, nil
+}
+
+func (i *intercepted) Attach(r *protocol.AttachRequest) (*protocol.AttachResponse, error) {
+	resp, err := i.next(i.ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	x, ok := resp.(*protocol.AttachResponse)
+	if !ok {
+		return nil, errBadResponse
+	}
+	return x, nil
+}
+
+func (i *intercepted) Flush(r *protocol.FlushRequest) (*protocol.FlushResponse, error) {
+	resp, err := i.next(i.ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	x, ok := resp.(*protocol.FlushResponse)
+	if !ok {
+		return nil, errBadResponse
+	}
+	return x, nil
+}
+
+func (i *intercepted) Walk(r *protocol.WalkRequest) (*protocol.WalkResponse, error) {
+	resp, err := i.next(i.ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	x, ok := resp.(*protocol.WalkResponse)
+	if !ok {
+		return nil, errBadResponse
+	}
+	return x, nil
+}
+
+func (i *intercepted) Open(r *protocol.OpenRequest) (*protocol.OpenResponse, error) {
+	resp, err := i.next(i.ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	x, ok := resp.(*protocol.OpenResponse)
+	if !ok {
+		return nil, errBadResponse
+	}
+	return x, nil
+}
+
+func (i *intercepted) Create(r *protocol.CreateRequest) (*protocol.CreateResponse, error) {
+	resp, err := i.next(i.ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	x, ok := resp.(*protocol.CreateResponse)
+	if !ok {
+		return nil, errBadResponse
+	}
+	return x, nil
+}
+
+func (i *intercepted) Read(r *protocol.ReadRequest) (*protocol.ReadResponse, error) {
+	resp, err := i.next(i.ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	x, ok := resp.(*protocol.ReadResponse)
+	if !ok {
+		return nil, errBadResponse
+	}
+	return x, nil
+}
+
+func (i *intercepted) Write(r *protocol.WriteRequest) (*protocol.WriteResponse, error) {
+	resp, err := i.next(i.ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	x, ok := resp.(*protocol.WriteResponse)
+	if !ok {
+		return nil, errBadResponse
+	}
+	return x, nil
+}
+
+func (i *intercepted) Clunk(r *protocol.ClunkRequest) (*protocol.ClunkResponse, error) {
+	resp, err := i.next(i.ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	x, ok := resp.(*protocol.ClunkResponse)
+	if !ok {
+		return nil, errBadResponse
+	}
+	return x, nil
+}
+
+func (i *intercepted) Remove(r *protocol.RemoveRequest) (*protocol.RemoveResponse, error) {
+	resp, err := i.next(i.ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	x, ok := resp.(*protocol.RemoveResponse)
+	if !ok {
+		return nil, errBadResponse
+	}
+	return x, nil
+}
+
+func (i *intercepted) Stat(r *protocol.StatRequest) (*protocol.StatResponse, error) {
+	resp, err := i.next(i.ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	x, ok := resp.(*protocol.StatResponse)
+	if !ok {
+		return nil, errBadResponse
+	}
+	return x, nil
+}
+
+func (i *intercepted) WriteStat(r *protocol.WriteStatRequest) (*protocol.WriteStatResponse, error) {
+	resp, err := i.next(i.ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	x, ok := resp.(*protocol.WriteStatResponse)
+	if !ok {
+		return nil, errBadResponse
+	}
+	return x, nil
+}
@@ -0,0 +1,451 @@
+package vfs
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+	"github.com/kennylevinsen/g9ptools/fileserver/iofs"
+)
+
+// Client accesses a tree with the permissions of a user, through os-like
+// operations on "/"-separated paths relative to the root of the tree.
+type Client struct {
+	Root fileserver.Dir
+	User string
+}
+
+// pathError wraps err in an *os.PathError, translating the errors of
+// fileserver to those of os.
+func pathError(op, name string, err error) error {
+	switch err {
+	case nil:
+		return nil
+	case fileserver.ErrNotExist:
+		err = os.ErrNotExist
+	}
+	return &os.PathError{Op: op, Path: name, Err: err}
+}
+
+func (c *Client) parent(name string) (fileserver.Dir, string, error) {
+	name = path.Clean("/" + name)
+	if name == "/" {
+		return nil, "", errors.New("path refers to the root")
+	}
+	f, err := fileserver.WalkPath(c.Root, c.User, path.Dir(name))
+	if err != nil {
+		return nil, "", err
+	}
+	d, ok := f.(fileserver.Dir)
+	if isdir, _ := f.IsDir(); !ok || !isdir {
+		return nil, "", fileserver.ErrNotDir
+	}
+	return d, path.Base(name), nil
+}
+
+func openMode(flag int) protocol.OpenMode {
+	var mode protocol.OpenMode
+	switch flag & (os.O_RDONLY | os.O_WRONLY | os.O_RDWR) {
+	case os.O_RDONLY:
+		mode = protocol.OREAD
+	case os.O_WRONLY:
+		mode = protocol.OWRITE
+	default:
+		mode = protocol.ORDWR
+	}
+	if flag&os.O_TRUNC != 0 {
+		mode |= protocol.OTRUNC
+	}
+	return mode
+}
+
+// OpenFile opens the file at name, like os.OpenFile.
+func (c *Client) OpenFile(name string, flag int, perm os.FileMode) (*ClientFile, error) {
+	mode := openMode(flag)
+	f, err := fileserver.WalkPath(c.Root, c.User, name)
+	switch {
+	case err == fileserver.ErrNotExist && flag&os.O_CREATE != 0:
+		d, base, err := c.parent(name)
+		if err != nil {
+			return nil, pathError("open", name, err)
+		}
+		perms := protocol.FileMode(perm & 0777)
+		if co, ok := d.(fileserver.CreateOpener); ok {
+			f, of, err := co.CreateOpen(c.User, base, perms, mode)
+			if err != nil {
+				return nil, pathError("open", name, err)
+			}
+			return c.newFile(name, flag, f, of), nil
+		}
+		if f, err = d.Create(c.User, base, perms); err != nil {
+			return nil, pathError("open", name, err)
+		}
+	case err != nil:
+		return nil, pathError("open", name, err)
+	case flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+		return nil, pathError("open", name, os.ErrExist)
+	}
+
+	of, err := f.Open(c.User, mode)
+	if err != nil {
+		return nil, pathError("open", name, err)
+	}
+	return c.newFile(name, flag, f, of), nil
+}
+
+func (c *Client) newFile(name string, flag int, f fileserver.File, of fileserver.OpenFile) *ClientFile {
+	return &ClientFile{c: c, name: name, f: f, of: of, appending: flag&os.O_APPEND != 0}
+}
+
+// Stat returns the FileInfo of the file at name, whose Sys method returns
+// its protocol.Stat.
+func (c *Client) Stat(name string) (os.FileInfo, error) {
+	f, err := fileserver.WalkPath(c.Root, c.User, name)
+	if err != nil {
+		return nil, pathError("stat", name, err)
+	}
+	st, err := f.Stat()
+	if err != nil {
+		return nil, pathError("stat", name, err)
+	}
+	return iofs.FileInfo(st), nil
+}
+
+// ReadDir returns the entries of the directory at name, sorted by name.
+func (c *Client) ReadDir(name string) ([]os.FileInfo, error) {
+	f, err := c.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fis, err := f.Readdir(-1)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(fis, func(i, j int) bool { return fis[i].Name() < fis[j].Name() })
+	return fis, nil
+}
+
+// Mkdir creates the directory at name.
+func (c *Client) Mkdir(name string, perm os.FileMode) error {
+	d, base, err := c.parent(name)
+	if err != nil {
+		return pathError("mkdir", name, err)
+	}
+	if _, err := d.Walk(c.User, base); err == nil {
+		return pathError("mkdir", name, os.ErrExist)
+	}
+	_, err = d.Create(c.User, base, protocol.DMDIR|protocol.FileMode(perm&0777))
+	return pathError("mkdir", name, err)
+}
+
+// MkdirAll creates the directory at name along with any missing parents.
+func (c *Client) MkdirAll(name string, perm os.FileMode) error {
+	return pathError("mkdir", name, fileserver.MkdirAll(c.Root, c.User, name, protocol.FileMode(perm&0777)))
+}
+
+// Remove removes the file or empty directory at name.
+func (c *Client) Remove(name string) error {
+	d, base, err := c.parent(name)
+	if err != nil {
+		return pathError("remove", name, err)
+	}
+	return pathError("remove", name, d.Remove(c.User, base))
+}
+
+// RemoveAll removes name and everything in it, succeeding if it does not
+// exist.
+func (c *Client) RemoveAll(name string) error {
+	fi, err := c.Stat(name)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		fis, err := c.ReadDir(name)
+		if err != nil {
+			return err
+		}
+		for _, e := range fis {
+			if err := c.RemoveAll(path.Join(name, e.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return c.Remove(name)
+}
+
+// Rename renames oldname to newname, which may be in another directory if
+// the tree implements fileserver.Mover.
+func (c *Client) Rename(oldname, newname string) error {
+	od, obase, err := c.parent(oldname)
+	if err != nil {
+		return pathError("rename", oldname, err)
+	}
+	if path.Dir(path.Clean("/"+oldname)) == path.Dir(path.Clean("/"+newname)) {
+		return pathError("rename", oldname, od.Rename(c.User, obase, path.Base(newname)))
+	}
+	nd, nbase, err := c.parent(newname)
+	if err != nil {
+		return pathError("rename", newname, err)
+	}
+	m, ok := od.(fileserver.Mover)
+	if !ok {
+		return pathError("rename", oldname, errors.New("cannot move between directories"))
+	}
+	return pathError("rename", oldname, m.Move(c.User, obase, nd, nbase))
+}
+
+// writeStat changes the stat of the file at name with fn. Like a wstat of
+// the mode or mtime, only the owner may do so.
+func (c *Client) writeStat(op, name string, fn func(st *protocol.Stat)) error {
+	f, err := fileserver.WalkPath(c.Root, c.User, name)
+	if err != nil {
+		return pathError(op, name, err)
+	}
+	return pathError(op, name, writeStat(c.User, f, fn))
+}
+
+func writeStat(user string, f fileserver.File, fn func(st *protocol.Stat)) error {
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if st.UID != user {
+		return os.ErrPermission
+	}
+	fn(&st)
+	return f.WriteStat(st)
+}
+
+// Chmod changes the permissions of the file at name.
+func (c *Client) Chmod(name string, mode os.FileMode) error {
+	return c.writeStat("chmod", name, func(st *protocol.Stat) {
+		st.Mode = st.Mode&^0777 | protocol.FileMode(mode&0777)
+	})
+}
+
+// Chtimes changes the modification time of the file at name. 9P does not
+// allow setting the access time, so atime is ignored.
+func (c *Client) Chtimes(name string, atime, mtime time.Time) error {
+	return c.writeStat("chtimes", name, func(st *protocol.Stat) {
+		st.Mtime = uint32(mtime.Unix())
+	})
+}
+
+// ClientFile is a file opened through a Client. It keeps its own offset, and
+// seeks the underlying OpenFile before every read and write, as fileserver
+// does.
+type ClientFile struct {
+	sync.Mutex
+	c         *Client
+	name      string
+	f         fileserver.File
+	of        fileserver.OpenFile
+	off       int64
+	appending bool
+	// entries are the remaining entries of a directory, read on the first
+	// call to Readdir.
+	entries []os.FileInfo
+	listed  bool
+}
+
+func (cf *ClientFile) Name() string {
+	return cf.name
+}
+
+// readAt reads at off. Must be called with the file locked.
+func (cf *ClientFile) readAt(p []byte, off int64) (int, error) {
+	if _, err := cf.of.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := cf.of.Read(p)
+	if err == nil && n == 0 && len(p) > 0 {
+		// A read returning no data is the end of file in 9P.
+		err = io.EOF
+	}
+	return n, err
+}
+
+// writeAt writes at off, or at the end of the file if opened for appending.
+// Must be called with the file locked.
+func (cf *ClientFile) writeAt(p []byte, off int64) (int, error) {
+	if cf.appending {
+		st, err := cf.f.Stat()
+		if err != nil {
+			return 0, err
+		}
+		off = int64(st.Length)
+	}
+	if _, err := cf.of.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return cf.of.Write(p)
+}
+
+func (cf *ClientFile) Read(p []byte) (int, error) {
+	cf.Lock()
+	defer cf.Unlock()
+	n, err := cf.readAt(p, cf.off)
+	cf.off += int64(n)
+	return n, err
+}
+
+func (cf *ClientFile) ReadAt(p []byte, off int64) (int, error) {
+	cf.Lock()
+	defer cf.Unlock()
+	var total int
+	for total < len(p) {
+		n, err := cf.readAt(p[total:], off+int64(total))
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+func (cf *ClientFile) Write(p []byte) (int, error) {
+	cf.Lock()
+	defer cf.Unlock()
+	n, err := cf.writeAt(p, cf.off)
+	cf.off += int64(n)
+	return n, err
+}
+
+func (cf *ClientFile) WriteAt(p []byte, off int64) (int, error) {
+	cf.Lock()
+	defer cf.Unlock()
+	return cf.writeAt(p, off)
+}
+
+func (cf *ClientFile) WriteString(s string) (int, error) {
+	return cf.Write([]byte(s))
+}
+
+func (cf *ClientFile) Seek(offset int64, whence int) (int64, error) {
+	cf.Lock()
+	defer cf.Unlock()
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += cf.off
+	case io.SeekEnd:
+		st, err := cf.f.Stat()
+		if err != nil {
+			return cf.off, err
+		}
+		offset += int64(st.Length)
+	default:
+		return cf.off, errors.New("invalid whence value")
+	}
+	if offset < 0 {
+		return cf.off, errors.New("negative seek invalid")
+	}
+	cf.off = offset
+	return offset, nil
+}
+
+func (cf *ClientFile) Stat() (os.FileInfo, error) {
+	st, err := cf.f.Stat()
+	if err != nil {
+		return nil, pathError("stat", cf.name, err)
+	}
+	return iofs.FileInfo(st), nil
+}
+
+// Truncate changes the length of the file. Like a wstat of the length, it
+// requires permission to write the file.
+func (cf *ClientFile) Truncate(size int64) error {
+	of, err := cf.f.Open(cf.c.User, protocol.OWRITE)
+	if err != nil {
+		return pathError("truncate", cf.name, err)
+	}
+	of.Close()
+	st, err := cf.f.Stat()
+	if err != nil {
+		return pathError("truncate", cf.name, err)
+	}
+	st.Length = uint64(size)
+	return pathError("truncate", cf.name, cf.f.WriteStat(st))
+}
+
+// Sync syncs the file if the backend supports it.
+func (cf *ClientFile) Sync() error {
+	if s, ok := cf.of.(fileserver.Syncer); ok {
+		return s.Sync()
+	}
+	if s, ok := cf.f.(fileserver.Syncer); ok {
+		return s.Sync()
+	}
+	return nil
+}
+
+// Readdir returns the next count entries of a directory, or all remaining
+// entries if count is not positive, like os.File.Readdir.
+func (cf *ClientFile) Readdir(count int) ([]os.FileInfo, error) {
+	cf.Lock()
+	defer cf.Unlock()
+	if !cf.listed {
+		if isdir, _ := cf.f.IsDir(); !isdir {
+			return nil, pathError("readdir", cf.name, fileserver.ErrNotDir)
+		}
+		var b []byte
+		buf := make([]byte, 8192)
+		for {
+			n, err := cf.readAt(buf, int64(len(b)))
+			b = append(b, buf[:n]...)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, pathError("readdir", cf.name, err)
+			}
+		}
+		for r := bytes.NewReader(b); r.Len() > 0; {
+			var st protocol.Stat
+			if err := st.Decode(r); err != nil {
+				return nil, pathError("readdir", cf.name, err)
+			}
+			cf.entries = append(cf.entries, iofs.FileInfo(st))
+		}
+		cf.listed = true
+	}
+
+	if count <= 0 {
+		fis := cf.entries
+		cf.entries = nil
+		return fis, nil
+	}
+	if len(cf.entries) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(cf.entries) {
+		count = len(cf.entries)
+	}
+	fis := cf.entries[:count]
+	cf.entries = cf.entries[count:]
+	return fis, nil
+}
+
+// Readdirnames is like Readdir, but returns only names.
+func (cf *ClientFile) Readdirnames(n int) ([]string, error) {
+	fis, err := cf.Readdir(n)
+	names := make([]string, len(fis))
+	for i, fi := range fis {
+		names[i] = fi.Name()
+	}
+	return names, err
+}
+
+func (cf *ClientFile) Close() error {
+	return cf.of.Close()
+}
@@ -0,0 +1,283 @@
+// Package vfs implements the adapters between fileserver trees and os-like
+// file system interfaces, such as those of afero and go-billy, which differ
+// mostly in naming.
+package vfs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"time"
+
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+)
+
+// FS is an os-like file system with "/"-separated paths.
+type FS interface {
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	Stat(name string) (os.FileInfo, error)
+	ReadDir(name string) ([]os.FileInfo, error)
+	Mkdir(name string, perm os.FileMode) error
+	Remove(name string) error
+	Rename(oldname, newname string) error
+	Chmod(name string, mode os.FileMode) error
+	Chtimes(name string, atime, mtime time.Time) error
+}
+
+// File is an open file of an FS.
+type File interface {
+	io.Reader
+	io.Writer
+	io.Seeker
+	io.Closer
+	Truncate(size int64) error
+}
+
+// Tree is a file of an FS served as a tree. Like exportfs, it does not keep
+// track of ownership, and reports all files as owned by the user and group
+// of the tree.
+type Tree struct {
+	fs    FS
+	path  string
+	user  string
+	group string
+}
+
+// NewTree returns the directory at root of fs as a tree.
+func NewTree(fs FS, root, user, group string) *Tree {
+	return &Tree{fs: fs, path: path.Clean(root), user: user, group: group}
+}
+
+func (t *Tree) child(name string) *Tree {
+	return &Tree{fs: t.fs, path: path.Join(t.path, name), user: t.user, group: t.group}
+}
+
+func (t *Tree) info() (os.FileInfo, error) {
+	fi, err := t.fs.Stat(t.path)
+	if os.IsNotExist(err) {
+		return nil, fileserver.ErrNotExist
+	}
+	return fi, err
+}
+
+func (t *Tree) Name() (string, error) {
+	if t.path == "/" || t.path == "." {
+		return "/", nil
+	}
+	return path.Base(t.path), nil
+}
+
+func (t *Tree) qid(fi os.FileInfo) protocol.Qid {
+	// There is no portable notion of file identity, so the path has to do.
+	sum := sha256.Sum224([]byte(t.path))
+	q := protocol.Qid{
+		Path:    binary.LittleEndian.Uint64(sum[:8]),
+		Version: uint32(fi.ModTime().UnixNano() / 1000000),
+	}
+	if fi.IsDir() {
+		q.Type |= protocol.QTDIR
+	}
+	return q
+}
+
+func (t *Tree) Qid() (protocol.Qid, error) {
+	fi, err := t.info()
+	if err != nil {
+		return protocol.Qid{}, err
+	}
+	return t.qid(fi), nil
+}
+
+func (t *Tree) stat(fi os.FileInfo) protocol.Stat {
+	name, _ := t.Name()
+	st := protocol.Stat{
+		Qid:    t.qid(fi),
+		Mode:   protocol.FileMode(fi.Mode().Perm()),
+		Atime:  uint32(fi.ModTime().Unix()),
+		Mtime:  uint32(fi.ModTime().Unix()),
+		Length: uint64(fi.Size()),
+		Name:   name,
+		UID:    t.user,
+		GID:    t.group,
+		MUID:   t.user,
+	}
+	if fi.IsDir() {
+		st.Mode |= protocol.DMDIR
+		st.Length = 0
+	}
+	return st
+}
+
+func (t *Tree) Stat() (protocol.Stat, error) {
+	fi, err := t.info()
+	if err != nil {
+		return protocol.Stat{}, err
+	}
+	return t.stat(fi), nil
+}
+
+// WriteStat applies the mode, mtime and length of s. A rename has already
+// been done by the parent when WriteStat is called, so only the name is
+// updated.
+func (t *Tree) WriteStat(s protocol.Stat) error {
+	if s.Name != "" {
+		if name, _ := t.Name(); s.Name != name {
+			t.path = path.Join(path.Dir(t.path), s.Name)
+		}
+	}
+
+	fi, err := t.info()
+	if err != nil {
+		return err
+	}
+	if perm := os.FileMode(s.Mode & 0777); perm != fi.Mode().Perm() {
+		if err := t.fs.Chmod(t.path, perm); err != nil {
+			return err
+		}
+	}
+	if !fi.IsDir() && int64(s.Length) != fi.Size() {
+		f, err := t.fs.OpenFile(t.path, os.O_WRONLY, 0)
+		if err != nil {
+			return err
+		}
+		err = f.Truncate(int64(s.Length))
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if int64(s.Mtime) != fi.ModTime().Unix() {
+		mtime := time.Unix(int64(s.Mtime), 0)
+		if err := t.fs.Chtimes(t.path, mtime, mtime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *Tree) IsDir() (bool, error) {
+	fi, err := t.info()
+	if err != nil {
+		return false, err
+	}
+	return fi.IsDir(), nil
+}
+
+func (t *Tree) CanRemove() (bool, error) {
+	return true, nil
+}
+
+func openFlag(mode protocol.OpenMode) int {
+	var flag int
+	switch mode & 3 {
+	case protocol.OREAD, protocol.OEXEC:
+		flag = os.O_RDONLY
+	case protocol.OWRITE:
+		flag = os.O_WRONLY
+	case protocol.ORDWR:
+		flag = os.O_RDWR
+	}
+	if mode&protocol.OTRUNC != 0 {
+		flag |= os.O_TRUNC
+	}
+	return flag
+}
+
+func (t *Tree) Open(user string, mode protocol.OpenMode) (fileserver.OpenFile, error) {
+	fi, err := t.info()
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		if mode&3 != protocol.OREAD || mode&protocol.OTRUNC != 0 {
+			return nil, errors.New("directories can only be opened for reading")
+		}
+		return t.openDir()
+	}
+	return t.fs.OpenFile(t.path, openFlag(mode), 0)
+}
+
+// openDir lists the directory, returning the encoded stats of its entries.
+func (t *Tree) openDir() (fileserver.OpenFile, error) {
+	fis, err := t.fs.ReadDir(t.path)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	for _, fi := range fis {
+		st := t.child(fi.Name()).stat(fi)
+		st.Encode(&buf)
+	}
+	return &openDir{r: bytes.NewReader(buf.Bytes())}, nil
+}
+
+func (t *Tree) Walk(user, name string) (fileserver.File, error) {
+	c := t.child(name)
+	if _, err := c.info(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (t *Tree) Create(user, name string, perms protocol.FileMode) (fileserver.File, error) {
+	c := t.child(name)
+	if perms&protocol.DMDIR != 0 {
+		if err := t.fs.Mkdir(c.path, os.FileMode(perms&0777)); err != nil {
+			return nil, err
+		}
+		return c, nil
+	}
+	f, err := t.fs.OpenFile(c.path, os.O_RDWR|os.O_CREATE|os.O_EXCL, os.FileMode(perms&0777))
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	return c, nil
+}
+
+func (t *Tree) Remove(user, name string) error {
+	return t.fs.Remove(path.Join(t.path, name))
+}
+
+func (t *Tree) Rename(user, oldname, newname string) error {
+	return t.fs.Rename(path.Join(t.path, oldname), path.Join(t.path, newname))
+}
+
+// Move implements fileserver.Mover within the same FS.
+func (t *Tree) Move(user, name string, dst fileserver.Dir, newname string) error {
+	d, ok := dst.(*Tree)
+	if !ok || d.fs != t.fs {
+		return errors.New("cannot move between file systems")
+	}
+	return t.fs.Rename(path.Join(t.path, name), path.Join(d.path, newname))
+}
+
+// openDir is an open directory of a Tree.
+type openDir struct {
+	r *bytes.Reader
+}
+
+func (d *openDir) Seek(offset int64, whence int) (int64, error) {
+	return d.r.Seek(offset, whence)
+}
+
+func (d *openDir) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+func (d *openDir) Write(p []byte) (int, error) {
+	return 0, errors.New("cannot write to directory")
+}
+
+func (d *openDir) Close() error {
+	return nil
+}
@@ -0,0 +1,243 @@
+// Package iofs adapts between fileserver trees and io/fs file systems. FS
+// exposes a fileserver.Dir as an fs.FS, so that served trees can be used
+// with the standard library, such as fs.WalkDir, http.FS and testing/fstest.
+// NewTree does the reverse, serving any fs.FS, such as an embed.FS, a
+// *zip.Reader or os.DirFS, as a read-only tree.
+package iofs
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+)
+
+// dirFS is a fileserver.Dir as an fs.FS.
+type dirFS struct {
+	root fileserver.Dir
+	user string
+}
+
+// FS returns root as an fs.FS, accessed with the permissions of user. The
+// returned file system also implements fs.ReadDirFS, fs.ReadFileFS and
+// fs.StatFS. The Sys method of its FileInfos returns the protocol.Stat of
+// the file.
+func FS(root fileserver.Dir, user string) fs.FS {
+	return &dirFS{root: root, user: user}
+}
+
+// walk returns the file called name, as validated by fs.ValidPath.
+func (d *dirFS) walk(op, name string) (fileserver.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	p := name
+	if p == "." {
+		p = ""
+	}
+	f, err := fileserver.WalkPath(d.root, d.user, p)
+	if err != nil {
+		return nil, pathError(op, name, err)
+	}
+	return f, nil
+}
+
+// pathError wraps err in an *fs.PathError, translating the errors of
+// fileserver to those of fs.
+func pathError(op, name string, err error) error {
+	switch err {
+	case fileserver.ErrNotExist:
+		err = fs.ErrNotExist
+	}
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+func (d *dirFS) Open(name string) (fs.File, error) {
+	f, err := d.walk("open", name)
+	if err != nil {
+		return nil, err
+	}
+	of, err := f.Open(d.user, protocol.OREAD)
+	if err != nil {
+		return nil, pathError("open", name, err)
+	}
+	// The fileserver seeks before every read, which some OpenFiles rely on
+	// to prepare their content.
+	if _, err := of.Seek(0, io.SeekStart); err != nil {
+		of.Close()
+		return nil, pathError("open", name, err)
+	}
+	return &file{f: f, of: of, name: name}, nil
+}
+
+func (d *dirFS) Stat(name string) (fs.FileInfo, error) {
+	f, err := d.walk("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		return nil, pathError("stat", name, err)
+	}
+	// The root is called "/" in 9P, but "." in fs.
+	st.Name = path.Base(name)
+	return FileInfo(st), nil
+}
+
+func (d *dirFS) ReadFile(name string) ([]byte, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readfile", Path: name, Err: fs.ErrInvalid}
+	}
+	b, err := fileserver.ReadFile(d.root, d.user, name)
+	if err != nil {
+		return nil, pathError("readfile", name, err)
+	}
+	return b, nil
+}
+
+func (d *dirFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	f, err := d.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	df, ok := f.(*file)
+	if !ok {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fileserver.ErrNotDir}
+	}
+	es, err := df.ReadDir(-1)
+	sort.Slice(es, func(i, j int) bool { return es[i].Name() < es[j].Name() })
+	return es, err
+}
+
+// file is an open file of a dirFS.
+type file struct {
+	f    fileserver.File
+	of   fileserver.OpenFile
+	name string
+	// entries are the remaining entries of a directory, read on the first
+	// call to ReadDir.
+	entries []fs.DirEntry
+	listed  bool
+}
+
+func (f *file) Stat() (fs.FileInfo, error) {
+	st, err := f.f.Stat()
+	if err != nil {
+		return nil, pathError("stat", f.name, err)
+	}
+	st.Name = path.Base(f.name)
+	return FileInfo(st), nil
+}
+
+func (f *file) Read(p []byte) (int, error) {
+	n, err := f.of.Read(p)
+	if err == nil && n == 0 && len(p) > 0 {
+		// A read returning no data is the end of file in 9P.
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	return f.of.Seek(offset, whence)
+}
+
+func (f *file) Close() error {
+	return f.of.Close()
+}
+
+// ReadDir implements fs.ReadDirFile.
+func (f *file) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !f.listed {
+		isdir, err := f.f.IsDir()
+		if err != nil {
+			return nil, pathError("readdir", f.name, err)
+		}
+		if !isdir {
+			return nil, pathError("readdir", f.name, fileserver.ErrNotDir)
+		}
+		b, err := readAll(f)
+		if err != nil {
+			return nil, pathError("readdir", f.name, err)
+		}
+		r := bytes.NewReader(b)
+		for r.Len() > 0 {
+			var st protocol.Stat
+			if err := st.Decode(r); err != nil {
+				return nil, pathError("readdir", f.name, err)
+			}
+			f.entries = append(f.entries, fs.FileInfoToDirEntry(FileInfo(st)))
+		}
+		f.listed = true
+	}
+
+	if n <= 0 {
+		es := f.entries
+		f.entries = nil
+		return es, nil
+	}
+	if len(f.entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(f.entries) {
+		n = len(f.entries)
+	}
+	es := f.entries[:n]
+	f.entries = f.entries[n:]
+	return es, nil
+}
+
+// readAll reads r until a read returns no data.
+func readAll(r io.Reader) ([]byte, error) {
+	var b []byte
+	buf := make([]byte, 8192)
+	for {
+		n, err := r.Read(buf)
+		b = append(b, buf[:n]...)
+		if err == io.EOF {
+			return b, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// statInfo is a protocol.Stat as an fs.FileInfo.
+type statInfo struct {
+	st protocol.Stat
+}
+
+// FileInfo returns st as an fs.FileInfo, whose Sys method returns st.
+func FileInfo(st protocol.Stat) fs.FileInfo {
+	return &statInfo{st: st}
+}
+
+func (si *statInfo) Name() string       { return si.st.Name }
+func (si *statInfo) Size() int64        { return int64(si.st.Length) }
+func (si *statInfo) ModTime() time.Time { return time.Unix(int64(si.st.Mtime), 0) }
+func (si *statInfo) IsDir() bool        { return si.st.Mode&protocol.DMDIR != 0 }
+func (si *statInfo) Sys() interface{}   { return si.st }
+
+func (si *statInfo) Mode() fs.FileMode {
+	m := fs.FileMode(si.st.Mode & 0777)
+	if si.st.Mode&protocol.DMDIR != 0 {
+		m |= fs.ModeDir
+	}
+	if si.st.Mode&protocol.DMAPPEND != 0 {
+		m |= fs.ModeAppend
+	}
+	if si.st.Mode&protocol.DMEXCL != 0 {
+		m |= fs.ModeExclusive
+	}
+	if si.st.Mode&protocol.DMTMP != 0 {
+		m |= fs.ModeTemporary
+	}
+	return m
+}
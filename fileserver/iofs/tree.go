@@ -0,0 +1,274 @@
+package iofs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+)
+
+var errReadOnly = errors.New("read-only file system")
+
+// Tree is a file of an fs.FS served as a read-only tree. Files are owned by
+// the user and group of the tree, and write permissions are masked away.
+type Tree struct {
+	fsys  fs.FS
+	path  string
+	user  string
+	group string
+}
+
+// NewTree returns the root of fsys as a read-only tree.
+func NewTree(fsys fs.FS, user, group string) *Tree {
+	return &Tree{fsys: fsys, path: ".", user: user, group: group}
+}
+
+func (t *Tree) info() (fs.FileInfo, error) {
+	fi, err := fs.Stat(t.fsys, t.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fileserver.ErrNotExist
+	}
+	return fi, err
+}
+
+func (t *Tree) Name() (string, error) {
+	if t.path == "." {
+		return "/", nil
+	}
+	return path.Base(t.path), nil
+}
+
+func (t *Tree) qid(fi fs.FileInfo) protocol.Qid {
+	// fs has no notion of file identity, so the path is the best there is.
+	sum := sha256.Sum224([]byte(t.path))
+	q := protocol.Qid{
+		Path:    binary.LittleEndian.Uint64(sum[:8]),
+		Version: uint32(fi.ModTime().UnixNano() / 1000000),
+	}
+	if fi.IsDir() {
+		q.Type |= protocol.QTDIR
+	}
+	return q
+}
+
+func (t *Tree) Qid() (protocol.Qid, error) {
+	fi, err := t.info()
+	if err != nil {
+		return protocol.Qid{}, err
+	}
+	return t.qid(fi), nil
+}
+
+func (t *Tree) stat(fi fs.FileInfo) protocol.Stat {
+	name, _ := t.Name()
+	mode := protocol.FileMode(fi.Mode().Perm() &^ 0222)
+	if fi.IsDir() {
+		mode |= protocol.DMDIR
+	}
+	return protocol.Stat{
+		Qid:    t.qid(fi),
+		Mode:   mode,
+		Atime:  uint32(fi.ModTime().Unix()),
+		Mtime:  uint32(fi.ModTime().Unix()),
+		Length: uint64(fi.Size()),
+		Name:   name,
+		UID:    t.user,
+		GID:    t.group,
+		MUID:   t.user,
+	}
+}
+
+func (t *Tree) Stat() (protocol.Stat, error) {
+	fi, err := t.info()
+	if err != nil {
+		return protocol.Stat{}, err
+	}
+	st := t.stat(fi)
+	if fi.IsDir() {
+		st.Length = 0
+	}
+	return st, nil
+}
+
+func (t *Tree) WriteStat(protocol.Stat) error {
+	return errReadOnly
+}
+
+func (t *Tree) IsDir() (bool, error) {
+	fi, err := t.info()
+	if err != nil {
+		return false, err
+	}
+	return fi.IsDir(), nil
+}
+
+func (t *Tree) CanRemove() (bool, error) {
+	return false, nil
+}
+
+func (t *Tree) Open(user string, mode protocol.OpenMode) (fileserver.OpenFile, error) {
+	if mode&3 != protocol.OREAD && mode&3 != protocol.OEXEC || mode&protocol.OTRUNC != 0 {
+		return nil, errReadOnly
+	}
+	fi, err := t.info()
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return t.openDir()
+	}
+	f, err := t.fsys.Open(t.path)
+	if err != nil {
+		return nil, err
+	}
+	return &openFile{t: t, f: f}, nil
+}
+
+// openDir lists the directory, returning the encoded stats of its entries.
+func (t *Tree) openDir() (fileserver.OpenFile, error) {
+	es, err := fs.ReadDir(t.fsys, t.path)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	for _, e := range es {
+		fi, err := e.Info()
+		if err != nil {
+			// The entry went away since it was listed.
+			continue
+		}
+		c := t.child(e.Name())
+		st := c.stat(fi)
+		if fi.IsDir() {
+			st.Length = 0
+		}
+		st.Encode(&buf)
+	}
+	return &openDir{r: bytes.NewReader(buf.Bytes())}, nil
+}
+
+func (t *Tree) child(name string) *Tree {
+	return &Tree{fsys: t.fsys, path: path.Join(t.path, name), user: t.user, group: t.group}
+}
+
+func (t *Tree) Walk(user, name string) (fileserver.File, error) {
+	if name == ".." {
+		// The fileserver resolves ".." itself, so this is never asked for.
+		return nil, fileserver.ErrNotExist
+	}
+	c := t.child(name)
+	if !fs.ValidPath(c.path) {
+		return nil, fileserver.ErrNotExist
+	}
+	if _, err := c.info(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (t *Tree) Create(user, name string, perms protocol.FileMode) (fileserver.File, error) {
+	return nil, errReadOnly
+}
+
+func (t *Tree) Remove(user, name string) error {
+	return errReadOnly
+}
+
+func (t *Tree) Rename(user, oldname, newname string) error {
+	return errReadOnly
+}
+
+// openDir is an open directory of a Tree.
+type openDir struct {
+	r *bytes.Reader
+}
+
+func (d *openDir) Seek(offset int64, whence int) (int64, error) {
+	return d.r.Seek(offset, whence)
+}
+
+func (d *openDir) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+func (d *openDir) Write(p []byte) (int, error) {
+	return 0, errReadOnly
+}
+
+func (d *openDir) Close() error {
+	return nil
+}
+
+// openFile is an open file of a Tree. Files of an fs.FS need not be
+// seekable, so those that are not are reopened to seek backwards, and read
+// to seek forwards.
+type openFile struct {
+	t   *Tree
+	f   fs.File
+	off int64
+}
+
+func (of *openFile) Seek(offset int64, whence int) (int64, error) {
+	if s, ok := of.f.(io.Seeker); ok {
+		n, err := s.Seek(offset, whence)
+		if err == nil {
+			of.off = n
+		}
+		return n, err
+	}
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += of.off
+	default:
+		return of.off, errors.New("file is not seekable")
+	}
+	if offset < 0 {
+		return of.off, errors.New("negative seek invalid")
+	}
+	if offset < of.off {
+		f, err := of.t.fsys.Open(of.t.path)
+		if err != nil {
+			return of.off, err
+		}
+		of.f.Close()
+		of.f, of.off = f, 0
+	}
+	if offset > of.off {
+		n, err := io.CopyN(io.Discard, of.f, offset-of.off)
+		of.off += n
+		if err != nil && err != io.EOF {
+			return of.off, err
+		}
+	}
+	return of.off, nil
+}
+
+func (of *openFile) Read(p []byte) (int, error) {
+	n, err := of.f.Read(p)
+	of.off += int64(n)
+	if err == io.EOF {
+		// A read returning no data is the end of file in 9P.
+		err = nil
+	}
+	return n, err
+}
+
+func (of *openFile) Write(p []byte) (int, error) {
+	return 0, errReadOnly
+}
+
+func (of *openFile) Close() error {
+	return of.f.Close()
+}
@@ -0,0 +1,219 @@
+package fileserver
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/kennylevinsen/g9p/protocol"
+)
+
+// LockType is the type of an advisory byte-range lock, with the values of
+// 9P2000.L.
+type LockType uint8
+
+const (
+	LockRead LockType = iota
+	LockWrite
+	LockUnlock
+)
+
+// Lock describes an advisory byte-range lock. A Length of zero extends the
+// range to the end of the file, wherever that ends up being. Locks are owned
+// by the ProcID of a client, as POSIX locks are owned by processes.
+type Lock struct {
+	Type   LockType
+	Start  uint64
+	Length uint64
+	ProcID uint32
+	// ClientID identifies the client host, and is only reported back.
+	ClientID string
+}
+
+func (l Lock) end() uint64 {
+	if l.Length == 0 || l.Start+l.Length < l.Start {
+		return ^uint64(0)
+	}
+	return l.Start + l.Length
+}
+
+func (l Lock) overlaps(o Lock) bool {
+	return l.Start < o.end() && o.Start < l.end()
+}
+
+// lockKey identifies a file across the FileServers sharing a LockTable.
+type lockKey struct {
+	service string
+	path    uint64
+}
+
+// lockOwner is a process of a client, which is a FileServer.
+type lockOwner struct {
+	fs     *FileServer
+	procID uint32
+}
+
+type heldLock struct {
+	Lock
+	owner lockOwner
+	fid   protocol.Fid
+}
+
+// LockTable holds advisory byte-range locks. Every FileServer has a table of
+// its own, so FileServers that serve the same trees must be given the same
+// table for locks to conflict across clients. Files are told apart by
+// service and qid path, so a table must not be shared by FileServers serving
+// different trees under the same service names.
+type LockTable struct {
+	sync.Mutex
+	files map[lockKey][]heldLock
+}
+
+func NewLockTable() *LockTable {
+	return &LockTable{files: make(map[lockKey][]heldLock)}
+}
+
+// conflict returns the first lock on key that conflicts with l, if any.
+// Must be called with the table locked.
+func (lt *LockTable) conflict(key lockKey, owner lockOwner, l Lock) (heldLock, bool) {
+	for _, h := range lt.files[key] {
+		if h.owner == owner || !h.overlaps(l) {
+			continue
+		}
+		if h.Type == LockWrite || l.Type == LockWrite {
+			return h, true
+		}
+	}
+	return heldLock{}, false
+}
+
+// set applies l for owner, replacing the parts of the locks of owner that it
+// overlaps, and reports false without changing anything if another owner
+// holds a conflicting lock.
+func (lt *LockTable) set(key lockKey, owner lockOwner, fid protocol.Fid, l Lock) bool {
+	lt.Lock()
+	defer lt.Unlock()
+	if l.Type != LockUnlock {
+		if _, ok := lt.conflict(key, owner, l); ok {
+			return false
+		}
+	}
+
+	var held []heldLock
+	for _, h := range lt.files[key] {
+		if h.owner != owner || !h.overlaps(l) {
+			held = append(held, h)
+			continue
+		}
+		// Keep the parts outside of l.
+		if h.Start < l.Start {
+			before := h
+			before.Length = l.Start - h.Start
+			held = append(held, before)
+		}
+		if l.end() < h.end() {
+			after := h
+			after.Start = l.end()
+			if h.Length != 0 {
+				after.Length = h.end() - l.end()
+			}
+			held = append(held, after)
+		}
+	}
+	if l.Type != LockUnlock {
+		held = append(held, heldLock{Lock: l, owner: owner, fid: fid})
+	}
+	if len(held) == 0 {
+		delete(lt.files, key)
+	} else {
+		lt.files[key] = held
+	}
+	return true
+}
+
+// get returns the first lock conflicting with l, or l with type LockUnlock
+// if there is none.
+func (lt *LockTable) get(key lockKey, owner lockOwner, l Lock) Lock {
+	lt.Lock()
+	defer lt.Unlock()
+	if h, ok := lt.conflict(key, owner, l); ok {
+		return h.Lock
+	}
+	l.Type = LockUnlock
+	return l
+}
+
+// release drops the locks taken through fid of fs, or through any fid of fs
+// if all is set.
+func (lt *LockTable) release(fs *FileServer, fid protocol.Fid, all bool) {
+	lt.Lock()
+	defer lt.Unlock()
+	for key, hs := range lt.files {
+		var held []heldLock
+		for _, h := range hs {
+			if h.owner.fs != fs || (!all && h.fid != fid) {
+				held = append(held, h)
+			}
+		}
+		if len(held) == 0 {
+			delete(lt.files, key)
+		} else {
+			lt.files[key] = held
+		}
+	}
+}
+
+func (fs *FileServer) locks() *LockTable {
+	fs.locksOnce.Do(func() {
+		if fs.Locks == nil {
+			fs.Locks = NewLockTable()
+		}
+	})
+	return fs.Locks
+}
+
+// lockTarget returns the key of the file open on fid.
+func (fs *FileServer) lockTarget(fid protocol.Fid) (lockKey, error) {
+	fs.fidLock.RLock()
+	s, ok := fs.Fids[fid]
+	fs.fidLock.RUnlock()
+	if !ok {
+		return lockKey{}, errors.New("unknown fid")
+	}
+	s.RLock()
+	defer s.RUnlock()
+	if s.open == nil {
+		return lockKey{}, errors.New("file not open")
+	}
+	q, err := s.location.Current().Qid()
+	if err != nil {
+		return lockKey{}, err
+	}
+	return lockKey{service: s.service, path: q.Path}, nil
+}
+
+// SetLock applies an advisory byte-range lock to the file open on fid, as
+// for a 9P2000.L Tlock. It reports false if the lock conflicts with a lock
+// of another owner. Locks are released when the fid is clunked or removed.
+//
+// The FileServer only speaks 9P2000, so Tlock and Tgetlock are never served,
+// and locks are only taken by calling SetLock and GetLock directly.
+func (fs *FileServer) SetLock(fid protocol.Fid, l Lock) (bool, error) {
+	key, err := fs.lockTarget(fid)
+	if err != nil {
+		return false, err
+	}
+	if l.Type > LockUnlock {
+		return false, errors.New("invalid lock type")
+	}
+	return fs.locks().set(key, lockOwner{fs, l.ProcID}, fid, l), nil
+}
+
+// GetLock returns the first lock conflicting with l on the file open on fid,
+// or l with type LockUnlock if there is none, as for a 9P2000.L Tgetlock.
+func (fs *FileServer) GetLock(fid protocol.Fid, l Lock) (Lock, error) {
+	key, err := fs.lockTarget(fid)
+	if err != nil {
+		return Lock{}, err
+	}
+	return fs.locks().get(key, lockOwner{fs, l.ProcID}, l), nil
+}
@@ -0,0 +1,146 @@
+package fileserver
+
+import (
+	"errors"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/kennylevinsen/g9p/protocol"
+)
+
+// The helpers in this file access a tree directly through the File and Dir
+// interfaces, with the permissions of user, so that an application serving
+// a tree can manipulate it without speaking 9P to itself. Paths are
+// relative to root, and ".." is resolved lexically.
+
+// splitPath returns the names of the elements of p.
+func splitPath(p string) []string {
+	p = path.Clean("/" + p)
+	if p == "/" {
+		return nil
+	}
+	return strings.Split(p[1:], "/")
+}
+
+// walkNames walks the names from root.
+func walkNames(root Dir, user string, names []string) (File, error) {
+	var f File = root
+	for _, name := range names {
+		d, err := asDir(f)
+		if err != nil {
+			return nil, err
+		}
+		if f, err = d.Walk(user, name); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// WalkPath returns the file at p.
+func WalkPath(root Dir, user, p string) (File, error) {
+	return walkNames(root, user, splitPath(p))
+}
+
+// walkParent returns the directory containing p, and the name of p in it.
+func walkParent(root Dir, user, p string) (Dir, string, error) {
+	names := splitPath(p)
+	if len(names) == 0 {
+		return nil, "", errors.New("path refers to the root")
+	}
+	f, err := walkNames(root, user, names[:len(names)-1])
+	if err != nil {
+		return nil, "", err
+	}
+	d, err := asDir(f)
+	if err != nil {
+		return nil, "", err
+	}
+	return d, names[len(names)-1], nil
+}
+
+// ReadFile returns the content of the file at p.
+func ReadFile(root Dir, user, p string) ([]byte, error) {
+	f, err := WalkPath(root, user, p)
+	if err != nil {
+		return nil, err
+	}
+	of, err := f.Open(user, protocol.OREAD)
+	if err != nil {
+		return nil, err
+	}
+	defer of.Close()
+
+	// Like a client, read from the start until a read returns no data,
+	// seeking first as some OpenFiles prepare their content then.
+	if _, err := of.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	var b []byte
+	buf := make([]byte, 8192)
+	for {
+		n, err := of.Read(buf)
+		b = append(b, buf[:n]...)
+		if err == io.EOF || (err == nil && n == 0) {
+			return b, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// WriteFile replaces the content of the file at p with data, creating it
+// with perms if it does not exist.
+func WriteFile(root Dir, user, p string, data []byte, perms protocol.FileMode) error {
+	d, name, err := walkParent(root, user, p)
+	if err != nil {
+		return err
+	}
+
+	var of OpenFile
+	f, err := d.Walk(user, name)
+	switch {
+	case err == ErrNotExist:
+		if co, ok := d.(CreateOpener); ok {
+			_, of, err = co.CreateOpen(user, name, perms, protocol.OWRITE|protocol.OTRUNC)
+			break
+		}
+		if f, err = d.Create(user, name, perms); err == nil {
+			of, err = f.Open(user, protocol.OWRITE|protocol.OTRUNC)
+		}
+	case err == nil:
+		of, err = f.Open(user, protocol.OWRITE|protocol.OTRUNC)
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err = of.Seek(0, io.SeekStart); err == nil {
+		_, err = of.Write(data)
+	}
+	if cerr := of.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// MkdirAll creates the directory at p with perms, along with any missing
+// parents. It succeeds if p is already a directory.
+func MkdirAll(root Dir, user, p string, perms protocol.FileMode) error {
+	var d Dir = root
+	for _, name := range splitPath(p) {
+		f, err := d.Walk(user, name)
+		if err == ErrNotExist {
+			f, err = d.Create(user, name, protocol.DMDIR|perms)
+		}
+		if err != nil {
+			return err
+		}
+		if d, err = asDir(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package fileserver
+
+import "github.com/kennylevinsen/g9p/protocol"
+
+// PermissionPolicy decides whether user may access a file owned by owner and
+// group with the given permissions, in the way described by mode. Only the
+// access mode bits of mode are considered, except by policies that look at
+// OTRUNC as well.
+type PermissionPolicy interface {
+	Allowed(user, owner, group string, permissions protocol.FileMode, mode protocol.OpenMode) bool
+}
+
+// PermissionFunc is a function as a PermissionPolicy.
+type PermissionFunc func(user, owner, group string, permissions protocol.FileMode, mode protocol.OpenMode) bool
+
+func (f PermissionFunc) Allowed(user, owner, group string, permissions protocol.FileMode, mode protocol.OpenMode) bool {
+	return f(user, owner, group, permissions, mode)
+}
+
+// ModePolicy checks the owner permission bits for the owner of a file, the
+// group bits for members of its group and the other bits for everyone else.
+type ModePolicy struct {
+	// Member reports whether user is a member of group. If nil, users are
+	// only members of the group of their own name, as on Plan 9.
+	Member func(user, group string) bool
+}
+
+func (p ModePolicy) Allowed(user, owner, group string, permissions protocol.FileMode, mode protocol.OpenMode) bool {
+	var offset uint8
+	switch {
+	case user == owner:
+		offset = 6
+	case p.member(user, group):
+		offset = 3
+	}
+
+	switch mode & 3 {
+	case protocol.OREAD:
+		return permissions&(1<<(2+offset)) != 0
+	case protocol.OWRITE:
+		return permissions&(1<<(1+offset)) != 0
+	case protocol.ORDWR:
+		return (permissions&(1<<(2+offset)) != 0) && (permissions&(1<<(1+offset)) != 0)
+	case protocol.OEXEC:
+		return permissions&(1<<offset) != 0
+	default:
+		return false
+	}
+}
+
+func (p ModePolicy) member(user, group string) bool {
+	if p.Member == nil {
+		return user == group
+	}
+	return p.Member(user, group)
+}
+
+// DefaultPolicy is the policy used when none has been set.
+var DefaultPolicy PermissionPolicy = ModePolicy{}
+
+// AllowAll permits every access, for trees only reachable by trusted users.
+var AllowAll PermissionPolicy = PermissionFunc(func(user, owner, group string, permissions protocol.FileMode, mode protocol.OpenMode) bool {
+	return true
+})
+
+// DenyWrites returns a policy denying all writes and truncations, and
+// otherwise deferring to p, or DefaultPolicy if p is nil.
+func DenyWrites(p PermissionPolicy) PermissionPolicy {
+	if p == nil {
+		p = DefaultPolicy
+	}
+	return PermissionFunc(func(user, owner, group string, permissions protocol.FileMode, mode protocol.OpenMode) bool {
+		switch {
+		case mode&3 == protocol.OWRITE, mode&3 == protocol.ORDWR, mode&protocol.OTRUNC != 0:
+			return false
+		}
+		return p.Allowed(user, owner, group, permissions, mode)
+	})
+}
+
+// Allowed checks access with p, or DefaultPolicy if p is nil.
+func Allowed(p PermissionPolicy, user, owner, group string, permissions protocol.FileMode, mode protocol.OpenMode) bool {
+	if p == nil {
+		p = DefaultPolicy
+	}
+	return p.Allowed(user, owner, group, permissions, mode)
+}
+
+// UserDB knows the users of a server and the groups they are members of.
+type UserDB interface {
+	// Exists reports whether user is known.
+	Exists(user string) (bool, error)
+	// Groups returns the groups user is a member of, which need not include
+	// the group of the name of the user.
+	Groups(user string) ([]string, error)
+}
+
+// GroupPolicy returns a ModePolicy taking group membership from db. As on
+// Plan 9, users are also members of the group of their own name. Users whose
+// groups cannot be looked up are treated as members of no other group.
+func GroupPolicy(db UserDB) PermissionPolicy {
+	return ModePolicy{Member: func(user, group string) bool {
+		if user == group {
+			return true
+		}
+		groups, err := db.Groups(user)
+		if err != nil {
+			return false
+		}
+		for _, g := range groups {
+			if g == group {
+				return true
+			}
+		}
+		return false
+	}}
+}
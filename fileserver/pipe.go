@@ -0,0 +1,24 @@
+package fileserver
+
+import (
+	"net"
+
+	"github.com/kennylevinsen/g9p"
+	"github.com/kennylevinsen/g9ptools/transport"
+)
+
+// Pipe serves h over an in-memory connection, and returns the client end of
+// it. This allows accessing a tree through a 9P client in the same process,
+// without opening any sockets:
+//
+//	root := ramtree.NewRAMTree("/", 0777, "user", "group")
+//	fs := fileserver.NewFileServer(root, nil, 64*1024, fileserver.Quiet)
+//	c := &convenience.Client{}
+//	err := c.Connect(fileserver.Pipe(fs), "user", "")
+//
+// The server side stops when the returned connection is closed.
+func Pipe(h g9p.Handler) net.Conn {
+	client, server := net.Pipe()
+	go g9p.ServeListener(transport.NewConnListener(server), func() g9p.Handler { return h })
+	return client
+}
@@ -0,0 +1,33 @@
+package fileserver
+
+import "strings"
+
+// Restriction confines the fids of a user.
+type Restriction struct {
+	// Scope, if set, is a path within every service that attaches are
+	// confined to, as if it was the root of the service. It is relative to
+	// the Scope of the FileServer, if any.
+	Scope string
+	// ReadOnly rejects all requests that would modify the served trees.
+	ReadOnly bool
+}
+
+// scope returns the location of an attach by user to root confined to p,
+// which must be a clean, absolute path. The location starts at the directory
+// at p, so that walks cannot leave it.
+func scope(user string, root Dir, p string) (FilePath, error) {
+	loc := FilePath{root}
+	for _, name := range strings.Split(p, "/") {
+		if name == "" {
+			continue
+		}
+		var err error
+		if loc, err = walkStep(user, loc, name); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := asDir(loc.Current()); err != nil {
+		return nil, err
+	}
+	return FilePath{loc.Current()}, nil
+}
@@ -0,0 +1,183 @@
+package fileserver
+
+import (
+	"errors"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kennylevinsen/g9p/protocol"
+)
+
+// FidInfo describes a fid of a FileServer.
+type FidInfo struct {
+	Fid     protocol.Fid
+	Service string
+	User    string
+	// Path is the path of the file of the fid within its service. It is
+	// empty for auth fids.
+	Path string
+	Open bool
+	Mode protocol.OpenMode
+	// Read and Written are the bytes transferred through the fid.
+	Read    uint64
+	Written uint64
+}
+
+// path returns the path of a location, by the names of its files.
+func (fp FilePath) path() string {
+	if len(fp) == 0 {
+		return ""
+	}
+	var names []string
+	for _, f := range fp[1:] {
+		name, err := f.Name()
+		if err != nil {
+			name = "?"
+		}
+		names = append(names, name)
+	}
+	return "/" + strings.Join(names, "/")
+}
+
+// FidInfos describes the fids of the server, ordered by fid. The fids are
+// collected before their states are inspected, so that a fid busy with a
+// request only holds up the listing, and not the requests of other fids.
+func (fs *FileServer) FidInfos() []FidInfo {
+	fs.fidLock.RLock()
+	fids := make(map[protocol.Fid]*State, len(fs.Fids))
+	for fid, s := range fs.Fids {
+		fids[fid] = s
+	}
+	fs.fidLock.RUnlock()
+
+	infos := make([]FidInfo, 0, len(fids))
+	for fid, s := range fids {
+		s.RLock()
+		infos = append(infos, FidInfo{
+			Fid:     fid,
+			Service: s.service,
+			User:    s.username,
+			Path:    s.location.path(),
+			Open:    s.open != nil,
+			Mode:    s.mode,
+			Read:    atomic.LoadUint64(&s.read),
+			Written: atomic.LoadUint64(&s.written),
+		})
+		s.RUnlock()
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Fid < infos[j].Fid })
+	return infos
+}
+
+// ForceClunk clunks a fid on behalf of the server, such as when a client is
+// stuck on a file that blocks. The fid is detached at once, and pending
+// requests on it are interrupted. Its open file is closed once they have
+// returned, as closing it under them would pull the file out from under
+// reads and writes still using it. The client gets errors for any further
+// use of the fid.
+func (fs *FileServer) ForceClunk(fid protocol.Fid) error {
+	return fs.clunk(fid)
+}
+
+// ClunkAll forcibly clunks all fids of the server.
+func (fs *FileServer) ClunkAll() {
+	fs.fidLock.RLock()
+	var fids []protocol.Fid
+	for fid := range fs.Fids {
+		fids = append(fids, fid)
+	}
+	fs.fidLock.RUnlock()
+
+	for _, fid := range fids {
+		fs.ForceClunk(fid)
+	}
+}
+
+// Session is a connection served by a FileServer.
+type Session struct {
+	ID     int
+	Remote string
+	// Listener names the endpoint the connection arrived on.
+	Listener string
+	Started  time.Time
+	FS       *FileServer
+	conn     io.Closer
+}
+
+// Sessions keeps track of the sessions of a server, so that they can be
+// inspected and killed.
+type Sessions struct {
+	sync.Mutex
+	next     int
+	sessions map[int]*Session
+}
+
+// NewSessions returns an empty session registry.
+func NewSessions() *Sessions {
+	return &Sessions{sessions: make(map[int]*Session)}
+}
+
+// Add registers a session served by fs over conn, which is closed to kill
+// the session.
+func (ss *Sessions) Add(fs *FileServer, conn io.Closer, remote, listener string) *Session {
+	ss.Lock()
+	defer ss.Unlock()
+	ss.next++
+	s := &Session{
+		ID:       ss.next,
+		Remote:   remote,
+		Listener: listener,
+		Started:  time.Now(),
+		FS:       fs,
+		conn:     conn,
+	}
+	ss.sessions[s.ID] = s
+	return s
+}
+
+// Remove forgets a session that has ended.
+func (ss *Sessions) Remove(s *Session) {
+	ss.Lock()
+	defer ss.Unlock()
+	delete(ss.sessions, s.ID)
+}
+
+// List returns the sessions, ordered by ID.
+func (ss *Sessions) List() []*Session {
+	ss.Lock()
+	defer ss.Unlock()
+	list := make([]*Session, 0, len(ss.sessions))
+	for _, s := range ss.sessions {
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// Get returns the session with the given ID.
+func (ss *Sessions) Get(id int) (*Session, error) {
+	ss.Lock()
+	defer ss.Unlock()
+	s, ok := ss.sessions[id]
+	if !ok {
+		return nil, errors.New("no such session")
+	}
+	return s, nil
+}
+
+// Kill closes the connection of a session and clunks its fids, releasing
+// the files it holds open.
+func (ss *Sessions) Kill(id int) error {
+	s, err := ss.Get(id)
+	if err != nil {
+		return err
+	}
+	err = s.conn.Close()
+	s.FS.ClunkAll()
+	ss.Remove(s)
+	return err
+}
@@ -0,0 +1,195 @@
+// Package tarstream serves directories as tarballs, so that a whole tree can
+// be fetched with one sequential read, rather than a walk, open, read and
+// clunk for every file.
+//
+// By convention, a directory supporting it answers a walk to name.tar, where
+// name is one of its subdirectories and no file called name.tar exists, with
+// a read-only file streaming a tarball of the subdirectory, and a walk to
+// .tar with one of the directory itself. The files are not listed in the
+// directory. The tarball holds what the user opening the file may read,
+// skipping what they may not.
+//
+// The files are append-only, which tells clients to read them in order, as
+// reading at any other offset than where the previous read ended fails.
+package tarstream
+
+import (
+	"archive/tar"
+	"errors"
+	"io"
+	"io/fs"
+	"strings"
+	"sync"
+
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+	"github.com/kennylevinsen/g9ptools/fileserver/iofs"
+	"github.com/kennylevinsen/g9ptools/fileserver/templatefs"
+)
+
+// Suffix is the suffix of the names of tarballs.
+const Suffix = ".tar"
+
+var errNotSequential = errors.New("tarball must be read sequentially")
+
+// Walk returns the tarball called name in d, or fileserver.ErrNotExist if
+// name does not refer to one. Directories supporting tarballs call it when
+// a walk finds no file.
+func Walk(d fileserver.Dir, user, name string) (fileserver.File, error) {
+	if !strings.HasSuffix(name, Suffix) {
+		return nil, fileserver.ErrNotExist
+	}
+	target := d
+	if base := strings.TrimSuffix(name, Suffix); base != "" {
+		f, err := d.Walk(user, base)
+		if err != nil {
+			return nil, err
+		}
+		isdir, err := f.IsDir()
+		if err != nil {
+			return nil, err
+		}
+		sub, ok := f.(fileserver.Dir)
+		if !isdir || !ok {
+			return nil, fileserver.ErrNotExist
+		}
+		target = sub
+	}
+	return NewFile(target, name)
+}
+
+// File is a tarball of a directory.
+type File struct {
+	templatefs.FileBase
+	dir fileserver.Dir
+}
+
+// NewFile returns a tarball of dir called name. It is owned by the owner of
+// dir, and readable by those who may read dir.
+func NewFile(dir fileserver.Dir, name string) (*File, error) {
+	st, err := dir.Stat()
+	if err != nil {
+		return nil, err
+	}
+	f := &File{dir: dir}
+	f.Init(name, protocol.DMAPPEND|st.Mode&0444, st.UID, st.GID)
+	return f, nil
+}
+
+func (f *File) Open(user string, mode protocol.OpenMode) (fileserver.OpenFile, error) {
+	if err := f.CheckOpen(user, mode); err != nil {
+		return nil, err
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(Write(pw, f.dir, user))
+	}()
+	return &stream{r: pr}, nil
+}
+
+// stream is an open tarball. Closing it stops the writer.
+type stream struct {
+	sync.Mutex
+	r      *io.PipeReader
+	offset int64
+}
+
+func (s *stream) Seek(offset int64, whence int) (int64, error) {
+	s.Lock()
+	defer s.Unlock()
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += s.offset
+	default:
+		return s.offset, errNotSequential
+	}
+	if offset != s.offset {
+		return s.offset, errNotSequential
+	}
+	return offset, nil
+}
+
+func (s *stream) Read(p []byte) (int, error) {
+	s.Lock()
+	defer s.Unlock()
+	n, err := s.r.Read(p)
+	s.offset += int64(n)
+	return n, err
+}
+
+func (s *stream) Write(p []byte) (int, error) {
+	return 0, fileserver.ErrPermission
+}
+
+func (s *stream) Close() error {
+	return s.r.Close()
+}
+
+// Interrupt stops the writer, which makes a blocked read return.
+func (s *stream) Interrupt() {
+	s.r.CloseWithError(errors.New("interrupted"))
+}
+
+// Write writes a tarball of dir, as read by user, to w. Files user may not
+// read, and files whose type tar cannot hold, are skipped.
+func Write(w io.Writer, dir fileserver.Dir, user string) error {
+	fsys := iofs.FS(dir, user)
+	tw := tar.NewWriter(w)
+	err := fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fileserver.ErrPermission) {
+			if d != nil && d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if p == "." {
+			return nil
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(fi, "")
+		if err != nil {
+			return nil
+		}
+		hdr.Name = p
+		if fi.IsDir() {
+			hdr.Name += "/"
+		}
+		if st, ok := fi.Sys().(protocol.Stat); ok {
+			hdr.Uname, hdr.Gname = st.UID, st.GID
+		}
+
+		var f fs.File
+		if hdr.Typeflag == tar.TypeReg && hdr.Size > 0 {
+			// The file is opened before the header is written, so that one
+			// that cannot be read is skipped whole.
+			if f, err = fsys.Open(p); errors.Is(err, fileserver.ErrPermission) {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			defer f.Close()
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if f == nil {
+			return nil
+		}
+		// Only the length seen by stat is copied, as synthetic files may
+		// produce more, or block.
+		_, err = io.CopyN(tw, f, hdr.Size)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
@@ -0,0 +1,162 @@
+package templatefs
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+)
+
+// DirBase implements a directory of static children on top of FileBase.
+// Files cannot be created in it unless the embedding type overrides Create,
+// which it may implement with Add.
+type DirBase struct {
+	FileBase
+	children map[string]fileserver.File
+}
+
+// Init initializes the directory. It must be called before the directory is
+// used.
+func (d *DirBase) Init(name string, permissions protocol.FileMode, user, group string) {
+	d.FileBase.Init(name, permissions|protocol.DMDIR, user, group)
+	d.children = make(map[string]fileserver.File)
+}
+
+// Add adds f to the directory, under the name it reports.
+func (d *DirBase) Add(f fileserver.File) error {
+	name, err := f.Name()
+	if err != nil {
+		return err
+	}
+	d.Lock()
+	defer d.Unlock()
+	if _, ok := d.children[name]; ok {
+		return errors.New("file already exists")
+	}
+	d.children[name] = f
+	d.version++
+	return nil
+}
+
+// Children returns the files of the directory.
+func (d *DirBase) Children() []fileserver.File {
+	d.RLock()
+	defer d.RUnlock()
+	files := make([]fileserver.File, 0, len(d.children))
+	for _, f := range d.children {
+		files = append(files, f)
+	}
+	return files
+}
+
+func (d *DirBase) Open(user string, mode protocol.OpenMode) (fileserver.OpenFile, error) {
+	if mode&3 != protocol.OREAD || mode&protocol.OTRUNC != 0 {
+		return nil, errors.New("directories can only be opened for reading")
+	}
+	if err := d.CheckOpen(user, mode); err != nil {
+		return nil, err
+	}
+	var stats []protocol.Stat
+	for _, f := range d.Children() {
+		st, err := f.Stat()
+		if err != nil {
+			return nil, err
+		}
+		stats = append(stats, st)
+	}
+	return NewListing(stats), nil
+}
+
+func (d *DirBase) Walk(user, name string) (fileserver.File, error) {
+	if !d.Allowed(user, protocol.OEXEC) {
+		return nil, ErrPermission
+	}
+	d.RLock()
+	defer d.RUnlock()
+	f, ok := d.children[name]
+	if !ok {
+		return nil, fileserver.ErrNotExist
+	}
+	return f, nil
+}
+
+func (d *DirBase) Create(user, name string, perms protocol.FileMode) (fileserver.File, error) {
+	return nil, ErrPermission
+}
+
+func (d *DirBase) Remove(user, name string) error {
+	if !d.Allowed(user, protocol.OWRITE) {
+		return ErrPermission
+	}
+	d.Lock()
+	defer d.Unlock()
+	f, ok := d.children[name]
+	if !ok {
+		return fileserver.ErrNotExist
+	}
+	if ok, err := f.CanRemove(); err != nil {
+		return err
+	} else if !ok {
+		return errors.New("file cannot be removed")
+	}
+	delete(d.children, name)
+	d.version++
+	return nil
+}
+
+// Rename moves the entry of a file. The name of the file itself is updated
+// by the WriteStat that follows.
+func (d *DirBase) Rename(user, oldname, newname string) error {
+	if !d.Allowed(user, protocol.OWRITE) {
+		return ErrPermission
+	}
+	d.Lock()
+	defer d.Unlock()
+	f, ok := d.children[oldname]
+	if !ok {
+		return fileserver.ErrNotExist
+	}
+	if _, ok := d.children[newname]; ok {
+		return errors.New("file already exists")
+	}
+	delete(d.children, oldname)
+	d.children[newname] = f
+	d.version++
+	return nil
+}
+
+// NewListing returns an open directory serving the encoded stats.
+func NewListing(stats []protocol.Stat) fileserver.OpenFile {
+	var buf bytes.Buffer
+	for _, st := range stats {
+		st.Encode(&buf)
+	}
+	return &listing{Reader: Reader{content: buf.Bytes()}}
+}
+
+// listing is a directory opened by NewListing. Like other directories, it
+// can only be seeked to the start or the current offset.
+type listing struct {
+	Reader
+}
+
+func (l *listing) Seek(offset int64, whence int) (int64, error) {
+	cur, err := l.Reader.Seek(0, 1)
+	if err != nil {
+		return 0, err
+	}
+	n, err := l.Reader.Seek(offset, whence)
+	if err != nil {
+		return n, err
+	}
+	if n != 0 && n != cur {
+		l.Reader.Seek(cur, 0)
+		return cur, errors.New("seek to other than 0 on dir illegal")
+	}
+	return n, nil
+}
+
+func (l *listing) Write(p []byte) (int, error) {
+	return 0, errors.New("cannot write to directory")
+}
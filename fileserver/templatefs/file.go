@@ -0,0 +1,207 @@
+// Package templatefs provides base types for fileserver backends to embed,
+// implementing the bookkeeping every File needs once: identity, ownership,
+// permissions, times and versions. A backend embeds FileBase or DirBase,
+// and only implements the methods it cares about:
+//
+//	type clock struct {
+//		templatefs.FileBase
+//	}
+//
+//	func (c *clock) Open(user string, mode protocol.OpenMode) (fileserver.OpenFile, error) {
+//		if err := c.CheckOpen(user, mode); err != nil {
+//			return nil, err
+//		}
+//		return templatefs.NewReader([]byte(time.Now().String())), nil
+//	}
+//
+//	c := &clock{}
+//	c.Init("clock", 0444, "glenda", "glenda")
+package templatefs
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+)
+
+// ErrPermission is returned when a permission check fails.
+var ErrPermission = fileserver.ErrPermission
+
+var ids uint64
+
+// NextID returns a new qid path from the counter used by Init. Backends
+// that allocate qid paths themselves should use SetID for all their files
+// instead, to avoid collisions.
+func NextID() uint64 {
+	return atomic.AddUint64(&ids, 1)
+}
+
+// FileBase implements the File methods concerning the metadata of a file.
+// Its embedded RWMutex guards the metadata, and may be used by the embedding
+// type for its own state as well. The length of a file is reported as zero,
+// so files with content override Stat to fill it in.
+type FileBase struct {
+	sync.RWMutex
+	id          uint64
+	name        string
+	user        string
+	group       string
+	muser       string
+	permissions protocol.FileMode
+	policy      fileserver.PermissionPolicy
+	atime       time.Time
+	mtime       time.Time
+	version     uint32
+}
+
+// Init initializes the file, allocating a qid path with NextID. It must be
+// called before the file is used.
+func (f *FileBase) Init(name string, permissions protocol.FileMode, user, group string) {
+	now := time.Now()
+	f.id = NextID()
+	f.name = name
+	f.permissions = permissions
+	f.user = user
+	f.group = group
+	f.muser = user
+	f.atime = now
+	f.mtime = now
+}
+
+// SetID sets the qid path of the file.
+func (f *FileBase) SetID(id uint64) {
+	f.Lock()
+	defer f.Unlock()
+	f.id = id
+}
+
+func (f *FileBase) Name() (string, error) {
+	f.RLock()
+	defer f.RUnlock()
+	return f.name, nil
+}
+
+// qid returns the qid of the file. Must be called with the file locked.
+func (f *FileBase) qid() protocol.Qid {
+	t := protocol.QTFILE
+	if f.permissions&protocol.DMDIR != 0 {
+		t = protocol.QTDIR
+	}
+	if f.permissions&protocol.DMAPPEND != 0 {
+		t |= protocol.QTAPPEND
+	}
+	if f.permissions&protocol.DMEXCL != 0 {
+		t |= protocol.QTEXCL
+	}
+	return protocol.Qid{Type: t, Version: f.version, Path: f.id}
+}
+
+func (f *FileBase) Qid() (protocol.Qid, error) {
+	f.RLock()
+	defer f.RUnlock()
+	return f.qid(), nil
+}
+
+func (f *FileBase) Stat() (protocol.Stat, error) {
+	f.RLock()
+	defer f.RUnlock()
+	return protocol.Stat{
+		Qid:   f.qid(),
+		Mode:  f.permissions,
+		Name:  f.name,
+		UID:   f.user,
+		GID:   f.group,
+		MUID:  f.muser,
+		Atime: uint32(f.atime.Unix()),
+		Mtime: uint32(f.mtime.Unix()),
+	}, nil
+}
+
+// WriteStat applies the name, owner, group, mode and mtime of s, except for
+// those set to the "don't touch" values of empty strings and all bits set.
+// The directory bit cannot be changed. The length is ignored, so files that
+// can be truncated override WriteStat to apply it.
+func (f *FileBase) WriteStat(s protocol.Stat) error {
+	f.Lock()
+	defer f.Unlock()
+	if s.Mode != ^protocol.FileMode(0) && s.Mode&protocol.DMDIR != f.permissions&protocol.DMDIR {
+		return errors.New("cannot change the directory bit")
+	}
+
+	if s.Name != "" {
+		f.name = s.Name
+	}
+	if s.UID != "" {
+		f.user = s.UID
+	}
+	if s.GID != "" {
+		f.group = s.GID
+	}
+	if s.Mode != ^protocol.FileMode(0) {
+		f.permissions = s.Mode
+	}
+	if s.Mtime != ^uint32(0) {
+		f.mtime = time.Unix(int64(s.Mtime), 0)
+	}
+	f.version++
+	return nil
+}
+
+func (f *FileBase) IsDir() (bool, error) {
+	f.RLock()
+	defer f.RUnlock()
+	return f.permissions&protocol.DMDIR != 0, nil
+}
+
+func (f *FileBase) CanRemove() (bool, error) {
+	return true, nil
+}
+
+// Permissions returns the owner, group and permissions of the file.
+func (f *FileBase) Permissions() (string, string, protocol.FileMode) {
+	f.RLock()
+	defer f.RUnlock()
+	return f.user, f.group, f.permissions
+}
+
+// SetPermissionPolicy sets the policy deciding access to the file. Without
+// one, fileserver.DefaultPolicy is used.
+func (f *FileBase) SetPermissionPolicy(p fileserver.PermissionPolicy) {
+	f.Lock()
+	defer f.Unlock()
+	f.policy = p
+}
+
+// Allowed reports whether user may open the file with mode.
+func (f *FileBase) Allowed(user string, mode protocol.OpenMode) bool {
+	f.RLock()
+	defer f.RUnlock()
+	return fileserver.Allowed(f.policy, user, f.user, f.group, f.permissions, mode)
+}
+
+// CheckOpen checks that user may open the file with mode, and updates the
+// access time if so. Open methods call it before opening the file.
+func (f *FileBase) CheckOpen(user string, mode protocol.OpenMode) error {
+	f.Lock()
+	defer f.Unlock()
+	if !fileserver.Allowed(f.policy, user, f.user, f.group, f.permissions, mode) {
+		return ErrPermission
+	}
+	f.atime = time.Now()
+	return nil
+}
+
+// Modified records a change of the content of the file by user, updating
+// the modification time and version.
+func (f *FileBase) Modified(user string) {
+	f.Lock()
+	defer f.Unlock()
+	f.muser = user
+	f.mtime = time.Now()
+	f.atime = f.mtime
+	f.version++
+}
@@ -0,0 +1,102 @@
+package templatefs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"sync"
+
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+)
+
+// PageFunc produces the entries of a directory from the index of the first
+// one to produce, returning as many as is convenient, and none once there
+// are no more.
+type PageFunc func(index int) ([]protocol.Stat, error)
+
+var errShortDirRead = errors.New("read too short for directory entry")
+
+// NewLazyListing returns an open directory serving the entries produced by
+// page. Entries are only produced as far as they are read, so that clients
+// listing the start of a large directory, or giving up on it, do not pay for
+// all of it. Reads return whole entries.
+func NewLazyListing(page PageFunc) fileserver.OpenFile {
+	return &lazyListing{page: page}
+}
+
+type lazyListing struct {
+	sync.Mutex
+	page   PageFunc
+	index  int
+	buf    []byte
+	offset int64
+	done   bool
+}
+
+// Seek permits seeking to the start, which lists the directory again, and to
+// the current offset.
+func (l *lazyListing) Seek(offset int64, whence int) (int64, error) {
+	l.Lock()
+	defer l.Unlock()
+	switch whence {
+	case 0:
+	case 1:
+		offset += l.offset
+	default:
+		return l.offset, errors.New("invalid whence value")
+	}
+	switch offset {
+	case l.offset:
+	case 0:
+		l.index, l.buf, l.offset, l.done = 0, nil, 0, false
+	default:
+		return l.offset, errors.New("seek to other than 0 on dir illegal")
+	}
+	return l.offset, nil
+}
+
+func (l *lazyListing) Read(p []byte) (int, error) {
+	l.Lock()
+	defer l.Unlock()
+	for len(l.buf) == 0 && !l.done {
+		stats, err := l.page(l.index)
+		if err != nil {
+			return 0, err
+		}
+		if len(stats) == 0 {
+			l.done = true
+			break
+		}
+		l.index += len(stats)
+		var buf bytes.Buffer
+		for _, st := range stats {
+			st.Encode(&buf)
+		}
+		l.buf = buf.Bytes()
+	}
+
+	n := 0
+	for len(l.buf)-n >= 2 {
+		size := 2 + int(binary.LittleEndian.Uint16(l.buf[n:]))
+		if n+size > len(p) {
+			break
+		}
+		n += size
+	}
+	if n == 0 && len(l.buf) > 0 {
+		return 0, errShortDirRead
+	}
+	copy(p, l.buf[:n])
+	l.buf = l.buf[n:]
+	l.offset += int64(n)
+	return n, nil
+}
+
+func (l *lazyListing) Write(p []byte) (int, error) {
+	return 0, errors.New("cannot write to directory")
+}
+
+func (l *lazyListing) Close() error {
+	return nil
+}
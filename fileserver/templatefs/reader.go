@@ -0,0 +1,70 @@
+package templatefs
+
+import (
+	"errors"
+	"sync"
+)
+
+// Reader is a read-only OpenFile serving a fixed content, for Open methods
+// of files whose content is produced when opened.
+type Reader struct {
+	sync.Mutex
+	content []byte
+	offset  int64
+	closed  bool
+}
+
+// NewReader returns a Reader serving b, which must not be modified.
+func NewReader(b []byte) *Reader {
+	return &Reader{content: b}
+}
+
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	r.Lock()
+	defer r.Unlock()
+	if r.closed {
+		return 0, errors.New("file not open")
+	}
+	length := int64(len(r.content))
+	switch whence {
+	case 0:
+	case 1:
+		offset = r.offset + offset
+	case 2:
+		offset = length + offset
+	default:
+		return r.offset, errors.New("invalid whence value")
+	}
+
+	if offset < 0 {
+		return r.offset, errors.New("negative seek invalid")
+	}
+
+	r.offset = offset
+	return r.offset, nil
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	r.Lock()
+	defer r.Unlock()
+	if r.closed {
+		return 0, errors.New("file not open")
+	}
+	if r.offset >= int64(len(r.content)) {
+		return 0, nil
+	}
+	n := copy(p, r.content[r.offset:])
+	r.offset += int64(n)
+	return n, nil
+}
+
+func (r *Reader) Write(p []byte) (int, error) {
+	return 0, errors.New("file not writable")
+}
+
+func (r *Reader) Close() error {
+	r.Lock()
+	defer r.Unlock()
+	r.closed = true
+	return nil
+}
@@ -2,10 +2,39 @@ package fileserver
 
 import (
 	"errors"
+	"path"
+	"strings"
 
 	"github.com/kennylevinsen/g9p/protocol"
 )
 
+// ErrNotExist is returned by Dir.Walk when the name does not exist.
+var ErrNotExist = errors.New("file does not exist")
+
+// ErrPermission is returned when a user is denied access to a file by its
+// permissions.
+var ErrPermission = errors.New("access denied")
+
+// ErrNotDir is returned when a directory operation, such as a walk, is
+// attempted on a file that is not a directory. The message matches the one
+// used by Plan 9, which the Linux client maps to ENOTDIR.
+var ErrNotDir = errors.New("not a directory")
+
+// asDir returns f as a Dir if it is a directory, and ErrNotDir otherwise.
+// Both IsDir and the Dir interface are checked, so that a File claiming to be
+// a directory without implementing Dir is not mistaken for one.
+func asDir(f File) (Dir, error) {
+	isdir, err := f.IsDir()
+	if err != nil {
+		return nil, err
+	}
+	d, ok := f.(Dir)
+	if !isdir || !ok {
+		return nil, ErrNotDir
+	}
+	return d, nil
+}
+
 type File interface {
 	Name() (string, error)
 
@@ -22,12 +51,17 @@ type File interface {
 type Dir interface {
 	File
 
+	// Walk returns the file called name in the directory, or ErrNotExist.
 	Walk(user, name string) (File, error)
 	Create(user, name string, perms protocol.FileMode) (File, error)
 	Remove(user, name string) error
 	Rename(user, oldname, newname string) error
 }
 
+// OpenFile is an open file. The fileserver always seeks to the offset of a
+// request before reading or writing. OpenFiles that also implement
+// io.ReaderAt or io.WriterAt are accessed through those instead, which avoids
+// serialising concurrent requests on a fid around the shared offset.
 type OpenFile interface {
 	Seek(offset int64, whence int) (int64, error)
 	Read(p []byte) (int, error)
@@ -35,6 +69,101 @@ type OpenFile interface {
 	Close() error
 }
 
+// Interrupter is implemented by OpenFiles whose Read or Write may block.
+// Interrupt is called when a pending request on the file is flushed or the
+// fid is clunked, and must make blocked calls return.
+type Interrupter interface {
+	Interrupt()
+}
+
+// Mover is implemented by Dirs that can move their files to another Dir. It
+// is used for wstat renames to a name containing a slash, which is taken as
+// a path relative to the parent directory, or to the root of the fid if
+// absolute.
+type Mover interface {
+	Move(user, name string, dst Dir, newname string) error
+}
+
+// CreateOpener is implemented by Dirs that can create and open a file in one
+// operation, so that nobody else can get to the file in between. As for
+// Tcreate, the file is opened with mode regardless of perms. When
+// implemented, CreateOpen is used instead of Create followed by Open.
+type CreateOpener interface {
+	CreateOpen(user, name string, perms protocol.FileMode, mode protocol.OpenMode) (File, OpenFile, error)
+}
+
+// XattrFile is implemented by Files that store extended attributes, which
+// are named values like those of Linux. The FileServer only speaks 9P2000,
+// which has no messages for them, and answers 9P2000.L clients with 9P2000,
+// so Txattrwalk and Txattrcreate are never served. The attributes are only
+// reachable by calling these methods directly.
+type XattrFile interface {
+	GetXattr(user, name string) ([]byte, error)
+	// SetXattr sets an attribute, with flags being 0, XattrCreate or
+	// XattrReplace.
+	SetXattr(user, name string, value []byte, flags int) error
+	ListXattr(user string) ([]string, error)
+	RemoveXattr(user, name string) error
+}
+
+// Flags for XattrFile.SetXattr.
+const (
+	// XattrCreate fails if the attribute exists.
+	XattrCreate = 1
+	// XattrReplace fails if the attribute does not exist.
+	XattrReplace = 2
+)
+
+// ErrNoXattr is returned by XattrFile when an attribute does not exist.
+var ErrNoXattr = errors.New("no such attribute")
+
+// Syncer is implemented by OpenFiles, or Files, of backends that can make
+// what has been written durable. Sync returns once it is on stable storage.
+// It is called for a 9P2000 wstat with all fields set to "don't touch",
+// which is how Plan 9 asks for a file to be synced, and by FileServer.Sync.
+// There is no Tfsync, as the FileServer only speaks 9P2000.
+type Syncer interface {
+	Sync() error
+}
+
+// Checksummer is implemented by Files that can produce a checksum of their
+// content faster than by reading it, such as by remembering it until the
+// content changes. Checksum returns the digest of the content with the named
+// algorithm, such as "sha256", or ErrUnknownChecksum, after checking that
+// user may read the file.
+type Checksummer interface {
+	Checksum(user, algorithm string) ([]byte, error)
+}
+
+// ErrUnknownChecksum is returned by Checksummer for unsupported algorithms.
+var ErrUnknownChecksum = errors.New("unknown checksum algorithm")
+
+// Statfs describes the space of a file system, in blocks of BlockSize
+// bytes, and the number of files in it.
+type Statfs struct {
+	BlockSize  uint32
+	Blocks     uint64
+	BlocksFree uint64
+	Files      uint64
+	FilesFree  uint64
+}
+
+// StatfsDir is implemented by Dirs that can describe the file system they
+// are part of.
+type StatfsDir interface {
+	Statfs() (Statfs, error)
+}
+
+// Slicer is implemented by OpenFiles that can hand out their content without
+// copying it, such as in-memory files. Slice returns up to n bytes at offset
+// off, or an empty slice at end of file. The returned slice is sent to the
+// client after Slice returns, so the implementation must not modify it
+// afterwards. When implemented, Slice is used for reads instead of Seek and
+// Read.
+type Slicer interface {
+	Slice(off int64, n int) ([]byte, error)
+}
+
 type FilePath []File
 
 func (fp FilePath) Current() File {
@@ -53,10 +182,59 @@ func (fp FilePath) Parent() File {
 	return fp[len(fp)-2]
 }
 
-func setStat(user string, e File, parent Dir, nstat protocol.Stat) error {
+// resolveMove resolves the target of a wstat rename to name, which contains
+// a slash, for the file at loc. It returns the location of the new parent
+// directory and the new name.
+func resolveMove(user string, loc FilePath, name string) (FilePath, string, error) {
+	var dir FilePath
+	if strings.HasPrefix(name, "/") {
+		dir = append(dir, loc[0])
+	} else {
+		dir = append(dir, loc[:len(loc)-1]...)
+	}
+
+	name = path.Clean(name)
+	elems := strings.Split(strings.Trim(name, "/"), "/")
+	base := elems[len(elems)-1]
+	if base == "" || base == "." || base == ".." {
+		return nil, "", errors.New("invalid name")
+	}
+
+	// The directories on the way are walked as by Twalk, which requires
+	// permission to search them.
+	for _, elem := range elems[:len(elems)-1] {
+		var err error
+		if dir, err = walkStep(user, dir, elem); err != nil {
+			return nil, "", err
+		}
+	}
+
+	if _, err := asDir(dir.Current()); err != nil {
+		return nil, "", err
+	}
+	return dir, base, nil
+}
+
+// isSyncStat reports whether st has all fields set to "don't touch", which
+// makes a wstat a request to sync the file.
+func isSyncStat(st protocol.Stat) bool {
+	return st.Type == ^uint16(0) && st.Dev == ^uint32(0) &&
+		st.Qid.Type == ^protocol.QidType(0) && st.Qid.Version == ^uint32(0) && st.Qid.Path == ^uint64(0) &&
+		st.Mode == ^protocol.FileMode(0) && st.Atime == ^uint32(0) && st.Mtime == ^uint32(0) &&
+		st.Length == ^uint64(0) && st.Name == "" && st.UID == "" && st.GID == "" && st.MUID == ""
+}
+
+// setStat applies a wstat to the file at loc, and returns its new location.
+func setStat(user string, loc FilePath, nstat protocol.Stat) (FilePath, error) {
+	e := loc.Current()
+	var parent Dir
+	if len(loc) > 1 {
+		parent = loc.Parent().(Dir)
+	}
+
 	ostat, err := e.Stat()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	needWrite := false
@@ -65,45 +243,49 @@ func setStat(user string, e File, parent Dir, nstat protocol.Stat) error {
 	newname := ""
 
 	if nstat.Type != ^uint16(0) && nstat.Type != ostat.Type {
-		return errors.New("it is illegal to modify type")
+		return nil, errors.New("it is illegal to modify type")
 	}
 	if nstat.Dev != ^uint32(0) && nstat.Dev != ostat.Dev {
-		return errors.New("it is illegal to modify dev")
+		return nil, errors.New("it is illegal to modify dev")
 	}
 	if nstat.Mode != ^protocol.FileMode(0) && nstat.Mode != ostat.Mode {
-		// TODO Ensure we don't flip DMDIR
+		if nstat.Mode&protocol.DMDIR != ostat.Mode&protocol.DMDIR {
+			return nil, errors.New("it is illegal to change the directory bit")
+		}
 		if user != ostat.UID {
-			return errors.New("only owner can change mode")
+			return nil, errors.New("only owner can change mode")
 		}
-		ostat.Mode = ostat.Mode&protocol.DMDIR | nstat.Mode & ^protocol.DMDIR
+		ostat.Mode = nstat.Mode
 	}
 	if nstat.Atime != ^uint32(0) && nstat.Atime != ostat.Atime {
-		return errors.New("it is illegal to modify atime")
+		return nil, errors.New("it is illegal to modify atime")
 	}
 	if nstat.Mtime != ^uint32(0) && nstat.Mtime != ostat.Mtime {
 		if user != ostat.UID {
-			return errors.New("only owner can change mtime")
+			return nil, errors.New("only owner can change mtime")
 		}
 		needWrite = true
 		ostat.Mtime = nstat.Mtime
 	}
 	if nstat.Length != ^uint64(0) && nstat.Length != ostat.Length {
 		if ostat.Mode&protocol.DMDIR != 0 {
-			return errors.New("cannot set length of directory")
-		}
-		if nstat.Length > ostat.Length {
-			return errors.New("cannot extend length")
+			return nil, errors.New("cannot set length of directory")
 		}
+		needWrite = true
 		ostat.Length = nstat.Length
 	}
 	if nstat.Name != "" && nstat.Name != ostat.Name {
+		// Like create, a file cannot be named "." or "..".
+		if base := path.Base(nstat.Name); base == "." || base == ".." {
+			return nil, errors.New("file name syntax")
+		}
 		if parent != nil {
 			curname = ostat.Name
 			newname = nstat.Name
 			ostat.Name = nstat.Name
 			rename = true
 		} else {
-			return errors.New("it is illegal to rename root")
+			return nil, errors.New("it is illegal to rename root")
 		}
 	}
 	if nstat.UID != "" && nstat.UID != ostat.UID {
@@ -116,23 +298,60 @@ func setStat(user string, e File, parent Dir, nstat protocol.Stat) error {
 		needWrite = true
 	}
 	if nstat.MUID != "" && nstat.MUID != ostat.MUID {
-		return errors.New("it is illegal to modify muid")
+		return nil, errors.New("it is illegal to modify muid")
 	}
 
 	if needWrite {
 		x, err := e.Open(user, protocol.OWRITE)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		x.Close()
 	}
 
-	// Try to perform the rename
-	if rename {
+	if !rename {
+		if err := e.WriteStat(ostat); err != nil {
+			return nil, err
+		}
+		return loc, nil
+	}
+
+	// Try to perform the rename, or move if the new name is a path.
+	dst := append(FilePath(nil), loc[:len(loc)-1]...)
+	var undo func()
+	if strings.Contains(newname, "/") {
+		var base string
+		dst, base, err = resolveMove(user, loc, newname)
+		if err != nil {
+			return nil, err
+		}
+		m, ok := parent.(Mover)
+		if !ok {
+			return nil, errors.New("cannot move between directories")
+		}
+		dstDir := dst.Current().(Dir)
+		if err := m.Move(user, curname, dstDir, base); err != nil {
+			return nil, err
+		}
+		ostat.Name = base
+		undo = func() {
+			if m, ok := dstDir.(Mover); ok {
+				m.Move(user, base, parent, curname)
+			}
+		}
+	} else {
 		if err := parent.Rename(user, curname, newname); err != nil {
-			return err
+			return nil, err
+		}
+		undo = func() {
+			parent.Rename(user, newname, curname)
 		}
 	}
 
-	return e.WriteStat(ostat)
+	if err := e.WriteStat(ostat); err != nil {
+		// Undo the rename, so that a failed wstat changes nothing.
+		undo()
+		return nil, err
+	}
+	return append(dst, e), nil
 }
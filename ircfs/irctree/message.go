@@ -0,0 +1,125 @@
+package irctree
+
+import (
+	"errors"
+	"strings"
+)
+
+var errEmptyMessage = errors.New("empty message")
+
+// message is an IRC protocol message, as in RFC 1459.
+type message struct {
+	prefix  string
+	command string
+	params  []string
+}
+
+// parseMessage parses a line received from a server, without the line
+// ending. Tags, as added by IRCv3 servers, are dropped.
+func parseMessage(line string) (message, error) {
+	var m message
+	line = strings.TrimRight(line, "\r\n")
+	if strings.HasPrefix(line, "@") {
+		idx := strings.IndexByte(line, ' ')
+		if idx == -1 {
+			return m, errEmptyMessage
+		}
+		line = strings.TrimLeft(line[idx+1:], " ")
+	}
+	if strings.HasPrefix(line, ":") {
+		idx := strings.IndexByte(line, ' ')
+		if idx == -1 {
+			return m, errEmptyMessage
+		}
+		m.prefix = line[1:idx]
+		line = strings.TrimLeft(line[idx+1:], " ")
+	}
+
+	for line != "" {
+		if strings.HasPrefix(line, ":") && m.command != "" {
+			m.params = append(m.params, line[1:])
+			break
+		}
+		idx := strings.IndexByte(line, ' ')
+		if idx == -1 {
+			idx = len(line)
+		}
+		if m.command == "" {
+			m.command = strings.ToUpper(line[:idx])
+		} else {
+			m.params = append(m.params, line[:idx])
+		}
+		line = strings.TrimLeft(line[idx:], " ")
+	}
+	if m.command == "" {
+		return m, errEmptyMessage
+	}
+	return m, nil
+}
+
+// nick returns the nickname of the sender, which is empty for messages from
+// the server.
+func (m message) nick() string {
+	idx := strings.IndexAny(m.prefix, "!@")
+	if idx == -1 {
+		if strings.Contains(m.prefix, ".") {
+			return ""
+		}
+		return m.prefix
+	}
+	return m.prefix[:idx]
+}
+
+// param returns the nth parameter, or an empty string.
+func (m message) param(n int) string {
+	if n < len(m.params) {
+		return m.params[n]
+	}
+	return ""
+}
+
+// trailing returns the last parameter.
+func (m message) trailing() string {
+	return m.param(len(m.params) - 1)
+}
+
+// format formats a message to send. The last parameter is always sent as
+// a trailing parameter, and line endings in parameters are dropped, so that
+// they cannot smuggle in other messages.
+func format(command string, params ...string) string {
+	var b strings.Builder
+	b.WriteString(command)
+	for i, p := range params {
+		p = strings.NewReplacer("\r", "", "\n", "").Replace(p)
+		b.WriteByte(' ')
+		if i == len(params)-1 {
+			b.WriteByte(':')
+		}
+		b.WriteString(p)
+	}
+	b.WriteString("\r\n")
+	return b.String()
+}
+
+// isChannel reports whether a target is a channel, rather than a user.
+func isChannel(target string) bool {
+	return target != "" && strings.ContainsRune("#&+!", rune(target[0]))
+}
+
+// fold returns the key of a channel or nickname, which are case-insensitive.
+func fold(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '[':
+			return '{'
+		case ']':
+			return '}'
+		case '\\':
+			return '|'
+		}
+		if r >= 'A' && r <= 'Z' {
+			return r + 'a' - 'A'
+		}
+		return r
+	}, name)
+}
@@ -0,0 +1,818 @@
+// Package irctree is an IRC client served as a file system, in the spirit
+// of ii and irc9p. Every network connected to is a directory, as is every
+// channel joined and every user talking to us privately:
+//
+//	ctl		"connect name dialstring nick", "disconnect name"
+//	net/ctl		"join channel [key]", "part channel [message]",
+//			"nick name", "msg target text", "raw line",
+//			"reconnect" and "quit [message]"
+//	net/in		lines written are sent to the server as they are
+//	net/out		messages from the server not concerning a channel
+//	net/nick	our current nickname
+//	net/chan/in	lines written are sent to the channel, with lines
+//			starting with "/me " sent as actions
+//	net/chan/out	the conversation, one line per read
+//	net/chan/users	the users in the channel, one per line
+//	net/chan/topic	the topic, which is set by writing it
+//
+// Reads of out files block until something is said, and start with the
+// last MaxHistory lines. Removing a channel directory leaves the channel.
+// A dial string of tls!host!port connects with TLS.
+package irctree
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+	"github.com/kennylevinsen/g9ptools/fileserver/ctl"
+	"github.com/kennylevinsen/g9ptools/ramfs/ramtree"
+	"github.com/kennylevinsen/g9ptools/transport"
+)
+
+const (
+	// MaxHistory is the number of lines of an out file that new readers
+	// get first.
+	MaxHistory = 100
+)
+
+var (
+	ErrNotConnected = errors.New("not connected")
+	ErrNoNetwork    = errors.New("no such network")
+	errExists       = errors.New("network already exists")
+	errStreamOnly   = errors.New("out is read-only")
+)
+
+// history is a stream that remembers its last lines, which new readers get
+// before anything sent after they opened it.
+type history struct {
+	sync.Mutex
+	s     *ramtree.Stream
+	lines [][]byte
+}
+
+func newHistory() *history {
+	return &history{s: ramtree.NewStream()}
+}
+
+// send sends a line, prefixed with the time.
+func (h *history) send(format string, args ...interface{}) {
+	line := []byte(time.Now().Format("15:04 ") + fmt.Sprintf(format, args...) + "\n")
+	h.Lock()
+	defer h.Unlock()
+	h.lines = append(h.lines, line)
+	if len(h.lines) > MaxHistory {
+		h.lines = h.lines[1:]
+	}
+	h.s.Send(line)
+}
+
+func (h *history) open(user string, mode protocol.OpenMode) (fileserver.OpenFile, error) {
+	if mode&3 != protocol.OREAD {
+		return nil, errStreamOnly
+	}
+	h.Lock()
+	defer h.Unlock()
+	return h.s.OpenWith(append([][]byte(nil), h.lines...)...), nil
+}
+
+// IRCTree is the root of the file system.
+type IRCTree struct {
+	*ramtree.RAMTree
+	sync.Mutex
+	user     string
+	group    string
+	networks map[string]*network
+}
+
+type network struct {
+	*ramtree.RAMTree
+	sync.Mutex
+	t          *IRCTree
+	name       string
+	dialstring string
+	nick       string
+	state      string
+	conn       net.Conn
+	out        *history
+	channels   map[string]*channel
+}
+
+type channel struct {
+	*ramtree.RAMTree
+	sync.Mutex
+	n     *network
+	name  string
+	query bool
+	topic string
+	users map[string]string
+	names []string
+	out   *history
+}
+
+// Connect adds the network name, connecting to the server at dialstring as
+// nick.
+func (t *IRCTree) Connect(name, dialstring, nick string) error {
+	n := t.newNetwork(name, dialstring, nick)
+	t.Lock()
+	if _, ok := t.networks[name]; ok {
+		t.Unlock()
+		return errExists
+	}
+	t.networks[name] = n
+	t.Unlock()
+
+	if err := t.RAMTree.Add(name, n); err != nil {
+		t.Lock()
+		delete(t.networks, name)
+		t.Unlock()
+		return err
+	}
+	return n.dial()
+}
+
+// Disconnect quits the network name, and removes it.
+func (t *IRCTree) Disconnect(name string) error {
+	t.Lock()
+	n, ok := t.networks[name]
+	delete(t.networks, name)
+	t.Unlock()
+	if !ok {
+		return ErrNoNetwork
+	}
+
+	n.quit("")
+	t.RAMTree.Delete(name)
+	n.out.s.Close()
+	for _, ch := range n.channelList() {
+		ch.out.s.Close()
+	}
+	return nil
+}
+
+func (t *IRCTree) readCtl(string) ([]byte, error) {
+	t.Lock()
+	var names []string
+	for name := range t.networks {
+		names = append(names, name)
+	}
+	t.Unlock()
+	sort.Strings(names)
+
+	var b []byte
+	for _, name := range names {
+		t.Lock()
+		n := t.networks[name]
+		t.Unlock()
+		if n != nil {
+			b = append(b, n.status()...)
+		}
+	}
+	return b, nil
+}
+
+func (t *IRCTree) ctl() *ctl.Parser {
+	p := ctl.NewParser()
+	p.Register(ctl.Command{
+		Name:    "connect",
+		Usage:   "connect name dialstring nick",
+		MinArgs: 3,
+		MaxArgs: 3,
+		Run: func(_ string, args []string) error {
+			return t.Connect(args[0], args[1], args[2])
+		},
+	})
+	p.Register(ctl.Command{
+		Name:    "disconnect",
+		Usage:   "disconnect name",
+		MinArgs: 1,
+		MaxArgs: 1,
+		Run: func(_ string, args []string) error {
+			return t.Disconnect(args[0])
+		},
+	})
+	return p
+}
+
+func (t *IRCTree) Create(user, name string, perms protocol.FileMode) (fileserver.File, error) {
+	return nil, fileserver.ErrPermission
+}
+
+// Remove disconnects from a network.
+func (t *IRCTree) Remove(user, name string) error {
+	if !mayRemove(t.RAMTree, user) {
+		return fileserver.ErrPermission
+	}
+	t.Lock()
+	_, ok := t.networks[name]
+	t.Unlock()
+	if !ok {
+		return fileserver.ErrPermission
+	}
+	return t.Disconnect(name)
+}
+
+func (t *IRCTree) newNetwork(name, dialstring, nick string) *network {
+	n := &network{
+		RAMTree:    ramtree.NewRAMTree(name, 0755, t.user, t.group),
+		t:          t,
+		name:       name,
+		dialstring: dialstring,
+		nick:       nick,
+		state:      "disconnected",
+		out:        newHistory(),
+		channels:   make(map[string]*channel),
+	}
+	n.RAMTree.Add("ctl", ramtree.NewCallbackFile("ctl", 0660, t.user, t.group, n.readCtl, n.ctl().Write))
+	n.RAMTree.Add("in", ramtree.NewCallbackFile("in", 0220, t.user, t.group, nil, n.writeIn))
+	n.RAMTree.Add("out", ramtree.NewSyntheticFile("out", 0440, t.user, t.group, n.out.open))
+	n.RAMTree.Add("nick", ramtree.NewCallbackFile("nick", 0440, t.user, t.group, n.readNick, nil))
+	return n
+}
+
+func (n *network) status() string {
+	n.Lock()
+	defer n.Unlock()
+	return fmt.Sprintf("%s %s %s %s\n", n.name, n.dialstring, n.nick, n.state)
+}
+
+func (n *network) readCtl(string) ([]byte, error) {
+	return []byte(n.status()), nil
+}
+
+func (n *network) readNick(string) ([]byte, error) {
+	n.Lock()
+	defer n.Unlock()
+	return []byte(n.nick + "\n"), nil
+}
+
+// isMe reports whether nick is our nickname.
+func (n *network) isMe(nick string) bool {
+	n.Lock()
+	defer n.Unlock()
+	return fold(nick) == fold(n.nick)
+}
+
+// dial connects to the server and registers.
+func (n *network) dial() error {
+	network, address, err := transport.ParseDialString(n.dialstring)
+	if err != nil {
+		return err
+	}
+	var c net.Conn
+	if network == "tls" {
+		c, err = tls.Dial("tcp", address, &tls.Config{MinVersion: tls.VersionTLS12})
+	} else {
+		c, err = transport.Dial(network, address)
+	}
+	if err != nil {
+		n.out.send("-!- unable to connect: %v", err)
+		return err
+	}
+
+	n.Lock()
+	if n.conn != nil {
+		n.conn.Close()
+	}
+	n.conn = c
+	n.state = "registering"
+	nick := n.nick
+	n.Unlock()
+
+	n.out.send("-!- connected to %s", n.dialstring)
+	go n.read(c)
+	n.send(format("NICK", nick))
+	return n.send(format("USER", nick, "0", "*", nick))
+}
+
+// send sends a formatted line to the server.
+func (n *network) send(line string) error {
+	n.Lock()
+	c := n.conn
+	n.Unlock()
+	if c == nil {
+		return ErrNotConnected
+	}
+	_, err := c.Write([]byte(line))
+	return err
+}
+
+func (n *network) quit(msg string) {
+	n.send(format("QUIT", msg))
+	n.Lock()
+	if n.conn != nil {
+		n.conn.Close()
+		n.conn = nil
+	}
+	n.state = "disconnected"
+	n.Unlock()
+}
+
+// read handles the messages from the server until the connection fails.
+func (n *network) read(c net.Conn) {
+	s := bufio.NewScanner(c)
+	s.Buffer(make([]byte, 4096), 64*1024)
+	for s.Scan() {
+		m, err := parseMessage(s.Text())
+		if err != nil {
+			continue
+		}
+		n.handle(m)
+	}
+
+	n.Lock()
+	current := n.conn == c
+	if current {
+		n.conn = nil
+		n.state = "disconnected"
+	}
+	n.Unlock()
+	c.Close()
+	if current {
+		err := s.Err()
+		if err == nil {
+			err = errors.New("connection closed")
+		}
+		n.out.send("-!- disconnected: %v", err)
+	}
+}
+
+// channel returns the directory of a channel or query, creating it if
+// asked to. It returns nil if there is none.
+func (n *network) channel(name string, create bool) *channel {
+	n.Lock()
+	defer n.Unlock()
+	if ch, ok := n.channels[fold(name)]; ok {
+		return ch
+	}
+	if !create {
+		return nil
+	}
+
+	t := n.t
+	ch := &channel{
+		RAMTree: ramtree.NewRAMTree(name, 0555, t.user, t.group),
+		n:       n,
+		name:    name,
+		query:   !isChannel(name),
+		users:   make(map[string]string),
+		out:     newHistory(),
+	}
+	ch.RAMTree.Add("in", ramtree.NewCallbackFile("in", 0220, t.user, t.group, nil, ch.writeIn))
+	ch.RAMTree.Add("out", ramtree.NewSyntheticFile("out", 0440, t.user, t.group, ch.out.open))
+	ch.RAMTree.Add("users", ramtree.NewCallbackFile("users", 0440, t.user, t.group, ch.readUsers, nil))
+	ch.RAMTree.Add("topic", ramtree.NewCallbackFile("topic", 0660, t.user, t.group, ch.readTopic, ch.writeTopic))
+	if err := n.RAMTree.Add(name, ch); err != nil {
+		// The name is not a valid file name.
+		return nil
+	}
+	n.channels[fold(name)] = ch
+	return ch
+}
+
+func (n *network) channelList() []*channel {
+	n.Lock()
+	defer n.Unlock()
+	var chs []*channel
+	for _, ch := range n.channels {
+		chs = append(chs, ch)
+	}
+	return chs
+}
+
+// dropChannel removes the directory of a channel. Readers of its out file
+// get the rest of the conversation, and then end of file.
+func (n *network) dropChannel(ch *channel) {
+	n.Lock()
+	delete(n.channels, fold(ch.name))
+	n.Unlock()
+	n.RAMTree.Delete(ch.name)
+	ch.out.s.Close()
+}
+
+// outFor returns where to report something concerning target, which is
+// the channel if we have one for it, and the out file of the network
+// otherwise.
+func (n *network) outFor(target string) *history {
+	if ch := n.channel(target, false); ch != nil {
+		return ch.out
+	}
+	return n.out
+}
+
+func (n *network) handle(m message) {
+	from := m.nick()
+	switch m.command {
+	case "PING":
+		n.send(format("PONG", m.trailing()))
+	case "001":
+		n.Lock()
+		n.nick = m.param(0)
+		n.state = "connected"
+		n.Unlock()
+		n.out.send("-!- %s", m.trailing())
+		// Channels are rejoined after reconnecting.
+		for _, ch := range n.channelList() {
+			if !ch.query {
+				n.send(format("JOIN", ch.name))
+			}
+		}
+	case "433":
+		// The nickname is taken. While registering, try another.
+		n.Lock()
+		registering := n.state == "registering"
+		if registering {
+			n.nick += "_"
+		}
+		nick := n.nick
+		n.Unlock()
+		if registering {
+			n.send(format("NICK", nick))
+		}
+		n.out.send("-!- %s", m.trailing())
+	case "NICK":
+		nick := m.param(0)
+		if n.isMe(from) {
+			n.Lock()
+			n.nick = nick
+			n.Unlock()
+			n.out.send("-!- you are now known as %s", nick)
+		}
+		for _, ch := range n.channelList() {
+			if ch.renameUser(from, nick) {
+				ch.out.send("-!- %s is now known as %s", from, nick)
+			}
+		}
+	case "JOIN":
+		ch := n.channel(m.param(0), n.isMe(from))
+		if ch == nil {
+			break
+		}
+		ch.addUsers(from)
+		ch.out.send("-!- %s has joined %s", from, ch.name)
+	case "PART":
+		ch := n.channel(m.param(0), false)
+		if ch == nil {
+			break
+		}
+		ch.out.send("-!- %s has left %s (%s)", from, ch.name, m.param(1))
+		if n.isMe(from) {
+			n.dropChannel(ch)
+		} else {
+			ch.removeUser(from)
+		}
+	case "KICK":
+		ch := n.channel(m.param(0), false)
+		if ch == nil {
+			break
+		}
+		victim := m.param(1)
+		ch.out.send("-!- %s was kicked from %s by %s (%s)", victim, ch.name, from, m.param(2))
+		if n.isMe(victim) {
+			n.out.send("-!- you were kicked from %s by %s (%s)", ch.name, from, m.param(2))
+			n.dropChannel(ch)
+		} else {
+			ch.removeUser(victim)
+		}
+	case "QUIT":
+		for _, ch := range n.channelList() {
+			if ch.removeUser(from) {
+				ch.out.send("-!- %s has quit (%s)", from, m.trailing())
+			}
+		}
+	case "PRIVMSG", "NOTICE":
+		n.message(m)
+	case "TOPIC":
+		ch := n.channel(m.param(0), false)
+		if ch == nil {
+			break
+		}
+		ch.Lock()
+		ch.topic = m.param(1)
+		ch.Unlock()
+		ch.out.send("-!- %s changed the topic to: %s", from, m.param(1))
+	case "332":
+		if ch := n.channel(m.param(1), false); ch != nil {
+			ch.Lock()
+			ch.topic = m.trailing()
+			ch.Unlock()
+		}
+	case "353":
+		if ch := n.channel(m.param(2), false); ch != nil {
+			ch.Lock()
+			ch.names = append(ch.names, strings.Fields(m.trailing())...)
+			ch.Unlock()
+		}
+	case "366":
+		if ch := n.channel(m.param(1), false); ch != nil {
+			ch.Lock()
+			names := ch.names
+			ch.names = nil
+			ch.users = make(map[string]string)
+			ch.Unlock()
+			ch.addUsers(names...)
+		}
+	default:
+		params := m.params
+		if len(m.command) == 3 && len(params) > 0 {
+			// Numeric replies start with our nickname.
+			params = params[1:]
+		}
+		n.out.send("%s", strings.Join(append([]string{m.command}, params...), " "))
+	}
+}
+
+// message reports a PRIVMSG or NOTICE. Messages to us from users go to a
+// directory for the sender.
+func (n *network) message(m message) {
+	from, target, text := m.nick(), m.param(0), m.trailing()
+
+	var out *history
+	switch {
+	case from == "":
+		out = n.out
+	case isChannel(target):
+		out = n.outFor(target)
+	default:
+		if ch := n.channel(from, true); ch != nil {
+			ch.addUsers(from)
+			out = ch.out
+		} else {
+			out = n.out
+		}
+	}
+
+	if strings.HasPrefix(text, "\x01") {
+		// Only actions are shown of the client-to-client protocol.
+		text = strings.Trim(text, "\x01")
+		if strings.HasPrefix(text, "ACTION ") && m.command == "PRIVMSG" {
+			out.send("* %s %s", from, strings.TrimPrefix(text, "ACTION "))
+		}
+		return
+	}
+	switch {
+	case from == "":
+		out.send("-!- %s", text)
+	case m.command == "NOTICE":
+		out.send("-%s- %s", from, text)
+	default:
+		out.send("<%s> %s", from, text)
+	}
+}
+
+// say sends a message to target, and adds it to the conversation, as the
+// server does not echo it back. Lines starting with "/me " are actions.
+func (n *network) say(target, line string) error {
+	n.Lock()
+	nick := n.nick
+	n.Unlock()
+
+	text := line
+	if strings.HasPrefix(line, "/me ") {
+		text = "\x01ACTION " + strings.TrimPrefix(line, "/me ") + "\x01"
+	}
+	if err := n.send(format("PRIVMSG", target, text)); err != nil {
+		return err
+	}
+
+	out := n.out
+	if ch := n.channel(target, !isChannel(target)); ch != nil {
+		out = ch.out
+	}
+	if text != line {
+		out.send("* %s %s", nick, strings.TrimPrefix(line, "/me "))
+	} else {
+		out.send("<%s> %s", nick, line)
+	}
+	return nil
+}
+
+// lines splits a write into its non-empty lines.
+func lines(p []byte) []string {
+	var ls []string
+	for _, l := range strings.Split(string(p), "\n") {
+		if l = strings.TrimRight(l, "\r"); l != "" {
+			ls = append(ls, l)
+		}
+	}
+	return ls
+}
+
+func (n *network) writeIn(_ string, p []byte) (int, error) {
+	for _, l := range lines(p) {
+		if err := n.send(l + "\r\n"); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (n *network) ctl() *ctl.Parser {
+	p := ctl.NewParser()
+	p.Register(ctl.Command{
+		Name:    "join",
+		Usage:   "join channel [key]",
+		MinArgs: 1,
+		MaxArgs: 2,
+		Run: func(_ string, args []string) error {
+			return n.send(format("JOIN", args...))
+		},
+	})
+	p.Register(ctl.Command{
+		Name:    "part",
+		Usage:   "part channel [message]",
+		MinArgs: 1,
+		MaxArgs: -1,
+		Run: func(_ string, args []string) error {
+			return n.send(format("PART", args[0], strings.Join(args[1:], " ")))
+		},
+	})
+	p.Register(ctl.Command{
+		Name:    "nick",
+		Usage:   "nick name",
+		MinArgs: 1,
+		MaxArgs: 1,
+		Run: func(_ string, args []string) error {
+			n.Lock()
+			connected := n.conn != nil
+			if !connected {
+				n.nick = args[0]
+			}
+			n.Unlock()
+			if !connected {
+				return nil
+			}
+			return n.send(format("NICK", args[0]))
+		},
+	})
+	p.Register(ctl.Command{
+		Name:    "msg",
+		Usage:   "msg target text",
+		MinArgs: 2,
+		MaxArgs: -1,
+		Run: func(_ string, args []string) error {
+			return n.say(args[0], strings.Join(args[1:], " "))
+		},
+	})
+	p.Register(ctl.Command{
+		Name:    "raw",
+		Usage:   "raw line",
+		MinArgs: 1,
+		MaxArgs: -1,
+		Run: func(_ string, args []string) error {
+			return n.send(strings.Join(args, " ") + "\r\n")
+		},
+	})
+	p.Register(ctl.Command{
+		Name: "reconnect",
+		Run: func(string, []string) error {
+			n.quit("")
+			return n.dial()
+		},
+	})
+	p.Register(ctl.Command{
+		Name:    "quit",
+		Usage:   "quit [message]",
+		MaxArgs: -1,
+		Run: func(_ string, args []string) error {
+			n.quit(strings.Join(args, " "))
+			return nil
+		},
+	})
+	return p
+}
+
+func (n *network) Create(user, name string, perms protocol.FileMode) (fileserver.File, error) {
+	return nil, fileserver.ErrPermission
+}
+
+// Remove leaves a channel, or forgets a query.
+func (n *network) Remove(user, name string) error {
+	if !mayRemove(n.RAMTree, user) {
+		return fileserver.ErrPermission
+	}
+	ch := n.channel(name, false)
+	if ch == nil {
+		return fileserver.ErrPermission
+	}
+	if !ch.query {
+		n.send(format("PART", ch.name, ""))
+	}
+	n.dropChannel(ch)
+	return nil
+}
+
+// mayRemove reports whether user may remove files from d.
+func mayRemove(d *ramtree.RAMTree, user string) bool {
+	st, err := d.Stat()
+	if err != nil {
+		return false
+	}
+	return fileserver.Allowed(nil, user, st.UID, st.GID, st.Mode, protocol.OWRITE)
+}
+
+func (ch *channel) addUsers(nicks ...string) {
+	ch.Lock()
+	defer ch.Unlock()
+	for _, nick := range nicks {
+		// Drop the prefixes showing channel modes.
+		nick = strings.TrimLeft(nick, "@+%~&")
+		if nick != "" {
+			ch.users[fold(nick)] = nick
+		}
+	}
+}
+
+// removeUser removes a user, reporting whether they were in the channel.
+func (ch *channel) removeUser(nick string) bool {
+	ch.Lock()
+	defer ch.Unlock()
+	_, ok := ch.users[fold(nick)]
+	delete(ch.users, fold(nick))
+	return ok
+}
+
+// renameUser renames a user, reporting whether they were in the channel.
+func (ch *channel) renameUser(old, nick string) bool {
+	ch.Lock()
+	defer ch.Unlock()
+	if _, ok := ch.users[fold(old)]; !ok {
+		return false
+	}
+	delete(ch.users, fold(old))
+	ch.users[fold(nick)] = nick
+	return true
+}
+
+func (ch *channel) readUsers(string) ([]byte, error) {
+	ch.Lock()
+	var nicks []string
+	for _, nick := range ch.users {
+		nicks = append(nicks, nick)
+	}
+	ch.Unlock()
+	sort.Strings(nicks)
+
+	var b []byte
+	for _, nick := range nicks {
+		b = append(b, nick+"\n"...)
+	}
+	return b, nil
+}
+
+func (ch *channel) readTopic(string) ([]byte, error) {
+	ch.Lock()
+	defer ch.Unlock()
+	if ch.topic == "" {
+		return nil, nil
+	}
+	return []byte(ch.topic + "\n"), nil
+}
+
+func (ch *channel) writeTopic(_ string, p []byte) (int, error) {
+	if ch.query {
+		return 0, errors.New("queries have no topic")
+	}
+	topic := strings.TrimRight(string(p), "\r\n")
+	if err := ch.n.send(format("TOPIC", ch.name, topic)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (ch *channel) writeIn(_ string, p []byte) (int, error) {
+	for _, l := range lines(p) {
+		if err := ch.n.say(ch.name, l); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (ch *channel) Create(user, name string, perms protocol.FileMode) (fileserver.File, error) {
+	return nil, fileserver.ErrPermission
+}
+
+// CanRemove always permits removal, as the files of a channel go with it.
+func (ch *channel) CanRemove() (bool, error) {
+	return true, nil
+}
+
+func NewIRCTree(user, group string) *IRCTree {
+	t := &IRCTree{
+		RAMTree:  ramtree.NewRAMTree("/", 0755, user, group),
+		user:     user,
+		group:    group,
+		networks: make(map[string]*network),
+	}
+	t.RAMTree.Add("ctl", ramtree.NewCallbackFile("ctl", 0660, user, group, t.readCtl, t.ctl().Write))
+	return t
+}
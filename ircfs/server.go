@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/kennylevinsen/g9p"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+	"github.com/kennylevinsen/g9ptools/ircfs/irctree"
+	"github.com/kennylevinsen/g9ptools/transport"
+)
+
+func main() {
+	if len(os.Args) < 5 {
+		fmt.Printf("Too few arguments\n")
+		fmt.Printf("%s service UID GID address [name=nick@dialstring...]\n", os.Args[0])
+		fmt.Printf("UID and GID are the user/group that owns /\n")
+		fmt.Printf("address is a dial string, such as :5640, or stdio to serve a single session on standard input and output\n")
+		fmt.Printf("networks to connect to may be given, with tls!host!port connecting with TLS, e.g.:\n")
+		fmt.Printf("  %s irc glenda glenda :5640 libera=glenda@tls!irc.libera.chat!6697\n", os.Args[0])
+		return
+	}
+
+	service := os.Args[1]
+	user := os.Args[2]
+	group := os.Args[3]
+	addr := os.Args[4]
+
+	root := irctree.NewIRCTree(user, group)
+	for _, arg := range os.Args[5:] {
+		eq := strings.Index(arg, "=")
+		at := strings.Index(arg, "@")
+		if eq == -1 || at < eq {
+			log.Fatalf("Invalid network %q: expected name=nick@dialstring", arg)
+		}
+		name, nick, dialstring := arg[:eq], arg[eq+1:at], arg[at+1:]
+		if err := root.Connect(name, dialstring, nick); err != nil {
+			log.Printf("Unable to connect to %s: %v", name, err)
+		}
+	}
+
+	l, err := transport.ListenDialString(addr)
+	if err != nil {
+		log.Fatalf("Unable to listen: %v", err)
+	}
+
+	h := func() g9p.Handler {
+		m := make(map[string]fileserver.Dir)
+		m[service] = root
+		return fileserver.NewFileServer(nil, m, 10*1024*1024, fileserver.Chatty)
+	}
+
+	log.Printf("Starting ircfs at %s", addr)
+	transport.Ready()
+	g9p.ServeListener(l, h)
+}
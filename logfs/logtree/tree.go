@@ -0,0 +1,310 @@
+package logtree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+	"github.com/kennylevinsen/g9ptools/ramfs/ramtree"
+)
+
+const (
+	DefaultMaxSize = 10 * 1024 * 1024
+	DefaultKeep    = 5
+	DefaultTail    = 8 * 1024
+	logSuffix      = ".log"
+)
+
+// Options control rotation and tailing of logs.
+type Options struct {
+	// MaxSize is the size a log may grow to before it is rotated.
+	MaxSize int64
+
+	// Keep is the number of rotated logs to retain.
+	Keep int
+
+	// Tail is the number of bytes of history served to new readers.
+	Tail int64
+}
+
+// LogTree serves append-only logs stored in a directory on disk. Every file
+// created in /log is a log, and each line written to it is timestamped and
+// appended to <dir>/<name>.log. Reading a log returns its tail, and then
+// blocks for new lines like tail -f.
+type LogTree struct {
+	*ramtree.RAMTree
+	logs *logDir
+}
+
+type logDir struct {
+	*ramtree.RAMTree
+	dir   string
+	user  string
+	group string
+	opts  Options
+}
+
+func (d *logDir) Create(user, name string, perms protocol.FileMode) (fileserver.File, error) {
+	if perms&protocol.DMDIR != 0 {
+		return nil, errors.New("cannot create directories in log")
+	}
+	if strings.ContainsAny(name, "/\\") || strings.HasPrefix(name, ".") {
+		return nil, errors.New("invalid log name")
+	}
+	return d.add(name, perms&0666)
+}
+
+func (d *logDir) add(name string, perms protocol.FileMode) (fileserver.File, error) {
+	l := &logger{
+		path:   filepath.Join(d.dir, name+logSuffix),
+		opts:   d.opts,
+		stream: ramtree.NewStream(),
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+
+	f := ramtree.NewSyntheticFile(name, perms, d.user, d.group, l.openFunc)
+	if err := d.RAMTree.Add(name, f); err != nil {
+		l.close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// logger owns the on-disk log for a single name.
+type logger struct {
+	sync.Mutex
+	path   string
+	opts   Options
+	f      *os.File
+	size   int64
+	stream *ramtree.Stream
+}
+
+func (l *logger) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.f = f
+	l.size = st.Size()
+	return nil
+}
+
+func (l *logger) close() {
+	l.Lock()
+	defer l.Unlock()
+	if l.f != nil {
+		l.f.Close()
+		l.f = nil
+	}
+}
+
+// rotate must be called with the logger locked.
+func (l *logger) rotate() error {
+	l.f.Close()
+	l.f = nil
+	for i := l.opts.Keep - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", l.path, i), fmt.Sprintf("%s.%d", l.path, i+1))
+	}
+	if l.opts.Keep > 0 {
+		if err := os.Rename(l.path, l.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(l.path); err != nil {
+		return err
+	}
+	return l.open()
+}
+
+// append writes complete lines to the log, prefixing each with a timestamp.
+func (l *logger) append(lines []byte) error {
+	l.Lock()
+	defer l.Unlock()
+	if l.f == nil {
+		return errors.New("log closed")
+	}
+
+	ts := time.Now().Format(time.RFC3339)
+	buf := new(bytes.Buffer)
+	for _, line := range bytes.SplitAfter(lines, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		fmt.Fprintf(buf, "%s %s", ts, line)
+	}
+
+	if l.size > 0 && l.size+int64(buf.Len()) > l.opts.MaxSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := l.f.Write(buf.Bytes())
+	l.size += int64(n)
+	if err != nil {
+		return err
+	}
+	l.stream.Send(buf.Bytes())
+	return nil
+}
+
+func (l *logger) tail() ([]byte, error) {
+	f, err := os.Open(l.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	off := st.Size() - l.opts.Tail
+	if off < 0 {
+		off = 0
+	}
+	if _, err := f.Seek(off, 0); err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+
+	// Start at a line boundary.
+	if off > 0 {
+		if idx := bytes.IndexByte(b, '\n'); idx != -1 {
+			b = b[idx+1:]
+		}
+	}
+	return b, nil
+}
+
+func (l *logger) openFunc(user string, mode protocol.OpenMode) (fileserver.OpenFile, error) {
+	switch mode & 3 {
+	case protocol.OREAD:
+		l.Lock()
+		defer l.Unlock()
+		b, err := l.tail()
+		if err != nil {
+			return nil, err
+		}
+		if len(b) == 0 {
+			return l.stream.Open(), nil
+		}
+		return l.stream.OpenWith(b), nil
+	case protocol.OWRITE:
+		return &logWriter{l: l}, nil
+	default:
+		return nil, errors.New("logs must be opened for either reading or writing")
+	}
+}
+
+// logWriter collects writes into lines, as a line may span several writes.
+type logWriter struct {
+	sync.Mutex
+	l       *logger
+	partial []byte
+}
+
+func (w *logWriter) Seek(offset int64, whence int) (int64, error) {
+	return offset, nil
+}
+
+func (w *logWriter) Read(p []byte) (int, error) {
+	return 0, errors.New("log not opened for reading")
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+	b := append(w.partial, p...)
+	idx := bytes.LastIndexByte(b, '\n')
+	if idx == -1 {
+		w.partial = b
+		return len(p), nil
+	}
+	w.partial = append([]byte(nil), b[idx+1:]...)
+	if err := w.l.append(b[:idx+1]); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (w *logWriter) Close() error {
+	w.Lock()
+	defer w.Unlock()
+	if len(w.partial) == 0 {
+		return nil
+	}
+	b := append(w.partial, '\n')
+	w.partial = nil
+	return w.l.append(b)
+}
+
+// load adds the logs already present in the directory.
+func (d *logDir) load() error {
+	infos, err := ioutil.ReadDir(d.dir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range infos {
+		if fi.IsDir() || !strings.HasSuffix(fi.Name(), logSuffix) {
+			continue
+		}
+		if _, err := d.add(strings.TrimSuffix(fi.Name(), logSuffix), 0666); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewLogTree serves the logs in dir, which is created if necessary.
+func NewLogTree(dir, user, group string, opts Options) (*LogTree, error) {
+	if opts.MaxSize <= 0 {
+		opts.MaxSize = DefaultMaxSize
+	}
+	if opts.Keep < 0 {
+		opts.Keep = 0
+	}
+	if opts.Tail < 0 {
+		opts.Tail = 0
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	logs := &logDir{
+		RAMTree: ramtree.NewRAMTree("log", 0777, user, group),
+		dir:     dir,
+		user:    user,
+		group:   group,
+		opts:    opts,
+	}
+	if err := logs.load(); err != nil {
+		return nil, err
+	}
+
+	t := &LogTree{
+		RAMTree: ramtree.NewRAMTree("/", 0555, user, group),
+		logs:    logs,
+	}
+	t.RAMTree.Add("log", logs)
+	return t, nil
+}
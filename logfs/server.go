@@ -0,0 +1,58 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/kennylevinsen/g9p"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+	"github.com/kennylevinsen/g9ptools/logfs/logtree"
+	"github.com/kennylevinsen/g9ptools/transport"
+)
+
+func main() {
+	maxSize := flag.Int64("maxsize", logtree.DefaultMaxSize, "size at which logs are rotated")
+	keep := flag.Int("keep", logtree.DefaultKeep, "number of rotated logs to keep")
+	tail := flag.Int64("tail", logtree.DefaultTail, "bytes of history served to new readers")
+	flag.Parse()
+
+	if flag.NArg() < 5 {
+		fmt.Printf("Too few arguments\n")
+		fmt.Printf("%s [-maxsize bytes] [-keep n] [-tail bytes] path service UID GID address\n", os.Args[0])
+		fmt.Printf("UID and GID are the user/group that owns /\n")
+		fmt.Printf("address is a dial string, such as :5640, or stdio to serve a single session on standard input and output\n")
+		return
+	}
+
+	path := flag.Arg(0)
+	service := flag.Arg(1)
+	user := flag.Arg(2)
+	group := flag.Arg(3)
+	addr := flag.Arg(4)
+
+	root, err := logtree.NewLogTree(path, user, group, logtree.Options{
+		MaxSize: *maxSize,
+		Keep:    *keep,
+		Tail:    *tail,
+	})
+	if err != nil {
+		log.Fatalf("Unable to open logs: %v", err)
+	}
+
+	l, err := transport.ListenDialString(addr)
+	if err != nil {
+		log.Fatalf("Unable to listen: %v", err)
+	}
+
+	h := func() g9p.Handler {
+		m := make(map[string]fileserver.Dir)
+		m[service] = root
+		return fileserver.NewFileServer(nil, m, 10*1024*1024, fileserver.Chatty)
+	}
+
+	log.Printf("Starting logfs at %s", addr)
+	transport.Ready()
+	g9p.ServeListener(l, h)
+}
@@ -0,0 +1,466 @@
+// Package mailtree serves a maildir read-only, with mailboxes as
+// directories and messages as directories of their parts:
+//
+//	inbox/			the messages of the maildir itself
+//	name/			the messages of the Maildir++ folder .name
+//	mailbox/id/raw		the message as stored
+//	mailbox/id/header	the header
+//	mailbox/id/body		the body, as stored
+//	mailbox/id/subject	the subject, from, to and date headers,
+//	mailbox/id/from		decoded, one line each
+//	mailbox/id/to
+//	mailbox/id/date
+//	mailbox/id/flags	the maildir flags, such as S for seen
+//
+// Messages are named by the unique part of their maildir file name, which
+// stays the same as their flags change and they move from new to cur, and
+// are listed in order of delivery. Mailboxes are listed a page at a time,
+// as they are read, so that large ones are cheap to open.
+//
+// Only local maildirs are served. IMAP accounts can be served by
+// synchronizing them to a maildir, such as with mbsync or offlineimap.
+package mailtree
+
+import (
+	"bytes"
+	"errors"
+	"hash/fnv"
+	"io/ioutil"
+	"mime"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+	"github.com/kennylevinsen/g9ptools/fileserver/templatefs"
+)
+
+const (
+	// Inbox is the name of the mailbox of the maildir itself.
+	Inbox = "inbox"
+
+	// PageSize is the number of messages listed at a time.
+	PageSize = 256
+)
+
+var errReadOnly = errors.New("mail is read-only")
+
+// parts are the files of a message.
+var parts = []string{"raw", "header", "body", "subject", "from", "to", "date", "flags"}
+
+// id returns a qid path for the file at p, relative to the maildir. Paths
+// are hashed, so that the qid of a file stays the same across walks, and
+// have the top bit set, so that they do not collide with the qid paths
+// allocated by templatefs.NextID.
+func id(p string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(p))
+	return h.Sum64() | 1<<63
+}
+
+// readOnly implements the methods common to all files of the tree.
+type readOnly struct {
+	templatefs.FileBase
+	mtime time.Time
+	size  int64
+}
+
+func (f *readOnly) init(p, name string, perms protocol.FileMode, user, group string, fi os.FileInfo) {
+	f.Init(name, perms, user, group)
+	f.SetID(id(p))
+	if fi != nil {
+		f.mtime = fi.ModTime()
+		if !fi.IsDir() {
+			f.size = fi.Size()
+		}
+	}
+}
+
+func (f *readOnly) Stat() (protocol.Stat, error) {
+	st, err := f.FileBase.Stat()
+	if !f.mtime.IsZero() {
+		st.Mtime = uint32(f.mtime.Unix())
+	}
+	st.Length = uint64(f.size)
+	return st, err
+}
+
+func (f *readOnly) WriteStat(protocol.Stat) error {
+	return errReadOnly
+}
+
+func (f *readOnly) Create(user, name string, perms protocol.FileMode) (fileserver.File, error) {
+	return nil, errReadOnly
+}
+
+func (f *readOnly) Remove(user, name string) error {
+	return errReadOnly
+}
+
+func (f *readOnly) Rename(user, oldname, newname string) error {
+	return errReadOnly
+}
+
+// MailTree is the root of the tree, listing the mailboxes of a maildir.
+type MailTree struct {
+	readOnly
+	root  string
+	user  string
+	group string
+}
+
+// mailboxPath returns the directory of a mailbox.
+func (t *MailTree) mailboxPath(name string) (string, bool) {
+	if name == Inbox {
+		return t.root, true
+	}
+	if name == "" || strings.HasPrefix(name, ".") || strings.ContainsAny(name, "/\\") {
+		return "", false
+	}
+	return filepath.Join(t.root, "."+name), true
+}
+
+// mailboxes returns the names of the mailboxes.
+func (t *MailTree) mailboxes() ([]string, error) {
+	names := []string{Inbox}
+	fis, err := ioutil.ReadDir(t.root)
+	if err != nil {
+		return nil, err
+	}
+	for _, fi := range fis {
+		name := fi.Name()
+		if !fi.IsDir() || !strings.HasPrefix(name, ".") || name == "." || name == ".." {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(t.root, name, "cur")); err != nil {
+			continue
+		}
+		names = append(names, name[1:])
+	}
+	return names, nil
+}
+
+func (t *MailTree) Walk(user, name string) (fileserver.File, error) {
+	if !t.Allowed(user, protocol.OEXEC) {
+		return nil, templatefs.ErrPermission
+	}
+	p, ok := t.mailboxPath(name)
+	if !ok {
+		return nil, fileserver.ErrNotExist
+	}
+	fi, err := os.Stat(filepath.Join(p, "cur"))
+	if err != nil || !fi.IsDir() {
+		return nil, fileserver.ErrNotExist
+	}
+	return t.newMailbox(name, p, fi), nil
+}
+
+func (t *MailTree) Open(user string, mode protocol.OpenMode) (fileserver.OpenFile, error) {
+	if mode&3 != protocol.OREAD || mode&protocol.OTRUNC != 0 {
+		return nil, errReadOnly
+	}
+	if err := t.CheckOpen(user, mode); err != nil {
+		return nil, err
+	}
+	names, err := t.mailboxes()
+	if err != nil {
+		return nil, err
+	}
+	var stats []protocol.Stat
+	for _, name := range names {
+		f, err := t.Walk(user, name)
+		if err != nil {
+			continue
+		}
+		st, err := f.Stat()
+		if err != nil {
+			return nil, err
+		}
+		stats = append(stats, st)
+	}
+	return templatefs.NewListing(stats), nil
+}
+
+// mailbox is a directory of messages.
+type mailbox struct {
+	readOnly
+	t    *MailTree
+	name string
+	path string
+}
+
+func (t *MailTree) newMailbox(name, p string, fi os.FileInfo) *mailbox {
+	mb := &mailbox{t: t, name: name, path: p}
+	mb.init(name, name, protocol.DMDIR|0500, t.user, t.group, fi)
+	return mb
+}
+
+// split splits a maildir file name into its unique part and its info.
+func split(filename string) (string, string) {
+	if idx := strings.IndexByte(filename, ':'); idx != -1 {
+		return filename[:idx], filename[idx+1:]
+	}
+	return filename, ""
+}
+
+// messages returns the unique names of the messages, in order of delivery.
+// Maildir names start with the time of delivery, so this is mostly by name.
+func (mb *mailbox) messages() ([]string, error) {
+	var names []string
+	for _, sub := range []string{"new", "cur"} {
+		d, err := os.Open(filepath.Join(mb.path, sub))
+		if err != nil {
+			continue
+		}
+		filenames, err := d.Readdirnames(-1)
+		d.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, filename := range filenames {
+			if !strings.HasPrefix(filename, ".") {
+				unique, _ := split(filename)
+				names = append(names, unique)
+			}
+		}
+	}
+	sort.Slice(names, func(i, j int) bool {
+		ti, tj := deliveryTime(names[i]), deliveryTime(names[j])
+		if ti != tj {
+			return ti < tj
+		}
+		return names[i] < names[j]
+	})
+	return names, nil
+}
+
+// deliveryTime returns the time of delivery in the unique part of a maildir
+// file name, or zero if there is none.
+func deliveryTime(unique string) int64 {
+	var t int64
+	for _, c := range unique {
+		if c < '0' || c > '9' {
+			break
+		}
+		t = t*10 + int64(c-'0')
+	}
+	return t
+}
+
+// find returns the path of a message, which changes as the message moves
+// from new to cur and its flags change.
+func (mb *mailbox) find(unique string) (string, os.FileInfo, error) {
+	if unique == "" || strings.HasPrefix(unique, ".") || strings.ContainsAny(unique, "/\\:") {
+		return "", nil, fileserver.ErrNotExist
+	}
+	p := filepath.Join(mb.path, "new", unique)
+	if fi, err := os.Stat(p); err == nil {
+		return p, fi, nil
+	}
+	cur := filepath.Join(mb.path, "cur")
+	d, err := os.Open(cur)
+	if err != nil {
+		return "", nil, fileserver.ErrNotExist
+	}
+	defer d.Close()
+	filenames, err := d.Readdirnames(-1)
+	if err != nil {
+		return "", nil, err
+	}
+	for _, filename := range filenames {
+		if u, _ := split(filename); u == unique {
+			p := filepath.Join(cur, filename)
+			fi, err := os.Stat(p)
+			if err != nil {
+				return "", nil, fileserver.ErrNotExist
+			}
+			return p, fi, nil
+		}
+	}
+	return "", nil, fileserver.ErrNotExist
+}
+
+func (mb *mailbox) Walk(user, name string) (fileserver.File, error) {
+	if !mb.Allowed(user, protocol.OEXEC) {
+		return nil, templatefs.ErrPermission
+	}
+	_, fi, err := mb.find(name)
+	if err != nil {
+		return nil, err
+	}
+	return mb.newMessage(name, fi), nil
+}
+
+func (mb *mailbox) Open(user string, mode protocol.OpenMode) (fileserver.OpenFile, error) {
+	if mode&3 != protocol.OREAD || mode&protocol.OTRUNC != 0 {
+		return nil, errReadOnly
+	}
+	if err := mb.CheckOpen(user, mode); err != nil {
+		return nil, err
+	}
+	names, err := mb.messages()
+	if err != nil {
+		return nil, err
+	}
+	return templatefs.NewLazyListing(func(index int) ([]protocol.Stat, error) {
+		var stats []protocol.Stat
+		for ; index < len(names) && len(stats) < PageSize; index++ {
+			_, fi, err := mb.find(names[index])
+			if err != nil {
+				// Removed since listed.
+				continue
+			}
+			st, err := mb.newMessage(names[index], fi).Stat()
+			if err != nil {
+				return nil, err
+			}
+			stats = append(stats, st)
+		}
+		return stats, nil
+	}), nil
+}
+
+// message is the directory of a message.
+type message struct {
+	readOnly
+	mb     *mailbox
+	unique string
+}
+
+func (mb *mailbox) newMessage(unique string, fi os.FileInfo) *message {
+	m := &message{mb: mb, unique: unique}
+	m.init(mb.name+"/"+unique, unique, protocol.DMDIR|0500, mb.t.user, mb.t.group, fi)
+	return m
+}
+
+func (m *message) Walk(user, name string) (fileserver.File, error) {
+	if !m.Allowed(user, protocol.OEXEC) {
+		return nil, templatefs.ErrPermission
+	}
+	for _, part := range parts {
+		if part == name {
+			return m.newPart(name)
+		}
+	}
+	return nil, fileserver.ErrNotExist
+}
+
+func (m *message) Open(user string, mode protocol.OpenMode) (fileserver.OpenFile, error) {
+	if mode&3 != protocol.OREAD || mode&protocol.OTRUNC != 0 {
+		return nil, errReadOnly
+	}
+	if err := m.CheckOpen(user, mode); err != nil {
+		return nil, err
+	}
+	var stats []protocol.Stat
+	for _, name := range parts {
+		f, err := m.newPart(name)
+		if err != nil {
+			return nil, err
+		}
+		st, err := f.Stat()
+		if err != nil {
+			return nil, err
+		}
+		stats = append(stats, st)
+	}
+	return templatefs.NewListing(stats), nil
+}
+
+// part is a file of a message.
+type part struct {
+	readOnly
+	m    *message
+	name string
+}
+
+func (m *message) newPart(name string) (*part, error) {
+	_, fi, err := m.mb.find(m.unique)
+	if err != nil {
+		return nil, err
+	}
+	p := &part{m: m, name: name}
+	p.init(m.mb.name+"/"+m.unique+"/"+name, name, 0400, m.mb.t.user, m.mb.t.group, fi)
+	if name != "raw" {
+		// The length of the other parts is only known once produced.
+		p.size = 0
+	}
+	return p, nil
+}
+
+func (p *part) Open(user string, mode protocol.OpenMode) (fileserver.OpenFile, error) {
+	if mode&3 != protocol.OREAD || mode&protocol.OTRUNC != 0 {
+		return nil, errReadOnly
+	}
+	if err := p.CheckOpen(user, mode); err != nil {
+		return nil, err
+	}
+	path, _, err := p.m.mb.find(p.m.unique)
+	if err != nil {
+		return nil, err
+	}
+	if p.name == "flags" {
+		_, info := split(filepath.Base(path))
+		return templatefs.NewReader([]byte(strings.TrimPrefix(info, "2,") + "\n")), nil
+	}
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	b, err := extract(raw, p.name)
+	if err != nil {
+		return nil, err
+	}
+	return templatefs.NewReader(b), nil
+}
+
+// headerEnd returns the length of the header of a message, including the
+// blank line ending it.
+func headerEnd(raw []byte) int {
+	for _, sep := range []string{"\r\n\r\n", "\n\n"} {
+		if idx := bytes.Index(raw, []byte(sep)); idx != -1 {
+			return idx + len(sep)
+		}
+	}
+	return len(raw)
+}
+
+// extract returns a part of a message.
+func extract(raw []byte, name string) ([]byte, error) {
+	switch name {
+	case "raw":
+		return raw, nil
+	case "header":
+		return raw[:headerEnd(raw)], nil
+	case "body":
+		return raw[headerEnd(raw):], nil
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	v := msg.Header.Get(strings.Title(name))
+	var dec mime.WordDecoder
+	if d, err := dec.DecodeHeader(v); err == nil {
+		v = d
+	}
+	return []byte(v + "\n"), nil
+}
+
+func NewMailTree(root, user, group string) (*MailTree, error) {
+	fi, err := os.Stat(filepath.Join(root, "cur"))
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, errors.New("not a maildir")
+	}
+	t := &MailTree{root: root, user: user, group: group}
+	t.init("", "/", protocol.DMDIR|0500, user, group, fi)
+	return t, nil
+}
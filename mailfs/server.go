@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/kennylevinsen/g9p"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+	"github.com/kennylevinsen/g9ptools/mailfs/mailtree"
+	"github.com/kennylevinsen/g9ptools/transport"
+)
+
+func main() {
+	if len(os.Args) < 6 {
+		fmt.Printf("Too few arguments\n")
+		fmt.Printf("%s maildir service UID GID address\n", os.Args[0])
+		fmt.Printf("maildir is the maildir to serve, read-only, with its Maildir++ folders\n")
+		fmt.Printf("UID and GID are the user/group that owns the mail\n")
+		fmt.Printf("address is a dial string, such as :5640, or stdio to serve a single session on standard input and output\n")
+		return
+	}
+
+	maildir := os.Args[1]
+	service := os.Args[2]
+	user := os.Args[3]
+	group := os.Args[4]
+	addr := os.Args[5]
+
+	root, err := mailtree.NewMailTree(maildir, user, group)
+	if err != nil {
+		log.Fatalf("Unable to open maildir: %v", err)
+	}
+
+	l, err := transport.ListenDialString(addr)
+	if err != nil {
+		log.Fatalf("Unable to listen: %v", err)
+	}
+
+	h := func() g9p.Handler {
+		m := make(map[string]fileserver.Dir)
+		m[service] = root
+		return fileserver.NewFileServer(nil, m, 10*1024*1024, fileserver.Chatty)
+	}
+
+	log.Printf("Starting mailfs at %s", addr)
+	transport.Ready()
+	g9p.ServeListener(l, h)
+}
@@ -0,0 +1,130 @@
+package mqtree
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+	"github.com/kennylevinsen/g9ptools/ramfs/ramtree"
+)
+
+// MQTree is a publish/subscribe message bus. Every directory created in the
+// root is a topic. Each write to <topic>/in publishes a message, and every
+// open handle of <topic>/out receives the messages published after it was
+// opened, one message per read. Reads of out block until a message arrives.
+// Removing a topic ends the streams of its subscribers.
+type MQTree struct {
+	*ramtree.RAMTree
+	sync.Mutex
+	user   string
+	group  string
+	topics map[string]*Topic
+}
+
+// Topic is a single topic directory.
+type Topic struct {
+	*ramtree.RAMTree
+	stream *ramtree.Stream
+}
+
+// Publish sends a message to all current subscribers of the topic.
+func (t *Topic) Publish(msg []byte) {
+	t.stream.Send(append([]byte(nil), msg...))
+}
+
+func (t *Topic) writeIn(_ string, p []byte) (int, error) {
+	t.Publish(p)
+	return len(p), nil
+}
+
+func (t *Topic) Create(user, name string, perms protocol.FileMode) (fileserver.File, error) {
+	return nil, fileserver.ErrPermission
+}
+
+// CanRemove always permits removal, as the files of a topic go with it.
+func (t *Topic) CanRemove() (bool, error) {
+	return true, nil
+}
+
+// Create creates a new topic. Only directories may be created.
+func (t *MQTree) Create(user, name string, perms protocol.FileMode) (fileserver.File, error) {
+	if perms&protocol.DMDIR == 0 {
+		return nil, errors.New("only topics can be created")
+	}
+
+	topic := t.newTopic(name, perms&0777)
+	if err := t.RAMTree.Add(name, topic); err != nil {
+		return nil, err
+	}
+
+	t.Lock()
+	t.topics[name] = topic
+	t.Unlock()
+	return topic, nil
+}
+
+func (t *MQTree) Remove(user, name string) error {
+	if err := t.RAMTree.Remove(user, name); err != nil {
+		return err
+	}
+
+	t.Lock()
+	topic := t.topics[name]
+	delete(t.topics, name)
+	t.Unlock()
+
+	if topic != nil {
+		topic.stream.Close()
+	}
+	return nil
+}
+
+func (t *MQTree) Rename(user, oldname, newname string) error {
+	if err := t.RAMTree.Rename(user, oldname, newname); err != nil {
+		return err
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	if topic, ok := t.topics[oldname]; ok {
+		delete(t.topics, oldname)
+		t.topics[newname] = topic
+	}
+	return nil
+}
+
+// Topic returns the named topic, creating it if necessary.
+func (t *MQTree) Topic(name string) (*Topic, error) {
+	t.Lock()
+	topic, ok := t.topics[name]
+	t.Unlock()
+	if ok {
+		return topic, nil
+	}
+
+	f, err := t.Create(t.user, name, protocol.DMDIR|0777)
+	if err != nil {
+		return nil, err
+	}
+	return f.(*Topic), nil
+}
+
+func (t *MQTree) newTopic(name string, perms protocol.FileMode) *Topic {
+	topic := &Topic{
+		RAMTree: ramtree.NewRAMTree(name, perms|0111, t.user, t.group),
+		stream:  ramtree.NewStream(),
+	}
+	topic.RAMTree.Add("in", ramtree.NewCallbackFile("in", 0222, t.user, t.group, nil, topic.writeIn))
+	topic.RAMTree.Add("out", ramtree.NewStreamFile("out", 0444, t.user, t.group, topic.stream))
+	return topic
+}
+
+func NewMQTree(user, group string) *MQTree {
+	return &MQTree{
+		RAMTree: ramtree.NewRAMTree("/", 0777, user, group),
+		user:    user,
+		group:   group,
+		topics:  make(map[string]*Topic),
+	}
+}
@@ -0,0 +1,462 @@
+package nettree
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+	"github.com/kennylevinsen/g9ptools/fileserver/ctl"
+	"github.com/kennylevinsen/g9ptools/ramfs/ramtree"
+)
+
+var (
+	ErrNotConnected = errors.New("not connected")
+	ErrNotAnnounced = errors.New("not announced")
+	ErrInUse        = errors.New("connection in use")
+)
+
+// NetTree implements the Plan 9 network interface for TCP and UDP. Opening
+// <proto>/clone allocates a connection directory containing ctl, data,
+// listen, local, remote and status files, and the clone file then acts as
+// the ctl file of the connection. Connections are closed when the last file
+// referencing them is closed.
+//
+// Unlike Plan 9, opening listen does not block. Instead, the first read of
+// listen blocks until a call arrives, and returns the number of the new
+// connection. The listen handle then acts as its ctl file.
+type NetTree struct {
+	*ramtree.RAMTree
+}
+
+type protoDir struct {
+	*ramtree.RAMTree
+	sync.Mutex
+	proto string
+	user  string
+	group string
+	next  int
+}
+
+type conn struct {
+	sync.Mutex
+	id       int
+	p        *protoDir
+	refs     int
+	state    string
+	c        net.Conn
+	l        net.Listener
+	incoming chan net.Conn
+}
+
+func (c *conn) ref() {
+	c.Lock()
+	defer c.Unlock()
+	c.refs++
+}
+
+func (c *conn) unref() {
+	c.Lock()
+	c.refs--
+	if c.refs > 0 {
+		c.Unlock()
+		return
+	}
+	c.hangup()
+	c.Unlock()
+	c.p.RAMTree.Delete(strconv.Itoa(c.id))
+}
+
+// hangup must be called with the connection locked.
+func (c *conn) hangup() {
+	if c.c != nil {
+		c.c.Close()
+		c.c = nil
+	}
+	if c.l != nil {
+		c.l.Close()
+		c.l = nil
+	}
+	c.state = "Closed"
+}
+
+// dialAddr converts a Plan 9 address (net!host!port) to a Go address.
+func dialAddr(addr string) (string, error) {
+	parts := strings.Split(addr, "!")
+	switch len(parts) {
+	case 3:
+		parts = parts[1:]
+	case 2:
+	case 1:
+		// A bare port, as used by announce.
+		parts = []string{"*", parts[0]}
+	default:
+		return "", fmt.Errorf("malformed address: %s", addr)
+	}
+	host := parts[0]
+	if host == "*" {
+		host = ""
+	}
+	return net.JoinHostPort(host, parts[1]), nil
+}
+
+// netAddr converts a Go address to a Plan 9 address.
+func netAddr(a net.Addr) string {
+	if a == nil {
+		return "::!0"
+	}
+	host, port, err := net.SplitHostPort(a.String())
+	if err != nil {
+		return a.String()
+	}
+	return host + "!" + port
+}
+
+func (c *conn) ctl(cmd string) error {
+	fields, err := ctl.Tokenize(cmd)
+	if err != nil {
+		return err
+	}
+	if len(fields) == 0 {
+		return ctl.ErrEmpty
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	switch fields[0] {
+	case "connect":
+		if len(fields) < 2 {
+			return errors.New("connect needs an address")
+		}
+		if c.c != nil || c.l != nil {
+			return ErrInUse
+		}
+		addr, err := dialAddr(fields[1])
+		if err != nil {
+			return err
+		}
+		nc, err := net.Dial(c.p.proto, addr)
+		if err != nil {
+			return err
+		}
+		c.c = nc
+		c.state = "Established"
+	case "announce":
+		if len(fields) < 2 {
+			return errors.New("announce needs an address")
+		}
+		if c.c != nil || c.l != nil {
+			return ErrInUse
+		}
+		if c.p.proto != "tcp" {
+			return fmt.Errorf("announce not supported for %s", c.p.proto)
+		}
+		addr, err := dialAddr(fields[1])
+		if err != nil {
+			return err
+		}
+		l, err := net.Listen(c.p.proto, addr)
+		if err != nil {
+			return err
+		}
+		c.l = l
+		c.incoming = make(chan net.Conn)
+		c.state = "Announced"
+		go c.accept(l, c.incoming)
+	case "hangup":
+		c.hangup()
+	default:
+		return fmt.Errorf("unknown ctl command: %s", fields[0])
+	}
+	return nil
+}
+
+func (c *conn) accept(l net.Listener, incoming chan net.Conn) {
+	defer close(incoming)
+	for {
+		nc, err := l.Accept()
+		if err != nil {
+			return
+		}
+		incoming <- nc
+	}
+}
+
+func (c *conn) readID(string) ([]byte, error) {
+	return []byte(strconv.Itoa(c.id)), nil
+}
+
+func (c *conn) writeCtl(_ string, p []byte) (int, error) {
+	if err := c.ctl(string(p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *conn) readStatus(string) ([]byte, error) {
+	c.Lock()
+	defer c.Unlock()
+	return []byte(fmt.Sprintf("%s\n", c.state)), nil
+}
+
+func (c *conn) readLocal(string) ([]byte, error) {
+	c.Lock()
+	defer c.Unlock()
+	switch {
+	case c.c != nil:
+		return []byte(netAddr(c.c.LocalAddr()) + "\n"), nil
+	case c.l != nil:
+		return []byte(netAddr(c.l.Addr()) + "\n"), nil
+	}
+	return []byte(netAddr(nil) + "\n"), nil
+}
+
+func (c *conn) readRemote(string) ([]byte, error) {
+	c.Lock()
+	defer c.Unlock()
+	if c.c != nil {
+		return []byte(netAddr(c.c.RemoteAddr()) + "\n"), nil
+	}
+	return []byte(netAddr(nil) + "\n"), nil
+}
+
+// opener wraps an OpenFunc so that the handle holds a reference to the
+// connection for as long as it is open.
+func (c *conn) opener(open ramtree.OpenFunc) ramtree.OpenFunc {
+	return ramtree.RefOpener(open, c.ref, c.unref)
+}
+
+func (c *conn) openData(user string, mode protocol.OpenMode) (fileserver.OpenFile, error) {
+	c.Lock()
+	defer c.Unlock()
+	if c.c == nil {
+		return nil, ErrNotConnected
+	}
+	return &dataOpenFile{c: c.c}, nil
+}
+
+func (c *conn) openListen(user string, mode protocol.OpenMode) (fileserver.OpenFile, error) {
+	c.Lock()
+	defer c.Unlock()
+	if c.l == nil {
+		return nil, ErrNotAnnounced
+	}
+	return &listenOpenFile{c: c, incoming: c.incoming, intr: make(chan struct{})}, nil
+}
+
+// dataOpenFile reads and writes the network connection directly. Offsets are
+// ignored.
+type dataOpenFile struct {
+	sync.Mutex
+	c net.Conn
+	// reads counts the Reads in progress, which are all Interrupt
+	// interrupts. interrupted is set if it did.
+	reads       int
+	interrupted bool
+}
+
+func (of *dataOpenFile) Seek(offset int64, whence int) (int64, error) {
+	return offset, nil
+}
+
+func (of *dataOpenFile) Read(p []byte) (int, error) {
+	of.Lock()
+	of.reads++
+	of.Unlock()
+
+	n, err := of.c.Read(p)
+
+	of.Lock()
+	defer of.Unlock()
+	of.reads--
+	if of.interrupted {
+		if of.reads == 0 {
+			of.interrupted = false
+			of.c.SetReadDeadline(time.Time{})
+		}
+		if n == 0 {
+			return 0, ramtree.ErrInterrupted
+		}
+		return n, nil
+	}
+	return n, err
+}
+
+func (of *dataOpenFile) Write(p []byte) (int, error) {
+	return of.c.Write(p)
+}
+
+func (of *dataOpenFile) Interrupt() {
+	of.Lock()
+	defer of.Unlock()
+	if of.reads == 0 {
+		return
+	}
+	of.interrupted = true
+	of.c.SetReadDeadline(time.Now())
+}
+
+func (of *dataOpenFile) Close() error {
+	return nil
+}
+
+// listenOpenFile waits for an incoming call on its first read, after which it
+// is the ctl file of the new connection.
+type listenOpenFile struct {
+	sync.Mutex
+	c        *conn
+	incoming chan net.Conn
+	intr     chan struct{}
+	ctl      fileserver.OpenFile
+	nc       *conn
+}
+
+func (of *listenOpenFile) Seek(offset int64, whence int) (int64, error) {
+	of.Lock()
+	ctl := of.ctl
+	of.Unlock()
+	if ctl != nil {
+		return ctl.Seek(offset, whence)
+	}
+	return offset, nil
+}
+
+func (of *listenOpenFile) Read(p []byte) (int, error) {
+	of.Lock()
+	ctl := of.ctl
+	intr := of.intr
+	of.Unlock()
+	if ctl != nil {
+		return ctl.Read(p)
+	}
+
+	var nc net.Conn
+	select {
+	case c, ok := <-of.incoming:
+		if !ok {
+			return 0, errors.New("listener closed")
+		}
+		nc = c
+	case <-intr:
+		return 0, ramtree.ErrInterrupted
+	}
+
+	c, err := of.c.p.newConn()
+	if err != nil {
+		nc.Close()
+		return 0, err
+	}
+	c.Lock()
+	c.c = nc
+	c.state = "Established"
+	c.Unlock()
+
+	ctl, err = c.opener(ramtree.CallbackOpener(c.readID, c.writeCtl))("", protocol.ORDWR)
+	if err != nil {
+		return 0, err
+	}
+
+	of.Lock()
+	of.ctl = ctl
+	of.Unlock()
+	return ctl.Read(p)
+}
+
+func (of *listenOpenFile) Write(p []byte) (int, error) {
+	of.Lock()
+	ctl := of.ctl
+	of.Unlock()
+	if ctl == nil {
+		return 0, errors.New("no call accepted")
+	}
+	return ctl.Write(p)
+}
+
+func (of *listenOpenFile) Interrupt() {
+	of.Lock()
+	defer of.Unlock()
+	close(of.intr)
+	of.intr = make(chan struct{})
+}
+
+func (of *listenOpenFile) Close() error {
+	of.Lock()
+	defer of.Unlock()
+	if of.ctl != nil {
+		return of.ctl.Close()
+	}
+	return nil
+}
+
+func (p *protoDir) newConn() (*conn, error) {
+	p.Lock()
+	id := p.next
+	p.next++
+	p.Unlock()
+
+	c := &conn{
+		id:    id,
+		p:     p,
+		state: "Closed",
+	}
+
+	dir := ramtree.NewRAMTree(strconv.Itoa(id), 0555, p.user, p.group)
+	files := []*ramtree.SyntheticFile{
+		ramtree.NewSyntheticFile("ctl", 0666, p.user, p.group, c.opener(ramtree.CallbackOpener(c.readID, c.writeCtl))),
+		ramtree.NewSyntheticFile("data", 0666, p.user, p.group, c.opener(c.openData)),
+		ramtree.NewSyntheticFile("listen", 0666, p.user, p.group, c.opener(c.openListen)),
+		ramtree.NewSyntheticFile("local", 0444, p.user, p.group, c.opener(ramtree.CallbackOpener(c.readLocal, nil))),
+		ramtree.NewSyntheticFile("remote", 0444, p.user, p.group, c.opener(ramtree.CallbackOpener(c.readRemote, nil))),
+		ramtree.NewSyntheticFile("status", 0444, p.user, p.group, c.opener(ramtree.CallbackOpener(c.readStatus, nil))),
+	}
+	for _, f := range files {
+		n, _ := f.Name()
+		if err := dir.Add(n, f); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := p.RAMTree.Add(strconv.Itoa(id), dir); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (p *protoDir) openClone(user string, mode protocol.OpenMode) (fileserver.OpenFile, error) {
+	c, err := p.newConn()
+	if err != nil {
+		return nil, err
+	}
+	return c.opener(ramtree.CallbackOpener(c.readID, c.writeCtl))(user, mode)
+}
+
+func (p *protoDir) Create(user, name string, perms protocol.FileMode) (fileserver.File, error) {
+	return nil, fileserver.ErrPermission
+}
+
+func (t *NetTree) Create(user, name string, perms protocol.FileMode) (fileserver.File, error) {
+	return nil, fileserver.ErrPermission
+}
+
+func NewNetTree(user, group string) *NetTree {
+	t := &NetTree{
+		RAMTree: ramtree.NewRAMTree("/", 0555, user, group),
+	}
+	for _, proto := range []string{"tcp", "udp"} {
+		p := &protoDir{
+			RAMTree: ramtree.NewRAMTree(proto, 0555, user, group),
+			proto:   proto,
+			user:    user,
+			group:   group,
+		}
+		p.RAMTree.Add("clone", ramtree.NewSyntheticFile("clone", 0666, user, group, p.openClone))
+		t.RAMTree.Add(proto, p)
+	}
+	return t
+}
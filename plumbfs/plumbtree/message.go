@@ -0,0 +1,89 @@
+package plumbtree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/kennylevinsen/g9ptools/fileserver/ctl"
+)
+
+// Message is a plumb message. Its wire format is that of the Plan 9 plumber:
+// src, dst, wdir, type, attr and ndata on separate lines, followed by ndata
+// bytes of data.
+type Message struct {
+	Src  string
+	Dst  string
+	Wdir string
+	Type string
+	Attr map[string]string
+	Data []byte
+}
+
+func (m *Message) attrString() string {
+	var parts []string
+	for k, v := range m.Attr {
+		parts = append(parts, k+"="+ctl.Quote(v))
+	}
+	return strings.Join(parts, " ")
+}
+
+func (m *Message) Encode() []byte {
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "%s\n%s\n%s\n%s\n%s\n%d\n", m.Src, m.Dst, m.Wdir, m.Type, m.attrString(), len(m.Data))
+	buf.Write(m.Data)
+	return buf.Bytes()
+}
+
+// parseAttr parses the attributes of a message, name=value pairs separated by
+// white space, with values quoted as in ctl files.
+func parseAttr(s string) (map[string]string, error) {
+	fields, err := ctl.Tokenize(s)
+	if err != nil {
+		return nil, err
+	}
+	attr := make(map[string]string)
+	for _, f := range fields {
+		idx := strings.Index(f, "=")
+		if idx == -1 {
+			return nil, fmt.Errorf("malformed attribute: %s", f)
+		}
+		attr[f[:idx]] = f[idx+1:]
+	}
+	return attr, nil
+}
+
+func DecodeMessage(b []byte) (*Message, error) {
+	var fields [6]string
+	for i := range fields {
+		idx := bytes.IndexByte(b, '\n')
+		if idx == -1 {
+			return nil, errors.New("malformed message")
+		}
+		fields[i] = string(b[:idx])
+		b = b[idx+1:]
+	}
+
+	ndata, err := strconv.Atoi(fields[5])
+	if err != nil || ndata < 0 {
+		return nil, errors.New("malformed message length")
+	}
+	if ndata > len(b) {
+		return nil, errors.New("short message")
+	}
+	attr, err := parseAttr(fields[4])
+	if err != nil {
+		return nil, err
+	}
+
+	return &Message{
+		Src:  fields[0],
+		Dst:  fields[1],
+		Wdir: fields[2],
+		Type: fields[3],
+		Attr: attr,
+		Data: b[:ndata],
+	}, nil
+}
@@ -0,0 +1,240 @@
+package plumbtree
+
+import (
+	"bufio"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/kennylevinsen/g9ptools/fileserver/ctl"
+)
+
+// The rules language is a subset of the Plan 9 plumbing rules. Rule sets are
+// separated by blank lines, and each line of a rule set is of the form
+//
+//	object verb argument
+//
+// where object is one of src, dst, wdir, type, data or attr, and verb is one
+// of is, isn't, matches or set. A rule set is completed by actions:
+//
+//	plumb to port
+//	plumb start command
+//
+// The argument may refer to $0 through $9 from the last successful matches,
+// and to $src, $dst, $wdir, $type and $data. An argument starting with a
+// single quote is quoted as in ctl files. Lines starting with # are comments.
+//
+// The command of plumb start is split into words when the rules are parsed,
+// with single quotes grouping words as in ctl files, and run directly rather
+// than by a shell. Variables are only expanded in the arguments, each of
+// which stays a single argument whatever the message holds, so the program
+// run is always the one named by the rule.
+
+type rule struct {
+	object string
+	verb   string
+	arg    string
+	re     *regexp.Regexp
+}
+
+type ruleset struct {
+	rules []rule
+	port  string
+	start []string
+}
+
+var objects = map[string]bool{
+	"src": true, "dst": true, "wdir": true, "type": true, "data": true, "attr": true,
+}
+
+func parseRules(text string) ([]*ruleset, error) {
+	var sets []*ruleset
+	var cur *ruleset
+
+	s := bufio.NewScanner(strings.NewReader(text))
+	lineno := 0
+	for s.Scan() {
+		lineno++
+		line := strings.TrimSpace(s.Text())
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		if line == "" {
+			if cur != nil {
+				sets = append(sets, cur)
+				cur = nil
+			}
+			continue
+		}
+
+		fields := strings.SplitN(line, " ", 3)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("line %d: malformed rule", lineno)
+		}
+		object, verb, arg := fields[0], fields[1], strings.TrimSpace(fields[2])
+		raw := arg
+		if strings.HasPrefix(arg, "'") {
+			quoted, err := ctl.Tokenize(arg)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", lineno, err)
+			}
+			if len(quoted) != 1 {
+				return nil, fmt.Errorf("line %d: malformed argument", lineno)
+			}
+			arg = quoted[0]
+		}
+
+		if cur == nil {
+			cur = &ruleset{}
+		}
+
+		if object == "plumb" {
+			switch verb {
+			case "to":
+				cur.port = arg
+			case "start", "client":
+				argv, err := ctl.Tokenize(raw)
+				if err != nil {
+					return nil, fmt.Errorf("line %d: %v", lineno, err)
+				}
+				if len(argv) == 0 || strings.Contains(argv[0], "$") {
+					return nil, fmt.Errorf("line %d: plumb %s must name a program", lineno, verb)
+				}
+				cur.start = argv
+			default:
+				return nil, fmt.Errorf("line %d: unknown plumb action %s", lineno, verb)
+			}
+			continue
+		}
+
+		if !objects[object] {
+			return nil, fmt.Errorf("line %d: unknown object %s", lineno, object)
+		}
+
+		r := rule{object: object, verb: verb, arg: arg}
+		switch verb {
+		case "is", "isn't", "set":
+		case "matches":
+			re, err := regexp.Compile("^(?:" + arg + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", lineno, err)
+			}
+			r.re = re
+		default:
+			return nil, fmt.Errorf("line %d: unknown verb %s", lineno, verb)
+		}
+		cur.rules = append(cur.rules, r)
+	}
+	if cur != nil {
+		sets = append(sets, cur)
+	}
+
+	for _, set := range sets {
+		if set.port == "" && set.start == nil {
+			return nil, fmt.Errorf("rule set without plumb action")
+		}
+	}
+
+	return sets, s.Err()
+}
+
+func objectValue(m *Message, object string) string {
+	switch object {
+	case "src":
+		return m.Src
+	case "dst":
+		return m.Dst
+	case "wdir":
+		return m.Wdir
+	case "type":
+		return m.Type
+	case "data":
+		return string(m.Data)
+	case "attr":
+		return m.attrString()
+	}
+	return ""
+}
+
+func setObject(m *Message, object, value string) {
+	switch object {
+	case "src":
+		m.Src = value
+	case "dst":
+		m.Dst = value
+	case "wdir":
+		m.Wdir = value
+	case "type":
+		m.Type = value
+	case "data":
+		m.Data = []byte(value)
+	case "attr":
+		// Malformed attributes, as may result from expansion, set nothing.
+		attr, _ := parseAttr(value)
+		for k, v := range attr {
+			m.Attr[k] = v
+		}
+	}
+}
+
+var variableRegexp = regexp.MustCompile(`\$([0-9]|src|dst|wdir|type|data)`)
+
+func expand(s string, m *Message, vars []string) string {
+	return variableRegexp.ReplaceAllStringFunc(s, func(v string) string {
+		name := v[1:]
+		if len(name) == 1 && name[0] >= '0' && name[0] <= '9' {
+			idx := int(name[0] - '0')
+			if idx < len(vars) {
+				return vars[idx]
+			}
+			return ""
+		}
+		return objectValue(m, name)
+	})
+}
+
+// apply evaluates the rule set against a copy of the message, returning the
+// rewritten message and the expanded start command if all rules matched.
+func (rs *ruleset) apply(msg *Message) (*Message, []string, bool) {
+	m := *msg
+	m.Attr = make(map[string]string)
+	for k, v := range msg.Attr {
+		m.Attr[k] = v
+	}
+
+	var vars []string
+	for _, r := range rs.rules {
+		val := objectValue(&m, r.object)
+		arg := expand(r.arg, &m, vars)
+		switch r.verb {
+		case "is":
+			if val != arg {
+				return nil, nil, false
+			}
+		case "isn't":
+			if val == arg {
+				return nil, nil, false
+			}
+		case "matches":
+			match := r.re.FindStringSubmatch(val)
+			if match == nil {
+				return nil, nil, false
+			}
+			vars = match
+		case "set":
+			setObject(&m, r.object, arg)
+		}
+	}
+
+	if rs.port != "" {
+		m.Dst = expand(rs.port, &m, vars)
+	}
+	var start []string
+	if rs.start != nil {
+		start = append(start, rs.start[0])
+		for _, arg := range rs.start[1:] {
+			start = append(start, expand(arg, &m, vars))
+		}
+	}
+	return &m, start, true
+}
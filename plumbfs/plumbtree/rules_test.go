@@ -0,0 +1,169 @@
+package plumbtree
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseRules(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules string
+		sets  int
+		err   string
+	}{
+		{name: "empty", rules: "", sets: 0},
+		{name: "comments", rules: "# nothing\n\n# here\n", sets: 0},
+		{name: "single", rules: "type is text\nplumb to edit\n", sets: 1},
+		{name: "several", rules: "type is text\nplumb to edit\n\n# images\ndata matches '.*\\.png'\nplumb start page $0\n", sets: 2},
+		{name: "quoted argument", rules: "data is 'it''s'\nplumb to edit\n", sets: 1},
+		{name: "malformed", rules: "type text\nplumb to edit\n", err: "line 1: malformed rule"},
+		{name: "unknown object", rules: "kind is text\nplumb to edit\n", err: "line 1: unknown object kind"},
+		{name: "unknown verb", rules: "type contains text\nplumb to edit\n", err: "line 1: unknown verb contains"},
+		{name: "unknown action", rules: "type is text\nplumb into edit\n", err: "line 2: unknown plumb action into"},
+		{name: "bad regexp", rules: "data matches '('\nplumb to edit\n", err: "line 1: error parsing regexp"},
+		{name: "unterminated quote", rules: "data is 'text\nplumb to edit\n", err: "line 1: unterminated quote"},
+		{name: "several quoted words", rules: "data is 'a' 'b'\nplumb to edit\n", err: "line 1: malformed argument"},
+		{name: "variable program", rules: "type is text\nplumb start $data\n", err: "line 2: plumb start must name a program"},
+		{name: "no action", rules: "type is text\n", err: "rule set without plumb action"},
+	}
+
+	for _, tt := range tests {
+		sets, err := parseRules(tt.rules)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: parse returned %v, expected %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: parse: %v", tt.name, err)
+			continue
+		}
+		if len(sets) != tt.sets {
+			t.Errorf("%s: parsed %d rule sets, expected %d", tt.name, len(sets), tt.sets)
+		}
+	}
+}
+
+const testRules = `
+# Files with a line number go to the editor, at that line.
+type is text
+data matches '([^:]+):([0-9]+)'
+attr set 'addr=$2'
+data set $1
+plumb to edit
+
+# Images are shown.
+type is text
+data matches '.*\.(png|jpg)'
+plumb start page -w $wdir $0
+
+# Anything else not from the editor goes to it.
+src isn't edit
+plumb to edit
+`
+
+func TestApply(t *testing.T) {
+	sets, err := parseRules(testRules)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		msg   Message
+		dst   string
+		data  string
+		attr  map[string]string
+		start []string
+	}{
+		{
+			name: "address",
+			msg:  Message{Src: "rc", Type: "text", Data: []byte("main.go:42")},
+			dst:  "edit",
+			data: "main.go",
+			attr: map[string]string{"addr": "42"},
+		},
+		{
+			name:  "image",
+			msg:   Message{Src: "rc", Wdir: "/usr/glenda", Type: "text", Data: []byte("my cat.png")},
+			data:  "my cat.png",
+			start: []string{"page", "-w", "/usr/glenda", "my cat.png"},
+		},
+		{
+			name: "fallback",
+			msg:  Message{Src: "rc", Type: "image", Data: []byte("main.go:42")},
+			dst:  "edit",
+			data: "main.go:42",
+		},
+		{
+			name: "no match",
+			msg:  Message{Src: "edit", Type: "image", Data: []byte("main.go:42")},
+		},
+	}
+
+	for _, tt := range tests {
+		orig := string(tt.msg.Data)
+		var m *Message
+		var start []string
+		for _, rs := range sets {
+			var ok bool
+			if m, start, ok = rs.apply(&tt.msg); ok {
+				break
+			}
+		}
+		if tt.dst == "" && tt.start == nil {
+			if m != nil {
+				t.Errorf("%s: matched, sending %+v", tt.name, m)
+			}
+			continue
+		}
+		if m == nil {
+			t.Errorf("%s: no rule set matched", tt.name)
+			continue
+		}
+		if m.Dst != tt.dst || string(m.Data) != tt.data || !reflect.DeepEqual(start, tt.start) {
+			t.Errorf("%s: sent %q to %q, starting %q, expected %q to %q, starting %q", tt.name, m.Data, m.Dst, start, tt.data, tt.dst, tt.start)
+		}
+		for k, v := range tt.attr {
+			if m.Attr[k] != v {
+				t.Errorf("%s: attribute %s is %q, expected %q", tt.name, k, m.Attr[k], v)
+			}
+		}
+		if string(tt.msg.Data) != orig || len(tt.msg.Attr) != 0 {
+			t.Errorf("%s: applying the rules modified the message", tt.name)
+		}
+	}
+}
+
+func TestMessage(t *testing.T) {
+	in := &Message{
+		Src:  "rc",
+		Dst:  "edit",
+		Wdir: "/usr/glenda",
+		Type: "text",
+		Attr: map[string]string{"addr": "42", "title": "it's a file", "empty": ""},
+		Data: []byte("main.go\nwith a newline"),
+	}
+	out, err := DecodeMessage(in.Encode())
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if !reflect.DeepEqual(out, in) {
+		t.Fatalf("message came back as %+v, expected %+v", out, in)
+	}
+
+	for _, b := range []string{
+		"rc\nedit\n/\ntext\n\n",
+		"rc\nedit\n/\ntext\n\nten\n",
+		"rc\nedit\n/\ntext\n\n10\nshort",
+		"rc\nedit\n/\ntext\naddr='42\n0\n",
+		"rc\nedit\n/\ntext\naddr\n0\n",
+	} {
+		if _, err := DecodeMessage([]byte(b)); err == nil {
+			t.Errorf("decoding %q succeeded", b)
+		}
+	}
+}
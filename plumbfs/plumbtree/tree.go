@@ -0,0 +1,187 @@
+package plumbtree
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+	"github.com/kennylevinsen/g9ptools/ramfs/ramtree"
+)
+
+var (
+	ErrNoMatch  = errors.New("no matching plumb rule")
+	ErrNoPort   = errors.New("no such port")
+	ErrNoReader = errors.New("no one is reading the port")
+
+	ErrInvalidWdir = errors.New("wdir is not an absolute path to a directory")
+)
+
+// DefaultPorts are always present, regardless of the rules.
+var DefaultPorts = []string{"edit", "web", "image"}
+
+// PlumbTree implements the Plan 9 plumber. Messages written to send are
+// matched against the rules, and delivered to every reader of the selected
+// port. Reads of a port block until a message arrives, and each read returns
+// at most one message.
+type PlumbTree struct {
+	*ramtree.RAMTree
+	plumbLock sync.RWMutex
+	user      string
+	group     string
+	rulesText string
+	rules     []*ruleset
+	ports     map[string]*ramtree.Stream
+}
+
+// SetRules parses and installs a new rule set. Ports named by the rules are
+// created as needed, but existing ports are never removed.
+func (t *PlumbTree) SetRules(text string) error {
+	rules, err := parseRules(text)
+	if err != nil {
+		return err
+	}
+
+	t.plumbLock.Lock()
+	defer t.plumbLock.Unlock()
+	t.rules = rules
+	t.rulesText = text
+	for _, rs := range rules {
+		if rs.port != "" && !strings.Contains(rs.port, "$") {
+			t.addPort(rs.port)
+		}
+	}
+	return nil
+}
+
+// addPort must be called with plumbLock held.
+func (t *PlumbTree) addPort(name string) {
+	if _, ok := t.ports[name]; ok {
+		return
+	}
+	s := ramtree.NewStream()
+	t.ports[name] = s
+	t.RAMTree.Add(name, ramtree.NewStreamFile(name, 0444, t.user, t.group, s))
+}
+
+// Plumb routes a message. A message with a destination set is delivered to
+// that port directly, otherwise the rules decide.
+func (t *PlumbTree) Plumb(m *Message) error {
+	t.plumbLock.RLock()
+	defer t.plumbLock.RUnlock()
+
+	var start []string
+	if m.Dst == "" {
+		matched := false
+		for _, rs := range t.rules {
+			if nm, st, ok := rs.apply(m); ok {
+				m, start, matched = nm, st, true
+				break
+			}
+		}
+		if !matched {
+			return ErrNoMatch
+		}
+	}
+
+	if m.Dst != "" {
+		if s, ok := t.ports[m.Dst]; ok && s.Readers() > 0 {
+			s.Send(m.Encode())
+			return nil
+		} else if !ok && start == nil {
+			return ErrNoPort
+		}
+	}
+
+	if start == nil {
+		return ErrNoReader
+	}
+
+	cmd := exec.Command(start[0], start[1:]...)
+	if m.Wdir != "" {
+		if err := checkWdir(m.Wdir); err != nil {
+			return err
+		}
+		cmd.Dir = m.Wdir
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	go func() {
+		if err := cmd.Wait(); err != nil {
+			log.Printf("plumb start %q: %v", start, err)
+		}
+	}()
+	return nil
+}
+
+// checkWdir checks that the working directory of a message is an existing
+// directory, named by a clean absolute path, before a command is started in
+// it.
+func checkWdir(wdir string) error {
+	if !filepath.IsAbs(wdir) || filepath.Clean(wdir) != wdir {
+		return ErrInvalidWdir
+	}
+	fi, err := os.Stat(wdir)
+	if err != nil || !fi.IsDir() {
+		return ErrInvalidWdir
+	}
+	return nil
+}
+
+func (t *PlumbTree) writeSend(_ string, p []byte) (int, error) {
+	m, err := DecodeMessage(p)
+	if err != nil {
+		return 0, err
+	}
+	if err := t.Plumb(m); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (t *PlumbTree) readRules(string) ([]byte, error) {
+	t.plumbLock.RLock()
+	defer t.plumbLock.RUnlock()
+	return []byte(t.rulesText), nil
+}
+
+func (t *PlumbTree) commitRules(_ string, content []byte) error {
+	if err := t.SetRules(string(content)); err != nil {
+		log.Printf("Rejected plumb rules: %v", err)
+		return err
+	}
+	return nil
+}
+
+func (t *PlumbTree) Create(user, name string, perms protocol.FileMode) (fileserver.File, error) {
+	return nil, fileserver.ErrPermission
+}
+
+func NewPlumbTree(user, group string) *PlumbTree {
+	t := &PlumbTree{
+		RAMTree: ramtree.NewRAMTree("/", 0555, user, group),
+		user:    user,
+		group:   group,
+		ports:   make(map[string]*ramtree.Stream),
+	}
+
+	t.RAMTree.Add("send", ramtree.NewCallbackFile("send", 0222, user, group, nil, t.writeSend))
+	t.RAMTree.Add("rules", ramtree.NewBufferFile("rules", 0600, user, group, t.readRules, t.commitRules))
+	for _, p := range DefaultPorts {
+		t.addPort(p)
+	}
+	return t
+}
+
+func (t *PlumbTree) String() string {
+	t.plumbLock.RLock()
+	defer t.plumbLock.RUnlock()
+	return fmt.Sprintf("plumber with %d rule sets and %d ports", len(t.rules), len(t.ports))
+}
@@ -0,0 +1,152 @@
+package policy
+
+import (
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/kennylevinsen/g9p"
+	"github.com/kennylevinsen/g9p/protocol"
+)
+
+// attachFid is used internally while walking to the attach path. It is
+// never visible to the client, but must not be used by it either.
+const attachFid = protocol.NOFID - 1
+
+// Handler enforces a rule on a single connection. Attaches are performed as
+// the uname of the rule, and only to permitted attach names. An attach name
+// of the form "service/path" attaches to the path within the service, and
+// walks can never leave the attach point.
+type Handler struct {
+	g9p.Handler
+	sync.Mutex
+	rule  *Rule
+	depth map[protocol.Fid]int
+}
+
+func (h *Handler) Auth(r *protocol.AuthRequest) (*protocol.AuthResponse, error) {
+	return nil, errors.New("authentication not required")
+}
+
+func (h *Handler) Attach(r *protocol.AttachRequest) (*protocol.AttachResponse, error) {
+	if !h.rule.Allowed(r.Service) {
+		return nil, ErrDenied
+	}
+
+	aname := CleanAname(r.Service)
+	service, p := aname, ""
+	if idx := strings.Index(aname, "/"); idx != -1 {
+		service, p = aname[:idx], aname[idx+1:]
+	}
+
+	req := *r
+	req.Username = h.rule.User(r.Username)
+	req.Service = service
+	req.AuthFid = protocol.NOFID
+
+	if p == "" {
+		resp, err := h.Handler.Attach(&req)
+		if err == nil {
+			h.setDepth(r.Fid, 0)
+		}
+		return resp, err
+	}
+
+	req.Fid = attachFid
+	if _, err := h.Handler.Attach(&req); err != nil {
+		return nil, err
+	}
+	defer h.Handler.Clunk(&protocol.ClunkRequest{Tag: r.Tag, Fid: attachFid})
+
+	names := strings.Split(p, "/")
+	wresp, err := h.Handler.Walk(&protocol.WalkRequest{
+		Tag:    r.Tag,
+		Fid:    attachFid,
+		NewFid: r.Fid,
+		Names:  names,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(wresp.Qids) != len(names) {
+		return nil, errors.New("attach path not found")
+	}
+
+	h.setDepth(r.Fid, 0)
+	return &protocol.AttachResponse{
+		Tag: r.Tag,
+		Qid: wresp.Qids[len(wresp.Qids)-1],
+	}, nil
+}
+
+func (h *Handler) setDepth(fid protocol.Fid, d int) {
+	h.Lock()
+	defer h.Unlock()
+	h.depth[fid] = d
+}
+
+func (h *Handler) forget(fid protocol.Fid) {
+	h.Lock()
+	defer h.Unlock()
+	delete(h.depth, fid)
+}
+
+// Walk rewrites ".." at the attach point to ".", so that the client cannot
+// walk above it.
+func (h *Handler) Walk(r *protocol.WalkRequest) (*protocol.WalkResponse, error) {
+	if r.Fid == attachFid || r.NewFid == attachFid {
+		return nil, errors.New("fid reserved")
+	}
+
+	h.Lock()
+	d, ok := h.depth[r.Fid]
+	h.Unlock()
+	if !ok {
+		return h.Handler.Walk(r)
+	}
+
+	req := *r
+	req.Names = make([]string, len(r.Names))
+	for i, name := range r.Names {
+		switch name {
+		case "..":
+			if d == 0 {
+				name = "."
+			} else {
+				d--
+			}
+		case ".":
+		default:
+			d++
+		}
+		req.Names[i] = name
+	}
+
+	resp, err := h.Handler.Walk(&req)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Qids) == len(r.Names) {
+		h.setDepth(r.NewFid, d)
+	}
+	return resp, nil
+}
+
+func (h *Handler) Clunk(r *protocol.ClunkRequest) (*protocol.ClunkResponse, error) {
+	h.forget(r.Fid)
+	return h.Handler.Clunk(r)
+}
+
+func (h *Handler) Remove(r *protocol.RemoveRequest) (*protocol.RemoveResponse, error) {
+	h.forget(r.Fid)
+	return h.Handler.Remove(r)
+}
+
+// NewHandler wraps a handler to enforce a rule.
+func NewHandler(h g9p.Handler, rule *Rule) *Handler {
+	return &Handler{
+		Handler: h,
+		rule:    rule,
+		depth:   make(map[protocol.Fid]int),
+	}
+}
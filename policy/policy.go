@@ -0,0 +1,214 @@
+package policy
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+var ErrDenied = errors.New("identity not permitted")
+
+// A policy file maps client identities to 9P users, and restricts the attach
+// names they may use. Every non-empty line not starting with '#' is a rule:
+//
+//	identity	uname	attach...
+//
+// The identity is one of:
+//
+//	cn=name		certificate subject common name
+//	email=address	certificate email address
+//	spki=hex	SHA-256 of the certificate public key
+//	*		any client with a verified certificate
+//
+// The uname is the user the client is attached as, or "-" to keep the uname
+// given by the client. Each attach entry is a service name, optionally
+// followed by a path within it, such as "ram/pub". The client may attach to
+// the listed locations and anything beneath them. An entry of "*" permits
+// every service. The first matching rule applies.
+
+// Identity describes an authenticated client.
+type Identity struct {
+	CommonName string
+	Emails     []string
+	SPKI       string
+}
+
+func (id Identity) String() string {
+	return fmt.Sprintf("cn=%s spki=%s", id.CommonName, id.SPKI)
+}
+
+// CertIdentity extracts the identity of a certificate.
+func CertIdentity(cert *x509.Certificate) Identity {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return Identity{
+		CommonName: cert.Subject.CommonName,
+		Emails:     cert.EmailAddresses,
+		SPKI:       hex.EncodeToString(sum[:]),
+	}
+}
+
+// TLSIdentity extracts the identity of the client of a TLS connection.
+func TLSIdentity(state tls.ConnectionState) (Identity, error) {
+	if len(state.PeerCertificates) == 0 {
+		return Identity{}, errors.New("no client certificate")
+	}
+	return CertIdentity(state.PeerCertificates[0]), nil
+}
+
+// Rule is a single line of a policy.
+type Rule struct {
+	Identity string
+	Uname    string
+	Attach   []string
+}
+
+func (r *Rule) matches(id Identity) bool {
+	if r.Identity == "*" {
+		return true
+	}
+	idx := strings.Index(r.Identity, "=")
+	if idx == -1 {
+		return false
+	}
+	kind, value := r.Identity[:idx], r.Identity[idx+1:]
+	switch kind {
+	case "cn":
+		return id.CommonName == value
+	case "email":
+		for _, e := range id.Emails {
+			if e == value {
+				return true
+			}
+		}
+	case "spki":
+		return strings.EqualFold(id.SPKI, value)
+	}
+	return false
+}
+
+// User returns the uname for a client that asked for uname.
+func (r *Rule) User(uname string) string {
+	if r.Uname == "-" {
+		return uname
+	}
+	return r.Uname
+}
+
+// Allowed reports whether the rule permits attaching to aname.
+func (r *Rule) Allowed(aname string) bool {
+	aname = CleanAname(aname)
+	for _, a := range r.Attach {
+		if a == "*" {
+			return true
+		}
+		a = CleanAname(a)
+		if aname == a || strings.HasPrefix(aname, a+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// CleanAname normalizes an attach name of the form "service/path".
+func CleanAname(aname string) string {
+	return strings.TrimPrefix(path.Clean("/"+aname), "/")
+}
+
+// Policy is an ordered list of rules.
+type Policy struct {
+	Rules []*Rule
+}
+
+// Lookup returns the first rule matching the identity.
+func (p *Policy) Lookup(id Identity) (*Rule, error) {
+	for _, r := range p.Rules {
+		if r.matches(id) {
+			return r, nil
+		}
+	}
+	return nil, ErrDenied
+}
+
+// Parse reads a policy.
+func Parse(rd io.Reader) (*Policy, error) {
+	p := &Policy{}
+	s := bufio.NewScanner(rd)
+	lineno := 0
+	for s.Scan() {
+		lineno++
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("line %d: expected identity, uname and attach names", lineno)
+		}
+		if fields[0] != "*" && !strings.Contains(fields[0], "=") {
+			return nil, fmt.Errorf("line %d: malformed identity %q", lineno, fields[0])
+		}
+		p.Rules = append(p.Rules, &Rule{
+			Identity: fields[0],
+			Uname:    fields[1],
+			Attach:   fields[2:],
+		})
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// File is a policy backed by a file, which can be reloaded at runtime.
+// Connections established before a reload keep the rule they were given.
+type File struct {
+	sync.RWMutex
+	path string
+	p    *Policy
+}
+
+// Reload reads the policy file again. The previous policy is kept if the
+// file cannot be parsed.
+func (f *File) Reload() error {
+	fp, err := os.Open(f.path)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	p, err := Parse(fp)
+	if err != nil {
+		return err
+	}
+
+	f.Lock()
+	defer f.Unlock()
+	f.p = p
+	return nil
+}
+
+// Lookup returns the rule matching the identity in the current policy.
+func (f *File) Lookup(id Identity) (*Rule, error) {
+	f.RLock()
+	p := f.p
+	f.RUnlock()
+	return p.Lookup(id)
+}
+
+// Load reads a policy file.
+func Load(path string) (*File, error) {
+	f := &File{path: path}
+	if err := f.Reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
@@ -0,0 +1,145 @@
+package proxy
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/kennylevinsen/g9p/protocol"
+)
+
+type readKey struct {
+	path    uint64
+	version uint32
+	offset  uint64
+	count   uint32
+}
+
+type readEntry struct {
+	key  readKey
+	data []byte
+}
+
+// Cache stores read results of upstream files, keyed by Qid path and
+// version. Whenever a Qid with a new version is observed for a path, all
+// cached data for that path is dropped. Read results are evicted in LRU order
+// once the cache exceeds its size limit.
+//
+// As other clients of the upstream server may change files, the Qid of a fid
+// is revalidated with a Tstat when it is older than the ttl of the cache,
+// before the cache is consulted for a read. Stats are always forwarded.
+//
+// Only files whose versions can be trusted are cached. Append-only and
+// exclusive-use files, such as logs, streams and ctl files, change or answer
+// differently without a new version, as do files of version 0, which is what
+// synthetic files that never bump their version report.
+type Cache struct {
+	sync.Mutex
+	maxBytes int
+	size     int
+	versions map[uint64]uint32
+	reads    map[readKey]*list.Element
+	byPath   map[uint64]map[readKey]bool
+	lru      *list.List
+	ttl      time.Duration
+}
+
+// observe records the version of a Qid, purging stale entries if it changed.
+func (c *Cache) observe(q protocol.Qid) {
+	c.Lock()
+	defer c.Unlock()
+	if v, ok := c.versions[q.Path]; ok && v == q.Version {
+		return
+	}
+	c.purge(q.Path)
+	c.versions[q.Path] = q.Version
+}
+
+// invalidate drops everything known about a path. Used after modifications
+// made through the proxy itself.
+func (c *Cache) invalidate(path uint64) {
+	c.Lock()
+	defer c.Unlock()
+	c.purge(path)
+	delete(c.versions, path)
+}
+
+// cacheable reports whether the file of q may be cached.
+func cacheable(q protocol.Qid) bool {
+	return q.Type&(protocol.QTAPPEND|protocol.QTEXCL) == 0 && q.Version != 0
+}
+
+func (c *Cache) purge(path uint64) {
+	for k := range c.byPath[path] {
+		if e, ok := c.reads[k]; ok {
+			c.size -= len(e.Value.(*readEntry).data)
+			c.lru.Remove(e)
+			delete(c.reads, k)
+		}
+	}
+	delete(c.byPath, path)
+}
+
+func (c *Cache) getRead(q protocol.Qid, offset uint64, count uint32) ([]byte, bool) {
+	if !cacheable(q) {
+		return nil, false
+	}
+	c.Lock()
+	defer c.Unlock()
+	if v, ok := c.versions[q.Path]; !ok || v != q.Version {
+		return nil, false
+	}
+	e, ok := c.reads[readKey{q.Path, q.Version, offset, count}]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*readEntry).data, true
+}
+
+func (c *Cache) putRead(q protocol.Qid, offset uint64, count uint32, data []byte) {
+	if !cacheable(q) {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	if v, ok := c.versions[q.Path]; !ok || v != q.Version {
+		return
+	}
+	if len(data) > c.maxBytes {
+		return
+	}
+	k := readKey{q.Path, q.Version, offset, count}
+	if _, ok := c.reads[k]; ok {
+		return
+	}
+
+	c.reads[k] = c.lru.PushFront(&readEntry{key: k, data: data})
+	if c.byPath[q.Path] == nil {
+		c.byPath[q.Path] = make(map[readKey]bool)
+	}
+	c.byPath[q.Path][k] = true
+	c.size += len(data)
+
+	for c.size > c.maxBytes {
+		e := c.lru.Back()
+		re := e.Value.(*readEntry)
+		c.lru.Remove(e)
+		delete(c.reads, re.key)
+		delete(c.byPath[re.key.path], re.key)
+		c.size -= len(re.data)
+	}
+}
+
+// NewCache returns a cache holding at most maxBytes of read data, trusting
+// the Qid of a fid for ttl before revalidating it.
+func NewCache(maxBytes int, ttl time.Duration) *Cache {
+	return &Cache{
+		maxBytes: maxBytes,
+		versions: make(map[uint64]uint32),
+		reads:    make(map[readKey]*list.Element),
+		byPath:   make(map[uint64]map[readKey]bool),
+		lru:      list.New(),
+		ttl:      ttl,
+	}
+}
@@ -0,0 +1,610 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/kennylevinsen/g9p"
+	"github.com/kennylevinsen/g9p/protocol"
+)
+
+const (
+	DefaultMaxSize = 128 * 1024
+	Version        = "9P2000"
+)
+
+var (
+	ErrUnknownProtocol = errors.New("unknown protocol")
+	ErrReadOnly        = errors.New("read-only export")
+	ErrNoSuchFile      = errors.New("file does not exist")
+	ErrUnknownFid      = errors.New("unknown fid")
+	ErrFidInUse        = errors.New("fid already in use")
+)
+
+// Rules restrict what clients of the proxy can do with the upstream tree.
+type Rules struct {
+	// ReadOnly rejects all requests that could modify the upstream tree.
+	ReadOnly bool
+
+	// Hide is a list of path.Match patterns. Matching paths, and everything
+	// below them, are neither walkable nor listed in directory reads.
+	Hide []string
+}
+
+func (r *Rules) hidden(p string) bool {
+	for p != "/" && p != "." {
+		for _, pattern := range r.Hide {
+			if ok, _ := path.Match(pattern, p); ok {
+				return true
+			}
+		}
+		p = path.Dir(p)
+	}
+	return false
+}
+
+// Upstream is a single connection to a 9P server, shared by any number of
+// proxy sessions. Tags are allocated by the underlying client, and fids are
+// allocated by the Upstream, so sessions never collide.
+type Upstream struct {
+	c       *g9p.Client
+	maxSize uint32
+
+	// Cache, if set, is used to serve repeated reads locally.
+	Cache *Cache
+
+	fidLock sync.Mutex
+	nextFid protocol.Fid
+}
+
+func (u *Upstream) getFid() protocol.Fid {
+	u.fidLock.Lock()
+	defer u.fidLock.Unlock()
+	if u.nextFid == protocol.NOFID {
+		u.nextFid++
+	}
+	f := u.nextFid
+	u.nextFid++
+	return f
+}
+
+func (u *Upstream) clunk(fid protocol.Fid) {
+	u.c.Clunk(&protocol.ClunkRequest{
+		Tag: u.c.NextTag(),
+		Fid: fid,
+	})
+}
+
+// NewUpstream negotiates a session over rw and returns the resulting
+// Upstream.
+func NewUpstream(rw io.ReadWriter) (*Upstream, error) {
+	c := g9p.NewClient(rw)
+	go c.Start()
+
+	vresp, err := c.Version(&protocol.VersionRequest{
+		Tag:     protocol.NOTAG,
+		MaxSize: DefaultMaxSize,
+		Version: Version,
+	})
+	if err != nil {
+		c.Stop()
+		return nil, err
+	}
+	if vresp.Version != Version {
+		c.Stop()
+		return nil, ErrUnknownProtocol
+	}
+
+	return &Upstream{
+		c:       c,
+		maxSize: vresp.MaxSize,
+	}, nil
+}
+
+type fidState struct {
+	fid protocol.Fid
+	qid protocol.Qid
+	// observed is when qid was last received from upstream.
+	observed  time.Time
+	path      string
+	isDir     bool
+	open      bool
+	dirOffset uint64
+}
+
+// Session is a g9p.Handler serving a single client connection by forwarding
+// its requests to an Upstream, remapping fids and tags as it goes.
+type Session struct {
+	sync.Mutex
+	up      *Upstream
+	rules   Rules
+	maxSize uint32
+	fids    map[protocol.Fid]*fidState
+	tags    map[protocol.Tag]protocol.Tag
+}
+
+func (s *Session) lookup(fid protocol.Fid) (*fidState, error) {
+	s.Lock()
+	defer s.Unlock()
+	f, ok := s.fids[fid]
+	if !ok {
+		return nil, ErrUnknownFid
+	}
+	return f, nil
+}
+
+// observe records the latest known Qid of a fid, and lets the cache know
+// about it.
+func (s *Session) observe(f *fidState, q protocol.Qid) {
+	s.Lock()
+	f.qid = q
+	f.observed = time.Now()
+	s.Unlock()
+	if s.up.Cache != nil {
+		s.up.Cache.observe(q)
+	}
+}
+
+// tag allocates an upstream tag for a client request, remembering the
+// mapping so that a Tflush can be forwarded.
+func (s *Session) tag(t protocol.Tag) protocol.Tag {
+	ut := s.up.c.NextTag()
+	s.Lock()
+	s.tags[t] = ut
+	s.Unlock()
+	return ut
+}
+
+func (s *Session) untag(t protocol.Tag) {
+	s.Lock()
+	delete(s.tags, t)
+	s.Unlock()
+}
+
+func (s *Session) Version(r *protocol.VersionRequest) (*protocol.VersionResponse, error) {
+	// A new version resets the session, so all fids must go.
+	s.Lock()
+	for k, f := range s.fids {
+		s.up.clunk(f.fid)
+		delete(s.fids, k)
+	}
+	s.Unlock()
+
+	s.maxSize = r.MaxSize
+	if s.maxSize > s.up.maxSize {
+		s.maxSize = s.up.maxSize
+	}
+
+	proto := Version
+	if r.Version != Version {
+		proto = "unknown"
+	}
+
+	return &protocol.VersionResponse{
+		MaxSize: s.maxSize,
+		Version: proto,
+	}, nil
+}
+
+func (s *Session) Auth(r *protocol.AuthRequest) (*protocol.AuthResponse, error) {
+	return nil, fmt.Errorf("auth not supported")
+}
+
+func (s *Session) Attach(r *protocol.AttachRequest) (*protocol.AttachResponse, error) {
+	s.Lock()
+	_, ok := s.fids[r.Fid]
+	s.Unlock()
+	if ok {
+		return nil, ErrFidInUse
+	}
+
+	fid := s.up.getFid()
+	defer s.untag(r.Tag)
+	resp, err := s.up.c.Attach(&protocol.AttachRequest{
+		Tag:      s.tag(r.Tag),
+		Fid:      fid,
+		AuthFid:  protocol.NOFID,
+		Username: r.Username,
+		Service:  r.Service,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	f := &fidState{fid: fid, path: "/", isDir: true}
+	s.observe(f, resp.Qid)
+	s.Lock()
+	s.fids[r.Fid] = f
+	s.Unlock()
+
+	return &protocol.AttachResponse{Qid: resp.Qid}, nil
+}
+
+func (s *Session) Flush(r *protocol.FlushRequest) (*protocol.FlushResponse, error) {
+	s.Lock()
+	ut, ok := s.tags[r.OldTag]
+	s.Unlock()
+	if ok {
+		if _, err := s.up.c.Flush(&protocol.FlushRequest{
+			Tag:    s.up.c.NextTag(),
+			OldTag: ut,
+		}); err != nil {
+			return nil, err
+		}
+	}
+	return &protocol.FlushResponse{}, nil
+}
+
+func (s *Session) Walk(r *protocol.WalkRequest) (*protocol.WalkResponse, error) {
+	f, err := s.lookup(r.Fid)
+	if err != nil {
+		return nil, err
+	}
+	s.Lock()
+	_, ok := s.fids[r.NewFid]
+	s.Unlock()
+	if ok && r.NewFid != r.Fid {
+		return nil, ErrFidInUse
+	}
+
+	// Stop the walk before the first hidden element.
+	names := r.Names
+	p := f.path
+	for i, name := range names {
+		np := path.Join(p, name)
+		if s.rules.hidden(np) {
+			if i == 0 {
+				return nil, ErrNoSuchFile
+			}
+			names = names[:i]
+			break
+		}
+		p = np
+	}
+
+	nf := &fidState{fid: s.up.getFid(), qid: f.qid, path: f.path, isDir: f.isDir}
+	defer s.untag(r.Tag)
+	resp, err := s.up.c.Walk(&protocol.WalkRequest{
+		Tag:    s.tag(r.Tag),
+		Fid:    f.fid,
+		NewFid: nf.fid,
+		Names:  names,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resp.Qids) == len(names) && len(names) < len(r.Names) {
+		// Upstream completed the walk, but we cut it short.
+		s.up.clunk(nf.fid)
+	} else if len(resp.Qids) == len(r.Names) {
+		for i, q := range resp.Qids {
+			nf.path = path.Join(nf.path, names[i])
+			nf.isDir = q.Type&protocol.QTDIR != 0
+			nf.qid = q
+			if s.up.Cache != nil {
+				s.up.Cache.observe(q)
+			}
+		}
+
+		s.Lock()
+		if r.NewFid == r.Fid {
+			s.up.clunk(f.fid)
+		}
+		s.fids[r.NewFid] = nf
+		s.Unlock()
+	}
+
+	return &protocol.WalkResponse{Qids: resp.Qids}, nil
+}
+
+func writeMode(mode protocol.OpenMode) bool {
+	return mode&3 == protocol.OWRITE || mode&3 == protocol.ORDWR || mode&protocol.OTRUNC != 0 || mode&protocol.ORCLOSE != 0
+}
+
+func (s *Session) Open(r *protocol.OpenRequest) (*protocol.OpenResponse, error) {
+	f, err := s.lookup(r.Fid)
+	if err != nil {
+		return nil, err
+	}
+	if s.rules.ReadOnly && writeMode(r.Mode) {
+		return nil, ErrReadOnly
+	}
+
+	defer s.untag(r.Tag)
+	resp, err := s.up.c.Open(&protocol.OpenRequest{
+		Tag:  s.tag(r.Tag),
+		Fid:  f.fid,
+		Mode: r.Mode,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.observe(f, resp.Qid)
+	s.Lock()
+	f.open = true
+	f.dirOffset = 0
+	s.Unlock()
+	return &protocol.OpenResponse{Qid: resp.Qid, IOUnit: resp.IOUnit}, nil
+}
+
+func (s *Session) Create(r *protocol.CreateRequest) (*protocol.CreateResponse, error) {
+	f, err := s.lookup(r.Fid)
+	if err != nil {
+		return nil, err
+	}
+	if s.rules.ReadOnly {
+		return nil, ErrReadOnly
+	}
+	np := path.Join(f.path, r.Name)
+	if s.rules.hidden(np) {
+		return nil, errors.New("permission denied")
+	}
+
+	defer s.untag(r.Tag)
+	resp, err := s.up.c.Create(&protocol.CreateRequest{
+		Tag:         s.tag(r.Tag),
+		Fid:         f.fid,
+		Name:        r.Name,
+		Permissions: r.Permissions,
+		Mode:        r.Mode,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.observe(f, resp.Qid)
+	s.Lock()
+	f.path = np
+	f.isDir = resp.Qid.Type&protocol.QTDIR != 0
+	f.open = true
+	s.Unlock()
+	return &protocol.CreateResponse{Qid: resp.Qid, IOUnit: resp.IOUnit}, nil
+}
+
+func (s *Session) Read(r *protocol.ReadRequest) (*protocol.ReadResponse, error) {
+	f, err := s.lookup(r.Fid)
+	if err != nil {
+		return nil, err
+	}
+
+	cache := s.up.Cache
+	if f.isDir {
+		cache = nil
+	}
+	s.Lock()
+	q, observed := f.qid, f.observed
+	s.Unlock()
+	if cache != nil && time.Since(observed) > cache.ttl {
+		// The file may have been changed by other clients of the
+		// upstream server since its qid was last seen.
+		resp, err := s.up.c.Stat(&protocol.StatRequest{
+			Tag: s.tag(r.Tag),
+			Fid: f.fid,
+		})
+		s.untag(r.Tag)
+		if err != nil {
+			return nil, err
+		}
+		s.observe(f, resp.Stat.Qid)
+		q = resp.Stat.Qid
+	}
+	if cache != nil {
+		if data, ok := cache.getRead(q, r.Offset, r.Count); ok {
+			return &protocol.ReadResponse{Data: data}, nil
+		}
+	}
+
+	defer s.untag(r.Tag)
+	if !f.isDir || len(s.rules.Hide) == 0 {
+		resp, err := s.up.c.Read(&protocol.ReadRequest{
+			Tag:    s.tag(r.Tag),
+			Fid:    f.fid,
+			Offset: r.Offset,
+			Count:  r.Count,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if cache != nil {
+			cache.putRead(q, r.Offset, r.Count, resp.Data)
+		}
+		return &protocol.ReadResponse{Data: resp.Data}, nil
+	}
+
+	// Directory reads are filtered, so the offsets seen by the client no
+	// longer match upstream offsets. We track the upstream offset ourselves.
+	s.Lock()
+	if r.Offset == 0 {
+		f.dirOffset = 0
+	}
+	s.Unlock()
+
+	for {
+		s.Lock()
+		off := f.dirOffset
+		s.Unlock()
+
+		resp, err := s.up.c.Read(&protocol.ReadRequest{
+			Tag:    s.tag(r.Tag),
+			Fid:    f.fid,
+			Offset: off,
+			Count:  r.Count,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if len(resp.Data) == 0 {
+			return &protocol.ReadResponse{}, nil
+		}
+
+		s.Lock()
+		f.dirOffset += uint64(len(resp.Data))
+		s.Unlock()
+
+		in := bytes.NewBuffer(resp.Data)
+		out := new(bytes.Buffer)
+		for in.Len() > 0 {
+			st := protocol.Stat{}
+			if err := st.Decode(in); err != nil {
+				return nil, err
+			}
+			if s.rules.hidden(path.Join(f.path, st.Name)) {
+				continue
+			}
+			st.Encode(out)
+		}
+
+		if out.Len() > 0 {
+			return &protocol.ReadResponse{Data: out.Bytes()}, nil
+		}
+	}
+}
+
+func (s *Session) Write(r *protocol.WriteRequest) (*protocol.WriteResponse, error) {
+	f, err := s.lookup(r.Fid)
+	if err != nil {
+		return nil, err
+	}
+	if s.rules.ReadOnly {
+		return nil, ErrReadOnly
+	}
+
+	defer s.untag(r.Tag)
+	resp, err := s.up.c.Write(&protocol.WriteRequest{
+		Tag:    s.tag(r.Tag),
+		Fid:    f.fid,
+		Offset: r.Offset,
+		Data:   r.Data,
+	})
+	if s.up.Cache != nil {
+		s.up.Cache.invalidate(f.qid.Path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &protocol.WriteResponse{Count: resp.Count}, nil
+}
+
+func (s *Session) Clunk(r *protocol.ClunkRequest) (*protocol.ClunkResponse, error) {
+	f, err := s.lookup(r.Fid)
+	if err != nil {
+		return nil, err
+	}
+
+	s.Lock()
+	delete(s.fids, r.Fid)
+	s.Unlock()
+
+	defer s.untag(r.Tag)
+	if _, err := s.up.c.Clunk(&protocol.ClunkRequest{
+		Tag: s.tag(r.Tag),
+		Fid: f.fid,
+	}); err != nil {
+		return nil, err
+	}
+	return &protocol.ClunkResponse{}, nil
+}
+
+func (s *Session) Remove(r *protocol.RemoveRequest) (*protocol.RemoveResponse, error) {
+	f, err := s.lookup(r.Fid)
+	if err != nil {
+		return nil, err
+	}
+
+	// Remove clunks the fid regardless of the outcome.
+	s.Lock()
+	delete(s.fids, r.Fid)
+	s.Unlock()
+
+	if s.rules.ReadOnly {
+		s.up.clunk(f.fid)
+		return nil, ErrReadOnly
+	}
+
+	defer s.untag(r.Tag)
+	if _, err := s.up.c.Remove(&protocol.RemoveRequest{
+		Tag: s.tag(r.Tag),
+		Fid: f.fid,
+	}); err != nil {
+		return nil, err
+	}
+	return &protocol.RemoveResponse{}, nil
+}
+
+func (s *Session) Stat(r *protocol.StatRequest) (*protocol.StatResponse, error) {
+	f, err := s.lookup(r.Fid)
+	if err != nil {
+		return nil, err
+	}
+
+	defer s.untag(r.Tag)
+	resp, err := s.up.c.Stat(&protocol.StatRequest{
+		Tag: s.tag(r.Tag),
+		Fid: f.fid,
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.observe(f, resp.Stat.Qid)
+	return &protocol.StatResponse{Stat: resp.Stat}, nil
+}
+
+func (s *Session) WriteStat(r *protocol.WriteStatRequest) (*protocol.WriteStatResponse, error) {
+	f, err := s.lookup(r.Fid)
+	if err != nil {
+		return nil, err
+	}
+	if s.rules.ReadOnly {
+		return nil, ErrReadOnly
+	}
+	if r.Stat.Name != "" && s.rules.hidden(path.Join(path.Dir(f.path), r.Stat.Name)) {
+		return nil, errors.New("permission denied")
+	}
+
+	defer s.untag(r.Tag)
+	_, err = s.up.c.WriteStat(&protocol.WriteStatRequest{
+		Tag:  s.tag(r.Tag),
+		Fid:  f.fid,
+		Stat: r.Stat,
+	})
+	if s.up.Cache != nil {
+		s.up.Cache.invalidate(f.qid.Path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if r.Stat.Name != "" {
+		s.Lock()
+		f.path = path.Join(path.Dir(f.path), r.Stat.Name)
+		s.Unlock()
+	}
+	return &protocol.WriteStatResponse{}, nil
+}
+
+// NewSession returns a handler for a single client connection.
+func NewSession(up *Upstream, rules Rules) *Session {
+	return &Session{
+		up:      up,
+		rules:   rules,
+		maxSize: up.maxSize,
+		fids:    make(map[protocol.Fid]*fidState),
+		tags:    make(map[protocol.Tag]protocol.Tag),
+	}
+}
+
+// Handler returns a handler constructor suitable for g9p.ServeListener.
+func Handler(up *Upstream, rules Rules) func() g9p.Handler {
+	return func() g9p.Handler {
+		log.Printf("New proxy session")
+		return NewSession(up, rules)
+	}
+}
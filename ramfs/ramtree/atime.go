@@ -0,0 +1,69 @@
+package ramtree
+
+import (
+	"fmt"
+	"time"
+)
+
+// AtimeMode decides when reading a file or directory updates its access
+// time. Modifications always update it.
+type AtimeMode int
+
+const (
+	// AtimeStrict updates the access time on every access.
+	AtimeStrict AtimeMode = iota
+
+	// AtimeRelative only updates the access time if it is not newer than
+	// the modification time, or older than RelatimeInterval, like relatime
+	// on Linux.
+	AtimeRelative
+
+	// AtimeOff never updates the access time on access.
+	AtimeOff
+)
+
+// RelatimeInterval is how old an access time may get under AtimeRelative.
+const RelatimeInterval = 24 * time.Hour
+
+func (m AtimeMode) String() string {
+	switch m {
+	case AtimeStrict:
+		return "strict"
+	case AtimeRelative:
+		return "relatime"
+	case AtimeOff:
+		return "off"
+	default:
+		return fmt.Sprintf("AtimeMode(%d)", int(m))
+	}
+}
+
+// ParseAtimeMode parses the name of an AtimeMode, as returned by String.
+// "noatime" is accepted for AtimeOff.
+func ParseAtimeMode(s string) (AtimeMode, error) {
+	switch s {
+	case "", "strict":
+		return AtimeStrict, nil
+	case "relatime":
+		return AtimeRelative, nil
+	case "off", "noatime":
+		return AtimeOff, nil
+	default:
+		return 0, fmt.Errorf("unknown atime mode %q", s)
+	}
+}
+
+// access updates the access time for a read under mode, given the
+// modification time. It only needs a read lock on the file.
+func (t *atomicTime) access(mode AtimeMode, mtime time.Time) {
+	switch mode {
+	case AtimeOff:
+		return
+	case AtimeRelative:
+		at := t.Load()
+		if at.After(mtime) && time.Since(at) < RelatimeInterval {
+			return
+		}
+	}
+	t.Store(time.Now())
+}
@@ -0,0 +1,139 @@
+package ramtree_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+	"github.com/kennylevinsen/g9ptools/ramfs/ramtree"
+)
+
+const (
+	fileSize  = 1024 * 1024
+	blockSize = 4096
+)
+
+// BenchmarkAppend writes a file a block at a time, which copied the whole
+// file on every write before files grew geometrically.
+func BenchmarkAppend(b *testing.B) {
+	root := ramtree.NewRAMTree("/", 0777, user, user)
+	f, err := root.Create(user, "file", 0666)
+	if err != nil {
+		b.Fatalf("create: %v", err)
+	}
+	buf := make([]byte, blockSize)
+
+	b.SetBytes(fileSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		of, err := f.Open(user, protocol.OWRITE|protocol.OTRUNC)
+		if err != nil {
+			b.Fatalf("open: %v", err)
+		}
+		for n := 0; n < fileSize; n += len(buf) {
+			if _, err := of.Write(buf); err != nil {
+				b.Fatalf("write: %v", err)
+			}
+		}
+		of.Close()
+	}
+}
+
+func BenchmarkRead(b *testing.B) {
+	root := ramtree.NewRAMTree("/", 0777, user, user)
+	f, err := root.Create(user, "file", 0666)
+	if err != nil {
+		b.Fatalf("create: %v", err)
+	}
+	f.(*ramtree.RAMFile).SetContent(make([]byte, fileSize))
+	buf := make([]byte, blockSize)
+
+	b.SetBytes(fileSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		of, err := f.Open(user, protocol.OREAD)
+		if err != nil {
+			b.Fatalf("open: %v", err)
+		}
+		for {
+			n, err := of.Read(buf)
+			if err != nil {
+				b.Fatalf("read: %v", err)
+			}
+			if n == 0 {
+				break
+			}
+		}
+		of.Close()
+	}
+}
+
+func BenchmarkListDir(b *testing.B) {
+	for _, n := range []int{10, 1000, 10000} {
+		n := n
+		b.Run(fmt.Sprintf("entries=%d", n), func(b *testing.B) {
+			root := ramtree.NewRAMTree("/", 0777, user, user)
+			for i := 0; i < n; i++ {
+				if _, err := root.Create(user, fmt.Sprintf("file%d", i), 0666); err != nil {
+					b.Fatalf("create: %v", err)
+				}
+			}
+			buf := make([]byte, 64*1024)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				of, err := root.Open(user, protocol.OREAD)
+				if err != nil {
+					b.Fatalf("open: %v", err)
+				}
+				// Like fileserver, seek first, which prepares the listing.
+				if _, err := of.Seek(0, 0); err != nil {
+					b.Fatalf("seek: %v", err)
+				}
+				for {
+					m, err := of.Read(buf)
+					if err != nil {
+						b.Fatalf("read: %v", err)
+					}
+					if m == 0 {
+						break
+					}
+				}
+				of.Close()
+			}
+		})
+	}
+}
+
+func BenchmarkWalk(b *testing.B) {
+	for _, depth := range []int{1, 8, 16} {
+		depth := depth
+		b.Run(fmt.Sprintf("depth=%d", depth), func(b *testing.B) {
+			root := ramtree.NewRAMTree("/", 0777, user, user)
+			var d fileserver.Dir = root
+			for i := 0; i < depth; i++ {
+				f, err := d.Create(user, "dir", protocol.DMDIR|0777)
+				if err != nil {
+					b.Fatalf("create: %v", err)
+				}
+				d = f.(fileserver.Dir)
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				var f fileserver.File = root
+				for j := 0; j < depth; j++ {
+					var err error
+					if f, err = f.(fileserver.Dir).Walk(user, "dir"); err != nil {
+						b.Fatalf("walk: %v", err)
+					}
+				}
+			}
+		})
+	}
+}
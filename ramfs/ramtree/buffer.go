@@ -0,0 +1,127 @@
+package ramtree
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+)
+
+// CommitFunc receives the full content of a buffered file after it has been
+// written to and closed.
+type CommitFunc func(user string, content []byte) error
+
+// BufferOpenFile holds a private copy of the content of a buffered file.
+// Reads and writes operate on the copy, which is handed to a CommitFunc when
+// the file is closed, provided that it was written to.
+type BufferOpenFile struct {
+	sync.Mutex
+	user    string
+	content []byte
+	offset  int64
+	commit  CommitFunc
+	written bool
+	closed  bool
+}
+
+func (of *BufferOpenFile) Seek(offset int64, whence int) (int64, error) {
+	of.Lock()
+	defer of.Unlock()
+	if of.closed {
+		return 0, errors.New("file not open")
+	}
+	switch whence {
+	case 0:
+	case 1:
+		offset = of.offset + offset
+	case 2:
+		offset = int64(len(of.content)) + offset
+	default:
+		return of.offset, errors.New("invalid whence value")
+	}
+
+	if offset < 0 {
+		return of.offset, errors.New("negative seek invalid")
+	}
+
+	of.offset = offset
+	return of.offset, nil
+}
+
+func (of *BufferOpenFile) Read(p []byte) (int, error) {
+	of.Lock()
+	defer of.Unlock()
+	if of.closed {
+		return 0, errors.New("file not open")
+	}
+	if of.offset >= int64(len(of.content)) {
+		return 0, nil
+	}
+	n := copy(p, of.content[of.offset:])
+	of.offset += int64(n)
+	return n, nil
+}
+
+func (of *BufferOpenFile) Write(p []byte) (int, error) {
+	of.Lock()
+	defer of.Unlock()
+	if of.closed {
+		return 0, errors.New("file not open")
+	}
+	if of.commit == nil {
+		return 0, errors.New("file not writable")
+	}
+
+	end := of.offset + int64(len(p))
+	if end > int64(len(of.content)) {
+		b := make([]byte, end)
+		copy(b, of.content)
+		of.content = b
+	}
+	copy(of.content[of.offset:], p)
+	of.offset = end
+	of.written = true
+	return len(p), nil
+}
+
+func (of *BufferOpenFile) Close() error {
+	of.Lock()
+	defer of.Unlock()
+	if of.closed {
+		return errors.New("file not open")
+	}
+	of.closed = true
+	if !of.written || of.commit == nil {
+		return nil
+	}
+	return of.commit(of.user, of.content)
+}
+
+// BufferOpener returns an OpenFunc producing BufferOpenFiles. The ReadFunc
+// provides the initial content, unless the file is opened with OTRUNC, which
+// commits the empty content on close even if nothing is written. Without a
+// CommitFunc, the file is read-only, and OTRUNC only empties the copy.
+func BufferOpener(read ReadFunc, commit CommitFunc) OpenFunc {
+	return func(user string, mode protocol.OpenMode) (fileserver.OpenFile, error) {
+		of := &BufferOpenFile{
+			user:   user,
+			commit: commit,
+		}
+		if read != nil && mode&protocol.OTRUNC == 0 {
+			b, err := read(user)
+			if err != nil {
+				return nil, err
+			}
+			of.content = append([]byte(nil), b...)
+		}
+		if mode&protocol.OTRUNC != 0 {
+			of.written = true
+		}
+		return of, nil
+	}
+}
+
+func NewBufferFile(name string, permissions protocol.FileMode, user, group string, read ReadFunc, commit CommitFunc) *SyntheticFile {
+	return NewSyntheticFile(name, permissions, user, group, BufferOpener(read, commit))
+}
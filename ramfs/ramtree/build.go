@@ -0,0 +1,261 @@
+package ramtree
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+)
+
+// Spec describes a file to be built by Build. A Spec is a directory if Perm
+// has DMDIR set or it has Children, a symbolic link if Target is set, and a
+// regular file otherwise. User and Group default to those of the parent
+// directory, and a zero Perm to 0644 for files and 0755 for directories. If
+// File is set, it is added as is, and only Name and Children are used.
+type Spec struct {
+	Name     string
+	Perm     protocol.FileMode
+	User     string
+	Group    string
+	Content  []byte
+	Target   string
+	File     fileserver.File
+	Children []Spec
+}
+
+func (s *Spec) isDir() bool {
+	return s.Perm&protocol.DMDIR != 0 || len(s.Children) > 0
+}
+
+// Build returns a new tree described by root, which must be a directory:
+//
+//	t, err := ramtree.Build(ramtree.Spec{
+//		Name: "/", Perm: 0755, User: "glenda", Group: "glenda",
+//		Children: []ramtree.Spec{
+//			{Name: "lib", Children: []ramtree.Spec{
+//				{Name: "motd", Content: []byte("hello\n")},
+//			}},
+//			{Name: "tmp", Perm: protocol.DMDIR | 0777},
+//		},
+//	})
+func Build(root Spec) (*RAMTree, error) {
+	if root.File != nil || root.Target != "" {
+		return nil, errors.New("root must be a directory")
+	}
+	perm := root.Perm
+	if perm&0777 == 0 {
+		perm |= 0755
+	}
+	t := NewRAMTree(root.Name, perm|protocol.DMDIR, root.User, root.Group)
+	if err := t.Build(root.Children...); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Build adds the files described by specs to the tree, along with their
+// children, without checking permissions. Files created by it inherit the
+// settings of the tree, like those created by Create. Building stops at the
+// first error, leaving the files built so far in place.
+func (t *RAMTree) Build(specs ...Spec) error {
+	for i := range specs {
+		if err := t.build(&specs[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *RAMTree) build(s *Spec) error {
+	if s.File != nil {
+		if err := t.Add(s.Name, s.File); err != nil {
+			return fmt.Errorf("%s: %v", s.Name, err)
+		}
+		if len(s.Children) == 0 {
+			return nil
+		}
+		d, ok := s.File.(*RAMTree)
+		if !ok {
+			return fmt.Errorf("%s: children given for a file that is not a RAMTree", s.Name)
+		}
+		return prefixErr(s.Name, d.Build(s.Children...))
+	}
+
+	perm := s.Perm
+	switch {
+	case s.Target != "":
+		perm = DMSYMLINK | 0777
+	case s.isDir():
+		perm |= protocol.DMDIR
+		if perm&0777 == 0 {
+			perm |= 0755
+		}
+	case perm&0777 == 0:
+		perm |= 0644
+	}
+
+	t.Lock()
+	user, group := s.User, s.Group
+	if user == "" {
+		user = t.user
+	}
+	if group == "" {
+		group = t.group
+	}
+	f, err := t.newChild(user, s.Name, user, group, perm)
+	t.Unlock()
+	if err != nil {
+		return fmt.Errorf("%s: %v", s.Name, err)
+	}
+
+	switch f := f.(type) {
+	case *RAMTree:
+		return prefixErr(s.Name, f.Build(s.Children...))
+	case *RAMFile:
+		switch {
+		case s.Target != "":
+			f.SetContent([]byte(s.Target))
+		case s.Content != nil:
+			f.SetContent(s.Content)
+		}
+	}
+	return nil
+}
+
+func prefixErr(name string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return fmt.Errorf("%s/%v", name, err)
+}
+
+// ParseManifest parses a manifest in a format similar to the proto files of
+// Plan 9's mkfs, with one file per line:
+//
+//	# comment
+//	lib	d755 glenda sys
+//		motd	644 - - "hello\n"
+//		news	l - - "/lib/motd"
+//	tmp	d777
+//
+// Each line holds a name and a mode, optionally followed by an owner, a
+// group and a Go-quoted string, which is the content of a file or the target
+// of a symbolic link. An owner or group of "-" is inherited from the parent.
+// Modes are octal, prefixed by "d" for directories, or "l" for symbolic
+// links. Lines indented deeper than a directory describe its children. Names
+// cannot contain spaces or quotes.
+func ParseManifest(r io.Reader) ([]Spec, error) {
+	type level struct {
+		indent string
+		specs  *[]Spec
+	}
+	var root []Spec
+	stack := []level{{indent: "", specs: &root}}
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		trimmed := strings.TrimLeft(line, " \t")
+		if trimmed == "" || trimmed[0] == '#' {
+			continue
+		}
+		indent := line[:len(line)-len(trimmed)]
+
+		s, err := parseManifestLine(trimmed)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+
+		// Leave the directories this line is not indented deeper than.
+		for len(stack) > 1 && len(indent) < len(stack[len(stack)-1].indent) {
+			stack = stack[:len(stack)-1]
+		}
+		top := stack[len(stack)-1]
+		if len(indent) > len(top.indent) {
+			if len(*top.specs) == 0 {
+				return nil, fmt.Errorf("line %d: first line is indented", n)
+			}
+			prev := &(*top.specs)[len(*top.specs)-1]
+			if !prev.isDir() {
+				return nil, fmt.Errorf("line %d: %s is not a directory", n, prev.Name)
+			}
+			if len(prev.Children) > 0 {
+				return nil, fmt.Errorf("line %d: inconsistent indentation", n)
+			}
+			top = level{indent: indent, specs: &prev.Children}
+			stack = append(stack, top)
+		}
+		if indent != top.indent {
+			return nil, fmt.Errorf("line %d: inconsistent indentation", n)
+		}
+		*top.specs = append(*top.specs, s)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return root, nil
+}
+
+func parseManifestLine(line string) (Spec, error) {
+	var s Spec
+	var quoted string
+	if idx := strings.IndexByte(line, '"'); idx != -1 {
+		line, quoted = line[:idx], line[idx:]
+	}
+	fields := strings.Fields(line)
+	if len(fields) < 2 || len(fields) > 4 {
+		return s, errors.New("expected name, mode, and optionally owner, group and content")
+	}
+
+	s.Name = fields[0]
+	if s.Name != path.Base(s.Name) || s.Name == "." || s.Name == ".." {
+		return s, fmt.Errorf("invalid name %q", s.Name)
+	}
+
+	mode := fields[1]
+	switch {
+	case mode == "l":
+		if quoted == "" {
+			return s, errors.New("symbolic link without target")
+		}
+	case strings.HasPrefix(mode, "d"):
+		s.Perm = protocol.DMDIR
+		mode = mode[1:]
+		fallthrough
+	default:
+		perm, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil || perm > 0777 {
+			return s, fmt.Errorf("invalid mode %q", fields[1])
+		}
+		s.Perm |= protocol.FileMode(perm)
+	}
+
+	if len(fields) > 2 && fields[2] != "-" {
+		s.User = fields[2]
+	}
+	if len(fields) > 3 && fields[3] != "-" {
+		s.Group = fields[3]
+	}
+
+	if quoted != "" {
+		content, err := strconv.Unquote(strings.TrimSpace(quoted))
+		if err != nil {
+			return s, fmt.Errorf("invalid content: %v", err)
+		}
+		switch {
+		case fields[1] == "l":
+			s.Target = content
+		case s.Perm&protocol.DMDIR != 0:
+			return s, errors.New("directory with content")
+		default:
+			s.Content = []byte(content)
+		}
+	}
+	return s, nil
+}
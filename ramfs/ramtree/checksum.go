@@ -0,0 +1,63 @@
+package ramtree
+
+import (
+	"crypto/sha256"
+	"io/ioutil"
+	"sync"
+
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+	"github.com/kennylevinsen/g9ptools/fileserver/checksum"
+)
+
+// SetChecksums makes the tree, and directories created in it from now on,
+// serve checksums of files by the conventions of package checksum.
+func (t *RAMTree) SetChecksums(on bool) {
+	t.Lock()
+	defer t.Unlock()
+	t.sums = on
+}
+
+// fileSum is the remembered checksum of a version of a file.
+type fileSum struct {
+	sync.Mutex
+	version uint32
+	sum     []byte
+}
+
+// Checksum implements fileserver.Checksummer, remembering the SHA-256 of
+// the content until it changes.
+func (f *RAMFile) Checksum(user, algorithm string) ([]byte, error) {
+	if algorithm != checksum.Algorithm {
+		return nil, fileserver.ErrUnknownChecksum
+	}
+	f.RLock()
+	defer f.RUnlock()
+	if !f.allowed(user, protocol.OREAD) {
+		return nil, fileserver.ErrPermission
+	}
+
+	f.sum.Lock()
+	defer f.sum.Unlock()
+	if f.sum.sum != nil && f.sum.version == f.version {
+		return append([]byte(nil), f.sum.sum...), nil
+	}
+
+	h := sha256.New()
+	switch {
+	case f.spill != "":
+		b, err := ioutil.ReadFile(f.spill)
+		if err != nil {
+			return nil, err
+		}
+		h.Write(b)
+	case f.blocks != nil:
+		for _, b := range f.blocks {
+			h.Write(b.data)
+		}
+	default:
+		h.Write(f.content)
+	}
+	f.sum.version, f.sum.sum = f.version, h.Sum(nil)
+	return append([]byte(nil), f.sum.sum...), nil
+}
@@ -0,0 +1,167 @@
+package ramtree
+
+import (
+	"crypto/sha256"
+	"sync"
+	"sync/atomic"
+)
+
+// BlockSize is the size of the blocks that deduplicated content is split
+// into.
+const BlockSize = 64 * 1024
+
+// block is a deduplicated piece of content. The data is never modified.
+type block struct {
+	sum  [sha256.Size]byte
+	data []byte
+	refs int
+}
+
+// BlockStore deduplicates the content of files, so that identical content
+// stored in several files is only held once. Files are split into blocks
+// when they are closed after being written to, and are copied out of the
+// store again when next written to.
+type BlockStore struct {
+	sync.Mutex
+	blocks map[[sha256.Size]byte]*block
+	bytes  int64
+}
+
+// intern returns the blocks of b, adding the ones not already in the store.
+func (s *BlockStore) intern(b []byte) []*block {
+	var bs []*block
+	s.Lock()
+	defer s.Unlock()
+	for len(b) > 0 {
+		n := BlockSize
+		if n > len(b) {
+			n = len(b)
+		}
+		sum := sha256.Sum256(b[:n])
+		bl, ok := s.blocks[sum]
+		if !ok {
+			bl = &block{sum: sum, data: append([]byte(nil), b[:n]...)}
+			s.blocks[sum] = bl
+			s.bytes += int64(n)
+		}
+		bl.refs++
+		bs = append(bs, bl)
+		b = b[n:]
+	}
+	return bs
+}
+
+// release drops a reference to each of bs, removing unused blocks.
+func (s *BlockStore) release(bs []*block) {
+	s.Lock()
+	defer s.Unlock()
+	for _, bl := range bs {
+		bl.refs--
+		if bl.refs == 0 {
+			delete(s.blocks, bl.sum)
+			s.bytes -= int64(len(bl.data))
+		}
+	}
+}
+
+// Stats returns the number of blocks in the store, and the number of bytes
+// they hold.
+func (s *BlockStore) Stats() (int, int64) {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.blocks), s.bytes
+}
+
+func NewBlockStore() *BlockStore {
+	return &BlockStore{blocks: make(map[[sha256.Size]byte]*block)}
+}
+
+// size returns the length of the content. Must be called with the file read
+// locked.
+func (f *RAMFile) size() int64 {
+	if f.spill != "" {
+		return f.slen
+	}
+	if f.blocks != nil {
+		return f.blen
+	}
+	return int64(len(f.content))
+}
+
+// dedup moves the content of the file into the block store, if it has one.
+// Must be called with the file locked.
+func (f *RAMFile) dedup() {
+	if f.store == nil || f.blocks != nil || len(f.content) == 0 {
+		return
+	}
+	f.blocks = f.store.intern(f.content)
+	f.blen = int64(len(f.content))
+	f.content = nil
+	atomic.StoreUint32(&f.shared, 0)
+}
+
+// materialize copies deduplicated content out of the block store, so that it
+// can be modified. Must be called with the file locked.
+func (f *RAMFile) materialize() {
+	if f.blocks == nil {
+		return
+	}
+	b := make([]byte, 0, f.blen)
+	for _, bl := range f.blocks {
+		b = append(b, bl.data...)
+	}
+	f.store.release(f.blocks)
+	f.blocks = nil
+	f.blen = 0
+	f.content = b
+}
+
+// dropContent discards the content. Must be called with the file locked.
+func (f *RAMFile) dropContent() {
+	f.unspill()
+	if f.blocks != nil {
+		f.store.release(f.blocks)
+		f.blocks = nil
+		f.blen = 0
+	}
+	f.content = nil
+}
+
+// readAt copies content at off into p, returning the number of bytes copied.
+// Must be called with the file read locked.
+func (f *RAMFile) readAt(p []byte, off int64) int {
+	if f.blocks == nil {
+		if off >= int64(len(f.content)) {
+			return 0
+		}
+		return copy(p, f.content[off:])
+	}
+	n := 0
+	for i := off / BlockSize; i < int64(len(f.blocks)) && n < len(p); i++ {
+		data := f.blocks[i].data
+		if i == off/BlockSize {
+			data = data[off%BlockSize:]
+		}
+		n += copy(p[n:], data)
+	}
+	return n
+}
+
+// slice returns a view of the content from off up to end, which may be cut
+// short at a block boundary. Must be called with the file read locked.
+func (f *RAMFile) slice(off, end int64) []byte {
+	if f.blocks == nil {
+		atomic.StoreUint32(&f.shared, 1)
+		return f.content[off:end:end]
+	}
+	if off >= end {
+		return nil
+	}
+	data := f.blocks[off/BlockSize].data
+	start := off % BlockSize
+	stop := start + end - off
+	if stop > int64(len(data)) {
+		stop = int64(len(data))
+	}
+	return data[start:stop:stop]
+}
@@ -0,0 +1,138 @@
+package ramtree
+
+import (
+	"sort"
+	"time"
+)
+
+// SetEvict makes writes that would exceed the quota evict the least recently
+// accessed files instead of failing. Files that are open, pinned or have
+// several links are never evicted.
+func (q *Quota) SetEvict(evict bool) {
+	q.Lock()
+	defer q.Unlock()
+	q.evict = evict
+}
+
+// track registers a file whose content is accounted to the quota, so that it
+// can be evicted.
+func (q *Quota) track(f *RAMFile) {
+	if q == nil {
+		return
+	}
+	q.Lock()
+	defer q.Unlock()
+	if q.files == nil {
+		q.files = make(map[*RAMFile]struct{})
+	}
+	q.files[f] = struct{}{}
+}
+
+// untrack unregisters a removed file.
+func (q *Quota) untrack(f *RAMFile) {
+	if q == nil {
+		return
+	}
+	q.Lock()
+	defer q.Unlock()
+	delete(q.files, f)
+}
+
+// makeRoom evicts files until n more bytes fit in the quota, if eviction is
+// enabled. exclude is never evicted. It must be called without any file or
+// tree locked, and gives no guarantee that the room is still available when
+// it returns.
+func (q *Quota) makeRoom(n int64, exclude *RAMFile) {
+	if q == nil || n <= 0 {
+		return
+	}
+	q.Lock()
+	if !q.evict || q.max <= 0 || q.used+n <= q.max {
+		q.Unlock()
+		return
+	}
+	var files []*RAMFile
+	for f := range q.files {
+		if f != exclude {
+			files = append(files, f)
+		}
+	}
+	q.Unlock()
+
+	type candidate struct {
+		f     *RAMFile
+		atime time.Time
+	}
+	var cands []candidate
+	for _, f := range files {
+		f.RLock()
+		if f.opens == 0 && !f.pinned && f.nlink == 1 && f.size() > 0 {
+			cands = append(cands, candidate{f, f.atime.Load()})
+		}
+		f.RUnlock()
+	}
+	sort.Slice(cands, func(i, j int) bool {
+		return cands[i].atime.Before(cands[j].atime)
+	})
+
+	for _, c := range cands {
+		q.Lock()
+		fits := q.used+n <= q.max
+		q.Unlock()
+		if fits {
+			return
+		}
+		c.f.evict()
+	}
+}
+
+// evict removes the file from its tree, unless it has been opened, pinned or
+// linked since it was picked for eviction.
+func (f *RAMFile) evict() {
+	f.RLock()
+	t, ok := f.parent.(*RAMTree)
+	name := f.name
+	f.RUnlock()
+	if !ok {
+		return
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	key := t.names.key(name)
+	if t.tree[key] != f {
+		return
+	}
+	f.RLock()
+	busy := f.opens > 0 || f.pinned || f.nlink > 1
+	f.RUnlock()
+	if busy {
+		return
+	}
+	releaseFile(t, f)
+	delete(t.tree, key)
+	t.releaseID(key)
+	t.mtime = time.Now()
+	t.changed()
+}
+
+// SetPinned sets whether the file is protected from eviction.
+func (f *RAMFile) SetPinned(pinned bool) {
+	f.Lock()
+	defer f.Unlock()
+	f.pinned = pinned
+}
+
+// Pinned reports whether the file is protected from eviction.
+func (f *RAMFile) Pinned() bool {
+	f.RLock()
+	defer f.RUnlock()
+	return f.pinned
+}
+
+// Evicts reports whether eviction is enabled.
+func (q *Quota) Evicts() bool {
+	q.Lock()
+	defer q.Unlock()
+	return q.evict
+}
@@ -0,0 +1,120 @@
+package ramtree
+
+import (
+	"strings"
+	"time"
+
+	"github.com/kennylevinsen/g9ptools/fileserver"
+)
+
+// SetExpiry makes the file expire at tm, after which Expire removes it. The
+// zero time makes the file never expire.
+func (f *RAMFile) SetExpiry(tm time.Time) {
+	f.Lock()
+	defer f.Unlock()
+	f.expires = tm
+}
+
+// Expiry returns the time the file expires, or the zero time if it never
+// does.
+func (f *RAMFile) Expiry() time.Time {
+	f.RLock()
+	defer f.RUnlock()
+	return f.expires
+}
+
+// expired reports whether the file has expired at now.
+func (f *RAMFile) expired(now time.Time) bool {
+	f.RLock()
+	defer f.RUnlock()
+	return !f.expires.IsZero() && !now.Before(f.expires)
+}
+
+// Expire removes the files of t and its subdirectories that have expired at
+// now, and returns how many were removed. Like other removals, files that
+// are open keep working until closed.
+func (t *RAMTree) Expire(now time.Time) int {
+	t.Lock()
+	var subs []*RAMTree
+	n := 0
+	for name, f := range t.tree {
+		switch f := f.(type) {
+		case *RAMFile:
+			if !f.expired(now) {
+				continue
+			}
+			releaseFile(t, f)
+			delete(t.tree, name)
+			t.releaseID(name)
+			n++
+		case *RAMTree:
+			subs = append(subs, f)
+		}
+	}
+	if n > 0 {
+		t.mtime = now
+		t.changed()
+	}
+	t.Unlock()
+
+	for _, sub := range subs {
+		n += sub.Expire(now)
+	}
+	return n
+}
+
+// Lookup returns the file at the slash-separated path p, relative to t,
+// without checking permissions.
+func (t *RAMTree) Lookup(p string) (fileserver.File, error) {
+	var f fileserver.File = t
+	for _, name := range strings.Split(p, "/") {
+		if name == "" || name == "." {
+			continue
+		}
+		d, ok := f.(*RAMTree)
+		if !ok {
+			return nil, fileserver.ErrNotDir
+		}
+		d.RLock()
+		f, ok = d.tree[d.names.key(name)]
+		d.RUnlock()
+		if !ok {
+			return nil, fileserver.ErrNotExist
+		}
+	}
+	return f, nil
+}
+
+// Sweeper periodically removes expired files from a tree.
+type Sweeper struct {
+	t    *RAMTree
+	stop chan struct{}
+}
+
+func (s *Sweeper) run(interval time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case now := <-tick.C:
+			s.t.Expire(now)
+		}
+	}
+}
+
+// Stop stops the sweeper.
+func (s *Sweeper) Stop() {
+	close(s.stop)
+}
+
+// NewSweeper starts removing expired files from t every interval.
+func NewSweeper(t *RAMTree, interval time.Duration) *Sweeper {
+	s := &Sweeper{
+		t:    t,
+		stop: make(chan struct{}),
+	}
+	go s.run(interval)
+	return s
+}
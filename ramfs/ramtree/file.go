@@ -2,7 +2,9 @@ package ramtree
 
 import (
 	"errors"
+	"io/ioutil"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/kennylevinsen/g9p/protocol"
@@ -12,6 +14,8 @@ import (
 type RAMOpenFile struct {
 	offset int64
 	f      *RAMFile
+	// user opened the file, and is recorded as the last modifier on writes.
+	user string
 }
 
 func (of *RAMOpenFile) Seek(offset int64, whence int) (int64, error) {
@@ -20,7 +24,7 @@ func (of *RAMOpenFile) Seek(offset int64, whence int) (int64, error) {
 	}
 	of.f.RLock()
 	defer of.f.RUnlock()
-	length := int64(len(of.f.content))
+	length := of.f.size()
 	switch whence {
 	case 0:
 	case 1:
@@ -35,12 +39,12 @@ func (of *RAMOpenFile) Seek(offset int64, whence int) (int64, error) {
 		return of.offset, errors.New("negative seek invalid")
 	}
 
-	if offset > int64(len(of.f.content)) {
-		offset = int64(len(of.f.content))
+	if offset > length {
+		offset = length
 	}
 
 	of.offset = offset
-	of.f.atime = time.Now()
+	of.f.atime.access(of.f.atimeMode, of.f.mtime)
 	return of.offset, nil
 }
 
@@ -51,45 +55,149 @@ func (of *RAMOpenFile) Read(p []byte) (int, error) {
 	of.f.RLock()
 	defer of.f.RUnlock()
 	maxRead := int64(len(p))
-	remaining := int64(len(of.f.content)) - of.offset
+	remaining := of.f.size() - of.offset
+	if remaining < 0 {
+		// The file was truncated by someone else.
+		remaining = 0
+		of.offset = of.f.size()
+	}
 	if maxRead > remaining {
 		maxRead = remaining
 	}
 
-	copy(p, of.f.content[of.offset:maxRead+of.offset])
+	of.f.readAt(p[:maxRead], of.offset)
 	of.offset += maxRead
-	of.f.atime = time.Now()
+	of.f.atime.access(of.f.atimeMode, of.f.mtime)
 	return int(maxRead), nil
 }
 
+// Slice implements fileserver.Slicer, handing out a view of the content. The
+// content is marked as shared, so that the next write copies it first.
+// Deduplicated content is never modified, and is handed out a block at a
+// time.
+func (of *RAMOpenFile) Slice(off int64, n int) ([]byte, error) {
+	if of.f == nil {
+		return nil, errors.New("file not open")
+	}
+	if off < 0 {
+		return nil, errors.New("negative seek invalid")
+	}
+	of.f.RLock()
+	defer of.f.RUnlock()
+	length := of.f.size()
+	if off > length {
+		off = length
+	}
+	end := off + int64(n)
+	if end > length {
+		end = length
+	}
+	of.f.atime.access(of.f.atimeMode, of.f.mtime)
+	return of.f.slice(off, end), nil
+}
+
 func (of *RAMOpenFile) Write(p []byte) (int, error) {
+	n, err := of.WriteAt(p, of.offset)
+	of.offset += int64(n)
+	return n, err
+}
+
+// WriteAt writes p at off, extending the file as needed. It does not affect
+// the offset used by Read and Write.
+func (of *RAMOpenFile) WriteAt(p []byte, off int64) (int, error) {
+	f := of.f
+	n, err := of.writeAt(p, off)
+	if n > 0 {
+		f.hooks.written(of.user, f, off, n)
+	}
+	return n, err
+}
+
+// writeAt implements WriteAt, without calling hooks.
+func (of *RAMOpenFile) writeAt(p []byte, off int64) (int, error) {
 	if of.f == nil {
 		return 0, errors.New("file not open")
 	}
+	if off < 0 {
+		return 0, errors.New("negative seek invalid")
+	}
+
+	of.f.RLock()
+	grow := int64(len(p)) + off - of.f.size()
+	of.f.RUnlock()
+	of.f.quota.makeRoom(grow, of.f)
+
+	of.f.Lock()
+	defer of.f.Unlock()
+	defer of.f.account(int64(len(of.f.content)))
+	of.f.materialize()
 
 	// TODO(kl): handle append-only
 	wlen := int64(len(p))
 
-	if wlen+of.offset > int64(len(of.f.content)) {
-		b := make([]byte, wlen+of.offset)
-		copy(b, of.f.content[:of.offset])
-		of.f.content = b
+	end := wlen + off
+	if end > int64(len(of.f.content)) {
+		if err := of.f.quota.reserve(end - int64(len(of.f.content))); err != nil {
+			return 0, err
+		}
+		if end <= int64(cap(of.f.content)) && atomic.LoadUint32(&of.f.shared) == 0 {
+			// Extend in place, clearing what lies between the old end
+			// and the write, which may hold truncated content.
+			old := len(of.f.content)
+			of.f.content = of.f.content[:end]
+			for i := int64(old); i < off; i++ {
+				of.f.content[i] = 0
+			}
+		} else {
+			// Grow the capacity geometrically, so that a file written
+			// by appending is copied a logarithmic number of times,
+			// rather than on every write.
+			c := 2 * int64(cap(of.f.content))
+			if c < end {
+				c = end
+			}
+			b := make([]byte, end, c)
+			copy(b, of.f.content)
+			of.f.content = b
+			atomic.StoreUint32(&of.f.shared, 0)
+		}
+	} else if atomic.LoadUint32(&of.f.shared) != 0 {
+		of.f.content = append([]byte(nil), of.f.content...)
+		atomic.StoreUint32(&of.f.shared, 0)
 	}
 
-	copy(of.f.content[of.offset:], p)
+	copy(of.f.content[off:], p)
 
-	of.offset += wlen
+	of.f.muser = of.user
 	of.f.mtime = time.Now()
-	of.f.atime = of.f.mtime
+	of.f.atime.Store(of.f.mtime)
 	of.f.version++
+	of.f.invalidate()
 	return int(wlen), nil
 }
 
 func (of *RAMOpenFile) Close() error {
-	of.f.Lock()
-	defer of.f.Unlock()
-	of.f.opens--
+	f := of.f
+	if f == nil {
+		return errors.New("file not open")
+	}
+	f.Lock()
+	before := int64(len(f.content))
+	f.opens--
+	if f.opens == 0 {
+		if f.removed {
+			f.quota.release(f.size())
+			f.dropContent()
+			f.spiller.untrack(f)
+		} else {
+			f.dedup()
+		}
+	}
+	f.account(before)
+	f.Unlock()
 	of.f = nil
+
+	f.spiller.check()
 	return nil
 }
 
@@ -102,11 +210,53 @@ type RAMFile struct {
 	user        string
 	group       string
 	muser       string
-	atime       time.Time
+	atime       atomicTime
+	atimeMode   AtimeMode
 	mtime       time.Time
 	version     uint32
 	permissions protocol.FileMode
+	policy      fileserver.PermissionPolicy
 	opens       uint
+	quota       *Quota
+	store       *BlockStore
+
+	// blocks holds the content instead of content when it is deduplicated,
+	// with blen being its length.
+	blocks []*block
+	blen   int64
+
+	// spill is the file holding the content instead of content when it has
+	// been spilled to disk, with slen being its length.
+	spiller *Spiller
+	spill   string
+	slen    int64
+
+	// shared is set when content has been handed out by Slice, and must be
+	// copied before it is modified. It is accessed atomically, as Slice only
+	// holds a read lock.
+	shared uint32
+
+	// removed is set when the file has been removed from its tree, but may
+	// still be open.
+	removed bool
+
+	// expires is when the file is removed by Expire, if not zero.
+	expires time.Time
+
+	// pinned protects the file from eviction.
+	pinned bool
+
+	// nlink is the number of names of the file, and dirs counts the links
+	// to it in each directory, apart from the original name.
+	nlink int
+	dirs  map[*RAMTree]int
+
+	xattrs xattrs
+	sum    fileSum
+
+	// hooks are those of the tree the file was created in, or set by
+	// SetHooks, and are not changed once the file is served.
+	hooks *Hooks
 }
 
 func (f *RAMFile) SetParent(d fileserver.Dir) error {
@@ -123,31 +273,91 @@ func (f *RAMFile) Name() (string, error) {
 }
 
 func (f *RAMFile) Qid() (protocol.Qid, error) {
+	typ := protocol.QTFILE
+	if f.permissions&DMSYMLINK != 0 {
+		typ = QTSYMLINK
+	}
 	return protocol.Qid{
-		Type:    protocol.QTFILE,
+		Type:    typ,
 		Version: f.version,
 		Path:    f.id,
 	}, nil
 }
 
+// WriteStat applies the fields of s that are not set to the "don't touch"
+// values of empty strings and all bits set. The fields are validated before
+// any are applied, so a failed WriteStat changes nothing. Permissions are
+// checked by the caller.
 func (f *RAMFile) WriteStat(s protocol.Stat) error {
-	if s.Length != ^uint64(0) {
-		if s.Length > uint64(len(f.content)) {
-			return errors.New("cannot extend length")
+	if s.Length != ^uint64(0) && int64(s.Length) >= 0 {
+		f.RLock()
+		grow := int64(s.Length) - f.size()
+		f.RUnlock()
+		f.quota.makeRoom(grow, f)
+	}
+
+	f.Lock()
+	defer f.Unlock()
+	defer f.account(int64(len(f.content)))
+	if s.Mode != ^protocol.FileMode(0) && s.Mode&protocol.DMDIR != 0 {
+		return errors.New("cannot make a file a directory")
+	}
+	if s.Mode != ^protocol.FileMode(0) && (s.Mode^f.permissions)&DMSYMLINK != 0 {
+		return errors.New("cannot change whether a file is a symbolic link")
+	}
+	if s.Length != ^uint64(0) && s.Length != uint64(f.size()) {
+		if err := f.load(); err != nil {
+			return err
 		}
-		f.content = f.content[:s.Length]
 	}
-	f.name = s.Name
-	f.user = s.UID
-	f.group = s.GID
-	f.permissions = s.Mode
-	f.mtime = time.Now()
-	f.atime = f.mtime
+	if s.Length != ^uint64(0) && s.Length > uint64(f.size()) {
+		if int64(s.Length) < 0 {
+			return errors.New("length too large")
+		}
+		// Reserving is the last step that can fail.
+		if err := f.quota.reserve(int64(s.Length) - f.size()); err != nil {
+			return err
+		}
+	}
+
+	mtime := f.mtime
+	if s.Length != ^uint64(0) && s.Length != uint64(f.size()) {
+		f.materialize()
+		if s.Length < uint64(len(f.content)) {
+			f.quota.release(int64(len(f.content)) - int64(s.Length))
+			f.content = f.content[:s.Length]
+		} else {
+			// Extend with zeroes.
+			b := make([]byte, s.Length)
+			copy(b, f.content)
+			f.content = b
+			atomic.StoreUint32(&f.shared, 0)
+		}
+		f.mtime = time.Now()
+	}
+	if s.Name != "" {
+		f.name = displayIn(f.parent, s.Name)
+	}
+	if s.UID != "" {
+		f.user = s.UID
+	}
+	if s.GID != "" {
+		f.group = s.GID
+	}
+	if s.Mode != ^protocol.FileMode(0) {
+		f.permissions = s.Mode
+	}
+	if s.Mtime != ^uint32(0) && s.Mtime != uint32(mtime.Unix()) {
+		f.mtime = time.Unix(int64(s.Mtime), 0)
+	}
 	f.version++
+	f.invalidate()
 	return nil
 }
 
 func (f *RAMFile) Stat() (protocol.Stat, error) {
+	f.RLock()
+	defer f.RUnlock()
 	q, err := f.Qid()
 	if err != nil {
 		return protocol.Stat{}, err
@@ -160,28 +370,83 @@ func (f *RAMFile) Stat() (protocol.Stat, error) {
 		Qid:    q,
 		Mode:   f.permissions,
 		Name:   n,
-		Length: uint64(len(f.content)),
+		Length: uint64(f.size()),
 		UID:    f.user,
-		GID:    f.user,
-		MUID:   f.user,
-		Atime:  uint32(f.atime.Unix()),
+		GID:    f.group,
+		MUID:   f.muser,
+		Atime:  uint32(f.atime.Load().Unix()),
 		Mtime:  uint32(f.mtime.Unix()),
 	}, nil
 }
 
 func (f *RAMFile) Open(user string, mode protocol.OpenMode) (fileserver.OpenFile, error) {
-	owner := f.user == user
-	if !permCheck(owner, f.permissions, mode) {
-		return nil, errors.New("access denied")
+	f.Lock()
+	if !f.allowed(user, mode) {
+		f.Unlock()
+		return nil, fileserver.ErrPermission
+	}
+	of, err := f.open(user, mode)
+	f.Unlock()
+	if err != nil {
+		return nil, err
 	}
 
-	f.atime = time.Now()
+	f.hooks.opened(user, f, mode)
+	return of, nil
+}
 
-	f.Lock()
-	defer f.Unlock()
+// open opens the file without checking permissions, truncating it if
+// requested, and otherwise reading back spilled content. Must be called with
+// the file locked.
+func (f *RAMFile) open(user string, mode protocol.OpenMode) (*RAMOpenFile, error) {
+	defer f.account(int64(len(f.content)))
+	if mode&protocol.OTRUNC != 0 && f.size() > 0 {
+		f.quota.release(f.size())
+		f.dropContent()
+		f.mtime = time.Now()
+		f.muser = user
+		f.version++
+		f.invalidate()
+	} else if err := f.load(); err != nil {
+		return nil, err
+	}
+
+	f.atime.access(f.atimeMode, f.mtime)
 	f.opens++
+	return &RAMOpenFile{f: f, user: user}, nil
+}
 
-	return &RAMOpenFile{f: f}, nil
+// Content returns a copy of the content of the file.
+func (f *RAMFile) Content() []byte {
+	f.RLock()
+	defer f.RUnlock()
+	if f.spill != "" {
+		b, _ := ioutil.ReadFile(f.spill)
+		return b
+	}
+	b := make([]byte, f.size())
+	f.readAt(b, 0)
+	return b
+}
+
+// SetContent replaces the content of the file.
+func (f *RAMFile) SetContent(b []byte) {
+	f.Lock()
+	defer f.Unlock()
+	defer f.account(int64(len(f.content)))
+	// SetContent cannot fail, so the quota is only accounted for, and not
+	// enforced.
+	f.quota.release(f.size())
+	f.quota.charge(int64(len(b)))
+	f.dropContent()
+	f.content = append([]byte(nil), b...)
+	if f.opens == 0 {
+		f.dedup()
+	}
+	f.mtime = time.Now()
+	f.atime.Store(f.mtime)
+	f.version++
+	f.invalidate()
 }
 
 func (f *RAMFile) IsDir() (bool, error) {
@@ -199,8 +464,9 @@ func NewRAMFile(name string, permissions protocol.FileMode, user, group string)
 		user:        user,
 		group:       group,
 		muser:       user,
+		nlink:       1,
 		id:          nextID(),
-		atime:       time.Now(),
+		atime:       newAtomicTime(time.Now()),
 		mtime:       time.Now(),
 	}
 }
@@ -0,0 +1,63 @@
+package ramtree
+
+import (
+	"path"
+	"sort"
+
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+	"github.com/kennylevinsen/g9ptools/fileserver/findfs"
+)
+
+// SetFind makes the tree, and directories created in it from now on, answer
+// searches by the conventions of package findfs.
+func (t *RAMTree) SetFind(on bool) {
+	t.Lock()
+	defer t.Unlock()
+	t.find = on
+}
+
+// Search implements findfs.Searcher, walking the tree in memory rather than
+// by opening and reading every directory. Directories the user may not list
+// and search are skipped.
+func (t *RAMTree) Search(user string, q findfs.Query, fn func(p string) error) error {
+	return t.search(user, "", q, fn)
+}
+
+func (t *RAMTree) search(user, prefix string, q findfs.Query, fn func(p string) error) error {
+	t.RLock()
+	if !t.allowed(user, protocol.OREAD) || !t.allowed(user, protocol.OEXEC) {
+		t.RUnlock()
+		return nil
+	}
+	// The children are collected first, so that the tree is not kept
+	// locked while fn waits for a slow reader.
+	children := make(map[string]fileserver.File, len(t.tree))
+	for _, f := range t.tree {
+		if name, err := f.Name(); err == nil {
+			children[name] = f
+		}
+	}
+	t.RUnlock()
+
+	names := make([]string, 0, len(children))
+	for name := range children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		p := path.Join(prefix, name)
+		if q.Match(p) {
+			if err := fn(p); err != nil {
+				return err
+			}
+		}
+		if sub, ok := children[name].(*RAMTree); ok {
+			if err := sub.search(user, p, q, fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package ramtree
+
+import (
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+)
+
+// Hooks lets applications embedding a tree react to what clients do in it,
+// such as applying a configuration file when it is written, without
+// polling. Every callback is optional, and is called once the operation has
+// succeeded and the locks of the tree have been released, so it may use the
+// tree freely. Callbacks run on the goroutine serving the request, which
+// they hold up until they return.
+//
+// Files and directories created in a tree with hooks share them. Changes
+// made through the API, such as Add, Delete and SetContent, do not call
+// them.
+type Hooks struct {
+	// OnCreate is called when user has created f in dir.
+	OnCreate func(user string, dir *RAMTree, f fileserver.File)
+	// OnOpen is called when user has opened f with mode.
+	OnOpen func(user string, f fileserver.File, mode protocol.OpenMode)
+	// OnWrite is called when user has written n bytes to f at off.
+	OnWrite func(user string, f *RAMFile, off int64, n int)
+	// OnRemove is called when user has removed f from dir.
+	OnRemove func(user string, dir *RAMTree, f fileserver.File)
+}
+
+// SetHooks sets the hooks of the tree, and of everything created in it from
+// now on. A nil Hooks removes them.
+func (t *RAMTree) SetHooks(h *Hooks) {
+	t.Lock()
+	defer t.Unlock()
+	t.hooks = h
+}
+
+// SetHooks sets the hooks of a file that was not created in a tree with
+// them, such as one added with Add. It must be called before the file is
+// served.
+func (f *RAMFile) SetHooks(h *Hooks) {
+	f.Lock()
+	defer f.Unlock()
+	f.hooks = h
+}
+
+// The methods below call the hooks, if any. A nil Hooks has none.
+
+func (h *Hooks) created(user string, dir *RAMTree, f fileserver.File) {
+	if h != nil && h.OnCreate != nil {
+		h.OnCreate(user, dir, f)
+	}
+}
+
+func (h *Hooks) opened(user string, f fileserver.File, mode protocol.OpenMode) {
+	if h != nil && h.OnOpen != nil {
+		h.OnOpen(user, f, mode)
+	}
+}
+
+func (h *Hooks) written(user string, f *RAMFile, off int64, n int) {
+	if h != nil && h.OnWrite != nil {
+		h.OnWrite(user, f, off, n)
+	}
+}
+
+func (h *Hooks) removed(user string, dir *RAMTree, f fileserver.File) {
+	if h != nil && h.OnRemove != nil {
+		h.OnRemove(user, dir, f)
+	}
+}
@@ -0,0 +1,121 @@
+package ramtree
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+)
+
+// IDAllocator allocates qid paths for files created in a RAMTree.
+type IDAllocator interface {
+	// NextID returns the qid path of a file called name created in the
+	// directory with qid path parent.
+	NextID(parent uint64, name string) uint64
+
+	// Release is called when the file called name in the directory with
+	// qid path parent is removed or renamed, after which the name may be
+	// reused by a different file.
+	Release(parent uint64, name string)
+}
+
+// HashIDs derives qid paths from a hash of the seed, the qid path of the
+// parent directory and the name, making them stable across restarts as long
+// as the tree is rebuilt the same way. A file created where another was
+// previously removed or renamed from gets a different path, as required by
+// 9P, by hashing in the number of times the name has been released.
+type HashIDs struct {
+	sync.Mutex
+	seed        string
+	generations map[hashKey]uint64
+}
+
+type hashKey struct {
+	parent uint64
+	name   string
+}
+
+func (h *HashIDs) NextID(parent uint64, name string) uint64 {
+	h.Lock()
+	gen := h.generations[hashKey{parent, name}]
+	h.Unlock()
+
+	var b [8]byte
+	hash := fnv.New64a()
+	hash.Write([]byte(h.seed))
+	binary.LittleEndian.PutUint64(b[:], parent)
+	hash.Write(b[:])
+	hash.Write([]byte(name))
+	binary.LittleEndian.PutUint64(b[:], gen)
+	hash.Write(b[:])
+	return hash.Sum64()
+}
+
+func (h *HashIDs) Release(parent uint64, name string) {
+	h.Lock()
+	defer h.Unlock()
+	h.generations[hashKey{parent, name}]++
+}
+
+// NewHashIDs returns a HashIDs. Trees served side by side should use
+// different seeds, such as their service names.
+func NewHashIDs(seed string) *HashIDs {
+	return &HashIDs{
+		seed:        seed,
+		generations: make(map[hashKey]uint64),
+	}
+}
+
+// Counter allocates qid paths sequentially. Released paths are never reused.
+type Counter struct {
+	next uint64 // accessed atomically
+}
+
+func (c *Counter) NextID(parent uint64, name string) uint64 {
+	return atomic.AddUint64(&c.next, 1) - 1
+}
+
+func (c *Counter) Release(parent uint64, name string) {}
+
+// Reserve makes sure that id is never returned by NextID, by skipping past
+// it. It is used when restoring a tree with previously allocated paths.
+func (c *Counter) Reserve(id uint64) {
+	for {
+		next := atomic.LoadUint64(&c.next)
+		if id < next || atomic.CompareAndSwapUint64(&c.next, next, id+1) {
+			return
+		}
+	}
+}
+
+// NewCounter returns a Counter starting at start.
+func NewCounter(start uint64) *Counter {
+	return &Counter{next: start}
+}
+
+// NamespaceBits is the number of high bits of a qid path that Namespace
+// replaces with the namespace.
+const NamespaceBits = 16
+
+type namespaced struct {
+	ns  uint64
+	ids IDAllocator
+}
+
+func (n *namespaced) NextID(parent uint64, name string) uint64 {
+	const mask = 1<<(64-NamespaceBits) - 1
+	return n.ns<<(64-NamespaceBits) | n.ids.NextID(parent, name)&mask
+}
+
+func (n *namespaced) Release(parent uint64, name string) {
+	n.ids.Release(parent, name)
+}
+
+// Namespace returns an IDAllocator placing ns in the high NamespaceBits bits
+// of the paths allocated by ids. Trees served together, such as through a
+// proxy or in the same server, should have different namespaces, so that
+// their qid paths cannot collide. Namespace 0 is used by trees without an
+// IDAllocator.
+func Namespace(ns uint16, ids IDAllocator) IDAllocator {
+	return &namespaced{ns: uint64(ns), ids: ids}
+}
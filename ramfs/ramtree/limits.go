@@ -0,0 +1,70 @@
+package ramtree
+
+import "errors"
+
+var (
+	errInvalidName  = errors.New("invalid file name")
+	errNameTooLong  = errors.New("file name too long")
+	errTooDeep      = errors.New("path too deep")
+	errTooManyFiles = errors.New("too many files in directory")
+)
+
+// Limits restricts the names and shape of a tree. Zero fields are
+// unlimited.
+type Limits struct {
+	// MaxName is the maximum length of a name in bytes.
+	MaxName int
+	// MaxDepth is the maximum number of path elements below the root.
+	MaxDepth int
+	// MaxChildren is the maximum number of entries in a directory.
+	MaxChildren int
+}
+
+// SetLimits sets the limits of the tree and the directories created in it
+// from now on.
+func (t *RAMTree) SetLimits(l Limits) {
+	t.Lock()
+	defer t.Unlock()
+	t.limits = l
+}
+
+// checkName checks that name may be used for an entry of t. "." and ".." are
+// never allowed, as they could not be walked to. Must be called with the
+// tree locked.
+func (t *RAMTree) checkName(name string) error {
+	if name == "" || name == "." || name == ".." {
+		return errInvalidName
+	}
+	if t.limits.MaxName > 0 && len(name) > t.limits.MaxName {
+		return errNameTooLong
+	}
+	return nil
+}
+
+// checkRoom checks that another entry may be added to t. Moving a directory
+// only checks the depth of the directory itself, not of its content. Must be
+// called with the tree locked.
+func (t *RAMTree) checkRoom() error {
+	if t.limits.MaxChildren > 0 && len(t.tree) >= t.limits.MaxChildren {
+		return errTooManyFiles
+	}
+	if t.limits.MaxDepth > 0 && t.depth()+1 > t.limits.MaxDepth {
+		return errTooDeep
+	}
+	return nil
+}
+
+// depth returns the number of path elements from the root to t. Like the
+// check in Move, the parents are not locked, as a tree only changes parent
+// with both trees locked.
+func (t *RAMTree) depth() int {
+	n := 0
+	for p := t.parent; p != nil; n++ {
+		pt, ok := p.(*RAMTree)
+		if !ok {
+			break
+		}
+		p = pt.parent
+	}
+	return n
+}
@@ -0,0 +1,160 @@
+package ramtree
+
+import (
+	"errors"
+	"time"
+
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+)
+
+// RAMLink is an additional name of a RAMFile, created by Link. Everything
+// but the name is shared with the file, including the qid, so the file is
+// the same through all of its names. The content is freed once the last name
+// is removed and the file is no longer open.
+type RAMLink struct {
+	*RAMFile
+	name string
+	dir  *RAMTree
+}
+
+// Name returns the name of the link.
+func (l *RAMLink) Name() (string, error) {
+	l.RLock()
+	defer l.RUnlock()
+	return l.name, nil
+}
+
+// SetParent moves the link to d.
+func (l *RAMLink) SetParent(d fileserver.Dir) error {
+	t, ok := d.(*RAMTree)
+	if !ok {
+		return errors.New("links can only be in RAM trees")
+	}
+	l.Lock()
+	defer l.Unlock()
+	l.RAMFile.unlinkDir(l.dir)
+	l.RAMFile.linkDir(t)
+	l.dir = t
+	return nil
+}
+
+// Parent returns the directory of the link.
+func (l *RAMLink) Parent() (fileserver.Dir, error) {
+	return l.dir, nil
+}
+
+func (l *RAMLink) Stat() (protocol.Stat, error) {
+	st, err := l.RAMFile.Stat()
+	if err != nil {
+		return st, err
+	}
+	l.RLock()
+	st.Name = l.name
+	l.RUnlock()
+	return st, nil
+}
+
+// WriteStat applies s to the file, but renames only the link.
+func (l *RAMLink) WriteStat(s protocol.Stat) error {
+	name := s.Name
+	s.Name = ""
+	if err := l.RAMFile.WriteStat(s); err != nil {
+		return err
+	}
+	if name != "" {
+		l.Lock()
+		l.name = displayIn(l.dir, name)
+		l.Unlock()
+	}
+	return nil
+}
+
+// Links returns the number of names of the file. It is not part of the stat,
+// as 9P2000 has no field for it.
+func (f *RAMFile) Links() int {
+	f.RLock()
+	defer f.RUnlock()
+	return f.nlink
+}
+
+// linkDir records that the file has a link in t. Must be called with the file
+// locked.
+func (f *RAMFile) linkDir(t *RAMTree) {
+	if f.dirs == nil {
+		f.dirs = make(map[*RAMTree]int)
+	}
+	f.dirs[t]++
+}
+
+// unlinkDir records that a link in t is gone. Must be called with the file
+// locked.
+func (f *RAMFile) unlinkDir(t *RAMTree) {
+	f.dirs[t]--
+	if f.dirs[t] <= 0 {
+		delete(f.dirs, t)
+	}
+}
+
+// invalidate invalidates the listings of the directories the file is in.
+// Must be called with the file read locked.
+func (f *RAMFile) invalidate() {
+	invalidateListing(f.parent)
+	for t := range f.dirs {
+		t.listing.invalidate()
+	}
+}
+
+// Link makes f, which must be a RAMFile or a RAMLink, also available as name
+// in t. The user must be allowed to write to t, and t must share the quota
+// of the file.
+func (t *RAMTree) Link(user string, f fileserver.File, name string) error {
+	var rf *RAMFile
+	switch f := f.(type) {
+	case *RAMFile:
+		rf = f
+	case *RAMLink:
+		rf = f.RAMFile
+	default:
+		return errors.New("only RAM files can be linked")
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	if !t.allowed(user, protocol.OWRITE) {
+		return fileserver.ErrPermission
+	}
+	name, err := t.names.normalize(name)
+	if err != nil {
+		return err
+	}
+	if err := t.checkName(name); err != nil {
+		return err
+	}
+	key := t.names.key(name)
+	if _, ok := t.tree[key]; ok {
+		return errors.New("file already exists")
+	}
+	if err := t.checkRoom(); err != nil {
+		return err
+	}
+	if rf.quota != t.quota {
+		return errors.New("cannot link between quotas")
+	}
+
+	rf.Lock()
+	if rf.removed {
+		rf.Unlock()
+		return errors.New("file has been removed")
+	}
+	rf.nlink++
+	rf.linkDir(t)
+	rf.Unlock()
+
+	t.tree[key] = &RAMLink{RAMFile: rf, name: name, dir: t}
+	t.muser = user
+	t.mtime = time.Now()
+	t.atime.Store(t.mtime)
+	t.changed()
+	return nil
+}
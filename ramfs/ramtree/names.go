@@ -0,0 +1,129 @@
+package ramtree
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/kennylevinsen/g9ptools/fileserver"
+	"golang.org/x/text/unicode/norm"
+)
+
+// NamePolicy decides how a tree checks and compares the names of its
+// entries. The zero NamePolicy stores and compares names exactly as given.
+type NamePolicy uint8
+
+const (
+	// NameStrict rejects names containing '/' or NUL, which cannot be
+	// represented on most other file systems.
+	NameStrict NamePolicy = 1 << iota
+
+	// NameNFC normalizes names to Unicode NFC before storing or comparing
+	// them, so that differently composed forms of a name are the same file.
+	NameNFC
+
+	// NameFold compares names case-insensitively, using Unicode simple case
+	// folding. Names keep the case they were created with.
+	NameFold
+)
+
+var namePolicyNames = []struct {
+	p    NamePolicy
+	name string
+}{
+	{NameStrict, "strict"},
+	{NameNFC, "nfc"},
+	{NameFold, "fold"},
+}
+
+func (p NamePolicy) String() string {
+	var s []string
+	for _, n := range namePolicyNames {
+		if p&n.p != 0 {
+			s = append(s, n.name)
+		}
+	}
+	return strings.Join(s, ",")
+}
+
+// ParseNamePolicy parses a comma-separated list of the policies strict, nfc
+// and fold, as returned by String. An empty string is the zero NamePolicy.
+func ParseNamePolicy(s string) (NamePolicy, error) {
+	var p NamePolicy
+	for _, name := range strings.Split(s, ",") {
+		if name == "" {
+			continue
+		}
+		found := false
+		for _, n := range namePolicyNames {
+			if n.name == name {
+				p |= n.p
+				found = true
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("unknown name policy %q", name)
+		}
+	}
+	return p, nil
+}
+
+// normalize checks name, and returns the name to store it as.
+func (p NamePolicy) normalize(name string) (string, error) {
+	if p&NameStrict != 0 {
+		if strings.ContainsAny(name, "/\x00") {
+			return "", errInvalidName
+		}
+	}
+	return p.display(name), nil
+}
+
+// display returns name as it is stored, for names that have already been
+// checked by normalize.
+func (p NamePolicy) display(name string) string {
+	if p&NameNFC != 0 {
+		return norm.NFC.String(name)
+	}
+	return name
+}
+
+// displayIn returns name as it is stored in d, if d is a RAMTree. The policy
+// is not changed once a tree is served, so d need not be locked.
+func displayIn(d fileserver.Dir, name string) string {
+	if t, ok := d.(*RAMTree); ok {
+		return t.names.display(name)
+	}
+	return name
+}
+
+// key returns the key that name is looked up by.
+func (p NamePolicy) key(name string) string {
+	if p&NameNFC != 0 {
+		name = norm.NFC.String(name)
+	}
+	if p&NameFold != 0 {
+		name = strings.Map(foldRune, name)
+	}
+	return name
+}
+
+// foldRune maps r to the smallest rune it is equivalent to under simple case
+// folding.
+func foldRune(r rune) rune {
+	min := r
+	for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+		if f < min {
+			min = f
+		}
+	}
+	return min
+}
+
+// SetNamePolicy sets the name policy of the tree and the directories created
+// in it from now on. It should be called before anything is added to the
+// tree and before it is served, as existing entries are not renamed.
+func (t *RAMTree) SetNamePolicy(p NamePolicy) {
+	t.Lock()
+	defer t.Unlock()
+	t.names = p
+}
@@ -0,0 +1,40 @@
+package ramtree
+
+import "github.com/kennylevinsen/g9p/protocol"
+
+// Ownership decides the owner, group and permissions of files created in a
+// tree. Without one, new files belong to the owner and group of their
+// directory, and have their permissions masked by those of the directory, as
+// on Plan 9.
+type Ownership struct {
+	// UID is the owner of new files. If empty, the creating user is the
+	// owner.
+	UID string
+	// GID is the group of new files. If empty, the group of the directory is
+	// used.
+	GID string
+	// Umask is cleared from the permissions of new files.
+	Umask protocol.FileMode
+}
+
+// ownership returns the owner, group and permissions of a file created by user
+// in t with the requested permissions. Must be called with the tree locked.
+func (t *RAMTree) ownership(user string, perms protocol.FileMode) (string, string, protocol.FileMode) {
+	o := t.own
+	if o == nil {
+		mask := protocol.FileMode(0666)
+		if perms&protocol.DMDIR != 0 {
+			mask = 0777
+		}
+		return t.user, t.group, perms & (^mask | (t.permissions & mask))
+	}
+
+	uid, gid := o.UID, o.GID
+	if uid == "" {
+		uid = user
+	}
+	if gid == "" {
+		gid = t.group
+	}
+	return uid, gid, perms &^ (o.Umask & 0777)
+}
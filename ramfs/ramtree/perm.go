@@ -0,0 +1,27 @@
+package ramtree
+
+import (
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+)
+
+// SetPermissionPolicy sets the policy deciding access to the tree and
+// everything created in it from now on. Without one,
+// fileserver.DefaultPolicy is used.
+func (t *RAMTree) SetPermissionPolicy(p fileserver.PermissionPolicy) {
+	t.Lock()
+	defer t.Unlock()
+	t.policy = p
+}
+
+// allowed reports whether user may access t with mode. Must be called with
+// the tree read locked.
+func (t *RAMTree) allowed(user string, mode protocol.OpenMode) bool {
+	return fileserver.Allowed(t.policy, user, t.user, t.group, t.permissions, mode)
+}
+
+// allowed reports whether user may access f with mode. Must be called with
+// the file read locked.
+func (f *RAMFile) allowed(user string, mode protocol.OpenMode) bool {
+	return fileserver.Allowed(f.policy, user, f.user, f.group, f.permissions, mode)
+}
@@ -0,0 +1,152 @@
+package ramtree
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+)
+
+const (
+	// DefaultPipeBuffer is the amount of unread data a Pipe holds before
+	// writes block.
+	DefaultPipeBuffer = 1024 * 1024
+)
+
+var ErrPipeClosed = errors.New("pipe closed")
+
+// Pipe is a byte stream with a single logical consumer. Data written to the
+// pipe is kept until read, reads block until data is available, and reads
+// return end of file once the writing side is closed and the buffer drained.
+// A Pipe implements io.Writer, so it can be used directly as the output of
+// an exec.Cmd.
+type Pipe struct {
+	sync.Mutex
+	buf    bytes.Buffer
+	max    int
+	wake   chan struct{}
+	closed bool
+}
+
+// signal wakes up all waiters. Must be called with the pipe locked.
+func (p *Pipe) signal() {
+	close(p.wake)
+	p.wake = make(chan struct{})
+}
+
+func (p *Pipe) Write(b []byte) (int, error) {
+	p.Lock()
+	defer p.Unlock()
+	for p.buf.Len() >= p.max && !p.closed {
+		wake := p.wake
+		p.Unlock()
+		<-wake
+		p.Lock()
+	}
+	if p.closed {
+		return 0, ErrPipeClosed
+	}
+	n, _ := p.buf.Write(b)
+	p.signal()
+	return n, nil
+}
+
+// CloseWrite marks the end of the stream.
+func (p *Pipe) CloseWrite() error {
+	p.Lock()
+	defer p.Unlock()
+	p.closed = true
+	p.signal()
+	return nil
+}
+
+// read blocks until data is available, the pipe is closed or of is
+// interrupted.
+func (p *Pipe) read(b []byte, of *PipeOpenFile) (int, error) {
+	p.Lock()
+	defer p.Unlock()
+	for p.buf.Len() == 0 {
+		if p.closed {
+			return 0, nil
+		}
+		if of.takeInterrupt() {
+			return 0, ErrInterrupted
+		}
+		wake := p.wake
+		p.Unlock()
+		<-wake
+		p.Lock()
+	}
+	of.takeInterrupt()
+	n, _ := p.buf.Read(b)
+	p.signal()
+	return n, nil
+}
+
+// Opener returns an OpenFunc for read-only files serving the pipe.
+func (p *Pipe) Opener() OpenFunc {
+	return func(user string, mode protocol.OpenMode) (fileserver.OpenFile, error) {
+		if mode&3 != protocol.OREAD {
+			return nil, errors.New("pipe is read-only")
+		}
+		return &PipeOpenFile{p: p}, nil
+	}
+}
+
+// PipeOpenFile is a reader of a Pipe. Offsets are ignored.
+type PipeOpenFile struct {
+	sync.Mutex
+	p           *Pipe
+	interrupted bool
+}
+
+// takeInterrupt reports whether the file was interrupted, clearing it.
+func (of *PipeOpenFile) takeInterrupt() bool {
+	of.Lock()
+	defer of.Unlock()
+	intr := of.interrupted
+	of.interrupted = false
+	return intr
+}
+
+func (of *PipeOpenFile) Seek(offset int64, whence int) (int64, error) {
+	return offset, nil
+}
+
+func (of *PipeOpenFile) Read(b []byte) (int, error) {
+	return of.p.read(b, of)
+}
+
+func (of *PipeOpenFile) Write(b []byte) (int, error) {
+	return 0, errors.New("pipe is read-only")
+}
+
+// Interrupt makes a blocked read return ErrInterrupted. It is remembered
+// until a read consumes it, so that a read about to block is interrupted as
+// well.
+func (of *PipeOpenFile) Interrupt() {
+	of.Lock()
+	of.interrupted = true
+	of.Unlock()
+
+	of.p.Lock()
+	defer of.p.Unlock()
+	of.p.signal()
+}
+
+func (of *PipeOpenFile) Close() error {
+	return nil
+}
+
+func NewPipe() *Pipe {
+	return &Pipe{
+		max:  DefaultPipeBuffer,
+		wake: make(chan struct{}),
+	}
+}
+
+func NewPipeFile(name string, permissions protocol.FileMode, user, group string, p *Pipe) *SyntheticFile {
+	return NewSyntheticFile(name, permissions, user, group, p.Opener())
+}
@@ -0,0 +1,84 @@
+package ramtree
+
+import (
+	"errors"
+	"sync"
+)
+
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// Quota limits the total size of the file content in a tree. Files and
+// directories created in a tree with a quota share it. A limit of zero or
+// less only accounts for usage. With eviction enabled, the quota makes the
+// tree a cache, removing files as needed to make room.
+type Quota struct {
+	sync.Mutex
+	max   int64
+	used  int64
+	evict bool
+	files map[*RAMFile]struct{}
+}
+
+// reserve accounts for n more bytes, failing if the quota would be exceeded.
+// A nil Quota permits everything.
+func (q *Quota) reserve(n int64) error {
+	if q == nil || n <= 0 {
+		return nil
+	}
+	q.Lock()
+	defer q.Unlock()
+	if q.max > 0 && q.used+n > q.max {
+		return ErrQuotaExceeded
+	}
+	q.used += n
+	return nil
+}
+
+// charge accounts for n more bytes without enforcing the limit.
+func (q *Quota) charge(n int64) {
+	if q == nil || n <= 0 {
+		return
+	}
+	q.Lock()
+	defer q.Unlock()
+	q.used += n
+}
+
+// release returns n bytes to the quota.
+func (q *Quota) release(n int64) {
+	if q == nil || n <= 0 {
+		return
+	}
+	q.Lock()
+	defer q.Unlock()
+	q.used -= n
+	if q.used < 0 {
+		q.used = 0
+	}
+}
+
+// Used returns the number of bytes in use.
+func (q *Quota) Used() int64 {
+	q.Lock()
+	defer q.Unlock()
+	return q.used
+}
+
+// Max returns the limit of the quota.
+func (q *Quota) Max() int64 {
+	q.Lock()
+	defer q.Unlock()
+	return q.max
+}
+
+// SetMax changes the limit. Content already stored is kept, even if it
+// exceeds the new limit.
+func (q *Quota) SetMax(max int64) {
+	q.Lock()
+	defer q.Unlock()
+	q.max = max
+}
+
+func NewQuota(max int64) *Quota {
+	return &Quota{max: max}
+}
@@ -0,0 +1,278 @@
+package ramtree_test
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+	"github.com/kennylevinsen/g9ptools/fileserver/fileservertest"
+	"github.com/kennylevinsen/g9ptools/ramfs/ramtree"
+)
+
+const user = "glenda"
+
+func TestDir(t *testing.T) {
+	root := ramtree.NewRAMTree("/", 0777, user, user)
+	if err := fileservertest.TestDir(root, user); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// serve returns a FileServer serving root, with fid 0 attached to it.
+func serve(t *testing.T, root *ramtree.RAMTree) *fileserver.FileServer {
+	fs := fileserver.NewFileServer(root, nil, 64*1024, fileserver.Quiet)
+	if _, err := fs.Version(&protocol.VersionRequest{Tag: protocol.NOTAG, MaxSize: 64 * 1024, Version: "9P2000"}); err != nil {
+		t.Fatalf("version: %v", err)
+	}
+	if _, err := fs.Attach(&protocol.AttachRequest{Fid: 0, AuthFid: protocol.NOFID, Username: user}); err != nil {
+		t.Fatalf("attach: %v", err)
+	}
+	return fs
+}
+
+// tree returns a tree holding dir/file.
+func tree(t *testing.T) *ramtree.RAMTree {
+	root := ramtree.NewRAMTree("/", 0777, user, user)
+	d, err := root.Create(user, "dir", protocol.DMDIR|0777)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if _, err := d.(fileserver.Dir).Create(user, "file", 0666); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	return root
+}
+
+func TestWalkPartial(t *testing.T) {
+	fs := serve(t, tree(t))
+
+	resp, err := fs.Walk(&protocol.WalkRequest{Fid: 0, NewFid: 1, Names: []string{"dir", "missing", "file"}})
+	if err != nil {
+		t.Fatalf("partial walk: %v", err)
+	}
+	if len(resp.Qids) != 1 || resp.Qids[0].Type&protocol.QTDIR == 0 {
+		t.Fatalf("partial walk returned qids %+v", resp.Qids)
+	}
+	if _, err := fs.Clunk(&protocol.ClunkRequest{Fid: 1}); err == nil {
+		t.Fatal("partial walk allocated newfid")
+	}
+
+	// ".." at the root stays at the root.
+	if _, err := fs.Walk(&protocol.WalkRequest{Fid: 0, NewFid: 1, Names: []string{"..", "dir", "file"}}); err != nil {
+		t.Fatalf("walk of .. at root: %v", err)
+	}
+	st, err := fs.Stat(&protocol.StatRequest{Fid: 1})
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	if st.Stat.Name != "file" {
+		t.Fatalf("walk of .. at root ended at %q", st.Stat.Name)
+	}
+}
+
+func TestRemoveClunks(t *testing.T) {
+	root := tree(t)
+	fs := serve(t, root)
+
+	// Removing a non-empty directory fails, but clunks the fid.
+	if _, err := fs.Walk(&protocol.WalkRequest{Fid: 0, NewFid: 1, Names: []string{"dir"}}); err != nil {
+		t.Fatalf("walk: %v", err)
+	}
+	if _, err := fs.Remove(&protocol.RemoveRequest{Fid: 1}); err == nil {
+		t.Fatal("remove of non-empty directory succeeded")
+	}
+	if _, err := fs.Stat(&protocol.StatRequest{Fid: 1}); err == nil {
+		t.Fatal("failed remove left fid alive")
+	}
+	if _, err := root.Walk(user, "dir"); err != nil {
+		t.Fatalf("failed remove removed directory: %v", err)
+	}
+}
+
+func TestOpenAfterRemove(t *testing.T) {
+	root := ramtree.NewRAMTree("/", 0777, user, user)
+	f, err := root.Create(user, "file", 0666)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	f.(*ramtree.RAMFile).SetContent([]byte("content"))
+
+	of, err := f.Open(user, protocol.ORDWR)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer of.Close()
+	if err := root.Remove(user, "file"); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+
+	// The open file keeps working on the orphaned file.
+	b := make([]byte, 64)
+	n, err := of.Read(b)
+	if err != nil {
+		t.Fatalf("read after remove: %v", err)
+	}
+	if !bytes.Equal(b[:n], []byte("content")) {
+		t.Fatalf("read after remove returned %q", b[:n])
+	}
+	if _, err := of.Write([]byte(" and more")); err != nil {
+		t.Fatalf("write after remove: %v", err)
+	}
+	if _, err := root.Walk(user, "file"); err != fileserver.ErrNotExist {
+		t.Fatalf("walk after remove returned %v", err)
+	}
+}
+
+func TestCreateOpens(t *testing.T) {
+	root := tree(t)
+	fs := serve(t, root)
+
+	// The fid is left open with the requested mode, even though the
+	// permissions of the file do not allow writing.
+	if _, err := fs.Walk(&protocol.WalkRequest{Fid: 0, NewFid: 1}); err != nil {
+		t.Fatalf("walk: %v", err)
+	}
+	if _, err := fs.Create(&protocol.CreateRequest{Fid: 1, Name: "new", Permissions: 0444, Mode: protocol.OWRITE}); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if _, err := fs.Write(&protocol.WriteRequest{Fid: 1, Data: []byte("hello")}); err != nil {
+		t.Fatalf("write after create: %v", err)
+	}
+
+	f, err := root.Walk(user, "new")
+	if err != nil {
+		t.Fatalf("walk: %v", err)
+	}
+	if got := f.(*ramtree.RAMFile).Content(); string(got) != "hello" {
+		t.Fatalf("created file holds %q", got)
+	}
+
+	// A failed create leaves the fid at the directory.
+	if _, err := fs.Walk(&protocol.WalkRequest{Fid: 0, NewFid: 2, Names: []string{"dir"}}); err != nil {
+		t.Fatalf("walk: %v", err)
+	}
+	if _, err := fs.Create(&protocol.CreateRequest{Fid: 2, Name: "file", Permissions: 0666, Mode: protocol.OREAD}); err == nil {
+		t.Fatal("create of existing file succeeded")
+	}
+	if _, err := fs.Walk(&protocol.WalkRequest{Fid: 2, NewFid: 3, Names: []string{"file"}}); err != nil {
+		t.Fatalf("walk after failed create: %v", err)
+	}
+}
+
+func TestWalkNotDir(t *testing.T) {
+	fs := serve(t, tree(t))
+
+	resp, err := fs.Walk(&protocol.WalkRequest{Fid: 0, NewFid: 1, Names: []string{"dir", "file", "extra"}})
+	if err != nil {
+		t.Fatalf("walk through a file: %v", err)
+	}
+	if len(resp.Qids) != 2 {
+		t.Fatalf("walk through a file returned qids %+v", resp.Qids)
+	}
+
+	if _, err := fs.Walk(&protocol.WalkRequest{Fid: 0, NewFid: 1, Names: []string{"dir", "file"}}); err != nil {
+		t.Fatalf("walk: %v", err)
+	}
+	if _, err := fs.Walk(&protocol.WalkRequest{Fid: 1, NewFid: 2, Names: []string{"extra"}}); err != fileserver.ErrNotDir {
+		t.Fatalf("walk from a file returned %v, expected %v", err, fileserver.ErrNotDir)
+	}
+}
+
+func TestReadAfterTruncate(t *testing.T) {
+	root := ramtree.NewRAMTree("/", 0777, user, user)
+	f, err := root.Create(user, "file", 0666)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	f.(*ramtree.RAMFile).SetContent([]byte("content"))
+
+	of, err := f.Open(user, protocol.OREAD)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer of.Close()
+	b := make([]byte, 3)
+	if _, err := of.Read(b); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+
+	// Another fid truncates the file past the offset of the first.
+	trunc, err := f.Open(user, protocol.OWRITE|protocol.OTRUNC)
+	if err != nil {
+		t.Fatalf("open with truncate: %v", err)
+	}
+	trunc.Close()
+
+	n, err := of.Read(b)
+	if err != nil {
+		t.Fatalf("read after truncate: %v", err)
+	}
+	if n != 0 {
+		t.Fatalf("read after truncate returned %q", b[:n])
+	}
+}
+
+// TestConcurrentTruncate reads a file while it is truncated, rewritten and
+// removed, and is meant to be run with -race.
+func TestConcurrentTruncate(t *testing.T) {
+	root := ramtree.NewRAMTree("/", 0777, user, user)
+	f, err := root.Create(user, "file", 0666)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	f.(*ramtree.RAMFile).SetContent(bytes.Repeat([]byte("x"), 64*1024))
+
+	of, err := f.Open(user, protocol.OREAD)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer of.Close()
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		b := make([]byte, 4096)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if _, err := of.Read(b); err != nil {
+				t.Errorf("read: %v", err)
+				return
+			}
+			if _, err := of.Seek(0, 0); err != nil {
+				t.Errorf("seek: %v", err)
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		wf, err := f.Open(user, protocol.OWRITE|protocol.OTRUNC)
+		if err != nil {
+			t.Fatalf("open with truncate: %v", err)
+		}
+		if _, err := wf.Write(bytes.Repeat([]byte("y"), 8192)); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		wf.Close()
+	}
+	if err := root.Remove(user, "file"); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		wf, err := f.Open(user, protocol.OWRITE|protocol.OTRUNC)
+		if err != nil {
+			t.Fatalf("open after remove: %v", err)
+		}
+		wf.Close()
+	}
+	close(done)
+	wg.Wait()
+}
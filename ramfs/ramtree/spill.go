@@ -0,0 +1,184 @@
+package ramtree
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Spiller moves the content of files that are not open to disk when the
+// content held in memory grows past a threshold, keeping everything else
+// about the files in memory. Spilled content is read back in when the file is
+// next opened.
+type Spiller struct {
+	sync.Mutex
+	dir       string
+	threshold int64
+	resident  int64
+	files     map[*RAMFile]struct{}
+}
+
+// track registers a file that may be spilled.
+func (s *Spiller) track(f *RAMFile) {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.files[f] = struct{}{}
+}
+
+// untrack unregisters a removed file.
+func (s *Spiller) untrack(f *RAMFile) {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	delete(s.files, f)
+}
+
+// add adjusts the amount of content in memory by n.
+func (s *Spiller) add(n int64) {
+	if s == nil || n == 0 {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.resident += n
+}
+
+// Resident returns the amount of content held in memory by the files of the
+// spiller.
+func (s *Spiller) Resident() int64 {
+	s.Lock()
+	defer s.Unlock()
+	return s.resident
+}
+
+// check spills the least recently accessed files that are not open until the
+// content in memory is below the threshold. It must be called without any
+// file locked.
+func (s *Spiller) check() {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	if s.resident <= s.threshold {
+		s.Unlock()
+		return
+	}
+	var files []*RAMFile
+	for f := range s.files {
+		files = append(files, f)
+	}
+	s.Unlock()
+
+	type candidate struct {
+		f     *RAMFile
+		atime time.Time
+	}
+	var cands []candidate
+	for _, f := range files {
+		f.RLock()
+		if f.opens == 0 && len(f.content) > 0 {
+			cands = append(cands, candidate{f, f.atime.Load()})
+		}
+		f.RUnlock()
+	}
+	sort.Slice(cands, func(i, j int) bool {
+		return cands[i].atime.Before(cands[j].atime)
+	})
+
+	for _, c := range cands {
+		if s.Resident() <= s.threshold {
+			return
+		}
+		c.f.spillOut()
+	}
+}
+
+// Close removes the spilled content. Spilled files lose their content.
+func (s *Spiller) Close() error {
+	return os.RemoveAll(s.dir)
+}
+
+// NewSpiller returns a spiller storing content in a new temporary directory
+// in dir, or in the default directory for temporary files if dir is empty,
+// once more than threshold bytes are held in memory.
+func NewSpiller(dir string, threshold int64) (*Spiller, error) {
+	d, err := ioutil.TempDir(dir, "ramfs-spill")
+	if err != nil {
+		return nil, err
+	}
+	return &Spiller{
+		dir:       d,
+		threshold: threshold,
+		files:     make(map[*RAMFile]struct{}),
+	}, nil
+}
+
+// account updates the spiller with the change in the content held in memory
+// since it was before. It is meant to be deferred by anything modifying the
+// content, and must be called with the file locked.
+func (f *RAMFile) account(before int64) {
+	f.spiller.add(int64(len(f.content)) - before)
+}
+
+// spillOut writes the content of the file to disk, unless the file has been
+// opened since it was picked.
+func (f *RAMFile) spillOut() {
+	f.Lock()
+	defer f.Unlock()
+	if f.opens > 0 || len(f.content) == 0 || f.removed {
+		return
+	}
+	defer f.account(int64(len(f.content)))
+
+	tf, err := ioutil.TempFile(f.spiller.dir, "file")
+	if err != nil {
+		return
+	}
+	_, err = tf.Write(f.content)
+	if cerr := tf.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tf.Name())
+		return
+	}
+	f.spill = tf.Name()
+	f.slen = int64(len(f.content))
+	f.content = nil
+	atomic.StoreUint32(&f.shared, 0)
+}
+
+// load reads spilled content back into memory. Must be called with the file
+// locked.
+func (f *RAMFile) load() error {
+	if f.spill == "" {
+		return nil
+	}
+	defer f.account(int64(len(f.content)))
+	b, err := ioutil.ReadFile(f.spill)
+	if err != nil {
+		return err
+	}
+	os.Remove(f.spill)
+	f.spill = ""
+	f.slen = 0
+	f.content = b
+	return nil
+}
+
+// unspill discards spilled content. Must be called with the file locked.
+func (f *RAMFile) unspill() {
+	if f.spill != "" {
+		os.Remove(f.spill)
+		f.spill = ""
+		f.slen = 0
+	}
+}
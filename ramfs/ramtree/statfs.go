@@ -0,0 +1,29 @@
+package ramtree
+
+import "github.com/kennylevinsen/g9ptools/fileserver"
+
+// statfsBlockSize is the block size reported by Statfs.
+const statfsBlockSize = 4096
+
+// Statfs implements fileserver.StatfsDir, describing the quota of the tree.
+// Without a limit, the size reported is the space in use.
+func (t *RAMTree) Statfs() (fileserver.Statfs, error) {
+	t.RLock()
+	q := t.quota
+	t.RUnlock()
+
+	st := fileserver.Statfs{BlockSize: statfsBlockSize}
+	if q == nil {
+		return st, nil
+	}
+	q.Lock()
+	defer q.Unlock()
+	size := q.max
+	if size <= 0 || size < q.used {
+		size = q.used
+	}
+	st.Blocks = uint64((size + statfsBlockSize - 1) / statfsBlockSize)
+	st.BlocksFree = uint64((size - q.used) / statfsBlockSize)
+	st.Files = uint64(len(q.files))
+	return st, nil
+}
@@ -0,0 +1,198 @@
+package ramtree
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+)
+
+const (
+	// DefaultStreamQueue is the number of messages a reader of a Stream may
+	// fall behind before the oldest messages are dropped.
+	DefaultStreamQueue = 1024
+)
+
+var (
+	ErrInterrupted  = errors.New("interrupted")
+	ErrStreamClosed = errors.New("stream closed")
+)
+
+// Stream fans out messages to every open handle of the files serving it.
+// Each handle receives the messages sent after it was opened, one message per
+// read, and reads block until a message is available.
+type Stream struct {
+	sync.Mutex
+	readers map[*StreamOpenFile]bool
+	queue   int
+	closed  bool
+}
+
+// Send delivers a message to all current readers. It never blocks.
+func (s *Stream) Send(msg []byte) {
+	s.Lock()
+	defer s.Unlock()
+	for r := range s.readers {
+		r.push(msg)
+	}
+}
+
+// Readers returns the number of open handles on the stream.
+func (s *Stream) Readers() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.readers)
+}
+
+// Close makes all pending and future reads return io.EOF once the queued
+// messages have been read.
+func (s *Stream) Close() {
+	s.Lock()
+	defer s.Unlock()
+	s.closed = true
+	for r := range s.readers {
+		r.finish()
+	}
+}
+
+// Open returns a new reader on the stream.
+func (s *Stream) Open() *StreamOpenFile {
+	return s.OpenWith()
+}
+
+// OpenWith returns a new reader on the stream, with the provided messages
+// queued ahead of anything sent after the call.
+func (s *Stream) OpenWith(backlog ...[]byte) *StreamOpenFile {
+	of := &StreamOpenFile{
+		s:    s,
+		msgs: backlog,
+		wake: make(chan struct{}),
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	of.done = s.closed
+	s.readers[of] = true
+	return of
+}
+
+// Opener returns an OpenFunc for files serving the stream.
+func (s *Stream) Opener() OpenFunc {
+	return func(user string, mode protocol.OpenMode) (fileserver.OpenFile, error) {
+		if mode&3 != protocol.OREAD {
+			return nil, errors.New("stream is read-only")
+		}
+		return s.Open(), nil
+	}
+}
+
+// StreamOpenFile is a reader on a Stream. Offsets are ignored, as a stream
+// has no position.
+type StreamOpenFile struct {
+	sync.Mutex
+	s           *Stream
+	msgs        [][]byte
+	wake        chan struct{}
+	done        bool
+	closed      bool
+	interrupted bool
+}
+
+// push queues a message and wakes up pending reads. Must be called with the
+// stream locked.
+func (of *StreamOpenFile) push(msg []byte) {
+	of.Lock()
+	defer of.Unlock()
+	if len(of.msgs) >= of.s.queue {
+		of.msgs = of.msgs[1:]
+	}
+	of.msgs = append(of.msgs, msg)
+	of.signal()
+}
+
+func (of *StreamOpenFile) finish() {
+	of.Lock()
+	defer of.Unlock()
+	of.done = true
+	of.signal()
+}
+
+// signal wakes up all waiters. Must be called with the file locked.
+func (of *StreamOpenFile) signal() {
+	close(of.wake)
+	of.wake = make(chan struct{})
+}
+
+func (of *StreamOpenFile) Seek(offset int64, whence int) (int64, error) {
+	return offset, nil
+}
+
+func (of *StreamOpenFile) Read(p []byte) (int, error) {
+	of.Lock()
+	defer of.Unlock()
+	for len(of.msgs) == 0 {
+		if of.closed {
+			return 0, errors.New("file not open")
+		}
+		if of.done {
+			return 0, nil
+		}
+		if of.interrupted {
+			of.interrupted = false
+			return 0, ErrInterrupted
+		}
+		wake := of.wake
+		of.Unlock()
+		<-wake
+		of.Lock()
+	}
+
+	// A read that did not block has nothing left to interrupt.
+	of.interrupted = false
+	msg := of.msgs[0]
+	n := copy(p, msg)
+	if n < len(msg) {
+		of.msgs[0] = msg[n:]
+	} else {
+		of.msgs = of.msgs[1:]
+	}
+	return n, nil
+}
+
+func (of *StreamOpenFile) Write(p []byte) (int, error) {
+	return 0, errors.New("stream is read-only")
+}
+
+// Interrupt makes one blocked read return ErrInterrupted. It is remembered
+// until a read consumes it, so that a read about to block is interrupted as
+// well. Other reads blocked on the handle keep waiting.
+func (of *StreamOpenFile) Interrupt() {
+	of.Lock()
+	defer of.Unlock()
+	of.interrupted = true
+	of.signal()
+}
+
+func (of *StreamOpenFile) Close() error {
+	of.s.Lock()
+	delete(of.s.readers, of)
+	of.s.Unlock()
+
+	of.Lock()
+	defer of.Unlock()
+	of.closed = true
+	of.signal()
+	return nil
+}
+
+func NewStream() *Stream {
+	return &Stream{
+		readers: make(map[*StreamOpenFile]bool),
+		queue:   DefaultStreamQueue,
+	}
+}
+
+func NewStreamFile(name string, permissions protocol.FileMode, user, group string, s *Stream) *SyntheticFile {
+	return NewSyntheticFile(name, permissions, user, group, s.Opener())
+}
@@ -0,0 +1,33 @@
+package ramtree
+
+import "github.com/kennylevinsen/g9p/protocol"
+
+// DMSYMLINK and QTSYMLINK mark symbolic links in stat modes and qid types,
+// with the values of 9P2000.u.
+const (
+	DMSYMLINK protocol.FileMode = 0x02000000
+	QTSYMLINK protocol.QidType  = 0x02
+)
+
+// NewRAMSymlink returns a symbolic link to target. A symbolic link is a
+// RAMFile with DMSYMLINK set, whose content is the target, so clients that
+// do not know about symbolic links can read the target. Files created with
+// DMSYMLINK in their permissions are symbolic links whose target is written
+// after creation.
+func NewRAMSymlink(name, target, user, group string) *RAMFile {
+	f := NewRAMFile(name, DMSYMLINK|0777, user, group)
+	f.content = []byte(target)
+	return f
+}
+
+// IsSymlink reports whether the file is a symbolic link.
+func (f *RAMFile) IsSymlink() bool {
+	f.RLock()
+	defer f.RUnlock()
+	return f.permissions&DMSYMLINK != 0
+}
+
+// Target returns the target of a symbolic link.
+func (f *RAMFile) Target() string {
+	return string(f.Content())
+}
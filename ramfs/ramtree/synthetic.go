@@ -0,0 +1,168 @@
+package ramtree
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+	"github.com/kennylevinsen/g9ptools/fileserver/templatefs"
+)
+
+// OpenFunc produces the handle for an opened synthetic file. The permission
+// check has already been performed when it is called.
+type OpenFunc func(user string, mode protocol.OpenMode) (fileserver.OpenFile, error)
+
+// ReadFunc produces the content of a callback file. It is called once per
+// open, and the result is served for the lifetime of the handle.
+type ReadFunc func(user string) ([]byte, error)
+
+// WriteFunc consumes a single write to a callback file. Each Twrite results
+// in exactly one call, which is how Plan 9 ctl files expect to be used.
+type WriteFunc func(user string, p []byte) (int, error)
+
+// SyntheticFile is a file whose content is not stored, but produced by an
+// OpenFunc whenever the file is opened.
+type SyntheticFile struct {
+	templatefs.FileBase
+	open OpenFunc
+}
+
+func (f *SyntheticFile) Open(user string, mode protocol.OpenMode) (fileserver.OpenFile, error) {
+	if err := f.CheckOpen(user, mode); err != nil {
+		return nil, err
+	}
+	return f.open(user, mode)
+}
+
+// CallbackOpenFile serves a snapshot produced by a ReadFunc, and hands every
+// write to a WriteFunc.
+type CallbackOpenFile struct {
+	sync.Mutex
+	user    string
+	content []byte
+	offset  int64
+	write   WriteFunc
+	closed  bool
+}
+
+func (of *CallbackOpenFile) Seek(offset int64, whence int) (int64, error) {
+	of.Lock()
+	defer of.Unlock()
+	if of.closed {
+		return 0, errors.New("file not open")
+	}
+	length := int64(len(of.content))
+	switch whence {
+	case 0:
+	case 1:
+		offset = of.offset + offset
+	case 2:
+		offset = length + offset
+	default:
+		return of.offset, errors.New("invalid whence value")
+	}
+
+	if offset < 0 {
+		return of.offset, errors.New("negative seek invalid")
+	}
+
+	of.offset = offset
+	return of.offset, nil
+}
+
+func (of *CallbackOpenFile) Read(p []byte) (int, error) {
+	of.Lock()
+	defer of.Unlock()
+	if of.closed {
+		return 0, errors.New("file not open")
+	}
+	if of.offset >= int64(len(of.content)) {
+		return 0, nil
+	}
+	n := copy(p, of.content[of.offset:])
+	of.offset += int64(n)
+	return n, nil
+}
+
+func (of *CallbackOpenFile) Write(p []byte) (int, error) {
+	of.Lock()
+	defer of.Unlock()
+	if of.closed {
+		return 0, errors.New("file not open")
+	}
+	if of.write == nil {
+		return 0, errors.New("file not writable")
+	}
+	return of.write(of.user, p)
+}
+
+func (of *CallbackOpenFile) Close() error {
+	of.Lock()
+	defer of.Unlock()
+	of.closed = true
+	return nil
+}
+
+// CallbackOpener returns an OpenFunc producing CallbackOpenFiles. The ReadFunc
+// is only called if the file is opened for reading.
+func CallbackOpener(read ReadFunc, write WriteFunc) OpenFunc {
+	return func(user string, mode protocol.OpenMode) (fileserver.OpenFile, error) {
+		of := &CallbackOpenFile{
+			user:  user,
+			write: write,
+		}
+		if read != nil && (mode&3 == protocol.OREAD || mode&3 == protocol.ORDWR) {
+			b, err := read(user)
+			if err != nil {
+				return nil, err
+			}
+			of.content = b
+		}
+		return of, nil
+	}
+}
+
+// RefOpener returns an OpenFunc wrapping open, for the files of something
+// that lives as long as any of them are open, such as a connection directory.
+// ref is called before every open, and unref once the handle is closed, or
+// if the open fails. Interrupts are forwarded to the handle.
+func RefOpener(open OpenFunc, ref, unref func()) OpenFunc {
+	return func(user string, mode protocol.OpenMode) (fileserver.OpenFile, error) {
+		ref()
+		of, err := open(user, mode)
+		if err != nil {
+			unref()
+			return nil, err
+		}
+		return &refOpenFile{OpenFile: of, unref: unref}, nil
+	}
+}
+
+type refOpenFile struct {
+	fileserver.OpenFile
+	unref func()
+}
+
+func (of *refOpenFile) Interrupt() {
+	if i, ok := of.OpenFile.(fileserver.Interrupter); ok {
+		i.Interrupt()
+	}
+}
+
+func (of *refOpenFile) Close() error {
+	err := of.OpenFile.Close()
+	of.unref()
+	return err
+}
+
+func NewSyntheticFile(name string, permissions protocol.FileMode, user, group string, open OpenFunc) *SyntheticFile {
+	f := &SyntheticFile{open: open}
+	f.Init(name, permissions, user, group)
+	f.SetID(nextID())
+	return f
+}
+
+func NewCallbackFile(name string, permissions protocol.FileMode, user, group string, read ReadFunc, write WriteFunc) *SyntheticFile {
+	return NewSyntheticFile(name, permissions, user, group, CallbackOpener(read, write))
+}
@@ -3,11 +3,16 @@ package ramtree
 import (
 	"bytes"
 	"errors"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/kennylevinsen/g9p/protocol"
 	"github.com/kennylevinsen/g9ptools/fileserver"
+	"github.com/kennylevinsen/g9ptools/fileserver/checksum"
+	"github.com/kennylevinsen/g9ptools/fileserver/findfs"
+	"github.com/kennylevinsen/g9ptools/fileserver/tarstream"
 )
 
 type RAMOpenTree struct {
@@ -16,18 +21,14 @@ type RAMOpenTree struct {
 	offset int64
 }
 
+// update fetches the directory listing. Must be called with the tree read
+// locked.
 func (ot *RAMOpenTree) update() error {
-	ot.t.RLock()
-	defer ot.t.RUnlock()
-	buf := new(bytes.Buffer)
-	for _, i := range ot.t.tree {
-		y, err := i.Stat()
-		if err != nil {
-			return err
-		}
-		y.Encode(buf)
+	b, err := ot.t.encodeListing()
+	if err != nil {
+		return err
 	}
-	ot.buffer = buf.Bytes()
+	ot.buffer = b
 	return nil
 }
 
@@ -61,7 +62,7 @@ func (ot *RAMOpenTree) Seek(offset int64, whence int) (int64, error) {
 	if err != nil {
 		return 0, err
 	}
-	ot.t.atime = time.Now()
+	ot.t.atime.access(ot.t.atimeMode, ot.t.mtime)
 	return ot.offset, nil
 }
 
@@ -69,15 +70,13 @@ func (ot *RAMOpenTree) Read(p []byte) (int, error) {
 	if ot.t == nil {
 		return 0, errors.New("file not open")
 	}
-	ot.t.RLock()
-	defer ot.t.RUnlock()
 	rlen := int64(len(p))
 	if rlen > int64(len(ot.buffer))-ot.offset {
 		rlen = int64(len(ot.buffer)) - ot.offset
 	}
+	// The access time is updated by Seek, which the tree is locked for.
 	copy(p, ot.buffer[ot.offset:rlen+ot.offset])
 	ot.offset += rlen
-	ot.t.atime = time.Now()
 	return int(rlen), nil
 }
 
@@ -103,10 +102,228 @@ type RAMTree struct {
 	group       string
 	muser       string
 	version     uint32
-	atime       time.Time
+	atime       atomicTime
+	atimeMode   AtimeMode
 	mtime       time.Time
 	permissions protocol.FileMode
 	opens       uint
+	quota       *Quota
+	store       *BlockStore
+	spiller     *Spiller
+	ids         IDAllocator
+	own         *Ownership
+	policy      fileserver.PermissionPolicy
+	names       NamePolicy
+	limits      Limits
+	listing     listing
+	xattrs      xattrs
+	tarStreams  bool
+	find        bool
+	sums        bool
+	hooks       *Hooks
+}
+
+// listing is a cached, encoded directory listing. It is invalidated by
+// changes to the tree or the stat of any of its entries, but not by access
+// time updates.
+type listing struct {
+	sync.Mutex
+	gen    uint32 // accessed atomically
+	cached uint32
+	valid  bool
+	buf    []byte
+}
+
+func (l *listing) invalidate() {
+	atomic.AddUint32(&l.gen, 1)
+}
+
+// invalidateListing invalidates the listing of d if it is a RAMTree. Files
+// call this on their parent when their stat changes.
+func invalidateListing(d fileserver.Dir) {
+	if t, ok := d.(*RAMTree); ok {
+		t.listing.invalidate()
+	}
+}
+
+// changed bumps the version of the tree and invalidates the listings it is
+// part of. Must be called with the tree locked.
+func (t *RAMTree) changed() {
+	t.version++
+	t.listing.invalidate()
+	invalidateListing(t.parent)
+}
+
+// encodeListing returns the encoded stats of the entries of the tree, which
+// must not be modified. Must be called with the tree read locked.
+func (t *RAMTree) encodeListing() ([]byte, error) {
+	l := &t.listing
+	gen := atomic.LoadUint32(&l.gen)
+	l.Lock()
+	defer l.Unlock()
+	if l.valid && l.cached == gen {
+		return l.buf, nil
+	}
+
+	buf := new(bytes.Buffer)
+	for _, i := range t.tree {
+		y, err := i.Stat()
+		if err != nil {
+			return nil, err
+		}
+		y.Encode(buf)
+	}
+	l.buf = buf.Bytes()
+	l.cached = gen
+	l.valid = true
+	return l.buf, nil
+}
+
+// setName updates the name of a renamed file, if it is a RAMFile, RAMLink,
+// ValidatedFile or RAMTree.
+func setName(f fileserver.File, name string) {
+	switch f := f.(type) {
+	case *ValidatedFile:
+		f.Lock()
+		f.name = name
+		f.Unlock()
+	case *RAMLink:
+		f.Lock()
+		f.name = name
+		f.Unlock()
+	case *RAMFile:
+		f.Lock()
+		f.name = name
+		f.Unlock()
+	case *RAMTree:
+		f.Lock()
+		f.name = name
+		f.Unlock()
+	}
+}
+
+// adopt makes t the parent of f, if f keeps track of its parent.
+func (t *RAMTree) adopt(f fileserver.File) {
+	if p, ok := f.(interface {
+		SetParent(fileserver.Dir) error
+	}); ok {
+		p.SetParent(t)
+	}
+}
+
+// SetIDAllocator makes the tree allocate qid paths from ids, for itself and
+// everything created in it from now on. It should be called before the tree
+// is served.
+func (t *RAMTree) SetIDAllocator(ids IDAllocator) {
+	t.Lock()
+	defer t.Unlock()
+	t.ids = ids
+	var parent uint64
+	if p, ok := t.parent.(*RAMTree); ok {
+		parent = p.id
+	}
+	t.id = ids.NextID(parent, t.name)
+}
+
+// allocID returns the qid path for a new file called name. Must be called
+// with the tree locked.
+func (t *RAMTree) allocID(name string) uint64 {
+	if t.ids == nil {
+		return nextID()
+	}
+	return t.ids.NextID(t.id, name)
+}
+
+// releaseID releases the qid path of name. Must be called with the tree
+// locked.
+func (t *RAMTree) releaseID(name string) {
+	if t.ids != nil {
+		t.ids.Release(t.id, name)
+	}
+}
+
+// SetOwnership sets the ownership applied to files created in the tree, and
+// in directories created in it from now on. A nil Ownership restores the
+// default of inheriting from the directory.
+func (t *RAMTree) SetOwnership(o *Ownership) {
+	t.Lock()
+	defer t.Unlock()
+	t.own = o
+}
+
+// SetAtimeMode sets when reads update access times, for the tree and
+// everything created in it from now on.
+func (t *RAMTree) SetAtimeMode(m AtimeMode) {
+	t.Lock()
+	defer t.Unlock()
+	t.atimeMode = m
+}
+
+// SetBlockStore makes files created in the tree from now on, and in
+// directories created in it, deduplicate their content in s.
+func (t *RAMTree) SetBlockStore(s *BlockStore) {
+	t.Lock()
+	defer t.Unlock()
+	t.store = s
+}
+
+// SetSpiller makes files created in the tree from now on, and in
+// directories created in it, spill their content to disk through s.
+func (t *RAMTree) SetSpiller(s *Spiller) {
+	t.Lock()
+	defer t.Unlock()
+	t.spiller = s
+}
+
+// SetQuota sets the quota shared by the tree and everything created in it
+// from now on.
+func (t *RAMTree) SetQuota(q *Quota) {
+	t.Lock()
+	defer t.Unlock()
+	t.quota = q
+}
+
+// SetTarStreams makes the tree, and directories created in it from now on,
+// serve tarballs of themselves by the conventions of package tarstream.
+func (t *RAMTree) SetTarStreams(on bool) {
+	t.Lock()
+	defer t.Unlock()
+	t.tarStreams = on
+}
+
+// releaseFile detaches a file removed from t. Like on Plan 9, fids that have
+// the file open keep working on the orphaned file, so its content is only
+// returned to the quota once the last of them is closed. Files with other
+// links are left alone.
+func releaseFile(t *RAMTree, f fileserver.File) {
+	var rf *RAMFile
+	switch f := f.(type) {
+	case *RAMFile:
+		rf = f
+		rf.Lock()
+		rf.parent = nil
+	case *RAMLink:
+		rf = f.RAMFile
+		rf.Lock()
+		rf.unlinkDir(t)
+	default:
+		return
+	}
+	defer rf.Unlock()
+
+	rf.nlink--
+	if rf.nlink > 0 {
+		return
+	}
+	before := int64(len(rf.content))
+	rf.removed = true
+	if rf.opens == 0 {
+		rf.quota.release(rf.size())
+		rf.dropContent()
+		rf.spiller.untrack(rf)
+	}
+	rf.quota.untrack(rf)
+	rf.account(before)
 }
 
 func (t *RAMTree) SetParent(d fileserver.Dir) error {
@@ -132,22 +349,46 @@ func (t *RAMTree) Qid() (protocol.Qid, error) {
 func (t *RAMTree) Name() (string, error) {
 	t.RLock()
 	defer t.RUnlock()
+	return t.displayName(), nil
+}
+
+// displayName returns the name of the tree. Must be called with the tree read
+// locked.
+func (t *RAMTree) displayName() string {
 	if t.name == "" {
-		return "/", nil
+		return "/"
 	}
-	return t.name, nil
+	return t.name
 }
 
+// WriteStat applies the fields of s that are not set to the "don't touch"
+// values of empty strings and all bits set, like RAMFile.WriteStat.
 func (t *RAMTree) WriteStat(s protocol.Stat) error {
 	t.Lock()
 	defer t.Unlock()
-	t.name = s.Name
-	t.user = s.UID
-	t.group = s.GID
-	t.permissions = s.Mode
-	t.atime = time.Now()
-	t.mtime = time.Now()
-	t.version++
+	if s.Mode != ^protocol.FileMode(0) && s.Mode&protocol.DMDIR == 0 {
+		return errors.New("cannot make a directory a file")
+	}
+	if s.Length != ^uint64(0) && s.Length != 0 {
+		return errors.New("cannot set length of directory")
+	}
+
+	if s.Name != "" {
+		t.name = displayIn(t.parent, s.Name)
+	}
+	if s.UID != "" {
+		t.user = s.UID
+	}
+	if s.GID != "" {
+		t.group = s.GID
+	}
+	if s.Mode != ^protocol.FileMode(0) {
+		t.permissions = s.Mode
+	}
+	if s.Mtime != ^uint32(0) && s.Mtime != uint32(t.mtime.Unix()) {
+		t.mtime = time.Unix(int64(s.Mtime), 0)
+	}
+	t.changed()
 	return nil
 }
 
@@ -158,147 +399,413 @@ func (t *RAMTree) Stat() (protocol.Stat, error) {
 	if err != nil {
 		return protocol.Stat{}, err
 	}
-	n, err := t.Name()
-	if err != nil {
-		return protocol.Stat{}, err
-	}
 	return protocol.Stat{
 		Qid:   q,
 		Mode:  t.permissions | protocol.DMDIR,
-		Name:  n,
+		Name:  t.displayName(),
 		UID:   t.user,
 		GID:   t.group,
 		MUID:  t.muser,
-		Atime: uint32(t.atime.Unix()),
+		Atime: uint32(t.atime.Load().Unix()),
 		Mtime: uint32(t.mtime.Unix()),
 	}, nil
 }
 
 func (t *RAMTree) Open(user string, mode protocol.OpenMode) (fileserver.OpenFile, error) {
 	t.Lock()
-	defer t.Unlock()
-	owner := t.user == user
-
-	if !permCheck(owner, t.permissions, mode) {
-		return nil, errors.New("access denied")
+	if !t.allowed(user, mode) {
+		t.Unlock()
+		return nil, fileserver.ErrPermission
 	}
+	of, hooks := t.open(), t.hooks
+	t.Unlock()
 
-	t.atime = time.Now()
+	hooks.opened(user, t, mode)
+	return of, nil
+}
+
+// open opens the tree without checking permissions. Must be called with the
+// tree locked.
+func (t *RAMTree) open() *RAMOpenTree {
+	t.atime.access(t.atimeMode, t.mtime)
 	t.opens++
-	return &RAMOpenTree{t: t}, nil
+	return &RAMOpenTree{t: t}
 }
 
 func (t *RAMTree) CanRemove() (bool, error) {
+	t.RLock()
+	defer t.RUnlock()
 	return len(t.tree) == 0, nil
 }
 
 func (t *RAMTree) Create(user, name string, perms protocol.FileMode) (fileserver.File, error) {
 	t.Lock()
-	defer t.Unlock()
-	owner := t.user == user
-	if !permCheck(owner, t.permissions, protocol.OWRITE) {
-		return nil, errors.New("access denied")
+	f, err := t.create(user, name, perms)
+	hooks := t.hooks
+	t.Unlock()
+	if err != nil {
+		return nil, err
 	}
 
-	_, ok := t.tree[name]
-	if ok {
+	hooks.created(user, t, f)
+	return f, nil
+}
+
+// CreateOpen implements fileserver.CreateOpener. The new file is opened
+// before the tree is unlocked.
+func (t *RAMTree) CreateOpen(user, name string, perms protocol.FileMode, mode protocol.OpenMode) (fileserver.File, fileserver.OpenFile, error) {
+	if perms&protocol.DMDIR != 0 && (mode&3 != protocol.OREAD || mode&protocol.OTRUNC != 0) {
+		return nil, nil, errors.New("directories can only be opened for reading")
+	}
+
+	t.Lock()
+	d, err := t.create(user, name, perms)
+	if err != nil {
+		t.Unlock()
+		return nil, nil, err
+	}
+
+	var of fileserver.OpenFile
+	switch d := d.(type) {
+	case *RAMTree:
+		d.Lock()
+		of = d.open()
+		d.Unlock()
+	case *RAMFile:
+		// A new file has no content to read back, so this cannot fail.
+		d.Lock()
+		of, _ = d.open(user, mode)
+		d.Unlock()
+	}
+	hooks := t.hooks
+	t.Unlock()
+
+	hooks.created(user, t, d)
+	hooks.opened(user, d, mode)
+	return d, of, nil
+}
+
+// create creates a file or directory called name. Must be called with the
+// tree locked.
+func (t *RAMTree) create(user, name string, perms protocol.FileMode) (fileserver.File, error) {
+	if !t.allowed(user, protocol.OWRITE) {
+		return nil, fileserver.ErrPermission
+	}
+
+	uid, gid, perms := t.ownership(user, perms)
+	return t.newChild(user, name, uid, gid, perms)
+}
+
+// newChild creates a file or directory called name, owned by uid and gid, on
+// behalf of user, without checking permissions. Must be called with the tree
+// locked.
+func (t *RAMTree) newChild(user, name, uid, gid string, perms protocol.FileMode) (fileserver.File, error) {
+	name, err := t.names.normalize(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.checkName(name); err != nil {
+		return nil, err
+	}
+	key := t.names.key(name)
+	if _, ok := t.tree[key]; ok {
 		return nil, errors.New("file already exists")
 	}
+	if err := t.checkRoom(); err != nil {
+		return nil, err
+	}
 
 	var d fileserver.File
 	if perms&protocol.DMDIR != 0 {
-		perms = perms & (^protocol.FileMode(0777) | (t.permissions & 0777))
-		d = NewRAMTree(name, perms, t.user, t.group)
+		nt := NewRAMTree(name, perms, uid, gid)
+		nt.quota = t.quota
+		nt.store = t.store
+		nt.spiller = t.spiller
+		nt.parent = t
+		nt.ids = t.ids
+		nt.own = t.own
+		nt.policy = t.policy
+		nt.atimeMode = t.atimeMode
+		nt.names = t.names
+		nt.limits = t.limits
+		nt.tarStreams = t.tarStreams
+		nt.find = t.find
+		nt.sums = t.sums
+		nt.hooks = t.hooks
+		nt.id = t.allocID(key)
+		d = nt
 	} else {
-		perms = perms & (^protocol.FileMode(0666) | (t.permissions & 0666))
-		d = NewRAMFile(name, perms, t.user, t.group)
+		nf := NewRAMFile(name, perms, uid, gid)
+		nf.quota = t.quota
+		nf.store = t.store
+		nf.spiller = t.spiller
+		t.spiller.track(nf)
+		t.quota.track(nf)
+		nf.parent = t
+		nf.atimeMode = t.atimeMode
+		nf.policy = t.policy
+		nf.hooks = t.hooks
+		nf.id = t.allocID(key)
+		d = nf
 	}
 
-	t.tree[name] = d
+	t.tree[key] = d
 
+	t.muser = user
 	t.mtime = time.Now()
-	t.atime = t.mtime
-	t.version++
+	t.atime.Store(t.mtime)
+	t.changed()
 	return d, nil
 }
 
 func (t *RAMTree) Add(name string, f fileserver.File) error {
 	t.Lock()
 	defer t.Unlock()
-	_, ok := t.tree[name]
-	if ok {
+	name, err := t.names.normalize(name)
+	if err != nil {
+		return err
+	}
+	if err := t.checkName(name); err != nil {
+		return err
+	}
+	key := t.names.key(name)
+	if _, ok := t.tree[key]; ok {
 		return errors.New("file already exists")
 	}
-	t.tree[name] = f
+	t.adopt(f)
+	t.tree[key] = f
 	t.mtime = time.Now()
-	t.atime = t.mtime
-	t.version++
+	t.atime.Store(t.mtime)
+	t.changed()
+	return nil
+}
+
+// Names returns the names of the files in the tree.
+func (t *RAMTree) Names() []string {
+	t.RLock()
+	defer t.RUnlock()
+	var names []string
+	for key, f := range t.tree {
+		name, err := f.Name()
+		if err != nil {
+			name = key
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+// Delete removes a file from the tree without checking permissions, and is
+// the counterpart of Add.
+func (t *RAMTree) Delete(name string) error {
+	t.Lock()
+	defer t.Unlock()
+	key := t.names.key(name)
+	f, ok := t.tree[key]
+	if !ok {
+		return errors.New("no such file")
+	}
+	releaseFile(t, f)
+	delete(t.tree, key)
+	t.releaseID(key)
+	t.mtime = time.Now()
+	t.atime.Store(t.mtime)
+	t.changed()
 	return nil
 }
 
 func (t *RAMTree) Rename(user, oldname, newname string) error {
 	t.Lock()
 	defer t.Unlock()
-	_, ok := t.tree[oldname]
+	okey := t.names.key(oldname)
+	f, ok := t.tree[okey]
 	if !ok {
 		return errors.New("file not found")
 	}
-	_, ok = t.tree[newname]
-	if ok {
+	newname, err := t.names.normalize(newname)
+	if err != nil {
+		return err
+	}
+	if err := t.checkName(newname); err != nil {
+		return err
+	}
+	// With case folding, a file may be renamed to a name differing only in
+	// case, which is the same key.
+	nkey := t.names.key(newname)
+	if _, ok := t.tree[nkey]; ok && nkey != okey {
 		return errors.New("file already exists")
 	}
 
-	owner := t.user == user
-	if !permCheck(owner, t.permissions, protocol.OWRITE) {
-		return errors.New("access denied")
+	if !t.allowed(user, protocol.OWRITE) {
+		return fileserver.ErrPermission
 	}
 
-	t.tree[newname] = t.tree[oldname]
-	delete(t.tree, oldname)
+	if nkey != okey {
+		delete(t.tree, okey)
+		t.tree[nkey] = f
+		t.releaseID(okey)
+	}
+	setName(f, newname)
+	t.muser = user
+	t.mtime = time.Now()
+	t.atime.Store(t.mtime)
+	t.changed()
+	return nil
+}
+
+// Move implements fileserver.Mover. dst must be a RAMTree.
+func (t *RAMTree) Move(user, name string, dst fileserver.Dir, newname string) error {
+	d, ok := dst.(*RAMTree)
+	if !ok {
+		return errors.New("cannot move to a different kind of tree")
+	}
+	return Move(user, t, name, d, newname)
+}
+
+// Move moves the file called name in src to dst, calling it newname there.
+// The user must be allowed to write to both trees. The trees are locked in
+// qid path order, so that concurrent moves in opposite directions do not
+// deadlock.
+func Move(user string, src *RAMTree, name string, dst *RAMTree, newname string) error {
+	if src == dst {
+		return src.Rename(user, name, newname)
+	}
+
+	first, second := src, dst
+	if second.id < first.id {
+		first, second = second, first
+	}
+	first.Lock()
+	defer first.Unlock()
+	second.Lock()
+	defer second.Unlock()
+
+	if !src.allowed(user, protocol.OWRITE) ||
+		!dst.allowed(user, protocol.OWRITE) {
+		return fileserver.ErrPermission
+	}
+
+	key := src.names.key(name)
+	f, ok := src.tree[key]
+	if !ok {
+		return errors.New("file not found")
+	}
+	newname, err := dst.names.normalize(newname)
+	if err != nil {
+		return err
+	}
+	if err := dst.checkName(newname); err != nil {
+		return err
+	}
+	nkey := dst.names.key(newname)
+	if _, ok := dst.tree[nkey]; ok {
+		return errors.New("file already exists")
+	}
+	if err := dst.checkRoom(); err != nil {
+		return err
+	}
+	if src.quota != dst.quota {
+		return errors.New("cannot move between quotas")
+	}
+
+	// A directory cannot be moved into itself.
+	if ft, ok := f.(*RAMTree); ok {
+		for p := fileserver.Dir(dst); p != nil; {
+			pt, ok := p.(*RAMTree)
+			if !ok {
+				break
+			}
+			if pt == ft {
+				return errors.New("cannot move a directory into itself")
+			}
+			p = pt.parent
+		}
+	}
+
+	delete(src.tree, key)
+	src.releaseID(key)
+	dst.adopt(f)
+	dst.tree[nkey] = f
+	setName(f, newname)
+
+	now := time.Now()
+	for _, t := range []*RAMTree{src, dst} {
+		t.muser = user
+		t.mtime = now
+		t.atime.Store(now)
+		t.changed()
+	}
 	return nil
 }
 
 func (t *RAMTree) Remove(user, name string) error {
 	t.Lock()
-	defer t.Unlock()
-	owner := t.user == user
-	if !permCheck(owner, t.permissions, protocol.OWRITE) {
-		return errors.New("access denied")
+	f, err := t.remove(user, name)
+	hooks := t.hooks
+	t.Unlock()
+	if err != nil {
+		return err
 	}
 
-	if f, ok := t.tree[name]; ok {
+	hooks.removed(user, t, f)
+	return nil
+}
+
+// remove removes the file called name, returning it. Must be called with the
+// tree locked.
+func (t *RAMTree) remove(user, name string) (fileserver.File, error) {
+	if !t.allowed(user, protocol.OWRITE) {
+		return nil, fileserver.ErrPermission
+	}
+
+	key := t.names.key(name)
+	if f, ok := t.tree[key]; ok {
 		rem, err := f.CanRemove()
 		if err != nil {
-			return err
+			return nil, err
 		}
 		if !rem {
-			return errors.New("file could not be removed")
+			return nil, errors.New("file could not be removed")
 		}
-		delete(t.tree, name)
+		releaseFile(t, f)
+		delete(t.tree, key)
+		t.releaseID(key)
+		t.muser = user
 		t.mtime = time.Now()
-		t.atime = t.mtime
-		t.version++
-		return nil
+		t.atime.Store(t.mtime)
+		t.changed()
+		return f, nil
 	}
 
-	return errors.New("no such file")
+	return nil, errors.New("no such file")
 }
 
 func (t *RAMTree) Walk(user string, name string) (fileserver.File, error) {
-	t.Lock()
-	defer t.Unlock()
-	owner := t.user == user
-	if !permCheck(owner, t.permissions, protocol.OEXEC) {
-		return nil, errors.New("access denied")
+	t.RLock()
+	if !t.allowed(user, protocol.OEXEC) {
+		t.RUnlock()
+		return nil, fileserver.ErrPermission
 	}
 
-	t.atime = time.Now()
-	for i := range t.tree {
-		if i == name {
-			return t.tree[i], nil
-		}
+	t.atime.access(t.atimeMode, t.mtime)
+	f, ok := t.tree[t.names.key(name)]
+	tarStreams, find, sums := t.tarStreams, t.find, t.sums
+	t.RUnlock()
+	if ok {
+		return f, nil
+	}
+
+	// Files produced on demand are only found if no stored file shadows
+	// them.
+	switch {
+	case find && name == findfs.DirName:
+		return findfs.NewDir(t)
+	case sums && strings.HasSuffix(name, checksum.Suffix):
+		return checksum.Walk(t, user, name)
+	case tarStreams:
+		return tarstream.Walk(t, user, name)
 	}
-	return nil, nil
+	return nil, fileserver.ErrNotExist
 }
 
 func (t *RAMTree) IsDir() (bool, error) {
@@ -314,7 +821,7 @@ func NewRAMTree(name string, permissions protocol.FileMode, user, group string)
 		group:       group,
 		muser:       user,
 		id:          nextID(),
-		atime:       time.Now(),
+		atime:       newAtomicTime(time.Now()),
 		mtime:       time.Now(),
 	}
 }
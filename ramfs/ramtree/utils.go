@@ -1,40 +1,36 @@
 package ramtree
 
 import (
-	"sync"
-
-	"github.com/kennylevinsen/g9p/protocol"
+	"sync/atomic"
+	"time"
 )
 
-var (
-	globalIDLock sync.Mutex
-	globalID     uint64 = 0
-)
+// globalIDs allocates qid paths for trees without an IDAllocator, and for
+// files not created through a tree. It uses namespace 0, so trees given other
+// namespaces with Namespace never collide with it.
+var globalIDs = NewCounter(0)
 
-func nextID() uint64 {
-	globalIDLock.Lock()
-	defer globalIDLock.Unlock()
-	id := globalID
-	globalID++
-	return id
+// atomicTime is a time that can be updated while only holding a read lock,
+// such as the access time of a file being read.
+type atomicTime struct {
+	v atomic.Value
 }
 
-func permCheck(owner bool, permissions protocol.FileMode, mode protocol.OpenMode) bool {
-	var offset uint8
-	if owner {
-		offset = 6
-	}
+func (t *atomicTime) Store(tm time.Time) {
+	t.v.Store(tm)
+}
 
-	switch mode & 3 {
-	case protocol.OREAD:
-		return permissions&(1<<(2+offset)) != 0
-	case protocol.OWRITE:
-		return permissions&(1<<(1+offset)) != 0
-	case protocol.ORDWR:
-		return (permissions&(1<<(2+offset)) != 0) && (permissions&(1<<(1+offset)) != 0)
-	case protocol.OEXEC:
-		return permissions&(1<<offset) != 0
-	default:
-		return false
-	}
+func (t *atomicTime) Load() time.Time {
+	tm, _ := t.v.Load().(time.Time)
+	return tm
+}
+
+func newAtomicTime(tm time.Time) atomicTime {
+	var t atomicTime
+	t.Store(tm)
+	return t
+}
+
+func nextID() uint64 {
+	return globalIDs.NextID(0, "")
 }
@@ -0,0 +1,69 @@
+package ramtree
+
+import (
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+)
+
+// ValidateFunc checks the content written to a validated file, returning
+// what to store instead, which may be transformed, such as by formatting
+// it. Returning an error rejects the content.
+type ValidateFunc func(user string, content []byte) ([]byte, error)
+
+// ValidatedFile is a RAMFile whose content is checked as a whole, which is
+// the usual way of serving configuration files. Opening it for writing
+// gives a private copy, which is handed to a ValidateFunc when closed after
+// being written to. What it accepts replaces the content of the file, while
+// rejected content is discarded, and the error returned by Tclunk. Readers
+// never see partially written content.
+type ValidatedFile struct {
+	*RAMFile
+	validate ValidateFunc
+}
+
+func (f *ValidatedFile) Open(user string, mode protocol.OpenMode) (fileserver.OpenFile, error) {
+	if mode&3 == protocol.OREAD || mode&3 == protocol.OEXEC {
+		return f.RAMFile.Open(user, mode)
+	}
+
+	f.RLock()
+	allowed := f.allowed(user, mode)
+	f.RUnlock()
+	if !allowed {
+		return nil, fileserver.ErrPermission
+	}
+	of, err := BufferOpener(f.read, f.commit)(user, mode)
+	if err != nil {
+		return nil, err
+	}
+
+	f.hooks.opened(user, f, mode)
+	return of, nil
+}
+
+func (f *ValidatedFile) read(user string) ([]byte, error) {
+	return f.Content(), nil
+}
+
+func (f *ValidatedFile) commit(user string, content []byte) error {
+	b, err := f.validate(user, content)
+	if err != nil {
+		return err
+	}
+	f.SetContent(b)
+	f.Lock()
+	f.muser = user
+	f.Unlock()
+
+	f.hooks.written(user, f.RAMFile, 0, len(b))
+	return nil
+}
+
+// NewValidatedFile returns an empty file whose content is checked by
+// validate.
+func NewValidatedFile(name string, permissions protocol.FileMode, user, group string, validate ValidateFunc) *ValidatedFile {
+	return &ValidatedFile{
+		RAMFile:  NewRAMFile(name, permissions, user, group),
+		validate: validate,
+	}
+}
@@ -0,0 +1,138 @@
+package ramtree
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+)
+
+// XattrMax is the largest value an extended attribute can hold.
+const XattrMax = 64 * 1024
+
+// xattrs holds the extended attributes of a file or directory.
+type xattrs map[string][]byte
+
+func (x xattrs) get(name string) ([]byte, error) {
+	v, ok := x[name]
+	if !ok {
+		return nil, fileserver.ErrNoXattr
+	}
+	return append([]byte(nil), v...), nil
+}
+
+func (x *xattrs) set(name string, value []byte, flags int) error {
+	if name == "" {
+		return errors.New("invalid attribute name")
+	}
+	if len(value) > XattrMax {
+		return errors.New("attribute value too large")
+	}
+	_, ok := (*x)[name]
+	switch {
+	case flags&fileserver.XattrCreate != 0 && ok:
+		return errors.New("attribute already exists")
+	case flags&fileserver.XattrReplace != 0 && !ok:
+		return fileserver.ErrNoXattr
+	}
+	if *x == nil {
+		*x = make(xattrs)
+	}
+	(*x)[name] = append([]byte(nil), value...)
+	return nil
+}
+
+func (x xattrs) list() []string {
+	var names []string
+	for name := range x {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (x xattrs) remove(name string) error {
+	if _, ok := x[name]; !ok {
+		return fileserver.ErrNoXattr
+	}
+	delete(x, name)
+	return nil
+}
+
+// GetXattr implements fileserver.XattrFile. Reading attributes requires read
+// permission.
+func (f *RAMFile) GetXattr(user, name string) ([]byte, error) {
+	f.RLock()
+	defer f.RUnlock()
+	if !f.allowed(user, protocol.OREAD) {
+		return nil, fileserver.ErrPermission
+	}
+	return f.xattrs.get(name)
+}
+
+// SetXattr implements fileserver.XattrFile. Changing attributes requires
+// write permission.
+func (f *RAMFile) SetXattr(user, name string, value []byte, flags int) error {
+	f.Lock()
+	defer f.Unlock()
+	if !f.allowed(user, protocol.OWRITE) {
+		return fileserver.ErrPermission
+	}
+	return f.xattrs.set(name, value, flags)
+}
+
+func (f *RAMFile) ListXattr(user string) ([]string, error) {
+	f.RLock()
+	defer f.RUnlock()
+	if !f.allowed(user, protocol.OREAD) {
+		return nil, fileserver.ErrPermission
+	}
+	return f.xattrs.list(), nil
+}
+
+func (f *RAMFile) RemoveXattr(user, name string) error {
+	f.Lock()
+	defer f.Unlock()
+	if !f.allowed(user, protocol.OWRITE) {
+		return fileserver.ErrPermission
+	}
+	return f.xattrs.remove(name)
+}
+
+// GetXattr implements fileserver.XattrFile, like RAMFile.GetXattr.
+func (t *RAMTree) GetXattr(user, name string) ([]byte, error) {
+	t.RLock()
+	defer t.RUnlock()
+	if !t.allowed(user, protocol.OREAD) {
+		return nil, fileserver.ErrPermission
+	}
+	return t.xattrs.get(name)
+}
+
+func (t *RAMTree) SetXattr(user, name string, value []byte, flags int) error {
+	t.Lock()
+	defer t.Unlock()
+	if !t.allowed(user, protocol.OWRITE) {
+		return fileserver.ErrPermission
+	}
+	return t.xattrs.set(name, value, flags)
+}
+
+func (t *RAMTree) ListXattr(user string) ([]string, error) {
+	t.RLock()
+	defer t.RUnlock()
+	if !t.allowed(user, protocol.OREAD) {
+		return nil, fileserver.ErrPermission
+	}
+	return t.xattrs.list(), nil
+}
+
+func (t *RAMTree) RemoveXattr(user, name string) error {
+	t.Lock()
+	defer t.Unlock()
+	if !t.allowed(user, protocol.OWRITE) {
+		return fileserver.ErrPermission
+	}
+	return t.xattrs.remove(name)
+}
@@ -0,0 +1,750 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/kennylevinsen/g9p"
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/audit"
+	"github.com/kennylevinsen/g9ptools/auth"
+	"github.com/kennylevinsen/g9ptools/config"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+	"github.com/kennylevinsen/g9ptools/policy"
+	"github.com/kennylevinsen/g9ptools/ramfs/ramtree"
+	"github.com/kennylevinsen/g9ptools/record"
+	"github.com/kennylevinsen/g9ptools/srvctl"
+	"github.com/kennylevinsen/g9ptools/transport"
+	"github.com/kennylevinsen/g9ptools/userdb"
+)
+
+// sweepInterval is how often expired files are removed.
+const sweepInterval = time.Second
+
+// server serves a configuration file. The configuration can be reloaded at
+// any time, which affects new sessions only, with the exception of keys and
+// quotas, which apply immediately. Existing sessions are never dropped, even
+// if the listener they arrived on is removed.
+type server struct {
+	sync.Mutex
+	path      string
+	conf      *config.Config
+	verbosity fileserver.Verbosity
+	keys      *auth.Keyring
+	users     *userdb.Replaceable
+	sessions  *fileserver.Sessions
+	// locks is shared by the sessions, as they serve the same trees.
+	locks     *fileserver.LockTable
+	roots     map[string]*ramtree.RAMTree
+	quotas    map[string]*ramtree.Quota
+	sweepers  map[string]*ramtree.Sweeper
+	stores    map[string]*ramtree.BlockStore
+	listeners map[string]*listener
+	// namespace is the qid path namespace of the last tree created.
+	namespace uint16
+	// intercept is applied to the sessions of all listeners, before the
+	// interceptors of the listener itself.
+	intercept []fileserver.Interceptor
+	// recorder records all sessions to the file at recordPath, if set.
+	recorder   *record.Recorder
+	recordFile *os.File
+	recordPath string
+	// auditor logs the events of all sessions to auditSink, opened from
+	// auditPath, if set.
+	auditor   *audit.Logger
+	auditSink io.WriteCloser
+	auditPath string
+	ctl       *srvctl.Tree
+}
+
+type listener struct {
+	conf      config.Listener
+	l         net.Listener
+	pol       *policy.File
+	intercept []fileserver.Interceptor
+}
+
+func listenerKey(lc config.Listener) string {
+	return lc.Network + "!" + lc.Address
+}
+
+// sameTransport reports whether two listener configurations can share a
+// socket.
+func sameTransport(a, b config.Listener) bool {
+	return a.TLSCert == b.TLSCert && a.TLSKey == b.TLSKey && a.TLSCA == b.TLSCA
+}
+
+// listenerCtxKey is the context key of the listener key of a session.
+type listenerCtxKey struct{}
+
+// faultChain returns the interceptors injecting the faults of spec, which has
+// been validated by the configuration.
+func faultChain(spec string) []fileserver.Interceptor {
+	if spec == "" {
+		return nil
+	}
+	f, err := fileserver.ParseFaults(spec)
+	if err != nil {
+		return nil
+	}
+	return []fileserver.Interceptor{f}
+}
+
+// session is the handler of a session, which is registered with the server
+// for as long as its connection lasts.
+type session struct {
+	g9p.Handler
+	sessions *fileserver.Sessions
+	sess     *fileserver.Session
+	cancel   context.CancelFunc
+}
+
+// Close forgets the session when its connection ends, and clunks the fids
+// left behind by the client. Its context is cancelled, so that interceptors
+// can forget it as well.
+func (h *session) Close() error {
+	h.cancel()
+	h.sessions.Remove(h.sess)
+	h.sess.FS.ClunkAll()
+	return nil
+}
+
+// handler produces the handler for a new session on the named listener,
+// using the configuration current at the time the session starts.
+func (s *server) handler(key string) func(net.Conn) g9p.Handler {
+	return func(conn net.Conn) g9p.Handler {
+		s.Lock()
+		defer s.Unlock()
+
+		m := make(map[string]fileserver.Dir)
+		for k, v := range s.roots {
+			m[k] = v
+		}
+		if s.ctl != nil {
+			m[srvctl.Service] = s.ctl
+		}
+
+		fs := fileserver.NewFileServer(nil, m, s.conf.MaxSize, s.verbosity)
+		fs.Restrict = restrictions(s.conf.Restrictions)
+		fs.Locks = s.locks
+		chain := append([]fileserver.Interceptor(nil), s.intercept...)
+		if l, ok := s.listeners[key]; ok {
+			fs.ReadOnly = l.conf.ReadOnly
+			fs.Scope = l.conf.Scope
+			if l.conf.Auth {
+				fs.Keys = s.keys
+			}
+			fs.Users = s.users
+			chain = append(chain, l.intercept...)
+		}
+		// Each session gets its own context, which Faults relies on to
+		// tell sessions apart.
+		ctx := context.WithValue(context.Background(), listenerCtxKey{}, key)
+		ctx = audit.WithRemote(ctx, conn.RemoteAddr().String())
+		ctx, cancel := context.WithCancel(ctx)
+		return &session{
+			Handler:  fileserver.Intercept(ctx, fs, chain...),
+			sessions: s.sessions,
+			sess:     s.sessions.Add(fs, conn, conn.RemoteAddr().String(), key),
+			cancel:   cancel,
+		}
+	}
+}
+
+// restrictions returns the restriction function of the configured
+// restrictions.
+func restrictions(rs []config.Restriction) func(string) fileserver.Restriction {
+	if len(rs) == 0 {
+		return nil
+	}
+	m := make(map[string]fileserver.Restriction)
+	for _, r := range rs {
+		m[r.User] = fileserver.Restriction{Scope: r.Scope, ReadOnly: r.ReadOnly}
+	}
+	return func(user string) fileserver.Restriction {
+		return m[user]
+	}
+}
+
+// tlsHandler applies the current policy of the named listener, if any.
+func (s *server) tlsHandler(key string) func(net.Conn, tls.ConnectionState) (g9p.Handler, error) {
+	h := s.handler(key)
+	return func(conn net.Conn, state tls.ConnectionState) (g9p.Handler, error) {
+		s.Lock()
+		var pol *policy.File
+		if l, ok := s.listeners[key]; ok {
+			pol = l.pol
+		}
+		s.Unlock()
+
+		if pol == nil {
+			return h(conn), nil
+		}
+		id, err := policy.TLSIdentity(state)
+		if err != nil {
+			return nil, err
+		}
+		rule, err := pol.Lookup(id)
+		if err != nil {
+			return nil, err
+		}
+		sh := h(conn).(*session)
+		sh.Handler = policy.NewHandler(sh.Handler, rule)
+		return sh, nil
+	}
+}
+
+// start opens a listener. Must be called with the server locked.
+func (s *server) start(lc config.Listener) error {
+	key := listenerKey(lc)
+	l := &listener{conf: lc, intercept: faultChain(lc.Faults)}
+
+	if lc.Policy != "" {
+		pol, err := policy.Load(lc.Policy)
+		if err != nil {
+			return err
+		}
+		l.pol = pol
+	}
+
+	var tlsConfig *tls.Config
+	if lc.TLS() {
+		var err error
+		tlsConfig, err = transport.TLSConfig(lc.TLSCert, lc.TLSKey, lc.TLSCA)
+		if err != nil {
+			return err
+		}
+	}
+
+	if lc.Network == "quic" {
+		nl, err := transport.ListenQUIC(lc.Address, tlsConfig)
+		if err != nil {
+			return err
+		}
+		l.l = nl
+		s.listeners[key] = l
+		log.Printf("Starting ramfs with QUIC at %s", key)
+		go transport.ServeQUIC(nl, s.tlsHandler(key))
+		return nil
+	}
+
+	nl, err := transport.Listen(lc.Network, lc.Address)
+	if err != nil {
+		return err
+	}
+	l.l = nl
+	s.listeners[key] = l
+
+	serveConns := func() { transport.Serve(nl, s.handler(key)) }
+	if tlsConfig != nil {
+		log.Printf("Starting ramfs with TLS at %s", key)
+		serveConns = func() { transport.ServeTLS(nl, tlsConfig, s.tlsHandler(key)) }
+	} else {
+		log.Printf("Starting ramfs at %s", key)
+	}
+
+	if lc.Network == "stdio" {
+		// The standard input and output carry a single session, as when
+		// run by inetd or as an SSH forced command, and the server is done
+		// once it ends.
+		go func() {
+			serveConns()
+			log.Printf("Session on standard input ended")
+			os.Exit(0)
+		}()
+		return nil
+	}
+	go serveConns()
+	return nil
+}
+
+// apply makes a configuration current.
+func (s *server) apply(c *config.Config) error {
+	verbosity, err := c.FileServerVerbosity()
+	if err != nil {
+		return err
+	}
+
+	keys := auth.NewKeyring()
+	if c.Keys != "" {
+		if keys, err = auth.LoadKeys(c.Keys); err != nil {
+			return err
+		}
+	}
+
+	users, err := openUsers(c.Users)
+	if err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if c.Record != s.recordPath {
+		var f *os.File
+		if c.Record != "" {
+			if f, err = os.OpenFile(c.Record, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600); err != nil {
+				return err
+			}
+		}
+		if s.recordFile != nil {
+			s.recordFile.Close()
+		}
+		s.recordFile, s.recorder, s.recordPath = f, nil, c.Record
+		if f != nil {
+			s.recorder = record.NewRecorder(f)
+		}
+	}
+
+	if c.Audit != s.auditPath {
+		var sink io.WriteCloser
+		if c.Audit != "" {
+			if sink, err = audit.OpenSink(c.Audit); err != nil {
+				return err
+			}
+		}
+		if s.auditSink != nil {
+			s.auditSink.Close()
+		}
+		s.auditSink, s.auditor, s.auditPath = sink, nil, c.Audit
+		if sink != nil {
+			s.auditor = audit.NewLogger(sink)
+		}
+	}
+
+	s.conf = c
+	s.verbosity = verbosity
+	// Sessions are recorded as the client sees them, with any faults
+	// injected, while the audit log records what actually happened.
+	s.intercept = nil
+	if s.recorder != nil {
+		s.intercept = append(s.intercept, s.recorder)
+	}
+	s.intercept = append(s.intercept, faultChain(c.Faults)...)
+	if s.auditor != nil {
+		s.intercept = append(s.intercept, s.auditor)
+	}
+	s.keys.Replace(keys)
+	s.users.Replace(users)
+
+	// Trees are kept across reloads, so that their content survives.
+	// Removed trees are no longer offered to new sessions.
+	roots := make(map[string]*ramtree.RAMTree)
+	for _, t := range c.Trees {
+		root, ok := s.roots[t.Service]
+		if !ok {
+			root = ramtree.NewRAMTree("/", protocol.FileMode(t.Perm), t.User, t.Group)
+			// Each tree gets its own namespace, so that qid paths are
+			// unique across the server. The namespaces follow the order
+			// of the trees, so stable IDs stay stable as long as the
+			// configuration does.
+			var ids ramtree.IDAllocator = ramtree.NewCounter(0)
+			if t.StableIDs {
+				ids = ramtree.NewHashIDs(t.Service)
+			}
+			s.namespace++
+			root.SetIDAllocator(ramtree.Namespace(s.namespace, ids))
+			atime, _ := ramtree.ParseAtimeMode(t.Atime)
+			root.SetAtimeMode(atime)
+			names, _ := ramtree.ParseNamePolicy(t.Names)
+			root.SetNamePolicy(names)
+			root.SetPermissionPolicy(fileserver.GroupPolicy(s.users))
+			root.SetLimits(ramtree.Limits{
+				MaxName:     int(t.MaxName),
+				MaxDepth:    int(t.MaxDepth),
+				MaxChildren: int(t.MaxChildren),
+			})
+			if t.Ownership() {
+				own := &ramtree.Ownership{UID: t.UID, GID: t.GID}
+				if t.Umask >= 0 {
+					own.Umask = protocol.FileMode(t.Umask)
+				}
+				root.SetOwnership(own)
+			}
+			root.SetTarStreams(t.TarStreams)
+			root.SetFind(t.Find)
+			root.SetChecksums(t.Checksums)
+			s.quotas[t.Service] = ramtree.NewQuota(t.Quota)
+			root.SetQuota(s.quotas[t.Service])
+			s.sweepers[t.Service] = ramtree.NewSweeper(root, sweepInterval)
+			if t.Dedup {
+				s.stores[t.Service] = ramtree.NewBlockStore()
+				root.SetBlockStore(s.stores[t.Service])
+			}
+			if t.Spill > 0 {
+				// The spill directory is left behind if the tree is
+				// removed, as existing sessions may still use it.
+				sp, err := ramtree.NewSpiller(t.SpillDir, t.Spill)
+				if err != nil {
+					log.Printf("Unable to spill tree %s to disk: %v", t.Service, err)
+				} else {
+					root.SetSpiller(sp)
+				}
+			}
+			if t.Proto != "" {
+				if err := buildProto(root, t.Proto); err != nil {
+					log.Printf("Unable to populate tree %s: %v", t.Service, err)
+				}
+			}
+		}
+		s.quotas[t.Service].SetMax(t.Quota)
+		s.quotas[t.Service].SetEvict(t.Evict)
+		roots[t.Service] = root
+	}
+	for service, sw := range s.sweepers {
+		if _, ok := roots[service]; !ok {
+			sw.Stop()
+			delete(s.sweepers, service)
+			delete(s.stores, service)
+		}
+	}
+	s.roots = roots
+
+	if c.Srvctl.User != "" {
+		if s.ctl == nil {
+			s.ctl = srvctl.NewTree(c.Srvctl.User, c.Srvctl.Group)
+			s.ctl.Handle("reload", func([]string) error { return s.reload() })
+			s.ctl.Handle("expire", s.expire)
+			s.ctl.Handle("pin", s.pin(true))
+			s.ctl.Handle("unpin", s.pin(false))
+			s.ctl.SetStatus(s.status)
+			s.ctl.SetDF(s.df)
+			s.ctl.SetSessions(s.describeSessions)
+			s.ctl.Handle("kill", s.kill)
+			s.ctl.Handle("clunk", s.clunk)
+		}
+	} else {
+		s.ctl = nil
+	}
+
+	wanted := make(map[string]config.Listener)
+	for _, lc := range c.Listeners {
+		wanted[listenerKey(lc)] = lc
+	}
+
+	for key, l := range s.listeners {
+		lc, ok := wanted[key]
+		if ok && sameTransport(l.conf, lc) {
+			continue
+		}
+		log.Printf("Stopping ramfs at %s", key)
+		l.l.Close()
+		delete(s.listeners, key)
+	}
+
+	var errs []string
+	for key, lc := range wanted {
+		if l, ok := s.listeners[key]; ok {
+			l.conf = lc
+			l.intercept = faultChain(lc.Faults)
+			if lc.Policy == "" {
+				l.pol = nil
+			} else if l.pol == nil {
+				if l.pol, err = policy.Load(lc.Policy); err != nil {
+					errs = append(errs, fmt.Sprintf("%s: %v", key, err))
+				}
+			} else if err := l.pol.Reload(); err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %v", key, err))
+			}
+			continue
+		}
+		if err := s.start(lc); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", key, err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// buildProto populates root with the files of the manifest in file.
+func buildProto(root *ramtree.RAMTree, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	specs, err := ramtree.ParseManifest(f)
+	if err != nil {
+		return err
+	}
+	return root.Build(specs...)
+}
+
+// openUsers opens the user database of the configuration, which is nil if
+// none is configured.
+func openUsers(c config.Users) (fileserver.UserDB, error) {
+	var db fileserver.UserDB
+	cache := time.Duration(c.Cache) * time.Second
+	switch c.Source {
+	case "":
+		return nil, nil
+	case "file":
+		f, err := userdb.Load(c.File)
+		if err != nil {
+			return nil, err
+		}
+		db = f
+	case "os":
+		db = userdb.OS{}
+	case "ldap":
+		db = &userdb.LDAP{
+			URL:          c.LDAPURL,
+			BindDN:       c.LDAPBindDN,
+			BindPassword: c.LDAPBindPassword,
+			BaseDN:       c.LDAPBaseDN,
+			UserFilter:   c.LDAPUserFilter,
+			GroupFilter:  c.LDAPGroupFilter,
+			GroupAttr:    c.LDAPGroupAttr,
+		}
+		if cache <= 0 {
+			cache = time.Minute
+		}
+	default:
+		return nil, fmt.Errorf("unknown user database %q", c.Source)
+	}
+	if cache > 0 {
+		db = userdb.NewCache(db, cache)
+	}
+	return db, nil
+}
+
+// lookup returns the file at path in the tree of service.
+func (s *server) lookup(service, path string) (*ramtree.RAMFile, error) {
+	s.Lock()
+	root, ok := s.roots[service]
+	s.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("no such service: %s", service)
+	}
+	f, err := root.Lookup(path)
+	if err != nil {
+		return nil, err
+	}
+	switch f := f.(type) {
+	case *ramtree.RAMFile:
+		return f, nil
+	case *ramtree.RAMLink:
+		return f.RAMFile, nil
+	default:
+		return nil, errors.New("not a file")
+	}
+}
+
+// expire handles "expire service path duration", making the file at path in
+// the tree of service expire after duration. A duration of zero makes the
+// file never expire.
+func (s *server) expire(args []string) error {
+	if len(args) != 3 {
+		return errors.New("usage: expire service path duration")
+	}
+	d, err := time.ParseDuration(args[2])
+	if err != nil {
+		return err
+	}
+	f, err := s.lookup(args[0], args[1])
+	if err != nil {
+		return err
+	}
+	var tm time.Time
+	if d != 0 {
+		tm = time.Now().Add(d)
+	}
+	f.SetExpiry(tm)
+	return nil
+}
+
+// pin returns the handler of "pin service path" or "unpin service path",
+// which protect a file from eviction, or remove that protection.
+func (s *server) pin(pinned bool) srvctl.Command {
+	return func(args []string) error {
+		if len(args) != 2 {
+			return errors.New("usage: pin|unpin service path")
+		}
+		f, err := s.lookup(args[0], args[1])
+		if err != nil {
+			return err
+		}
+		f.SetPinned(pinned)
+		return nil
+	}
+}
+
+// reload reads the configuration file again and applies it.
+func (s *server) reload() error {
+	c, err := config.Load(s.path)
+	if err != nil {
+		return err
+	}
+	return s.apply(c)
+}
+
+// status describes the listeners and trees. Must be called without the
+// server locked.
+func (s *server) status() string {
+	s.Lock()
+	defer s.Unlock()
+
+	var buf bytes.Buffer
+	var keys []string
+	for key := range s.listeners {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		l := s.listeners[key]
+		fmt.Fprintf(&buf, "listener %s auth=%v readonly=%v tls=%v", key, l.conf.Auth, l.conf.ReadOnly, l.conf.TLS())
+		if l.conf.Scope != "" {
+			fmt.Fprintf(&buf, " scope=%s", l.conf.Scope)
+		}
+		buf.WriteString("\n")
+	}
+
+	var services []string
+	for service := range s.roots {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+	for _, service := range services {
+		q := s.quotas[service]
+		fmt.Fprintf(&buf, "tree %s used=%d quota=%d evict=%v", service, q.Used(), q.Max(), q.Evicts())
+		if bs, ok := s.stores[service]; ok {
+			blocks, n := bs.Stats()
+			fmt.Fprintf(&buf, " blocks=%d stored=%d", blocks, n)
+		}
+		buf.WriteString("\n")
+	}
+	return buf.String()
+}
+
+// describeSessions lists the sessions and their fids.
+func (s *server) describeSessions() string {
+	var buf bytes.Buffer
+	for _, sess := range s.sessions.List() {
+		fmt.Fprintf(&buf, "session %d remote=%s listener=%s started=%s\n",
+			sess.ID, sess.Remote, sess.Listener, sess.Started.Format(time.RFC3339))
+		for _, fi := range sess.FS.FidInfos() {
+			fmt.Fprintf(&buf, "\tfid %d service=%s user=%s path=%s", fi.Fid, fi.Service, fi.User, fi.Path)
+			if fi.Open {
+				fmt.Fprintf(&buf, " mode=%d read=%d written=%d", fi.Mode, fi.Read, fi.Written)
+			}
+			buf.WriteString("\n")
+		}
+	}
+	return buf.String()
+}
+
+// kill handles "kill session", closing the connection of the session with
+// the ID listed in the sessions file, and clunking its fids.
+func (s *server) kill(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: kill session")
+	}
+	id, err := strconv.Atoi(args[0])
+	if err != nil {
+		return err
+	}
+	return s.sessions.Kill(id)
+}
+
+// clunk handles "clunk session fid", clunking a fid of a session, such as
+// one stuck on a blocking file.
+func (s *server) clunk(args []string) error {
+	if len(args) != 2 {
+		return errors.New("usage: clunk session fid")
+	}
+	id, err := strconv.Atoi(args[0])
+	if err != nil {
+		return err
+	}
+	fid, err := strconv.ParseUint(args[1], 10, 32)
+	if err != nil {
+		return err
+	}
+	sess, err := s.sessions.Get(id)
+	if err != nil {
+		return err
+	}
+	return sess.FS.ForceClunk(protocol.Fid(fid))
+}
+
+// df describes the space of the trees like df(1), in kilobytes. Must be
+// called without the server locked.
+func (s *server) df() string {
+	s.Lock()
+	defer s.Unlock()
+
+	var services []string
+	for service := range s.roots {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%-16s %12s %12s %12s %8s\n", "service", "size", "used", "avail", "files")
+	for _, service := range services {
+		st, err := s.roots[service].Statfs()
+		if err != nil {
+			continue
+		}
+		kb := func(blocks uint64) uint64 { return blocks * uint64(st.BlockSize) / 1024 }
+		fmt.Fprintf(&buf, "%-16s %12d %12d %12d %8d\n", service, kb(st.Blocks), kb(st.Blocks-st.BlocksFree), kb(st.BlocksFree), st.Files)
+	}
+	return buf.String()
+}
+
+// serve serves a configuration, and never returns. On SIGHUP, the
+// configuration is read again from path, or if path is empty, the key and
+// policy files it refers to are.
+func serve(path string, c *config.Config) {
+	s := &server{
+		path:      path,
+		keys:      auth.NewKeyring(),
+		users:     &userdb.Replaceable{},
+		sessions:  fileserver.NewSessions(),
+		locks:     fileserver.NewLockTable(),
+		roots:     make(map[string]*ramtree.RAMTree),
+		quotas:    make(map[string]*ramtree.Quota),
+		sweepers:  make(map[string]*ramtree.Sweeper),
+		stores:    make(map[string]*ramtree.BlockStore),
+		listeners: make(map[string]*listener),
+	}
+	if err := s.apply(c); err != nil {
+		log.Fatalf("Unable to apply configuration: %v", err)
+	}
+	transport.Ready()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	for range sig {
+		transport.Notify("RELOADING=1")
+		var err error
+		if path != "" {
+			err = s.reload()
+		} else {
+			err = s.apply(c)
+		}
+		if err != nil {
+			log.Printf("Unable to reload configuration: %v", err)
+		} else {
+			log.Printf("Reloaded configuration")
+		}
+		transport.Notify("READY=1")
+	}
+}
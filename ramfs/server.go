@@ -1,41 +1,177 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
-	"net"
 	"os"
+	"strings"
 
-	"github.com/kennylevinsen/g9p"
-	"github.com/kennylevinsen/g9ptools/fileserver"
-	"github.com/kennylevinsen/g9ptools/ramfs/ramtree"
+	"github.com/kennylevinsen/g9ptools/config"
+	"github.com/kennylevinsen/g9ptools/transport"
 )
 
+// listenFlags collects repeated -listen flags.
+type listenFlags []string
+
+func (l *listenFlags) String() string {
+	return strings.Join(*l, " ")
+}
+
+func (l *listenFlags) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
 func main() {
-	if len(os.Args) < 5 {
+	var listens listenFlags
+	configFile := flag.String("config", "", "configuration file; replaces all other arguments")
+	keyfile := flag.String("keys", "", "require p9sk1 authentication using the keys in file")
+	tlsAddr := flag.String("tlsaddr", "", "additionally serve TLS on address")
+	tlsCert := flag.String("tlscert", "", "TLS certificate file")
+	tlsKey := flag.String("tlskey", "", "TLS key file")
+	tlsCA := flag.String("tlsca", "", "CA file for verifying TLS client certificates")
+	policyFile := flag.String("policy", "", "policy file mapping TLS client certificates to users, reloaded on SIGHUP")
+	stableIDs := flag.Bool("stableids", false, "derive qid paths from file paths, keeping them stable across restarts")
+	uid := flag.String("uid", "", "owner of created files, instead of the owner of their directory")
+	gid := flag.String("gid", "", "group of created files, instead of the group of their directory")
+	umask := flag.Int("umask", -1, "clear umask from the permissions of created files, instead of masking by their directory")
+	atime := flag.String("atime", "strict", "access time mode: strict, relatime or off")
+	recordFile := flag.String("record", "", "record all sessions to file, for replay with 9preplay")
+	auditLog := flag.String("audit", "", "write an audit log to file, or to syslog if \"syslog\"")
+	faults := flag.String("faults", "", "inject faults for testing clients, such as latency=50ms,drop=0.01,short=0.1,error=0.01")
+	names := flag.String("names", "", "name policy: comma-separated list of strict, nfc and fold")
+	maxName := flag.Int64("maxname", 0, "maximum length of names, if positive")
+	maxDepth := flag.Int64("maxdepth", 0, "maximum depth of paths, if positive")
+	maxChildren := flag.Int64("maxchildren", 0, "maximum number of entries per directory, if positive")
+	evict := flag.Bool("evict", false, "evict least recently accessed files when the quota is exceeded")
+	quota := flag.Int64("quota", 0, "limit the total content size in bytes")
+	dedup := flag.Bool("dedup", false, "store identical blocks of file content only once")
+	spill := flag.Int64("spill", 0, "spill content of closed files to disk beyond this many bytes in memory")
+	spillDir := flag.String("spilldir", "", "directory to spill content to")
+	proto := flag.String("proto", "", "populate the tree with the files of a manifest")
+	users := flag.String("users", "", "user database: os, or a users file")
+	tarStreams := flag.Bool("tar", false, "serve tarballs of directories as name.tar")
+	find := flag.Bool("find", false, "answer searches in .find directories")
+	sums := flag.Bool("sums", false, "serve SHA-256 checksums of files as name.sum")
+	stdio := flag.Bool("stdio", false, "serve a single session on standard input and output instead of address")
+	flag.Var(&listens, "listen", "additionally listen on dialstring[,auth|noauth|readonly|tls|scope=path...]; may be repeated")
+	flag.Parse()
+
+	if *configFile != "" {
+		c, err := config.Load(*configFile)
+		if err != nil {
+			log.Fatalf("Unable to load configuration: %v", err)
+		}
+		serve(*configFile, c)
+	}
+
+	nargs := 4
+	if *stdio {
+		nargs = 3
+	}
+	if flag.NArg() < nargs {
 		fmt.Printf("Too few arguments\n")
-		fmt.Printf("%s service UID GID address\n", os.Args[0])
+		fmt.Printf("%s [-keys file] [-record file] [-audit file|syslog] [-faults spec] [-stableids] [-uid user] [-gid group] [-umask mask] [-atime mode] [-names policy] [-maxname n] [-maxdepth n] [-maxchildren n] [-quota bytes [-evict]] [-dedup] [-spill bytes [-spilldir dir]] [-proto file] [-tar] [-find] [-sums] [-users os|file] [-listen dialstring[,options]]... [-tlsaddr address] [-tlscert file -tlskey file [-tlsca file] [-policy file]] service UID GID address\n", os.Args[0])
+		fmt.Printf("%s [options] -stdio service UID GID\n", os.Args[0])
+		fmt.Printf("%s -config file\n", os.Args[0])
 		fmt.Printf("UID and GID are the user/group that owns /\n")
 		return
 	}
 
-	service := os.Args[1]
-	user := os.Args[2]
-	group := os.Args[3]
-	addr := os.Args[4]
+	service := flag.Arg(0)
+	user := flag.Arg(1)
+	group := flag.Arg(2)
+	addr := flag.Arg(3)
+
+	c := &config.Config{
+		Verbosity: "debug",
+		MaxSize:   10 * 1024 * 1024,
+		Keys:      *keyfile,
+		Faults:    *faults,
+		Record:    *recordFile,
+		Audit:     *auditLog,
+		Trees: []config.Tree{{
+			Service:     service,
+			User:        user,
+			Group:       group,
+			Perm:        0777,
+			StableIDs:   *stableIDs,
+			UID:         *uid,
+			GID:         *gid,
+			Umask:       int64(*umask),
+			Atime:       *atime,
+			Names:       *names,
+			MaxName:     *maxName,
+			MaxDepth:    *maxDepth,
+			MaxChildren: *maxChildren,
+			Quota:       *quota,
+			Evict:       *evict,
+			Dedup:       *dedup,
+			Spill:       *spill,
+			SpillDir:    *spillDir,
+			Proto:       *proto,
+			TarStreams:  *tarStreams,
+			Find:        *find,
+			Checksums:   *sums,
+		}},
+	}
+	switch *users {
+	case "":
+	case "os":
+		c.Users.Source = "os"
+	default:
+		c.Users = config.Users{Source: "file", File: *users}
+	}
+
+	tlsListener := func(lc config.Listener) config.Listener {
+		lc.TLSCert = *tlsCert
+		lc.TLSKey = *tlsKey
+		lc.TLSCA = *tlsCA
+		lc.Policy = *policyFile
+		return lc
+	}
 
-	root := ramtree.NewRAMTree("/", 0777, user, group)
-	l, err := net.Listen("tcp", addr)
-	if err != nil {
-		log.Fatalf("Unable to listen: %v", err)
+	auth := *keyfile != ""
+	if *stdio {
+		c.Listeners = append(c.Listeners, config.Listener{Network: "stdio", Auth: auth})
+	} else {
+		c.Listeners = append(c.Listeners, config.Listener{Network: "tcp", Address: addr, Auth: auth})
+	}
+	if *tlsAddr != "" {
+		c.Listeners = append(c.Listeners, tlsListener(config.Listener{Network: "tcp", Address: *tlsAddr, Auth: auth}))
 	}
 
-	h := func() g9p.Handler {
-		m := make(map[string]fileserver.Dir)
-		m[service] = root
-		return fileserver.NewFileServer(nil, m, 10*1024*1024, fileserver.Debug)
+	for _, l := range listens {
+		opts := strings.Split(l, ",")
+		network, address, err := transport.ParseDialString(opts[0])
+		if err != nil {
+			log.Fatalf("Invalid listener: %v", err)
+		}
+		lc := config.Listener{Network: network, Address: address, Auth: auth}
+		for _, opt := range opts[1:] {
+			switch opt {
+			case "auth":
+				lc.Auth = true
+			case "noauth":
+				lc.Auth = false
+			case "readonly":
+				lc.ReadOnly = true
+			case "tls":
+				lc = tlsListener(lc)
+			default:
+				if strings.HasPrefix(opt, "scope=") {
+					lc.Scope = strings.TrimPrefix(opt, "scope=")
+					continue
+				}
+				log.Fatalf("Invalid listener option: %s", opt)
+			}
+		}
+		c.Listeners = append(c.Listeners, lc)
 	}
 
-	log.Printf("Starting ramfs at %s", addr)
-	g9p.ServeListener(l, h)
+	if err := c.Validate(); err != nil {
+		log.Fatalf("Invalid arguments: %v", err)
+	}
+	serve("", c)
 }
@@ -0,0 +1,207 @@
+// Package record records 9P sessions passing through a server, and replays
+// them, either by driving a recorded client session against a server, or by
+// serving the recorded responses to a client.
+//
+// A recording is a stream of JSON entries, one per line, holding a request
+// or its response. Entries of concurrent sessions are interleaved, and are
+// told apart by their session number.
+package record
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+)
+
+// Entry is a recorded request or response.
+type Entry struct {
+	Time    time.Time
+	Session int
+	Tag     protocol.Tag
+	// Type is the name of the message type, such as "WalkRequest".
+	Type string
+	// Message is the request or response, which is nil for a response
+	// that is an error.
+	Message protocol.Message `json:"-"`
+	// Error is the error returned instead of a response.
+	Error string `json:",omitempty"`
+}
+
+// IsRequest reports whether the entry is a request.
+func (e *Entry) IsRequest() bool {
+	return strings.HasSuffix(e.Type, "Request")
+}
+
+// entry is the encoded form of an Entry.
+type entry struct {
+	Time    time.Time
+	Session int
+	Tag     protocol.Tag
+	Type    string
+	Message json.RawMessage `json:",omitempty"`
+	Error   string          `json:",omitempty"`
+}
+
+var messageTypes = map[string]func() protocol.Message{
+	"VersionRequest":    func() protocol.Message { return &protocol.VersionRequest{} },
+	"VersionResponse":   func() protocol.Message { return &protocol.VersionResponse{} },
+	"AuthRequest":       func() protocol.Message { return &protocol.AuthRequest{} },
+	"AuthResponse":      func() protocol.Message { return &protocol.AuthResponse{} },
+	"AttachRequest":     func() protocol.Message { return &protocol.AttachRequest{} },
+	"AttachResponse":    func() protocol.Message { return &protocol.AttachResponse{} },
+	"FlushRequest":      func() protocol.Message { return &protocol.FlushRequest{} },
+	"FlushResponse":     func() protocol.Message { return &protocol.FlushResponse{} },
+	"WalkRequest":       func() protocol.Message { return &protocol.WalkRequest{} },
+	"WalkResponse":      func() protocol.Message { return &protocol.WalkResponse{} },
+	"OpenRequest":       func() protocol.Message { return &protocol.OpenRequest{} },
+	"OpenResponse":      func() protocol.Message { return &protocol.OpenResponse{} },
+	"CreateRequest":     func() protocol.Message { return &protocol.CreateRequest{} },
+	"CreateResponse":    func() protocol.Message { return &protocol.CreateResponse{} },
+	"ReadRequest":       func() protocol.Message { return &protocol.ReadRequest{} },
+	"ReadResponse":      func() protocol.Message { return &protocol.ReadResponse{} },
+	"WriteRequest":      func() protocol.Message { return &protocol.WriteRequest{} },
+	"WriteResponse":     func() protocol.Message { return &protocol.WriteResponse{} },
+	"ClunkRequest":      func() protocol.Message { return &protocol.ClunkRequest{} },
+	"ClunkResponse":     func() protocol.Message { return &protocol.ClunkResponse{} },
+	"RemoveRequest":     func() protocol.Message { return &protocol.RemoveRequest{} },
+	"RemoveResponse":    func() protocol.Message { return &protocol.RemoveResponse{} },
+	"StatRequest":       func() protocol.Message { return &protocol.StatRequest{} },
+	"StatResponse":      func() protocol.Message { return &protocol.StatResponse{} },
+	"WriteStatRequest":  func() protocol.Message { return &protocol.WriteStatRequest{} },
+	"WriteStatResponse": func() protocol.Message { return &protocol.WriteStatResponse{} },
+}
+
+// typeName returns the name of the type of m, as used in entries.
+func typeName(m protocol.Message) string {
+	return strings.TrimPrefix(fmt.Sprintf("%T", m), "*protocol.")
+}
+
+// Recorder is a fileserver.Interceptor writing every request and response to
+// a recording. Each context given to fileserver.Intercept is a session.
+type Recorder struct {
+	sync.Mutex
+	enc      *json.Encoder
+	err      error
+	sessions map[context.Context]int
+}
+
+// session returns the session number of ctx. Must be called with the
+// recorder locked.
+func (r *Recorder) session(ctx context.Context) int {
+	n, ok := r.sessions[ctx]
+	if !ok {
+		n = len(r.sessions) + 1
+		r.sessions[ctx] = n
+	}
+	return n
+}
+
+// write writes an entry. Once writing fails, the recording stops, and Err
+// returns the error.
+func (r *Recorder) write(ctx context.Context, tag protocol.Tag, typ string, m protocol.Message, err error) {
+	r.Lock()
+	defer r.Unlock()
+	if r.err != nil {
+		return
+	}
+
+	e := entry{Time: time.Now(), Session: r.session(ctx), Tag: tag, Type: typ}
+	if err != nil {
+		e.Error = err.Error()
+	} else if m != nil {
+		b, err := json.Marshal(m)
+		if err != nil {
+			r.err = err
+			return
+		}
+		e.Message = b
+	}
+	r.err = r.enc.Encode(&e)
+}
+
+func (r *Recorder) Handle(ctx context.Context, req protocol.Message, next fileserver.Next) (protocol.Message, error) {
+	typ := typeName(req)
+	r.write(ctx, req.GetTag(), typ, req, nil)
+	resp, err := next(ctx, req)
+	r.write(ctx, req.GetTag(), strings.TrimSuffix(typ, "Request")+"Response", resp, err)
+	return resp, err
+}
+
+// Err returns the error that stopped the recording, if any.
+func (r *Recorder) Err() error {
+	r.Lock()
+	defer r.Unlock()
+	return r.err
+}
+
+// NewRecorder returns a Recorder writing to w.
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{
+		enc:      json.NewEncoder(w),
+		sessions: make(map[context.Context]int),
+	}
+}
+
+// Decoder reads the entries of a recording.
+type Decoder struct {
+	dec *json.Decoder
+}
+
+// Next returns the next entry, or io.EOF at the end of the recording.
+func (d *Decoder) Next() (*Entry, error) {
+	var e entry
+	if err := d.dec.Decode(&e); err != nil {
+		return nil, err
+	}
+
+	x := &Entry{Time: e.Time, Session: e.Session, Tag: e.Tag, Type: e.Type, Error: e.Error}
+	if e.Error != "" {
+		return x, nil
+	}
+	newMessage, ok := messageTypes[e.Type]
+	if !ok {
+		return nil, fmt.Errorf("unknown message type %q", e.Type)
+	}
+	x.Message = newMessage()
+	if len(e.Message) > 0 {
+		if err := json.Unmarshal(e.Message, x.Message); err != nil {
+			return nil, fmt.Errorf("%s: %v", e.Type, err)
+		}
+	}
+	return x, nil
+}
+
+// NewDecoder returns a Decoder reading from r.
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{dec: json.NewDecoder(r)}
+}
+
+// ReadSession reads the entries of a session from a recording, in order.
+func ReadSession(r io.Reader, session int) ([]*Entry, error) {
+	var entries []*Entry
+	d := NewDecoder(r)
+	for {
+		e, err := d.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if e.Session == session {
+			entries = append(entries, e)
+		}
+	}
+	if len(entries) == 0 {
+		return nil, errors.New("session not found in recording")
+	}
+	return entries, nil
+}
@@ -0,0 +1,205 @@
+package record
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sync"
+
+	"github.com/kennylevinsen/g9p"
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+)
+
+// Exchange is a recorded request and its response.
+type Exchange struct {
+	Request  *Entry
+	Response *Entry
+}
+
+// Exchanges pairs the requests of a session with their responses by tag, in
+// the order the requests were made. Requests without a recorded response,
+// such as those of a session that was cut short, are left out.
+func Exchanges(entries []*Entry) []*Exchange {
+	var xs []*Exchange
+	pending := make(map[protocol.Tag]*Exchange)
+	for _, e := range entries {
+		if e.IsRequest() {
+			x := &Exchange{Request: e}
+			xs = append(xs, x)
+			pending[e.Tag] = x
+			continue
+		}
+		if x, ok := pending[e.Tag]; ok {
+			x.Response = e
+			delete(pending, e.Tag)
+		}
+	}
+
+	var done []*Exchange
+	for _, x := range xs {
+		if x.Response != nil {
+			done = append(done, x)
+		}
+	}
+	return done
+}
+
+// withoutTag returns the JSON encoding of m without its tag, for comparing
+// messages of different sessions.
+func withoutTag(m protocol.Message) ([]byte, error) {
+	if m == nil {
+		return nil, nil
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return nil, err
+	}
+	delete(fields, "Tag")
+	return json.Marshal(fields)
+}
+
+// Mismatch is a replayed request that got a response different from the
+// recorded one.
+type Mismatch struct {
+	Exchange *Exchange
+	Response protocol.Message
+	Error    error
+}
+
+// Replay sends the recorded requests of a session to h one at a time, and
+// returns the responses that differ from the recording, ignoring tags. h may
+// be a *g9p.Client to replay a session against a remote server. Note that
+// qid paths and times often differ between runs, and are reported too.
+func Replay(h g9p.Handler, xs []*Exchange) ([]Mismatch, error) {
+	var mismatches []Mismatch
+	for _, x := range xs {
+		resp, err := send(h, x.Request.Message)
+
+		same := false
+		switch {
+		case err != nil || x.Response.Error != "":
+			same = err != nil && err.Error() == x.Response.Error
+		default:
+			got, err := withoutTag(resp)
+			if err != nil {
+				return nil, err
+			}
+			want, err := withoutTag(x.Response.Message)
+			if err != nil {
+				return nil, err
+			}
+			same = bytes.Equal(got, want)
+		}
+		if !same {
+			mismatches = append(mismatches, Mismatch{Exchange: x, Response: resp, Error: err})
+		}
+	}
+	return mismatches, nil
+}
+
+// send sends req to h, and returns a nil interface rather than a nil pointer
+// for failed requests.
+func send(h g9p.Handler, req protocol.Message) (protocol.Message, error) {
+	var (
+		resp protocol.Message
+		err  error
+	)
+	switch r := req.(type) {
+	case *protocol.VersionRequest:
+		resp, err = h.Version(r)
+	case *protocol.AuthRequest:
+		resp, err = h.Auth(r)
+	case *protocol.AttachRequest:
+		resp, err = h.Attach(r)
+	case *protocol.FlushRequest:
+		resp, err = h.Flush(r)
+	case *protocol.WalkRequest:
+		resp, err = h.Walk(r)
+	case *protocol.OpenRequest:
+		resp, err = h.Open(r)
+	case *protocol.CreateRequest:
+		resp, err = h.Create(r)
+	case *protocol.ReadRequest:
+		resp, err = h.Read(r)
+	case *protocol.WriteRequest:
+		resp, err = h.Write(r)
+	case *protocol.ClunkRequest:
+		resp, err = h.Clunk(r)
+	case *protocol.RemoveRequest:
+		resp, err = h.Remove(r)
+	case *protocol.StatRequest:
+		resp, err = h.Stat(r)
+	case *protocol.WriteStatRequest:
+		resp, err = h.WriteStat(r)
+	default:
+		return nil, errors.New("unknown request type")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// Player answers requests with the responses of a recording, allowing a
+// client to be tested against a recorded server. A request is answered with
+// the response to the first unused recorded request equal to it, ignoring
+// tags, and fails if there is none.
+type Player struct {
+	sync.Mutex
+	xs   []*Exchange
+	used []bool
+}
+
+func (p *Player) Handle(ctx context.Context, req protocol.Message, next fileserver.Next) (protocol.Message, error) {
+	b, err := withoutTag(req)
+	if err != nil {
+		return nil, err
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	for i, x := range p.xs {
+		if p.used[i] || x.Request.Type != typeName(req) {
+			continue
+		}
+		rb, err := withoutTag(x.Request.Message)
+		if err != nil || !bytes.Equal(b, rb) {
+			continue
+		}
+
+		p.used[i] = true
+		if x.Response.Error != "" {
+			return nil, errors.New(x.Response.Error)
+		}
+		return withTag(x.Response.Message, req.GetTag()), nil
+	}
+	return nil, errors.New("request not in recording")
+}
+
+// withTag returns a copy of m with the given tag.
+func withTag(m protocol.Message, tag protocol.Tag) protocol.Message {
+	v := reflect.New(reflect.TypeOf(m).Elem())
+	v.Elem().Set(reflect.ValueOf(m).Elem())
+	if f := v.Elem().FieldByName("Tag"); f.IsValid() && f.CanSet() {
+		f.Set(reflect.ValueOf(tag))
+	}
+	return v.Interface().(protocol.Message)
+}
+
+// Handler returns a handler for a session served by p. As p answers all
+// requests itself, there is no backend.
+func (p *Player) Handler() g9p.Handler {
+	return fileserver.Intercept(context.Background(), nil, p)
+}
+
+// NewPlayer returns a Player answering with the responses of xs.
+func NewPlayer(xs []*Exchange) *Player {
+	return &Player{xs: xs, used: make([]bool, len(xs))}
+}
@@ -0,0 +1,95 @@
+package sectree
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+)
+
+const (
+	// KeyIterations is the PBKDF2 iteration count used to derive the store
+	// key from the passphrase.
+	KeyIterations = 100000
+
+	keySize  = 32
+	saltSize = 16
+)
+
+var ErrDecrypt = errors.New("decryption failed")
+
+// pbkdf2 implements PBKDF2 with HMAC-SHA256 as described in RFC 2898.
+func pbkdf2(password, salt []byte, iter, size int) []byte {
+	prf := hmac.New(sha256.New, password)
+	hlen := prf.Size()
+	blocks := (size + hlen - 1) / hlen
+
+	var out []byte
+	buf := make([]byte, 4)
+	for block := 1; block <= blocks; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		buf[0] = byte(block >> 24)
+		buf[1] = byte(block >> 16)
+		buf[2] = byte(block >> 8)
+		buf[3] = byte(block)
+		prf.Write(buf)
+		u := prf.Sum(nil)
+		t := append([]byte(nil), u...)
+		for i := 1; i < iter; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		out = append(out, t...)
+	}
+	return out[:size]
+}
+
+func deriveKey(passphrase string, salt []byte) []byte {
+	return pbkdf2([]byte(passphrase), salt, KeyIterations, keySize)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts plaintext with AES-GCM. The name is authenticated along with
+// the content, so that encrypted files cannot be swapped undetected.
+func seal(key []byte, name string, plaintext []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, []byte(name)), nil
+}
+
+// unseal is the inverse of seal.
+func unseal(key []byte, name string, ciphertext []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, ErrDecrypt
+	}
+	nonce := ciphertext[:aead.NonceSize()]
+	b, err := aead.Open(nil, nonce, ciphertext[aead.NonceSize():], []byte(name))
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return b, nil
+}
@@ -0,0 +1,152 @@
+package sectree
+
+import (
+	"crypto/rand"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	saltFile  = ".salt"
+	checkFile = ".check"
+	checkText = "secstore"
+)
+
+var (
+	ErrBadPassphrase = errors.New("bad passphrase")
+	ErrBadName       = errors.New("invalid secret name")
+)
+
+// Store is a directory of files encrypted at rest. Every file is encrypted
+// with a key derived from a single passphrase, and plaintext never touches
+// the disk.
+type Store struct {
+	sync.Mutex
+	path string
+	salt []byte
+}
+
+func validName(name string) bool {
+	return name != "" && !strings.HasPrefix(name, ".") && !strings.ContainsAny(name, "/\\")
+}
+
+// Key derives the store key from a passphrase. The first passphrase used
+// with an empty store becomes the passphrase of the store; afterwards, the
+// passphrase is verified.
+func (s *Store) Key(passphrase string) ([]byte, error) {
+	key := deriveKey(passphrase, s.salt)
+
+	s.Lock()
+	defer s.Unlock()
+	check := filepath.Join(s.path, checkFile)
+	b, err := ioutil.ReadFile(check)
+	if os.IsNotExist(err) {
+		b, err = seal(key, checkFile, []byte(checkText))
+		if err != nil {
+			return nil, err
+		}
+		if err := writeFile(check, b); err != nil {
+			return nil, err
+		}
+		return key, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := unseal(key, checkFile, b); err != nil {
+		return nil, ErrBadPassphrase
+	}
+	return key, nil
+}
+
+// List returns the names of the stored files.
+func (s *Store) List() ([]string, error) {
+	s.Lock()
+	defer s.Unlock()
+	fis, err := ioutil.ReadDir(s.path)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, fi := range fis {
+		if fi.Mode().IsRegular() && validName(fi.Name()) {
+			names = append(names, fi.Name())
+		}
+	}
+	return names, nil
+}
+
+// Get decrypts a stored file.
+func (s *Store) Get(key []byte, name string) ([]byte, error) {
+	if !validName(name) {
+		return nil, ErrBadName
+	}
+	s.Lock()
+	defer s.Unlock()
+	b, err := ioutil.ReadFile(filepath.Join(s.path, name))
+	if err != nil {
+		return nil, err
+	}
+	return unseal(key, name, b)
+}
+
+// Put encrypts and stores a file, replacing any previous content.
+func (s *Store) Put(key []byte, name string, content []byte) error {
+	if !validName(name) {
+		return ErrBadName
+	}
+	b, err := seal(key, name, content)
+	if err != nil {
+		return err
+	}
+	s.Lock()
+	defer s.Unlock()
+	return writeFile(filepath.Join(s.path, name), b)
+}
+
+// Remove deletes a stored file.
+func (s *Store) Remove(name string) error {
+	if !validName(name) {
+		return ErrBadName
+	}
+	s.Lock()
+	defer s.Unlock()
+	return os.Remove(filepath.Join(s.path, name))
+}
+
+// writeFile atomically replaces the file at path. The temporary file is
+// hidden, so that it is never mistaken for a stored file.
+func writeFile(path string, b []byte) error {
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// NewStore opens the store at path, creating it if necessary.
+func NewStore(path string) (*Store, error) {
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return nil, err
+	}
+
+	saltPath := filepath.Join(path, saltFile)
+	salt, err := ioutil.ReadFile(saltPath)
+	if os.IsNotExist(err) {
+		salt = make([]byte, saltSize)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+		if err := writeFile(saltPath, salt); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &Store{path: path, salt: salt}, nil
+}
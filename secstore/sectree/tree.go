@@ -0,0 +1,181 @@
+package sectree
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+	"github.com/kennylevinsen/g9ptools/ramfs/ramtree"
+)
+
+var ErrLocked = errors.New("secstore locked")
+
+// SecTree is the view of a Store from a single connection. It starts out
+// locked, containing only a ctl file. Writing "unlock passphrase" to ctl
+// authenticates the connection and makes the secrets visible, and "lock"
+// hides them again. Secrets are decrypted into memory when opened, and
+// encrypted again when a written file is closed.
+type SecTree struct {
+	*ramtree.RAMTree
+	sync.Mutex
+	user  string
+	group string
+	store *Store
+	key   []byte
+}
+
+func (t *SecTree) getKey() ([]byte, error) {
+	t.Lock()
+	defer t.Unlock()
+	if t.key == nil {
+		return nil, ErrLocked
+	}
+	return t.key, nil
+}
+
+func (t *SecTree) secret(name string) *ramtree.SyntheticFile {
+	read := func(string) ([]byte, error) {
+		key, err := t.getKey()
+		if err != nil {
+			return nil, err
+		}
+		return t.store.Get(key, name)
+	}
+	commit := func(_ string, content []byte) error {
+		key, err := t.getKey()
+		if err != nil {
+			return err
+		}
+		return t.store.Put(key, name, content)
+	}
+	return ramtree.NewBufferFile(name, 0600, t.user, t.group, read, commit)
+}
+
+func (t *SecTree) unlock(passphrase string) error {
+	key, err := t.store.Key(passphrase)
+	if err != nil {
+		return err
+	}
+	names, err := t.store.List()
+	if err != nil {
+		return err
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	if t.key != nil {
+		return nil
+	}
+	for _, name := range names {
+		if err := t.RAMTree.Add(name, t.secret(name)); err != nil {
+			return err
+		}
+	}
+	t.key = key
+	return nil
+}
+
+func (t *SecTree) lock() {
+	t.Lock()
+	defer t.Unlock()
+	for i := range t.key {
+		t.key[i] = 0
+	}
+	t.key = nil
+	for _, name := range t.RAMTree.Names() {
+		if name != "ctl" {
+			t.RAMTree.Delete(name)
+		}
+	}
+}
+
+func (t *SecTree) readCtl(string) ([]byte, error) {
+	if _, err := t.getKey(); err != nil {
+		return []byte("locked\n"), nil
+	}
+	return []byte("unlocked\n"), nil
+}
+
+func (t *SecTree) writeCtl(_ string, p []byte) (int, error) {
+	cmd := strings.TrimRight(string(p), "\n")
+	var arg string
+	if idx := strings.Index(cmd, " "); idx != -1 {
+		arg = cmd[idx+1:]
+		cmd = cmd[:idx]
+	}
+
+	switch cmd {
+	case "unlock":
+		if arg == "" {
+			return 0, errors.New("usage: unlock passphrase")
+		}
+		if err := t.unlock(arg); err != nil {
+			return 0, err
+		}
+	case "lock":
+		t.lock()
+	default:
+		return 0, fmt.Errorf("unknown ctl command: %s", cmd)
+	}
+	return len(p), nil
+}
+
+// Create creates a new, empty secret.
+func (t *SecTree) Create(user, name string, perms protocol.FileMode) (fileserver.File, error) {
+	if perms&protocol.DMDIR != 0 {
+		return nil, errors.New("cannot create directories in secstore")
+	}
+	if user != t.user {
+		return nil, fileserver.ErrPermission
+	}
+	key, err := t.getKey()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := t.store.Get(key, name); err == nil {
+		return nil, errors.New("file already exists")
+	}
+	if err := t.store.Put(key, name, nil); err != nil {
+		return nil, err
+	}
+	f := t.secret(name)
+	if err := t.RAMTree.Add(name, f); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Remove removes a secret from the store.
+func (t *SecTree) Remove(user, name string) error {
+	if user != t.user || name == "ctl" {
+		return fileserver.ErrPermission
+	}
+	if _, err := t.getKey(); err != nil {
+		return err
+	}
+	if err := t.store.Remove(name); err != nil {
+		return err
+	}
+	return t.RAMTree.Delete(name)
+}
+
+// Rename is not permitted, as the name of a secret is bound to its
+// encryption.
+func (t *SecTree) Rename(user, oldname, newname string) error {
+	return fileserver.ErrPermission
+}
+
+// NewSecTree returns a new, locked view of the store.
+func NewSecTree(store *Store, user, group string) *SecTree {
+	t := &SecTree{
+		RAMTree: ramtree.NewRAMTree("/", 0700, user, group),
+		user:    user,
+		group:   group,
+		store:   store,
+	}
+	t.RAMTree.Add("ctl", ramtree.NewCallbackFile("ctl", 0600, user, group, t.readCtl, t.writeCtl))
+	return t
+}
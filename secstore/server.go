@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/kennylevinsen/g9p"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+	"github.com/kennylevinsen/g9ptools/secstore/sectree"
+	"github.com/kennylevinsen/g9ptools/transport"
+)
+
+func main() {
+	if len(os.Args) < 6 {
+		fmt.Printf("Too few arguments\n")
+		fmt.Printf("%s path service UID GID address\n", os.Args[0])
+		fmt.Printf("UID and GID are the user/group that owns /\n")
+		fmt.Printf("address is a dial string, such as :5640, or stdio to serve a single session on standard input and output\n")
+		return
+	}
+
+	path := os.Args[1]
+	service := os.Args[2]
+	user := os.Args[3]
+	group := os.Args[4]
+	addr := os.Args[5]
+
+	store, err := sectree.NewStore(path)
+	if err != nil {
+		log.Fatalf("Unable to open store: %v", err)
+	}
+
+	l, err := transport.ListenDialString(addr)
+	if err != nil {
+		log.Fatalf("Unable to listen: %v", err)
+	}
+
+	// Every connection must unlock the store on its own.
+	h := func() g9p.Handler {
+		m := make(map[string]fileserver.Dir)
+		m[service] = sectree.NewSecTree(store, user, group)
+		return fileserver.NewFileServer(nil, m, 10*1024*1024, fileserver.Chatty)
+	}
+
+	log.Printf("Starting secstore at %s", addr)
+	transport.Ready()
+	g9p.ServeListener(l, h)
+}
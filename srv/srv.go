@@ -0,0 +1,472 @@
+package srv
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kennylevinsen/g9p"
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/proxy"
+	"github.com/kennylevinsen/g9ptools/transport"
+)
+
+// A connection to the broker either starts with a line-based command, or is a
+// 9P client session. The commands are:
+//
+//	post <name>	the connection is posted under name, and the broker
+//			becomes a 9P client on it.
+//	list		the broker replies with the posted names, one per line.
+//
+// 9P clients select a posted connection with the attach name, which is of the
+// form "name" or "name/aname", where aname is passed on to the posted server.
+
+var (
+	ErrNotAttached = errors.New("not attached")
+	ErrNoSuchSrv   = errors.New("no such srv")
+	ErrSrvExists   = errors.New("srv already exists")
+)
+
+// Broker keeps a registry of posted 9P connections.
+type Broker struct {
+	sync.RWMutex
+	srvs map[string]*proxy.Upstream
+}
+
+func (b *Broker) post(name string, conn net.Conn) error {
+	b.Lock()
+	if _, ok := b.srvs[name]; ok {
+		b.Unlock()
+		return ErrSrvExists
+	}
+	b.srvs[name] = nil
+	b.Unlock()
+
+	up, err := proxy.NewUpstream(&watchConn{Conn: conn, onErr: func() { b.remove(name) }})
+	if err != nil {
+		b.remove(name)
+		return err
+	}
+
+	b.Lock()
+	b.srvs[name] = up
+	b.Unlock()
+	return nil
+}
+
+func (b *Broker) remove(name string) {
+	b.Lock()
+	defer b.Unlock()
+	if _, ok := b.srvs[name]; ok {
+		log.Printf("Removing srv %s", name)
+		delete(b.srvs, name)
+	}
+}
+
+func (b *Broker) lookup(name string) (*proxy.Upstream, error) {
+	b.RLock()
+	defer b.RUnlock()
+	up := b.srvs[name]
+	if up == nil {
+		return nil, ErrNoSuchSrv
+	}
+	return up, nil
+}
+
+// List returns the names of all posted connections.
+func (b *Broker) List() []string {
+	b.RLock()
+	defer b.RUnlock()
+	var names []string
+	for k, v := range b.srvs {
+		if v != nil {
+			names = append(names, k)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// HandshakeTimeout is how long a new connection may take to send its first
+// bytes, and the line of a command, before it is dropped.
+const HandshakeTimeout = 10 * time.Second
+
+// Listener wraps l, handling broker commands on incoming connections and only
+// yielding the connections of 9P clients. Connections are sorted on their own
+// goroutines, so that one sending nothing does not hold up the others.
+func (b *Broker) Listener(l net.Listener) net.Listener {
+	return &brokerListener{
+		Listener: l,
+		b:        b,
+		conns:    make(chan net.Conn),
+		done:     make(chan struct{}),
+	}
+}
+
+// Handler returns a handler constructor for 9P clients of the broker.
+func (b *Broker) Handler() func() g9p.Handler {
+	return func() g9p.Handler {
+		return &handler{b: b}
+	}
+}
+
+type brokerListener struct {
+	net.Listener
+	b     *Broker
+	once  sync.Once
+	conns chan net.Conn
+	done  chan struct{}
+	err   error
+}
+
+// run accepts connections until the listener fails, which ends Accept.
+func (l *brokerListener) run() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			l.err = err
+			close(l.done)
+			return
+		}
+		go l.sort(conn)
+	}
+}
+
+// sort runs the command of a connection, or hands it to Accept if it is a
+// 9P client.
+func (l *brokerListener) sort(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(HandshakeTimeout))
+	br := bufio.NewReader(conn)
+	peek, err := br.Peek(4)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	bc := &bufferedConn{Conn: conn, r: br}
+	switch string(peek) {
+	case "post", "list":
+		// The deadline is left for command to clear once it has read
+		// the line.
+		l.b.command(bc)
+	default:
+		conn.SetReadDeadline(time.Time{})
+		select {
+		case l.conns <- bc:
+		case <-l.done:
+			conn.Close()
+		}
+	}
+}
+
+func (l *brokerListener) Accept() (net.Conn, error) {
+	l.once.Do(func() { go l.run() })
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+func (b *Broker) command(conn net.Conn) {
+	line, err := readLine(conn)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	switch {
+	case line == "list":
+		for _, n := range b.List() {
+			fmt.Fprintf(conn, "%s\n", n)
+		}
+		conn.Close()
+	case strings.HasPrefix(line, "post "):
+		name := strings.TrimSpace(line[5:])
+		if name == "" || strings.Contains(name, "/") {
+			fmt.Fprintf(conn, "error invalid name\n")
+			conn.Close()
+			return
+		}
+		if _, err := fmt.Fprintf(conn, "ok\n"); err != nil {
+			conn.Close()
+			return
+		}
+		if err := b.post(name, conn); err != nil {
+			log.Printf("Post of %s failed: %v", name, err)
+			conn.Close()
+			return
+		}
+		log.Printf("Posted srv %s", name)
+	default:
+		fmt.Fprintf(conn, "error unknown command\n")
+		conn.Close()
+	}
+}
+
+// handler binds a client session to a posted connection on its first attach.
+type handler struct {
+	sync.Mutex
+	b       *Broker
+	name    string
+	version *protocol.VersionRequest
+	s       *proxy.Session
+}
+
+func (h *handler) session() (*proxy.Session, error) {
+	h.Lock()
+	defer h.Unlock()
+	if h.s == nil {
+		return nil, ErrNotAttached
+	}
+	return h.s, nil
+}
+
+func (h *handler) Version(r *protocol.VersionRequest) (*protocol.VersionResponse, error) {
+	h.Lock()
+	h.version = r
+	s := h.s
+	h.Unlock()
+
+	if s != nil {
+		return s.Version(r)
+	}
+
+	maxSize := r.MaxSize
+	if maxSize > proxy.DefaultMaxSize {
+		maxSize = proxy.DefaultMaxSize
+	}
+	proto := proxy.Version
+	if r.Version != proxy.Version {
+		proto = "unknown"
+	}
+	return &protocol.VersionResponse{
+		MaxSize: maxSize,
+		Version: proto,
+	}, nil
+}
+
+func (h *handler) Auth(r *protocol.AuthRequest) (*protocol.AuthResponse, error) {
+	return nil, fmt.Errorf("auth not supported")
+}
+
+func (h *handler) Attach(r *protocol.AttachRequest) (*protocol.AttachResponse, error) {
+	name, aname := r.Service, ""
+	if idx := strings.Index(name, "/"); idx != -1 {
+		name, aname = name[:idx], name[idx+1:]
+	}
+
+	h.Lock()
+	if h.s != nil && h.name != name {
+		h.Unlock()
+		return nil, errors.New("session already attached to another srv")
+	}
+	if h.s == nil {
+		up, err := h.b.lookup(name)
+		if err != nil {
+			h.Unlock()
+			return nil, err
+		}
+		h.s = proxy.NewSession(up, proxy.Rules{})
+		h.name = name
+		if h.version != nil {
+			h.s.Version(h.version)
+		}
+	}
+	s := h.s
+	h.Unlock()
+
+	nr := *r
+	nr.Service = aname
+	return s.Attach(&nr)
+}
+
+func (h *handler) Flush(r *protocol.FlushRequest) (*protocol.FlushResponse, error) {
+	s, err := h.session()
+	if err != nil {
+		return &protocol.FlushResponse{}, nil
+	}
+	return s.Flush(r)
+}
+
+func (h *handler) Walk(r *protocol.WalkRequest) (*protocol.WalkResponse, error) {
+	s, err := h.session()
+	if err != nil {
+		return nil, err
+	}
+	return s.Walk(r)
+}
+
+func (h *handler) Open(r *protocol.OpenRequest) (*protocol.OpenResponse, error) {
+	s, err := h.session()
+	if err != nil {
+		return nil, err
+	}
+	return s.Open(r)
+}
+
+func (h *handler) Create(r *protocol.CreateRequest) (*protocol.CreateResponse, error) {
+	s, err := h.session()
+	if err != nil {
+		return nil, err
+	}
+	return s.Create(r)
+}
+
+func (h *handler) Read(r *protocol.ReadRequest) (*protocol.ReadResponse, error) {
+	s, err := h.session()
+	if err != nil {
+		return nil, err
+	}
+	return s.Read(r)
+}
+
+func (h *handler) Write(r *protocol.WriteRequest) (*protocol.WriteResponse, error) {
+	s, err := h.session()
+	if err != nil {
+		return nil, err
+	}
+	return s.Write(r)
+}
+
+func (h *handler) Clunk(r *protocol.ClunkRequest) (*protocol.ClunkResponse, error) {
+	s, err := h.session()
+	if err != nil {
+		return nil, err
+	}
+	return s.Clunk(r)
+}
+
+func (h *handler) Remove(r *protocol.RemoveRequest) (*protocol.RemoveResponse, error) {
+	s, err := h.session()
+	if err != nil {
+		return nil, err
+	}
+	return s.Remove(r)
+}
+
+func (h *handler) Stat(r *protocol.StatRequest) (*protocol.StatResponse, error) {
+	s, err := h.session()
+	if err != nil {
+		return nil, err
+	}
+	return s.Stat(r)
+}
+
+func (h *handler) WriteStat(r *protocol.WriteStatRequest) (*protocol.WriteStatResponse, error) {
+	s, err := h.session()
+	if err != nil {
+		return nil, err
+	}
+	return s.WriteStat(r)
+}
+
+// Post dials a broker, as by transport.Dial, and posts a 9P server under name.
+// The server is served on the broker connection until it is closed.
+func Post(network, address, name string, h func() g9p.Handler) error {
+	conn, err := transport.Dial(network, address)
+	if err != nil {
+		return err
+	}
+
+	if _, err := fmt.Fprintf(conn, "post %s\n", name); err != nil {
+		conn.Close()
+		return err
+	}
+	line, err := readLine(conn)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	if line != "ok" {
+		conn.Close()
+		return errors.New(strings.TrimPrefix(line, "error "))
+	}
+
+	g9p.ServeListener(transport.NewConnListener(conn), h)
+	return nil
+}
+
+// List dials a broker and returns the posted names.
+func List(network, address string) ([]string, error) {
+	conn, err := transport.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if _, err := fmt.Fprintf(conn, "list\n"); err != nil {
+		return nil, err
+	}
+
+	var names []string
+	s := bufio.NewScanner(conn)
+	for s.Scan() {
+		names = append(names, s.Text())
+	}
+	return names, s.Err()
+}
+
+func NewBroker() *Broker {
+	return &Broker{
+		srvs: make(map[string]*proxy.Upstream),
+	}
+}
+
+// readLine reads a single line without buffering beyond it, as the rest of
+// the connection is 9P.
+func readLine(r io.Reader) (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for len(line) < 1024 {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", err
+		}
+		if b[0] == '\n' {
+			return string(line), nil
+		}
+		line = append(line, b[0])
+	}
+	return "", errors.New("line too long")
+}
+
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// watchConn calls onErr once the connection fails.
+type watchConn struct {
+	net.Conn
+	once  sync.Once
+	onErr func()
+}
+
+func (c *watchConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if err != nil {
+		c.once.Do(c.onErr)
+	}
+	return n, err
+}
+
+func (c *watchConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if err != nil {
+		c.once.Do(c.onErr)
+	}
+	return n, err
+}
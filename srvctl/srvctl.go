@@ -0,0 +1,125 @@
+package srvctl
+
+import (
+	"sync"
+
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+	"github.com/kennylevinsen/g9ptools/fileserver/ctl"
+	"github.com/kennylevinsen/g9ptools/ramfs/ramtree"
+)
+
+// Service is the conventional service name of the tree.
+const Service = "srvctl"
+
+// Command handles a ctl message. The first field of the message, as split by
+// ctl.Tokenize, selects the command, and the remaining fields are passed as
+// arguments.
+type Command func(args []string) error
+
+// Tree is a control filesystem for a server process. Writing to ctl runs the
+// registered commands, and reading it lists them. Reading status, df and
+// sessions returns the output of the status, df and sessions functions, if
+// set.
+type Tree struct {
+	*ramtree.RAMTree
+	sync.RWMutex
+	ctl      *ctl.Parser
+	status   func() string
+	df       func() string
+	sessions func() string
+}
+
+// Handle registers a command. It fails if name is already registered.
+func (t *Tree) Handle(name string, cmd Command) error {
+	return t.ctl.Register(ctl.Command{
+		Name:    name,
+		MaxArgs: -1,
+		Run: func(_ string, args []string) error {
+			return cmd(args)
+		},
+	})
+}
+
+// SetStatus sets the function producing the content of the status file.
+func (t *Tree) SetStatus(status func() string) {
+	t.Lock()
+	defer t.Unlock()
+	t.status = status
+}
+
+// SetDF sets the function producing the content of the df file, which
+// describes the space used by the served file systems.
+func (t *Tree) SetDF(df func() string) {
+	t.Lock()
+	defer t.Unlock()
+	t.df = df
+}
+
+// SetSessions sets the function producing the content of the sessions file,
+// which describes the sessions of the server and their fids.
+func (t *Tree) SetSessions(sessions func() string) {
+	t.Lock()
+	defer t.Unlock()
+	t.sessions = sessions
+}
+
+// Ctl runs a ctl message, one command per line.
+func (t *Tree) Ctl(msg string) error {
+	_, err := t.ctl.Write("", []byte(msg))
+	return err
+}
+
+func (t *Tree) readCtl(string) ([]byte, error) {
+	return []byte(t.ctl.Usage()), nil
+}
+
+func (t *Tree) writeCtl(user string, p []byte) (int, error) {
+	return t.ctl.Write(user, p)
+}
+
+func (t *Tree) readStatus(string) ([]byte, error) {
+	t.RLock()
+	status := t.status
+	t.RUnlock()
+	if status == nil {
+		return nil, nil
+	}
+	return []byte(status()), nil
+}
+
+func (t *Tree) readDF(string) ([]byte, error) {
+	t.RLock()
+	df := t.df
+	t.RUnlock()
+	if df == nil {
+		return nil, nil
+	}
+	return []byte(df()), nil
+}
+
+func (t *Tree) readSessions(string) ([]byte, error) {
+	t.RLock()
+	sessions := t.sessions
+	t.RUnlock()
+	if sessions == nil {
+		return nil, nil
+	}
+	return []byte(sessions()), nil
+}
+
+func (t *Tree) Create(user, name string, perms protocol.FileMode) (fileserver.File, error) {
+	return nil, fileserver.ErrPermission
+}
+
+func NewTree(user, group string) *Tree {
+	t := &Tree{
+		RAMTree: ramtree.NewRAMTree("/", 0550, user, group),
+		ctl:     ctl.NewParser(),
+	}
+	t.RAMTree.Add("ctl", ramtree.NewCallbackFile("ctl", 0660, user, group, t.readCtl, t.writeCtl))
+	t.RAMTree.Add("status", ramtree.NewCallbackFile("status", 0440, user, group, t.readStatus, nil))
+	t.RAMTree.Add("df", ramtree.NewCallbackFile("df", 0440, user, group, t.readDF, nil))
+	t.RAMTree.Add("sessions", ramtree.NewCallbackFile("sessions", 0440, user, group, t.readSessions, nil))
+	return t
+}
@@ -0,0 +1,15 @@
+package transport
+
+import "net"
+
+// Dial is like net.Dial, but also supports the "ssh" network, as dialed by
+// DialSSH, and the "npipe" network of DialPipe.
+func Dial(network, address string) (net.Conn, error) {
+	switch network {
+	case "ssh":
+		return DialSSH(address)
+	case "npipe":
+		return DialPipe(address)
+	}
+	return net.Dial(network, address)
+}
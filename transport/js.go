@@ -0,0 +1,184 @@
+//go:build js && wasm
+// +build js,wasm
+
+package transport
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"syscall/js"
+	"time"
+)
+
+var errNoDeadlines = errors.New("deadlines not supported")
+
+// jsConn is a connection over a JavaScript object passing messages, such as
+// a MessagePort or a WebSocket. Each message carries a chunk of the 9P byte
+// stream, so message boundaries need not match 9P messages.
+type jsConn struct {
+	sync.Mutex
+	cond   *sync.Cond
+	buf    []byte
+	closed bool
+	send   func(js.Value)
+	close  func()
+	funcs  []js.Func
+	remote net.Addr
+}
+
+func newJSConn(remote string, send func(js.Value), close func()) *jsConn {
+	c := &jsConn{send: send, close: close, remote: addr(remote)}
+	c.cond = sync.NewCond(&c.Mutex)
+	return c
+}
+
+// bytesOf copies the content of an ArrayBuffer or typed array.
+func bytesOf(v js.Value) []byte {
+	u8 := js.Global().Get("Uint8Array").New(v)
+	b := make([]byte, u8.Get("length").Int())
+	js.CopyBytesToGo(b, u8)
+	return b
+}
+
+// handle registers fn as the handler of an event of obj.
+func (c *jsConn) handle(obj js.Value, event string, fn func(js.Value)) {
+	f := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		fn(args[0])
+		return nil
+	})
+	c.funcs = append(c.funcs, f)
+	obj.Set("on"+event, f)
+}
+
+func (c *jsConn) receive(ev js.Value) {
+	b := bytesOf(ev.Get("data"))
+	c.Lock()
+	defer c.Unlock()
+	c.buf = append(c.buf, b...)
+	c.cond.Broadcast()
+}
+
+// hangup marks the connection as closed by the remote end. Data already
+// received can still be read.
+func (c *jsConn) hangup(js.Value) {
+	c.Lock()
+	defer c.Unlock()
+	c.closed = true
+	c.cond.Broadcast()
+}
+
+func (c *jsConn) Read(p []byte) (int, error) {
+	c.Lock()
+	defer c.Unlock()
+	for len(c.buf) == 0 && !c.closed {
+		c.cond.Wait()
+	}
+	if len(c.buf) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+func (c *jsConn) Write(p []byte) (int, error) {
+	c.Lock()
+	closed := c.closed
+	c.Unlock()
+	if closed {
+		return 0, io.ErrClosedPipe
+	}
+
+	u8 := js.Global().Get("Uint8Array").New(len(p))
+	js.CopyBytesToJS(u8, p)
+	c.send(u8)
+	return len(p), nil
+}
+
+func (c *jsConn) Close() error {
+	c.Lock()
+	if c.funcs == nil {
+		c.Unlock()
+		return nil
+	}
+	c.closed = true
+	funcs := c.funcs
+	c.funcs = nil
+	c.cond.Broadcast()
+	c.Unlock()
+
+	c.close()
+	for _, f := range funcs {
+		f.Release()
+	}
+	return nil
+}
+
+func (c *jsConn) LocalAddr() net.Addr  { return addr("js") }
+func (c *jsConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *jsConn) SetDeadline(t time.Time) error      { return errNoDeadlines }
+func (c *jsConn) SetReadDeadline(t time.Time) error  { return errNoDeadlines }
+func (c *jsConn) SetWriteDeadline(t time.Time) error { return errNoDeadlines }
+
+// MessagePortConn returns a connection over a MessagePort, such as one end
+// of a MessageChannel shared with a worker running the other end. Messages
+// are Uint8Arrays.
+func MessagePortConn(port js.Value) net.Conn {
+	c := newJSConn("messageport",
+		func(v js.Value) { port.Call("postMessage", v) },
+		func() { port.Call("close") })
+	c.handle(port, "message", c.receive)
+	port.Call("start")
+	return c
+}
+
+// WebSocketConn returns a connection over an open WebSocket, sending each
+// write as a binary message.
+func WebSocketConn(ws js.Value) net.Conn {
+	c := newJSConn(ws.Get("url").String(),
+		func(v js.Value) { ws.Call("send", v) },
+		func() { ws.Call("close") })
+	ws.Set("binaryType", "arraybuffer")
+	c.handle(ws, "message", c.receive)
+	c.handle(ws, "close", c.hangup)
+	return c
+}
+
+// DialWebSocket opens a WebSocket to url, and returns a connection over it
+// once it is open.
+func DialWebSocket(url string) (net.Conn, error) {
+	ws := js.Global().Get("WebSocket").New(url)
+	// Callbacks must not block, and only the first outcome counts.
+	result := make(chan error, 1)
+	report := func(err error) {
+		select {
+		case result <- err:
+		default:
+		}
+	}
+	onOpen := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		report(nil)
+		return nil
+	})
+	onError := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		report(errors.New("unable to open websocket"))
+		return nil
+	})
+	ws.Set("onopen", onOpen)
+	ws.Set("onerror", onError)
+	defer func() {
+		ws.Set("onopen", js.Null())
+		ws.Set("onerror", js.Null())
+		onOpen.Release()
+		onError.Release()
+	}()
+
+	if err := <-result; err != nil {
+		ws.Call("close")
+		return nil, err
+	}
+	return WebSocketConn(ws), nil
+}
@@ -0,0 +1,107 @@
+package transport
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/kennylevinsen/g9p"
+)
+
+// ParseDialString converts a Plan 9 style dial string, such as
+// "tcp!*!564", "tcp!localhost!5640", "unix!/tmp/ramfs", "vsock!*!564" or
+// `npipe!\\.\pipe\ramfs`, into a network and address suitable for Listen and
+// Dial. "stdio" is the standard input and output, "systemd!name" is a
+// socket passed by systemd, as described by ListenActivated, and
+// "ssh!glenda@host!command" runs command on host, as described by DialSSH.
+// Other strings without a '!' are taken to be TCP addresses.
+func ParseDialString(s string) (string, string, error) {
+	parts := strings.Split(s, "!")
+	switch {
+	case s == "stdio":
+		return "stdio", "", nil
+	case parts[0] == "systemd" && len(parts) <= 2:
+		return "systemd", strings.TrimPrefix(strings.TrimPrefix(s, "systemd"), "!"), nil
+	case parts[0] == "ssh" && len(parts) > 1 && parts[1] != "":
+		return "ssh", strings.TrimPrefix(s, "ssh!"), nil
+	case len(parts) == 1:
+		return "tcp", s, nil
+	case (parts[0] == "unix" || parts[0] == "npipe") && len(parts) == 2:
+		return parts[0], parts[1], nil
+	case len(parts) == 3:
+		host := parts[1]
+		if host == "*" {
+			host = ""
+		}
+		return parts[0], net.JoinHostPort(host, parts[2]), nil
+	default:
+		return "", "", fmt.Errorf("malformed dial string %q", s)
+	}
+}
+
+// Listen is like net.Listen, but removes stale unix sockets left behind by
+// previous processes. A socket is only removed if nothing answers on it.
+// It also supports the "vsock" network, as listened on by ListenVsock, the
+// "npipe" network of ListenPipe, the "systemd" network of ListenActivated,
+// and the "stdio" network, which yields the single connection of StdioConn.
+func Listen(network, address string) (net.Listener, error) {
+	switch network {
+	case "vsock":
+		return ListenVsock(address)
+	case "stdio":
+		return NewConnListener(StdioConn()), nil
+	case "systemd":
+		return ListenActivated(address)
+	case "npipe":
+		return ListenPipe(address)
+	case "unix":
+		if fi, err := os.Stat(address); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			conn, err := net.DialTimeout("unix", address, time.Second)
+			if err == nil {
+				conn.Close()
+				return nil, fmt.Errorf("%s is in use", address)
+			}
+			os.Remove(address)
+		}
+	}
+	return net.Listen(network, address)
+}
+
+// ListenDialString listens on the endpoint of a Plan 9 style dial string,
+// as parsed by ParseDialString. This includes "stdio", which serves a single
+// session on the standard input and output, as used by inetd, systemd socket
+// activation with Accept=yes, SSH forced commands and subsystems, and pipes.
+func ListenDialString(s string) (net.Listener, error) {
+	network, address, err := ParseDialString(s)
+	if err != nil {
+		return nil, err
+	}
+	return Listen(network, address)
+}
+
+// Serve accepts connections on l, and serves each with the handler produced
+// for it, like g9p.ServeListener, but letting the handler know about its
+// connection, such as for the remote address. Handlers implementing
+// io.Closer are closed when their connection ends. It returns when l fails
+// to accept.
+func Serve(l net.Listener, h func(net.Conn) g9p.Handler) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go ServeConn(conn, h(conn))
+	}
+}
+
+// ServeConn serves a single connection with h, returning when the
+// connection ends. If h implements io.Closer, it is then closed.
+func ServeConn(conn net.Conn, h g9p.Handler) {
+	g9p.ServeListener(NewConnListener(conn), func() g9p.Handler { return h })
+	if c, ok := h.(io.Closer); ok {
+		c.Close()
+	}
+}
@@ -0,0 +1,72 @@
+package transport
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+var ErrListenerClosed = errors.New("listener closed")
+
+// ConnListener is a net.Listener that yields a single, already established
+// connection. It allows serving a connection with g9p.ServeListener. Once the
+// connection has been accepted, Accept blocks until either the connection or
+// the listener is closed.
+type ConnListener struct {
+	sync.Mutex
+	conn   net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (l *ConnListener) Accept() (net.Conn, error) {
+	l.Lock()
+	c := l.conn
+	l.conn = nil
+	l.Unlock()
+
+	if c != nil {
+		return &listenerConn{Conn: c, l: l}, nil
+	}
+
+	<-l.closed
+	return nil, ErrListenerClosed
+}
+
+func (l *ConnListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *ConnListener) Addr() net.Addr {
+	l.Lock()
+	defer l.Unlock()
+	if l.conn != nil {
+		return l.conn.LocalAddr()
+	}
+	return addr("conn")
+}
+
+func NewConnListener(conn net.Conn) *ConnListener {
+	return &ConnListener{
+		conn:   conn,
+		closed: make(chan struct{}),
+	}
+}
+
+type addr string
+
+func (a addr) Network() string { return string(a) }
+func (a addr) String() string  { return string(a) }
+
+// listenerConn closes its listener when closed.
+type listenerConn struct {
+	net.Conn
+	l *ConnListener
+}
+
+func (c *listenerConn) Close() error {
+	err := c.Conn.Close()
+	c.l.Close()
+	return err
+}
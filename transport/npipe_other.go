@@ -0,0 +1,21 @@
+//go:build !windows
+// +build !windows
+
+package transport
+
+import (
+	"errors"
+	"net"
+)
+
+var errNoPipes = errors.New("named pipes are only supported on Windows")
+
+// ListenPipe is only supported on Windows.
+func ListenPipe(path string) (net.Listener, error) {
+	return nil, errNoPipes
+}
+
+// DialPipe is only supported on Windows.
+func DialPipe(path string) (net.Conn, error) {
+	return nil, errNoPipes
+}
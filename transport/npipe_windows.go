@@ -0,0 +1,28 @@
+//go:build windows
+// +build windows
+
+package transport
+
+import (
+	"net"
+	"time"
+
+	"github.com/Microsoft/go-winio"
+)
+
+// ListenPipe listens on the Windows named pipe at path, such as
+// `\\.\pipe\ramfs`, serving local clients without opening a TCP port. The
+// pipe gets the default security descriptor, granting access to the owner
+// of the process, administrators and the local system.
+func ListenPipe(path string) (net.Listener, error) {
+	return winio.ListenPipe(path, &winio.PipeConfig{
+		InputBufferSize:  64 * 1024,
+		OutputBufferSize: 64 * 1024,
+	})
+}
+
+// DialPipe connects to the Windows named pipe at path.
+func DialPipe(path string) (net.Conn, error) {
+	timeout := 30 * time.Second
+	return winio.DialPipe(path, &timeout)
+}
@@ -0,0 +1,193 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/kennylevinsen/g9p"
+	"github.com/quic-go/quic-go"
+)
+
+// QUICProto is the ALPN protocol of 9P over QUIC.
+const QUICProto = "9p"
+
+func quicConfig() *quic.Config {
+	return &quic.Config{
+		MaxIdleTimeout:  time.Minute,
+		KeepAlivePeriod: 15 * time.Second,
+	}
+}
+
+// quicTLS returns config with QUICProto as the ALPN protocol, unless the
+// caller has chosen one.
+func quicTLS(config *tls.Config) *tls.Config {
+	config = config.Clone()
+	if len(config.NextProtos) == 0 {
+		config.NextProtos = []string{QUICProto}
+	}
+	return config
+}
+
+// ListenQUIC listens for QUIC connections at address with the given TLS
+// configuration. The returned listener accepts a net.Conn per stream opened
+// by a client, on any of its connections. Every stream thus carries a
+// separate 9P session, and a client can run several sessions over a single
+// connection without a lost packet of one stalling the others. QUIC support
+// is experimental.
+func ListenQUIC(address string, config *tls.Config) (net.Listener, error) {
+	ql, err := quic.ListenAddr(address, quicTLS(config), quicConfig())
+	if err != nil {
+		return nil, err
+	}
+
+	l := &quicListener{
+		l:     ql,
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+	go l.acceptConns()
+	return l, nil
+}
+
+type quicListener struct {
+	l     *quic.Listener
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+	err   error
+}
+
+func (l *quicListener) acceptConns() {
+	for {
+		c, err := l.l.Accept(context.Background())
+		if err != nil {
+			l.fail(err)
+			return
+		}
+		go l.acceptStreams(c)
+	}
+}
+
+func (l *quicListener) acceptStreams(c quic.Connection) {
+	for {
+		st, err := c.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		select {
+		case l.conns <- &quicConn{Stream: st, c: c}:
+		case <-l.done:
+			st.CancelRead(0)
+			st.Close()
+			return
+		}
+	}
+}
+
+// fail stops the listener, making Accept return err.
+func (l *quicListener) fail(err error) {
+	l.once.Do(func() {
+		l.err = err
+		close(l.done)
+	})
+}
+
+func (l *quicListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+func (l *quicListener) Close() error {
+	l.fail(ErrListenerClosed)
+	return l.l.Close()
+}
+
+func (l *quicListener) Addr() net.Addr {
+	return l.l.Addr()
+}
+
+// quicConn is a stream of a QUIC connection.
+type quicConn struct {
+	quic.Stream
+	c quic.Connection
+}
+
+func (c *quicConn) LocalAddr() net.Addr  { return c.c.LocalAddr() }
+func (c *quicConn) RemoteAddr() net.Addr { return c.c.RemoteAddr() }
+
+// ConnectionState returns the TLS state of the connection of the stream.
+func (c *quicConn) ConnectionState() tls.ConnectionState {
+	return c.c.ConnectionState().TLS
+}
+
+// Close ends the stream in both directions. Closing a QUIC stream only ends
+// the sending side, so reading is cancelled as well.
+func (c *quicConn) Close() error {
+	c.Stream.CancelRead(0)
+	return c.Stream.Close()
+}
+
+// ServeQUIC serves the streams accepted from a listener returned by
+// ListenQUIC like ServeTLS serves connections, with the handler produced
+// for each stream and the TLS state of its connection.
+func ServeQUIC(l net.Listener, h func(net.Conn, tls.ConnectionState) (g9p.Handler, error)) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			var state tls.ConnectionState
+			if qc, ok := conn.(*quicConn); ok {
+				state = qc.ConnectionState()
+			}
+
+			handler, err := h(conn, state)
+			if err != nil {
+				log.Printf("Rejecting %s: %v", conn.RemoteAddr(), err)
+				conn.Close()
+				return
+			}
+
+			ServeConn(conn, handler)
+		}()
+	}
+}
+
+// QUICSession is a QUIC connection to a server, each stream of which is a
+// 9P session.
+type QUICSession struct {
+	c quic.Connection
+}
+
+// DialQUIC connects to the QUIC listener at address.
+func DialQUIC(address string, config *tls.Config) (*QUICSession, error) {
+	c, err := quic.DialAddr(context.Background(), address, quicTLS(config), quicConfig())
+	if err != nil {
+		return nil, err
+	}
+	return &QUICSession{c: c}, nil
+}
+
+// Open opens a stream for a new 9P session.
+func (s *QUICSession) Open() (net.Conn, error) {
+	st, err := s.c.OpenStreamSync(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return &quicConn{Stream: st, c: s.c}, nil
+}
+
+// Close closes the connection, ending all its sessions.
+func (s *QUICSession) Close() error {
+	return s.c.CloseWithError(0, "")
+}
@@ -0,0 +1,95 @@
+package transport
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// SSHSubsystem is the SSH subsystem run by DialSSH when no command is given.
+// A server is made available as the subsystem with a line like the
+// following in sshd_config, serving 9P on the standard input and output:
+//
+//	Subsystem 9p /usr/local/bin/exportfs / 9p glenda glenda stdio
+const SSHSubsystem = "9p"
+
+// DialSSH connects to a server by running a command on a remote host with
+// ssh(1), and speaking 9P over its standard input and output, as 9import
+// does. address is "destination!command", or just the destination to run
+// SSHSubsystem. The destination is anything ssh accepts, such as
+// "glenda@host", and authentication is left to ssh and its configuration.
+func DialSSH(address string) (net.Conn, error) {
+	dest, command := address, ""
+	if idx := strings.Index(address, "!"); idx != -1 {
+		dest, command = address[:idx], address[idx+1:]
+	}
+
+	if command == "" {
+		return DialCommand(dest, "ssh", "-T", "-s", dest, SSHSubsystem)
+	}
+	return DialCommand(dest, "ssh", "-T", dest, command)
+}
+
+// DialCommand starts a command and returns a connection to its standard
+// input and output, naming remote as the remote address. The standard error
+// of the command is that of the process. Closing the connection kills the
+// command.
+func DialCommand(remote, name string, args ...string) (net.Conn, error) {
+	inr, inw, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	outr, outw, err := os.Pipe()
+	if err != nil {
+		inr.Close()
+		inw.Close()
+		return nil, err
+	}
+
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = inr
+	cmd.Stdout = outw
+	cmd.Stderr = os.Stderr
+	err = cmd.Start()
+	inr.Close()
+	outw.Close()
+	if err != nil {
+		inw.Close()
+		outr.Close()
+		return nil, err
+	}
+	return &cmdConn{cmd: cmd, r: outr, w: inw, remote: addr(remote)}, nil
+}
+
+type cmdConn struct {
+	cmd    *exec.Cmd
+	r      *os.File
+	w      *os.File
+	remote net.Addr
+}
+
+func (c *cmdConn) Read(p []byte) (int, error)  { return c.r.Read(p) }
+func (c *cmdConn) Write(p []byte) (int, error) { return c.w.Write(p) }
+
+func (c *cmdConn) Close() error {
+	c.w.Close()
+	c.r.Close()
+	c.cmd.Process.Kill()
+	c.cmd.Wait()
+	return nil
+}
+
+func (c *cmdConn) LocalAddr() net.Addr  { return addr("cmd") }
+func (c *cmdConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *cmdConn) SetDeadline(t time.Time) error {
+	if err := c.r.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.w.SetWriteDeadline(t)
+}
+
+func (c *cmdConn) SetReadDeadline(t time.Time) error  { return c.r.SetReadDeadline(t) }
+func (c *cmdConn) SetWriteDeadline(t time.Time) error { return c.w.SetWriteDeadline(t) }
@@ -0,0 +1,44 @@
+package transport
+
+import (
+	"net"
+	"os"
+	"time"
+)
+
+// StdioConn returns a connection reading from the standard input and
+// writing to the standard output of the process. It serves a single client
+// on the other end of a pipe, such as a virtio-serial port of a guest, or a
+// QEMU stdio chardev, set up as the standard input and output.
+func StdioConn() net.Conn {
+	return &stdioConn{in: os.Stdin, out: os.Stdout}
+}
+
+type stdioConn struct {
+	in  *os.File
+	out *os.File
+}
+
+func (c *stdioConn) Read(p []byte) (int, error)  { return c.in.Read(p) }
+func (c *stdioConn) Write(p []byte) (int, error) { return c.out.Write(p) }
+
+func (c *stdioConn) Close() error {
+	err := c.in.Close()
+	if err2 := c.out.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+func (c *stdioConn) LocalAddr() net.Addr  { return addr("stdio") }
+func (c *stdioConn) RemoteAddr() net.Addr { return addr("stdio") }
+
+func (c *stdioConn) SetDeadline(t time.Time) error {
+	if err := c.in.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.out.SetWriteDeadline(t)
+}
+
+func (c *stdioConn) SetReadDeadline(t time.Time) error  { return c.in.SetReadDeadline(t) }
+func (c *stdioConn) SetWriteDeadline(t time.Time) error { return c.out.SetWriteDeadline(t) }
@@ -0,0 +1,144 @@
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The file descriptors passed by systemd socket activation start at 3.
+const listenFdsStart = 3
+
+var activation struct {
+	sync.Mutex
+	once      sync.Once
+	listeners map[string]net.Listener
+	order     []string
+	err       error
+}
+
+// activated takes over the sockets passed by systemd, as described by
+// sd_listen_fds(3). Sockets are named by LISTEN_FDNAMES, or by their index
+// if unnamed, and the environment variables are cleared so that child
+// processes do not take the sockets as theirs.
+func activated() error {
+	activation.once.Do(func() {
+		defer func() {
+			os.Unsetenv("LISTEN_PID")
+			os.Unsetenv("LISTEN_FDS")
+			os.Unsetenv("LISTEN_FDNAMES")
+		}()
+
+		activation.listeners = make(map[string]net.Listener)
+		pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+		if err != nil || pid != os.Getpid() {
+			return
+		}
+		n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+		if err != nil || n <= 0 {
+			return
+		}
+		names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+		for i := 0; i < n; i++ {
+			name := strconv.Itoa(i)
+			if i < len(names) && names[i] != "" && names[i] != "unknown" {
+				name = names[i]
+			}
+			f := os.NewFile(uintptr(listenFdsStart+i), name)
+			l, err := net.FileListener(f)
+			f.Close()
+			if err != nil {
+				activation.err = fmt.Errorf("activated socket %s: %v", name, err)
+				return
+			}
+			activation.listeners[name] = l
+			activation.order = append(activation.order, name)
+		}
+	})
+	return activation.err
+}
+
+// ListenActivated returns the listener of a socket passed by systemd socket
+// activation, with the name given by FileDescriptorName= in the socket
+// unit, or its index among the passed sockets. An empty name is the first
+// socket. Each socket can only be taken once. Sockets of units with
+// Accept=yes are connections rather than listeners, and are served as
+// "stdio" instead, with StandardInput=socket.
+func ListenActivated(name string) (net.Listener, error) {
+	if err := activated(); err != nil {
+		return nil, err
+	}
+
+	activation.Lock()
+	defer activation.Unlock()
+	if name == "" {
+		if len(activation.order) == 0 {
+			return nil, errors.New("no sockets passed by systemd")
+		}
+		name = activation.order[0]
+	}
+	l, ok := activation.listeners[name]
+	if !ok {
+		return nil, fmt.Errorf("no socket %q passed by systemd", name)
+	}
+	delete(activation.listeners, name)
+	for i, n := range activation.order {
+		if n == name {
+			activation.order = append(activation.order[:i:i], activation.order[i+1:]...)
+			break
+		}
+	}
+	return l, nil
+}
+
+// Notify sends a state to the service manager, as described by
+// sd_notify(3), such as "READY=1" or "STOPPING=1". It does nothing if the
+// process is not run by a service manager that wants notifications.
+func Notify(state string) error {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+var watchdog sync.Once
+
+// Ready tells the service manager that the server is ready, and starts
+// sending the keep-alive pings of its watchdog, if WatchdogSec= is set for
+// the service. Servers call it once they serve their listeners.
+func Ready() {
+	if err := Notify("READY=1"); err != nil {
+		log.Printf("Unable to notify service manager: %v", err)
+	}
+	watchdog.Do(func() {
+		usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+		if err != nil || usec <= 0 {
+			return
+		}
+		if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+			return
+		}
+
+		// Pinging at half the interval leaves room for scheduling delays.
+		interval := time.Duration(usec) * time.Microsecond / 2
+		go func() {
+			for range time.Tick(interval) {
+				Notify("WATCHDOG=1")
+			}
+		}()
+	})
+}
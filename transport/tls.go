@@ -0,0 +1,73 @@
+package transport
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+
+	"github.com/kennylevinsen/g9p"
+)
+
+// TLSConfig returns a server configuration using the given certificate and
+// key. If caFile is set, clients must present a certificate signed by one of
+// the authorities in it.
+func TLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if caFile != "" {
+		b, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, errors.New("no certificates in CA file")
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return config, nil
+}
+
+// ServeTLS accepts TLS connections on l, and serves each with the handler
+// produced for the connection and the state of its handshake. This lets the
+// handler act on the identity of the client. Handlers implementing io.Closer
+// are closed when their connection ends. It returns when l fails to accept.
+func ServeTLS(l net.Listener, config *tls.Config, h func(net.Conn, tls.ConnectionState) (g9p.Handler, error)) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			tc := tls.Server(conn, config)
+			if err := tc.Handshake(); err != nil {
+				log.Printf("TLS handshake with %s failed: %v", conn.RemoteAddr(), err)
+				conn.Close()
+				return
+			}
+
+			handler, err := h(conn, tc.ConnectionState())
+			if err != nil {
+				log.Printf("Rejecting %s: %v", conn.RemoteAddr(), err)
+				tc.Close()
+				return
+			}
+
+			ServeConn(tc, handler)
+		}()
+	}
+}
@@ -0,0 +1,42 @@
+package transport
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// VsockAnyCID binds a vsock listener to any context ID of the machine.
+const VsockAnyCID = ^uint32(0)
+
+// VsockAddr is the address of an AF_VSOCK endpoint. The host is context ID
+// 2, and guests have the context IDs assigned to them by the hypervisor.
+type VsockAddr struct {
+	CID  uint32
+	Port uint32
+}
+
+func (a *VsockAddr) Network() string { return "vsock" }
+func (a *VsockAddr) String() string  { return fmt.Sprintf("%d:%d", a.CID, a.Port) }
+
+// parseVsockAddr parses "cid:port". An empty or "*" context ID is
+// VsockAnyCID.
+func parseVsockAddr(address string) (*VsockAddr, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	p, err := strconv.ParseUint(port, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid vsock port %q", port)
+	}
+	a := &VsockAddr{CID: VsockAnyCID, Port: uint32(p)}
+	if host != "" && host != "*" {
+		cid, err := strconv.ParseUint(host, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid vsock context ID %q", host)
+		}
+		a.CID = uint32(cid)
+	}
+	return a, nil
+}
@@ -0,0 +1,95 @@
+//go:build linux
+// +build linux
+
+package transport
+
+import (
+	"net"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// ListenVsock listens for AF_VSOCK connections at address, given as
+// "cid:port", such as ":564" for port 564 of any context ID. It lets a
+// hypervisor host serve its guests, or a guest serve its host, without a
+// network between them.
+func ListenVsock(address string) (net.Listener, error) {
+	a, err := parseVsockAddr(address)
+	if err != nil {
+		return nil, err
+	}
+
+	fd, err := unix.Socket(unix.AF_VSOCK, unix.SOCK_STREAM|unix.SOCK_CLOEXEC|unix.SOCK_NONBLOCK, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Bind(fd, &unix.SockaddrVM{CID: a.CID, Port: a.Port}); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	if err := unix.Listen(fd, unix.SOMAXCONN); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+
+	// The socket is non-blocking, so the file is registered with the
+	// runtime poller, and Accept does not tie up a thread.
+	f := os.NewFile(uintptr(fd), "vsock")
+	rc, err := f.SyscallConn()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &vsockListener{f: f, rc: rc, addr: a}, nil
+}
+
+type vsockListener struct {
+	f    *os.File
+	rc   syscall.RawConn
+	addr *VsockAddr
+}
+
+func (l *vsockListener) Accept() (net.Conn, error) {
+	var (
+		nfd  int
+		sa   unix.Sockaddr
+		aerr error
+	)
+	err := l.rc.Read(func(fd uintptr) bool {
+		nfd, sa, aerr = unix.Accept4(int(fd), unix.SOCK_CLOEXEC|unix.SOCK_NONBLOCK)
+		return aerr != unix.EAGAIN
+	})
+	if err != nil {
+		return nil, err
+	}
+	if aerr != nil {
+		return nil, aerr
+	}
+
+	remote := &VsockAddr{}
+	if vm, ok := sa.(*unix.SockaddrVM); ok {
+		remote.CID, remote.Port = vm.CID, vm.Port
+	}
+	return &vsockConn{File: os.NewFile(uintptr(nfd), "vsock"), local: l.addr, remote: remote}, nil
+}
+
+func (l *vsockListener) Close() error {
+	return l.f.Close()
+}
+
+func (l *vsockListener) Addr() net.Addr {
+	return l.addr
+}
+
+// vsockConn is an accepted vsock connection. The file provides reads,
+// writes and deadlines through the runtime poller.
+type vsockConn struct {
+	*os.File
+	local  *VsockAddr
+	remote *VsockAddr
+}
+
+func (c *vsockConn) LocalAddr() net.Addr  { return c.local }
+func (c *vsockConn) RemoteAddr() net.Addr { return c.remote }
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package transport
+
+import (
+	"errors"
+	"net"
+)
+
+// ListenVsock is only supported on Linux.
+func ListenVsock(address string) (net.Listener, error) {
+	return nil, errors.New("vsock is not supported on this platform")
+}
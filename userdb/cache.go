@@ -0,0 +1,64 @@
+package userdb
+
+import (
+	"sync"
+	"time"
+
+	"github.com/kennylevinsen/g9ptools/fileserver"
+)
+
+// Cache remembers the answers of a slow database, such as LDAP, for a while.
+// Failed lookups are not remembered.
+type Cache struct {
+	sync.Mutex
+	db      fileserver.UserDB
+	ttl     time.Duration
+	entries map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	exists  bool
+	groups  []string
+	expires time.Time
+}
+
+// NewCache returns a Cache remembering answers of db for ttl.
+func NewCache(db fileserver.UserDB, ttl time.Duration) *Cache {
+	return &Cache{db: db, ttl: ttl, entries: make(map[string]cacheEntry)}
+}
+
+func (c *Cache) lookup(user string) (cacheEntry, error) {
+	c.Lock()
+	e, ok := c.entries[user]
+	c.Unlock()
+	if ok && time.Now().Before(e.expires) {
+		return e, nil
+	}
+
+	exists, err := c.db.Exists(user)
+	if err != nil {
+		return e, err
+	}
+	var groups []string
+	if exists {
+		if groups, err = c.db.Groups(user); err != nil {
+			return e, err
+		}
+	}
+	e = cacheEntry{exists: exists, groups: groups, expires: time.Now().Add(c.ttl)}
+
+	c.Lock()
+	defer c.Unlock()
+	c.entries[user] = e
+	return e, nil
+}
+
+func (c *Cache) Exists(user string) (bool, error) {
+	e, err := c.lookup(user)
+	return e.exists, err
+}
+
+func (c *Cache) Groups(user string) ([]string, error) {
+	e, err := c.lookup(user)
+	return e.groups, err
+}
@@ -0,0 +1,85 @@
+// Package userdb implements user databases, which tell the fileserver what
+// users exist and what groups they are members of.
+package userdb
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// File is a static user database in the format of the Plan 9 users file.
+// Every non-empty line not starting with '#' describes a user, which is also
+// a group:
+//
+//	id:name:leader:members
+//
+// The members are a comma-separated list of the users in the group, which
+// also includes the leader, if any. The id is ignored.
+type File struct {
+	users  map[string]bool
+	groups map[string][]string
+}
+
+// Parse parses a users file.
+func Parse(r io.Reader) (*File, error) {
+	f := &File{
+		users:  make(map[string]bool),
+		groups: make(map[string][]string),
+	}
+	s := bufio.NewScanner(r)
+	line := 0
+	for s.Scan() {
+		line++
+		l := strings.TrimSpace(s.Text())
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		fields := strings.Split(l, ":")
+		if len(fields) != 4 || fields[1] == "" {
+			return nil, fmt.Errorf("line %d: expected id:name:leader:members", line)
+		}
+		name, leader := fields[1], fields[2]
+		if f.users[name] {
+			return nil, fmt.Errorf("line %d: duplicate user %s", line, name)
+		}
+		f.users[name] = true
+
+		members := map[string]bool{}
+		if leader != "" {
+			members[leader] = true
+		}
+		for _, m := range strings.Split(fields[3], ",") {
+			if m = strings.TrimSpace(m); m != "" {
+				members[m] = true
+			}
+		}
+		for m := range members {
+			f.groups[m] = append(f.groups[m], name)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Load reads a users file.
+func Load(path string) (*File, error) {
+	r, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return Parse(r)
+}
+
+func (f *File) Exists(user string) (bool, error) {
+	return f.users[user], nil
+}
+
+func (f *File) Groups(user string) ([]string, error) {
+	return f.groups[user], nil
+}
@@ -0,0 +1,83 @@
+package userdb
+
+import (
+	"fmt"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// LDAP looks up users and groups in an LDAP directory. Every lookup uses a
+// connection of its own, so it should be wrapped in a Cache.
+type LDAP struct {
+	// URL is the address of the server, such as ldaps://ldap.example.com.
+	URL string
+	// BindDN and BindPassword are the credentials to bind with. If BindDN
+	// is empty, the directory is searched anonymously.
+	BindDN       string
+	BindPassword string
+	// BaseDN is the base of all searches.
+	BaseDN string
+	// UserFilter finds the entry of a user, with the user name in place of
+	// %s. It defaults to (uid=%s).
+	UserFilter string
+	// GroupFilter finds the groups of a user, with the user name in place of
+	// %s. It defaults to (memberUid=%s).
+	GroupFilter string
+	// GroupAttr is the attribute holding the name of a group. It defaults to
+	// cn.
+	GroupAttr string
+}
+
+func (l *LDAP) search(filter, user string, attrs []string) ([]*ldap.Entry, error) {
+	conn, err := ldap.DialURL(l.URL)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if l.BindDN != "" {
+		if err := conn.Bind(l.BindDN, l.BindPassword); err != nil {
+			return nil, err
+		}
+	}
+	req := ldap.NewSearchRequest(l.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		fmt.Sprintf(filter, ldap.EscapeFilter(user)), attrs, nil)
+	res, err := conn.Search(req)
+	if err != nil {
+		return nil, err
+	}
+	return res.Entries, nil
+}
+
+func (l *LDAP) Exists(user string) (bool, error) {
+	filter := l.UserFilter
+	if filter == "" {
+		filter = "(uid=%s)"
+	}
+	entries, err := l.search(filter, user, []string{"dn"})
+	if err != nil {
+		return false, err
+	}
+	return len(entries) > 0, nil
+}
+
+func (l *LDAP) Groups(user string) ([]string, error) {
+	filter := l.GroupFilter
+	if filter == "" {
+		filter = "(memberUid=%s)"
+	}
+	attr := l.GroupAttr
+	if attr == "" {
+		attr = "cn"
+	}
+	entries, err := l.search(filter, user, []string{attr})
+	if err != nil {
+		return nil, err
+	}
+	var groups []string
+	for _, e := range entries {
+		if g := e.GetAttributeValue(attr); g != "" {
+			groups = append(groups, g)
+		}
+	}
+	return groups, nil
+}
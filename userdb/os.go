@@ -0,0 +1,39 @@
+package userdb
+
+import "os/user"
+
+// OS looks up users and groups in the user database of the host, such as
+// /etc/passwd and /etc/group.
+type OS struct{}
+
+func (OS) Exists(name string) (bool, error) {
+	_, err := user.Lookup(name)
+	if _, ok := err.(user.UnknownUserError); ok {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (OS) Groups(name string) ([]string, error) {
+	u, err := user.Lookup(name)
+	if _, ok := err.(user.UnknownUserError); ok {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	gids, err := u.GroupIds()
+	if err != nil {
+		return nil, err
+	}
+	var groups []string
+	for _, gid := range gids {
+		g, err := user.LookupGroupId(gid)
+		if err != nil {
+			// Groups without a name cannot be referred to by files.
+			continue
+		}
+		groups = append(groups, g.Name)
+	}
+	return groups, nil
+}
@@ -0,0 +1,44 @@
+package userdb
+
+import (
+	"sync"
+
+	"github.com/kennylevinsen/g9ptools/fileserver"
+)
+
+// Replaceable is a database whose backend can be replaced while it is in
+// use, such as when a configuration is reloaded. Without a backend, every
+// user exists and is a member of no groups.
+type Replaceable struct {
+	sync.RWMutex
+	db fileserver.UserDB
+}
+
+// Replace makes db the backend, which may be nil.
+func (r *Replaceable) Replace(db fileserver.UserDB) {
+	r.Lock()
+	defer r.Unlock()
+	r.db = db
+}
+
+func (r *Replaceable) backend() fileserver.UserDB {
+	r.RLock()
+	defer r.RUnlock()
+	return r.db
+}
+
+func (r *Replaceable) Exists(user string) (bool, error) {
+	db := r.backend()
+	if db == nil {
+		return true, nil
+	}
+	return db.Exists(user)
+}
+
+func (r *Replaceable) Groups(user string) ([]string, error) {
+	db := r.backend()
+	if db == nil {
+		return nil, nil
+	}
+	return db.Groups(user)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/kennylevinsen/g9p"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+	"github.com/kennylevinsen/g9ptools/transport"
+	"github.com/kennylevinsen/g9ptools/ventifs/ventitree"
+)
+
+func main() {
+	gc := flag.Duration("gc", 0, "collect unreferenced blobs at this interval, in addition to on request")
+	flag.Parse()
+
+	if flag.NArg() < 4 {
+		fmt.Printf("Too few arguments\n")
+		fmt.Printf("%s [-gc interval] service UID GID address\n", os.Args[0])
+		fmt.Printf("UID and GID are the user/group that owns / and may use ctl\n")
+		fmt.Printf("address is a dial string, such as :5640, or stdio to serve a single session on standard input and output\n")
+		return
+	}
+
+	service := flag.Arg(0)
+	user := flag.Arg(1)
+	group := flag.Arg(2)
+	addr := flag.Arg(3)
+
+	root := ventitree.NewVentiTree(user, group)
+	if *gc > 0 {
+		go func() {
+			for range time.Tick(*gc) {
+				if n, freed := root.Store().GC(); n > 0 {
+					log.Printf("Collected %d blobs, %d bytes", n, freed)
+				}
+			}
+		}()
+	}
+
+	l, err := transport.ListenDialString(addr)
+	if err != nil {
+		log.Fatalf("Unable to listen: %v", err)
+	}
+
+	h := func() g9p.Handler {
+		m := make(map[string]fileserver.Dir)
+		m[service] = root
+		return fileserver.NewFileServer(nil, m, 10*1024*1024, fileserver.Chatty)
+	}
+
+	log.Printf("Starting ventifs at %s", addr)
+	transport.Ready()
+	g9p.ServeListener(l, h)
+}
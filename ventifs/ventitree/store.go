@@ -0,0 +1,173 @@
+package ventitree
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"sync"
+)
+
+var (
+	ErrNoBlob       = errors.New("no such blob")
+	ErrUnreferenced = errors.New("blob not referenced")
+	errInvalidScore = errors.New("invalid score")
+)
+
+// Score is the SHA-256 of the content of a blob, by which it is addressed.
+type Score [sha256.Size]byte
+
+// ParseScore parses the hexadecimal form of a score, as returned by String.
+func ParseScore(s string) (Score, error) {
+	var sc Score
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != len(sc) {
+		return sc, errInvalidScore
+	}
+	copy(sc[:], b)
+	return sc, nil
+}
+
+func (sc Score) String() string {
+	return hex.EncodeToString(sc[:])
+}
+
+// blob is a stored piece of content. The data is never modified.
+type blob struct {
+	data []byte
+	refs int
+	file *blobFile
+}
+
+// Store holds blobs by their score, so that content stored several times is
+// only held once. Storing a blob adds a reference to it, as does Ref, and
+// Unref drops one. Blobs that lose their last reference are kept until the
+// next GC, so that they may be referenced again in the meantime.
+type Store struct {
+	sync.Mutex
+	blobs map[Score]*blob
+	bytes int64
+	// newFile returns the file serving a blob, which is made once per blob
+	// so that its qid stays the same.
+	newFile func(sc Score, data []byte) *blobFile
+}
+
+// Put stores data, returning its score.
+func (s *Store) Put(data []byte) Score {
+	sc := Score(sha256.Sum256(data))
+	s.Lock()
+	defer s.Unlock()
+	b, ok := s.blobs[sc]
+	if !ok {
+		data = append([]byte(nil), data...)
+		b = &blob{data: data}
+		if s.newFile != nil {
+			b.file = s.newFile(sc, data)
+		}
+		s.blobs[sc] = b
+		s.bytes += int64(len(data))
+	}
+	b.refs++
+	return sc
+}
+
+// Get returns the content of a blob.
+func (s *Store) Get(sc Score) ([]byte, error) {
+	s.Lock()
+	defer s.Unlock()
+	b, ok := s.blobs[sc]
+	if !ok {
+		return nil, ErrNoBlob
+	}
+	return b.data, nil
+}
+
+// Ref adds a reference to a blob.
+func (s *Store) Ref(sc Score) error {
+	s.Lock()
+	defer s.Unlock()
+	b, ok := s.blobs[sc]
+	if !ok {
+		return ErrNoBlob
+	}
+	b.refs++
+	return nil
+}
+
+// Unref drops a reference to a blob.
+func (s *Store) Unref(sc Score) error {
+	s.Lock()
+	defer s.Unlock()
+	b, ok := s.blobs[sc]
+	if !ok {
+		return ErrNoBlob
+	}
+	if b.refs == 0 {
+		return ErrUnreferenced
+	}
+	b.refs--
+	return nil
+}
+
+// GC removes the blobs without references, returning how many were removed
+// and the number of bytes they held. Open blob files keep serving their
+// content.
+func (s *Store) GC() (int, int64) {
+	s.Lock()
+	defer s.Unlock()
+	var n int
+	var freed int64
+	for sc, b := range s.blobs {
+		if b.refs == 0 {
+			delete(s.blobs, sc)
+			n++
+			freed += int64(len(b.data))
+		}
+	}
+	s.bytes -= freed
+	return n, freed
+}
+
+// Stats returns the number of blobs in the store, the number of bytes they
+// hold, and the number of blobs awaiting collection.
+func (s *Store) Stats() (int, int64, int) {
+	s.Lock()
+	defer s.Unlock()
+	var unreferenced int
+	for _, b := range s.blobs {
+		if b.refs == 0 {
+			unreferenced++
+		}
+	}
+	return len(s.blobs), s.bytes, unreferenced
+}
+
+// Scores returns the scores of all blobs, in order.
+func (s *Store) Scores() []Score {
+	s.Lock()
+	defer s.Unlock()
+	scores := make([]Score, 0, len(s.blobs))
+	for sc := range s.blobs {
+		scores = append(scores, sc)
+	}
+	sort.Slice(scores, func(i, j int) bool {
+		return bytes.Compare(scores[i][:], scores[j][:]) < 0
+	})
+	return scores
+}
+
+// file returns the file serving a blob.
+func (s *Store) file(sc Score) (*blobFile, error) {
+	s.Lock()
+	defer s.Unlock()
+	b, ok := s.blobs[sc]
+	if !ok || b.file == nil {
+		return nil, ErrNoBlob
+	}
+	return b.file, nil
+}
+
+func NewStore() *Store {
+	return &Store{blobs: make(map[Score]*blob)}
+}
@@ -0,0 +1,254 @@
+// Package ventitree serves a content-addressed store of immutable blobs, in
+// the manner of Venti. Content is stored by writing it to /ingest, which
+// may be opened for reading and writing so that the score of what was
+// written can be read back once the writes are done:
+//
+//	ingest	writing stores a blob, reading returns its score
+//	blob/	the blobs, named by score
+//	ctl	"ref score", "unref score" and "gc"
+//	stats	the number of blobs, bytes and unreferenced blobs
+//
+// Identical content is stored once. Every ingest adds a reference to the
+// blob, and blobs without references are removed by gc.
+package ventitree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+	"github.com/kennylevinsen/g9ptools/fileserver/ctl"
+	"github.com/kennylevinsen/g9ptools/fileserver/templatefs"
+	"github.com/kennylevinsen/g9ptools/ramfs/ramtree"
+)
+
+var errNothingWritten = errors.New("nothing written")
+
+// VentiTree is the root of the store.
+type VentiTree struct {
+	templatefs.DirBase
+	store *Store
+}
+
+// Store returns the store served by the tree.
+func (t *VentiTree) Store() *Store {
+	return t.store
+}
+
+// ctl returns the parser of the commands of the ctl file.
+func (t *VentiTree) ctl() *ctl.Parser {
+	p := ctl.NewParser()
+	p.Register(ctl.Command{
+		Name: "gc",
+		Run: func(string, []string) error {
+			t.store.GC()
+			return nil
+		},
+	})
+	p.Register(ctl.Command{
+		Name:    "ref",
+		Usage:   "ref score",
+		MinArgs: 1,
+		MaxArgs: 1,
+		Run: func(_ string, args []string) error {
+			sc, err := ParseScore(args[0])
+			if err != nil {
+				return err
+			}
+			return t.store.Ref(sc)
+		},
+	})
+	p.Register(ctl.Command{
+		Name:    "unref",
+		Usage:   "unref score",
+		MinArgs: 1,
+		MaxArgs: 1,
+		Run: func(_ string, args []string) error {
+			sc, err := ParseScore(args[0])
+			if err != nil {
+				return err
+			}
+			return t.store.Unref(sc)
+		},
+	})
+	return p
+}
+
+func (t *VentiTree) stats(user string) ([]byte, error) {
+	blobs, n, unreferenced := t.store.Stats()
+	return []byte(fmt.Sprintf("blobs %d\nbytes %d\nunreferenced %d\n", blobs, n, unreferenced)), nil
+}
+
+// blobDir lists the blobs of the store.
+type blobDir struct {
+	templatefs.DirBase
+	store *Store
+}
+
+func (d *blobDir) Open(user string, mode protocol.OpenMode) (fileserver.OpenFile, error) {
+	if mode&3 != protocol.OREAD || mode&protocol.OTRUNC != 0 {
+		return nil, errors.New("directories can only be opened for reading")
+	}
+	if err := d.CheckOpen(user, mode); err != nil {
+		return nil, err
+	}
+	var stats []protocol.Stat
+	for _, sc := range d.store.Scores() {
+		f, err := d.store.file(sc)
+		if err != nil {
+			// Collected since listed.
+			continue
+		}
+		st, err := f.Stat()
+		if err != nil {
+			return nil, err
+		}
+		stats = append(stats, st)
+	}
+	return templatefs.NewListing(stats), nil
+}
+
+func (d *blobDir) Walk(user, name string) (fileserver.File, error) {
+	if !d.Allowed(user, protocol.OEXEC) {
+		return nil, templatefs.ErrPermission
+	}
+	sc, err := ParseScore(name)
+	if err != nil {
+		return nil, fileserver.ErrNotExist
+	}
+	f, err := d.store.file(sc)
+	if err != nil {
+		return nil, fileserver.ErrNotExist
+	}
+	return f, nil
+}
+
+func (d *blobDir) Remove(user, name string) error {
+	return templatefs.ErrPermission
+}
+
+func (d *blobDir) Rename(user, oldname, newname string) error {
+	return templatefs.ErrPermission
+}
+
+// blobFile is a read-only file serving a blob.
+type blobFile struct {
+	templatefs.FileBase
+	data []byte
+}
+
+func (f *blobFile) Stat() (protocol.Stat, error) {
+	st, err := f.FileBase.Stat()
+	st.Length = uint64(len(f.data))
+	return st, err
+}
+
+func (f *blobFile) WriteStat(st protocol.Stat) error {
+	return templatefs.ErrPermission
+}
+
+func (f *blobFile) Open(user string, mode protocol.OpenMode) (fileserver.OpenFile, error) {
+	if err := f.CheckOpen(user, mode); err != nil {
+		return nil, err
+	}
+	return templatefs.NewReader(f.data), nil
+}
+
+// ingestFile stores what is written to it.
+type ingestFile struct {
+	templatefs.FileBase
+	store *Store
+}
+
+func (f *ingestFile) Open(user string, mode protocol.OpenMode) (fileserver.OpenFile, error) {
+	if err := f.CheckOpen(user, mode); err != nil {
+		return nil, err
+	}
+	return &ingestOpenFile{store: f.store}, nil
+}
+
+// ingestOpenFile collects writes into a blob, which is stored when the file
+// is first read, or closed. Offsets are ignored, as writes append and reads
+// continue where the last ended. Reading serves the score of the blob, and
+// writing after reading starts a new blob.
+type ingestOpenFile struct {
+	sync.Mutex
+	store   *Store
+	buf     bytes.Buffer
+	written bool
+	score   *templatefs.Reader
+}
+
+func (of *ingestOpenFile) Seek(offset int64, whence int) (int64, error) {
+	return offset, nil
+}
+
+func (of *ingestOpenFile) Write(p []byte) (int, error) {
+	of.Lock()
+	defer of.Unlock()
+	of.score = nil
+	of.written = true
+	return of.buf.Write(p)
+}
+
+// commit stores the collected blob. Must be called with the file locked.
+func (of *ingestOpenFile) commit() Score {
+	sc := of.store.Put(of.buf.Bytes())
+	of.buf.Reset()
+	of.written = false
+	return sc
+}
+
+func (of *ingestOpenFile) Read(p []byte) (int, error) {
+	of.Lock()
+	defer of.Unlock()
+	if of.score == nil {
+		if !of.written {
+			return 0, errNothingWritten
+		}
+		of.score = templatefs.NewReader([]byte(of.commit().String() + "\n"))
+	}
+	return of.score.Read(p)
+}
+
+func (of *ingestOpenFile) Close() error {
+	of.Lock()
+	defer of.Unlock()
+	if of.written {
+		of.commit()
+	}
+	return nil
+}
+
+// NewVentiTree returns a tree serving an empty store, owned by user and
+// group. Anyone may ingest and read blobs, while only the owners may use
+// ctl.
+func NewVentiTree(user, group string) *VentiTree {
+	t := &VentiTree{store: NewStore()}
+	t.Init("/", 0555, user, group)
+
+	blobs := &blobDir{store: t.store}
+	blobs.Init("blob", 0555, user, group)
+	t.store.newFile = func(sc Score, data []byte) *blobFile {
+		f := &blobFile{data: data}
+		f.Init(sc.String(), 0444, user, group)
+		return f
+	}
+
+	ingest := &ingestFile{store: t.store}
+	ingest.Init("ingest", protocol.DMAPPEND|0666, user, group)
+
+	// The qid of the callback file is taken from the same counter as those
+	// of the other files.
+	stats := ramtree.NewCallbackFile("stats", 0444, user, group, t.stats, nil)
+	stats.SetID(templatefs.NextID())
+
+	t.Add(ingest)
+	t.Add(blobs)
+	t.Add(ctl.NewFile("ctl", 0660, user, group, t.ctl()))
+	t.Add(stats)
+	return t
+}
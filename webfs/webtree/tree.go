@@ -0,0 +1,362 @@
+package webtree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+	"github.com/kennylevinsen/g9ptools/ramfs/ramtree"
+)
+
+// WebTree implements the Plan 9 webfs interface. Opening clone allocates a
+// new connection directory, whose number can be read from the clone file.
+// The clone file then acts as the ctl file of the new connection. The
+// connection is torn down when the last file referencing it is closed.
+type WebTree struct {
+	*ramtree.RAMTree
+	sync.Mutex
+	user   string
+	group  string
+	client *http.Client
+	next   int
+}
+
+type conn struct {
+	sync.Mutex
+	id          int
+	t           *WebTree
+	dir         *ramtree.RAMTree
+	refs        int
+	url         *url.URL
+	baseurl     *url.URL
+	method      string
+	headers     http.Header
+	postbody    bytes.Buffer
+	contenttype string
+	resp        *http.Response
+	bodyOpened  bool
+}
+
+func (c *conn) ref() {
+	c.Lock()
+	defer c.Unlock()
+	c.refs++
+}
+
+func (c *conn) unref() {
+	c.Lock()
+	c.refs--
+	if c.refs > 0 {
+		c.Unlock()
+		return
+	}
+	if c.resp != nil {
+		c.resp.Body.Close()
+		c.resp = nil
+	}
+	c.Unlock()
+
+	c.t.RAMTree.Delete(strconv.Itoa(c.id))
+}
+
+func (c *conn) ctl(cmd string) error {
+	cmd = strings.TrimRight(cmd, "\n")
+	var arg string
+	if idx := strings.Index(cmd, " "); idx != -1 {
+		arg = strings.TrimSpace(cmd[idx+1:])
+		cmd = cmd[:idx]
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	switch cmd {
+	case "url":
+		u, err := url.Parse(arg)
+		if err != nil {
+			return err
+		}
+		if c.baseurl != nil {
+			u = c.baseurl.ResolveReference(u)
+		}
+		c.url = u
+	case "baseurl":
+		u, err := url.Parse(arg)
+		if err != nil {
+			return err
+		}
+		c.baseurl = u
+	case "request":
+		if arg == "" {
+			return errors.New("request needs a method")
+		}
+		c.method = strings.ToUpper(arg)
+	case "headers":
+		for _, line := range strings.Split(arg, "\n") {
+			idx := strings.Index(line, ":")
+			if idx == -1 {
+				return fmt.Errorf("malformed header: %s", line)
+			}
+			c.headers.Add(strings.TrimSpace(line[:idx]), strings.TrimSpace(line[idx+1:]))
+		}
+	case "useragent":
+		c.headers.Set("User-Agent", arg)
+	default:
+		return fmt.Errorf("unknown ctl command: %s", cmd)
+	}
+	return nil
+}
+
+// do performs the request described by the connection. It must be called
+// with the connection locked.
+func (c *conn) do() error {
+	if c.resp != nil {
+		return nil
+	}
+	if c.url == nil {
+		return errors.New("url not set")
+	}
+
+	method := c.method
+	if method == "" {
+		method = "GET"
+		if c.postbody.Len() > 0 {
+			method = "POST"
+		}
+	}
+
+	req, err := http.NewRequest(method, c.url.String(), bytes.NewReader(c.postbody.Bytes()))
+	if err != nil {
+		return err
+	}
+	for k, v := range c.headers {
+		req.Header[k] = v
+	}
+
+	resp, err := c.t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 400 {
+		resp.Body.Close()
+		return fmt.Errorf("%s", resp.Status)
+	}
+
+	c.resp = resp
+	c.url = resp.Request.URL
+	c.contenttype = resp.Header.Get("Content-Type")
+	return nil
+}
+
+func (c *conn) readID(string) ([]byte, error) {
+	return []byte(fmt.Sprintf("%d\n", c.id)), nil
+}
+
+func (c *conn) writeCtl(_ string, p []byte) (int, error) {
+	if err := c.ctl(string(p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *conn) writePostbody(_ string, p []byte) (int, error) {
+	c.Lock()
+	defer c.Unlock()
+	if c.resp != nil {
+		return 0, errors.New("request already sent")
+	}
+	return c.postbody.Write(p)
+}
+
+func (c *conn) readContentType(string) ([]byte, error) {
+	c.Lock()
+	defer c.Unlock()
+	return []byte(c.contenttype), nil
+}
+
+func (c *conn) readParsed(field string) ramtree.ReadFunc {
+	return func(string) ([]byte, error) {
+		c.Lock()
+		defer c.Unlock()
+		u := c.url
+		if u == nil {
+			return nil, nil
+		}
+		var s string
+		switch field {
+		case "url":
+			s = u.String()
+		case "scheme":
+			s = u.Scheme
+		case "user":
+			if u.User != nil {
+				s = u.User.Username()
+			}
+		case "pass":
+			if u.User != nil {
+				s, _ = u.User.Password()
+			}
+		case "host":
+			s = u.Hostname()
+		case "port":
+			s = u.Port()
+		case "path":
+			s = u.EscapedPath()
+		case "query":
+			s = u.RawQuery
+		case "fragment":
+			s = u.Fragment
+		}
+		return []byte(s), nil
+	}
+}
+
+// opener wraps an OpenFunc so that the handle holds a reference to the
+// connection for as long as it is open.
+func (c *conn) opener(open ramtree.OpenFunc) ramtree.OpenFunc {
+	return ramtree.RefOpener(open, c.ref, c.unref)
+}
+
+func (c *conn) openBody(user string, mode protocol.OpenMode) (fileserver.OpenFile, error) {
+	c.Lock()
+	defer c.Unlock()
+	if c.bodyOpened {
+		return nil, errors.New("body already opened")
+	}
+	if err := c.do(); err != nil {
+		return nil, err
+	}
+	c.bodyOpened = true
+	return &bodyOpenFile{r: c.resp.Body}, nil
+}
+
+// bodyOpenFile streams a response body. As the body can only be read once,
+// seeking anywhere but the current offset is an error.
+type bodyOpenFile struct {
+	sync.Mutex
+	r      io.Reader
+	offset int64
+}
+
+func (of *bodyOpenFile) Seek(offset int64, whence int) (int64, error) {
+	of.Lock()
+	defer of.Unlock()
+	switch whence {
+	case 0:
+	case 1:
+		offset = of.offset + offset
+	default:
+		return of.offset, errors.New("invalid whence value")
+	}
+
+	if offset != of.offset {
+		return of.offset, errors.New("seek on body illegal")
+	}
+	return of.offset, nil
+}
+
+func (of *bodyOpenFile) Read(p []byte) (int, error) {
+	of.Lock()
+	defer of.Unlock()
+	n, err := of.r.Read(p)
+	of.offset += int64(n)
+	if err == io.EOF {
+		// The fileserver discards data returned alongside io.EOF.
+		if n > 0 {
+			return n, nil
+		}
+		return 0, nil
+	}
+	return n, err
+}
+
+func (of *bodyOpenFile) Write(p []byte) (int, error) {
+	return 0, errors.New("cannot write to body")
+}
+
+func (of *bodyOpenFile) Close() error {
+	return nil
+}
+
+// Interrupt closes the body, as a read blocked on the network cannot be
+// woken up otherwise. The transfer is thus aborted, and later reads fail.
+func (of *bodyOpenFile) Interrupt() {
+	if c, ok := of.r.(io.Closer); ok {
+		c.Close()
+	}
+}
+
+func (t *WebTree) newConn() (*conn, error) {
+	t.Lock()
+	id := t.next
+	t.next++
+	t.Unlock()
+
+	c := &conn{
+		id:      id,
+		t:       t,
+		headers: make(http.Header),
+		dir:     ramtree.NewRAMTree(strconv.Itoa(id), 0555, t.user, t.group),
+	}
+
+	files := []*ramtree.SyntheticFile{
+		ramtree.NewSyntheticFile("ctl", 0666, t.user, t.group, c.opener(ramtree.CallbackOpener(c.readID, c.writeCtl))),
+		ramtree.NewSyntheticFile("body", 0444, t.user, t.group, c.opener(c.openBody)),
+		ramtree.NewSyntheticFile("postbody", 0222, t.user, t.group, c.opener(ramtree.CallbackOpener(nil, c.writePostbody))),
+		ramtree.NewSyntheticFile("contenttype", 0444, t.user, t.group, c.opener(ramtree.CallbackOpener(c.readContentType, nil))),
+	}
+	for _, f := range files {
+		n, _ := f.Name()
+		if err := c.dir.Add(n, f); err != nil {
+			return nil, err
+		}
+	}
+
+	parsed := ramtree.NewRAMTree("parsed", 0555, t.user, t.group)
+	for _, field := range []string{"url", "scheme", "user", "pass", "host", "port", "path", "query", "fragment"} {
+		f := ramtree.NewSyntheticFile(field, 0444, t.user, t.group, c.opener(ramtree.CallbackOpener(c.readParsed(field), nil)))
+		if err := parsed.Add(field, f); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.dir.Add("parsed", parsed); err != nil {
+		return nil, err
+	}
+
+	if err := t.RAMTree.Add(strconv.Itoa(id), c.dir); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (t *WebTree) openClone(user string, mode protocol.OpenMode) (fileserver.OpenFile, error) {
+	c, err := t.newConn()
+	if err != nil {
+		return nil, err
+	}
+	return c.opener(ramtree.CallbackOpener(c.readID, c.writeCtl))(user, mode)
+}
+
+func (t *WebTree) Create(user, name string, perms protocol.FileMode) (fileserver.File, error) {
+	return nil, fileserver.ErrPermission
+}
+
+func NewWebTree(user, group string) *WebTree {
+	t := &WebTree{
+		RAMTree: ramtree.NewRAMTree("/", 0555, user, group),
+		user:    user,
+		group:   group,
+		client:  &http.Client{},
+	}
+	t.RAMTree.Add("clone", ramtree.NewSyntheticFile("clone", 0666, user, group, t.openClone))
+	return t
+}
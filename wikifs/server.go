@@ -0,0 +1,76 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/kennylevinsen/g9p"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+	"github.com/kennylevinsen/g9ptools/ramfs/ramtree"
+	"github.com/kennylevinsen/g9ptools/transport"
+	"github.com/kennylevinsen/g9ptools/wikifs/wikitree"
+)
+
+// load adds the pages found in dir to the wiki.
+func load(t *wikitree.WikiTree, dir, user string) error {
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+wikitree.MDSuffix))
+	if err != nil {
+		return err
+	}
+	for _, p := range paths {
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		f, err := t.Create(user, filepath.Base(p), 0664)
+		if err != nil {
+			return err
+		}
+		f.(*ramtree.RAMFile).SetContent(b)
+	}
+	return nil
+}
+
+func main() {
+	pages := flag.String("pages", "", "directory of .md pages to load at start")
+	flag.Parse()
+
+	if flag.NArg() < 4 {
+		fmt.Printf("Too few arguments\n")
+		fmt.Printf("%s [-pages dir] service UID GID address\n", os.Args[0])
+		fmt.Printf("UID and GID are the user/group that owns / and may write pages\n")
+		fmt.Printf("address is a dial string, such as :5640, or stdio to serve a single session on standard input and output\n")
+		return
+	}
+
+	service := flag.Arg(0)
+	user := flag.Arg(1)
+	group := flag.Arg(2)
+	addr := flag.Arg(3)
+
+	root := wikitree.NewWikiTree(user, group)
+	if *pages != "" {
+		if err := load(root, *pages, user); err != nil {
+			log.Fatalf("Unable to load pages: %v", err)
+		}
+	}
+
+	l, err := transport.ListenDialString(addr)
+	if err != nil {
+		log.Fatalf("Unable to listen: %v", err)
+	}
+
+	h := func() g9p.Handler {
+		m := make(map[string]fileserver.Dir)
+		m[service] = root
+		return fileserver.NewFileServer(nil, m, 10*1024*1024, fileserver.Chatty)
+	}
+
+	log.Printf("Starting wikifs at %s", addr)
+	transport.Ready()
+	g9p.ServeListener(l, h)
+}
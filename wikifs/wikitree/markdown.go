@@ -0,0 +1,186 @@
+package wikitree
+
+import (
+	"html"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Render renders the common subset of markdown as HTML: headings, fenced
+// code blocks, block quotes, lists, rules and paragraphs, with code spans,
+// emphasis and links inline. Wiki links, written [[name]], link to the
+// rendered view of the page called name. Raw HTML is escaped, so that pages
+// cannot inject markup.
+func Render(md string) string {
+	var b strings.Builder
+	lines := strings.Split(strings.Replace(md, "\r\n", "\n", -1), "\n")
+	var para []string
+	var list string
+
+	flushPara := func() {
+		if len(para) > 0 {
+			b.WriteString("<p>" + inline(strings.Join(para, " ")) + "</p>\n")
+			para = nil
+		}
+	}
+	closeList := func() {
+		if list != "" {
+			b.WriteString("</" + list + ">\n")
+			list = ""
+		}
+	}
+	openList := func(tag string) {
+		if list != tag {
+			closeList()
+			b.WriteString("<" + tag + ">\n")
+			list = tag
+		}
+	}
+
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		trimmed := strings.TrimSpace(line)
+
+		switch {
+		case strings.HasPrefix(trimmed, "```"):
+			flushPara()
+			closeList()
+			b.WriteString("<pre><code>")
+			for i++; i < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[i]), "```"); i++ {
+				b.WriteString(html.EscapeString(lines[i]) + "\n")
+			}
+			b.WriteString("</code></pre>\n")
+
+		case trimmed == "":
+			flushPara()
+			closeList()
+
+		case heading(trimmed) > 0:
+			flushPara()
+			closeList()
+			n := heading(trimmed)
+			text := strings.TrimSpace(strings.TrimRight(trimmed[n:], "#"))
+			tag := string(rune('0' + n))
+			b.WriteString("<h" + tag + ">" + inline(text) + "</h" + tag + ">\n")
+
+		case isRule(trimmed):
+			flushPara()
+			closeList()
+			b.WriteString("<hr>\n")
+
+		case strings.HasPrefix(trimmed, ">"):
+			flushPara()
+			closeList()
+			var quote []string
+			for ; i < len(lines) && strings.HasPrefix(strings.TrimSpace(lines[i]), ">"); i++ {
+				q := strings.TrimPrefix(strings.TrimSpace(lines[i]), ">")
+				quote = append(quote, strings.TrimPrefix(q, " "))
+			}
+			i--
+			b.WriteString("<blockquote>\n" + Render(strings.Join(quote, "\n")) + "</blockquote>\n")
+
+		case bullet(trimmed) != "":
+			flushPara()
+			openList("ul")
+			b.WriteString("<li>" + inline(bullet(trimmed)) + "</li>\n")
+
+		case numbered(trimmed) != "":
+			flushPara()
+			openList("ol")
+			b.WriteString("<li>" + inline(numbered(trimmed)) + "</li>\n")
+
+		default:
+			closeList()
+			para = append(para, trimmed)
+		}
+	}
+	flushPara()
+	closeList()
+	return b.String()
+}
+
+// heading returns the level of an ATX heading, or 0.
+func heading(line string) int {
+	n := 0
+	for n < len(line) && n < 6 && line[n] == '#' {
+		n++
+	}
+	if n == 0 || (n < len(line) && line[n] != ' ') {
+		return 0
+	}
+	return n
+}
+
+// isRule reports whether a line is a horizontal rule.
+func isRule(line string) bool {
+	s := strings.Replace(line, " ", "", -1)
+	if len(s) < 3 {
+		return false
+	}
+	for _, c := range []string{"-", "*", "_"} {
+		if strings.Trim(s, c) == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// bullet returns the text of an unordered list item, or an empty string.
+func bullet(line string) string {
+	if len(line) > 2 && strings.ContainsRune("-*+", rune(line[0])) && line[1] == ' ' {
+		return strings.TrimSpace(line[2:])
+	}
+	return ""
+}
+
+// numbered returns the text of an ordered list item, or an empty string.
+func numbered(line string) string {
+	n := 0
+	for n < len(line) && line[n] >= '0' && line[n] <= '9' {
+		n++
+	}
+	if n == 0 || n+1 >= len(line) || line[n] != '.' || line[n+1] != ' ' {
+		return ""
+	}
+	return strings.TrimSpace(line[n+2:])
+}
+
+var (
+	codeSpan = regexp.MustCompile("`([^`]+)`")
+	wikiLink = regexp.MustCompile(`\[\[([^\]]+)\]\]`)
+	link     = regexp.MustCompile(`\[([^\]]+)\]\(([^)\s]+)\)`)
+	strong   = regexp.MustCompile(`\*\*([^*]+)\*\*|__([^_]+)__`)
+	em       = regexp.MustCompile(`\*([^*]+)\*|\b_([^_]+)_\b`)
+)
+
+// inline renders the inline markup of text. Code spans are set aside
+// first, so that nothing within them is interpreted.
+func inline(text string) string {
+	var codes []string
+	text = codeSpan.ReplaceAllStringFunc(text, func(s string) string {
+		codes = append(codes, "<code>"+html.EscapeString(s[1:len(s)-1])+"</code>")
+		return "\x00" + strconv.Itoa(len(codes)-1) + "\x00"
+	})
+
+	text = html.EscapeString(text)
+	text = wikiLink.ReplaceAllStringFunc(text, func(s string) string {
+		name := strings.TrimSpace(s[2 : len(s)-2])
+		return `<a href="` + name + HTMLSuffix + `">` + name + `</a>`
+	})
+	text = link.ReplaceAllStringFunc(text, func(s string) string {
+		m := link.FindStringSubmatch(s)
+		href := m[2]
+		if strings.HasPrefix(strings.ToLower(html.UnescapeString(href)), "javascript:") {
+			href = "#"
+		}
+		return `<a href="` + href + `">` + m[1] + `</a>`
+	})
+	text = strong.ReplaceAllString(text, "<strong>$1$2</strong>")
+	text = em.ReplaceAllString(text, "<em>$1$2</em>")
+
+	for i, code := range codes {
+		text = strings.Replace(text, "\x00"+strconv.Itoa(i)+"\x00", code, 1)
+	}
+	return text
+}
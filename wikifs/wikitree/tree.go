@@ -0,0 +1,196 @@
+// Package wikitree serves a wiki of markdown pages. Pages are created and
+// edited as name.md, and every page has a rendered sibling, name.html,
+// which is produced from the page whenever it is opened:
+//
+//	index.md	a page, as written
+//	index.html	the page rendered as HTML
+//
+// The rendered views are not stored, but derived from the pages as they are
+// walked to and listed, so they follow pages as they are written, renamed
+// and removed. The wiki is flat: only pages may be created, and they cannot
+// be created under the names of the rendered views.
+package wikitree
+
+import (
+	"errors"
+	"hash/fnv"
+	"html"
+	"sort"
+	"strings"
+
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+	"github.com/kennylevinsen/g9ptools/fileserver/templatefs"
+	"github.com/kennylevinsen/g9ptools/ramfs/ramtree"
+)
+
+const (
+	// MDSuffix is the suffix of pages.
+	MDSuffix = ".md"
+	// HTMLSuffix is the suffix of rendered views.
+	HTMLSuffix = ".html"
+)
+
+var errNotPage = errors.New("only pages ending in " + MDSuffix + " may be created")
+
+// WikiTree is the root of the wiki.
+type WikiTree struct {
+	*ramtree.RAMTree
+}
+
+func (t *WikiTree) Create(user, name string, perms protocol.FileMode) (fileserver.File, error) {
+	if perms&protocol.DMDIR != 0 || !strings.HasSuffix(name, MDSuffix) || name == MDSuffix {
+		return nil, errNotPage
+	}
+	return t.RAMTree.Create(user, name, perms)
+}
+
+func (t *WikiTree) CreateOpen(user, name string, perms protocol.FileMode, mode protocol.OpenMode) (fileserver.File, fileserver.OpenFile, error) {
+	if perms&protocol.DMDIR != 0 || !strings.HasSuffix(name, MDSuffix) || name == MDSuffix {
+		return nil, nil, errNotPage
+	}
+	return t.RAMTree.CreateOpen(user, name, perms, mode)
+}
+
+func (t *WikiTree) Rename(user, oldname, newname string) error {
+	if !strings.HasSuffix(newname, MDSuffix) || newname == MDSuffix {
+		return errNotPage
+	}
+	return t.RAMTree.Rename(user, oldname, newname)
+}
+
+func (t *WikiTree) Remove(user, name string) error {
+	if strings.HasSuffix(name, HTMLSuffix) {
+		if _, err := t.page(user, name); err == nil {
+			return errors.New("rendered views are removed with their page")
+		}
+	}
+	return t.RAMTree.Remove(user, name)
+}
+
+// page returns the page rendered by the view called name.
+func (t *WikiTree) page(user, name string) (*ramtree.RAMFile, error) {
+	if !strings.HasSuffix(name, HTMLSuffix) {
+		return nil, fileserver.ErrNotExist
+	}
+	f, err := t.RAMTree.Walk(user, strings.TrimSuffix(name, HTMLSuffix)+MDSuffix)
+	if err != nil {
+		return nil, err
+	}
+	p, ok := f.(*ramtree.RAMFile)
+	if !ok {
+		return nil, fileserver.ErrNotExist
+	}
+	return p, nil
+}
+
+func (t *WikiTree) Walk(user, name string) (fileserver.File, error) {
+	f, err := t.RAMTree.Walk(user, name)
+	if err != fileserver.ErrNotExist {
+		return f, err
+	}
+	p, err := t.page(user, name)
+	if err != nil {
+		return nil, err
+	}
+	return newView(name, p), nil
+}
+
+// Open lists the pages along with their rendered views.
+func (t *WikiTree) Open(user string, mode protocol.OpenMode) (fileserver.OpenFile, error) {
+	of, err := t.RAMTree.Open(user, mode)
+	if err != nil {
+		return nil, err
+	}
+	of.Close()
+
+	names := t.Names()
+	sort.Strings(names)
+	var stats []protocol.Stat
+	for _, name := range names {
+		f, err := t.RAMTree.Walk(user, name)
+		if err != nil {
+			continue
+		}
+		st, err := f.Stat()
+		if err != nil {
+			return nil, err
+		}
+		stats = append(stats, st)
+		if p, ok := f.(*ramtree.RAMFile); ok && strings.HasSuffix(name, MDSuffix) {
+			vst, err := newView(strings.TrimSuffix(name, MDSuffix)+HTMLSuffix, p).Stat()
+			if err != nil {
+				return nil, err
+			}
+			stats = append(stats, vst)
+		}
+	}
+	return templatefs.NewListing(stats), nil
+}
+
+// view is the rendered view of a page.
+type view struct {
+	templatefs.FileBase
+	page *ramtree.RAMFile
+}
+
+func newView(name string, page *ramtree.RAMFile) *view {
+	st, _ := page.Stat()
+	v := &view{page: page}
+	v.Init(name, st.Mode&0444, st.UID, st.GID)
+
+	// The qid is derived from that of the page, so that it stays the same
+	// across walks, with the top bit set, so that it does not collide with
+	// the qid paths of ramtree and templatefs.
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	v.SetID((st.Qid.Path ^ h.Sum64()) | 1<<63)
+	return v
+}
+
+// render returns the HTML document of the page.
+func (v *view) render() []byte {
+	name, _ := v.Name()
+	title := html.EscapeString(strings.TrimSuffix(name, HTMLSuffix))
+	return []byte("<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n<title>" + title +
+		"</title>\n</head>\n<body>\n" + Render(string(v.page.Content())) + "</body>\n</html>\n")
+}
+
+func (v *view) Stat() (protocol.Stat, error) {
+	st, err := v.FileBase.Stat()
+	if err != nil {
+		return st, err
+	}
+	pst, err := v.page.Stat()
+	if err != nil {
+		return st, err
+	}
+	st.Mtime = pst.Mtime
+	st.Atime = pst.Atime
+	st.MUID = pst.MUID
+	st.Qid.Version = pst.Qid.Version
+	st.Length = uint64(len(v.render()))
+	return st, nil
+}
+
+func (v *view) Qid() (protocol.Qid, error) {
+	st, err := v.Stat()
+	return st.Qid, err
+}
+
+func (v *view) WriteStat(protocol.Stat) error {
+	return errors.New("rendered views cannot be changed")
+}
+
+func (v *view) Open(user string, mode protocol.OpenMode) (fileserver.OpenFile, error) {
+	if err := v.CheckOpen(user, mode); err != nil {
+		return nil, err
+	}
+	return templatefs.NewReader(v.render()), nil
+}
+
+// NewWikiTree returns an empty wiki, owned by user and group, who may write
+// pages.
+func NewWikiTree(user, group string) *WikiTree {
+	return &WikiTree{RAMTree: ramtree.NewRAMTree("/", protocol.DMDIR|0775, user, group)}
+}
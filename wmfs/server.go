@@ -0,0 +1,94 @@
+// wmfs is a toy demonstrating package wmtree: a scratchpad of text windows.
+// Besides the files of every wmtree window, each window has a wc file
+// counting the lines, words and bytes of its data, and understands the ctl
+// commands "upper", which turns its data to upper case, and "clear". Data
+// must be UTF-8.
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"unicode/utf8"
+
+	"github.com/kennylevinsen/g9p"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+	"github.com/kennylevinsen/g9ptools/fileserver/ctl"
+	"github.com/kennylevinsen/g9ptools/ramfs/ramtree"
+	"github.com/kennylevinsen/g9ptools/transport"
+	"github.com/kennylevinsen/g9ptools/wmfs/wmtree"
+)
+
+var errNotUTF8 = errors.New("data is not UTF-8")
+
+func setup(user, group string) func(w *wmtree.Window) error {
+	return func(w *wmtree.Window) error {
+		w.Ctl().Register(ctl.Command{
+			Name: "upper",
+			Run: func(string, []string) error {
+				b := bytes.ToUpper(w.Data().Content())
+				w.Data().SetContent(b)
+				w.Event("data %d", len(b))
+				return nil
+			},
+		})
+		w.Ctl().Register(ctl.Command{
+			Name: "clear",
+			Run: func(string, []string) error {
+				w.Data().SetContent(nil)
+				w.Event("data 0")
+				return nil
+			},
+		})
+		return w.AddFile(ramtree.NewCallbackFile("wc", 0444, user, group, func(string) ([]byte, error) {
+			b := w.Data().Content()
+			return []byte(fmt.Sprintf("%d %d %d\n", bytes.Count(b, []byte("\n")), len(bytes.Fields(b)), len(b))), nil
+		}, nil))
+	}
+}
+
+func validate(w *wmtree.Window, user string, content []byte) ([]byte, error) {
+	if !utf8.Valid(content) {
+		return nil, errNotUTF8
+	}
+	return content, nil
+}
+
+func main() {
+	if len(os.Args) < 5 {
+		fmt.Printf("Too few arguments\n")
+		fmt.Printf("%s service UID GID address\n", os.Args[0])
+		fmt.Printf("UID and GID are the user/group that owns /\n")
+		fmt.Printf("address is a dial string, such as :5640, or stdio to serve a single session on standard input and output\n")
+		return
+	}
+
+	service := os.Args[1]
+	user := os.Args[2]
+	group := os.Args[3]
+	addr := os.Args[4]
+
+	root := wmtree.NewTree(user, group, wmtree.Config{
+		Setup:    setup(user, group),
+		Validate: validate,
+		Deleted: func(w *wmtree.Window) {
+			log.Printf("Window %d deleted", w.ID())
+		},
+	})
+	l, err := transport.ListenDialString(addr)
+	if err != nil {
+		log.Fatalf("Unable to listen: %v", err)
+	}
+
+	h := func() g9p.Handler {
+		m := make(map[string]fileserver.Dir)
+		m[service] = root
+		return fileserver.NewFileServer(nil, m, 10*1024*1024, fileserver.Chatty)
+	}
+
+	log.Printf("Starting wmfs at %s", addr)
+	transport.Ready()
+	g9p.ServeListener(l, h)
+}
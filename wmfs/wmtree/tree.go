@@ -0,0 +1,286 @@
+// Package wmtree is a skeleton for file systems in the style of acme and
+// wmii, where clients manage numbered entities, such as windows, through
+// files. The tree looks like:
+//
+//	clone		opening allocates a window, and acts as its ctl file
+//	index		"id label" of every window, one per line
+//	event		"new id" and "del id" as windows come and go
+//	n/ctl		reading returns "id label", writing runs commands
+//	n/data		the content of the window
+//	n/event		events of the window, one per read
+//
+// Reads of the event files block until an event happens. Every window
+// understands the ctl commands "label text" and "delete", and applications
+// add their own commands and files when windows are set up. A write of
+// data is reported as a "data n" event, with n being the new length.
+package wmtree
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+	"github.com/kennylevinsen/g9ptools/fileserver/ctl"
+	"github.com/kennylevinsen/g9ptools/ramfs/ramtree"
+)
+
+var ErrDeleted = errors.New("window deleted")
+
+// Config describes the application built on the tree. All of it is
+// optional.
+type Config struct {
+	// Setup is called for every new window before clients can reach it,
+	// and may add files and ctl commands to it. An error discards the
+	// window.
+	Setup func(w *Window) error
+	// Validate checks and transforms what clients write to data files, as
+	// for ramtree.ValidatedFile.
+	Validate func(w *Window, user string, content []byte) ([]byte, error)
+	// Deleted is called when a window has been deleted.
+	Deleted func(w *Window)
+}
+
+// Tree is the root of the file system.
+type Tree struct {
+	*ramtree.RAMTree
+	sync.Mutex
+	user    string
+	group   string
+	cfg     Config
+	next    int
+	windows map[int]*Window
+	events  *ramtree.Stream
+}
+
+// Window is the numbered directory of a window.
+type Window struct {
+	*ramtree.RAMTree
+	sync.Mutex
+	id      int
+	t       *Tree
+	label   string
+	deleted bool
+	ctl     *ctl.Parser
+	data    *ramtree.ValidatedFile
+	events  *ramtree.Stream
+}
+
+// ID returns the number of the window.
+func (w *Window) ID() int {
+	return w.id
+}
+
+// Label returns the label of the window, which is empty until set.
+func (w *Window) Label() string {
+	w.Lock()
+	defer w.Unlock()
+	return w.label
+}
+
+// SetLabel sets the label of the window, as the "label" ctl command does,
+// and sends a "label text" event.
+func (w *Window) SetLabel(label string) {
+	w.Lock()
+	w.label = label
+	w.Unlock()
+	w.Event("label %s", ctl.Quote(label))
+}
+
+// Ctl returns the parser of the ctl commands of the window, with which
+// applications register their own.
+func (w *Window) Ctl() *ctl.Parser {
+	return w.ctl
+}
+
+// Data returns the data file of the window.
+func (w *Window) Data() *ramtree.ValidatedFile {
+	return w.data
+}
+
+// Event sends an event to the readers of the event file of the window.
+func (w *Window) Event(format string, args ...interface{}) {
+	w.events.Send([]byte(fmt.Sprintf(format, args...) + "\n"))
+}
+
+// AddFile adds a file to the directory of the window.
+func (w *Window) AddFile(f fileserver.File) error {
+	name, err := f.Name()
+	if err != nil {
+		return err
+	}
+	return w.RAMTree.Add(name, f)
+}
+
+// Delete removes the window. Pending reads of its event file return the
+// events already sent, and then end of file.
+func (w *Window) Delete() error {
+	w.Lock()
+	if w.deleted {
+		w.Unlock()
+		return ErrDeleted
+	}
+	w.deleted = true
+	w.Unlock()
+
+	t := w.t
+	t.Lock()
+	delete(t.windows, w.id)
+	t.Unlock()
+	t.RAMTree.Delete(strconv.Itoa(w.id))
+
+	w.events.Close()
+	t.events.Send([]byte(fmt.Sprintf("del %d\n", w.id)))
+	if t.cfg.Deleted != nil {
+		t.cfg.Deleted(w)
+	}
+	return nil
+}
+
+func (w *Window) Create(user, name string, perms protocol.FileMode) (fileserver.File, error) {
+	return nil, fileserver.ErrPermission
+}
+
+// Remove is not permitted, as windows are deleted through ctl.
+func (w *Window) Remove(user, name string) error {
+	return fileserver.ErrPermission
+}
+
+func (w *Window) readCtl(string) ([]byte, error) {
+	return []byte(fmt.Sprintf("%d %s\n", w.id, ctl.Quote(w.Label()))), nil
+}
+
+func (w *Window) validate(user string, content []byte) ([]byte, error) {
+	if w.t.cfg.Validate == nil {
+		return content, nil
+	}
+	return w.t.cfg.Validate(w, user, content)
+}
+
+func (w *Window) written(user string, f *ramtree.RAMFile, off int64, n int) {
+	w.Event("data %d", n)
+}
+
+// NewWindow allocates a window, as opening clone does.
+func (t *Tree) NewWindow() (*Window, error) {
+	t.Lock()
+	t.next++
+	id := t.next
+	t.Unlock()
+
+	w := &Window{
+		RAMTree: ramtree.NewRAMTree(strconv.Itoa(id), 0555, t.user, t.group),
+		id:      id,
+		t:       t,
+		ctl:     ctl.NewParser(),
+		events:  ramtree.NewStream(),
+	}
+	w.ctl.Register(ctl.Command{
+		Name:    "label",
+		Usage:   "label text",
+		MinArgs: 1,
+		MaxArgs: 1,
+		Run: func(_ string, args []string) error {
+			w.SetLabel(args[0])
+			return nil
+		},
+	})
+	w.ctl.Register(ctl.Command{
+		Name: "delete",
+		Run: func(string, []string) error {
+			return w.Delete()
+		},
+	})
+
+	// The data file reports client writes through hooks, which files
+	// added to a tree do not inherit, so it gets its own.
+	w.data = ramtree.NewValidatedFile("data", 0666, t.user, t.group, w.validate)
+	w.data.SetHooks(&ramtree.Hooks{OnWrite: w.written})
+	files := []fileserver.File{
+		ramtree.NewCallbackFile("ctl", 0666, t.user, t.group, w.readCtl, w.ctl.Write),
+		w.data,
+		ramtree.NewStreamFile("event", 0444, t.user, t.group, w.events),
+	}
+	for _, f := range files {
+		if err := w.AddFile(f); err != nil {
+			return nil, err
+		}
+	}
+	if t.cfg.Setup != nil {
+		if err := t.cfg.Setup(w); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := t.RAMTree.Add(strconv.Itoa(id), w); err != nil {
+		return nil, err
+	}
+	t.Lock()
+	t.windows[id] = w
+	t.Unlock()
+	t.events.Send([]byte(fmt.Sprintf("new %d\n", id)))
+	return w, nil
+}
+
+// Window returns the window with the given number.
+func (t *Tree) Window(id int) (*Window, bool) {
+	t.Lock()
+	defer t.Unlock()
+	w, ok := t.windows[id]
+	return w, ok
+}
+
+// Windows returns all windows, in order.
+func (t *Tree) Windows() []*Window {
+	t.Lock()
+	defer t.Unlock()
+	ws := make([]*Window, 0, len(t.windows))
+	for _, w := range t.windows {
+		ws = append(ws, w)
+	}
+	sort.Slice(ws, func(i, j int) bool { return ws[i].id < ws[j].id })
+	return ws
+}
+
+func (t *Tree) openClone(user string, mode protocol.OpenMode) (fileserver.OpenFile, error) {
+	w, err := t.NewWindow()
+	if err != nil {
+		return nil, err
+	}
+	return ramtree.CallbackOpener(w.readCtl, w.ctl.Write)(user, mode)
+}
+
+func (t *Tree) readIndex(string) ([]byte, error) {
+	var b []byte
+	for _, w := range t.Windows() {
+		b = append(b, fmt.Sprintf("%d %s\n", w.id, ctl.Quote(w.Label()))...)
+	}
+	return b, nil
+}
+
+func (t *Tree) Create(user, name string, perms protocol.FileMode) (fileserver.File, error) {
+	return nil, fileserver.ErrPermission
+}
+
+// Remove is not permitted, as windows are deleted through ctl.
+func (t *Tree) Remove(user, name string) error {
+	return fileserver.ErrPermission
+}
+
+func NewTree(user, group string, cfg Config) *Tree {
+	t := &Tree{
+		RAMTree: ramtree.NewRAMTree("/", 0555, user, group),
+		user:    user,
+		group:   group,
+		cfg:     cfg,
+		windows: make(map[int]*Window),
+		events:  ramtree.NewStream(),
+	}
+	t.RAMTree.Add("clone", ramtree.NewSyntheticFile("clone", 0666, user, group, t.openClone))
+	t.RAMTree.Add("index", ramtree.NewCallbackFile("index", 0444, user, group, t.readIndex, nil))
+	t.RAMTree.Add("event", ramtree.NewStreamFile("event", 0444, user, group, t.events))
+	return t
+}